@@ -0,0 +1,241 @@
+package condomngr
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// accountingTxn is a payment (credit) or expense (debit) in an accounting export
+type accountingTxn struct {
+	// FITID is stable across exports so accounting packages can skip
+	// transactions they have already imported
+	FITID  string
+	Date   time.Time
+	Amount float64
+	Name   string
+	Memo   string
+}
+
+// accountingTransactions returns payments as positive and expenses as negative
+// amounts, oldest first
+func accountingTransactions(db *sql.DB, startDate, endDate string) ([]accountingTxn, error) {
+	paymentWhere := []string{}
+	expenseWhere := []string{}
+	paymentArgs := []interface{}{}
+	expenseArgs := []interface{}{}
+
+	if startDate != "" {
+		paymentWhere = append(paymentWhere, "p.payment_date >= ?")
+		expenseWhere = append(expenseWhere, "expense_date >= ?")
+		paymentArgs = append(paymentArgs, startDate)
+		expenseArgs = append(expenseArgs, startDate)
+	}
+	if endDate != "" {
+		paymentWhere = append(paymentWhere, "p.payment_date <= ?")
+		expenseWhere = append(expenseWhere, "expense_date <= ?")
+		paymentArgs = append(paymentArgs, endDate)
+		expenseArgs = append(expenseArgs, endDate)
+	}
+
+	paymentQuery := `
+		SELECT p.id, p.payment_date, p.amount, p.description, r.name, r.unit
+		FROM payments p
+		JOIN residents r ON p.resident_id = r.id
+	`
+	if len(paymentWhere) > 0 {
+		paymentQuery += " WHERE " + strings.Join(paymentWhere, " AND ")
+	}
+
+	rows, err := db.Query(paymentQuery, paymentArgs...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	txns := []accountingTxn{}
+	for rows.Next() {
+		var id int
+		var date time.Time
+		var amount float64
+		var description, name, unit string
+		if err := rows.Scan(&id, &date, &amount, &description, &name, &unit); err != nil {
+			return nil, err
+		}
+		txns = append(txns, accountingTxn{
+			FITID:  fmt.Sprintf("P%d", id),
+			Date:   date,
+			Amount: amount,
+			Name:   name,
+			Memo:   fmt.Sprintf("%s - %s (unit %s)", description, name, unit),
+		})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	expenseQuery := "SELECT id, expense_date, amount, description, category FROM expenses"
+	if len(expenseWhere) > 0 {
+		expenseQuery += " WHERE " + strings.Join(expenseWhere, " AND ")
+	}
+
+	rows, err = db.Query(expenseQuery, expenseArgs...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int
+		var date time.Time
+		var amount float64
+		var description, category string
+		if err := rows.Scan(&id, &date, &amount, &description, &category); err != nil {
+			return nil, err
+		}
+		txns = append(txns, accountingTxn{
+			FITID:  fmt.Sprintf("E%d", id),
+			Date:   date,
+			Amount: -amount,
+			Name:   description,
+			Memo:   fmt.Sprintf("%s - %s", description, category),
+		})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Order by date, keeping payments before expenses on the same day
+	sort.SliceStable(txns, func(i, j int) bool {
+		return txns[i].Date.Before(txns[j].Date)
+	})
+	return txns, nil
+}
+
+// formatAmount formats an amount with a dot decimal separator regardless of
+// the server locale
+func formatAmount(amount float64) string {
+	return strconv.FormatFloat(amount, 'f', 2, 64)
+}
+
+var ofxEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+func ofxText(s string, max int) string {
+	s = strings.Join(strings.Fields(s), " ")
+	if r := []rune(s); len(r) > max {
+		s = string(r[:max])
+	}
+	return ofxEscaper.Replace(s)
+}
+
+func writeOFX(w http.ResponseWriter, txns []accountingTxn, currency string, start, end, now time.Time) {
+	balance := 0.0
+	for _, t := range txns {
+		balance += t.Amount
+	}
+
+	var b strings.Builder
+	b.WriteString("OFXHEADER:100\nDATA:OFXSGML\nVERSION:102\nSECURITY:NONE\nENCODING:UNICODE\nCHARSET:NONE\nCOMPRESSION:NONE\nOLDFILEUID:NONE\nNEWFILEUID:NONE\n\n")
+	b.WriteString("<OFX>\n<SIGNONMSGSRSV1>\n<SONRS>\n<STATUS>\n<CODE>0\n<SEVERITY>INFO\n</STATUS>\n")
+	fmt.Fprintf(&b, "<DTSERVER>%s\n<LANGUAGE>ENG\n</SONRS>\n</SIGNONMSGSRSV1>\n", now.Format("20060102150405"))
+	b.WriteString("<BANKMSGSRSV1>\n<STMTTRNRS>\n<TRNUID>1\n<STATUS>\n<CODE>0\n<SEVERITY>INFO\n</STATUS>\n<STMTRS>\n")
+	fmt.Fprintf(&b, "<CURDEF>%s\n", currency)
+	b.WriteString("<BANKACCTFROM>\n<BANKID>CONDOMNGR\n<ACCTID>CONDO\n<ACCTTYPE>CHECKING\n</BANKACCTFROM>\n")
+	fmt.Fprintf(&b, "<BANKTRANLIST>\n<DTSTART>%s\n<DTEND>%s\n", start.Format("20060102"), end.Format("20060102"))
+	for _, t := range txns {
+		trnType := "CREDIT"
+		if t.Amount < 0 {
+			trnType = "DEBIT"
+		}
+		b.WriteString("<STMTTRN>\n")
+		fmt.Fprintf(&b, "<TRNTYPE>%s\n<DTPOSTED>%s\n<TRNAMT>%s\n<FITID>%s\n", trnType, t.Date.Format("20060102"), formatAmount(t.Amount), t.FITID)
+		fmt.Fprintf(&b, "<NAME>%s\n<MEMO>%s\n", ofxText(t.Name, 32), ofxText(t.Memo, 255))
+		b.WriteString("</STMTTRN>\n")
+	}
+	b.WriteString("</BANKTRANLIST>\n")
+	fmt.Fprintf(&b, "<LEDGERBAL>\n<BALAMT>%s\n<DTASOF>%s\n</LEDGERBAL>\n", formatAmount(balance), end.Format("20060102"))
+	b.WriteString("</STMTRS>\n</STMTTRNRS>\n</BANKMSGSRSV1>\n</OFX>\n")
+
+	w.Header().Set("Content-Type", "application/x-ofx")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=accounting_export_%s.ofx",
+		now.Format("2006-01-02")))
+	w.Write([]byte(b.String()))
+}
+
+func writeQIF(w http.ResponseWriter, txns []accountingTxn, now time.Time) {
+	var b strings.Builder
+	b.WriteString("!Type:Bank\n")
+	for _, t := range txns {
+		fmt.Fprintf(&b, "D%s\n", t.Date.Format("01/02/2006"))
+		fmt.Fprintf(&b, "T%s\n", formatAmount(t.Amount))
+		fmt.Fprintf(&b, "N%s\n", t.FITID)
+		fmt.Fprintf(&b, "P%s\n", strings.Join(strings.Fields(t.Name), " "))
+		fmt.Fprintf(&b, "M%s\n", strings.Join(strings.Fields(t.Memo), " "))
+		b.WriteString("^\n")
+	}
+
+	w.Header().Set("Content-Type", "application/qif")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=accounting_export_%s.qif",
+		now.Format("2006-01-02")))
+	w.Write([]byte(b.String()))
+}
+
+// Export payments and expenses for accounting packages in OFX or QIF format
+func exportAccountingReport(db *sql.DB, currency string, cal calendar) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		format := r.URL.Query().Get("format")
+		startDate := r.URL.Query().Get("start_date")
+		endDate := r.URL.Query().Get("end_date")
+
+		if format == "" {
+			format = "ofx"
+		}
+		if format != "ofx" && format != "qif" {
+			respondWithError(w, http.StatusBadRequest, "format must be ofx or qif")
+			return
+		}
+
+		var start, end time.Time
+		var err error
+		if startDate != "" {
+			if start, err = time.Parse("2006-01-02", startDate); err != nil {
+				respondWithError(w, http.StatusBadRequest, "invalid start date format, must be YYYY-MM-DD")
+				return
+			}
+		}
+		if endDate != "" {
+			if end, err = time.Parse("2006-01-02", endDate); err != nil {
+				respondWithError(w, http.StatusBadRequest, "invalid end date format, must be YYYY-MM-DD")
+				return
+			}
+		}
+
+		txns, err := accountingTransactions(db, startDate, endDate)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		now := cal.now()
+		if format == "qif" {
+			writeQIF(w, txns, now)
+			return
+		}
+
+		// Default the statement period to the transactions it contains
+		if start.IsZero() {
+			start = now
+			if len(txns) > 0 {
+				start = txns[0].Date
+			}
+		}
+		if end.IsZero() {
+			end = now
+		}
+		writeOFX(w, txns, currency, start, end, now)
+	}
+}
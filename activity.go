@@ -0,0 +1,174 @@
+package condomngr
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Activity actions
+const (
+	ActivityCreated = "created"
+	ActivityUpdated = "updated"
+)
+
+// ActivityEntry is a resident, payment or expense that was created or last
+// updated at Timestamp. Rows only keep their latest change, so an entry
+// stands for that change alone.
+type ActivityEntry struct {
+	Type      string    `json:"type"` // resident, payment or expense
+	ID        int       `json:"id"`
+	Action    string    `json:"action"` // created or updated
+	Summary   string    `json:"summary"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// sqliteTimestamp is the layout of CURRENT_TIMESTAMP, which is UTC
+const sqliteTimestamp = "2006-01-02 15:04:05"
+
+// activityQuery merges the changes of every entity, each normalized to the
+// CURRENT_TIMESTAMP layout so they sort and compare as text
+const activityQuery = `SELECT type, id, created_at, changed_at, summary FROM (
+	SELECT 'resident' AS type, id, strftime('%Y-%m-%d %H:%M:%S', created_at) AS created_at,
+		strftime('%Y-%m-%d %H:%M:%S', updated_at) AS changed_at, printf('%s, unit %s', name, unit) AS summary
+	FROM residents
+	UNION ALL
+	SELECT 'payment', p.id, strftime('%Y-%m-%d %H:%M:%S', p.created_at), strftime('%Y-%m-%d %H:%M:%S', p.updated_at),
+		printf('%.2f from %s on %s', p.amount, COALESCE(r.name, 'resident #' || p.resident_id), p.payment_date)
+	FROM payments p LEFT JOIN residents r ON p.resident_id = r.id
+	UNION ALL
+	SELECT 'expense', id, strftime('%Y-%m-%d %H:%M:%S', created_at), strftime('%Y-%m-%d %H:%M:%S', updated_at),
+		printf('%.2f for %s: %s', amount, category, description)
+	FROM expenses
+)`
+
+// activityCursor is the position after the last entry of a page
+type activityCursor struct {
+	changedAt string
+	kind      string
+	id        int
+}
+
+func (c activityCursor) String() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%s|%s|%d", c.changedAt, c.kind, c.id)))
+}
+
+func parseActivityCursor(s string) (activityCursor, error) {
+	var c activityCursor
+	invalid := fmt.Errorf("invalid cursor")
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, invalid
+	}
+	parts := strings.Split(string(raw), "|")
+	if len(parts) != 3 {
+		return c, invalid
+	}
+	if _, err := time.Parse(sqliteTimestamp, parts[0]); err != nil {
+		return c, invalid
+	}
+	if c.id, err = strconv.Atoi(parts[2]); err != nil {
+		return c, invalid
+	}
+	c.changedAt, c.kind = parts[0], parts[1]
+	return c, nil
+}
+
+// parseSince accepts a YYYY-MM-DD date, taken as the start of that day in
+// the condominium's timezone, or an RFC 3339 timestamp
+func parseSince(value string, location *time.Location) (time.Time, error) {
+	if t, err := time.ParseInLocation("2006-01-02", value, location); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return t, fmt.Errorf("invalid since, must be YYYY-MM-DD or an RFC 3339 timestamp")
+	}
+	return t, nil
+}
+
+// Get what was created or updated, newest first. The X-Next-Cursor header
+// holds the cursor of the next page, and is absent on the last one.
+func getActivity(db *sql.DB, cal calendar) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := checkQueryParams(r, "since", "limit", "cursor"); err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		var conditions []string
+		var args []interface{}
+		if value := r.URL.Query().Get("since"); value != "" {
+			since, err := parseSince(value, cal.location)
+			if err != nil {
+				respondWithError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			conditions = append(conditions, "changed_at >= ?")
+			args = append(args, since.UTC().Format(sqliteTimestamp))
+		}
+		if value := r.URL.Query().Get("cursor"); value != "" {
+			cursor, err := parseActivityCursor(value)
+			if err != nil {
+				respondWithError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			conditions = append(conditions, "(changed_at, type, id) < (?, ?, ?)")
+			args = append(args, cursor.changedAt, cursor.kind, cursor.id)
+		}
+		limit := 50
+		if value := r.URL.Query().Get("limit"); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 || n > 200 {
+				respondWithError(w, http.StatusBadRequest, "Invalid limit, must be between 1 and 200")
+				return
+			}
+			limit = n
+		}
+
+		query := activityQuery
+		if len(conditions) > 0 {
+			query += " WHERE " + strings.Join(conditions, " AND ")
+		}
+		// One more than a page tells whether there is a next one
+		query += " ORDER BY changed_at DESC, type DESC, id DESC LIMIT ?"
+		rows, err := db.Query(query, append(args, limit+1)...)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		defer rows.Close()
+
+		entries := []ActivityEntry{}
+		var last activityCursor
+		for rows.Next() {
+			if len(entries) == limit {
+				w.Header().Set("X-Next-Cursor", last.String())
+				break
+			}
+			var entry ActivityEntry
+			var createdAt, changedAt string
+			if err := rows.Scan(&entry.Type, &entry.ID, &createdAt, &changedAt, &entry.Summary); err != nil {
+				respondWithError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			entry.Action = ActivityUpdated
+			if changedAt == createdAt {
+				entry.Action = ActivityCreated
+			}
+			entry.Timestamp, _ = time.Parse(sqliteTimestamp, changedAt)
+			entries = append(entries, entry)
+			last = activityCursor{changedAt: changedAt, kind: entry.Type, id: entry.ID}
+		}
+		if err := rows.Err(); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		respondWithJSON(w, http.StatusOK, entries)
+	}
+}
@@ -0,0 +1,275 @@
+package condomngr
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// AgingBuckets splits outstanding amounts by how many days past due their
+// charges are on the as-of date. What residents on an active payment plan owe
+// isn't aged, as the plan reschedules it.
+type AgingBuckets struct {
+	Current    float64 `json:"current"` // not yet past due
+	Days1To30  float64 `json:"days_1_30"`
+	Days31To60 float64 `json:"days_31_60"`
+	Days61To90 float64 `json:"days_61_90"`
+	Over90     float64 `json:"days_over_90"`
+	OnPlan     float64 `json:"on_plan"`
+	Total      float64 `json:"total"`
+}
+
+// add puts amount in the bucket of a charge daysPastDue days past due
+func (b *AgingBuckets) add(amount float64, daysPastDue int) {
+	switch {
+	case daysPastDue <= 0:
+		b.Current = roundCents(b.Current + amount)
+	case daysPastDue <= 30:
+		b.Days1To30 = roundCents(b.Days1To30 + amount)
+	case daysPastDue <= 60:
+		b.Days31To60 = roundCents(b.Days31To60 + amount)
+	case daysPastDue <= 90:
+		b.Days61To90 = roundCents(b.Days61To90 + amount)
+	default:
+		b.Over90 = roundCents(b.Over90 + amount)
+	}
+	b.Total = roundCents(b.Total + amount)
+}
+
+func (b *AgingBuckets) addAll(o AgingBuckets) {
+	b.Current = roundCents(b.Current + o.Current)
+	b.Days1To30 = roundCents(b.Days1To30 + o.Days1To30)
+	b.Days31To60 = roundCents(b.Days31To60 + o.Days31To60)
+	b.Days61To90 = roundCents(b.Days61To90 + o.Days61To90)
+	b.Over90 = roundCents(b.Over90 + o.Over90)
+	b.OnPlan = roundCents(b.OnPlan + o.OnPlan)
+	b.Total = roundCents(b.Total + o.Total)
+}
+
+// ResidentAging is what a resident owes on the as-of date, by age, or the
+// status of their active payment plan
+type ResidentAging struct {
+	ResidentID  int          `json:"resident_id"`
+	Name        string       `json:"name"`
+	Unit        string       `json:"unit"`
+	Outstanding AgingBuckets `json:"outstanding"`
+	WrittenOff  float64      `json:"written_off"` // by the as-of date, not reversed
+	PaymentPlan *AgingPlan   `json:"payment_plan,omitempty"`
+}
+
+// AgingPlan is the status of a payment plan on the as-of date
+type AgingPlan struct {
+	ID        int     `json:"id"`
+	Status    string  `json:"status"`
+	Remaining float64 `json:"remaining"`
+	Overdue   float64 `json:"overdue"`
+}
+
+// AgingReport is the receivables of the building on a date
+type AgingReport struct {
+	AsOf       string          `json:"as_of"`
+	Residents  []ResidentAging `json:"residents"`
+	Totals     AgingBuckets    `json:"totals"`
+	WrittenOff float64         `json:"written_off"`
+}
+
+// agingReport works out what each resident owes as of a date (YYYY-MM-DD).
+// Payments, credits and write-offs up to the date settle the oldest charges
+// first, like for interest; what is left of each charge is aged from its due date. Charges
+// already raised but not yet due count as current. Residents on a payment plan
+// that is on track or behind owe it all on the plan instead.
+func agingReport(db *sql.DB, asOf string, includeZero bool) (AgingReport, error) {
+	report := AgingReport{AsOf: asOf, Residents: []ResidentAging{}}
+	end, err := time.Parse("2006-01-02", asOf)
+	if err != nil {
+		return report, err
+	}
+
+	charges := map[int][]Charge{}
+	rows, err := db.Query(`
+		SELECT resident_id, id, amount, substr(due_date, 1, 10) AS date FROM charges
+		WHERE due_date <= ?1 OR substr(created_at, 1, 10) <= ?1
+		UNION ALL
+		SELECT resident_id, 0, -amount, credit_date FROM credits
+		WHERE amount < 0 AND credit_date <= ?1
+		ORDER BY date, id
+	`, asOf)
+	if err != nil {
+		return report, err
+	}
+	for rows.Next() {
+		var c Charge
+		if err := rows.Scan(&c.ResidentID, &c.ID, &c.Amount, &c.DueDate); err != nil {
+			rows.Close()
+			return report, err
+		}
+		charges[c.ResidentID] = append(charges[c.ResidentID], c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return report, err
+	}
+
+	payments := map[int][]Payment{}
+	rows, err = db.Query(`
+		SELECT resident_id, amount, substr(payment_date, 1, 10) AS date FROM payments
+		WHERE status = ?2 AND substr(payment_date, 1, 10) <= ?1
+		UNION ALL
+		SELECT resident_id, amount, credit_date FROM credits
+		WHERE amount > 0 AND credit_date <= ?1
+		UNION ALL
+		SELECT resident_id, amount, writeoff_date FROM write_offs
+		WHERE reversed_at IS NULL AND writeoff_date <= ?1
+		ORDER BY date
+	`, asOf, PaymentStatusConfirmed)
+	if err != nil {
+		return report, err
+	}
+	for rows.Next() {
+		var p Payment
+		if err := rows.Scan(&p.ResidentID, &p.Amount, &p.PaymentDate); err != nil {
+			rows.Close()
+			return report, err
+		}
+		payments[p.ResidentID] = append(payments[p.ResidentID], p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return report, err
+	}
+
+	writtenOff := map[int]float64{}
+	rows, err = db.Query("SELECT resident_id, SUM(amount) FROM write_offs WHERE reversed_at IS NULL AND writeoff_date <= ? GROUP BY resident_id", asOf)
+	if err != nil {
+		return report, err
+	}
+	for rows.Next() {
+		var residentID int
+		var amount float64
+		if err := rows.Scan(&residentID, &amount); err != nil {
+			rows.Close()
+			return report, err
+		}
+		writtenOff[residentID] = roundCents(amount)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return report, err
+	}
+
+	plans := map[int]*AgingPlan{}
+	all, err := loadPaymentPlans(db, 0, asOf)
+	if err != nil {
+		return report, err
+	}
+	for _, p := range all {
+		if p.active() {
+			plans[p.ResidentID] = &AgingPlan{ID: p.ID, Status: p.Status, Remaining: p.Remaining, Overdue: p.Overdue}
+		}
+	}
+
+	rows, err = db.Query("SELECT id, name, unit FROM residents ORDER BY unit, name")
+	if err != nil {
+		return report, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var resident ResidentAging
+		if err := rows.Scan(&resident.ResidentID, &resident.Name, &resident.Unit); err != nil {
+			return report, err
+		}
+		resident.PaymentPlan = plans[resident.ResidentID]
+		resident.WrittenOff = writtenOff[resident.ResidentID]
+		own := charges[resident.ResidentID]
+		for i, parts := range allocateFIFO(own, payments[resident.ResidentID]) {
+			due, _ := time.Parse("2006-01-02", own[i].DueDate)
+			for _, part := range parts {
+				switch {
+				case part.date != "":
+				case resident.PaymentPlan != nil:
+					resident.Outstanding.OnPlan = roundCents(resident.Outstanding.OnPlan + part.amount)
+					resident.Outstanding.Total = roundCents(resident.Outstanding.Total + part.amount)
+				default:
+					resident.Outstanding.add(part.amount, int(end.Sub(due).Hours()/24))
+				}
+			}
+		}
+		if resident.Outstanding.Total == 0 && resident.WrittenOff == 0 && !includeZero {
+			continue
+		}
+		report.Residents = append(report.Residents, resident)
+		report.Totals.addAll(resident.Outstanding)
+		report.WrittenOff = roundCents(report.WrittenOff + resident.WrittenOff)
+	}
+	return report, rows.Err()
+}
+
+// Get the receivables aging report, as JSON or CSV
+func getAgingReport(db *sql.DB, cal calendar) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := checkQueryParams(r, "as_of", "include_zero", "format", "locale"); err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		format := r.URL.Query().Get("format")
+		if format != "" && format != "json" && format != "csv" {
+			respondWithError(w, http.StatusBadRequest, "Invalid format, must be json or csv")
+			return
+		}
+		locale, err := reportLocale(r)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		asOf := r.URL.Query().Get("as_of")
+		if asOf == "" {
+			asOf = cal.today()
+		}
+		if _, err := time.Parse("2006-01-02", asOf); err != nil {
+			respondWithError(w, http.StatusBadRequest, "invalid as_of format, must be YYYY-MM-DD")
+			return
+		}
+		includeZero := false
+		if value := r.URL.Query().Get("include_zero"); value != "" {
+			var err error
+			if includeZero, err = strconv.ParseBool(value); err != nil {
+				respondWithError(w, http.StatusBadRequest, "Invalid include_zero, must be true or false")
+				return
+			}
+		}
+
+		report, err := agingReport(db, asOf, includeZero)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		if format == "csv" {
+			custom, err := loadCustomColumns(db)
+			if err != nil {
+				respondWithError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			w.Header().Set("Content-Type", "text/csv")
+			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=aging_report_%s.csv", asOf))
+			locale.Start(w)
+			locale.Row(w, append([]string{"Resident", "Unit", "Current", "1-30", "31-60", "61-90", "90+", "On plan", "Total", "Plan status", "Written off"}, custom.Header()...)...)
+			row := func(name, unit string, b AgingBuckets, plan *AgingPlan, writtenOff float64, custom []string) {
+				status := ""
+				if plan != nil {
+					status = plan.Status
+				}
+				locale.Row(w, append([]string{name, unit, locale.Amount(b.Current), locale.Amount(b.Days1To30), locale.Amount(b.Days31To60),
+					locale.Amount(b.Days61To90), locale.Amount(b.Over90), locale.Amount(b.OnPlan), locale.Amount(b.Total), status, locale.Amount(writtenOff)}, custom...)...)
+			}
+			for _, resident := range report.Residents {
+				row(resident.Name, resident.Unit, resident.Outstanding, resident.PaymentPlan, resident.WrittenOff, custom.Row(locale, resident.ResidentID))
+			}
+			row("Total", "", report.Totals, nil, report.WrittenOff, nil)
+			return
+		}
+		respondWithJSON(w, http.StatusOK, report)
+	}
+}
@@ -0,0 +1,354 @@
+package condomngr
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// How payments are allocated to charges
+const (
+	AllocationFIFO   = "fifo"   // payments settle the oldest open charges first
+	AllocationManual = "manual" // payments are only allocated by hand
+)
+
+// paymentRules decide how payments count: how they settle charges and
+// whether cheques are paid before they clear. From Options.PaymentAllocation
+// and Options.CountUnclearedCheques.
+type paymentRules struct {
+	allocation            string
+	countUnclearedCheques bool
+}
+
+func validAllocation(mode string) bool {
+	return mode == AllocationFIFO || mode == AllocationManual
+}
+
+// Allocation is the part of a payment that settles a charge. Manual
+// allocations are set by hand and kept when payments are reallocated.
+type Allocation struct {
+	ChargeID    int     `json:"charge_id"`
+	Period      string  `json:"period"`
+	Description string  `json:"description"`
+	DueDate     string  `json:"due_date"`
+	Amount      float64 `json:"amount"`
+	Manual      bool    `json:"manual"`
+}
+
+// AllocationRequest replaces the manual allocations of a payment
+type AllocationRequest struct {
+	Allocations []struct {
+		ChargeID int     `json:"charge_id"`
+		Amount   float64 `json:"amount"`
+	} `json:"allocations"`
+}
+
+// querier is what *sql.DB and *sql.Tx have in common
+type querier interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// openAmount is what is left of a charge or payment after its allocations
+type openAmount struct {
+	id     int
+	amount float64
+}
+
+func queryOpenAmounts(q querier, query string, args ...interface{}) ([]openAmount, error) {
+	rows, err := q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var open []openAmount
+	for rows.Next() {
+		var o openAmount
+		if err := rows.Scan(&o.id, &o.amount); err != nil {
+			return nil, err
+		}
+		o.amount = roundCents(o.amount)
+		if o.amount >= 0.005 {
+			open = append(open, o)
+		}
+	}
+	return open, rows.Err()
+}
+
+// reallocate recomputes how a resident's confirmed payments settle their
+// charges. Manual allocations are kept unless their payment or charge is gone,
+// or the payment no longer covers them. In FIFO mode what is left of each
+// payment, oldest first, then settles the oldest charges still open.
+func reallocate(q querier, rules paymentRules, residentID int) error {
+	_, err := q.Exec(`
+		DELETE FROM payment_allocations WHERE resident_id = ?1 AND (
+			manual = 0
+			OR payment_id NOT IN (SELECT id FROM payments WHERE resident_id = ?1 AND status = ?2)
+			OR charge_id NOT IN (SELECT id FROM charges WHERE resident_id = ?1)
+			OR payment_id IN (
+				SELECT a.payment_id FROM payment_allocations a JOIN payments p ON p.id = a.payment_id
+				WHERE a.resident_id = ?1 AND a.manual = 1 GROUP BY a.payment_id HAVING SUM(a.amount) > MAX(p.amount) + 0.005
+			)
+		)
+	`, residentID, PaymentStatusConfirmed)
+	if err != nil {
+		return err
+	}
+	if rules.allocation == AllocationManual {
+		return nil
+	}
+
+	charges, err := queryOpenAmounts(q, `
+		SELECT id, amount - COALESCE((SELECT SUM(a.amount) FROM payment_allocations a WHERE a.charge_id = c.id), 0)
+		FROM charges c WHERE resident_id = ? ORDER BY due_date, id
+	`, residentID)
+	if err != nil {
+		return err
+	}
+	payments, err := queryOpenAmounts(q, `
+		SELECT id, amount - COALESCE((SELECT SUM(a.amount) FROM payment_allocations a WHERE a.payment_id = p.id), 0)
+		FROM payments p WHERE resident_id = ? AND status = ? ORDER BY payment_date, id
+	`, residentID, PaymentStatusConfirmed)
+	if err != nil {
+		return err
+	}
+
+	next := 0
+	for _, payment := range payments {
+		for payment.amount >= 0.005 && next < len(charges) {
+			settled := roundCents(min(payment.amount, charges[next].amount))
+			_, err := q.Exec("INSERT INTO payment_allocations(resident_id, payment_id, charge_id, amount) VALUES(?, ?, ?, ?)",
+				residentID, payment.id, charges[next].id, settled)
+			if err != nil {
+				return err
+			}
+			payment.amount = roundCents(payment.amount - settled)
+			charges[next].amount = roundCents(charges[next].amount - settled)
+			if charges[next].amount < 0.005 {
+				next++
+			}
+		}
+	}
+	return nil
+}
+
+// reallocateAll reallocates the payments of every resident and drops the
+// allocations of payments that are gone
+func reallocateAll(q querier, rules paymentRules) error {
+	if _, err := q.Exec("DELETE FROM payment_allocations WHERE payment_id NOT IN (SELECT id FROM payments WHERE status = ?)", PaymentStatusConfirmed); err != nil {
+		return err
+	}
+	rows, err := q.Query("SELECT id FROM residents ORDER BY id")
+	if err != nil {
+		return err
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if err := reallocate(q, rules, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rebuildAllocations reallocates every payment in one transaction, such as at
+// startup after the allocation mode changed
+func rebuildAllocations(db *sql.DB, rules paymentRules) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := reallocateAll(tx, rules); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// syncPayments brings the derived state of payments up to date when a database
+// is opened: cheque statuses, allocations and the reserve share
+func syncPayments(db *sql.DB, rules paymentRules) error {
+	if err := syncChequeStatuses(db, rules); err != nil {
+		return fmt.Errorf("failed to update cheque payments: %v", err)
+	}
+	if err := rebuildAllocations(db, rules); err != nil {
+		return fmt.Errorf("failed to allocate payments: %v", err)
+	}
+	if err := tagReserve(db); err != nil {
+		return fmt.Errorf("failed to set aside the reserve: %v", err)
+	}
+	return nil
+}
+
+// paymentAllocations returns the charges a payment settles, oldest first
+func paymentAllocations(q querier, paymentID int) ([]Allocation, error) {
+	rows, err := q.Query(`
+		SELECT a.charge_id, c.period, c.description, substr(c.due_date, 1, 10), a.amount, a.manual
+		FROM payment_allocations a
+		JOIN charges c ON c.id = a.charge_id
+		WHERE a.payment_id = ?
+		ORDER BY c.due_date, c.id
+	`, paymentID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	allocations := []Allocation{}
+	for rows.Next() {
+		var a Allocation
+		if err := rows.Scan(&a.ChargeID, &a.Period, &a.Description, &a.DueDate, &a.Amount, &a.Manual); err != nil {
+			return nil, err
+		}
+		allocations = append(allocations, a)
+	}
+	return allocations, rows.Err()
+}
+
+// withAllocations adds the allocations of a payment and what is left of it
+func withAllocations(q querier, payment *Payment) error {
+	allocations, err := paymentAllocations(q, payment.ID)
+	if err != nil {
+		return err
+	}
+	unallocated := payment.Amount
+	for _, a := range allocations {
+		unallocated -= a.Amount
+	}
+	unallocated = roundCents(unallocated)
+	payment.Allocations = allocations
+	payment.Unallocated = &unallocated
+	return nil
+}
+
+// Set the charges a payment settles by hand. The allocations replace the
+// payment's earlier manual ones; in FIFO mode the rest of the payment is then
+// allocated to the oldest charges still open.
+func setPaymentAllocations(db *sql.DB, rules paymentRules) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id, err := strconv.Atoi(vars["id"])
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid payment ID")
+			return
+		}
+
+		var req AllocationRequest
+		if err := decodeRequest(r, &req); err != nil {
+			respondWithError(w, payloadErrorStatus(err), "Invalid request payload: "+err.Error())
+			return
+		}
+		defer r.Body.Close()
+
+		tx, err := db.Begin()
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		defer tx.Rollback()
+
+		var payment Payment
+		err = tx.QueryRow(`
+			SELECT p.id, p.resident_id, r.name, p.amount, p.description, p.payment_date, p.method, p.status, p.reference, p.bank_reference, p.cheque_number, p.cheque_bank, p.cheque_status, p.cheque_status_date, p.created_at, p.updated_at
+			FROM payments p
+			JOIN residents r ON p.resident_id = r.id
+			WHERE p.id = ?
+		`, id).Scan(&payment.ID, &payment.ResidentID, &payment.ResidentName, &payment.Amount, &payment.Description, &payment.PaymentDate, &payment.Method, &payment.Status, &payment.Reference, &payment.BankReference, &payment.ChequeNumber, &payment.ChequeBank, &payment.ChequeStatus, &payment.ChequeStatusDate, &payment.CreatedAt, &payment.UpdatedAt)
+		if err == sql.ErrNoRows {
+			respondWithError(w, http.StatusNotFound, "Payment not found")
+			return
+		}
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		var errs ValidationErrors
+		if payment.Status != PaymentStatusConfirmed {
+			errs.Add("allocations", "only confirmed payments can be allocated")
+		}
+		var total float64
+		seen := map[int]bool{}
+		for i, a := range req.Allocations {
+			field := fmt.Sprintf("allocations[%d]", i)
+			total += a.Amount
+			if a.Amount <= 0 {
+				errs.Add(field+".amount", "amount must be positive")
+				continue
+			}
+			if seen[a.ChargeID] {
+				errs.Add(field+".charge_id", "charge is allocated more than once")
+				continue
+			}
+			seen[a.ChargeID] = true
+
+			// What other payments' manual allocations leave open of the charge
+			var amount, allocated float64
+			err := tx.QueryRow(`
+				SELECT c.amount, COALESCE((SELECT SUM(a.amount) FROM payment_allocations a WHERE a.charge_id = c.id AND a.manual = 1 AND a.payment_id != ?), 0)
+				FROM charges c WHERE c.id = ? AND c.resident_id = ?
+			`, id, a.ChargeID, payment.ResidentID).Scan(&amount, &allocated)
+			if err == sql.ErrNoRows {
+				errs.Add(field+".charge_id", "charge not found for the payment's resident")
+				continue
+			}
+			if err != nil {
+				respondWithError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			if open := roundCents(amount - allocated); a.Amount > open+0.005 {
+				errs.Add(field+".amount", fmt.Sprintf("only %.2f of the charge is open", open))
+			}
+		}
+		if roundCents(total) > payment.Amount+0.005 {
+			errs.Add("allocations", fmt.Sprintf("allocations total %.2f, more than the payment of %.2f", roundCents(total), payment.Amount))
+		}
+		if err := errs.Err(); err != nil {
+			respondWithValidationError(w, err)
+			return
+		}
+
+		// Other payments' automatic allocations are recomputed around these
+		if _, err := tx.Exec("DELETE FROM payment_allocations WHERE payment_id = ? AND manual = 1", id); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		for _, a := range req.Allocations {
+			_, err := tx.Exec("INSERT INTO payment_allocations(resident_id, payment_id, charge_id, amount, manual) VALUES(?, ?, ?, ?, 1)",
+				payment.ResidentID, id, a.ChargeID, roundCents(a.Amount))
+			if err != nil {
+				respondWithError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+		}
+		if err := reallocate(tx, rules, payment.ResidentID); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if err := withAllocations(tx, &payment); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		respondWithJSON(w, http.StatusOK, payment)
+	}
+}
@@ -0,0 +1,199 @@
+package condomngr
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestReallocate(t *testing.T) {
+	type charge struct {
+		amount float64
+		due    string
+	}
+	type payment struct {
+		amount float64
+		date   string
+		status string
+	}
+	// allocation is a part of a payment settling the charge at index charge
+	type allocation struct {
+		charge int
+		amount float64
+	}
+	fifo, manual := paymentRules{allocation: AllocationFIFO}, paymentRules{allocation: AllocationManual}
+
+	s := newTestServer(t, Options{})
+	for _, tt := range []struct {
+		name     string
+		rules    paymentRules
+		charges  []charge
+		payments []payment
+		want     [][]allocation // by payment
+	}{
+		{"settled exactly", fifo,
+			[]charge{{100, "2024-01-01"}, {100, "2024-02-01"}},
+			[]payment{{200, "2024-02-10", ""}},
+			[][]allocation{{{0, 100}, {1, 100}}}},
+		{"split across charges", fifo,
+			[]charge{{100, "2024-01-01"}, {100, "2024-02-01"}},
+			[]payment{{150, "2024-02-10", ""}},
+			[][]allocation{{{0, 100}, {1, 50}}}},
+		{"paid in part by two payments", fifo,
+			[]charge{{100, "2024-01-01"}},
+			[]payment{{40, "2024-01-05", ""}, {30, "2024-01-20", ""}},
+			[][]allocation{{{0, 40}}, {{0, 30}}}},
+		{"overpaid", fifo,
+			[]charge{{50, "2024-01-01"}},
+			[]payment{{80, "2024-01-05", ""}},
+			[][]allocation{{{0, 50}}}},
+		{"thirds rounded to cents", fifo,
+			[]charge{{33.33, "2024-01-01"}, {33.33, "2024-02-01"}, {33.34, "2024-03-01"}},
+			[]payment{{10.01, "2024-01-05", ""}, {89.99, "2024-03-05", ""}},
+			[][]allocation{{{0, 10.01}}, {{0, 23.32}, {1, 33.33}, {2, 33.34}}}},
+		{"cents that don't add up in binary", fifo,
+			[]charge{{0.3, "2024-01-01"}, {1, "2024-02-01"}},
+			[]payment{{0.1, "2024-01-05", ""}, {0.2, "2024-01-06", ""}, {0.5, "2024-02-05", ""}},
+			[][]allocation{{{0, 0.1}}, {{0, 0.2}}, {{1, 0.5}}}},
+		{"oldest due first, not first raised", fifo,
+			[]charge{{100, "2024-03-01"}, {100, "2024-01-01"}},
+			[]payment{{120, "2024-03-05", ""}},
+			[][]allocation{{{1, 100}, {0, 20}}}},
+		{"same due date on a leap day", fifo,
+			[]charge{{60, "2024-02-29"}, {60, "2024-02-29"}},
+			[]payment{{90, "2024-02-29", ""}},
+			[][]allocation{{{0, 60}, {1, 30}}}},
+		{"oldest payment first", fifo,
+			[]charge{{60, "2024-01-01"}},
+			[]payment{{50, "2024-03-01", ""}, {50, "2024-01-31", ""}},
+			[][]allocation{{{0, 10}}, {{0, 50}}}},
+		{"paid ahead across the year end", fifo,
+			[]charge{{100, "2024-12-31"}, {100, "2025-01-01"}},
+			[]payment{{150, "2024-12-01", ""}},
+			[][]allocation{{{0, 100}, {1, 50}}}},
+		{"pending payment", fifo,
+			[]charge{{100, "2024-01-01"}},
+			[]payment{{100, "2024-01-05", PaymentStatusPending}, {30, "2024-01-10", ""}},
+			[][]allocation{nil, {{0, 30}}}},
+		{"manual", manual,
+			[]charge{{100, "2024-01-01"}},
+			[]payment{{100, "2024-01-05", ""}},
+			[][]allocation{nil}},
+	} {
+		resident := s.createResident(tt.name, "1A")
+		charges := map[int]int{}
+		for i, c := range tt.charges {
+			result, err := s.db.Exec("INSERT INTO charges(resident_id, kind, period, amount, due_date) VALUES(?, ?, ?, ?, ?)",
+				resident.ID, ChargeKindDues, fmt.Sprint("P", i), c.amount, c.due)
+			if err != nil {
+				t.Fatal(err)
+			}
+			id, _ := result.LastInsertId()
+			charges[int(id)] = i
+		}
+		payments := map[int]int{}
+		for i, p := range tt.payments {
+			status := p.status
+			if status == "" {
+				status = PaymentStatusConfirmed
+			}
+			result, err := s.db.Exec("INSERT INTO payments(resident_id, amount, description, payment_date, status) VALUES(?, ?, 'Dues', ?, ?)",
+				resident.ID, p.amount, p.date, status)
+			if err != nil {
+				t.Fatal(err)
+			}
+			id, _ := result.LastInsertId()
+			payments[int(id)] = i
+		}
+
+		if err := reallocate(s.db, tt.rules, resident.ID); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		got := make([][]allocation, len(tt.payments))
+		rows, err := s.db.Query("SELECT payment_id, charge_id, amount FROM payment_allocations WHERE resident_id = ? ORDER BY id", resident.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for rows.Next() {
+			var paymentID, chargeID int
+			var amount float64
+			if err := rows.Scan(&paymentID, &chargeID, &amount); err != nil {
+				t.Fatal(err)
+			}
+			got[payments[paymentID]] = append(got[payments[paymentID]], allocation{charges[chargeID], amount})
+		}
+		rows.Close()
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: allocations %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestResidentBalanceBefore(t *testing.T) {
+	s := newTestServer(t, Options{})
+	resident := s.createResident("Ana Silva", "1A")
+	for _, statement := range []string{
+		"INSERT INTO charges(resident_id, kind, period, amount, due_date) VALUES(?1, 'dues', '2024-01', 100, '2024-01-31')",
+		"INSERT INTO payments(resident_id, amount, payment_date, status) VALUES(?1, 30, '2024-01-31', 'confirmed')",
+		"INSERT INTO payments(resident_id, amount, payment_date, status) VALUES(?1, 10, '2024-01-31', 'pending')",
+		"INSERT INTO credits(resident_id, amount, reason, credit_date) VALUES(?1, 0.1, 'Refund', '2024-02-01')",
+		"INSERT INTO credits(resident_id, amount, reason, credit_date) VALUES(?1, 0.2, 'Refund', '2024-02-01')",
+		"INSERT INTO credits(resident_id, amount, reason, credit_date) VALUES(?1, -5, 'Correction', '2024-02-15')",
+		"INSERT INTO write_offs(resident_id, amount, reason, decision, writeoff_date) VALUES(?1, 20, 'Unpaid', 'Minutes', '2024-02-29')",
+		"INSERT INTO write_offs(resident_id, amount, reason, decision, writeoff_date, reversed_at) VALUES(?1, 50, 'Unpaid', 'Minutes', '2024-02-01', '2024-02-10')",
+	} {
+		if _, err := s.db.Exec(statement, resident.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Each only counts the day after it
+	for _, tt := range []struct {
+		before                                       string
+		charged, paid, credited, writtenOff, balance float64
+	}{
+		{"2024-01-31", 0, 0, 0, 0, 0},
+		{"2024-02-01", 100, 30, 0, 0, 70},
+		{"2024-02-02", 100, 30, 0.3, 0, 69.7},
+		{"2024-02-15", 100, 30, 0.3, 0, 69.7},
+		{"2024-02-16", 100, 30, -4.7, 0, 74.7},
+		{"2024-02-29", 100, 30, -4.7, 0, 74.7},
+		{"2024-03-01", 100, 30, -4.7, 20, 54.7},
+		{"", 100, 30, -4.7, 20, 54.7},
+	} {
+		b, err := residentBalanceBefore(s.db, resident.ID, tt.before)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b.Charged != tt.charged || b.Paid != tt.paid || b.Credited != tt.credited || b.WrittenOff != tt.writtenOff || b.Balance != tt.balance {
+			t.Errorf("before %q: %+v, want charged %v, paid %v, credited %v, written off %v, balance %v",
+				tt.before, b, tt.charged, tt.paid, tt.credited, tt.writtenOff, tt.balance)
+		}
+	}
+}
+
+func TestWriteOffUpToTheDebt(t *testing.T) {
+	s := newTestServer(t, Options{})
+	s.token = s.signIn("admin", RoleAdmin)
+	resident := s.createResident("Ana Silva", "1A")
+	if _, err := s.db.Exec("INSERT INTO charges(resident_id, kind, period, amount, due_date) VALUES(?, 'dues', '2024-01', 100.01, '2024-01-31')", resident.ID); err != nil {
+		t.Fatal(err)
+	}
+	path := fmt.Sprintf("/api/v1/residents/%d/writeoff", resident.ID)
+	for _, tt := range []struct {
+		amount float64
+		status int
+	}{
+		{100.02, http.StatusUnprocessableEntity},
+		{60, http.StatusCreated},
+		{40.02, http.StatusUnprocessableEntity},
+		{40.01, http.StatusCreated},
+		{0.01, http.StatusUnprocessableEntity},
+	} {
+		s.expect(tt.status, "POST", path, map[string]interface{}{"amount": tt.amount, "reason": "Unpaid", "decision": "Minutes of 2024-03-12", "writeoff_date": "2024-03-12"}, nil)
+	}
+	if b, err := residentBalance(s.db, resident.ID); err != nil || b.Balance != 0 || b.WrittenOff != 100.01 {
+		t.Errorf("balance %+v, %v, want all of 100.01 written off", b, err)
+	}
+}
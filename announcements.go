@@ -0,0 +1,143 @@
+package condomngr
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Announcement is a notice for residents. Public announcements are also shown
+// in the resident portal.
+type Announcement struct {
+	ID        int       `json:"id"`
+	Title     string    `json:"title"`
+	Body      string    `json:"body"`
+	Public    bool      `json:"public"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Validation function for Announcement data
+func validateAnnouncement(a Announcement) error {
+	var errs ValidationErrors
+	if a.Title == "" {
+		errs.Add("title", "title is required")
+	}
+	return errs.Err()
+}
+
+// Handlers for announcement endpoints
+func getAnnouncements(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rows, err := db.Query("SELECT id, title, body, public, created_at FROM announcements ORDER BY created_at DESC, id DESC")
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		defer rows.Close()
+
+		announcements := []Announcement{}
+		for rows.Next() {
+			var a Announcement
+			if err := rows.Scan(&a.ID, &a.Title, &a.Body, &a.Public, &a.CreatedAt); err != nil {
+				respondWithError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			announcements = append(announcements, a)
+		}
+
+		respondWithJSON(w, http.StatusOK, announcements)
+	}
+}
+
+func createAnnouncement(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var a Announcement
+		if err := decodeRequest(r, &a); err != nil {
+			respondWithError(w, payloadErrorStatus(err), "Invalid request payload: "+err.Error())
+			return
+		}
+		defer r.Body.Close()
+
+		if err := validateAnnouncement(a); err != nil {
+			respondWithValidationError(w, err)
+			return
+		}
+
+		result, err := db.Exec("INSERT INTO announcements(title, body, public) VALUES(?, ?, ?)", a.Title, a.Body, a.Public)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		id, err := result.LastInsertId()
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		a.ID = int(id)
+		respondWithJSON(w, http.StatusCreated, a)
+	}
+}
+
+func updateAnnouncement(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id, err := strconv.Atoi(vars["id"])
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid announcement ID")
+			return
+		}
+
+		var a Announcement
+		if err := decodeRequest(r, &a); err != nil {
+			respondWithError(w, payloadErrorStatus(err), "Invalid request payload: "+err.Error())
+			return
+		}
+		defer r.Body.Close()
+
+		if err := validateAnnouncement(a); err != nil {
+			respondWithValidationError(w, err)
+			return
+		}
+
+		result, err := db.Exec("UPDATE announcements SET title = ?, body = ?, public = ? WHERE id = ?", a.Title, a.Body, a.Public, id)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			respondWithError(w, http.StatusNotFound, "Announcement not found")
+			return
+		}
+
+		a.ID = id
+		respondWithJSON(w, http.StatusOK, a)
+	}
+}
+
+func deleteAnnouncement(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id, err := strconv.Atoi(vars["id"])
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid announcement ID")
+			return
+		}
+
+		result, err := db.Exec("DELETE FROM announcements WHERE id = ?", id)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			respondWithError(w, http.StatusNotFound, "Announcement not found")
+			return
+		}
+
+		respondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
+	}
+}
@@ -0,0 +1,136 @@
+package condomngr
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// ResidentAnonymization is a request to erase a resident's personal data, as
+// when a former tenant exercises their right to erasure
+type ResidentAnonymization struct {
+	LegalBasis string `json:"legal_basis"` // why it was erased, e.g. GDPR art. 17 request of 2024-09-02
+	Force      bool   `json:"force"`       // anonymize even if the resident owes money
+}
+
+// anonymizeResident replaces a resident's name, contact and email with
+// placeholders and drops their custom field values, the copies of their
+// contact details in the logs of what was sent to them, and their portal
+// links, failing the SMS still queued for them. Their charges, payments,
+// credits and the like are kept for the books, under the placeholder name;
+// anonymized_at flags the resident. It returns sql.ErrNoRows if there is no
+// such resident.
+func anonymizeResident(tx *sql.Tx, id int) error {
+	result, err := tx.Exec(`
+		UPDATE residents SET name = ?, contact = '', email = '', anonymized_at = ?, updated_at = CURRENT_TIMESTAMP
+		WHERE id = ?
+	`, fmt.Sprintf("Anonymized resident %d", id), time.Now().UTC().Format(sqliteTimestamp), id)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	for _, query := range []string{
+		"DELETE FROM resident_custom_values WHERE resident_id = ?",
+		"UPDATE sms_messages SET status = 'failed', error = 'resident was anonymized' WHERE resident_id = ? AND status = 'queued'",
+		"UPDATE sms_messages SET phone = '', body = '' WHERE resident_id = ?",
+		"UPDATE receipt_emails SET email = '' WHERE resident_id = ?",
+		"UPDATE statement_sends SET email = '' WHERE resident_id = ?",
+		"UPDATE maintenance_requests SET sender = '' WHERE resident_id = ?",
+		"UPDATE portal_tokens SET revoked_at = CURRENT_TIMESTAMP WHERE resident_id = ? AND revoked_at IS NULL",
+	} {
+		if _, err := tx.Exec(query, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Anonymize a resident for good, with the legal basis recorded in the audit
+// log. A resident who owes money is only anonymized with force (admins only).
+func anonymizeResidentHandler(db *sql.DB, changes *ChangeBroker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := requireAdmin(db, w, r); !ok {
+			return
+		}
+		id, err := strconv.Atoi(mux.Vars(r)["id"])
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid resident ID")
+			return
+		}
+
+		var req ResidentAnonymization
+		if err := decodeRequest(r, &req); err != nil {
+			respondWithError(w, payloadErrorStatus(err), "Invalid request payload: "+err.Error())
+			return
+		}
+		defer r.Body.Close()
+		if req.LegalBasis == "" {
+			var errs ValidationErrors
+			errs.Add("legal_basis", "legal_basis is required")
+			respondWithValidationError(w, errs)
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		defer tx.Rollback()
+
+		var anonymizedAt sql.NullTime
+		err = tx.QueryRow("SELECT anonymized_at FROM residents WHERE id = ?", id).Scan(&anonymizedAt)
+		if err == sql.ErrNoRows {
+			respondWithError(w, http.StatusNotFound, "Resident not found")
+			return
+		}
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if anonymizedAt.Valid {
+			respondWithError(w, http.StatusConflict, "Resident is already anonymized")
+			return
+		}
+		balance, err := residentBalance(tx, id)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if balance.Balance > 0 && !req.Force {
+			respondWithError(w, http.StatusConflict, "Resident has an outstanding balance, set force to anonymize anyway")
+			return
+		}
+
+		if err := anonymizeResident(tx, id); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		detail := req.LegalBasis
+		if balance.Balance > 0 {
+			detail += fmt.Sprintf(" (forced, owing %.2f)", balance.Balance)
+		}
+		if err := recordAudit(tx, r, AuditResidentAnonymized, fmt.Sprintf("resident %d", id), detail); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		resident, err := scanResidentRow(tx.QueryRow("SELECT "+residentColumns+" FROM residents WHERE id = ?", id))
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		changes.Publish(Change{Type: "resident", ID: id, Action: ChangeUpdated})
+		respondWithJSON(w, http.StatusOK, resident)
+	}
+}
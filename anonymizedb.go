@@ -0,0 +1,330 @@
+package condomngr
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// faker makes up the values an anonymized copy of the database has instead
+// of real ones. The same seed makes up the same values for the same data.
+type faker struct {
+	rand *rand.Rand
+}
+
+func newFaker(seed int64) *faker {
+	return &faker{rand: rand.New(rand.NewPCG(uint64(seed), uint64(seed)))}
+}
+
+var (
+	fakeFirstNames = []string{"Ana", "Bruno", "Carla", "Diogo", "Elena", "Filipe", "Grace", "Hugo", "Irene", "Joao",
+		"Laura", "Miguel", "Nadia", "Oscar", "Paula", "Rui", "Sofia", "Tiago", "Vera", "Xavier"}
+	fakeLastNames = []string{"Almeida", "Baker", "Costa", "Duarte", "Evans", "Ferreira", "Gomes", "Harris", "Lopes", "Martins",
+		"Nunes", "Oliveira", "Pereira", "Ramos", "Santos", "Silva", "Sousa", "Taylor", "Vieira", "Walker"}
+	fakeWords = strings.Fields(`lorem ipsum dolor sit amet consectetur adipiscing elit sed do eiusmod tempor incididunt ut
+		labore et dolore magna aliqua enim ad minim veniam quis nostrud exercitation ullamco laboris nisi aliquip ex ea
+		commodo consequat duis aute irure in reprehenderit voluptate velit esse cillum fugiat nulla pariatur`)
+)
+
+func (f *faker) pick(words []string) string {
+	return words[f.rand.IntN(len(words))]
+}
+
+// name makes up a person's name
+func (f *faker) name(string) string {
+	return f.pick(fakeFirstNames) + " " + f.pick(fakeLastNames)
+}
+
+// email makes up an address at example.com
+func (f *faker) email(string) string {
+	return fmt.Sprintf("%s.%s%d@example.com", strings.ToLower(f.pick(fakeFirstNames)), strings.ToLower(f.pick(fakeLastNames)), f.rand.IntN(100))
+}
+
+// emails makes up as many addresses as the comma-separated list has
+func (f *faker) emails(list string) string {
+	addresses := strings.Split(list, ",")
+	for i := range addresses {
+		addresses[i] = f.email("")
+	}
+	return strings.Join(addresses, ",")
+}
+
+// digits replaces every digit of a phone number or the like, keeping its
+// form
+func (f *faker) digits(value string) string {
+	b := []byte(value)
+	for i, c := range b {
+		if c >= '0' && c <= '9' {
+			b[i] = byte('0' + f.rand.IntN(10))
+		}
+	}
+	return string(b)
+}
+
+// iban makes up an IBAN of the same country and length, with valid check
+// digits, or replaces the digits of one that isn't valid
+func (f *faker) iban(value string) string {
+	if !validIBAN(value) {
+		return f.digits(value)
+	}
+	bban := f.digits(value[4:])
+	return fmt.Sprintf("%s%02d%s", value[:2], 98-mod97(bban+value[:2]+"00"), bban)
+}
+
+// text makes up text of as many words
+func (f *faker) text(value string) string {
+	words := strings.Fields(value)
+	if len(words) == 0 {
+		return value
+	}
+	for i := range words {
+		words[i] = f.pick(fakeWords)
+	}
+	words[0] = strings.ToUpper(words[0][:1]) + words[0][1:]
+	return strings.Join(words, " ")
+}
+
+// filename makes up a file name with the same extension
+func (f *faker) filename(value string) string {
+	return fmt.Sprintf("file-%04d%s", f.rand.IntN(10000), filepath.Ext(value))
+}
+
+// snapshot makes up the personal and free-text values of a record in the
+// trash, and drops its custom values
+func (f *faker) snapshot(value string) string {
+	var record map[string]interface{}
+	if err := json.Unmarshal([]byte(value), &record); err != nil {
+		return value
+	}
+	fakes := map[string]func(string) string{
+		"name": f.name, "residentName": f.name, "contact": f.digits, "email": f.email,
+		"description": f.text, "reason": f.text,
+	}
+	for _, key := range []string{"name", "residentName", "contact", "email", "description", "reason"} {
+		if s, ok := record[key].(string); ok && s != "" {
+			record[key] = fakes[key](s)
+		}
+	}
+	if _, ok := record["custom"]; ok {
+		record["custom"] = map[string]interface{}{}
+	}
+	b, err := json.Marshal(record)
+	if err != nil {
+		return value
+	}
+	return string(b)
+}
+
+// anonymizedColumn is a column whose values an anonymized copy makes up,
+// in the rows matching where, if any
+type anonymizedColumn struct {
+	table, column, where string
+	fake                 func(f *faker, value string) string
+}
+
+// anonymizedColumns are the columns with personal data or free text. Rows are
+// taken in order, so a seed makes up the same values every time.
+var anonymizedColumns = []anonymizedColumn{
+	{"residents", "name", "", (*faker).name},
+	{"residents", "contact", "", (*faker).digits},
+	{"residents", "email", "", (*faker).email},
+	{"resident_custom_values", "value", "field_id IN (SELECT id FROM custom_field_definitions WHERE type = 'text')", (*faker).text},
+	{"payments", "description", "", (*faker).text},
+	{"expenses", "description", "", (*faker).text},
+	{"credits", "reason", "", (*faker).text},
+	{"write_offs", "reason", "", (*faker).text},
+	{"write_offs", "decision", "", (*faker).text},
+	{"announcements", "title", "", (*faker).text},
+	{"announcements", "body", "", (*faker).text},
+	{"incidents", "location", "", (*faker).text},
+	{"incidents", "description", "", (*faker).text},
+	{"tasks", "title", "", (*faker).text},
+	{"tasks", "description", "", (*faker).text},
+	{"tasks", "assignee", "", (*faker).name},
+	{"maintenance_requests", "sender", "", (*faker).email},
+	{"maintenance_requests", "subject", "", (*faker).text},
+	{"maintenance_requests", "description", "", (*faker).text},
+	{"documents", "name", "", (*faker).text},
+	{"documents", "notes", "", (*faker).text},
+	{"unit_transfers", "notes", "", (*faker).text},
+	{"bank_accounts", "iban", "", (*faker).iban},
+	{"bank_lines", "description", "", (*faker).text},
+	{"bank_lines", "note", "", (*faker).text},
+	{"sms_messages", "phone", "", (*faker).digits},
+	{"sms_messages", "body", "", (*faker).text},
+	{"receipt_emails", "email", "", (*faker).email},
+	{"statement_sends", "email", "", (*faker).email},
+	{"report_schedules", "recipients", "", (*faker).emails},
+	{"report_runs", "sent_to", "", (*faker).emails},
+	{"users", "email", "", (*faker).email},
+	{"audit_log", "detail", "", (*faker).text},
+	{"attachments", "filename", "", (*faker).filename},
+	{"deleted_records", "snapshot", "", (*faker).snapshot},
+	{"settings", "value", "key = '" + settingPaymentPayee + "'", (*faker).text},
+	{"settings", "value", "key = '" + settingPaymentIBAN + "'", (*faker).iban},
+}
+
+// anonymizedCredentials are run on an anonymized copy before its columns
+// are made up: users are renamed user<id> everywhere their name is kept and
+// can't sign in until their password is reset, and sessions, tokens and
+// secrets are dropped
+var anonymizedCredentials = []string{
+	"UPDATE audit_log SET actor = COALESCE((SELECT 'user' || u.id FROM users u WHERE u.username = audit_log.actor), ''), ip = '' WHERE actor != '' OR ip != ''",
+	"UPDATE deleted_records SET deleted_by = COALESCE((SELECT 'user' || u.id FROM users u WHERE u.username = deleted_records.deleted_by), '') WHERE deleted_by != ''",
+	"UPDATE users SET username = 'user' || id, password_hash = '', must_change_password = 1, totp_secret = '', totp_enabled = 0, totp_last_step = 0",
+	"DELETE FROM sessions",
+	"DELETE FROM login_challenges",
+	"DELETE FROM login_failures",
+	"DELETE FROM password_resets",
+	"DELETE FROM recovery_codes",
+	"DELETE FROM portal_tokens",
+	"DELETE FROM settings WHERE key IN ('portal_secret', 'unsubscribe_secret')",
+}
+
+// AnonymizedCopy is what an anonymized copy of the database changed, and
+// whether it passes the consistency check
+type AnonymizedCopy struct {
+	Seed        int64             `json:"seed"`
+	Changed     map[string]int    `json:"changed"` // values made up, by table.column
+	Consistency ConsistencyReport `json:"consistency"`
+}
+
+// anonymizeDatabase writes a copy of db to output, which must not exist,
+// with every name, email, phone number and free text made up from seed.
+// Row counts, amounts, dates and ids stay as they were, so the copy can be
+// restored like a backup. The copy is vacuumed so nothing of the real values
+// is left in its free pages.
+func anonymizeDatabase(db *sql.DB, output string, seed int64) (AnonymizedCopy, error) {
+	result := AnonymizedCopy{Seed: seed, Changed: map[string]int{}}
+	if _, err := db.Exec("VACUUM INTO ?", output); err != nil {
+		return result, err
+	}
+	if err := checkBackupEncrypted(output); err != nil {
+		return result, err
+	}
+	anon, err := openSQLite(output, dbKey)
+	if err != nil {
+		return result, err
+	}
+	defer anon.Close()
+
+	tx, err := anon.Begin()
+	if err != nil {
+		return result, err
+	}
+	defer tx.Rollback()
+	for _, query := range anonymizedCredentials {
+		if _, err := tx.Exec(query); err != nil {
+			return result, err
+		}
+	}
+	f := newFaker(seed)
+	for _, c := range anonymizedColumns {
+		n, err := anonymizeColumn(tx, f, c)
+		if err != nil {
+			return result, fmt.Errorf("%s.%s: %v", c.table, c.column, err)
+		}
+		if n > 0 {
+			result.Changed[c.table+"."+c.column] += n
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return result, err
+	}
+
+	if _, err := anon.Exec("VACUUM"); err != nil {
+		return result, err
+	}
+	result.Consistency, err = checkConsistency(anon)
+	return result, err
+}
+
+// anonymizeColumn makes up the values of a column that aren't empty, and
+// returns how many
+func anonymizeColumn(tx *sql.Tx, f *faker, c anonymizedColumn) (int, error) {
+	where := c.column + " != ''"
+	if c.where != "" {
+		where += " AND " + c.where
+	}
+	rows, err := tx.Query("SELECT rowid, " + c.column + " FROM " + c.table + " WHERE " + where + " ORDER BY rowid")
+	if err != nil {
+		return 0, err
+	}
+	type value struct {
+		rowid int64
+		value string
+	}
+	var values []value
+	for rows.Next() {
+		var v value
+		if err := rows.Scan(&v.rowid, &v.value); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		values = append(values, v)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, v := range values {
+		if _, err := tx.Exec("UPDATE "+c.table+" SET "+c.column+" = ? WHERE rowid = ?", c.fake(f, v.value), v.rowid); err != nil {
+			return 0, err
+		}
+	}
+	return len(values), nil
+}
+
+// Download an anonymized copy of the database, to share as test data. The
+// optional seed makes the same copy of the same data (admins only).
+func downloadAnonymizedDatabase(db *sql.DB, cal calendar) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := requireAdmin(db, w, r); !ok {
+			return
+		}
+		var req struct {
+			Seed *int64 `json:"seed"`
+		}
+		if err := decodeRequest(r, &req); err != nil {
+			respondWithError(w, payloadErrorStatus(err), "Invalid request payload: "+err.Error())
+			return
+		}
+		defer r.Body.Close()
+		seed := rand.Int64()
+		if req.Seed != nil {
+			seed = *req.Seed
+		}
+
+		dir, err := os.MkdirTemp("", "condomngr-anonymize-")
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		defer os.RemoveAll(dir)
+		file := filepath.Join(dir, "anonymized.db")
+		result, err := anonymizeDatabase(db, file, seed)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Anonymizing failed: %v", err))
+			return
+		}
+		f, err := os.Open(file)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		defer f.Close()
+
+		w.Header().Set("Content-Type", "application/vnd.sqlite3")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=condo-anonymized-%s.db", cal.today()))
+		w.Header().Set("X-Anonymize-Seed", fmt.Sprint(result.Seed))
+		w.Header().Set("X-Consistency-Problems", fmt.Sprint(result.Consistency.Rows))
+		http.ServeContent(w, r, "", time.Time{}, f)
+	}
+}
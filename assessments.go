@@ -0,0 +1,666 @@
+package condomngr
+
+import (
+	"database/sql"
+	"fmt"
+	"maps"
+	"math"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// How an assessment is split between the units
+const (
+	AssessmentEqual    = "equal"    // the same for every unit
+	AssessmentFraction = "fraction" // in proportion to the units' permilage
+	AssessmentCustom   = "custom"   // the amount given for each unit
+)
+
+var assessmentAllocations = []string{AssessmentEqual, AssessmentFraction, AssessmentCustom}
+
+// maxAssessmentInstallments bounds how many months an assessment is spread over
+const maxAssessmentInstallments = 120
+
+// Assessment is a one-off levy, such as for repairing the roof, split between
+// the units and charged to the residents living in them on the first due
+// date, alongside their dues. With several installments the share of each
+// unit is due in as many months, from the due date on.
+type Assessment struct {
+	ID           int                `json:"id"`
+	Name         string             `json:"name"`
+	TotalAmount  float64            `json:"total_amount"`
+	Allocation   string             `json:"allocation"`   // equal, fraction or custom
+	Shares       map[string]float64 `json:"shares"`       // the amount of each unit; given only with custom allocation
+	DueDate      string             `json:"due_date"`     // of the first installment, YYYY-MM-DD
+	Installments int                `json:"installments"` // monthly, 1 by default
+	Charged      float64            `json:"charged"`
+	CreatedAt    time.Time          `json:"created_at"`
+	UpdatedAt    time.Time          `json:"updated_at"`
+}
+
+// AssessmentProgress is how much of an assessment was collected
+type AssessmentProgress struct {
+	AssessmentID     int                          `json:"assessment_id"`
+	Name             string                       `json:"name"`
+	TotalAmount      float64                      `json:"total_amount"`
+	Charged          float64                      `json:"charged"`
+	Paid             float64                      `json:"paid"`
+	Outstanding      float64                      `json:"outstanding"`
+	Overdue          float64                      `json:"overdue"` // unpaid part of the installments past due
+	CollectedPercent float64                      `json:"collected_percent"`
+	Residents        []AssessmentResidentProgress `json:"residents"`
+}
+
+// AssessmentResidentProgress is how much of their share of an assessment a
+// resident paid
+type AssessmentResidentProgress struct {
+	ResidentID  int     `json:"resident_id"`
+	Name        string  `json:"name"`
+	Unit        string  `json:"unit"`
+	Charged     float64 `json:"charged"`
+	Paid        float64 `json:"paid"`
+	Outstanding float64 `json:"outstanding"`
+	Overdue     float64 `json:"overdue"`
+}
+
+// assessmentConflict is returned when an assessment can't change because some
+// of its charges are paid
+type assessmentConflict string
+
+func (e assessmentConflict) Error() string { return string(e) }
+
+const assessmentColumns = "id, name, total_amount, allocation, due_date, installments, created_at, updated_at"
+
+func scanAssessment(row interface{ Scan(...interface{}) error }) (Assessment, error) {
+	var a Assessment
+	err := row.Scan(&a.ID, &a.Name, &a.TotalAmount, &a.Allocation, &a.DueDate, &a.Installments, &a.CreatedAt, &a.UpdatedAt)
+	return a, err
+}
+
+// Validation function for Assessment data
+func validateAssessment(a Assessment) error {
+	var errs ValidationErrors
+	if a.Name == "" {
+		errs.Add("name", "name is required")
+	}
+	if a.TotalAmount <= 0 {
+		errs.Add("total_amount", "total_amount must be greater than zero")
+	}
+	if !slices.Contains(assessmentAllocations, a.Allocation) {
+		errs.Add("allocation", "allocation must be equal, fraction or custom")
+	}
+	if _, err := time.Parse("2006-01-02", a.DueDate); err != nil {
+		errs.Add("due_date", "invalid date format, must be YYYY-MM-DD")
+	}
+	if a.Installments < 1 || a.Installments > maxAssessmentInstallments {
+		errs.Add("installments", "installments must be between 1 and 120")
+	}
+	switch {
+	case a.Allocation == AssessmentCustom:
+		var sum float64
+		for _, amount := range a.Shares {
+			if amount < 0 {
+				errs.Add("shares", "shares must not be negative")
+				break
+			}
+			sum += amount
+		}
+		if math.Abs(sum-a.TotalAmount) >= 0.005 {
+			errs.Add("shares", "shares must add up to total_amount")
+		}
+	case len(a.Shares) > 0:
+		errs.Add("shares", "shares are only given with custom allocation")
+	}
+	return errs.Err()
+}
+
+// installmentDate is the due date of an installment months after the first
+// one, on the same day of the month or the last day of shorter months
+func installmentDate(first time.Time, months int) string {
+	last := time.Date(first.Year(), first.Month()+time.Month(months)+1, 0, 0, 0, 0, 0, time.UTC)
+	return time.Date(last.Year(), last.Month(), min(first.Day(), last.Day()), 0, 0, 0, 0, time.UTC).Format("2006-01-02")
+}
+
+// assessmentResidents returns the resident charged for each unit: the one
+// living there on date, the first added when there are several
+func assessmentResidents(q querier, date string) (map[string]int, error) {
+	rows, err := q.Query(`
+		SELECT id, unit FROM residents
+		WHERE unit != '' AND (move_in_date = '' OR move_in_date <= ?1) AND (move_out_date = '' OR move_out_date > ?1)
+		ORDER BY id
+	`, date)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	residents := map[string]int{}
+	for rows.Next() {
+		var id int
+		var unit string
+		if err := rows.Scan(&id, &unit); err != nil {
+			return nil, err
+		}
+		if _, ok := residents[unit]; !ok {
+			residents[unit] = id
+		}
+	}
+	return residents, rows.Err()
+}
+
+// assessmentShares splits an assessment between the units with a resident
+func assessmentShares(q querier, a Assessment, units []string) (map[string]float64, error) {
+	shares := map[string]float64{}
+	if a.Allocation == AssessmentCustom {
+		var errs ValidationErrors
+		for unit, amount := range a.Shares {
+			if !slices.Contains(units, unit) {
+				errs.Add("shares", "shares must be for units with a resident on the due date")
+				return nil, errs
+			}
+			shares[unit] = roundCents(amount)
+		}
+		return shares, nil
+	}
+
+	if len(units) == 0 {
+		var errs ValidationErrors
+		errs.Add("due_date", "no resident lives in a unit on the due date")
+		return nil, errs
+	}
+	weights := make([]float64, len(units))
+	for i := range weights {
+		weights[i] = 1
+	}
+	if a.Allocation == AssessmentFraction {
+		fractions, err := loadUnitFractions(q)
+		if err != nil {
+			return nil, err
+		}
+		var sum float64
+		for i, unit := range units {
+			weights[i] = fractions[unit]
+			sum += weights[i]
+		}
+		if sum == 0 {
+			var errs ValidationErrors
+			errs.Add("allocation", "no unit with a resident has an ownership fraction")
+			return nil, errs
+		}
+	}
+	for i, amount := range splitAmount(a.TotalAmount, weights) {
+		shares[units[i]] = amount
+	}
+	return shares, nil
+}
+
+// chargeAssessment replaces the shares and charges of an assessment: the share
+// of each unit, split into its installments, charged to the resident living
+// there. Payments are then reallocated for the residents charged before and
+// now.
+func chargeAssessment(tx *sql.Tx, a *Assessment, rules paymentRules) error {
+	residents, err := assessmentResidents(tx, a.DueDate)
+	if err != nil {
+		return err
+	}
+	units := make([]string, 0, len(residents))
+	for unit := range residents {
+		units = append(units, unit)
+	}
+	sort.Strings(units)
+	shares, err := assessmentShares(tx, *a, units)
+	if err != nil {
+		return err
+	}
+
+	affected, err := assessmentChargedResidents(tx, a.ID)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM charges WHERE assessment_id = ?", a.ID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM assessment_shares WHERE assessment_id = ?", a.ID); err != nil {
+		return err
+	}
+
+	first, _ := time.Parse("2006-01-02", a.DueDate)
+	installments := make([]float64, a.Installments)
+	for i := range installments {
+		installments[i] = 1
+	}
+	a.Charged = 0
+	for _, unit := range units {
+		share := shares[unit]
+		if share == 0 {
+			continue
+		}
+		if _, err := tx.Exec("INSERT INTO assessment_shares(assessment_id, unit, amount) VALUES(?, ?, ?)", a.ID, unit, share); err != nil {
+			return err
+		}
+		for i, amount := range splitAmount(share, installments) {
+			description := a.Name
+			if a.Installments > 1 {
+				description = fmt.Sprintf("%s (%d/%d)", a.Name, i+1, a.Installments)
+			}
+			_, err := tx.Exec(`
+				INSERT INTO charges(resident_id, kind, period, description, amount, due_date, assessment_id)
+				VALUES(?, ?, ?, ?, ?, ?, ?)
+			`, residents[unit], ChargeKindAssessment, fmt.Sprintf("A%d-%d", a.ID, i+1), description, amount, installmentDate(first, i), a.ID)
+			if err != nil {
+				return err
+			}
+		}
+		a.Charged = roundCents(a.Charged + share)
+		if !slices.Contains(affected, residents[unit]) {
+			affected = append(affected, residents[unit])
+		}
+	}
+	a.Shares = shares
+
+	for _, id := range affected {
+		if err := reallocate(tx, rules, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// assessmentChargedResidents returns the residents with a charge of an
+// assessment
+func assessmentChargedResidents(q querier, id int) ([]int, error) {
+	rows, err := q.Query("SELECT DISTINCT resident_id FROM charges WHERE assessment_id = ? ORDER BY resident_id", id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []int
+	for rows.Next() {
+		var residentID int
+		if err := rows.Scan(&residentID); err != nil {
+			return nil, err
+		}
+		ids = append(ids, residentID)
+	}
+	return ids, rows.Err()
+}
+
+// assessmentPaid reports whether payments settle any charge of an assessment
+func assessmentPaid(q querier, id int) (bool, error) {
+	var paid bool
+	err := q.QueryRow(`
+		SELECT EXISTS(SELECT 1 FROM payment_allocations a JOIN charges c ON c.id = a.charge_id WHERE c.assessment_id = ?)
+	`, id).Scan(&paid)
+	return paid, err
+}
+
+// loadAssessmentDetails fills in the shares and the amount charged of an
+// assessment
+func loadAssessmentDetails(q querier, a *Assessment) error {
+	rows, err := q.Query("SELECT unit, amount FROM assessment_shares WHERE assessment_id = ?", a.ID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	a.Shares = map[string]float64{}
+	for rows.Next() {
+		var unit string
+		var amount float64
+		if err := rows.Scan(&unit, &amount); err != nil {
+			return err
+		}
+		a.Shares[unit] = amount
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if err := q.QueryRow("SELECT COALESCE(SUM(amount), 0) FROM charges WHERE assessment_id = ?", a.ID).Scan(&a.Charged); err != nil {
+		return err
+	}
+	a.Charged = roundCents(a.Charged)
+	return nil
+}
+
+// saveAssessment inserts a, or updates it when it has an ID, and charges it
+// anew. Once payments settle any of its charges only the name can change, or
+// it fails with assessmentConflict. It returns sql.ErrNoRows when updating an
+// assessment that doesn't exist.
+func saveAssessment(db *sql.DB, a *Assessment, rules paymentRules) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	recharge := true
+	if a.ID == 0 {
+		result, err := tx.Exec("INSERT INTO assessments(name, total_amount, allocation, due_date, installments) VALUES(?, ?, ?, ?, ?)",
+			a.Name, a.TotalAmount, a.Allocation, a.DueDate, a.Installments)
+		if err != nil {
+			return err
+		}
+		id, err := result.LastInsertId()
+		if err != nil {
+			return err
+		}
+		a.ID = int(id)
+	} else {
+		current, err := scanAssessment(tx.QueryRow("SELECT "+assessmentColumns+" FROM assessments WHERE id = ?", a.ID))
+		if err != nil {
+			return err
+		}
+		if err := loadAssessmentDetails(tx, &current); err != nil {
+			return err
+		}
+		paid, err := assessmentPaid(tx, a.ID)
+		if err != nil {
+			return err
+		}
+		if paid {
+			sameShares := a.Allocation != AssessmentCustom || maps.Equal(a.Shares, current.Shares)
+			if a.TotalAmount != current.TotalAmount || a.Allocation != current.Allocation || !sameShares ||
+				a.DueDate != current.DueDate || a.Installments != current.Installments {
+				return assessmentConflict("Assessment has payments, only its name can change")
+			}
+			recharge = false
+		}
+		_, err = tx.Exec("UPDATE assessments SET name = ?, total_amount = ?, allocation = ?, due_date = ?, installments = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?",
+			a.Name, a.TotalAmount, a.Allocation, a.DueDate, a.Installments, a.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	if recharge {
+		if err := chargeAssessment(tx, a, rules); err != nil {
+			return err
+		}
+	} else {
+		// Only the name changed: rename the charges, keeping what settles them
+		_, err := tx.Exec(`
+			UPDATE charges SET description = CASE WHEN ?2 > 1
+				THEN ?1 || ' (' || substr(period, instr(period, '-') + 1) || '/' || ?2 || ')' ELSE ?1 END
+			WHERE assessment_id = ?3
+		`, a.Name, a.Installments, a.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	saved, err := scanAssessment(tx.QueryRow("SELECT "+assessmentColumns+" FROM assessments WHERE id = ?", a.ID))
+	if err != nil {
+		return err
+	}
+	if err := loadAssessmentDetails(tx, &saved); err != nil {
+		return err
+	}
+	*a = saved
+	return tx.Commit()
+}
+
+// assessmentProgress totals what each resident was charged and paid of an
+// assessment as of today
+func assessmentProgress(q querier, a Assessment, cal calendar) (AssessmentProgress, error) {
+	progress := AssessmentProgress{AssessmentID: a.ID, Name: a.Name, TotalAmount: a.TotalAmount, Residents: []AssessmentResidentProgress{}}
+	rows, err := q.Query(`
+		SELECT c.resident_id, COALESCE(r.name, ''), COALESCE(r.unit, ''), c.amount, substr(c.due_date, 1, 10),
+			COALESCE((SELECT SUM(amount) FROM payment_allocations WHERE charge_id = c.id), 0)
+		FROM charges c
+		LEFT JOIN residents r ON r.id = c.resident_id
+		WHERE c.assessment_id = ?
+		ORDER BY r.unit, c.resident_id, c.due_date
+	`, a.ID)
+	if err != nil {
+		return progress, err
+	}
+	defer rows.Close()
+
+	now := cal.today()
+	for rows.Next() {
+		var resident AssessmentResidentProgress
+		var amount, paid float64
+		var dueDate string
+		if err := rows.Scan(&resident.ResidentID, &resident.Name, &resident.Unit, &amount, &dueDate, &paid); err != nil {
+			return progress, err
+		}
+		n := len(progress.Residents)
+		if n == 0 || progress.Residents[n-1].ResidentID != resident.ResidentID {
+			progress.Residents = append(progress.Residents, resident)
+			n++
+		}
+		r := &progress.Residents[n-1]
+		r.Charged = roundCents(r.Charged + amount)
+		r.Paid = roundCents(r.Paid + paid)
+		r.Outstanding = roundCents(r.Charged - r.Paid)
+		if dueDate < now {
+			r.Overdue = roundCents(r.Overdue + amount - paid)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return progress, err
+	}
+
+	for _, r := range progress.Residents {
+		progress.Charged = roundCents(progress.Charged + r.Charged)
+		progress.Paid = roundCents(progress.Paid + r.Paid)
+		progress.Overdue = roundCents(progress.Overdue + r.Overdue)
+	}
+	progress.Outstanding = roundCents(progress.Charged - progress.Paid)
+	if progress.Charged > 0 {
+		progress.CollectedPercent = math.Round(progress.Paid/progress.Charged*1000) / 10
+	}
+	return progress, nil
+}
+
+// Handlers for assessment endpoints
+
+// Get every assessment, newest due first
+func getAssessments(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rows, err := db.Query("SELECT " + assessmentColumns + " FROM assessments ORDER BY due_date DESC, id DESC")
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		assessments := []Assessment{}
+		for rows.Next() {
+			a, err := scanAssessment(rows)
+			if err != nil {
+				rows.Close()
+				respondWithError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			assessments = append(assessments, a)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		for i := range assessments {
+			if err := loadAssessmentDetails(db, &assessments[i]); err != nil {
+				respondWithError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+		}
+		respondWithJSON(w, http.StatusOK, assessments)
+	}
+}
+
+// findAssessment loads the assessment in the path, or responds why it can't
+func findAssessment(db *sql.DB, w http.ResponseWriter, r *http.Request) (Assessment, bool) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid assessment ID")
+		return Assessment{}, false
+	}
+	a, err := scanAssessment(db.QueryRow("SELECT "+assessmentColumns+" FROM assessments WHERE id = ?", id))
+	if err == sql.ErrNoRows {
+		respondWithError(w, http.StatusNotFound, "Assessment not found")
+		return a, false
+	}
+	if err == nil {
+		err = loadAssessmentDetails(db, &a)
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return a, false
+	}
+	return a, true
+}
+
+func getAssessment(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if a, ok := findAssessment(db, w, r); ok {
+			respondWithJSON(w, http.StatusOK, a)
+		}
+	}
+}
+
+// respondWithSavedAssessment saves a and responds with it, or with why it
+// couldn't be saved
+func respondWithSavedAssessment(w http.ResponseWriter, db *sql.DB, a Assessment, status int, rules paymentRules) {
+	if a.Installments == 0 {
+		a.Installments = 1
+	}
+	if err := validateAssessment(a); err != nil {
+		respondWithValidationError(w, err)
+		return
+	}
+	err := saveAssessment(db, &a, rules)
+	if conflict, ok := err.(assessmentConflict); ok {
+		respondWithError(w, http.StatusConflict, conflict.Error())
+		return
+	}
+	if errs, ok := err.(ValidationErrors); ok {
+		respondWithValidationError(w, errs)
+		return
+	}
+	if err == sql.ErrNoRows {
+		respondWithError(w, http.StatusNotFound, "Assessment not found")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	respondWithJSON(w, status, a)
+}
+
+// Create an assessment and charge it to the residents
+func createAssessment(db *sql.DB, rules paymentRules) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var a Assessment
+		if err := decodeRequest(r, &a); err != nil {
+			respondWithError(w, payloadErrorStatus(err), "Invalid request payload: "+err.Error())
+			return
+		}
+		defer r.Body.Close()
+
+		a.ID = 0
+		respondWithSavedAssessment(w, db, a, http.StatusCreated, rules)
+	}
+}
+
+// Update an assessment and charge it anew, unless some of its charges are
+// paid: then only the name can change
+func updateAssessment(db *sql.DB, rules paymentRules) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(mux.Vars(r)["id"])
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid assessment ID")
+			return
+		}
+
+		var a Assessment
+		if err := decodeRequest(r, &a); err != nil {
+			respondWithError(w, payloadErrorStatus(err), "Invalid request payload: "+err.Error())
+			return
+		}
+		defer r.Body.Close()
+
+		a.ID = id
+		respondWithSavedAssessment(w, db, a, http.StatusOK, rules)
+	}
+}
+
+// Delete an assessment and its charges, unless some of them are paid
+func deleteAssessment(db *sql.DB, rules paymentRules) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(mux.Vars(r)["id"])
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid assessment ID")
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		defer tx.Rollback()
+
+		paid, err := assessmentPaid(tx, id)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if paid {
+			respondWithError(w, http.StatusConflict, "Assessment has payments, it can't be deleted")
+			return
+		}
+		residents, err := assessmentChargedResidents(tx, id)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		result, err := tx.Exec("DELETE FROM assessments WHERE id = ?", id)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			respondWithError(w, http.StatusNotFound, "Assessment not found")
+			return
+		}
+		for _, query := range []string{"DELETE FROM charges WHERE assessment_id = ?", "DELETE FROM assessment_shares WHERE assessment_id = ?"} {
+			if _, err := tx.Exec(query, id); err != nil {
+				respondWithError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+		}
+		for _, residentID := range residents {
+			if err := reallocate(tx, rules, residentID); err != nil {
+				respondWithError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		respondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
+	}
+}
+
+// Get how much of an assessment each resident paid and still owes
+func getAssessmentProgress(db *sql.DB, cal calendar) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		a, ok := findAssessment(db, w, r)
+		if !ok {
+			return
+		}
+		progress, err := assessmentProgress(db, a, cal)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		respondWithJSON(w, http.StatusOK, progress)
+	}
+}
@@ -0,0 +1,150 @@
+package condomngr
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestInstallmentDate(t *testing.T) {
+	for _, tt := range []struct {
+		first  string
+		months int
+		want   string
+	}{
+		{"2024-01-15", 0, "2024-01-15"},
+		{"2024-01-31", 1, "2024-02-29"},
+		{"2023-01-31", 1, "2023-02-28"},
+		{"2024-01-31", 2, "2024-03-31"},
+		{"2024-01-31", 3, "2024-04-30"},
+		{"2024-02-29", 12, "2025-02-28"},
+		{"2024-02-29", 48, "2028-02-29"},
+		{"2024-12-15", 1, "2025-01-15"},
+		{"2024-11-30", 3, "2025-02-28"},
+	} {
+		first, _ := time.Parse("2006-01-02", tt.first)
+		if got := installmentDate(first, tt.months); got != tt.want {
+			t.Errorf("%s + %d months: %s, want %s", tt.first, tt.months, got, tt.want)
+		}
+	}
+}
+
+func TestAssessmentCharges(t *testing.T) {
+	s := newTestServer(t, Options{})
+	for _, r := range []map[string]string{
+		{"name": "Ana Silva", "unit": "1A"},
+		{"name": "Rui Costa", "unit": "1B"},
+		{"name": "Eva Lima", "unit": "1C", "move_out_date": "2024-03-01"},
+		{"name": "Leo Sousa", "unit": "1C", "move_in_date": "2024-03-01"},
+	} {
+		s.expect(http.StatusCreated, "POST", "/api/v1/residents", r, nil)
+	}
+	for unit, permilage := range map[string]float64{"1A": 500, "1B": 300, "1C": 200} {
+		s.expect(http.StatusOK, "PUT", "/api/v1/fractions/"+unit, map[string]float64{"permilage": permilage}, nil)
+	}
+
+	for _, tt := range []struct {
+		name         string
+		total        float64
+		allocation   string
+		shares       map[string]float64
+		dueDate      string
+		installments int
+		want         []string // resident, amount and due date of each charge
+	}{
+		{"equal, a cent left over", 100, AssessmentEqual, nil, "2024-03-01", 1, []string{
+			"Ana Silva 33.34 2024-03-01", "Rui Costa 33.33 2024-03-01", "Leo Sousa 33.33 2024-03-01",
+		}},
+		{"the day before a handover", 100, AssessmentEqual, nil, "2024-02-29", 1, []string{
+			"Ana Silva 33.34 2024-02-29", "Rui Costa 33.33 2024-02-29", "Eva Lima 33.33 2024-02-29",
+		}},
+		{"by fraction", 1000.01, AssessmentFraction, nil, "2024-03-01", 1, []string{
+			"Ana Silva 500.01 2024-03-01", "Rui Costa 300 2024-03-01", "Leo Sousa 200 2024-03-01",
+		}},
+		{"custom", 100, AssessmentCustom, map[string]float64{"1A": 70.5, "1B": 29.5}, "2024-03-01", 1, []string{
+			"Ana Silva 70.5 2024-03-01", "Rui Costa 29.5 2024-03-01",
+		}},
+		{"in installments from the end of a month", 100, AssessmentEqual, nil, "2024-01-31", 3, []string{
+			"Ana Silva 11.12 2024-01-31", "Ana Silva 11.11 2024-02-29", "Ana Silva 11.11 2024-03-31",
+			"Rui Costa 11.11 2024-01-31", "Rui Costa 11.11 2024-02-29", "Rui Costa 11.11 2024-03-31",
+			"Eva Lima 11.11 2024-01-31", "Eva Lima 11.11 2024-02-29", "Eva Lima 11.11 2024-03-31",
+		}},
+	} {
+		var a Assessment
+		s.expect(http.StatusCreated, "POST", "/api/v1/assessments", map[string]interface{}{
+			"name": tt.name, "total_amount": tt.total, "allocation": tt.allocation, "shares": tt.shares, "due_date": tt.dueDate, "installments": tt.installments,
+		}, &a)
+		if a.Charged != tt.total {
+			t.Errorf("%s: charged %v of %v", tt.name, a.Charged, tt.total)
+		}
+		rows, err := s.db.Query(`
+			SELECT r.name, c.amount, substr(c.due_date, 1, 10) FROM charges c JOIN residents r ON r.id = c.resident_id
+			WHERE c.assessment_id = ? ORDER BY r.unit, r.id, c.due_date
+		`, a.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for rows.Next() {
+			var name, due string
+			var amount float64
+			if err := rows.Scan(&name, &amount, &due); err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, fmt.Sprint(name, " ", amount, " ", due))
+		}
+		rows.Close()
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: charges %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestAssessmentProgress(t *testing.T) {
+	s := newTestServer(t, Options{})
+	ana := s.createResident("Ana Silva", "1A")
+	s.createResident("Rui Costa", "1B")
+
+	create := func(total float64, dueDate string, installments int) Assessment {
+		t.Helper()
+		var a Assessment
+		s.expect(http.StatusCreated, "POST", "/api/v1/assessments", map[string]interface{}{
+			"name": "Roof", "total_amount": total, "allocation": AssessmentEqual, "due_date": dueDate, "installments": installments,
+		}, &a)
+		return a
+	}
+	past, future := create(200, "2024-01-31", 2), create(0.04, "2099-01-01", 2)
+	// Settles Ana's first installment and part of the second
+	s.expect(http.StatusCreated, "POST", "/api/v1/payments", map[string]interface{}{"resident_id": ana.ID, "amount": 60, "description": "Roof", "payment_date": "2024-02-01"}, nil)
+
+	for _, tt := range []struct {
+		assessment                                   Assessment
+		charged, paid, outstanding, overdue, percent float64
+		residents                                    []string // charged, paid, outstanding and overdue of each
+	}{
+		{past, 200, 60, 140, 140, 30, []string{"100 60 40 40", "100 0 100 100"}},
+		{future, 0.04, 0, 0.04, 0, 0, []string{"0.02 0 0.02 0", "0.02 0 0.02 0"}},
+	} {
+		var p AssessmentProgress
+		s.expect(http.StatusOK, "GET", fmt.Sprintf("/api/v1/assessments/%d/progress", tt.assessment.ID), nil, &p)
+		if p.Charged != tt.charged || p.Paid != tt.paid || p.Outstanding != tt.outstanding || p.Overdue != tt.overdue || p.CollectedPercent != tt.percent {
+			t.Errorf("assessment due %s: %+v", tt.assessment.DueDate, p)
+		}
+		var residents []string
+		for _, r := range p.Residents {
+			residents = append(residents, fmt.Sprint(r.Charged, " ", r.Paid, " ", r.Outstanding, " ", r.Overdue))
+		}
+		if !reflect.DeepEqual(residents, tt.residents) {
+			t.Errorf("assessment due %s: residents %q, want %q", tt.assessment.DueDate, residents, tt.residents)
+		}
+	}
+
+	// Once paid only the name can change
+	path := fmt.Sprintf("/api/v1/assessments/%d", past.ID)
+	body := map[string]interface{}{"name": "Roof", "total_amount": 300, "allocation": AssessmentEqual, "due_date": "2024-01-31", "installments": 2}
+	s.expect(http.StatusConflict, "PUT", path, body, nil)
+	body["name"], body["total_amount"] = "Roof repair", 200
+	s.expect(http.StatusOK, "PUT", path, body, nil)
+}
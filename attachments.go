@@ -0,0 +1,574 @@
+package condomngr
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// defaultMaxAttachmentSize is the largest file that can be attached, unless
+// set with -attachment-max-size
+const defaultMaxAttachmentSize = 10 << 20
+
+// attachmentTempPrefix names the files uploads are written to before they are
+// known to be accepted
+const attachmentTempPrefix = ".upload-"
+
+// attachmentTypes are the content types files can be attached with, as
+// sniffed from their content rather than as claimed by the client
+var attachmentTypes = map[string]bool{
+	"application/pdf": true,
+	"image/jpeg":      true,
+	"image/png":       true,
+	"image/gif":       true,
+	"image/webp":      true,
+	"text/plain":      true,
+}
+
+// attachmentEntity is a type of record files can be attached to
+type attachmentEntity struct {
+	table     string
+	invalidID string
+	notFound  string
+}
+
+var attachmentEntities = map[string]attachmentEntity{
+	"payment":             {table: "payments", invalidID: "Invalid payment ID", notFound: "Payment not found"},
+	"expense":             {table: "expenses", invalidID: "Invalid expense ID", notFound: "Expense not found"},
+	"incident":            {table: "incidents", invalidID: "Invalid incident ID", notFound: "Incident not found"},
+	"maintenance_request": {table: "maintenance_requests", invalidID: "Invalid maintenance request ID", notFound: "Maintenance request not found"},
+}
+
+// Attachment is a file attached to a record
+type Attachment struct {
+	ID          int       `json:"id"`
+	EntityType  string    `json:"entity_type"`
+	EntityID    int       `json:"entity_id"`
+	Filename    string    `json:"filename"`
+	ContentType string    `json:"content_type"`
+	Size        int64     `json:"size"`
+	SHA256      string    `json:"sha256"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+const attachmentColumns = "id, entity_type, entity_id, filename, content_type, size, sha256, created_at"
+
+func scanAttachmentRow(row interface{ Scan(...interface{}) error }) (Attachment, error) {
+	var a Attachment
+	err := row.Scan(&a.ID, &a.EntityType, &a.EntityID, &a.Filename, &a.ContentType, &a.Size, &a.SHA256, &a.CreatedAt)
+	return a, err
+}
+
+// AttachmentUsage is how much of the attachment storage is used
+type AttachmentUsage struct {
+	Attachments int   `json:"attachments"`
+	Files       int   `json:"files"` // stored once however often attached
+	Bytes       int64 `json:"bytes"`
+	Quota       int64 `json:"quota"` // 0 without a quota
+	MaxFileSize int64 `json:"max_file_size"`
+}
+
+// attachmentError is an upload the store refuses, with the status to respond
+// with
+type attachmentError struct {
+	status  int
+	message string
+}
+
+func (e *attachmentError) Error() string { return e.message }
+
+// AttachmentStore keeps the files attached to records of a database. Files are
+// stored on disk named by the SHA-256 of their content, so a file attached
+// twice, to one record or to several, is stored once; the attachments table
+// links them to records.
+type AttachmentStore struct {
+	db      *sql.DB
+	dir     string
+	maxSize int64 // bytes per file
+	quota   int64 // bytes stored in all, 0 for no limit
+
+	// mu serializes saving, deleting and collecting, so a file isn't
+	// removed while it is being attached again
+	mu sync.Mutex
+}
+
+// NewAttachmentStore stores the attachments of db next to its database file,
+// in condo-attachments for condo.db. A quota of zero doesn't limit the
+// storage.
+func NewAttachmentStore(db *sql.DB, maxSize, quota int64) (*AttachmentStore, error) {
+	dir, err := attachmentDir(db)
+	if err != nil {
+		return nil, err
+	}
+	if maxSize <= 0 {
+		maxSize = defaultMaxAttachmentSize
+	}
+	return &AttachmentStore{db: db, dir: dir, maxSize: maxSize, quota: quota}, nil
+}
+
+// attachmentDir is the directory of the attachments of db
+func attachmentDir(db *sql.DB) (string, error) {
+	var seq int
+	var name, file string
+	if err := db.QueryRow("PRAGMA database_list").Scan(&seq, &name, &file); err != nil {
+		return "", err
+	}
+	if file == "" {
+		// An in-memory database keeps its attachments for as long as the
+		// system keeps temporary files
+		return filepath.Join(os.TempDir(), "condomngr-attachments"), nil
+	}
+	ext := filepath.Ext(file)
+	return strings.TrimSuffix(file, ext) + "-attachments", nil
+}
+
+// path is where the file with a SHA-256 is stored, under a directory named
+// after its first two digits to keep directories small
+func (s *AttachmentStore) path(sum string) string {
+	return filepath.Join(s.dir, sum[:2], sum)
+}
+
+// Save stores a file attached to a record. The file is refused with an
+// attachmentError when it is empty, too large, of a type that isn't allowed
+// or over the quota.
+func (s *AttachmentStore) Save(entityType string, entityID int, filename string, content io.Reader) (Attachment, error) {
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return Attachment{}, err
+	}
+	tmp, err := os.CreateTemp(s.dir, attachmentTempPrefix+"*")
+	if err != nil {
+		return Attachment{}, err
+	}
+	defer os.Remove(tmp.Name()) // gone already once stored
+	defer tmp.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hash), io.LimitReader(content, s.maxSize+1))
+	if err != nil {
+		return Attachment{}, err
+	}
+	if size > s.maxSize {
+		return Attachment{}, &attachmentError{http.StatusRequestEntityTooLarge, fmt.Sprintf("Attachment is too large: the limit is %d bytes", s.maxSize)}
+	}
+	if size == 0 {
+		return Attachment{}, &attachmentError{http.StatusBadRequest, "Attachment is empty"}
+	}
+
+	head := make([]byte, 512)
+	n, err := tmp.ReadAt(head, 0)
+	if err != nil && err != io.EOF {
+		return Attachment{}, err
+	}
+	contentType := http.DetectContentType(head[:n])
+	if mediaType, _, _ := mime.ParseMediaType(contentType); !attachmentTypes[mediaType] {
+		return Attachment{}, &attachmentError{http.StatusUnsupportedMediaType, "Unsupported attachment type, must be PDF, JPEG, PNG, GIF, WebP or plain text"}
+	}
+	if err := tmp.Close(); err != nil {
+		return Attachment{}, err
+	}
+	sum := hex.EncodeToString(hash.Sum(nil))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	path := s.path(sum)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		if s.quota > 0 {
+			usage, err := s.usage()
+			if err != nil {
+				return Attachment{}, err
+			}
+			if usage.Bytes+size > s.quota {
+				return Attachment{}, &attachmentError{http.StatusInsufficientStorage,
+					fmt.Sprintf("Attachment storage quota exceeded: %d of %d bytes used, the file has %d", usage.Bytes, s.quota, size)}
+			}
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return Attachment{}, err
+		}
+		if err := os.Rename(tmp.Name(), path); err != nil {
+			return Attachment{}, err
+		}
+	} else if err != nil {
+		return Attachment{}, err
+	}
+
+	result, err := s.db.Exec("INSERT INTO attachments(entity_type, entity_id, sha256, filename, content_type, size) VALUES(?, ?, ?, ?, ?, ?)",
+		entityType, entityID, sum, attachmentFilename(filename), contentType, size)
+	if err != nil {
+		return Attachment{}, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return Attachment{}, err
+	}
+	return scanAttachmentRow(s.db.QueryRow("SELECT "+attachmentColumns+" FROM attachments WHERE id = ?", id))
+}
+
+// attachmentFilename is the name a file is downloaded with: the name it was
+// uploaded with, without any directory
+func attachmentFilename(name string) string {
+	name = strings.TrimSpace(filepath.Base(strings.ReplaceAll(name, "\\", "/")))
+	if name == "" || name == "." || name == "/" {
+		return "attachment"
+	}
+	if len(name) > 255 {
+		name = name[:255]
+	}
+	return name
+}
+
+// usage is how much storage the attachments take, counting each file once
+func (s *AttachmentStore) usage() (AttachmentUsage, error) {
+	usage := AttachmentUsage{Quota: s.quota, MaxFileSize: s.maxSize}
+	err := s.db.QueryRow(`
+		SELECT (SELECT COUNT(*) FROM attachments), COUNT(*), COALESCE(SUM(size), 0)
+		FROM (SELECT MAX(size) AS size FROM attachments GROUP BY sha256)
+	`).Scan(&usage.Attachments, &usage.Files, &usage.Bytes)
+	return usage, err
+}
+
+// Delete deletes an attachment, and its file unless it is attached elsewhere.
+// It reports whether the attachment existed.
+func (s *AttachmentStore) Delete(id int) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var sum string
+	err := s.db.QueryRow("SELECT sha256 FROM attachments WHERE id = ?", id).Scan(&sum)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if _, err := s.db.Exec("DELETE FROM attachments WHERE id = ?", id); err != nil {
+		return false, err
+	}
+
+	var attached bool
+	if err := s.db.QueryRow("SELECT EXISTS(SELECT 1 FROM attachments WHERE sha256 = ?)", sum).Scan(&attached); err != nil {
+		return true, err
+	}
+	if !attached {
+		if err := os.Remove(s.path(sum)); err != nil && !os.IsNotExist(err) {
+			return true, err
+		}
+	}
+	return true, nil
+}
+
+// Collect deletes the attachments of records that are gone, neither in their
+// table nor in the trash, and removes the files no attachment refers to. It
+// returns how many attachments and files went.
+func (s *AttachmentStore) Collect() (int64, int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var attachments int64
+	for entityType, entity := range attachmentEntities {
+		result, err := s.db.Exec(`
+			DELETE FROM attachments WHERE entity_type = ?1
+			AND entity_id NOT IN (SELECT id FROM `+entity.table+`)
+			AND entity_id NOT IN (SELECT entity_id FROM deleted_records WHERE entity_type = ?1)
+		`, entityType)
+		if err != nil {
+			return attachments, 0, err
+		}
+		n, _ := result.RowsAffected()
+		attachments += n
+	}
+
+	rows, err := s.db.Query("SELECT DISTINCT sha256 FROM attachments")
+	if err != nil {
+		return attachments, 0, err
+	}
+	defer rows.Close()
+	attached := map[string]bool{}
+	for rows.Next() {
+		var sum string
+		if err := rows.Scan(&sum); err != nil {
+			return attachments, 0, err
+		}
+		attached[sum] = true
+	}
+	if err := rows.Err(); err != nil {
+		return attachments, 0, err
+	}
+
+	if _, err := os.Stat(s.dir); os.IsNotExist(err) {
+		return attachments, 0, nil
+	}
+	files := 0
+	err = filepath.WalkDir(s.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		if strings.HasPrefix(d.Name(), attachmentTempPrefix) {
+			// Left by an upload that was interrupted, unless it is still
+			// going on
+			if info, err := d.Info(); err != nil || time.Since(info.ModTime()) < time.Hour {
+				return nil
+			}
+		} else if attached[d.Name()] {
+			return nil
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		files++
+		return nil
+	})
+	return attachments, files, err
+}
+
+// ScheduleCollect collects the attachments of deleted records now and then at
+// every interval in a background goroutine. Deleted records keep their
+// attachments while they are in the trash, so they can be restored with them.
+func (s *AttachmentStore) ScheduleCollect(interval time.Duration) {
+	collect := func() {
+		attachments, files, err := s.Collect()
+		if err != nil {
+			log.Printf("Failed to collect attachments: %v", err)
+		} else if attachments > 0 || files > 0 {
+			log.Printf("Collected %d attachments of deleted records and %d unused files", attachments, files)
+		}
+	}
+	go func() {
+		collect()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			collect()
+		}
+	}()
+}
+
+// attachmentPart finds the file of an upload in the multipart field
+// attachmentFile, reading the body as it streams in
+func attachmentPart(r *http.Request) (*multipart.Part, error) {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		part, err := reader.NextPart()
+		if err != nil {
+			return nil, err
+		}
+		if part.FormName() == "attachmentFile" {
+			return part, nil
+		}
+		part.Close()
+	}
+}
+
+// Handlers for the attachment endpoints. The endpoints of a type of record,
+// such as /payments/{id}/attachments, are set up with its entity type.
+
+// Get the attachments of a record
+func getAttachments(store *AttachmentStore, entityType string) http.HandlerFunc {
+	entity := attachmentEntities[entityType]
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id, err := strconv.Atoi(vars["id"])
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, entity.invalidID)
+			return
+		}
+		var exists bool
+		if err := store.db.QueryRow("SELECT EXISTS(SELECT 1 FROM "+entity.table+" WHERE id = ?)", id).Scan(&exists); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if !exists {
+			respondWithError(w, http.StatusNotFound, entity.notFound)
+			return
+		}
+
+		rows, err := store.db.Query("SELECT "+attachmentColumns+" FROM attachments WHERE entity_type = ? AND entity_id = ? ORDER BY id", entityType, id)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		defer rows.Close()
+
+		attachments := []Attachment{}
+		for rows.Next() {
+			a, err := scanAttachmentRow(rows)
+			if err != nil {
+				respondWithError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			attachments = append(attachments, a)
+		}
+		if err := rows.Err(); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		respondWithJSON(w, http.StatusOK, attachments)
+	}
+}
+
+// Attach a file to a record (multipart field attachmentFile)
+func createAttachment(store *AttachmentStore, entityType string) http.HandlerFunc {
+	entity := attachmentEntities[entityType]
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id, err := strconv.Atoi(vars["id"])
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, entity.invalidID)
+			return
+		}
+		var exists bool
+		if err := store.db.QueryRow("SELECT EXISTS(SELECT 1 FROM "+entity.table+" WHERE id = ?)", id).Scan(&exists); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if !exists {
+			respondWithError(w, http.StatusNotFound, entity.notFound)
+			return
+		}
+
+		part, err := attachmentPart(r)
+		if err != nil {
+			if payloadErrorStatus(err) == http.StatusRequestEntityTooLarge {
+				respondWithError(w, http.StatusRequestEntityTooLarge, "Attachment is too large")
+				return
+			}
+			respondWithError(w, http.StatusBadRequest, "Error retrieving attachment file")
+			return
+		}
+		defer part.Close()
+
+		attachment, err := store.Save(entityType, id, part.FileName(), part)
+		var refused *attachmentError
+		if errors.As(err, &refused) {
+			respondWithError(w, refused.status, refused.message)
+			return
+		}
+		if err != nil {
+			if payloadErrorStatus(err) == http.StatusRequestEntityTooLarge {
+				respondWithError(w, http.StatusRequestEntityTooLarge, "Attachment is too large")
+				return
+			}
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		respondWithJSON(w, http.StatusCreated, attachment)
+	}
+}
+
+// Get an attachment's details
+func getAttachment(store *AttachmentStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id, err := strconv.Atoi(vars["id"])
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid attachment ID")
+			return
+		}
+
+		a, err := scanAttachmentRow(store.db.QueryRow("SELECT "+attachmentColumns+" FROM attachments WHERE id = ?", id))
+		if err == sql.ErrNoRows {
+			respondWithError(w, http.StatusNotFound, "Attachment not found")
+			return
+		}
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		respondWithJSON(w, http.StatusOK, a)
+	}
+}
+
+// Download an attachment. Range requests are supported, so large files can be
+// resumed.
+func downloadAttachment(store *AttachmentStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id, err := strconv.Atoi(vars["id"])
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid attachment ID")
+			return
+		}
+
+		a, err := scanAttachmentRow(store.db.QueryRow("SELECT "+attachmentColumns+" FROM attachments WHERE id = ?", id))
+		if err == sql.ErrNoRows {
+			respondWithError(w, http.StatusNotFound, "Attachment not found")
+			return
+		}
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		file, err := os.Open(store.path(a.SHA256))
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		defer file.Close()
+
+		w.Header().Set("Content-Type", a.ContentType)
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": a.Filename}))
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("ETag", `"`+a.SHA256+`"`)
+		http.ServeContent(w, r, a.Filename, a.CreatedAt, file)
+	}
+}
+
+// Delete an attachment. Unlike records it doesn't go to the trash.
+func deleteAttachment(store *AttachmentStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id, err := strconv.Atoi(vars["id"])
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid attachment ID")
+			return
+		}
+
+		found, err := store.Delete(id)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if !found {
+			respondWithError(w, http.StatusNotFound, "Attachment not found")
+			return
+		}
+
+		respondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
+	}
+}
+
+// Get how much of the attachment storage is used
+func getAttachmentUsage(store *AttachmentStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		usage, err := store.usage()
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		respondWithJSON(w, http.StatusOK, usage)
+	}
+}
@@ -0,0 +1,126 @@
+package condomngr
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Audit actions
+const (
+	AuditPasswordResetRequested = "password_reset_requested"
+	AuditPasswordReset          = "password_reset"
+	AuditConsistencyFix         = "consistency_fix"
+	AuditWriteOff               = "write_off"
+	AuditWriteOffReversed       = "write_off_reversed"
+	AuditUnitTransfer           = "unit_transfer"
+	AuditRecompute              = "recompute"
+	AuditResidentAnonymized     = "resident_anonymized"
+	AuditExpensesBulkUpdated    = "expenses_bulk_updated"
+	AuditPaymentsReassigned     = "payments_reassigned"
+	AuditCondoGranted           = "condo_granted"
+	AuditCondoRevoked           = "condo_revoked"
+)
+
+// AuditEntry records who did something sensitive, from where and to what.
+// Entries are only ever added.
+type AuditEntry struct {
+	ID      int       `json:"id"`
+	At      time.Time `json:"at"`
+	Action  string    `json:"action"`
+	Actor   string    `json:"actor"` // username of the session, empty when not signed in or from the command line
+	IP      string    `json:"ip"`
+	Subject string    `json:"subject"` // what it was done to, e.g. user alice
+	Detail  string    `json:"detail"`
+}
+
+// recordAudit adds an entry for action on subject, done through r, or from
+// the command line when r is nil
+func recordAudit(q querier, r *http.Request, action, subject, detail string) error {
+	var actor, ip string
+	if r != nil {
+		// Sessions for other condos are in the default condo's database
+		if session, ok := condoSession(r); ok {
+			actor = session.User.Username
+		} else {
+			err := q.QueryRow(`
+				SELECT u.username FROM sessions s JOIN users u ON u.id = s.user_id
+				WHERE s.token_hash = ? AND s.expires_at > ?
+			`, hashToken(bearerToken(r)), time.Now().UTC()).Scan(&actor)
+			if err != nil && err != sql.ErrNoRows {
+				return err
+			}
+		}
+		ip = clientIP(r)
+	}
+	_, err := q.Exec("INSERT INTO audit_log(at, action, actor, ip, subject, detail) VALUES(?, ?, ?, ?, ?, ?)",
+		time.Now().UTC(), action, actor, ip, subject, detail)
+	return err
+}
+
+// Get the audit log, newest first. The X-Next-Cursor header holds the cursor
+// of the next page, and is absent on the last one.
+func getAuditLog(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := requireAdmin(db, w, r); !ok {
+			return
+		}
+		if err := checkQueryParams(r, "action", "limit", "cursor"); err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		query, args := "SELECT id, at, action, actor, ip, subject, detail FROM audit_log WHERE 1 = 1", []interface{}{}
+		if value := r.URL.Query().Get("action"); value != "" {
+			query += " AND action = ?"
+			args = append(args, value)
+		}
+		if value := r.URL.Query().Get("cursor"); value != "" {
+			cursor, err := strconv.Atoi(value)
+			if err != nil {
+				respondWithError(w, http.StatusBadRequest, "invalid cursor")
+				return
+			}
+			query += " AND id < ?"
+			args = append(args, cursor)
+		}
+		limit := 50
+		if value := r.URL.Query().Get("limit"); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 || n > 200 {
+				respondWithError(w, http.StatusBadRequest, "Invalid limit, must be between 1 and 200")
+				return
+			}
+			limit = n
+		}
+
+		// One more than a page tells whether there is a next one
+		rows, err := db.Query(query+" ORDER BY id DESC LIMIT "+strconv.Itoa(limit+1), args...)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		defer rows.Close()
+
+		entries := []AuditEntry{}
+		for rows.Next() {
+			if len(entries) == limit {
+				w.Header().Set("X-Next-Cursor", strconv.Itoa(entries[len(entries)-1].ID))
+				break
+			}
+			var e AuditEntry
+			if err := rows.Scan(&e.ID, &e.At, &e.Action, &e.Actor, &e.IP, &e.Subject, &e.Detail); err != nil {
+				respondWithError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			entries = append(entries, e)
+		}
+		if err := rows.Err(); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		respondWithJSON(w, http.StatusOK, entries)
+	}
+}
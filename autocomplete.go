@@ -0,0 +1,77 @@
+package condomngr
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+)
+
+// Suggestion is a value in use for a field, for autocomplete: how many
+// records have it and the date of the latest
+type Suggestion struct {
+	Value    string `json:"value"`
+	Count    int    `json:"count"`
+	LastUsed string `json:"last_used"`
+}
+
+// suggestions returns up to limit values of column in table, those matching
+// the LIKE pattern if given, the most used first with their counts and latest
+// dates. The table is expected to have an index on (column, dateColumn), so
+// the grouping only reads the index.
+func suggestions(db *sql.DB, table, column, dateColumn, pattern string, limit int) ([]Suggestion, error) {
+	var filter queryFilter
+	filter.add(column+" != ?", "")
+	if pattern != "" {
+		filter.add(column+` LIKE ? ESCAPE '\'`, pattern)
+	}
+	rows, err := db.Query("SELECT "+column+", COUNT(*), MAX("+dateColumn+") FROM "+table+filter.where()+
+		" GROUP BY "+column+" ORDER BY COUNT(*) DESC, MAX("+dateColumn+") DESC, "+column+" LIMIT ?", append(filter.args, limit)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := []Suggestion{}
+	for rows.Next() {
+		var s Suggestion
+		if err := rows.Scan(&s.Value, &s.Count, &s.LastUsed); err != nil {
+			return nil, err
+		}
+		list = append(list, s)
+	}
+	return list, rows.Err()
+}
+
+// Suggest values of column of table as they are typed: those matching q (all
+// without it), the most used first, 10 by default and at most 100
+func suggestionsHandler(db *sql.DB, table, column, dateColumn string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := checkQueryParams(r, "q", "match", "limit"); err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		limit := 10
+		if value := r.URL.Query().Get("limit"); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 || n > 100 {
+				respondWithError(w, http.StatusBadRequest, "Invalid limit, must be between 1 and 100")
+				return
+			}
+			limit = n
+		}
+		var pattern string
+		if r.URL.Query().Get("q") != "" {
+			var err error
+			if pattern, err = searchPattern(r); err != nil {
+				respondWithError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+		}
+
+		list, err := suggestions(db, table, column, dateColumn, pattern, limit)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		respondWithJSON(w, http.StatusOK, list)
+	}
+}
@@ -0,0 +1,462 @@
+package condomngr
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Statuses of the off-site copy of a backup
+const (
+	BackupRemoteNone     = "none" // no off-site target configured
+	BackupRemotePending  = "pending"
+	BackupRemoteUploaded = "uploaded"
+	BackupRemoteFailed   = "failed"
+)
+
+// Uploads are attempted this many times, waiting backupRetryDelay before the
+// second attempt and twice as long before each next one
+const (
+	backupUploadAttempts = 5
+	backupRetryDelay     = 30 * time.Second
+)
+
+// Backup is a snapshot of the database in the backup directory
+type Backup struct {
+	ID             int        `json:"id"`
+	Filename       string     `json:"filename"`
+	Size           int64      `json:"size"`
+	SHA256         string     `json:"sha256"`
+	CreatedAt      time.Time  `json:"created_at"`
+	RemoteStatus   string     `json:"remote_status"`
+	RemoteURL      string     `json:"remote_url,omitempty"` // s3://bucket/key, for restore -from
+	RemoteError    string     `json:"remote_error,omitempty"`
+	UploadAttempts int        `json:"upload_attempts"`
+	UploadedAt     *time.Time `json:"uploaded_at,omitempty"`
+}
+
+// Backups takes snapshots of the database into a directory, keeps the newest
+// few and uploads each to an S3-compatible bucket when one is configured,
+// keeping the same number there
+type Backups struct {
+	db       *sql.DB
+	dir      string // backups are off without it
+	keep     int    // 0 keeps every backup
+	remote   *S3Target
+	notifier *Notifier
+
+	mu      sync.Mutex // held while a snapshot is taken
+	pruneMu sync.Mutex
+}
+
+// NewBackups creates the backups of db into dir, uploaded to remote unless it
+// is nil
+func NewBackups(db *sql.DB, dir string, keep int, remote *S3Target, notifier *Notifier) *Backups {
+	if notifier == nil {
+		notifier = NewNotifier(nil, 0)
+	}
+	return &Backups{db: db, dir: dir, keep: keep, remote: remote, notifier: notifier}
+}
+
+// Configured reports whether backups are taken
+func (b *Backups) Configured() bool {
+	return b.dir != ""
+}
+
+// errBackupRunning is returned when a backup is requested while one is taken
+var errBackupRunning = errors.New("a backup is already running")
+
+// Schedule takes a backup every interval, the first one once interval has
+// passed since the last backup, so restarts don't postpone them. Uploads a
+// restart interrupted are resumed.
+func (b *Backups) Schedule(interval time.Duration) {
+	if !b.Configured() || interval <= 0 {
+		return
+	}
+
+	pending, err := b.list("WHERE remote_status = ?", BackupRemotePending)
+	if err != nil {
+		log.Printf("Failed to list pending backup uploads: %v", err)
+	}
+	for _, backup := range pending {
+		if b.remote != nil {
+			go b.upload(backup)
+		}
+	}
+
+	wait := interval
+	var last time.Time
+	err = b.db.QueryRow("SELECT created_at FROM backups ORDER BY created_at DESC LIMIT 1").Scan(&last)
+	if err == nil {
+		wait = max(interval-time.Since(last), 0)
+	} else if err != sql.ErrNoRows {
+		log.Printf("Failed to find the last backup: %v", err)
+	}
+
+	go func() {
+		time.Sleep(wait)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			if _, err := b.Run(); err != nil && err != errBackupRunning {
+				log.Printf("Scheduled backup failed: %v", err)
+			}
+			<-ticker.C
+		}
+	}()
+}
+
+// Run takes a backup and removes the local ones past the retention. The
+// upload, and the removal of remote backups past the retention once it
+// succeeds, continue in the background.
+func (b *Backups) Run() (Backup, error) {
+	if !b.mu.TryLock() {
+		return Backup{}, errBackupRunning
+	}
+	defer b.mu.Unlock()
+
+	backup, err := b.snapshot()
+	if err != nil {
+		b.notifier.Notify(Event{
+			Type:    EventBackupFailed,
+			Title:   "Backup failed",
+			Message: fmt.Sprintf("The database could not be backed up: %v", err),
+		})
+		return Backup{}, err
+	}
+	if err := b.pruneLocal(); err != nil {
+		log.Printf("Failed to remove old backups: %v", err)
+	}
+	if b.remote != nil {
+		go b.upload(backup)
+	}
+	return backup, nil
+}
+
+// snapshot writes a consistent copy of the database into the backup directory
+// and records it
+func (b *Backups) snapshot() (Backup, error) {
+	if err := os.MkdirAll(b.dir, 0755); err != nil {
+		return Backup{}, err
+	}
+	now := time.Now().UTC()
+	backup := Backup{
+		Filename:     "condo-" + now.Format("20060102T150405Z") + ".db",
+		CreatedAt:    now,
+		RemoteStatus: BackupRemoteNone,
+	}
+	file := filepath.Join(b.dir, backup.Filename)
+	if _, err := b.db.Exec("VACUUM INTO ?", file); err != nil {
+		return Backup{}, err
+	}
+	if err := checkBackupEncrypted(file); err != nil {
+		return Backup{}, err
+	}
+
+	sum, size, err := fileSHA256(file)
+	if err != nil {
+		os.Remove(file)
+		return Backup{}, err
+	}
+	backup.SHA256, backup.Size = sum, size
+	if b.remote != nil {
+		backup.RemoteStatus = BackupRemotePending
+		backup.RemoteURL = b.remote.URL(b.remote.Key(backup.Filename))
+	}
+
+	result, err := b.db.Exec("INSERT INTO backups(filename, size, sha256, remote_status, remote_url, created_at) VALUES(?, ?, ?, ?, ?, ?)",
+		backup.Filename, backup.Size, backup.SHA256, backup.RemoteStatus, backup.RemoteURL, backup.CreatedAt)
+	if err != nil {
+		os.Remove(file)
+		return Backup{}, err
+	}
+	id, _ := result.LastInsertId()
+	backup.ID = int(id)
+	return backup, nil
+}
+
+// upload copies a backup to the remote target, retrying with backoff, and
+// records how it went. The remote backups past the retention are removed once
+// it is there.
+func (b *Backups) upload(backup Backup) {
+	key := b.remote.Key(backup.Filename)
+	file := filepath.Join(b.dir, backup.Filename)
+	delay := backupRetryDelay
+	var err error
+	for attempt := 1; attempt <= backupUploadAttempts; attempt++ {
+		if attempt > 1 {
+			time.Sleep(delay)
+			delay *= 2
+		}
+		err = b.remote.Put(key, file, backup.SHA256)
+		if err == nil {
+			err = b.remote.Verify(key, backup.SHA256, backup.Size)
+		}
+		if err == nil {
+			break
+		}
+		log.Printf("Uploading backup %s failed (attempt %d of %d): %v", backup.Filename, attempt, backupUploadAttempts, err)
+		if _, dbErr := b.db.Exec("UPDATE backups SET upload_attempts = upload_attempts + 1, remote_error = ? WHERE id = ?", err.Error(), backup.ID); dbErr != nil {
+			log.Printf("Failed to record the upload of backup %s: %v", backup.Filename, dbErr)
+		}
+	}
+
+	if err != nil {
+		if _, dbErr := b.db.Exec("UPDATE backups SET remote_status = ? WHERE id = ?", BackupRemoteFailed, backup.ID); dbErr != nil {
+			log.Printf("Failed to record the upload of backup %s: %v", backup.Filename, dbErr)
+		}
+		b.notifier.Notify(Event{
+			Type:    EventBackupFailed,
+			Title:   "Backup upload failed",
+			Message: fmt.Sprintf("Backup %s could not be uploaded to %s after %d attempts: %v", backup.Filename, backup.RemoteURL, backupUploadAttempts, err),
+		})
+		return
+	}
+
+	if _, err := b.db.Exec("UPDATE backups SET remote_status = ?, remote_error = '', upload_attempts = upload_attempts + 1, uploaded_at = ? WHERE id = ?",
+		BackupRemoteUploaded, time.Now().UTC(), backup.ID); err != nil {
+		log.Printf("Failed to record the upload of backup %s: %v", backup.Filename, err)
+	}
+	if err := b.pruneRemote(); err != nil {
+		log.Printf("Failed to remove old remote backups: %v", err)
+	}
+}
+
+// pruneLocal removes the backups in the directory past the newest keep, and
+// the rows of backups whose file is gone. It goes by the files, as after a
+// restore the rows of the newer backups are missing.
+func (b *Backups) pruneLocal() error {
+	if b.keep <= 0 {
+		return nil
+	}
+	entries, err := os.ReadDir(b.dir)
+	if err != nil {
+		return err
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	for _, name := range pastRetention(names, b.keep) {
+		if err := os.Remove(filepath.Join(b.dir, name)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	recorded, err := b.list("")
+	if err != nil {
+		return err
+	}
+	for _, backup := range recorded {
+		if _, err := os.Stat(filepath.Join(b.dir, backup.Filename)); !os.IsNotExist(err) {
+			continue
+		}
+		if _, err := b.db.Exec("DELETE FROM backups WHERE id = ?", backup.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pruneRemote removes the remote backups under the prefix past the newest keep
+func (b *Backups) pruneRemote() error {
+	if b.keep <= 0 {
+		return nil
+	}
+	b.pruneMu.Lock()
+	defer b.pruneMu.Unlock()
+
+	keys, err := b.remote.List()
+	if err != nil {
+		return err
+	}
+	var names []string
+	for _, key := range keys {
+		names = append(names, strings.TrimPrefix(key, b.remote.prefix))
+	}
+	for _, name := range pastRetention(names, b.keep) {
+		if err := b.remote.Delete(b.remote.Key(name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pastRetention returns the backups among names, sorted, but the newest keep.
+// Backups are named after when they were taken, so the newest sort last;
+// other names are left out.
+func pastRetention(names []string, keep int) []string {
+	var backups []string
+	for _, name := range names {
+		if strings.HasPrefix(name, "condo-") && strings.HasSuffix(name, ".db") && !strings.Contains(name, "/") {
+			backups = append(backups, name)
+		}
+	}
+	if len(backups) <= keep {
+		return nil
+	}
+	return backups[:len(backups)-keep]
+}
+
+// list returns the recorded backups matching where, newest first
+func (b *Backups) list(where string, args ...interface{}) ([]Backup, error) {
+	rows, err := b.db.Query(`
+		SELECT id, filename, size, sha256, created_at, remote_status, remote_url, remote_error, upload_attempts, uploaded_at
+		FROM backups `+where+` ORDER BY created_at DESC, id DESC`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	backups := []Backup{}
+	for rows.Next() {
+		var backup Backup
+		var uploadedAt sql.NullTime
+		if err := rows.Scan(&backup.ID, &backup.Filename, &backup.Size, &backup.SHA256, &backup.CreatedAt,
+			&backup.RemoteStatus, &backup.RemoteURL, &backup.RemoteError, &backup.UploadAttempts, &uploadedAt); err != nil {
+			return nil, err
+		}
+		if uploadedAt.Valid {
+			backup.UploadedAt = &uploadedAt.Time
+		}
+		backups = append(backups, backup)
+	}
+	return backups, rows.Err()
+}
+
+// fileSHA256 returns the hex SHA-256 and the size of file
+func fileSHA256(file string) (string, int64, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), size, nil
+}
+
+// fetchBackup writes the backup at from, a file or an s3://bucket/key URL
+// reached with the endpoint and credentials of c, to w. A download is checked
+// against the SHA-256 it was uploaded with.
+func fetchBackup(w io.Writer, from string, c S3Config) error {
+	if !strings.HasPrefix(from, "s3://") {
+		f, err := os.Open(from)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(w, f)
+		return err
+	}
+
+	bucket, key, err := parseS3URL(from)
+	if err != nil {
+		return err
+	}
+	c.Bucket, c.Prefix = bucket, ""
+	target, err := NewS3Target(c)
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	want, err := target.Get(key, io.MultiWriter(w, h))
+	if err != nil {
+		return err
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); want != "" && got != want {
+		return fmt.Errorf("downloaded %s has SHA-256 %s instead of %s", from, got, want)
+	}
+	return nil
+}
+
+// checkBackup checks that file, opened with key, is an intact database of
+// this application
+func checkBackup(file, key string) error {
+	db, err := openSQLite(file, key)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	var result string
+	if err := db.QueryRow("PRAGMA quick_check").Scan(&result); err != nil {
+		return err
+	}
+	if result != "ok" {
+		return fmt.Errorf("integrity check failed: %s", result)
+	}
+	var residents int
+	return db.QueryRow("SELECT COUNT(*) FROM residents").Scan(&residents)
+}
+
+// replaceDatabase moves file over the database. The current database, with
+// its journal files, is moved aside first; the returned path is where, empty
+// if there was none.
+func replaceDatabase(file string) (string, error) {
+	previous := ""
+	if _, err := os.Stat(dbFile); err == nil {
+		stamp := time.Now().Format("20060102T150405")
+		previous = dbFile + ".before-restore-" + stamp
+		for n := 2; ; n++ {
+			if _, err := os.Stat(previous); os.IsNotExist(err) {
+				break
+			}
+			previous = fmt.Sprintf("%s.before-restore-%s-%d", dbFile, stamp, n)
+		}
+		for _, suffix := range []string{"", "-journal", "-wal", "-shm"} {
+			err := os.Rename(dbFile+suffix, previous+suffix)
+			if err != nil && !os.IsNotExist(err) {
+				return "", err
+			}
+		}
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+	return previous, os.Rename(file, dbFile)
+}
+
+// Get the backups, newest first, with the status of their upload
+func getBackups(backups *Backups) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		list, err := backups.list("")
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		respondWithJSON(w, http.StatusOK, list)
+	}
+}
+
+// Take a backup now. It is uploaded in the background.
+func createBackup(backups *Backups) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !backups.Configured() {
+			respondWithError(w, http.StatusBadRequest, "Backups are not configured")
+			return
+		}
+
+		backup, err := backups.Run()
+		if err == errBackupRunning {
+			respondWithError(w, http.StatusConflict, err.Error())
+			return
+		}
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Backup failed: %v", err))
+			return
+		}
+		respondWithJSON(w, http.StatusCreated, backup)
+	}
+}
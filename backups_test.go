@@ -0,0 +1,86 @@
+package condomngr
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCondoBackupsStaySeparate(t *testing.T) {
+	dir := t.TempDir()
+	open := func(name string) *Backups {
+		db, err := OpenDB(filepath.Join(t.TempDir(), name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { db.Close() })
+		backupDir := dir
+		if name != "condo.db" {
+			backupDir = filepath.Join(dir, "condo-2")
+		}
+		return NewBackups(db, backupDir, 1, nil, nil)
+	}
+	main, second := open("condo.db"), open("condo-2.db")
+
+	// The condo's backup goes to its subdirectory, which the default condo's
+	// retention leaves alone
+	if _, err := second.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := main.Run(); err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range []string{dir, filepath.Join(dir, "condo-2")} {
+		entries, err := os.ReadDir(d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var files int
+		for _, entry := range entries {
+			if !entry.IsDir() {
+				files++
+			}
+		}
+		if files != 1 {
+			t.Errorf("%d backups in %s, want 1", files, d)
+		}
+	}
+	for _, b := range []*Backups{main, second} {
+		if list, err := b.list(""); err != nil || len(list) != 1 {
+			t.Errorf("recorded backups %v, %v", list, err)
+		}
+	}
+}
+
+func TestS3TargetUnder(t *testing.T) {
+	target, err := NewS3Target(S3Config{Bucket: "backups", Prefix: "condomngr/", AccessKey: "key", SecretKey: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := target.Under("condo-2/").Key("condo-20240701T030000Z.db"); got != "condomngr/condo-2/condo-20240701T030000Z.db" {
+		t.Errorf("key %q", got)
+	}
+	if got := target.Key("condo-20240701T030000Z.db"); got != "condomngr/condo-20240701T030000Z.db" {
+		t.Errorf("Under changed the original target: key %q", got)
+	}
+	if pastRetention([]string{"condo-2/condo-20240701T030000Z.db", "condo-20240701T030000Z.db"}, 1) != nil {
+		t.Error("a condo's backups count toward the default condo's retention")
+	}
+	var none *S3Target
+	if none.Under("condo-2/") != nil {
+		t.Error("Under of no target isn't nil")
+	}
+}
+
+func TestCondosOpenAll(t *testing.T) {
+	_, condos := newCondosTestServer(t)
+	if err := condos.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := condos.OpenAll(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := condos.servers[2]; !ok || len(condos.servers) != 1 {
+		t.Errorf("open condos %v, want only condo 2", condos.servers)
+	}
+}
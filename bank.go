@@ -0,0 +1,788 @@
+package condomngr
+
+import (
+	"crypto/sha1"
+	"database/sql"
+	"encoding/csv"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Statuses of a bank statement line
+const (
+	BankLineUnmatched   = "unmatched"   // nothing in the app is known to match it
+	BankLineSuggested   = "suggested"   // matched automatically, waiting for review
+	BankLineMatched     = "matched"     // match confirmed; the entry has the line's reference
+	BankLineDiscrepancy = "discrepancy" // flagged during review, see the note
+)
+
+// bankMatchDays is how many days apart a statement line and a payment or
+// expense can be dated and still be matched automatically
+const bankMatchDays = 7
+
+// BankAccount is an account whose statements are reconciled with the app
+type BankAccount struct {
+	ID        int       `json:"id"`
+	Name      string    `json:"name"`
+	IBAN      string    `json:"iban"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// BankLine is a line of a bank statement. Money in has a positive amount and
+// matches payments; money out has a negative one and matches expenses.
+type BankLine struct {
+	ID               int       `json:"id"`
+	AccountID        int       `json:"account_id"`
+	LineDate         string    `json:"line_date"`
+	Amount           float64   `json:"amount"`
+	Description      string    `json:"description"`
+	Reference        string    `json:"reference"`
+	Status           string    `json:"status"`
+	EntityType       string    `json:"entity_type,omitempty"` // payment or expense, when suggested or matched
+	EntityID         int       `json:"entity_id,omitempty"`
+	Note             string    `json:"note,omitempty"`
+	PaymentRequestID int       `json:"payment_request_id,omitempty"` // whose reference the line quotes
+	CreatedAt        time.Time `json:"created_at"`
+}
+
+const bankLineColumns = "id, account_id, line_date, amount, description, reference, status, entity_type, entity_id, note, payment_request_id, created_at"
+
+func scanBankLineRow(row interface{ Scan(...interface{}) error }) (BankLine, error) {
+	var line BankLine
+	err := row.Scan(&line.ID, &line.AccountID, &line.LineDate, &line.Amount, &line.Description, &line.Reference,
+		&line.Status, &line.EntityType, &line.EntityID, &line.Note, &line.PaymentRequestID, &line.CreatedAt)
+	return line, err
+}
+
+// StatementImport reports what an uploaded statement added
+type StatementImport struct {
+	AccountID  int `json:"account_id"`
+	Lines      int `json:"lines"`
+	Imported   int `json:"imported"`
+	Duplicates int `json:"duplicates"` // already imported from an earlier statement
+	Suggested  int `json:"suggested"`  // lines of the account matched automatically
+}
+
+// BankLineReview is a decision on a statement line:
+//   - confirm accepts the suggested match, or the entry given by entity_type
+//     and entity_id, and stores the line's reference on it
+//   - create records the missing payment (for resident_id, by default the
+//     resident of the line's payment request) or expense (in category) from
+//     the line and matches it
+//   - flag marks the line as a discrepancy, explained by note
+//   - reject drops the line's match, confirmed or not
+type BankLineReview struct {
+	Action     string `json:"action"`
+	EntityType string `json:"entity_type"`
+	EntityID   int    `json:"entity_id"`
+	ResidentID int    `json:"resident_id"`
+	Method     string `json:"method"`
+	Category   string `json:"category"`
+	Note       string `json:"note"`
+}
+
+// ReconciliationEntry is a payment or expense of the month not matched with
+// any statement line. Expenses have negative amounts, like on the statement.
+type ReconciliationEntry struct {
+	EntityType  string  `json:"entity_type"`
+	EntityID    int     `json:"entity_id"`
+	Date        string  `json:"date"`
+	Amount      float64 `json:"amount"`
+	Description string  `json:"description"`
+}
+
+// ReconciliationReport is how far a month of an account is reconciled. The
+// month is done when nothing is left unmatched on either side.
+type ReconciliationReport struct {
+	AccountID       int                   `json:"account_id"`
+	Month           string                `json:"month"`
+	Matched         int                   `json:"matched"`
+	MatchedAmount   float64               `json:"matched_amount"`
+	UnmatchedInBank []BankLine            `json:"unmatched_in_bank"`
+	UnmatchedInApp  []ReconciliationEntry `json:"unmatched_in_app"`
+	Done            bool                  `json:"done"`
+}
+
+// Validation function for BankAccount data
+func validateBankAccount(a BankAccount) error {
+	var errs ValidationErrors
+	if strings.TrimSpace(a.Name) == "" {
+		errs.Add("name", "name is required")
+	}
+	return errs.Err()
+}
+
+// parseStatement reads the lines of a statement CSV. The header names the
+// columns: date (YYYY-MM-DD) and amount are required, description and
+// reference optional. Lines without a reference get one derived from their
+// content, so uploading the same statement twice imports nothing new.
+func parseStatement(r io.Reader) ([]BankLine, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, errors.New("statement is empty")
+	}
+	if err != nil {
+		return nil, err
+	}
+	columns := map[string]int{}
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))] = i
+	}
+	for _, name := range []string{"date", "amount"} {
+		if _, ok := columns[name]; !ok {
+			return nil, fmt.Errorf("statement has no %s column", name)
+		}
+	}
+	field := func(record []string, name string) string {
+		if i, ok := columns[name]; ok && i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+
+	var lines []BankLine
+	var errs ValidationErrors
+	seen := map[string]int{}
+	for n := 2; ; n++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		line := BankLine{
+			LineDate:    normalizeDate(field(record, "date")),
+			Description: field(record, "description"),
+			Reference:   field(record, "reference"),
+		}
+		if _, err := time.Parse("2006-01-02", line.LineDate); err != nil {
+			errs.Add(fmt.Sprintf("line %d", n), "invalid date format, must be YYYY-MM-DD")
+			continue
+		}
+		amount, err := strconv.ParseFloat(field(record, "amount"), 64)
+		if err != nil || roundCents(amount) == 0 {
+			errs.Add(fmt.Sprintf("line %d", n), "amount must be a non-zero number")
+			continue
+		}
+		line.Amount = roundCents(amount)
+		if line.Reference == "" {
+			key := fmt.Sprintf("%s|%.2f|%s", line.LineDate, line.Amount, line.Description)
+			seen[key]++
+			sum := sha1.Sum([]byte(fmt.Sprintf("%s|%d", key, seen[key])))
+			line.Reference = "line-" + hex.EncodeToString(sum[:8])
+		}
+		lines = append(lines, line)
+	}
+	if err := errs.Err(); err != nil {
+		return nil, err
+	}
+	return lines, nil
+}
+
+// bankEntityType is the kind of entry a line of amount matches
+func bankEntityType(amount float64) string {
+	if amount > 0 {
+		return "payment"
+	}
+	return "expense"
+}
+
+func bankEntityTable(entityType string) string {
+	if entityType == "payment" {
+		return "payments"
+	}
+	return "expenses"
+}
+
+// matchBankLines suggests a payment or expense for each unmatched line of an
+// account: one of the same amount dated at most bankMatchDays away, the
+// closest first, that isn't reconciled or suggested for another line yet.
+// Cheques not cleared yet can match too, but not bounced ones. Money in that
+// quotes the reference of a payment request only matches payments of its
+// resident, however far apart they are dated, and records the request. It
+// returns the number of lines suggested.
+func matchBankLines(q querier, accountID int) (int, error) {
+	rows, err := q.Query("SELECT "+bankLineColumns+" FROM bank_lines WHERE account_id = ? AND status = ? ORDER BY line_date, id", accountID, BankLineUnmatched)
+	if err != nil {
+		return 0, err
+	}
+	var lines []BankLine
+	for rows.Next() {
+		line, err := scanBankLineRow(rows)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		lines = append(lines, line)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	suggested := 0
+	for _, line := range lines {
+		entityType := bankEntityType(line.Amount)
+		query, args := `
+				SELECT e.id FROM payments e
+				WHERE e.status IN (?4, ?5) AND abs(e.amount - ?1) < 0.005 AND e.bank_reference = ''
+					AND abs(julianday(substr(e.payment_date, 1, 10)) - julianday(?2)) <= ?3
+					AND NOT EXISTS (SELECT 1 FROM bank_lines l WHERE l.entity_type = 'payment' AND l.entity_id = e.id AND l.status IN ('suggested', 'matched'))
+				ORDER BY abs(julianday(substr(e.payment_date, 1, 10)) - julianday(?2)), e.id
+				LIMIT 1`, []interface{}{line.Amount, line.LineDate, bankMatchDays, PaymentStatusConfirmed, PaymentStatusPending}
+		if entityType == "payment" {
+			requestID, residentID, err := bankLinePaymentRequest(q, line)
+			if err != nil {
+				return 0, err
+			}
+			if requestID != 0 {
+				if _, err := q.Exec("UPDATE bank_lines SET payment_request_id = ? WHERE id = ?", requestID, line.ID); err != nil {
+					return 0, err
+				}
+				query = `
+				SELECT e.id FROM payments e
+				WHERE e.status IN (?3, ?4) AND abs(e.amount - ?1) < 0.005 AND e.bank_reference = '' AND e.resident_id = ?5
+					AND NOT EXISTS (SELECT 1 FROM bank_lines l WHERE l.entity_type = 'payment' AND l.entity_id = e.id AND l.status IN ('suggested', 'matched'))
+				ORDER BY abs(julianday(substr(e.payment_date, 1, 10)) - julianday(?2)), e.id
+				LIMIT 1`
+				args = []interface{}{line.Amount, line.LineDate, PaymentStatusConfirmed, PaymentStatusPending, residentID}
+			}
+		}
+		if entityType == "expense" {
+			query, args = `
+				SELECT e.id FROM expenses e
+				WHERE abs(e.amount + ?1) < 0.005 AND e.bank_reference = ''
+					AND abs(julianday(substr(e.expense_date, 1, 10)) - julianday(?2)) <= ?3
+					AND NOT EXISTS (SELECT 1 FROM bank_lines l WHERE l.entity_type = 'expense' AND l.entity_id = e.id AND l.status IN ('suggested', 'matched'))
+				ORDER BY abs(julianday(substr(e.expense_date, 1, 10)) - julianday(?2)), e.id
+				LIMIT 1`, []interface{}{line.Amount, line.LineDate, bankMatchDays}
+		}
+		var entityID int
+		err := q.QueryRow(query, args...).Scan(&entityID)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		_, err = q.Exec("UPDATE bank_lines SET status = ?, entity_type = ?, entity_id = ? WHERE id = ?", BankLineSuggested, entityType, entityID, line.ID)
+		if err != nil {
+			return 0, err
+		}
+		suggested++
+	}
+	return suggested, nil
+}
+
+// unlinkBankLines drops the matches of lines whose payment or expense is gone,
+// or no longer has the line's reference, such as after an import
+func unlinkBankLines(q querier) error {
+	_, err := q.Exec(`
+		UPDATE bank_lines SET status = ?1, entity_type = '', entity_id = 0
+		WHERE (entity_type = 'payment' AND NOT EXISTS (
+				SELECT 1 FROM payments e WHERE e.id = bank_lines.entity_id AND (bank_lines.status != ?2 OR e.bank_reference = bank_lines.reference)))
+			OR (entity_type = 'expense' AND NOT EXISTS (
+				SELECT 1 FROM expenses e WHERE e.id = bank_lines.entity_id AND (bank_lines.status != ?2 OR e.bank_reference = bank_lines.reference)))
+	`, BankLineUnmatched, BankLineMatched)
+	return err
+}
+
+// bankAccountID reads the account of the request, answering 404 when it is
+// missing
+func bankAccountID(w http.ResponseWriter, r *http.Request, db *sql.DB) (int, bool) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid bank account ID")
+		return 0, false
+	}
+	var exists bool
+	if err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM bank_accounts WHERE id = ?)", id).Scan(&exists); err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return 0, false
+	}
+	if !exists {
+		respondWithError(w, http.StatusNotFound, "Bank account not found")
+		return 0, false
+	}
+	return id, true
+}
+
+// Handlers for bank account endpoints
+func getBankAccounts(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rows, err := db.Query("SELECT id, name, iban, created_at FROM bank_accounts ORDER BY name")
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		defer rows.Close()
+
+		accounts := []BankAccount{}
+		for rows.Next() {
+			var account BankAccount
+			if err := rows.Scan(&account.ID, &account.Name, &account.IBAN, &account.CreatedAt); err != nil {
+				respondWithError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			accounts = append(accounts, account)
+		}
+
+		respondWithJSON(w, http.StatusOK, accounts)
+	}
+}
+
+func createBankAccount(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var account BankAccount
+		if err := decodeRequest(r, &account); err != nil {
+			respondWithError(w, payloadErrorStatus(err), "Invalid request payload: "+err.Error())
+			return
+		}
+		defer r.Body.Close()
+
+		account.Name = strings.TrimSpace(account.Name)
+		account.IBAN = strings.ToUpper(strings.ReplaceAll(account.IBAN, " ", ""))
+		if err := validateBankAccount(account); err != nil {
+			respondWithValidationError(w, err)
+			return
+		}
+
+		result, err := db.Exec("INSERT INTO bank_accounts(name, iban) VALUES(?, ?)", account.Name, account.IBAN)
+		if isUniqueViolation(err) {
+			respondWithError(w, http.StatusConflict, "A bank account with this name already exists")
+			return
+		}
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		id, err := result.LastInsertId()
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		account.ID = int(id)
+		respondWithJSON(w, http.StatusCreated, account)
+	}
+}
+
+// Upload a statement CSV for an account (multipart field statementFile). Lines
+// already imported are skipped, then the account's unmatched lines are
+// matched automatically.
+func importBankStatement(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := bankAccountID(w, r, db)
+		if !ok {
+			return
+		}
+
+		if err := r.ParseMultipartForm(10 << 20); err != nil {
+			if payloadErrorStatus(err) == http.StatusRequestEntityTooLarge {
+				respondWithError(w, http.StatusRequestEntityTooLarge, "Statement file is too large")
+				return
+			}
+			respondWithError(w, http.StatusBadRequest, "Unable to parse form")
+			return
+		}
+		file, _, err := r.FormFile("statementFile")
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Error retrieving statement file")
+			return
+		}
+		defer file.Close()
+
+		lines, err := parseStatement(file)
+		if err != nil {
+			var fields ValidationErrors
+			if errors.As(err, &fields) {
+				respondWithValidationError(w, err)
+				return
+			}
+			respondWithError(w, http.StatusBadRequest, "Invalid statement file: "+err.Error())
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		defer tx.Rollback()
+
+		result := StatementImport{AccountID: id, Lines: len(lines)}
+		stmt, err := tx.Prepare("INSERT OR IGNORE INTO bank_lines(account_id, line_date, amount, description, reference) VALUES(?, ?, ?, ?, ?)")
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		defer stmt.Close()
+		for _, line := range lines {
+			res, err := stmt.Exec(id, line.LineDate, line.Amount, line.Description, line.Reference)
+			if err != nil {
+				respondWithError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			if n, _ := res.RowsAffected(); n > 0 {
+				result.Imported++
+			} else {
+				result.Duplicates++
+			}
+		}
+		if result.Suggested, err = matchBankLines(tx, id); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		respondWithJSON(w, http.StatusOK, result)
+	}
+}
+
+// Get the statement lines of an account, optionally of one status or month
+func getBankLines(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := checkQueryParams(r, "status", "month"); err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		id, ok := bankAccountID(w, r, db)
+		if !ok {
+			return
+		}
+		status := r.URL.Query().Get("status")
+		switch status {
+		case "", BankLineUnmatched, BankLineSuggested, BankLineMatched, BankLineDiscrepancy:
+		default:
+			respondWithError(w, http.StatusBadRequest, "Invalid status, must be unmatched, suggested, matched or discrepancy")
+			return
+		}
+		month := r.URL.Query().Get("month")
+		if month != "" {
+			if _, err := time.Parse("2006-01", month); err != nil {
+				respondWithError(w, http.StatusBadRequest, "invalid month format, must be YYYY-MM")
+				return
+			}
+		}
+
+		rows, err := db.Query("SELECT "+bankLineColumns+` FROM bank_lines
+			WHERE account_id = ?1 AND (?2 = '' OR status = ?2) AND (?3 = '' OR substr(line_date, 1, 7) = ?3)
+			ORDER BY line_date, id`, id, status, month)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		defer rows.Close()
+
+		lines := []BankLine{}
+		for rows.Next() {
+			line, err := scanBankLineRow(rows)
+			if err != nil {
+				respondWithError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			lines = append(lines, line)
+		}
+
+		respondWithJSON(w, http.StatusOK, lines)
+	}
+}
+
+// Review a statement line: confirm its match, create the missing entry, flag
+// a discrepancy or reject the match
+func reviewBankLine(db *sql.DB, receipts *ReceiptQueue, changes *ChangeBroker, rules paymentRules) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id, err := strconv.Atoi(vars["id"])
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid bank line ID")
+			return
+		}
+
+		var review BankLineReview
+		if err := decodeRequest(r, &review); err != nil {
+			respondWithError(w, payloadErrorStatus(err), "Invalid request payload: "+err.Error())
+			return
+		}
+		defer r.Body.Close()
+
+		tx, err := db.Begin()
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		defer tx.Rollback()
+
+		line, err := scanBankLineRow(tx.QueryRow("SELECT "+bankLineColumns+" FROM bank_lines WHERE id = ?", id))
+		if err == sql.ErrNoRows {
+			respondWithError(w, http.StatusNotFound, "Bank line not found")
+			return
+		}
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		// Whatever the decision, a confirmed match no longer stands as it was
+		if line.Status == BankLineMatched {
+			_, err := tx.Exec("UPDATE "+bankEntityTable(line.EntityType)+" SET bank_reference = '' WHERE id = ? AND bank_reference = ?", line.EntityID, line.Reference)
+			if err != nil {
+				respondWithError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+		}
+
+		entityType := bankEntityType(line.Amount)
+		var errs ValidationErrors
+		switch review.Action {
+		case "confirm":
+			if review.EntityID == 0 && review.EntityType == "" {
+				if line.EntityID == 0 {
+					errs.Add("entity_id", "the line has no suggested match, entity_type and entity_id are required")
+					break
+				}
+				review.EntityType, review.EntityID = line.EntityType, line.EntityID
+			}
+			if review.EntityType != entityType {
+				errs.Add("entity_type", fmt.Sprintf("a line of %.2f can only match a %s", line.Amount, entityType))
+				break
+			}
+			var amount float64
+			var bankReference string
+			err := tx.QueryRow("SELECT amount, bank_reference FROM "+bankEntityTable(entityType)+" WHERE id = ?", review.EntityID).Scan(&amount, &bankReference)
+			if err == sql.ErrNoRows {
+				errs.Add("entity_id", entityType+" not found")
+				break
+			}
+			if err != nil {
+				respondWithError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			if bankReference != "" {
+				errs.Add("entity_id", entityType+" is already matched with bank line "+bankReference)
+			}
+			if roundCents(amount) != roundCents(max(line.Amount, -line.Amount)) {
+				errs.Add("entity_id", fmt.Sprintf("the %s is of %.2f, not %.2f; flag the line as a discrepancy instead", entityType, amount, max(line.Amount, -line.Amount)))
+			}
+		case "create":
+			if entityType == "payment" {
+				if review.ResidentID == 0 && line.PaymentRequestID != 0 {
+					err := tx.QueryRow("SELECT resident_id FROM payment_requests WHERE id = ?", line.PaymentRequestID).Scan(&review.ResidentID)
+					if err != nil && err != sql.ErrNoRows {
+						respondWithError(w, http.StatusInternalServerError, err.Error())
+						return
+					}
+				}
+				payment := Payment{ResidentID: review.ResidentID, Amount: line.Amount, Description: line.Description, PaymentDate: line.LineDate, Method: review.Method}
+				if payment.Method == "" {
+					payment.Method = "transfer"
+				}
+				if payment.Method == "check" {
+					payment.ChequeStatus = ChequePending // cleared below, by the line
+				}
+				if err := validatePayment(payment); err != nil {
+					respondWithValidationError(w, err)
+					return
+				}
+				var exists bool
+				if err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM residents WHERE id = ?)", payment.ResidentID).Scan(&exists); err != nil {
+					respondWithError(w, http.StatusInternalServerError, err.Error())
+					return
+				}
+				if !exists {
+					errs.Add("resident_id", "resident does not exist")
+					break
+				}
+				result, err := tx.Exec("INSERT INTO payments(resident_id, amount, description, payment_date, method, status, cheque_status) VALUES(?, ?, ?, ?, ?, ?, ?)",
+					payment.ResidentID, payment.Amount, payment.Description, payment.PaymentDate, payment.Method, paymentStatus(payment, rules), payment.ChequeStatus)
+				if err != nil {
+					respondWithError(w, http.StatusInternalServerError, err.Error())
+					return
+				}
+				newID, _ := result.LastInsertId()
+				review.EntityID = int(newID)
+				if err := reallocate(tx, rules, payment.ResidentID); err != nil {
+					respondWithError(w, http.StatusInternalServerError, err.Error())
+					return
+				}
+				if err := tagReserve(tx); err != nil {
+					respondWithError(w, http.StatusInternalServerError, err.Error())
+					return
+				}
+			} else {
+				expense := Expense{Amount: -line.Amount, Description: line.Description, ExpenseDate: line.LineDate, Category: review.Category}
+				if expense.Description == "" {
+					expense.Description = "Bank line " + line.Reference
+				}
+				if review.Category == "" {
+					errs.Add("category", "category is required to create an expense")
+					break
+				}
+				if err := validateExpense(expense); err != nil {
+					respondWithValidationError(w, err)
+					return
+				}
+				result, err := tx.Exec("INSERT INTO expenses(amount, description, expense_date, category) VALUES(?, ?, ?, ?)",
+					expense.Amount, expense.Description, expense.ExpenseDate, expense.Category)
+				if err != nil {
+					respondWithError(w, http.StatusInternalServerError, err.Error())
+					return
+				}
+				newID, _ := result.LastInsertId()
+				review.EntityID = int(newID)
+			}
+			review.EntityType = entityType
+		case "flag":
+			if strings.TrimSpace(review.Note) == "" {
+				errs.Add("note", "note is required to flag a discrepancy")
+			}
+		case "reject":
+		default:
+			errs.Add("action", "action must be one of confirm, create, flag or reject")
+		}
+		if err := errs.Err(); err != nil {
+			respondWithValidationError(w, err)
+			return
+		}
+
+		switch review.Action {
+		case "confirm", "create":
+			line.Status, line.EntityType, line.EntityID = BankLineMatched, review.EntityType, review.EntityID
+			_, err = tx.Exec("UPDATE "+bankEntityTable(line.EntityType)+" SET bank_reference = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?", line.Reference, line.EntityID)
+			if err == nil && line.EntityType == "payment" {
+				// A cheque on the statement has cleared
+				err = clearChequeOnStatement(tx, rules, line.EntityID, line.LineDate)
+			}
+			if err == nil && review.Action == "create" && line.EntityType == "payment" {
+				err = queueReceipts(tx, line.EntityID)
+			}
+			if err == nil {
+				// Other lines the entry was suggested for are open again
+				_, err = tx.Exec("UPDATE bank_lines SET status = ?, entity_type = '', entity_id = 0 WHERE status = ? AND entity_type = ? AND entity_id = ? AND id != ?",
+					BankLineUnmatched, BankLineSuggested, line.EntityType, line.EntityID, line.ID)
+			}
+		case "flag":
+			line.Status, line.Note = BankLineDiscrepancy, strings.TrimSpace(review.Note)
+		case "reject":
+			line.Status, line.EntityType, line.EntityID = BankLineUnmatched, "", 0
+		}
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		_, err = tx.Exec("UPDATE bank_lines SET status = ?, entity_type = ?, entity_id = ?, note = ? WHERE id = ?",
+			line.Status, line.EntityType, line.EntityID, line.Note, line.ID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		switch review.Action {
+		case "confirm":
+			changes.Publish(Change{Type: line.EntityType, ID: line.EntityID, Action: ChangeUpdated})
+		case "create":
+			changes.Publish(Change{Type: line.EntityType, ID: line.EntityID, Action: ChangeCreated})
+			receipts.Wake()
+		}
+
+		respondWithJSON(w, http.StatusOK, line)
+	}
+}
+
+// Get how far a month of an account is reconciled: the lines matched, the
+// lines nothing in the app matches yet, and the payments and expenses of the
+// month not matched with any account's statement
+func getReconciliationReport(db *sql.DB, cal calendar) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := checkQueryParams(r, "month"); err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		id, ok := bankAccountID(w, r, db)
+		if !ok {
+			return
+		}
+		month := r.URL.Query().Get("month")
+		if month == "" {
+			month = cal.now().Format("2006-01")
+		}
+		if _, err := time.Parse("2006-01", month); err != nil {
+			respondWithError(w, http.StatusBadRequest, "invalid month format, must be YYYY-MM")
+			return
+		}
+
+		report := ReconciliationReport{AccountID: id, Month: month, UnmatchedInBank: []BankLine{}, UnmatchedInApp: []ReconciliationEntry{}}
+		rows, err := db.Query("SELECT "+bankLineColumns+" FROM bank_lines WHERE account_id = ? AND substr(line_date, 1, 7) = ? ORDER BY line_date, id", id, month)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		for rows.Next() {
+			line, err := scanBankLineRow(rows)
+			if err != nil {
+				rows.Close()
+				respondWithError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			if line.Status == BankLineMatched {
+				report.Matched++
+				report.MatchedAmount = roundCents(report.MatchedAmount + line.Amount)
+				continue
+			}
+			report.UnmatchedInBank = append(report.UnmatchedInBank, line)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		rows, err = db.Query(`
+			SELECT 'payment', id, substr(payment_date, 1, 10) AS date, amount, description FROM payments
+			WHERE status IN (?2, ?3) AND bank_reference = '' AND substr(payment_date, 1, 7) = ?1
+			UNION ALL
+			SELECT 'expense', id, substr(expense_date, 1, 10), -amount, description FROM expenses
+			WHERE bank_reference = '' AND substr(expense_date, 1, 7) = ?1
+			ORDER BY date, 1, 2
+		`, month, PaymentStatusConfirmed, PaymentStatusPending)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var entry ReconciliationEntry
+			if err := rows.Scan(&entry.EntityType, &entry.EntityID, &entry.Date, &entry.Amount, &entry.Description); err != nil {
+				respondWithError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			report.UnmatchedInApp = append(report.UnmatchedInApp, entry)
+		}
+		if err := rows.Err(); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		report.Done = len(report.UnmatchedInBank) == 0 && len(report.UnmatchedInApp) == 0
+
+		respondWithJSON(w, http.StatusOK, report)
+	}
+}
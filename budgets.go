@@ -0,0 +1,499 @@
+package condomngr
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gorilla/mux"
+)
+
+// Budget is what is planned to be spent on a category of expenses over a
+// fiscal year. The annual amount is spread evenly over its months, except the
+// months given a budget of their own.
+type Budget struct {
+	Year      int                `json:"year"`
+	Category  string             `json:"category"`
+	Amount    float64            `json:"amount"` // for the whole fiscal year
+	Months    map[string]float64 `json:"months"` // budgets of single months by YYYY-MM, instead of their share of amount
+	UpdatedAt time.Time          `json:"updated_at"`
+}
+
+// BudgetExpense is an expense counted in the actual spending of a month
+type BudgetExpense struct {
+	ID          int     `json:"id"`
+	ExpenseDate string  `json:"expense_date"`
+	Description string  `json:"description"`
+	Amount      float64 `json:"amount"`
+}
+
+// BudgetMonth compares what was budgeted and spent in a month; a positive
+// variance is spending over budget
+type BudgetMonth struct {
+	Month    string          `json:"month"` // YYYY-MM
+	Budgeted float64         `json:"budgeted"`
+	Actual   float64         `json:"actual"`
+	Variance float64         `json:"variance"`
+	Expenses []BudgetExpense `json:"expenses"`
+}
+
+// BudgetLine compares what was budgeted and spent on a category over a
+// fiscal year
+type BudgetLine struct {
+	Category        string        `json:"category"`
+	Budgeted        float64       `json:"budgeted"`
+	Actual          float64       `json:"actual"`
+	Variance        float64       `json:"variance"`
+	VariancePercent *float64      `json:"variance_percent"` // of the budget, null without one
+	Months          []BudgetMonth `json:"months,omitempty"`
+}
+
+// BudgetReport compares budget and actual spending per category over a
+// fiscal year
+type BudgetReport struct {
+	Year       int          `json:"year"`
+	StartDate  string       `json:"start_date"`
+	EndDate    string       `json:"end_date"`
+	Categories []BudgetLine `json:"categories"`
+	Budgeted   float64      `json:"budgeted"`
+	Actual     float64      `json:"actual"`
+	Variance   float64      `json:"variance"`
+}
+
+// BudgetDrillDown is the budget line of one category, month by month
+type BudgetDrillDown struct {
+	Year      int    `json:"year"`
+	StartDate string `json:"start_date"`
+	EndDate   string `json:"end_date"`
+	BudgetLine
+}
+
+// Validation function for Budget data
+func validateBudget(b Budget, cal calendar) error {
+	var errs ValidationErrors
+	if strings.TrimSpace(b.Category) == "" {
+		errs.Add("category", "category is required")
+	}
+	if b.Amount < 0 {
+		errs.Add("amount", "amount must not be negative")
+	}
+	months := cal.fiscalYearMonths(b.Year)
+	for month, amount := range b.Months {
+		if !slices.Contains(months, month) {
+			errs.Add("months", "months must be YYYY-MM months of the fiscal year")
+			break
+		}
+		if amount < 0 {
+			errs.Add("months", "monthly budgets must not be negative")
+			break
+		}
+	}
+	return errs.Err()
+}
+
+// fiscalYearMonths returns the months of a fiscal year as YYYY-MM, in order
+func (c calendar) fiscalYearMonths(year int) []string {
+	start, _ := c.fiscalYearRange(year)
+	months := make([]string, 12)
+	for i := range months {
+		months[i] = start.AddDate(0, i, 0).Format("2006-01")
+	}
+	return months
+}
+
+// budgetPathYear reads the fiscal year from the path
+func budgetPathYear(r *http.Request) (int, error) {
+	year, err := strconv.Atoi(mux.Vars(r)["year"])
+	if err != nil || year < 1900 || year > 9999 {
+		return 0, fmt.Errorf("invalid year, must be YYYY")
+	}
+	return year, nil
+}
+
+// loadBudgets returns the budgets of a fiscal year, by category
+func loadBudgets(q querier, year int) ([]Budget, error) {
+	rows, err := q.Query("SELECT category, month, amount, updated_at FROM budgets WHERE year = ? ORDER BY category, month", year)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	budgets := []Budget{}
+	for rows.Next() {
+		var category, month string
+		var amount float64
+		var updatedAt time.Time
+		if err := rows.Scan(&category, &month, &amount, &updatedAt); err != nil {
+			return nil, err
+		}
+		if len(budgets) == 0 || budgets[len(budgets)-1].Category != category {
+			budgets = append(budgets, Budget{Year: year, Category: category, Months: map[string]float64{}})
+		}
+		b := &budgets[len(budgets)-1]
+		if month == "" {
+			b.Amount = amount
+		} else {
+			b.Months[month] = amount
+		}
+		if updatedAt.After(b.UpdatedAt) {
+			b.UpdatedAt = updatedAt
+		}
+	}
+	return budgets, rows.Err()
+}
+
+// budgetMonths spreads a budget over the months of its fiscal year. Months
+// with a budget of their own keep it; what is left of the annual amount is
+// split evenly over the others, the last of them taking the cents that don't
+// divide, so the months add up to the annual amount.
+func budgetMonths(b Budget, months []string) []float64 {
+	budgeted := make([]float64, len(months))
+	rest := b.Amount
+	var spread []int
+	for i, month := range months {
+		if amount, ok := b.Months[month]; ok {
+			budgeted[i] = roundCents(amount)
+			rest -= amount
+		} else {
+			spread = append(spread, i)
+		}
+	}
+	if rest <= 0 || len(spread) == 0 {
+		return budgeted
+	}
+	share := roundCents(rest / float64(len(spread)))
+	for _, i := range spread {
+		budgeted[i] = share
+	}
+	budgeted[spread[len(spread)-1]] = roundCents(rest - share*float64(len(spread)-1))
+	return budgeted
+}
+
+// budgetLine compares a category's budget, nil without one, with its
+// expenses over the months of a fiscal year. The totals are the sums of the
+// months.
+func budgetLine(category string, budget *Budget, expenses []BudgetExpense, months []string) BudgetLine {
+	line := BudgetLine{Category: category, Months: make([]BudgetMonth, len(months))}
+	var budgeted []float64
+	if budget != nil {
+		budgeted = budgetMonths(*budget, months)
+	}
+	for i, month := range months {
+		m := BudgetMonth{Month: month, Expenses: []BudgetExpense{}}
+		if budgeted != nil {
+			m.Budgeted = budgeted[i]
+		}
+		for _, e := range expenses {
+			if strings.HasPrefix(e.ExpenseDate, month) {
+				m.Actual = roundCents(m.Actual + e.Amount)
+				m.Expenses = append(m.Expenses, e)
+			}
+		}
+		m.Variance = roundCents(m.Actual - m.Budgeted)
+		line.Months[i] = m
+		line.Budgeted = roundCents(line.Budgeted + m.Budgeted)
+		line.Actual = roundCents(line.Actual + m.Actual)
+	}
+	line.Variance = roundCents(line.Actual - line.Budgeted)
+	if line.Budgeted != 0 {
+		percent := math.Round(line.Variance/line.Budgeted*1000) / 10
+		line.VariancePercent = &percent
+	}
+	return line
+}
+
+// budgetReport compares the budgets of a fiscal year with its expenses, for
+// every category with either, months included
+func budgetReport(q querier, year int, cal calendar) (BudgetReport, error) {
+	report := BudgetReport{Year: year, Categories: []BudgetLine{}}
+	report.StartDate, report.EndDate = cal.fiscalYearDates(year)
+
+	budgets, err := loadBudgets(q, year)
+	if err != nil {
+		return report, err
+	}
+	byCategory := map[string]*Budget{}
+	for i := range budgets {
+		byCategory[budgets[i].Category] = &budgets[i]
+	}
+
+	rows, err := q.Query(`
+		SELECT id, substr(expense_date, 1, 10), description, amount, category
+		FROM expenses
+		WHERE substr(expense_date, 1, 10) BETWEEN ? AND ?
+		ORDER BY expense_date, id
+	`, report.StartDate, report.EndDate)
+	if err != nil {
+		return report, err
+	}
+	defer rows.Close()
+	expenses := map[string][]BudgetExpense{}
+	for rows.Next() {
+		var e BudgetExpense
+		var category string
+		if err := rows.Scan(&e.ID, &e.ExpenseDate, &e.Description, &e.Amount, &category); err != nil {
+			return report, err
+		}
+		expenses[category] = append(expenses[category], e)
+	}
+	if err := rows.Err(); err != nil {
+		return report, err
+	}
+
+	var categories []string
+	for category := range byCategory {
+		categories = append(categories, category)
+	}
+	for category := range expenses {
+		if byCategory[category] == nil {
+			categories = append(categories, category)
+		}
+	}
+	sort.Strings(categories)
+
+	months := cal.fiscalYearMonths(year)
+	for _, category := range categories {
+		line := budgetLine(category, byCategory[category], expenses[category], months)
+		report.Categories = append(report.Categories, line)
+		report.Budgeted = roundCents(report.Budgeted + line.Budgeted)
+		report.Actual = roundCents(report.Actual + line.Actual)
+	}
+	report.Variance = roundCents(report.Actual - report.Budgeted)
+	return report, nil
+}
+
+// budgetFilename makes a category safe to use in a file name
+func budgetFilename(category string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '-' {
+			return r
+		}
+		return '_'
+	}, category)
+}
+
+// Handlers for budget endpoints
+
+// Get the budgets of a fiscal year
+func getBudgets(db *sql.DB, cal calendar) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := checkQueryParams(r, "year"); err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		year, err := statementYear(r, cal)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		budgets, err := loadBudgets(db, year)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		respondWithJSON(w, http.StatusOK, budgets)
+	}
+}
+
+// Set the budget of a category for a fiscal year, replacing its monthly
+// budgets
+func setBudget(db *sql.DB, cal calendar) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		year, err := budgetPathYear(r)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		var b Budget
+		if err := decodeRequest(r, &b); err != nil {
+			respondWithError(w, payloadErrorStatus(err), "Invalid request payload: "+err.Error())
+			return
+		}
+		defer r.Body.Close()
+
+		b.Year, b.Category = year, mux.Vars(r)["category"]
+		if err := validateBudget(b, cal); err != nil {
+			respondWithValidationError(w, err)
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		defer tx.Rollback()
+
+		if _, err := tx.Exec("DELETE FROM budgets WHERE year = ? AND category = ?", b.Year, b.Category); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if _, err := tx.Exec("INSERT INTO budgets(year, category, month, amount) VALUES(?, ?, '', ?)", b.Year, b.Category, b.Amount); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		for month, amount := range b.Months {
+			if _, err := tx.Exec("INSERT INTO budgets(year, category, month, amount) VALUES(?, ?, ?, ?)", b.Year, b.Category, month, amount); err != nil {
+				respondWithError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+		}
+
+		budgets, err := loadBudgets(tx, b.Year)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		for _, saved := range budgets {
+			if saved.Category == b.Category {
+				respondWithJSON(w, http.StatusOK, saved)
+				return
+			}
+		}
+	}
+}
+
+// Delete the budget of a category for a fiscal year, monthly budgets
+// included
+func deleteBudget(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		year, err := budgetPathYear(r)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		result, err := db.Exec("DELETE FROM budgets WHERE year = ? AND category = ?", year, mux.Vars(r)["category"])
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			respondWithError(w, http.StatusNotFound, "Budget not found")
+			return
+		}
+
+		respondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
+	}
+}
+
+// budgetReportRequest reads the year and the format of a budget report
+func budgetReportRequest(w http.ResponseWriter, r *http.Request) (year int, format string, locale csvLocale, ok bool) {
+	if err := checkQueryParams(r, "format", "locale"); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	format = r.URL.Query().Get("format")
+	if format != "" && format != "json" && format != "csv" {
+		respondWithError(w, http.StatusBadRequest, "Invalid format, must be json or csv")
+		return
+	}
+	locale, err := reportLocale(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if year, err = budgetPathYear(r); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	return year, format, locale, true
+}
+
+// Get budget against actual spending per category for a fiscal year, as JSON
+// or CSV
+func getBudgetReport(db *sql.DB, cal calendar) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		year, format, locale, ok := budgetReportRequest(w, r)
+		if !ok {
+			return
+		}
+
+		report, err := budgetReport(db, year, cal)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		for i := range report.Categories {
+			report.Categories[i].Months = nil
+		}
+
+		if format == "csv" {
+			percent := func(p *float64) string {
+				if p == nil {
+					return ""
+				}
+				return locale.Number(*p)
+			}
+			w.Header().Set("Content-Type", "text/csv")
+			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=budget_%d.csv", year))
+			locale.Start(w)
+			locale.Row(w, "Category", "Budgeted", "Actual", "Variance", "Variance %")
+			for _, line := range report.Categories {
+				locale.Row(w, line.Category, locale.Amount(line.Budgeted), locale.Amount(line.Actual), locale.Amount(line.Variance), percent(line.VariancePercent))
+			}
+			locale.Row(w, "Total", locale.Amount(report.Budgeted), locale.Amount(report.Actual), locale.Amount(report.Variance), "")
+			return
+		}
+		respondWithJSON(w, http.StatusOK, report)
+	}
+}
+
+// Get budget against actual spending of a category for a fiscal year month by
+// month, with the expenses of each month, as JSON or CSV
+func getBudgetDrillDown(db *sql.DB, cal calendar) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		year, format, locale, ok := budgetReportRequest(w, r)
+		if !ok {
+			return
+		}
+		category := mux.Vars(r)["category"]
+
+		report, err := budgetReport(db, year, cal)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		drillDown := BudgetDrillDown{Year: year, StartDate: report.StartDate, EndDate: report.EndDate,
+			BudgetLine: budgetLine(category, nil, nil, cal.fiscalYearMonths(year))}
+		for _, line := range report.Categories {
+			if line.Category == category {
+				drillDown.BudgetLine = line
+			}
+		}
+
+		if format == "csv" {
+			w.Header().Set("Content-Type", "text/csv")
+			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=budget_%d_%s.csv", year, budgetFilename(category)))
+			locale.Start(w)
+			locale.Row(w, "Month", "Budgeted", "Actual", "Variance")
+			for _, m := range drillDown.Months {
+				locale.Row(w, m.Month, locale.Amount(m.Budgeted), locale.Amount(m.Actual), locale.Amount(m.Variance))
+			}
+			locale.Row(w, "Total", locale.Amount(drillDown.Budgeted), locale.Amount(drillDown.Actual), locale.Amount(drillDown.Variance))
+			io.WriteString(w, "\n")
+			locale.Row(w, "Month", "Expense ID", "Date", "Description", "Amount")
+			for _, m := range drillDown.Months {
+				for _, e := range m.Expenses {
+					locale.Row(w, m.Month, strconv.Itoa(e.ID), locale.Date(e.ExpenseDate), e.Description, locale.Amount(e.Amount))
+				}
+			}
+			return
+		}
+		respondWithJSON(w, http.StatusOK, drillDown)
+	}
+}
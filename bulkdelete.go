@@ -0,0 +1,202 @@
+package condomngr
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// maxBulkDelete caps how many rows a single bulk delete may remove
+const maxBulkDelete = 500
+
+// BulkDeleteFilter selects rows by their fields instead of by id. ResidentID
+// only applies to payments and Category only to expenses.
+type BulkDeleteFilter struct {
+	StartDate  string `json:"start_date"`
+	EndDate    string `json:"end_date"`
+	ResidentID int    `json:"resident_id"`
+	Category   string `json:"category"`
+}
+
+// BulkDeleteRequest selects the rows to delete either by ids or by filter
+type BulkDeleteRequest struct {
+	IDs    []int             `json:"ids"`
+	Filter *BulkDeleteFilter `json:"filter"`
+	DryRun bool              `json:"dry_run"`
+}
+
+// BulkDeleteSkip is a requested id that was not deleted
+type BulkDeleteSkip struct {
+	ID     int    `json:"id"`
+	Reason string `json:"reason"`
+}
+
+// BulkDeleteResult reports the outcome of a bulk delete. With dry_run the
+// ids are the ones that would have been deleted.
+type BulkDeleteResult struct {
+	DryRun  bool             `json:"dry_run"`
+	Deleted int              `json:"deleted"`
+	IDs     []int            `json:"ids"`
+	Skipped []BulkDeleteSkip `json:"skipped"`
+}
+
+// bulkDeleteTables describes the tables bulk delete works on
+var bulkDeleteTables = map[string]struct {
+	kind       string // in the trash
+	dateColumn string
+	residents  bool
+	categories bool
+}{
+	"payments": {kind: "payment", dateColumn: "payment_date", residents: true},
+	"expenses": {kind: "expense", dateColumn: "expense_date", categories: true},
+}
+
+// bulkDeleteWhere turns a filter into a WHERE clause for table
+func bulkDeleteWhere(table string, f BulkDeleteFilter) (string, []interface{}, error) {
+	spec := bulkDeleteTables[table]
+	var conditions []string
+	var args []interface{}
+
+	for _, date := range []string{f.StartDate, f.EndDate} {
+		if date == "" {
+			continue
+		}
+		if _, err := time.Parse("2006-01-02", date); err != nil {
+			return "", nil, fmt.Errorf("invalid date format, must be YYYY-MM-DD")
+		}
+	}
+	if f.StartDate != "" {
+		conditions = append(conditions, spec.dateColumn+" >= ?")
+		args = append(args, f.StartDate)
+	}
+	if f.EndDate != "" {
+		conditions = append(conditions, spec.dateColumn+" <= ?")
+		args = append(args, f.EndDate)
+	}
+	if f.ResidentID != 0 {
+		if !spec.residents {
+			return "", nil, fmt.Errorf("resident_id filter is not supported for %s", table)
+		}
+		conditions = append(conditions, "resident_id = ?")
+		args = append(args, f.ResidentID)
+	}
+	if f.Category != "" {
+		if !spec.categories {
+			return "", nil, fmt.Errorf("category filter is not supported for %s", table)
+		}
+		conditions = append(conditions, "category = ?")
+		args = append(args, f.Category)
+	}
+
+	// An empty filter would match every row, which is never what a bulk
+	// delete means to do
+	if len(conditions) == 0 {
+		return "", nil, fmt.Errorf("filter must set at least one field")
+	}
+	return strings.Join(conditions, " AND "), args, nil
+}
+
+// Move many payments or expenses to the trash in one transaction
+func bulkDelete(db *sql.DB, table string, changes *ChangeBroker, rules paymentRules) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req BulkDeleteRequest
+		if err := decodeRequest(r, &req); err != nil {
+			respondWithError(w, payloadErrorStatus(err), "Invalid request payload: "+err.Error())
+			return
+		}
+		defer r.Body.Close()
+
+		if (len(req.IDs) == 0) == (req.Filter == nil) {
+			respondWithError(w, http.StatusBadRequest, "exactly one of ids or filter is required")
+			return
+		}
+		if len(req.IDs) > maxBulkDelete {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("at most %d ids can be deleted per request", maxBulkDelete))
+			return
+		}
+
+		var where string
+		var args []interface{}
+		if req.Filter != nil {
+			var err error
+			where, args, err = bulkDeleteWhere(table, *req.Filter)
+			if err != nil {
+				respondWithError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+		} else {
+			where = "id IN (?" + strings.Repeat(", ?", len(req.IDs)-1) + ")"
+			for _, id := range req.IDs {
+				args = append(args, id)
+			}
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		defer tx.Rollback()
+
+		rows, err := tx.Query("SELECT id FROM "+table+" WHERE "+where+" ORDER BY id", args...)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		result := BulkDeleteResult{DryRun: req.DryRun, IDs: []int{}, Skipped: []BulkDeleteSkip{}}
+		found := map[int]bool{}
+		for rows.Next() {
+			var id int
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				respondWithError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			found[id] = true
+			result.IDs = append(result.IDs, id)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		if len(result.IDs) > maxBulkDelete {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("filter matches %d rows, at most %d can be deleted per request", len(result.IDs), maxBulkDelete))
+			return
+		}
+
+		for _, id := range req.IDs {
+			if !found[id] {
+				found[id] = true // report duplicates once
+				result.Skipped = append(result.Skipped, BulkDeleteSkip{ID: id, Reason: "not found"})
+			}
+		}
+
+		result.Deleted = len(result.IDs)
+		if req.DryRun || len(result.IDs) == 0 {
+			respondWithJSON(w, http.StatusOK, result)
+			return
+		}
+
+		deleteArgs := make([]interface{}, len(result.IDs))
+		for i, id := range result.IDs {
+			deleteArgs[i] = id
+		}
+		if _, err := moveToTrash(tx, rules, bulkDeleteTables[table].kind, "id IN (?"+strings.Repeat(", ?", len(result.IDs)-1)+")", deleteArgs...); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		for _, id := range result.IDs {
+			changes.Publish(Change{Type: bulkDeleteTables[table].kind, ID: id, Action: ChangeDeleted})
+		}
+
+		respondWithJSON(w, http.StatusOK, result)
+	}
+}
@@ -0,0 +1,257 @@
+package condomngr
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// maxBulkUpdate caps how many expenses a single bulk update may change
+const maxBulkUpdate = 500
+
+// ExpenseBulkFilter selects the expenses a bulk update changes. The fields
+// set are all matched; at least one must be. A category of "" matches the
+// expenses without one.
+type ExpenseBulkFilter struct {
+	IDs                 []int   `json:"ids,omitempty"`
+	StartDate           string  `json:"start_date,omitempty"`
+	EndDate             string  `json:"end_date,omitempty"`
+	Category            *string `json:"category,omitempty"` // the current category, exactly
+	DescriptionContains string  `json:"description_contains,omitempty"`
+}
+
+// ExpenseBulkPatch is what a bulk update sets on the expenses it selects; at
+// least one field must be set. AddTag tags them, keeping the tags they have.
+type ExpenseBulkPatch struct {
+	Category *string `json:"category,omitempty"`
+	Vendor   *string `json:"vendor,omitempty"`
+	AddTag   *string `json:"add_tag,omitempty"`
+}
+
+// validate trims the tag of the patch, adds its errors to errs and returns the
+// condition matching the expenses it would change
+func (p *ExpenseBulkPatch) validate(errs *ValidationErrors) queryFilter {
+	if p.Category == nil && p.Vendor == nil && p.AddTag == nil {
+		errs.Add("patch", "patch must set category, vendor or add_tag")
+		return queryFilter{}
+	}
+	if p.AddTag != nil {
+		tag := strings.TrimSpace(*p.AddTag)
+		p.AddTag = &tag
+		if err := validateTag(tag); err != "" {
+			errs.Add("patch.add_tag", err)
+		}
+	}
+
+	// Expenses the patch would leave as they are aren't changed
+	var changed []string
+	var args []interface{}
+	if p.Category != nil {
+		changed, args = append(changed, "category != ?"), append(args, *p.Category)
+	}
+	if p.Vendor != nil {
+		changed, args = append(changed, "vendor != ?"), append(args, *p.Vendor)
+	}
+	if p.AddTag != nil {
+		changed, args = append(changed, "NOT EXISTS (SELECT 1 FROM expense_tags t WHERE t.expense_id = expenses.id AND t.tag = ?)"), append(args, *p.AddTag)
+	}
+	return queryFilter{conditions: []string{"(" + strings.Join(changed, " OR ") + ")"}, args: args}
+}
+
+// apply changes the expenses with ids as the patch says
+func (p ExpenseBulkPatch) apply(tx *sql.Tx, ids []int) error {
+	updated := idsFilter(ids)
+	var set []string
+	var args []interface{}
+	if p.Category != nil {
+		set, args = append(set, "category = ?"), append(args, *p.Category)
+	}
+	if p.Vendor != nil {
+		set, args = append(set, "vendor = ?"), append(args, *p.Vendor)
+	}
+	set = append(set, "updated_at = CURRENT_TIMESTAMP")
+	if _, err := tx.Exec("UPDATE expenses SET "+strings.Join(set, ", ")+updated.where(), append(args, updated.args...)...); err != nil {
+		return err
+	}
+	if p.AddTag == nil {
+		return nil
+	}
+	for _, id := range ids {
+		if err := addExpenseTags(tx, id, *p.AddTag); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// String describes the changes of the patch, for the audit log
+func (p ExpenseBulkPatch) String() string {
+	var changes []string
+	if p.Category != nil {
+		changes = append(changes, fmt.Sprintf("moved to category %q", *p.Category))
+	}
+	if p.Vendor != nil {
+		changes = append(changes, fmt.Sprintf("vendor set to %q", *p.Vendor))
+	}
+	if p.AddTag != nil {
+		changes = append(changes, fmt.Sprintf("tagged %q", *p.AddTag))
+	}
+	return strings.Join(changes, ", ")
+}
+
+// ExpenseBulkUpdate is a request to change many expenses at once, e.g. to
+// move those under "Misc" to proper categories
+type ExpenseBulkUpdate struct {
+	Filter ExpenseBulkFilter `json:"filter"`
+	Patch  ExpenseBulkPatch  `json:"patch"`
+	DryRun bool              `json:"dry_run"`
+}
+
+// ExpenseBulkUpdateResult reports the expenses a bulk update changed, as they
+// are after it. With dry_run they are the ones it would change, as they are
+// now. Expenses the patch wouldn't change aren't counted.
+type ExpenseBulkUpdateResult struct {
+	DryRun   bool      `json:"dry_run"`
+	Updated  int       `json:"updated"`
+	Expenses []Expense `json:"expenses"`
+}
+
+// where turns the filter into a WHERE clause, adding its errors to errs
+func (f ExpenseBulkFilter) where(errs *ValidationErrors) queryFilter {
+	var filter queryFilter
+	if len(f.IDs) > maxBulkUpdate {
+		errs.Add("filter.ids", fmt.Sprintf("at most %d ids can be updated per request", maxBulkUpdate))
+	} else if len(f.IDs) > 0 {
+		filter = idsFilter(f.IDs)
+	}
+	for _, date := range []struct {
+		field, value, condition string
+	}{{"filter.start_date", f.StartDate, "expense_date >= ?"}, {"filter.end_date", f.EndDate, "expense_date <= ?"}} {
+		if date.value == "" {
+			continue
+		}
+		if _, err := time.Parse("2006-01-02", date.value); err != nil {
+			errs.Add(date.field, "invalid date format, must be YYYY-MM-DD")
+			continue
+		}
+		filter.add(date.condition, date.value)
+	}
+	if f.Category != nil {
+		filter.add("category = ?", *f.Category)
+	}
+	if f.DescriptionContains != "" {
+		filter.add(`description LIKE ? ESCAPE '\'`, "%"+likeEscaper.Replace(f.DescriptionContains)+"%")
+	}
+
+	// An empty filter would match every expense, which is never what a bulk
+	// update means to do
+	if len(filter.conditions) == 0 && len(*errs) == 0 {
+		errs.Add("filter", "filter must set at least one field")
+	}
+	return filter
+}
+
+// Change the category, vendor or tags of many expenses in one transaction, recorded in the
+// audit log as a single event with the filter. With dry_run nothing is
+// changed and the expenses that would be are listed.
+func bulkUpdateExpenses(db *sql.DB, changes *ChangeBroker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req ExpenseBulkUpdate
+		if err := decodeRequest(r, &req); err != nil {
+			respondWithError(w, payloadErrorStatus(err), "Invalid request payload: "+err.Error())
+			return
+		}
+		defer r.Body.Close()
+
+		var errs ValidationErrors
+		filter := req.Filter.where(&errs)
+		changed := req.Patch.validate(&errs)
+		if err := errs.Err(); err != nil {
+			respondWithValidationError(w, err)
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		defer tx.Rollback()
+
+		filter.conditions = append(filter.conditions, changed.conditions...)
+		filter.args = append(filter.args, changed.args...)
+		expenses, err := bulkUpdateExpensesList(tx, filter)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if len(expenses) > maxBulkUpdate {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("filter matches %d expenses, at most %d can be updated per request", len(expenses), maxBulkUpdate))
+			return
+		}
+
+		result := ExpenseBulkUpdateResult{DryRun: req.DryRun, Updated: len(expenses), Expenses: expenses}
+		if req.DryRun || len(expenses) == 0 {
+			respondWithJSON(w, http.StatusOK, result)
+			return
+		}
+
+		ids := make([]int, len(expenses))
+		for i, expense := range expenses {
+			ids[i] = expense.ID
+		}
+		if err := req.Patch.apply(tx, ids); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		filterJSON, _ := json.Marshal(req.Filter)
+		detail := fmt.Sprintf("%d expenses matching %s %s", len(expenses), filterJSON, req.Patch)
+		if err := recordAudit(tx, r, AuditExpensesBulkUpdated, "expenses", detail); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if result.Expenses, err = bulkUpdateExpensesList(tx, idsFilter(ids)); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		for _, expense := range result.Expenses {
+			changes.Publish(Change{Type: "expense", ID: expense.ID, Action: ChangeUpdated})
+		}
+
+		respondWithJSON(w, http.StatusOK, result)
+	}
+}
+
+// idsFilter matches the rows with one of ids
+func idsFilter(ids []int) queryFilter {
+	filter := queryFilter{conditions: []string{"id IN (?" + strings.Repeat(", ?", len(ids)-1) + ")"}}
+	for _, id := range ids {
+		filter.args = append(filter.args, id)
+	}
+	return filter
+}
+
+// bulkUpdateExpensesList returns the expenses matching filter, oldest first
+func bulkUpdateExpensesList(tx *sql.Tx, filter queryFilter) ([]Expense, error) {
+	rows, err := tx.Query("SELECT "+expenseColumns+" FROM expenses"+filter.where()+" ORDER BY expense_date, id", filter.args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	expenses := []Expense{}
+	for rows.Next() {
+		expense, err := scanExpenseRow(rows)
+		if err != nil {
+			return nil, err
+		}
+		expenses = append(expenses, expense)
+	}
+	return expenses, rows.Err()
+}
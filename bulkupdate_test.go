@@ -0,0 +1,71 @@
+package condomngr
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestBulkUpdateExpenses(t *testing.T) {
+	s := newTestServer(t, Options{})
+	var lift, bulbs, cleaning Expense
+	s.expect(http.StatusCreated, "POST", "/api/v1/expenses", map[string]interface{}{"amount": 300, "description": "Lift repair", "expense_date": "2024-03-01", "category": "Misc", "tags": []string{" roof-2024 ", "lift", "lift"}}, &lift)
+	s.expect(http.StatusCreated, "POST", "/api/v1/expenses", map[string]interface{}{"amount": 20, "description": "Bulbs", "expense_date": "2024-03-02", "category": "Misc", "vendor": "Leroy"}, &bulbs)
+	s.expect(http.StatusCreated, "POST", "/api/v1/expenses", map[string]interface{}{"amount": 80, "description": "Cleaning", "expense_date": "2024-03-03", "category": "Cleaning"}, &cleaning)
+	if want := []string{"lift", "roof-2024"}; !reflect.DeepEqual(lift.Tags, want) {
+		t.Errorf("tags %q, want %q", lift.Tags, want)
+	}
+
+	update := func(status int, patch map[string]interface{}, dryRun bool) ExpenseBulkUpdateResult {
+		t.Helper()
+		var result ExpenseBulkUpdateResult
+		s.expect(status, "POST", "/api/v1/expenses/bulk-update", map[string]interface{}{"filter": map[string]string{"category": "Misc"}, "patch": patch, "dry_run": dryRun}, &result)
+		return result
+	}
+	updated := func(result ExpenseBulkUpdateResult) []int {
+		ids := []int{}
+		for _, expense := range result.Expenses {
+			ids = append(ids, expense.ID)
+		}
+		return ids
+	}
+
+	for _, patch := range []map[string]interface{}{
+		{},
+		{"add_tag": " "},
+		{"add_tag": "a,b"},
+		{"vendor": "Leroy", "add_tag": "this tag is longer than the fifty characters allowed"},
+	} {
+		update(http.StatusUnprocessableEntity, patch, false)
+	}
+
+	// Only the expenses the patch changes are counted and changed
+	if got := update(http.StatusOK, map[string]interface{}{"add_tag": "lift"}, true); !reflect.DeepEqual(updated(got), []int{bulbs.ID}) {
+		t.Errorf("dry run would tag %v, want %v", updated(got), []int{bulbs.ID})
+	}
+	if got := update(http.StatusOK, map[string]interface{}{"vendor": "Leroy"}, false); !reflect.DeepEqual(updated(got), []int{lift.ID}) || got.Expenses[0].Vendor != "Leroy" {
+		t.Errorf("vendor set on %+v, want %v", got.Expenses, []int{lift.ID})
+	}
+	got := update(http.StatusOK, map[string]interface{}{"add_tag": " maintenance", "category": "Misc"}, false)
+	if !reflect.DeepEqual(updated(got), []int{lift.ID, bulbs.ID}) {
+		t.Fatalf("tagged %v, want %v", updated(got), []int{lift.ID, bulbs.ID})
+	}
+	if want := []string{"lift", "maintenance", "roof-2024"}; !reflect.DeepEqual(got.Expenses[0].Tags, want) {
+		t.Errorf("tags %q, want %q", got.Expenses[0].Tags, want)
+	}
+	if got := update(http.StatusOK, map[string]interface{}{"add_tag": "maintenance", "vendor": "Leroy"}, false); got.Updated != 0 {
+		t.Errorf("%d expenses updated again, want 0", got.Updated)
+	}
+
+	var expense Expense
+	s.expect(http.StatusOK, "GET", fmt.Sprint("/api/v1/expenses/", bulbs.ID), nil, &expense)
+	if expense.Vendor != "Leroy" || !reflect.DeepEqual(expense.Tags, []string{"maintenance"}) {
+		t.Errorf("expense %+v, want vendor Leroy tagged maintenance", expense)
+	}
+	var other Expense
+	s.expect(http.StatusOK, "GET", fmt.Sprint("/api/v1/expenses/", cleaning.ID), nil, &other)
+	if other.Vendor != "" || other.Tags != nil {
+		t.Errorf("expense %+v outside the filter changed", other)
+	}
+}
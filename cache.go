@@ -0,0 +1,247 @@
+package condomngr
+
+import (
+	"bytes"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Cache-Status values of cached endpoints
+const (
+	CacheHit    = "HIT"    // answered from the cache
+	CacheMiss   = "MISS"   // computed, and cached unless it failed
+	CacheBypass = "BYPASS" // computed because of ?refresh=true, and cached
+)
+
+// maxCacheEntries bounds the responses kept, as every set of parameters is
+// cached apart
+const maxCacheEntries = 256
+
+// cacheEntry is a response kept by ResponseCache
+type cacheEntry struct {
+	body      []byte
+	header    http.Header
+	expires   time.Time
+	dependsOn []string // change types, see changeTypes
+}
+
+// ResponseCache keeps the responses of the endpoints that aggregate a lot of
+// data, such as the dashboard and reports, for a TTL. Responses are keyed by
+// path, query and language, and dropped as soon as the data they depend on
+// changes: the changes the handlers publish drop the responses depending on
+// their type, and any other request that changes data drops them all.
+type ResponseCache struct {
+	ttl time.Duration // 0 disables the cache
+
+	mu         sync.Mutex
+	entries    map[string]cacheEntry
+	generation uint64 // incremented on every invalidation
+}
+
+// NewResponseCache creates a cache keeping responses for ttl, or a disabled
+// one if ttl is 0
+func NewResponseCache(ttl time.Duration) *ResponseCache {
+	return &ResponseCache{ttl: ttl, entries: make(map[string]cacheEntry)}
+}
+
+// Invalidate drops the responses that depend on changes of type
+func (c *ResponseCache) Invalidate(changeType string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	for key, entry := range c.entries {
+		if slices.Contains(entry.dependsOn, changeType) {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// InvalidateAll drops every response
+func (c *ResponseCache) InvalidateAll() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	clear(c.entries)
+}
+
+// invalidateChange drops the responses a published change makes stale.
+// Deleting a resident also deletes their payments, and an import changes
+// anything, so those drop them all.
+func (c *ResponseCache) invalidateChange(change Change) {
+	if change.Action == ChangeImported || (change.Type == "resident" && change.Action == ChangeDeleted) {
+		c.InvalidateAll()
+		return
+	}
+	c.Invalidate(change.Type)
+}
+
+func (c *ResponseCache) get(key string) (cacheEntry, uint64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if ok && time.Now().After(entry.expires) {
+		delete(c.entries, key)
+		ok = false
+	}
+	return entry, c.generation, ok
+}
+
+// put keeps a response computed at generation, unless the data changed
+// since, which would make it stale already
+func (c *ResponseCache) put(key string, entry cacheEntry, generation uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if generation != c.generation {
+		return
+	}
+	if len(c.entries) >= maxCacheEntries {
+		now := time.Now()
+		for key, entry := range c.entries {
+			if now.After(entry.expires) {
+				delete(c.entries, key)
+			}
+		}
+		if len(c.entries) >= maxCacheEntries {
+			clear(c.entries)
+		}
+	}
+	c.entries[key] = entry
+}
+
+// cacheRecorder passes a response through while keeping a copy of it
+type cacheRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *cacheRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *cacheRecorder) Write(p []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	rec.body.Write(p)
+	return rec.ResponseWriter.Write(p)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (rec *cacheRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// Cached serves the responses of next from the cache, computing and keeping
+// the successful ones, which depend on the changes of dependsOn and on every
+// change not published. ?refresh=true computes the response again; it isn't
+// passed on to next, even with the cache disabled. The Cache-Status header
+// tells how it was answered.
+func (c *ResponseCache) Cached(next http.HandlerFunc, dependsOn ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		refresh := false
+		if value := query.Get("refresh"); value != "" {
+			var err error
+			if refresh, err = strconv.ParseBool(value); err != nil {
+				respondWithError(w, http.StatusBadRequest, "Invalid refresh, must be true or false")
+				return
+			}
+		}
+		if query.Has("refresh") {
+			query.Del("refresh")
+			r = r.Clone(r.Context())
+			r.URL.RawQuery = query.Encode()
+		}
+		if c.ttl <= 0 {
+			next(w, r)
+			return
+		}
+
+		key := responseLanguage(w) + " " + r.URL.Path + "?" + query.Encode()
+		entry, generation, ok := c.get(key)
+		if ok && !refresh {
+			for name, values := range entry.header {
+				w.Header()[name] = values
+			}
+			w.Header().Set("Cache-Status", CacheHit)
+			w.Write(entry.body)
+			return
+		}
+
+		if refresh {
+			w.Header().Set("Cache-Status", CacheBypass)
+		} else {
+			w.Header().Set("Cache-Status", CacheMiss)
+		}
+		rec := &cacheRecorder{ResponseWriter: w}
+		next(rec, r)
+		if rec.status != http.StatusOK {
+			return
+		}
+		c.put(key, cacheEntry{
+			body:      bytes.Clone(rec.body.Bytes()),
+			header:    w.Header().Clone(),
+			expires:   time.Now().Add(c.ttl),
+			dependsOn: dependsOn,
+		}, generation)
+	}
+}
+
+// publishedPath matches the routes whose handlers publish their changes, so
+// their requests only drop the responses depending on them
+var publishedPath = regexp.MustCompile(`^/api(/v1)?/(residents|payments|expenses)(/[0-9]+)?$`)
+
+// Middleware drops every cached response when a request that changes data
+// succeeds, before it is answered, except for the routes whose handlers
+// publish their changes. Like read-only mode it goes by method rather than by
+// route, so new routes are covered without being listed.
+func (c *ResponseCache) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+		default:
+			if c.ttl > 0 && !publishedPath.MatchString(r.URL.Path) {
+				w = &invalidatingWriter{ResponseWriter: w, cache: c}
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// invalidatingWriter drops the cached responses as a successful status is
+// written, so a client that got the answer never reads the data from before
+type invalidatingWriter struct {
+	http.ResponseWriter
+	cache   *ResponseCache
+	written bool
+}
+
+func (iw *invalidatingWriter) WriteHeader(status int) {
+	if !iw.written {
+		iw.written = true
+		if status < http.StatusBadRequest {
+			iw.cache.InvalidateAll()
+		}
+	}
+	iw.ResponseWriter.WriteHeader(status)
+}
+
+func (iw *invalidatingWriter) Write(p []byte) (int, error) {
+	if !iw.written {
+		iw.WriteHeader(http.StatusOK)
+	}
+	return iw.ResponseWriter.Write(p)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (iw *invalidatingWriter) Unwrap() http.ResponseWriter {
+	return iw.ResponseWriter
+}
@@ -0,0 +1,120 @@
+package condomngr
+
+import (
+	"database/sql"
+	"net/http"
+	"time"
+)
+
+// CalendarDay is what came in on a day: the count and total of the confirmed
+// payments made on it and, when asked for, of the expenses
+type CalendarDay struct {
+	Date         string   `json:"date"` // YYYY-MM-DD
+	PaymentCount int      `json:"payment_count"`
+	PaymentTotal float64  `json:"payment_total"`
+	ExpenseCount *int     `json:"expense_count,omitempty"`
+	ExpenseTotal *float64 `json:"expense_total,omitempty"`
+}
+
+// PaymentCalendar is every day of a month, days without payments included,
+// and the totals of the month
+type PaymentCalendar struct {
+	Month        string        `json:"month"` // YYYY-MM
+	PaymentCount int           `json:"payment_count"`
+	PaymentTotal float64       `json:"payment_total"`
+	ExpenseCount *int          `json:"expense_count,omitempty"`
+	ExpenseTotal *float64      `json:"expense_total,omitempty"`
+	Days         []CalendarDay `json:"days"`
+}
+
+// calendarTotals runs a query selecting the day, count and total of rows
+// grouped by day, and returns the counts and totals by date
+func calendarTotals(db *sql.DB, query string, args ...interface{}) (map[string]int, map[string]float64, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	counts, totals := map[string]int{}, map[string]float64{}
+	for rows.Next() {
+		var day string
+		var count int
+		var total float64
+		if err := rows.Scan(&day, &count, &total); err != nil {
+			return nil, nil, err
+		}
+		counts[day], totals[day] = count, roundCents(total)
+	}
+	return counts, totals, rows.Err()
+}
+
+// Get a month day by day with the count and total of the confirmed payments
+// made each day, and with include=expenses of the expenses, for a calendar
+func getPaymentCalendar(db *sql.DB, cal calendar) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := checkQueryParams(r, "month", "include"); err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		month := r.URL.Query().Get("month")
+		if month == "" {
+			month = cal.now().Format("2006-01")
+		}
+		start, err := time.Parse("2006-01", month)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "invalid month format, must be YYYY-MM")
+			return
+		}
+		var expenses bool
+		for _, include := range queryValues(r, "include") {
+			if include != "expenses" {
+				respondWithError(w, http.StatusBadRequest, "Invalid include, must be expenses")
+				return
+			}
+			expenses = true
+		}
+		end := start.AddDate(0, 1, 0)
+
+		paymentCounts, paymentTotals, err := calendarTotals(db, `
+			SELECT substr(payment_date, 1, 10), COUNT(*), SUM(amount) FROM payments
+			WHERE status = ? AND payment_date >= ? AND payment_date < ?
+			GROUP BY substr(payment_date, 1, 10)
+		`, PaymentStatusConfirmed, start.Format("2006-01-02"), end.Format("2006-01-02"))
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		var expenseCounts map[string]int
+		var expenseTotals map[string]float64
+		if expenses {
+			expenseCounts, expenseTotals, err = calendarTotals(db, `
+				SELECT substr(expense_date, 1, 10), COUNT(*), SUM(amount) FROM expenses
+				WHERE expense_date >= ? AND expense_date < ?
+				GROUP BY substr(expense_date, 1, 10)
+			`, start.Format("2006-01-02"), end.Format("2006-01-02"))
+			if err != nil {
+				respondWithError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+		}
+
+		calendar := PaymentCalendar{Month: month, Days: []CalendarDay{}}
+		if expenses {
+			calendar.ExpenseCount, calendar.ExpenseTotal = new(int), new(float64)
+		}
+		for day := start; day.Before(end); day = day.AddDate(0, 0, 1) {
+			date := day.Format("2006-01-02")
+			entry := CalendarDay{Date: date, PaymentCount: paymentCounts[date], PaymentTotal: paymentTotals[date]}
+			calendar.PaymentCount += entry.PaymentCount
+			calendar.PaymentTotal = roundCents(calendar.PaymentTotal + entry.PaymentTotal)
+			if expenses {
+				count, total := expenseCounts[date], expenseTotals[date]
+				entry.ExpenseCount, entry.ExpenseTotal = &count, &total
+				*calendar.ExpenseCount += count
+				*calendar.ExpenseTotal = roundCents(*calendar.ExpenseTotal + total)
+			}
+			calendar.Days = append(calendar.Days, entry)
+		}
+		respondWithJSON(w, http.StatusOK, calendar)
+	}
+}
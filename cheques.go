@@ -0,0 +1,230 @@
+package condomngr
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Clearance statuses of a cheque
+const (
+	ChequePending = "pending"
+	ChequeCleared = "cleared"
+	ChequeBounced = "bounced"
+)
+
+// paymentStatus is the status a payment has from its method and cheque
+func paymentStatus(p Payment, rules paymentRules) string {
+	if p.Method != "check" {
+		return PaymentStatusConfirmed
+	}
+	switch p.ChequeStatus {
+	case ChequePending:
+		if rules.countUnclearedCheques {
+			return PaymentStatusConfirmed
+		}
+		return PaymentStatusPending
+	case ChequeBounced:
+		return PaymentStatusBounced
+	}
+	return PaymentStatusConfirmed
+}
+
+// syncChequeStatuses sets the status of cheque payments from their clearance,
+// such as after -count-uncleared-cheques changed. Cheques without clearance,
+// such as from exports made before cheques were tracked, cleared on the
+// payment date.
+func syncChequeStatuses(q querier, rules paymentRules) error {
+	_, err := q.Exec(`
+		UPDATE payments SET cheque_status = ?, cheque_status_date = substr(payment_date, 1, 10)
+		WHERE method = 'check' AND cheque_status = ''
+	`, ChequeCleared)
+	if err != nil {
+		return err
+	}
+	_, err = q.Exec(`
+		UPDATE payments SET status = CASE cheque_status WHEN ?1 THEN ?2 WHEN ?3 THEN ?4 ELSE ?5 END
+		WHERE method = 'check'
+	`, ChequePending, paymentStatus(Payment{Method: "check", ChequeStatus: ChequePending}, rules), ChequeBounced, PaymentStatusBounced, PaymentStatusConfirmed)
+	return err
+}
+
+// clearChequeOnStatement clears a pending cheque matched with a bank statement
+// line of date, or on the payment date if the line is older
+func clearChequeOnStatement(q querier, rules paymentRules, paymentID int, date string) error {
+	var payment Payment
+	err := q.QueryRow("SELECT resident_id, method, substr(payment_date, 1, 10), cheque_status FROM payments WHERE id = ?", paymentID).
+		Scan(&payment.ResidentID, &payment.Method, &payment.PaymentDate, &payment.ChequeStatus)
+	if err != nil || payment.Method != "check" || payment.ChequeStatus != ChequePending {
+		return err
+	}
+	payment.ChequeStatus, payment.ChequeStatusDate = ChequeCleared, max(date, payment.PaymentDate)
+	_, err = q.Exec("UPDATE payments SET status = ?, cheque_status = ?, cheque_status_date = ? WHERE id = ?",
+		paymentStatus(payment, rules), payment.ChequeStatus, payment.ChequeStatusDate, paymentID)
+	if err != nil {
+		return err
+	}
+	return reallocate(q, rules, payment.ResidentID)
+}
+
+// ChequeClearance records that a cheque cleared or bounced on a date, or puts
+// it back to pending
+type ChequeClearance struct {
+	Status string `json:"status"`
+	Date   string `json:"date"` // YYYY-MM-DD, defaults to today
+}
+
+// OutstandingCheque is a cheque not cleared yet
+type OutstandingCheque struct {
+	PaymentID    int     `json:"payment_id"`
+	ResidentID   int     `json:"resident_id"`
+	ResidentName string  `json:"residentName"`
+	Amount       float64 `json:"amount"`
+	PaymentDate  string  `json:"payment_date"`
+	ChequeNumber string  `json:"cheque_number"`
+	ChequeBank   string  `json:"cheque_bank"`
+	DaysPending  int     `json:"days_pending"`
+}
+
+// OutstandingCheques lists the cheques not cleared yet, oldest first
+type OutstandingCheques struct {
+	AsOf    string              `json:"as_of"`
+	Count   int                 `json:"count"`
+	Total   float64             `json:"total"`
+	Cheques []OutstandingCheque `json:"cheques"`
+}
+
+// Record that a cheque cleared or bounced. A bounced cheque no longer counts
+// as paid, and what it settled is open again.
+func setChequeClearance(db *sql.DB, changes *ChangeBroker, cal calendar, rules paymentRules) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id, err := strconv.Atoi(vars["id"])
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid payment ID")
+			return
+		}
+
+		var clearance ChequeClearance
+		if err := decodeRequest(r, &clearance); err != nil {
+			respondWithError(w, payloadErrorStatus(err), "Invalid request payload: "+err.Error())
+			return
+		}
+		defer r.Body.Close()
+
+		tx, err := db.Begin()
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		defer tx.Rollback()
+
+		var payment Payment
+		err = tx.QueryRow(`
+			SELECT p.id, p.resident_id, r.name, p.amount, p.description, p.payment_date, p.method, p.status, p.reference, p.bank_reference, p.cheque_number, p.cheque_bank, p.cheque_status, p.cheque_status_date, p.created_at, p.updated_at
+			FROM payments p
+			JOIN residents r ON p.resident_id = r.id
+			WHERE p.id = ?
+		`, id).Scan(&payment.ID, &payment.ResidentID, &payment.ResidentName, &payment.Amount, &payment.Description, &payment.PaymentDate, &payment.Method, &payment.Status, &payment.Reference, &payment.BankReference, &payment.ChequeNumber, &payment.ChequeBank, &payment.ChequeStatus, &payment.ChequeStatusDate, &payment.CreatedAt, &payment.UpdatedAt)
+		if err == sql.ErrNoRows {
+			respondWithError(w, http.StatusNotFound, "Payment not found")
+			return
+		}
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if payment.Method != "check" {
+			respondWithError(w, http.StatusConflict, "Only payments by check can clear or bounce")
+			return
+		}
+
+		payment.PaymentDate = normalizeDate(payment.PaymentDate)
+		payment.ChequeStatus, payment.ChequeStatusDate = clearance.Status, normalizeDate(clearance.Date)
+		if payment.ChequeStatusDate == "" && clearance.Status != ChequePending {
+			payment.ChequeStatusDate = cal.today()
+		}
+		if err := validatePayment(payment); err != nil {
+			respondWithValidationError(w, err)
+			return
+		}
+		payment.Status = paymentStatus(payment, rules)
+
+		_, err = tx.Exec("UPDATE payments SET status = ?, cheque_status = ?, cheque_status_date = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?",
+			payment.Status, payment.ChequeStatus, payment.ChequeStatusDate, id)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if err := reallocate(tx, rules, payment.ResidentID); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if err := withAllocations(tx, &payment); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		changes.Publish(Change{Type: "payment", ID: id, Action: ChangeUpdated})
+
+		respondWithJSON(w, http.StatusOK, payment)
+	}
+}
+
+// Get the cheques not cleared yet, oldest first, for following them up
+func getOutstandingCheques(db *sql.DB, cal calendar) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := checkQueryParams(r, "as_of"); err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		asOf := r.URL.Query().Get("as_of")
+		if asOf == "" {
+			asOf = cal.today()
+		}
+		end, err := time.Parse("2006-01-02", asOf)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "invalid as_of format, must be YYYY-MM-DD")
+			return
+		}
+
+		rows, err := db.Query(`
+			SELECT p.id, p.resident_id, r.name, p.amount, substr(p.payment_date, 1, 10), p.cheque_number, p.cheque_bank
+			FROM payments p
+			JOIN residents r ON p.resident_id = r.id
+			WHERE p.method = 'check' AND p.cheque_status = ? AND substr(p.payment_date, 1, 10) <= ?
+			ORDER BY p.payment_date, p.id
+		`, ChequePending, asOf)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		defer rows.Close()
+
+		result := OutstandingCheques{AsOf: asOf, Cheques: []OutstandingCheque{}}
+		for rows.Next() {
+			var cheque OutstandingCheque
+			if err := rows.Scan(&cheque.PaymentID, &cheque.ResidentID, &cheque.ResidentName, &cheque.Amount, &cheque.PaymentDate, &cheque.ChequeNumber, &cheque.ChequeBank); err != nil {
+				respondWithError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			date, _ := time.Parse("2006-01-02", cheque.PaymentDate)
+			cheque.DaysPending = int(end.Sub(date).Hours() / 24)
+			result.Cheques = append(result.Cheques, cheque)
+			result.Count++
+			result.Total = roundCents(result.Total + cheque.Amount)
+		}
+		if err := rows.Err(); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		respondWithJSON(w, http.StatusOK, result)
+	}
+}
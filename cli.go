@@ -0,0 +1,811 @@
+package condomngr
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// commands maps subcommand names to their entry points, which return the
+// process exit code. Without a subcommand the server is started.
+var commands = map[string]func(args []string) int{
+	"serve":       runServe,
+	"export":      runExport,
+	"import":      runImport,
+	"diff":        runDiff,
+	"backup":      runBackup,
+	"anonymize":   runAnonymize,
+	"restore":     runRestore,
+	"encrypt":     runEncrypt,
+	"decrypt":     runDecrypt,
+	"sample":      runSample,
+	"maintenance": runMaintenance,
+	"consistency": runConsistency,
+	"recompute":   runRecompute,
+	"user":        runUser,
+}
+
+const usage = `Usage: condomngr [command] [flags]
+
+Commands:
+  serve        Start the web server (default)
+  export       Write the database as JSON or NDJSON, like the Export Database button
+  import       Load a JSON or NDJSON export into the database
+  diff         Compare two exports, or an export with the database, record by record
+  backup       Write a consistent copy of the database file
+  anonymize    Write a copy of the database with made-up names, contacts and text, to share as test data
+  restore      Replace the database with a backup file or s3:// backup
+  encrypt      Encrypt a plaintext database with -db-key (SQLCipher builds)
+  decrypt      Decrypt the database encrypted with -db-key (SQLCipher builds)
+  sample       Replace the data with sample data
+  maintenance  Check integrity, then VACUUM and ANALYZE the database
+  consistency  Find orphaned and inconsistent data, and apply safe fixes with -fix
+  recompute    Rebuild allocations and reserve contributions, or only check them with -check
+  user         Add, list, disable, enable users or reset their password
+
+Run "condomngr <command> -h" for the flags of a command.
+`
+
+// Main runs the command line of condomngr with args, the arguments after the
+// program name, and returns the process exit code
+func Main(args []string) int {
+	name := "serve"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+
+	command, ok := commands[name]
+	if !ok {
+		if name != "help" {
+			fmt.Fprintf(os.Stderr, "condomngr: unknown command %q\n\n", name)
+		}
+		fmt.Fprint(os.Stderr, usage)
+		return 2
+	}
+	return command(args)
+}
+
+// commandFlags returns the flag set of a command with the flags all commands
+// share: -db, -db-key and -version
+func commandFlags(name string) (*flag.FlagSet, *bool) {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	flags.StringVar(&dbFile, "db", dbFile, "SQLite database file")
+	dbKey = os.Getenv("CONDO_DB_KEY")
+	flags.Func("db-key", "Key of the encrypted database, needs a SQLCipher build (or CONDO_DB_KEY)", func(key string) error {
+		dbKey = key
+		return nil
+	})
+	showVersion := flags.Bool("version", false, "Show version information")
+	return flags, showVersion
+}
+
+func printVersion() {
+	fmt.Printf("Condo Manager %s\n", Version)
+	if BuildTime != "" {
+		fmt.Printf("Build Time: %s\n", BuildTime)
+	}
+	if CommitHash != "" {
+		fmt.Printf("Commit: %s\n", CommitHash)
+	}
+	if version := sqlcipherVersion(); version != "" {
+		fmt.Printf("SQLCipher: %s\n", version)
+	}
+}
+
+// fail reports a command error on stderr and returns the exit code for it
+func fail(command string, err error) int {
+	fmt.Fprintf(os.Stderr, "condomngr %s: %v\n", command, err)
+	return 1
+}
+
+// requireDB fails commands that read the database when it doesn't exist yet,
+// instead of quietly creating an empty one
+func requireDB() error {
+	if _, err := os.Stat(dbFile); os.IsNotExist(err) {
+		return fmt.Errorf("database %s does not exist", dbFile)
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+// runExport writes the database as JSON or NDJSON to a file or stdout
+func runExport(args []string) int {
+	flags, showVersion := commandFlags("export")
+	output := flags.String("o", "-", "File to write the export to, - for stdout")
+	startDate := flags.String("start-date", "", "Only export payments and expenses from this date, YYYY-MM-DD")
+	endDate := flags.String("end-date", "", "Only export payments and expenses up to this date, YYYY-MM-DD")
+	entities := flags.String("entities", "", "Comma-separated sections to export: residents, payments, expenses (default all)")
+	format := flags.String("format", ExportFormatJSON, "json for a single JSON object, ndjson for one record per line")
+	flags.Parse(args)
+	if *showVersion {
+		printVersion()
+		return 0
+	}
+
+	var sections []string
+	for _, entity := range strings.Split(*entities, ",") {
+		if entity = strings.TrimSpace(entity); entity != "" {
+			sections = append(sections, entity)
+		}
+	}
+	filter, err := parseExportFilter(*startDate, *endDate, sections)
+	if err != nil {
+		return fail("export", err)
+	}
+	if !validExportFormat(*format) {
+		return fail("export", fmt.Errorf("invalid format %q, must be json or ndjson", *format))
+	}
+	if err := requireDB(); err != nil {
+		return fail("export", err)
+	}
+	db, err := initDB()
+	if err != nil {
+		return fail("export", err)
+	}
+	defer db.Close()
+
+	w := io.Writer(os.Stdout)
+	if *output != "-" {
+		file, err := os.Create(*output)
+		if err != nil {
+			return fail("export", err)
+		}
+		defer file.Close()
+		w = file
+	}
+	counts, err := writeExport(w, db, filter, *format, time.Now())
+	if err != nil {
+		return fail("export", err)
+	}
+
+	fmt.Fprintf(os.Stderr, "Exported %d residents, %d payments and %d expenses\n",
+		counts.residents, counts.payments, counts.expenses)
+	fmt.Fprintf(os.Stderr, "SHA-256 %s\n", counts.sha256)
+	return 0
+}
+
+// runImport loads a JSON or NDJSON export from a file or stdin
+func runImport(args []string) int {
+	flags, showVersion := commandFlags("import")
+	input := flags.String("i", "-", "Export file to import, - for stdin")
+	mode := flags.String("mode", ImportModeReplace, "replace deletes the existing data first, merge adds to it and overwrites rows with the same id")
+	lax := flags.Bool("lax-json", false, "Ignore unknown fields in the export file")
+	force := flags.Bool("force", false, "Import even if the file doesn't match its manifest, e.g. when it was edited by hand")
+	format := flags.String("format", "", "json or ndjson (default from the file name, json for stdin)")
+	flags.Parse(args)
+	if *showVersion {
+		printVersion()
+		return 0
+	}
+
+	if *mode != ImportModeReplace && *mode != ImportModeMerge {
+		return fail("import", fmt.Errorf("invalid mode %q, must be replace or merge", *mode))
+	}
+	if *format == "" {
+		*format = importFormat(*input)
+	}
+	if !validExportFormat(*format) {
+		return fail("import", fmt.Errorf("invalid format %q, must be json or ndjson", *format))
+	}
+
+	r := io.Reader(os.Stdin)
+	if *input != "-" {
+		file, err := os.Open(*input)
+		if err != nil {
+			return fail("import", err)
+		}
+		defer file.Close()
+		r = file
+	}
+	importData, err := decodeExport(r, *format, *lax)
+	if err != nil {
+		return fail("import", fmt.Errorf("invalid import file format: %v", err))
+	}
+	if err := verifyManifest(importData); err != nil {
+		if !*force || !errors.Is(err, errManifestMismatch) {
+			return fail("import", err)
+		}
+		fmt.Fprintf(os.Stderr, "WARNING: %v\n", err)
+	}
+	if err := validateImport(importData); err != nil {
+		return fail("import", err)
+	}
+
+	db, err := initDB()
+	if err != nil {
+		return fail("import", err)
+	}
+	defer db.Close()
+
+	// Payments are allocated oldest charges first; serve reallocates them
+	// with its -payment-allocation as it opens the database
+	if err := importAll(db, importData, *mode, paymentRules{allocation: AllocationFIFO}); err != nil {
+		return fail("import", err)
+	}
+
+	fmt.Fprintf(os.Stderr, "Imported %d residents, %d payments and %d expenses\n",
+		len(importData.Residents), len(importData.Payments), len(importData.Expenses))
+	return 0
+}
+
+// runDiff compares two exports, or an export with the database, and prints
+// the records added, removed and changed. Flags may also follow the files, as
+// in diff a.json b.json -summary. Like diff(1), it exits with 1 when the
+// exports differ.
+func runDiff(args []string) int {
+	flags, showVersion := commandFlags("diff")
+	summary := flags.Bool("summary", false, "Only print the counts of records added, removed, changed and unchanged")
+	asJSON := flags.Bool("json", false, "Print the differences as JSON, as the API answers")
+	flags.Parse(args)
+	var files []string
+	for flags.NArg() > 0 {
+		files = append(files, flags.Arg(0))
+		flags.Parse(flags.Args()[1:])
+	}
+	if *showVersion {
+		printVersion()
+		return 0
+	}
+	if len(files) == 0 || len(files) > 2 {
+		return fail("diff", fmt.Errorf("expected two export files, or one to compare with the database"))
+	}
+
+	var sides []exportRecords
+	for _, name := range files {
+		file, err := os.Open(name)
+		if err != nil {
+			return fail("diff", err)
+		}
+		defer file.Close()
+		sides = append(sides, exportFileRecords(name, file))
+	}
+	if len(sides) == 1 {
+		if err := requireDB(); err != nil {
+			return fail("diff", err)
+		}
+		db, err := initDB()
+		if err != nil {
+			return fail("diff", err)
+		}
+		defer db.Close()
+		sides = append(sides, databaseRecords(db))
+	}
+
+	diff, err := diffExports(sides[0], sides[1], *summary)
+	if err != nil {
+		return fail("diff", err)
+	}
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(diff)
+	} else {
+		writeDiff(os.Stdout, diff)
+	}
+	for _, d := range diff.Entities {
+		if d.AddedCount+d.RemovedCount+d.ChangedCount > 0 {
+			return 1
+		}
+	}
+	return 0
+}
+
+// runBackup copies the database with VACUUM INTO, which gives a consistent
+// snapshot even while the server is writing to it
+func runBackup(args []string) int {
+	flags, showVersion := commandFlags("backup")
+	output := flags.String("o", "", "File to write the backup to; it must not exist")
+	flags.Parse(args)
+	if *showVersion {
+		printVersion()
+		return 0
+	}
+
+	if *output == "" {
+		return fail("backup", fmt.Errorf("-o is required"))
+	}
+	if err := requireDB(); err != nil {
+		return fail("backup", err)
+	}
+	db, err := initDB()
+	if err != nil {
+		return fail("backup", err)
+	}
+	defer db.Close()
+
+	if _, err := db.Exec("VACUUM INTO ?", *output); err != nil {
+		return fail("backup", err)
+	}
+	if err := checkBackupEncrypted(*output); err != nil {
+		return fail("backup", err)
+	}
+
+	fmt.Fprintf(os.Stderr, "Backed up %s to %s\n", dbFile, *output)
+	return 0
+}
+
+// runAnonymize writes an anonymized copy of the database and prints what it
+// changed as JSON. It exits with 1 when the copy doesn't pass the
+// consistency check, which happens when the database doesn't either.
+func runAnonymize(args []string) int {
+	flags, showVersion := commandFlags("anonymize")
+	output := flags.String("o", "", "File to write the anonymized copy to; it must not exist")
+	seed := flags.Int64("seed", 0, "Seed of the made-up values; the same seed makes the same copy of the same data (default random)")
+	flags.Parse(args)
+	if *showVersion {
+		printVersion()
+		return 0
+	}
+
+	if *output == "" {
+		return fail("anonymize", fmt.Errorf("-o is required"))
+	}
+	if _, err := os.Stat(*output); err == nil {
+		return fail("anonymize", fmt.Errorf("%s already exists", *output))
+	}
+	seeded := false
+	flags.Visit(func(f *flag.Flag) { seeded = seeded || f.Name == "seed" })
+	if !seeded {
+		*seed = rand.Int64()
+	}
+	if err := requireDB(); err != nil {
+		return fail("anonymize", err)
+	}
+	db, err := initDB()
+	if err != nil {
+		return fail("anonymize", err)
+	}
+	defer db.Close()
+
+	result, err := anonymizeDatabase(db, *output, *seed)
+	if err != nil {
+		os.Remove(*output)
+		return fail("anonymize", err)
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(result)
+	if len(result.Consistency.Problems) > 0 {
+		return fail("anonymize", fmt.Errorf("the copy has %d rows with problems; check the database with consistency", result.Consistency.Rows))
+	}
+	fmt.Fprintf(os.Stderr, "Anonymized %s to %s\n", dbFile, *output)
+	return 0
+}
+
+// runRestore replaces the database with a backup, from a file or an S3
+// bucket. The server should be stopped first.
+func runRestore(args []string) int {
+	flags, showVersion := commandFlags("restore")
+	from := flags.String("from", "", "Backup to restore: a file, or s3://bucket/key as listed by GET /api/v1/admin/backups")
+	confirmed := flags.Bool("yes", false, "Don't ask before replacing the database")
+	s3 := s3Flags(flags)
+	flags.Parse(args)
+	if *showVersion {
+		printVersion()
+		return 0
+	}
+
+	if *from == "" {
+		return fail("restore", fmt.Errorf("-from is required"))
+	}
+
+	// Fetch the backup next to the database, so it can be renamed into place
+	if err := os.MkdirAll(filepath.Dir(dbFile), 0755); err != nil {
+		return fail("restore", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(dbFile), filepath.Base(dbFile)+".restore-*")
+	if err != nil {
+		return fail("restore", err)
+	}
+	defer os.Remove(tmp.Name())
+	err = fetchBackup(tmp, *from, *s3)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fail("restore", err)
+	}
+	if err := checkBackup(tmp.Name(), dbKey); err != nil {
+		return fail("restore", fmt.Errorf("%s is not a usable backup: %v", *from, err))
+	}
+
+	if _, err := os.Stat(dbFile); err == nil {
+		if err := confirm(fmt.Sprintf("restoring replaces all data in %s; the current file is kept next to it", dbFile), *confirmed); err != nil {
+			return fail("restore", err)
+		}
+	}
+	previous, err := replaceDatabase(tmp.Name())
+	if err != nil {
+		return fail("restore", err)
+	}
+
+	fmt.Fprintf(os.Stderr, "Restored %s from %s\n", dbFile, *from)
+	if previous != "" {
+		fmt.Fprintf(os.Stderr, "The previous database was moved to %s\n", previous)
+	}
+	return 0
+}
+
+// runEncrypt encrypts a plaintext database in place with -db-key. The server
+// should be stopped first.
+func runEncrypt(args []string) int {
+	flags, showVersion := commandFlags("encrypt")
+	flags.Parse(args)
+	if *showVersion {
+		printVersion()
+		return 0
+	}
+
+	if dbKey == "" {
+		return fail("encrypt", fmt.Errorf("-db-key or CONDO_DB_KEY is required"))
+	}
+	if err := requireDB(); err != nil {
+		return fail("encrypt", err)
+	}
+	if plaintext, err := plaintextDatabase(dbFile); err != nil {
+		return fail("encrypt", err)
+	} else if !plaintext {
+		return fail("encrypt", fmt.Errorf("%s is already encrypted", dbFile))
+	}
+	if err := rekeyDatabase("", dbKey); err != nil {
+		return fail("encrypt", err)
+	}
+
+	fmt.Fprintf(os.Stderr, "Encrypted %s. Keep the key safe: without it the data can't be recovered.\n", dbFile)
+	fmt.Fprintln(os.Stderr, "Backups taken before stay unencrypted; delete them or keep them somewhere safe.")
+	return 0
+}
+
+// runDecrypt turns the database encrypted with -db-key back into a plaintext
+// one, in place. The server should be stopped first.
+func runDecrypt(args []string) int {
+	flags, showVersion := commandFlags("decrypt")
+	flags.Parse(args)
+	if *showVersion {
+		printVersion()
+		return 0
+	}
+
+	if dbKey == "" {
+		return fail("decrypt", fmt.Errorf("-db-key or CONDO_DB_KEY is required"))
+	}
+	if err := requireDB(); err != nil {
+		return fail("decrypt", err)
+	}
+	if err := rekeyDatabase(dbKey, ""); err != nil {
+		return fail("decrypt", err)
+	}
+
+	fmt.Fprintf(os.Stderr, "Decrypted %s; start the server without -db-key from now on\n", dbFile)
+	return 0
+}
+
+// runSample replaces the data with the sample data
+func runSample(args []string) int {
+	flags, showVersion := commandFlags("sample")
+	confirmed := flags.Bool("yes", false, "Don't ask before replacing existing data")
+	flags.Parse(args)
+	if *showVersion {
+		printVersion()
+		return 0
+	}
+
+	db, err := initDB()
+	if err != nil {
+		return fail("sample", err)
+	}
+	defer db.Close()
+
+	if err := confirmSampleData(db, *confirmed); err != nil {
+		return fail("sample", err)
+	}
+	if err := insertSampleData(db); err != nil {
+		return fail("sample", err)
+	}
+
+	fmt.Fprintln(os.Stderr, "Sample data loaded")
+	return 0
+}
+
+// runMaintenance runs database maintenance, or with -stats just reports the
+// database size, and prints the result as JSON. It exits with 1 when the
+// integrity check finds problems.
+func runMaintenance(args []string) int {
+	flags, showVersion := commandFlags("maintenance")
+	statsOnly := flags.Bool("stats", false, "Only print the database size and row counts")
+	flags.Parse(args)
+	if *showVersion {
+		printVersion()
+		return 0
+	}
+
+	if err := requireDB(); err != nil {
+		return fail("maintenance", err)
+	}
+	db, err := initDB()
+	if err != nil {
+		return fail("maintenance", err)
+	}
+	defer db.Close()
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if *statsOnly {
+		stats, err := databaseStats(db)
+		if err != nil {
+			return fail("maintenance", err)
+		}
+		encoder.Encode(stats)
+		return 0
+	}
+
+	result, err := maintainDatabase(db)
+	if err != nil {
+		return fail("maintenance", err)
+	}
+	encoder.Encode(result)
+	if !result.Vacuumed {
+		return fail("maintenance", fmt.Errorf("integrity check failed"))
+	}
+	return 0
+}
+
+// runConsistency reports the problems found in the data, after applying the
+// fixes given with -fix, and prints the result as JSON. It exits with 1 when
+// problems are left.
+func runConsistency(args []string) int {
+	flags, showVersion := commandFlags("consistency")
+	fix := flags.String("fix", "", "Comma-separated fixes to apply first: assign_unknown_resident, backfill_defaults")
+	flags.Parse(args)
+	if *showVersion {
+		printVersion()
+		return 0
+	}
+
+	var fixes []string
+	if *fix != "" {
+		for _, f := range strings.Split(*fix, ",") {
+			fixes = append(fixes, strings.TrimSpace(f))
+		}
+		if err := validateConsistencyFixes(fixes); err != nil {
+			return fail("consistency", err)
+		}
+	}
+
+	if err := requireDB(); err != nil {
+		return fail("consistency", err)
+	}
+	db, err := initDB()
+	if err != nil {
+		return fail("consistency", err)
+	}
+	defer db.Close()
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	var report ConsistencyReport
+	if len(fixes) > 0 {
+		result, err := fixConsistency(db, nil, fixes)
+		if err != nil {
+			return fail("consistency", err)
+		}
+		encoder.Encode(result)
+		report = result.Report
+	} else {
+		if report, err = checkConsistency(db); err != nil {
+			return fail("consistency", err)
+		}
+		encoder.Encode(report)
+	}
+	if len(report.Problems) > 0 {
+		return fail("consistency", fmt.Errorf("%d rows with problems", report.Rows))
+	}
+	return 0
+}
+
+// runRecompute rebuilds the figures derived from the payments and charges and
+// prints what it corrected as JSON. With -check nothing is changed, and it
+// exits with 1 when there are discrepancies.
+func runRecompute(args []string) int {
+	flags, showVersion := commandFlags("recompute")
+	check := flags.Bool("check", false, "Only report the discrepancies, changing nothing")
+	flags.Parse(args)
+	if *showVersion {
+		printVersion()
+		return 0
+	}
+
+	if err := requireDB(); err != nil {
+		return fail("recompute", err)
+	}
+	db, err := initDB()
+	if err != nil {
+		return fail("recompute", err)
+	}
+	defer db.Close()
+
+	// Payments are allocated oldest charges first, as import does.
+	result, err := recompute(db, nil, *check, paymentRules{allocation: AllocationFIFO})
+	if err != nil {
+		return fail("recompute", err)
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(result)
+	if *check && result.Discrepancies > 0 {
+		return fail("recompute", fmt.Errorf("%d discrepancies", result.Discrepancies))
+	}
+	return 0
+}
+
+const userUsage = `Usage: condomngr user <action> [flags] [username]
+
+Actions:
+  add             Create a user; prints a temporary password unless -password-stdin is given
+  list            List users
+  disable         Disable a user
+  enable          Enable a disabled user
+  reset-password  Set a new temporary password, or the one on stdin with -password-stdin
+  unlock          Clear the failed sign-ins and lockout of a username, or of a client IP with -ip
+  reset-2fa       Turn off the two-factor authentication of a user who lost their authenticator
+`
+
+// runUser manages users from the command line, e.g. to create the first admin
+func runUser(args []string) int {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		fmt.Fprint(os.Stderr, userUsage)
+		return 2
+	}
+	action, args := args[0], args[1:]
+
+	flags, showVersion := commandFlags("user " + action)
+	role := flags.String("role", RoleViewer, "Role of the new user: admin, treasurer or viewer")
+	email := flags.String("email", "", "Email address of the new user, where password reset links are sent")
+	passwordStdin := flags.Bool("password-stdin", false, "Read the password from stdin instead of generating a temporary one")
+	ip := flags.String("ip", "", "Client IP to unlock instead of a username")
+	flags.Parse(args)
+	if *showVersion {
+		printVersion()
+		return 0
+	}
+
+	username := flags.Arg(0)
+	switch action {
+	case "list":
+	case "unlock":
+		if (flags.NArg() == 1) == (*ip != "") || flags.NArg() > 1 {
+			return fail("user unlock", fmt.Errorf("expected either a username or -ip"))
+		}
+	case "add", "disable", "enable", "reset-password", "reset-2fa":
+		if flags.NArg() != 1 {
+			return fail("user "+action, fmt.Errorf("expected a username"))
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "condomngr user: unknown action %q\n\n", action)
+		fmt.Fprint(os.Stderr, userUsage)
+		return 2
+	}
+
+	if action != "add" {
+		if err := requireDB(); err != nil {
+			return fail("user "+action, err)
+		}
+	}
+	db, err := initDB()
+	if err != nil {
+		return fail("user "+action, err)
+	}
+	defer db.Close()
+
+	// Failed sign-ins are counted for usernames that don't exist too
+	if action == "unlock" {
+		kind, value := LoginByUsername, username
+		if *ip != "" {
+			kind, value = LoginByIP, *ip
+		}
+		cleared, err := NewLoginGuard(db, nil, 0, 0, 0).Clear(kind, value)
+		if err != nil {
+			return fail("user unlock", err)
+		}
+		if !cleared {
+			return fail("user unlock", fmt.Errorf("no failed sign-ins for %s %s", kind, value))
+		}
+		fmt.Fprintf(os.Stderr, "Cleared the failed sign-ins of %s %s\n", kind, value)
+		return 0
+	}
+
+	// New and reset passwords are temporary unless given on stdin, so
+	// whoever receives one has to pick their own
+	password, temporary := "", !*passwordStdin
+	if action == "add" || action == "reset-password" {
+		if *passwordStdin {
+			line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+			if err != nil && err != io.EOF {
+				return fail("user "+action, err)
+			}
+			password = strings.TrimRight(line, "\r\n")
+		} else if password, err = temporaryPassword(); err != nil {
+			return fail("user "+action, err)
+		}
+	}
+
+	switch action {
+	case "list":
+		users, err := listUsers(db)
+		if err != nil {
+			return fail("user list", err)
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tUSERNAME\tROLE\tSTATUS\tCREATED")
+		for _, u := range users {
+			status := "enabled"
+			if u.Disabled {
+				status = "disabled"
+			} else if u.MustChangePassword {
+				status = "must change password"
+			}
+			fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\n", u.ID, u.Username, u.Role, status, u.CreatedAt.Format("2006-01-02"))
+		}
+		tw.Flush()
+		return 0
+
+	case "add":
+		req := NewUserRequest{Username: username, Password: password, Email: *email, Role: *role, MustChangePassword: temporary}
+		if err := validateNewUser(req); err != nil {
+			return fail("user add", err)
+		}
+		if _, err := createUser(db, req); err != nil {
+			return fail("user add", err)
+		}
+		fmt.Fprintf(os.Stderr, "Created %s %s\n", *role, username)
+	}
+
+	user, err := findUserByName(db, username)
+	if err != nil {
+		return fail("user "+action, err)
+	}
+	switch action {
+	case "disable", "enable":
+		if err := setUserDisabled(db, user.ID, action == "disable"); err != nil {
+			return fail("user "+action, err)
+		}
+		fmt.Fprintf(os.Stderr, "%s %sd\n", username, action)
+
+	case "reset-password":
+		var errs ValidationErrors
+		validatePassword(&errs, "password", password)
+		if err := errs.Err(); err != nil {
+			return fail("user reset-password", err)
+		}
+		if err := setUserPassword(db, user.ID, password, temporary, ""); err != nil {
+			return fail("user reset-password", err)
+		}
+		fmt.Fprintf(os.Stderr, "Password of %s reset\n", username)
+
+	case "reset-2fa":
+		reset, err := resetTwoFactor(db, user.ID)
+		if err != nil {
+			return fail("user reset-2fa", err)
+		}
+		if !reset {
+			return fail("user reset-2fa", fmt.Errorf("%s doesn't have two-factor authentication", username))
+		}
+		fmt.Fprintf(os.Stderr, "Two-factor authentication of %s turned off\n", username)
+	}
+
+	if temporary && (action == "add" || action == "reset-password") {
+		fmt.Fprintf(os.Stderr, "Temporary password, to be changed at first sign-in:\n")
+		fmt.Println(password)
+	}
+	return 0
+}
@@ -0,0 +1,13 @@
+// Command condomngr runs the condominium manager: the web server by default,
+// or one of the maintenance commands.
+package main
+
+import (
+	"os"
+
+	"condomngr"
+)
+
+func main() {
+	os.Exit(condomngr.Main(os.Args[1:]))
+}
@@ -0,0 +1,545 @@
+package condomngr
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// DefaultCondoID is the condo of the database the server starts on. Requests
+// that don't name a condo are for it, so single-condo installs see no change.
+const DefaultCondoID = 1
+
+// condoHeader names the condo a request is for, as an alternative to the
+// /condos/{id} path prefix
+const condoHeader = "X-Condo-ID"
+
+// condoPath matches API paths under a condo: /api/v1/condos/2/residents is
+// /api/v1/residents of condo 2
+var condoPath = regexp.MustCompile(`^(/api(?:/v1)?)/condos/([0-9]+)(/.*)$`)
+
+// instancePaths are the API paths of users and sign-in, which are of the
+// instance: users and sessions live in the default condo's database, and the
+// other condos don't serve them
+var instancePaths = []string{"/users", "/auth", "/sessions", "/password-reset", "/admin/sessions", "/admin/2fa", "/condos"}
+
+// publicCondoPaths are the API paths of another condo reached without
+// signing in: the links emailed to residents, and webhooks that authenticate
+// themselves
+var publicCondoPaths = []string{"/unsubscribe", "/portal", "/maintenance-requests/inbound", "/integrations/stripe/webhook"}
+
+// Condo is a condominium managed by the instance. Each has its own database,
+// so no query can reach the data of another.
+type Condo struct {
+	ID        int       `json:"id"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// CondoGrant gives a user who isn't an admin access to a condo other than the
+// default one
+type CondoGrant struct {
+	CondoID int `json:"condo_id"`
+}
+
+// Condos opens the databases of the condos and routes requests to them. The
+// condos are listed in the default condo's database.
+type Condos struct {
+	db        *sql.DB
+	newServer func(id int, db *sql.DB) (*Server, error)
+
+	mu      sync.Mutex
+	servers map[int]*condoServer
+}
+
+// condoServer is an open condo other than the default one
+type condoServer struct {
+	db     *sql.DB
+	server *Server
+}
+
+// NewCondos manages the condos listed in db, the default condo's database.
+// newServer sets up the server of another condo on its database, once opened.
+func NewCondos(db *sql.DB, newServer func(id int, db *sql.DB) (*Server, error)) *Condos {
+	return &Condos{db: db, newServer: newServer, servers: map[int]*condoServer{}}
+}
+
+// condoAPIURL is where the API of condo id is reached at publicURL, the
+// public URL of the application: /api/v1 for the default condo and
+// /api/v1/condos/{id} for the others. Links in emails point under it, so they
+// reach the condo they were sent from.
+func condoAPIURL(publicURL string, id int) string {
+	apiURL := strings.TrimRight(publicURL, "/") + "/api/v1"
+	if id != DefaultCondoID {
+		apiURL += fmt.Sprintf("/condos/%d", id)
+	}
+	return apiURL
+}
+
+// condoDBFile is the database of a condo other than the default one, next to
+// the default condo's: condo.db, condo-2.db, condo-3.db and so on
+func condoDBFile(id int) string {
+	ext := filepath.Ext(dbFile)
+	return fmt.Sprintf("%s-%d%s", strings.TrimSuffix(dbFile, ext), id, ext)
+}
+
+// server returns the server of a condo other than the default one, opening its
+// database on first use. It returns sql.ErrNoRows for an unknown condo.
+func (c *Condos) server(id int) (*Server, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if open, ok := c.servers[id]; ok {
+		return open.server, nil
+	}
+
+	var exists int
+	if err := c.db.QueryRow("SELECT 1 FROM condos WHERE id = ?", id).Scan(&exists); err != nil {
+		return nil, err
+	}
+	db, err := OpenDB(condoDBFile(id))
+	if err != nil {
+		return nil, err
+	}
+	server, err := c.newServer(id, db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	c.servers[id] = &condoServer{db: db, server: server}
+	return server, nil
+}
+
+// OpenAll opens every condo listed, so their scheduled work, backups
+// included, runs without waiting for a request. Condos that fail to open are
+// logged and left to open on their first request.
+func (c *Condos) OpenAll() error {
+	rows, err := c.db.Query("SELECT id FROM condos WHERE id != ? ORDER BY id", DefaultCondoID)
+	if err != nil {
+		return err
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if _, err := c.server(id); err != nil {
+			log.Printf("Failed to open condo %d: %v", id, err)
+		}
+	}
+	return nil
+}
+
+// Close closes the servers and databases of the condos opened so far
+func (c *Condos) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var firstErr error
+	for id, open := range c.servers {
+		if err := open.server.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		if err := open.db.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(c.servers, id)
+	}
+	return firstErr
+}
+
+// requestCondo returns the condo a request is for and its path within that
+// condo's API, from the /condos/{id} path prefix or the X-Condo-ID header
+func requestCondo(r *http.Request) (int, string, error) {
+	id, path := 0, r.URL.Path
+	if m := condoPath.FindStringSubmatch(r.URL.Path); m != nil {
+		id, _ = strconv.Atoi(m[2])
+		path = m[1] + m[3]
+	}
+	if header := r.Header.Get(condoHeader); header != "" {
+		headerID, err := strconv.Atoi(header)
+		if err != nil || headerID < 1 {
+			return 0, "", fmt.Errorf("Invalid %s", condoHeader)
+		}
+		if id != 0 && id != headerID {
+			return 0, "", fmt.Errorf("%s doesn't match the condo in the path", condoHeader)
+		}
+		id = headerID
+	}
+	if id == 0 {
+		id = DefaultCondoID
+	}
+	return id, path, nil
+}
+
+// underPath reports whether path is one of paths or under one of them
+func underPath(path string, paths []string) bool {
+	for _, p := range paths {
+		if path == p || strings.HasPrefix(path, p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// apiPath returns path within the API, without the /api/v1 or /api prefix,
+// and whether it is in the API at all
+func apiPath(path string) (string, bool) {
+	for _, prefix := range []string{"/api/v1", "/api"} {
+		if rest, ok := strings.CutPrefix(path, prefix); ok && strings.HasPrefix(rest, "/") {
+			return rest, true
+		}
+	}
+	return "", false
+}
+
+// condoGranted reports whether userID was granted access to condo id
+func condoGranted(db *sql.DB, userID, id int) (bool, error) {
+	var granted int
+	err := db.QueryRow("SELECT COUNT(*) FROM condo_grants WHERE user_id = ? AND condo_id = ?", userID, id).Scan(&granted)
+	return granted > 0, err
+}
+
+// authorize returns the session of a request for condo id, found in the
+// default condo's database where users live. Admins reach every condo, other
+// users the condos granted to them; the rest get 401 or 403.
+func (c *Condos) authorize(w http.ResponseWriter, r *http.Request, id int) (Session, bool) {
+	session, ok := requireSession(c.db, w, r)
+	if !ok {
+		return Session{}, false
+	}
+	if session.User.MustChangePassword {
+		respondWithError(w, http.StatusForbidden, "Change your password first")
+		return Session{}, false
+	}
+	if session.User.Role == RoleAdmin {
+		return session, true
+	}
+	granted, err := condoGranted(c.db, session.User.ID, id)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return Session{}, false
+	}
+	if !granted {
+		respondWithError(w, http.StatusForbidden, "You don't have access to this condo")
+		return Session{}, false
+	}
+	return session, true
+}
+
+// Handler routes requests for another condo to its server, and the rest to
+// main, the default condo's. Requests for another condo need the session of
+// a user who may reach it, but for its public paths.
+func (c *Condos) Handler(main http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Language", requestLanguage(r))
+		id, path, err := requestCondo(r)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		next := main
+		if id != DefaultCondoID {
+			rest, inAPI := apiPath(path)
+			if inAPI && underPath(rest, instancePaths) {
+				respondWithError(w, http.StatusNotFound, "Users and sign-in are served by the default condo")
+				return
+			}
+			if !inAPI || !underPath(rest, publicCondoPaths) {
+				session, ok := c.authorize(w, r, id)
+				if !ok {
+					return
+				}
+				r = r.WithContext(context.WithValue(r.Context(), condoSessionKey{}, session))
+			}
+
+			server, err := c.server(id)
+			if err == sql.ErrNoRows {
+				respondWithError(w, http.StatusNotFound, "Condo not found")
+				return
+			}
+			if err != nil {
+				respondWithError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			next = server
+		}
+		if path != r.URL.Path {
+			r = r.Clone(r.Context())
+			r.URL.Path, r.URL.RawPath = path, ""
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Get all condos
+func getCondos(c *Condos) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rows, err := c.db.Query("SELECT id, name, created_at FROM condos ORDER BY id")
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		defer rows.Close()
+
+		condos := []Condo{}
+		for rows.Next() {
+			var condo Condo
+			if err := rows.Scan(&condo.ID, &condo.Name, &condo.CreatedAt); err != nil {
+				respondWithError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			condos = append(condos, condo)
+		}
+		if err := rows.Err(); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		respondWithJSON(w, http.StatusOK, condos)
+	}
+}
+
+// Get a single condo
+func getCondo(c *Condos) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id, err := strconv.Atoi(vars["id"])
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid condo ID")
+			return
+		}
+
+		var condo Condo
+		err = c.db.QueryRow("SELECT id, name, created_at FROM condos WHERE id = ?", id).Scan(&condo.ID, &condo.Name, &condo.CreatedAt)
+		if err == sql.ErrNoRows {
+			respondWithError(w, http.StatusNotFound, "Condo not found")
+			return
+		}
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		respondWithJSON(w, http.StatusOK, condo)
+	}
+}
+
+// Create a condo and its empty database
+func createCondo(c *Condos) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var condo Condo
+		if err := decodeRequest(r, &condo); err != nil {
+			respondWithError(w, payloadErrorStatus(err), "Invalid request payload: "+err.Error())
+			return
+		}
+		defer r.Body.Close()
+
+		condo.Name = strings.TrimSpace(condo.Name)
+		var errs ValidationErrors
+		if condo.Name == "" {
+			errs.Add("name", "name is required")
+		}
+		if err := errs.Err(); err != nil {
+			respondWithValidationError(w, err)
+			return
+		}
+
+		result, err := c.db.Exec("INSERT INTO condos(name) VALUES(?)", condo.Name)
+		if isUniqueViolation(err) {
+			respondWithError(w, http.StatusConflict, "A condo with this name already exists")
+			return
+		}
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		id, err := result.LastInsertId()
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		condo.ID = int(id)
+
+		// Open the database now, so a condo that can't be set up isn't listed
+		if _, err := c.server(condo.ID); err != nil {
+			c.db.Exec("DELETE FROM condos WHERE id = ?", condo.ID)
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		respondWithJSON(w, http.StatusCreated, condo)
+	}
+}
+
+// Get the condos other than the default one a user was granted access to
+func getUserCondos(c *Condos) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(mux.Vars(r)["id"])
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid user ID")
+			return
+		}
+		if _, err := findUser(c.db, id); err != nil {
+			respondWithUserError(w, err)
+			return
+		}
+
+		rows, err := c.db.Query(`
+			SELECT c.id, c.name, c.created_at FROM condo_grants g JOIN condos c ON c.id = g.condo_id
+			WHERE g.user_id = ? ORDER BY c.id
+		`, id)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		defer rows.Close()
+
+		condos := []Condo{}
+		for rows.Next() {
+			var condo Condo
+			if err := rows.Scan(&condo.ID, &condo.Name, &condo.CreatedAt); err != nil {
+				respondWithError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			condos = append(condos, condo)
+		}
+		if err := rows.Err(); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		respondWithJSON(w, http.StatusOK, condos)
+	}
+}
+
+// Grant a user access to a condo other than the default one
+func grantUserCondo(c *Condos) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(mux.Vars(r)["id"])
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid user ID")
+			return
+		}
+		var grant CondoGrant
+		if err := decodeRequest(r, &grant); err != nil {
+			respondWithError(w, payloadErrorStatus(err), "Invalid request payload: "+err.Error())
+			return
+		}
+		defer r.Body.Close()
+
+		user, err := findUser(c.db, id)
+		if err != nil {
+			respondWithUserError(w, err)
+			return
+		}
+		var errs ValidationErrors
+		if grant.CondoID == DefaultCondoID {
+			errs.Add("condo_id", "every user has access to the default condo")
+		} else if grant.CondoID < 1 {
+			errs.Add("condo_id", "condo_id is required")
+		}
+		if err := errs.Err(); err != nil {
+			respondWithValidationError(w, err)
+			return
+		}
+
+		var condo Condo
+		err = c.db.QueryRow("SELECT id, name, created_at FROM condos WHERE id = ?", grant.CondoID).Scan(&condo.ID, &condo.Name, &condo.CreatedAt)
+		if err == sql.ErrNoRows {
+			respondWithError(w, http.StatusNotFound, "Condo not found")
+			return
+		}
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		tx, err := c.db.Begin()
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		defer tx.Rollback()
+		if _, err := tx.Exec("INSERT OR IGNORE INTO condo_grants(user_id, condo_id) VALUES(?, ?)", id, condo.ID); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if err := recordAudit(tx, r, AuditCondoGranted, "user "+user.Username, fmt.Sprintf("condo %d (%s)", condo.ID, condo.Name)); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		respondWithJSON(w, http.StatusCreated, condo)
+	}
+}
+
+// Revoke a user's access to a condo
+func revokeUserCondo(c *Condos) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id, err := strconv.Atoi(vars["id"])
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid user ID")
+			return
+		}
+		condoID, err := strconv.Atoi(vars["condo_id"])
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid condo ID")
+			return
+		}
+		user, err := findUser(c.db, id)
+		if err != nil {
+			respondWithUserError(w, err)
+			return
+		}
+
+		tx, err := c.db.Begin()
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		defer tx.Rollback()
+		result, err := tx.Exec("DELETE FROM condo_grants WHERE user_id = ? AND condo_id = ?", id, condoID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			respondWithError(w, http.StatusNotFound, "The user doesn't have access to this condo")
+			return
+		}
+		if err := recordAudit(tx, r, AuditCondoRevoked, "user "+user.Username, fmt.Sprintf("condo %d", condoID)); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		respondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
+	}
+}
@@ -0,0 +1,317 @@
+package condomngr
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testPublicURL is the public URL of the condos test server, which links in
+// emails are built on
+const testPublicURL = "https://condo.example.com"
+
+// newCondosTestServer starts the application with the condo routing of
+// runServe on a fresh default condo database, and adds a second condo
+func newCondosTestServer(t testing.TB) (*testServer, *Condos) {
+	t.Helper()
+	dir := t.TempDir()
+	previous := dbFile
+	dbFile = filepath.Join(dir, "condo.db")
+	t.Cleanup(func() { dbFile = previous })
+
+	db, err := OpenDB(dbFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	condos := NewCondos(db, func(id int, condoDB *sql.DB) (*Server, error) {
+		return NewServer(condoDB, Options{PublicURL: testPublicURL, CondoID: id})
+	})
+	t.Cleanup(func() { condos.Close() })
+	server, err := NewServer(db, Options{PublicURL: testPublicURL, Condos: condos})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+	ts := httptest.NewServer(condos.Handler(server))
+	t.Cleanup(ts.Close)
+
+	s := &testServer{Server: ts, t: t, db: db}
+	s.token = s.signIn("admin", RoleAdmin)
+	s.expect(http.StatusCreated, "POST", "/api/v1/condos", map[string]string{"name": "Second"}, nil)
+	return s, condos
+}
+
+// linkPath is the path and query of a link built on testPublicURL, to request
+// from the test server
+func linkPath(t testing.TB, link string) string {
+	t.Helper()
+	rest, ok := strings.CutPrefix(link, testPublicURL)
+	if !ok {
+		t.Fatalf("link %q isn't under %s", link, testPublicURL)
+	}
+	return rest
+}
+
+func TestCondoAPIURL(t *testing.T) {
+	for _, tt := range []struct {
+		publicURL string
+		id        int
+		want      string
+	}{
+		{"https://condo.example.com", DefaultCondoID, "https://condo.example.com/api/v1"},
+		{"https://condo.example.com/", 2, "https://condo.example.com/api/v1/condos/2"},
+		{"https://example.com/condo", 3, "https://example.com/condo/api/v1/condos/3"},
+	} {
+		if got := condoAPIURL(tt.publicURL, tt.id); got != tt.want {
+			t.Errorf("condoAPIURL(%q, %d) = %q, want %q", tt.publicURL, tt.id, got, tt.want)
+		}
+	}
+}
+
+func TestCondoUnsubscribeLinks(t *testing.T) {
+	s, condos := newCondosTestServer(t)
+	var resident Resident
+	s.expect(http.StatusCreated, "POST", "/api/v1/condos/2/residents", map[string]string{"name": "Ana Silva", "unit": "1A", "email": "ana@example.com"}, &resident)
+
+	// Sign a link as condo 2's server does, with the secret in its database
+	if _, err := condos.server(2); err != nil {
+		t.Fatal(err)
+	}
+	secret, err := loadOrCreateSecret(condos.servers[2].db, "unsubscribe_secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	link := NewUnsubscribe(secret, condoAPIURL(testPublicURL, 2)).URL(resident.ID, NotifyAll)
+	if !strings.HasPrefix(link, testPublicURL+"/api/v1/condos/2/unsubscribe?token=") {
+		t.Fatalf("link %q", link)
+	}
+
+	// Residents follow the link without signing in
+	admin := s.token
+	s.token = ""
+	s.expect(http.StatusOK, "GET", linkPath(t, link), nil, nil)
+	s.token = admin
+	var prefs NotificationPreferences
+	s.expect(http.StatusOK, "GET", fmt.Sprintf("/api/v1/condos/2/residents/%d/notifications", resident.ID), nil, &prefs)
+	if prefs.Receipts != "none" || prefs.Statements != "none" {
+		t.Errorf("preferences after unsubscribing: %+v", prefs)
+	}
+	// The same link doesn't verify against the default condo
+	s.expect(http.StatusBadRequest, "GET", strings.Replace(linkPath(t, link), "/condos/2", "", 1), nil, nil)
+}
+
+func TestCondoPortalLinks(t *testing.T) {
+	s, _ := newCondosTestServer(t)
+	var resident Resident
+	s.expect(http.StatusCreated, "POST", "/api/v1/condos/2/residents", map[string]string{"name": "Ana Silva", "unit": "1A"}, &resident)
+
+	var token PortalToken
+	s.expect(http.StatusCreated, "POST", fmt.Sprintf("/api/v1/condos/2/residents/%d/portal-token", resident.ID), map[string]int{"expires_in_days": 30}, &token)
+	u, err := url.Parse(token.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Path != "/api/v1/condos/2/portal/me" {
+		t.Fatalf("portal link %q", token.URL)
+	}
+	var me Resident
+	s.token = ""
+	s.expect(http.StatusOK, "GET", linkPath(t, token.URL), nil, &me)
+	if me.Name != "Ana Silva" {
+		t.Errorf("portal shows %+v", me)
+	}
+}
+
+// TestCondoUsersOnDefault checks that users and sign-in, which live in the
+// default condo's database, aren't served for another condo
+func TestCondoUsersOnDefault(t *testing.T) {
+	s, _ := newCondosTestServer(t)
+	for _, e := range []struct{ method, path string }{
+		{"GET", "/api/v1/condos/2/users"},
+		{"POST", "/api/v1/condos/2/auth/login"},
+		{"GET", "/api/v1/condos/2/auth/session"},
+		{"GET", "/api/v1/condos/2/sessions"},
+		{"GET", "/api/v1/condos/2/password-reset/confirm?token=x"},
+		{"GET", "/api/v1/condos/2/admin/2fa"},
+		{"GET", "/api/v1/condos/2/condos"},
+		{"GET", "/api/condos/2/users"},
+	} {
+		s.expect(http.StatusNotFound, e.method, e.path, nil, nil)
+	}
+	s.expect(http.StatusOK, "GET", "/api/v1/condos/2/admin/dbstats", nil, nil)
+}
+
+func TestCondoGrants(t *testing.T) {
+	s, _ := newCondosTestServer(t)
+	admin := s.token
+	viewer := s.signIn("victor", RoleViewer)
+	var victorID int
+	if err := s.db.QueryRow("SELECT id FROM users WHERE username = 'victor'").Scan(&victorID); err != nil {
+		t.Fatal(err)
+	}
+	grants := fmt.Sprintf("/api/v1/users/%d/condos", victorID)
+
+	// Condos and who may reach them are managed by admins
+	for _, e := range []struct {
+		method, path string
+		body         interface{}
+	}{
+		{"GET", "/api/v1/condos", nil},
+		{"POST", "/api/v1/condos", Condo{Name: "Third"}},
+		{"GET", "/api/v1/condos/2", nil},
+		{"GET", grants, nil},
+		{"POST", grants, CondoGrant{CondoID: 2}},
+		{"DELETE", grants + "/2", nil},
+	} {
+		s.token = ""
+		s.expect(http.StatusUnauthorized, e.method, e.path, e.body, nil)
+		s.token = viewer
+		s.expect(http.StatusForbidden, e.method, e.path, e.body, nil)
+	}
+
+	// Other condos take users granted access, and admins
+	s.token = ""
+	s.expect(http.StatusUnauthorized, "GET", "/api/v1/condos/2/residents", nil, nil)
+	s.token = viewer
+	s.expect(http.StatusForbidden, "GET", "/api/v1/condos/2/residents", nil, nil)
+	s.token = admin
+	s.expect(http.StatusUnprocessableEntity, "POST", grants, CondoGrant{CondoID: DefaultCondoID}, nil)
+	s.expect(http.StatusNotFound, "POST", grants, CondoGrant{CondoID: 9}, nil)
+	s.expect(http.StatusNotFound, "POST", "/api/v1/users/999999/condos", CondoGrant{CondoID: 2}, nil)
+	s.expect(http.StatusCreated, "POST", grants, CondoGrant{CondoID: 2}, nil)
+	var condos []Condo
+	s.expect(http.StatusOK, "GET", grants, nil, &condos)
+	if len(condos) != 1 || condos[0].ID != 2 {
+		t.Errorf("granted condos %+v, want condo 2", condos)
+	}
+
+	// With a grant the user has their role in the condo
+	s.token = viewer
+	s.expect(http.StatusOK, "GET", "/api/v1/condos/2/residents", nil, nil)
+	s.expect(http.StatusForbidden, "GET", "/api/v1/condos/2/admin/audit", nil, nil)
+
+	// The condo's audit log names the user of the default condo's session
+	s.token = admin
+	var expense Expense
+	s.expect(http.StatusCreated, "POST", "/api/v1/condos/2/expenses", map[string]interface{}{"amount": 10, "description": "Bulbs", "expense_date": "2024-03-05", "category": "Misc"}, &expense)
+	s.expect(http.StatusOK, "POST", "/api/v1/condos/2/expenses/bulk-update", map[string]interface{}{"filter": map[string][]int{"ids": {expense.ID}}, "patch": map[string]string{"category": "Lighting"}}, nil)
+	var audit []AuditEntry
+	s.expect(http.StatusOK, "GET", "/api/v1/condos/2/admin/audit?action="+AuditExpensesBulkUpdated, nil, &audit)
+	if len(audit) != 1 || audit[0].Actor != "admin" {
+		t.Errorf("condo 2 audit %+v, want a bulk update by admin", audit)
+	}
+
+	s.expect(http.StatusOK, "DELETE", grants+"/2", nil, nil)
+	s.expect(http.StatusNotFound, "DELETE", grants+"/2", nil, nil)
+	s.token = viewer
+	s.expect(http.StatusForbidden, "GET", "/api/v1/condos/2/residents", nil, nil)
+}
+
+// TestCondoScoping checks that every CRUD operation on one condo's residents,
+// payments and expenses leaves the other condo's alone. Condo 1 has records 1
+// and 2 of each and condo 2 only record 1, so a condo 1 ID either names a
+// different record in condo 2 or none.
+func TestCondoScoping(t *testing.T) {
+	s, _ := newCondosTestServer(t)
+	prefixes := map[int]string{1: "/api/v1", 2: "/api/v1/condos/2"}
+	names := map[int][]string{1: {"Ana Silva", "Rui Costa"}, 2: {"Eva Lopes"}}
+	for condo, prefix := range prefixes {
+		for i, name := range names[condo] {
+			s.expect(http.StatusCreated, "POST", prefix+"/residents", map[string]string{"name": name, "unit": fmt.Sprint(condo, "A")}, nil)
+			s.expect(http.StatusCreated, "POST", prefix+"/payments", map[string]interface{}{
+				"resident_id": i + 1, "amount": 10 * condo, "description": name + " dues", "payment_date": "2024-03-05",
+			}, nil)
+			s.expect(http.StatusCreated, "POST", prefix+"/expenses", map[string]interface{}{
+				"amount": 100 * condo, "description": name + " repair", "expense_date": "2024-03-10", "category": "Maintenance",
+			}, nil)
+		}
+	}
+
+	entities := []struct {
+		path   string
+		update map[string]interface{}
+	}{
+		{"/expenses", map[string]interface{}{"amount": 5, "description": "Changed", "expense_date": "2024-03-10", "category": "Maintenance"}},
+		{"/payments", map[string]interface{}{"resident_id": 1, "amount": 5, "description": "Changed", "payment_date": "2024-03-05"}},
+		{"/residents", map[string]interface{}{"name": "Changed", "unit": "2A"}},
+	}
+	for _, entity := range entities {
+		t.Run(entity.path[1:], func(t *testing.T) {
+			s := *s
+			s.t = t
+			description := func(condo, id int) string {
+				var record map[string]interface{}
+				s.expect(http.StatusOK, "GET", fmt.Sprint(prefixes[condo], entity.path, "/", id), nil, &record)
+				if entity.path == "/residents" {
+					return record["name"].(string)
+				}
+				return record["description"].(string)
+			}
+			for condo, want := range map[int]int{1: 2, 2: 1} {
+				var list []map[string]interface{}
+				s.expect(http.StatusOK, "GET", prefixes[condo]+entity.path, nil, &list)
+				if len(list) != want {
+					t.Errorf("condo %d lists %d, want %d", condo, len(list), want)
+				}
+			}
+
+			// Condo 1's record 2 doesn't exist in condo 2
+			other := fmt.Sprint(prefixes[2], entity.path, "/2")
+			s.expect(http.StatusNotFound, "GET", other, nil, nil)
+			s.expect(http.StatusNotFound, "PUT", other, entity.update, nil)
+			s.expect(http.StatusNotFound, "DELETE", other, nil, nil)
+
+			// Record 1 of condo 2 changes without touching condo 1's
+			before := description(1, 1)
+			s.expect(http.StatusOK, "PUT", fmt.Sprint(prefixes[2], entity.path, "/1"), entity.update, nil)
+			if got := description(2, 1); got != "Changed" {
+				t.Errorf("condo 2 record after update %q", got)
+			}
+			if got := description(1, 1); got != before {
+				t.Errorf("condo 1 record changed to %q by condo 2's update", got)
+			}
+			s.expect(http.StatusOK, "DELETE", fmt.Sprint(prefixes[2], entity.path, "/1"), nil, nil)
+			s.expect(http.StatusNotFound, "GET", fmt.Sprint(prefixes[2], entity.path, "/1"), nil, nil)
+			if got := description(1, 1); got != before {
+				t.Errorf("condo 1 record %q after condo 2's delete", got)
+			}
+		})
+	}
+}
+
+func TestCondoHeaderScoping(t *testing.T) {
+	s, _ := newCondosTestServer(t)
+	s.createResident("Ana Silva", "1A")
+	s.expect(http.StatusCreated, "POST", "/api/v1/condos/2/residents", map[string]string{"name": "Eva Lopes", "unit": "2A"}, nil)
+
+	for header, want := range map[string]string{"": "Ana Silva", "1": "Ana Silva", "2": "Eva Lopes"} {
+		req, err := http.NewRequest("GET", s.URL+"/api/v1/residents", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if header != "" {
+			req.Header.Set(condoHeader, header)
+		}
+		req.Header.Set("Authorization", "Bearer "+s.token)
+		resp, err := s.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var list []Resident
+		err = json.NewDecoder(resp.Body).Decode(&list)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(list) != 1 || list[0].Name != want {
+			t.Errorf("%s %q lists %+v, want %s", condoHeader, header, list, want)
+		}
+	}
+}
@@ -0,0 +1,301 @@
+package condomngr
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Consistency problem kinds
+const (
+	ProblemOrphan             = "orphan"              // belongs to a resident that doesn't exist
+	ProblemMissingValue       = "missing_value"       // a required field is empty
+	ProblemDuplicateReference = "duplicate_reference" // payments sharing a receipt reference
+	ProblemNegativeAmount     = "negative_amount"
+	ProblemDateOutOfRange     = "date_out_of_range" // not a date, or before 1990 or after 2100
+)
+
+// Consistency fixes, the problems that can be repaired without a person
+// deciding how
+const (
+	FixUnknownResident  = "assign_unknown_resident"
+	FixBackfillDefaults = "backfill_defaults"
+)
+
+var consistencyFixes = []string{FixUnknownResident, FixBackfillDefaults}
+
+// The placeholder resident orphans are assigned to
+const (
+	unknownResidentName = "Unknown resident"
+	unknownResidentUnit = "?"
+)
+
+// ConsistencyProblem lists the rows of a table with one kind of problem in
+// one column
+type ConsistencyProblem struct {
+	Kind   string `json:"kind"`
+	Table  string `json:"table"`
+	Column string `json:"column"`
+	IDs    []int  `json:"ids"`
+	Fix    string `json:"fix"` // empty when the rows must be corrected by hand
+}
+
+// ConsistencyReport lists the problems found in the data; an empty list means
+// none
+type ConsistencyReport struct {
+	CheckedAt time.Time            `json:"checked_at"`
+	Rows      int                  `json:"rows"` // rows with a problem, counted once per problem
+	Problems  []ConsistencyProblem `json:"problems"`
+}
+
+// ConsistencyFixRequest selects the fixes to apply
+type ConsistencyFixRequest struct {
+	Fixes []string `json:"fixes"` // assign_unknown_resident and/or backfill_defaults
+}
+
+// ConsistencyFixResult tells how many rows each fix changed, and what is left
+// afterwards
+type ConsistencyFixResult struct {
+	Applied map[string]int    `json:"applied"`
+	Report  ConsistencyReport `json:"report"`
+}
+
+// consistencyCheck finds the rows of table matching where
+type consistencyCheck struct {
+	kind, table, column, fix string
+	where                    string
+}
+
+var consistencyChecks = []consistencyCheck{
+	{ProblemOrphan, "payments", "resident_id", FixUnknownResident, "resident_id NOT IN (SELECT id FROM residents)"},
+	{ProblemOrphan, "credits", "resident_id", FixUnknownResident, "resident_id NOT IN (SELECT id FROM residents)"},
+	{ProblemMissingValue, "residents", "name", FixBackfillDefaults, missingValue("name")},
+	{ProblemMissingValue, "residents", "unit", FixBackfillDefaults, missingValue("unit")},
+	{ProblemMissingValue, "payments", "payment_date", FixBackfillDefaults, missingValue("payment_date")},
+	{ProblemMissingValue, "expenses", "description", FixBackfillDefaults, missingValue("description")},
+	{ProblemMissingValue, "expenses", "expense_date", FixBackfillDefaults, missingValue("expense_date")},
+	{ProblemDuplicateReference, "payments", "reference", "",
+		"reference IN (SELECT reference FROM payments WHERE reference != '' GROUP BY reference HAVING COUNT(*) > 1)"},
+	{ProblemNegativeAmount, "payments", "amount", "", "amount < 0"},
+	{ProblemNegativeAmount, "expenses", "amount", "", "amount < 0"},
+	{ProblemNegativeAmount, "charges", "amount", "", "amount < 0"},
+	{ProblemDateOutOfRange, "payments", "payment_date", "", dateOutOfRange("payment_date")},
+	{ProblemDateOutOfRange, "expenses", "expense_date", "", dateOutOfRange("expense_date")},
+	{ProblemDateOutOfRange, "charges", "due_date", "", dateOutOfRange("due_date")},
+	{ProblemDateOutOfRange, "credits", "credit_date", "", dateOutOfRange("credit_date")},
+}
+
+// missingValue matches the rows where column is NULL or blank
+func missingValue(column string) string {
+	return "TRIM(COALESCE(" + column + ", '')) = ''"
+}
+
+// dateOutOfRange matches the rows where column is set but isn't a date
+// between 1990 and 2100
+func dateOutOfRange(column string) string {
+	return fmt.Sprintf("TRIM(COALESCE(%[1]s, '')) != '' AND (date(%[1]s) IS NULL OR date(%[1]s) < '1990-01-01' OR date(%[1]s) > '2100-12-31')", column)
+}
+
+// checkConsistency runs every check over the data
+func checkConsistency(q querier) (ConsistencyReport, error) {
+	report := ConsistencyReport{CheckedAt: time.Now().UTC(), Problems: []ConsistencyProblem{}}
+	for _, check := range consistencyChecks {
+		// Tables and conditions are constants, not from the request
+		rows, err := q.Query("SELECT id FROM " + check.table + " WHERE " + check.where + " ORDER BY id")
+		if err != nil {
+			return report, err
+		}
+		var ids []int
+		for rows.Next() {
+			var id int
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return report, err
+			}
+			ids = append(ids, id)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return report, err
+		}
+		if len(ids) == 0 {
+			continue
+		}
+		report.Rows += len(ids)
+		report.Problems = append(report.Problems, ConsistencyProblem{Kind: check.kind, Table: check.table, Column: check.column, IDs: ids, Fix: check.fix})
+	}
+	return report, nil
+}
+
+// validateConsistencyFixes checks that fixes names at least one fix, and only
+// known ones
+func validateConsistencyFixes(fixes []string) error {
+	if len(fixes) == 0 {
+		return errors.New("Give at least one fix")
+	}
+	for _, fix := range fixes {
+		if !slices.Contains(consistencyFixes, fix) {
+			return errors.New("Invalid fix, must be assign_unknown_resident or backfill_defaults")
+		}
+	}
+	return nil
+}
+
+// fixConsistency applies fixes in one transaction, recording them in the
+// audit log as done through r (nil from the command line), and reports what
+// is left
+func fixConsistency(db *sql.DB, r *http.Request, fixes []string) (ConsistencyFixResult, error) {
+	result := ConsistencyFixResult{Applied: map[string]int{}}
+	if !dbLock(db).TryLock() {
+		return result, errBusy
+	}
+	defer dbLock(db).Unlock()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return result, err
+	}
+	defer tx.Rollback()
+
+	var details []string
+	for _, fix := range consistencyFixes {
+		if !slices.Contains(fixes, fix) {
+			continue
+		}
+		var n int
+		switch fix {
+		case FixUnknownResident:
+			n, err = assignUnknownResident(tx)
+		case FixBackfillDefaults:
+			n, err = backfillDefaults(tx)
+		}
+		if err != nil {
+			return result, err
+		}
+		result.Applied[fix] = n
+		details = append(details, fmt.Sprintf("%s: %d rows", fix, n))
+	}
+
+	if err := recordAudit(tx, r, AuditConsistencyFix, "database", strings.Join(details, ", ")); err != nil {
+		return result, err
+	}
+	if result.Report, err = checkConsistency(tx); err != nil {
+		return result, err
+	}
+	return result, tx.Commit()
+}
+
+// assignUnknownResident moves the orphan payments and credits to the
+// placeholder resident, creating it when there are orphans and it doesn't
+// exist yet. It returns how many rows moved.
+func assignUnknownResident(tx *sql.Tx) (int, error) {
+	var orphans int
+	err := tx.QueryRow(`SELECT
+		(SELECT COUNT(*) FROM payments WHERE resident_id NOT IN (SELECT id FROM residents)) +
+		(SELECT COUNT(*) FROM credits WHERE resident_id NOT IN (SELECT id FROM residents))`).Scan(&orphans)
+	if err != nil || orphans == 0 {
+		return 0, err
+	}
+
+	var residentID int64
+	err = tx.QueryRow("SELECT id FROM residents WHERE name = ? AND unit = ? ORDER BY id LIMIT 1", unknownResidentName, unknownResidentUnit).Scan(&residentID)
+	if err == sql.ErrNoRows {
+		res, err := tx.Exec("INSERT INTO residents(name, unit) VALUES(?, ?)", unknownResidentName, unknownResidentUnit)
+		if err != nil {
+			return 0, err
+		}
+		if residentID, err = res.LastInsertId(); err != nil {
+			return 0, err
+		}
+	} else if err != nil {
+		return 0, err
+	}
+
+	if _, err := tx.Exec("UPDATE payments SET resident_id = ?, updated_at = CURRENT_TIMESTAMP WHERE resident_id NOT IN (SELECT id FROM residents)", residentID); err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec("UPDATE credits SET resident_id = ? WHERE resident_id NOT IN (SELECT id FROM residents)", residentID); err != nil {
+		return 0, err
+	}
+	return orphans, nil
+}
+
+// backfillDefaults fills the empty required fields: names and units with a
+// placeholder, descriptions with one, and dates with the day the row was
+// created. It returns how many rows changed.
+func backfillDefaults(tx *sql.Tx) (int, error) {
+	updates := []string{
+		"UPDATE residents SET name = '(no name)', updated_at = CURRENT_TIMESTAMP WHERE " + missingValue("name"),
+		"UPDATE residents SET unit = '(no unit)', updated_at = CURRENT_TIMESTAMP WHERE " + missingValue("unit"),
+		"UPDATE payments SET payment_date = COALESCE(date(created_at), date('now')), updated_at = CURRENT_TIMESTAMP WHERE " + missingValue("payment_date"),
+		"UPDATE expenses SET description = '(no description)', updated_at = CURRENT_TIMESTAMP WHERE " + missingValue("description"),
+		"UPDATE expenses SET expense_date = COALESCE(date(created_at), date('now')), updated_at = CURRENT_TIMESTAMP WHERE " + missingValue("expense_date"),
+	}
+	total := 0
+	for _, update := range updates {
+		res, err := tx.Exec(update)
+		if err != nil {
+			return 0, err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+		total += int(n)
+	}
+	return total, nil
+}
+
+// Handlers for consistency endpoints
+
+// Scan the data for orphans, missing values, duplicate references, negative
+// amounts and dates out of range
+func getConsistency(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		report, err := checkConsistency(db)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		respondWithJSON(w, http.StatusOK, report)
+	}
+}
+
+// Apply the selected safe fixes in one transaction, and report what is left
+func postConsistencyFix(db *sql.DB, changes *ChangeBroker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req ConsistencyFixRequest
+		if err := decodeRequest(r, &req); err != nil {
+			respondWithError(w, payloadErrorStatus(err), "Invalid request payload: "+err.Error())
+			return
+		}
+		defer r.Body.Close()
+		if err := validateConsistencyFixes(req.Fixes); err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		result, err := fixConsistency(db, r, req.Fixes)
+		if errors.Is(err, errBusy) {
+			respondWithError(w, http.StatusConflict, err.Error())
+			return
+		}
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		for _, n := range result.Applied {
+			if n > 0 {
+				for _, t := range changeTypes {
+					changes.Publish(Change{Type: t, Action: ChangeImported})
+				}
+				break
+			}
+		}
+		respondWithJSON(w, http.StatusOK, result)
+	}
+}
@@ -0,0 +1,73 @@
+package condomngr
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+)
+
+// setTotalCount runs a COUNT(*) query and reports the result in the
+// X-Total-Count header, so clients can show totals without fetching every row
+func setTotalCount(w http.ResponseWriter, db *sql.DB, query string, args ...interface{}) error {
+	var count int
+	if err := db.QueryRow(query, args...).Scan(&count); err != nil {
+		return err
+	}
+	w.Header().Set("X-Total-Count", strconv.Itoa(count))
+	return nil
+}
+
+// countResponse runs a COUNT(*) query and responds with {"count": n}
+func countResponse(w http.ResponseWriter, db *sql.DB, query string, args ...interface{}) {
+	var count int
+	if err := db.QueryRow(query, args...).Scan(&count); err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]int{"count": count})
+}
+
+// Handlers for count endpoints. They accept the same filters as the lists.
+func countResidents(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := checkQueryParams(r, "unit"); err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		filter := residentFilter(r)
+		countResponse(w, db, "SELECT COUNT(*) FROM residents"+filter.where(), filter.args...)
+	}
+}
+
+func countPayments(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := checkQueryParams(r, "resident_id", "start_date", "end_date", "updated_since"); err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		filter, err := paymentFilter(r)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		countResponse(w, db, "SELECT COUNT(*) FROM payments p JOIN residents r ON p.resident_id = r.id"+filter.where(), filter.args...)
+	}
+}
+
+func countExpenses(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := checkQueryParams(r, "category", "start_date", "end_date", "updated_since"); err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		filter, err := expenseFilter(r)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		countResponse(w, db, "SELECT COUNT(*) FROM expenses"+filter.where(), filter.args...)
+	}
+}
@@ -0,0 +1,120 @@
+package condomngr
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Credit is a manual adjustment of a resident's balance, such as a refund or a
+// correction. A positive amount is in the resident's favour and settles
+// charges like a payment; a negative one takes credit back.
+type Credit struct {
+	ID         int       `json:"id"`
+	ResidentID int       `json:"resident_id"`
+	Amount     float64   `json:"amount"`
+	Reason     string    `json:"reason"`
+	CreditDate string    `json:"credit_date"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// Validation function for Credit data
+func validateCredit(c Credit) error {
+	var errs ValidationErrors
+	if c.Amount == 0 {
+		errs.Add("amount", "amount must not be zero")
+	}
+	if c.Reason == "" {
+		errs.Add("reason", "reason is required")
+	}
+	if _, err := time.Parse("2006-01-02", c.CreditDate); err != nil {
+		errs.Add("credit_date", "invalid date format, must be YYYY-MM-DD")
+	}
+	return errs.Err()
+}
+
+// Handlers for credit endpoints
+func getResidentCredits(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id, err := strconv.Atoi(vars["id"])
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid resident ID")
+			return
+		}
+
+		rows, err := db.Query("SELECT id, resident_id, amount, reason, credit_date, created_at FROM credits WHERE resident_id = ? ORDER BY credit_date, id", id)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		defer rows.Close()
+
+		credits := []Credit{}
+		for rows.Next() {
+			var c Credit
+			if err := rows.Scan(&c.ID, &c.ResidentID, &c.Amount, &c.Reason, &c.CreditDate, &c.CreatedAt); err != nil {
+				respondWithError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			credits = append(credits, c)
+		}
+
+		respondWithJSON(w, http.StatusOK, credits)
+	}
+}
+
+func createResidentCredit(db *sql.DB, cal calendar) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id, err := strconv.Atoi(vars["id"])
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid resident ID")
+			return
+		}
+
+		var c Credit
+		if err := decodeRequest(r, &c); err != nil {
+			respondWithError(w, payloadErrorStatus(err), "Invalid request payload: "+err.Error())
+			return
+		}
+		defer r.Body.Close()
+
+		c.ResidentID = id
+		if c.CreditDate == "" {
+			c.CreditDate = cal.today()
+		}
+		if err := validateCredit(c); err != nil {
+			respondWithValidationError(w, err)
+			return
+		}
+
+		var exists bool
+		if err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM residents WHERE id = ?)", id).Scan(&exists); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if !exists {
+			respondWithError(w, http.StatusNotFound, "Resident not found")
+			return
+		}
+
+		result, err := db.Exec("INSERT INTO credits(resident_id, amount, reason, credit_date) VALUES(?, ?, ?, ?)", c.ResidentID, c.Amount, c.Reason, c.CreditDate)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		creditID, err := result.LastInsertId()
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		c.ID = int(creditID)
+		respondWithJSON(w, http.StatusCreated, c)
+	}
+}
@@ -0,0 +1,123 @@
+package condomngr
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// errInvalidCron is returned for a cron expression that doesn't parse
+var errInvalidCron = errors.New("invalid cron expression, must be five fields: minute hour day month weekday")
+
+// cronSchedule is a parsed cron expression of five fields: minute, hour, day
+// of the month, month and day of the week (0 or 7 for Sunday). Each field is
+// *, a number, a range a-b, a list of them separated by commas, and any of
+// these but a number may step with /n. As in cron, when both days are
+// restricted a day matching either is taken.
+type cronSchedule struct {
+	minute, hour, day, month, weekday uint64 // bit i set when i matches
+	anyDay, anyWeekday                bool   // the day fields start with *
+}
+
+// parseCron parses a cron expression such as "0 8 1 * *", 08:00 on the
+// first of every month
+func parseCron(expr string) (cronSchedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return cronSchedule{}, errInvalidCron
+	}
+	var c cronSchedule
+	var err error
+	bounds := []struct {
+		bits     *uint64
+		min, max int
+	}{
+		{&c.minute, 0, 59},
+		{&c.hour, 0, 23},
+		{&c.day, 1, 31},
+		{&c.month, 1, 12},
+		{&c.weekday, 0, 7},
+	}
+	for i, b := range bounds {
+		if *b.bits, err = parseCronField(fields[i], b.min, b.max); err != nil {
+			return cronSchedule{}, err
+		}
+	}
+	if c.weekday&(1<<7) != 0 {
+		c.weekday |= 1
+	}
+	c.anyDay = strings.HasPrefix(fields[2], "*")
+	c.anyWeekday = strings.HasPrefix(fields[4], "*")
+	return c, nil
+}
+
+func parseCronField(field string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, item := range strings.Split(field, ",") {
+		from, to, step := min, max, 1
+		if value, stepText, ok := strings.Cut(item, "/"); ok {
+			n, err := strconv.Atoi(stepText)
+			if err != nil || n < 1 {
+				return 0, errInvalidCron
+			}
+			item, step = value, n
+		}
+		if item != "*" {
+			start, end, isRange := strings.Cut(item, "-")
+			var err error
+			if from, err = strconv.Atoi(start); err != nil {
+				return 0, errInvalidCron
+			}
+			to = from
+			if isRange {
+				if to, err = strconv.Atoi(end); err != nil {
+					return 0, errInvalidCron
+				}
+			} else if step > 1 {
+				to = max
+			}
+		}
+		if from < min || to > max || from > to {
+			return 0, errInvalidCron
+		}
+		for i := from; i <= to; i += step {
+			bits |= 1 << uint(i)
+		}
+	}
+	return bits, nil
+}
+
+// matchesDay reports whether the schedule runs on the day of t
+func (c cronSchedule) matchesDay(t time.Time) bool {
+	day := c.day&(1<<uint(t.Day())) != 0
+	weekday := c.weekday&(1<<uint(t.Weekday())) != 0
+	if c.anyDay || c.anyWeekday {
+		return day && weekday
+	}
+	return day || weekday
+}
+
+// Next returns the first time after after the schedule matches, in the
+// location of after, or the zero time when it matches none in the next five
+// years, as the 31st of February
+func (c cronSchedule) Next(after time.Time) time.Time {
+	loc := after.Location()
+	t := after.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case c.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+		case !c.matchesDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+		case c.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+		case c.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
@@ -0,0 +1,116 @@
+package condomngr
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// csvLocale is how a CSV report writes fields, numbers and dates, so
+// spreadsheets in that locale split the columns and read the numbers. The
+// values are the same in every locale, only written differently.
+type csvLocale struct {
+	Delimiter  string // between fields
+	Decimal    string // decimal separator
+	DateLayout string // dates as stored when empty
+	TimeLayout string // RFC 3339 when empty
+	BOM        bool   // start with a UTF-8 byte order mark, for Excel
+}
+
+// csvLocales are the locales of CSV reports. en writes them as the API
+// always has.
+var csvLocales = map[string]csvLocale{
+	"en":    {Delimiter: ",", Decimal: "."},
+	"pt-PT": {Delimiter: ";", Decimal: ",", DateLayout: "02/01/2006", TimeLayout: "02/01/2006 15:04:05", BOM: true},
+}
+
+// defaultCSVLocale is the locale of CSV reports that don't ask for one unless
+// Options.CSVLocale is set
+const defaultCSVLocale = "en"
+
+// findCSVLocale looks up a locale by name, ignoring case
+func findCSVLocale(name string) (csvLocale, bool) {
+	for key, locale := range csvLocales {
+		if strings.EqualFold(key, name) {
+			return locale, true
+		}
+	}
+	return csvLocale{}, false
+}
+
+// reportLocale reads the locale parameter of a CSV report
+func reportLocale(r *http.Request) (csvLocale, error) {
+	name := r.URL.Query().Get("locale")
+	if name == "" {
+		name = optionsOf(r).csvLocale
+	}
+	locale, ok := findCSVLocale(name)
+	if !ok {
+		return csvLocale{}, fmt.Errorf("Invalid locale, must be en or pt-PT")
+	}
+	return locale, nil
+}
+
+// Start writes what comes before the header row
+func (l csvLocale) Start(w io.Writer) {
+	if l.BOM {
+		io.WriteString(w, "\ufeff")
+	}
+}
+
+// Row writes a row of fields, quoting those that need it
+func (l csvLocale) Row(w io.Writer, fields ...string) {
+	for i, field := range fields {
+		fields[i] = l.Field(field)
+	}
+	io.WriteString(w, strings.Join(fields, l.Delimiter)+"\n")
+}
+
+// Field quotes a field when it contains the delimiter, a quote or a newline.
+// Text a spreadsheet would take for a formula, starting with =, +, -, @, a
+// tab or a carriage return, is prefixed with ' so it is shown as typed;
+// numbers such as negative amounts are left alone.
+func (l csvLocale) Field(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		if _, err := strconv.ParseFloat(strings.Replace(s, l.Decimal, ".", 1), 64); err != nil {
+			s = "'" + s
+		}
+	}
+	if strings.ContainsAny(s, l.Delimiter+"\"\n") {
+		return "\"" + strings.ReplaceAll(s, "\"", "\"\"") + "\""
+	}
+	return s
+}
+
+// Amount writes an amount with two decimals
+func (l csvLocale) Amount(amount float64) string {
+	return strings.Replace(fmt.Sprintf("%.2f", amount), ".", l.Decimal, 1)
+}
+
+// Number writes a number with as many decimals as it needs, such as a rate
+func (l csvLocale) Number(n float64) string {
+	return strings.Replace(strconv.FormatFloat(n, 'f', -1, 64), ".", l.Decimal, 1)
+}
+
+// Date writes a stored date, YYYY-MM-DD or a timestamp
+func (l csvLocale) Date(value string) string {
+	if l.DateLayout == "" {
+		return value
+	}
+	date, err := time.Parse("2006-01-02", normalizeDate(value))
+	if err != nil {
+		return value
+	}
+	return date.Format(l.DateLayout)
+}
+
+// Time writes a timestamp
+func (l csvLocale) Time(t time.Time) string {
+	if l.TimeLayout == "" {
+		return t.Format(time.RFC3339)
+	}
+	return t.Format(l.TimeLayout)
+}
@@ -0,0 +1,494 @@
+package condomngr
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Custom field types
+const (
+	CustomFieldText   = "text"
+	CustomFieldNumber = "number"
+	CustomFieldDate   = "date"
+	CustomFieldBool   = "bool"
+)
+
+// CustomFieldEntityResident is the only entity with custom fields so far
+const CustomFieldEntityResident = "resident"
+
+// customFieldKey is the form of a custom field key, the name of its value in
+// the custom map of a resident
+var customFieldKey = regexp.MustCompile(`^[a-z][a-z0-9_]{0,63}$`)
+
+// CustomField defines a field every association can add to its residents,
+// such as a permilage or a garage number, without a schema change
+type CustomField struct {
+	ID        int       `json:"id"`
+	Entity    string    `json:"entity"`
+	Key       string    `json:"key"`
+	Label     string    `json:"label"`
+	Type      string    `json:"type"`   // "text", "number", "date" or "bool"
+	Values    int       `json:"values"` // residents with a value, read-only
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+const customFieldColumns = `id, entity, key, label, type,
+	(SELECT COUNT(*) FROM resident_custom_values v WHERE v.field_id = custom_field_definitions.id),
+	created_at, updated_at`
+
+func scanCustomFieldRow(row interface{ Scan(...interface{}) error }) (CustomField, error) {
+	var f CustomField
+	err := row.Scan(&f.ID, &f.Entity, &f.Key, &f.Label, &f.Type, &f.Values, &f.CreatedAt, &f.UpdatedAt)
+	return f, err
+}
+
+func scanCustomField(rows *sql.Rows) (interface{}, error) {
+	return scanCustomFieldRow(rows)
+}
+
+// residentCustomColumn selects the custom values of a resident as a JSON
+// object, numbers and booleans as such. It needs the residents table, or a
+// subquery of it, named residents.
+const residentCustomColumn = `(SELECT json_group_object(d.key, CASE WHEN d.type IN ('number', 'bool') THEN json(v.value) ELSE v.value END)
+	FROM resident_custom_values v JOIN custom_field_definitions d ON d.id = v.field_id
+	WHERE v.resident_id = residents.id)`
+
+// Validation function for CustomField data
+func validateCustomField(f CustomField) error {
+	var errs ValidationErrors
+	if f.Entity != CustomFieldEntityResident {
+		errs.Add("entity", "entity must be resident")
+	}
+	if !customFieldKey.MatchString(f.Key) {
+		errs.Add("key", "key must be lowercase letters, digits and underscores, starting with a letter")
+	}
+	if f.Label == "" {
+		errs.Add("label", "label is required")
+	}
+	switch f.Type {
+	case CustomFieldText, CustomFieldNumber, CustomFieldDate, CustomFieldBool:
+	default:
+		errs.Add("type", "type must be one of text, number, date or bool")
+	}
+	return errs.Err()
+}
+
+// customFields returns the custom fields of residents, in the order they were
+// defined
+func customFields(q querier) ([]CustomField, error) {
+	rows, err := q.Query("SELECT "+customFieldColumns+" FROM custom_field_definitions WHERE entity = ? ORDER BY id", CustomFieldEntityResident)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	fields := []CustomField{}
+	for rows.Next() {
+		f, err := scanCustomFieldRow(rows)
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, f)
+	}
+	return fields, rows.Err()
+}
+
+// customValues checks the custom values of a resident against the field
+// definitions. It returns the values to store by field id, as text, with nil
+// for values to remove: a null, or an empty text.
+func customValues(fields []CustomField, custom map[string]interface{}) (map[int]*string, error) {
+	byKey := map[string]CustomField{}
+	for _, f := range fields {
+		byKey[f.Key] = f
+	}
+
+	keys := make([]string, 0, len(custom))
+	for key := range custom {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var errs ValidationErrors
+	values := map[int]*string{}
+	for _, key := range keys {
+		value := custom[key]
+		name := "custom." + key
+		f, ok := byKey[key]
+		if !ok {
+			errs.Add(name, "unknown custom field")
+			continue
+		}
+		if value == nil {
+			values[f.ID] = nil
+			continue
+		}
+		var text string
+		switch f.Type {
+		case CustomFieldText:
+			s, ok := value.(string)
+			if !ok {
+				errs.Add(name, "custom value must be text")
+				continue
+			}
+			if s == "" {
+				values[f.ID] = nil
+				continue
+			}
+			text = s
+		case CustomFieldNumber:
+			n, ok := value.(float64)
+			if !ok {
+				errs.Add(name, "custom value must be a number")
+				continue
+			}
+			text = strconv.FormatFloat(n, 'f', -1, 64)
+		case CustomFieldDate:
+			s, ok := value.(string)
+			if _, err := time.Parse("2006-01-02", s); !ok || err != nil {
+				errs.Add(name, "custom value must be a date, YYYY-MM-DD")
+				continue
+			}
+			text = s
+		case CustomFieldBool:
+			b, ok := value.(bool)
+			if !ok {
+				errs.Add(name, "custom value must be true or false")
+				continue
+			}
+			text = strconv.FormatBool(b)
+		}
+		values[f.ID] = &text
+	}
+	return values, errs.Err()
+}
+
+// storeCustomValues writes the custom values of a resident. With replace its
+// other values are removed; otherwise only the given ones change.
+func storeCustomValues(q querier, residentID int, values map[int]*string, replace bool) error {
+	if replace {
+		if _, err := q.Exec("DELETE FROM resident_custom_values WHERE resident_id = ?", residentID); err != nil {
+			return err
+		}
+	}
+	for fieldID, value := range values {
+		var err error
+		if value == nil {
+			_, err = q.Exec("DELETE FROM resident_custom_values WHERE resident_id = ? AND field_id = ?", residentID, fieldID)
+		} else {
+			_, err = q.Exec(`INSERT INTO resident_custom_values(resident_id, field_id, value) VALUES(?, ?, ?)
+				ON CONFLICT(resident_id, field_id) DO UPDATE SET value = excluded.value`, residentID, fieldID, *value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// residentCustom reads the custom values of a resident
+func residentCustom(q querier, residentID int) (map[string]interface{}, error) {
+	var custom string
+	if err := q.QueryRow("SELECT "+residentCustomColumn+" FROM residents WHERE id = ?", residentID).Scan(&custom); err != nil {
+		return nil, err
+	}
+	values := map[string]interface{}{}
+	return values, json.Unmarshal([]byte(custom), &values)
+}
+
+// deleteOrphanCustomValues removes the custom values of residents that are
+// gone
+func deleteOrphanCustomValues(q querier) error {
+	_, err := q.Exec("DELETE FROM resident_custom_values WHERE resident_id NOT IN (SELECT id FROM residents)")
+	return err
+}
+
+// customColumns are the custom values of residents as CSV columns, after the
+// columns of a report
+type customColumns struct {
+	fields []CustomField
+	values map[int]map[int]string // by resident id, then field id
+}
+
+// loadCustomColumns reads the custom fields and the values of every resident
+func loadCustomColumns(q querier) (*customColumns, error) {
+	fields, err := customFields(q)
+	if err != nil {
+		return nil, err
+	}
+	c := &customColumns{fields: fields, values: map[int]map[int]string{}}
+	rows, err := q.Query("SELECT resident_id, field_id, value FROM resident_custom_values")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var residentID, fieldID int
+		var value string
+		if err := rows.Scan(&residentID, &fieldID, &value); err != nil {
+			return nil, err
+		}
+		if c.values[residentID] == nil {
+			c.values[residentID] = map[int]string{}
+		}
+		c.values[residentID][fieldID] = value
+	}
+	return c, rows.Err()
+}
+
+// Header returns the labels of the custom fields
+func (c *customColumns) Header() []string {
+	labels := make([]string, len(c.fields))
+	for i, f := range c.fields {
+		labels[i] = f.Label
+	}
+	return labels
+}
+
+// Row returns the custom values of a resident, written for locale
+func (c *customColumns) Row(locale csvLocale, residentID int) []string {
+	row := make([]string, len(c.fields))
+	for i := range c.fields {
+		row[i] = c.Value(locale, residentID, i)
+	}
+	return row
+}
+
+// Value returns the value of a resident for the custom field at position i,
+// written for locale
+func (c *customColumns) Value(locale csvLocale, residentID, i int) string {
+	f := c.fields[i]
+	value, ok := c.values[residentID][f.ID]
+	if !ok {
+		return ""
+	}
+	switch f.Type {
+	case CustomFieldNumber:
+		if n, err := strconv.ParseFloat(value, 64); err == nil {
+			value = locale.Number(n)
+		}
+	case CustomFieldDate:
+		value = locale.Date(value)
+	}
+	return value
+}
+
+// importCustomFields adds the custom fields of an export that the database
+// doesn't have, matched by key. Existing fields are kept as they are.
+func importCustomFields(q querier, fields []CustomField) error {
+	for _, f := range fields {
+		if _, err := q.Exec("INSERT INTO custom_field_definitions(entity, key, label, type) VALUES(?, ?, ?, ?) ON CONFLICT(entity, key) DO NOTHING",
+			f.Entity, f.Key, f.Label, f.Type); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Handlers for custom field endpoints
+func getCustomFields(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		fields, err := customFields(db)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		respondWithJSON(w, http.StatusOK, fields)
+	}
+}
+
+func getCustomField(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id, err := strconv.Atoi(vars["id"])
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid custom field ID")
+			return
+		}
+
+		f, err := scanCustomFieldRow(db.QueryRow("SELECT "+customFieldColumns+" FROM custom_field_definitions WHERE id = ?", id))
+		if err == sql.ErrNoRows {
+			respondWithError(w, http.StatusNotFound, "Custom field not found")
+			return
+		}
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		respondWithJSON(w, http.StatusOK, f)
+	}
+}
+
+func createCustomField(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var f CustomField
+		if err := decodeRequest(r, &f); err != nil {
+			respondWithError(w, payloadErrorStatus(err), "Invalid request payload: "+err.Error())
+			return
+		}
+		defer r.Body.Close()
+
+		if f.Entity == "" {
+			f.Entity = CustomFieldEntityResident
+		}
+		f.Label = strings.TrimSpace(f.Label)
+		if err := validateCustomField(f); err != nil {
+			respondWithValidationError(w, err)
+			return
+		}
+
+		result, err := db.Exec("INSERT INTO custom_field_definitions(entity, key, label, type) VALUES(?, ?, ?, ?)", f.Entity, f.Key, f.Label, f.Type)
+		if isUniqueViolation(err) {
+			respondWithError(w, http.StatusConflict, "A custom field with this key already exists")
+			return
+		}
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		id, err := result.LastInsertId()
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		f, err = scanCustomFieldRow(db.QueryRow("SELECT "+customFieldColumns+" FROM custom_field_definitions WHERE id = ?", id))
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		respondWithJSON(w, http.StatusCreated, f)
+	}
+}
+
+// Update a custom field. Its key and type can only change while no resident
+// has a value for it, as the values were checked against them.
+func updateCustomField(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id, err := strconv.Atoi(vars["id"])
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid custom field ID")
+			return
+		}
+
+		var f CustomField
+		if err := decodeRequest(r, &f); err != nil {
+			respondWithError(w, payloadErrorStatus(err), "Invalid request payload: "+err.Error())
+			return
+		}
+		defer r.Body.Close()
+
+		if f.Entity == "" {
+			f.Entity = CustomFieldEntityResident
+		}
+		f.Label = strings.TrimSpace(f.Label)
+		if err := validateCustomField(f); err != nil {
+			respondWithValidationError(w, err)
+			return
+		}
+
+		current, err := scanCustomFieldRow(db.QueryRow("SELECT "+customFieldColumns+" FROM custom_field_definitions WHERE id = ?", id))
+		if err == sql.ErrNoRows {
+			respondWithError(w, http.StatusNotFound, "Custom field not found")
+			return
+		}
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if current.Values > 0 && (f.Entity != current.Entity || f.Key != current.Key || f.Type != current.Type) {
+			respondWithError(w, http.StatusConflict, "The entity, key and type of a custom field with values can't change")
+			return
+		}
+
+		_, err = db.Exec("UPDATE custom_field_definitions SET entity = ?, key = ?, label = ?, type = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?",
+			f.Entity, f.Key, f.Label, f.Type, id)
+		if isUniqueViolation(err) {
+			respondWithError(w, http.StatusConflict, "A custom field with this key already exists")
+			return
+		}
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		f, err = scanCustomFieldRow(db.QueryRow("SELECT "+customFieldColumns+" FROM custom_field_definitions WHERE id = ?", id))
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		respondWithJSON(w, http.StatusOK, f)
+	}
+}
+
+// Delete a custom field. When residents have values for it the values go
+// with it, which has to be confirmed with confirm=true; they aren't kept in
+// the trash.
+func deleteCustomField(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := checkQueryParams(r, "confirm"); err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		vars := mux.Vars(r)
+		id, err := strconv.Atoi(vars["id"])
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid custom field ID")
+			return
+		}
+		confirm := false
+		if value := r.URL.Query().Get("confirm"); value != "" {
+			if confirm, err = strconv.ParseBool(value); err != nil {
+				respondWithError(w, http.StatusBadRequest, "Invalid confirm, must be true or false")
+				return
+			}
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		defer tx.Rollback()
+
+		f, err := scanCustomFieldRow(tx.QueryRow("SELECT "+customFieldColumns+" FROM custom_field_definitions WHERE id = ?", id))
+		if err == sql.ErrNoRows {
+			respondWithError(w, http.StatusNotFound, "Custom field not found")
+			return
+		}
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if f.Values > 0 && !confirm {
+			respondWithError(w, http.StatusConflict, "Custom field has values, delete it with confirm=true to remove them")
+			return
+		}
+
+		if _, err := tx.Exec("DELETE FROM resident_custom_values WHERE field_id = ?", id); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if _, err := tx.Exec("DELETE FROM custom_field_definitions WHERE id = ?", id); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		respondWithJSON(w, http.StatusOK, map[string]interface{}{"result": "success", "values_deleted": f.Values})
+	}
+}
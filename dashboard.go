@@ -0,0 +1,120 @@
+package condomngr
+
+import (
+	"database/sql"
+	"net/http"
+)
+
+// dashboardRecent is how many of the latest payments and expenses the
+// dashboard lists
+const dashboardRecent = 5
+
+// Dashboard is what the front page shows: record counts, the totals of the
+// current month, occupancy, the latest payments and expenses, and the tasks
+// overdue
+type Dashboard struct {
+	Residents      int       `json:"residents"`
+	Payments       int       `json:"payments"`
+	Expenses       int       `json:"expenses"`
+	Month          string    `json:"month"`          // YYYY-MM
+	MonthPayments  float64   `json:"month_payments"` // confirmed payments made in the month
+	MonthExpenses  float64   `json:"month_expenses"` // expenses incurred in the month
+	Units          int       `json:"units"`
+	Vacant         int       `json:"vacant"`
+	VacancyRate    float64   `json:"vacancy_rate"`    // percent of the units vacant today
+	RecentPayments []Payment `json:"recent_payments"` // latest first
+	RecentExpenses []Expense `json:"recent_expenses"` // latest first
+	OverdueTasks   []Task    `json:"overdue_tasks"`
+}
+
+// loadDashboard computes the dashboard as of today
+func loadDashboard(q querier, cal calendar) (Dashboard, error) {
+	d := Dashboard{Month: cal.today()[:7], RecentPayments: []Payment{}, RecentExpenses: []Expense{}, OverdueTasks: []Task{}}
+	err := q.QueryRow(`
+		SELECT
+			(SELECT COUNT(*) FROM residents),
+			(SELECT COUNT(*) FROM payments WHERE resident_id IN (SELECT id FROM residents)),
+			(SELECT COUNT(*) FROM expenses),
+			(SELECT COALESCE(SUM(amount), 0) FROM payments WHERE resident_id IN (SELECT id FROM residents) AND status = ?1 AND substr(payment_date, 1, 7) = ?2),
+			(SELECT COALESCE(SUM(amount), 0) FROM expenses WHERE substr(expense_date, 1, 7) = ?2)
+	`, PaymentStatusConfirmed, d.Month).Scan(&d.Residents, &d.Payments, &d.Expenses, &d.MonthPayments, &d.MonthExpenses)
+	if err != nil {
+		return d, err
+	}
+	d.MonthPayments, d.MonthExpenses = roundCents(d.MonthPayments), roundCents(d.MonthExpenses)
+
+	occupancy, err := occupancyOn(q, cal.today())
+	if err != nil {
+		return d, err
+	}
+	d.Units, d.Vacant, d.VacancyRate = len(occupancy.Units), occupancy.Vacant, occupancy.VacancyRate
+
+	rows, err := q.Query(`
+		SELECT p.id, p.resident_id, r.name, p.amount, p.description, p.payment_date, p.method, p.status
+		FROM payments p JOIN residents r ON p.resident_id = r.id
+		ORDER BY p.payment_date DESC, p.id DESC LIMIT ?
+	`, dashboardRecent)
+	if err != nil {
+		return d, err
+	}
+	for rows.Next() {
+		var p Payment
+		if err := rows.Scan(&p.ID, &p.ResidentID, &p.ResidentName, &p.Amount, &p.Description, &p.PaymentDate, &p.Method, &p.Status); err != nil {
+			rows.Close()
+			return d, err
+		}
+		d.RecentPayments = append(d.RecentPayments, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return d, err
+	}
+
+	rows, err = q.Query("SELECT id, amount, description, expense_date, category FROM expenses ORDER BY expense_date DESC, id DESC LIMIT ?", dashboardRecent)
+	if err != nil {
+		return d, err
+	}
+	for rows.Next() {
+		var e Expense
+		if err := rows.Scan(&e.ID, &e.Amount, &e.Description, &e.ExpenseDate, &e.Category); err != nil {
+			rows.Close()
+			return d, err
+		}
+		d.RecentExpenses = append(d.RecentExpenses, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return d, err
+	}
+
+	rows, err = q.Query("SELECT "+taskColumns+taskFrom+" WHERE t.status = ? AND t.due_date != '' AND t.due_date < ? ORDER BY t.due_date, t.id", TaskOpen, cal.today())
+	if err != nil {
+		return d, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		t, err := scanTask(rows, cal)
+		if err != nil {
+			return d, err
+		}
+		d.OverdueTasks = append(d.OverdueTasks, t)
+	}
+	return d, rows.Err()
+}
+
+// Get the counts, monthly totals, occupancy and latest records the dashboard
+// shows, in one request
+func getDashboard(db *sql.DB, cal calendar) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := checkQueryParams(r); err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		d, err := loadDashboard(db, cal)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		respondWithJSON(w, http.StatusOK, d)
+	}
+}
@@ -0,0 +1,48 @@
+package condomngr
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestCachedDashboardShowsNewPayments(t *testing.T) {
+	s := newTestServer(t, Options{CacheTTL: time.Hour})
+	resident := s.createResident("Ana Silva", "1A")
+
+	// dashboard gets the dashboard and checks how it was answered
+	dashboard := func(status string) Dashboard {
+		t.Helper()
+		var d Dashboard
+		resp := s.expect(http.StatusOK, "GET", "/api/v1/dashboard", nil, &d)
+		if got := resp.Header.Get("Cache-Status"); got != status {
+			t.Errorf("Cache-Status %s, want %s", got, status)
+		}
+		return d
+	}
+	dashboard(CacheMiss)
+	dashboard(CacheHit)
+
+	var payment Payment
+	s.expect(http.StatusCreated, "POST", "/api/v1/payments", map[string]interface{}{"resident_id": resident.ID, "amount": 50, "description": "Dues", "payment_date": calendar{location: time.Local}.today()}, &payment)
+	d := dashboard(CacheMiss)
+	if d.Payments != 1 || d.MonthPayments != 50 || len(d.RecentPayments) != 1 || d.RecentPayments[0].ID != payment.ID {
+		t.Errorf("after creating a payment %+v", d)
+	}
+	dashboard(CacheHit)
+
+	path := fmt.Sprint("/api/v1/payments/", payment.ID)
+	s.expect(http.StatusOK, "PUT", path, map[string]interface{}{"resident_id": resident.ID, "amount": 80, "description": "Dues", "payment_date": calendar{location: time.Local}.today()}, nil)
+	if d := dashboard(CacheMiss); d.MonthPayments != 80 {
+		t.Errorf("after updating the payment %+v", d)
+	}
+
+	// Bulk deletes aren't among the routes that publish their changes, so
+	// they drop every cached response
+	dashboard(CacheHit)
+	s.expect(http.StatusOK, "POST", "/api/v1/payments/bulk-delete", map[string]interface{}{"ids": []int{payment.ID}}, nil)
+	if d := dashboard(CacheMiss); d.Payments != 0 || d.MonthPayments != 0 || len(d.RecentPayments) != 0 {
+		t.Errorf("after deleting the payment %+v", d)
+	}
+}
@@ -0,0 +1,165 @@
+package condomngr
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// requestOptions are the options that change how a server reads requests
+// and answers them, rather than what it stores
+type requestOptions struct {
+	laxJSON   bool   // Options.LaxJSON
+	csvLocale string // Options.CSVLocale
+}
+
+type requestOptionsKey struct{}
+
+// withRequestOptions makes the server's requestOptions available to the
+// handlers of its requests
+func withRequestOptions(opts requestOptions) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestOptionsKey{}, opts)))
+		})
+	}
+}
+
+// optionsOf returns the requestOptions of the server r was made to, the
+// defaults outside of one
+func optionsOf(r *http.Request) requestOptions {
+	opts, _ := r.Context().Value(requestOptionsKey{}).(requestOptions)
+	if opts.csvLocale == "" {
+		opts.csvLocale = defaultCSVLocale
+	}
+	return opts
+}
+
+// decodeRequest decodes the JSON body of r into v as decodeJSON does, leniently
+// when the server was started with Options.LaxJSON
+func decodeRequest(r *http.Request, v interface{}) error {
+	return decodeJSON(r.Body, v, optionsOf(r).laxJSON)
+}
+
+// decodeJSON decodes JSON from r into v. Unknown fields, values of the wrong
+// type and anything after the JSON value are rejected with an error naming
+// the problem, unless lax, for clients that depend on unknown fields being
+// ignored.
+func decodeJSON(r io.Reader, v interface{}, lax bool) error {
+	decoder := json.NewDecoder(r)
+	if !lax {
+		decoder.DisallowUnknownFields()
+	}
+	if err := decoder.Decode(v); err != nil {
+		return describeJSONError(err)
+	}
+	if !lax {
+		if _, err := decoder.Token(); err != io.EOF {
+			return fmt.Errorf("unexpected data after JSON value")
+		}
+	}
+	return nil
+}
+
+// maxMultipartOverhead is what a multipart upload may add to the size of its
+// file: boundaries, part headers and other form fields
+const maxMultipartOverhead = 64 << 10
+
+// limitRequestBody caps request bodies so an oversized one fails with 413
+// instead of being read into memory. The import endpoint takes whole database
+// exports and gets its own limit, as does the workbook importer, and inbound
+// emails, which can carry pictures, and so do attachment uploads.
+func limitRequestBody(limit, importLimit, attachmentLimit int64) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			max := limit
+			if strings.HasSuffix(r.URL.Path, "/import") || strings.Contains(r.URL.Path, "/import/") || strings.HasSuffix(r.URL.Path, "/inbound") {
+				max = importLimit
+			} else if r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/attachments") {
+				max = attachmentLimit
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, max)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// bodyTooLargeError reports a request body over the limit set by
+// limitRequestBody
+type bodyTooLargeError struct {
+	limit int64
+}
+
+func (e *bodyTooLargeError) Error() string {
+	return fmt.Sprintf("request body is larger than %d bytes", e.limit)
+}
+
+// payloadErrorStatus returns the status for a request body that could not be
+// decoded: 413 when it was too large, 400 otherwise
+func payloadErrorStatus(err error) int {
+	var tooLarge *bodyTooLargeError
+	var maxBytes *http.MaxBytesError
+	if errors.As(err, &tooLarge) || errors.As(err, &maxBytes) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
+}
+
+// decodeJSONBytes is decodeJSON for data that has already been read
+func decodeJSONBytes(data []byte, v interface{}, lax bool) error {
+	return decodeJSON(bytes.NewReader(data), v, lax)
+}
+
+// describeJSONError turns decoder errors into messages a client can act on
+func describeJSONError(err error) error {
+	var typeErr *json.UnmarshalTypeError
+	var syntaxErr *json.SyntaxError
+	var maxBytes *http.MaxBytesError
+	switch {
+	case errors.As(err, &maxBytes):
+		return &bodyTooLargeError{limit: maxBytes.Limit}
+	case errors.As(err, &typeErr):
+		if typeErr.Field == "" {
+			return fmt.Errorf("expected %s, got %s", jsonTypeName(typeErr.Type), typeErr.Value)
+		}
+		return fmt.Errorf("field %q must be %s, got %s", typeErr.Field, jsonTypeName(typeErr.Type), typeErr.Value)
+	case errors.As(err, &syntaxErr):
+		return fmt.Errorf("malformed JSON at offset %d", syntaxErr.Offset)
+	case errors.Is(err, io.EOF):
+		return fmt.Errorf("request body is empty")
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return fmt.Errorf("malformed JSON, unexpected end of input")
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		// encoding/json has no error type for unknown fields
+		return fmt.Errorf("unknown field %s", strings.TrimPrefix(err.Error(), "json: unknown field "))
+	}
+	return err
+}
+
+// jsonTypeName describes a Go type the way it appears in JSON
+func jsonTypeName(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "an integer"
+	case reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.String:
+		return "a string"
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.Slice, reflect.Array:
+		return "an array"
+	case reflect.Ptr:
+		return jsonTypeName(t.Elem())
+	}
+	return "an object"
+}
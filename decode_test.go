@@ -0,0 +1,85 @@
+package condomngr
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// payloadEntities are the entities with create and update handlers, a valid
+// body for them and a field of another JSON type than it should be
+var payloadEntities = []struct {
+	path     string
+	valid    map[string]interface{}
+	field    string
+	badValue interface{}
+	wantType string
+}{
+	{"/api/v1/residents", map[string]interface{}{"name": "Rui Costa", "unit": "2B"}, "name", 5, "a string"},
+	{"/api/v1/payments", map[string]interface{}{"resident_id": 1, "amount": 50, "description": "Dues", "payment_date": "2024-03-05"}, "amount", "500", "a number"},
+	{"/api/v1/expenses", map[string]interface{}{"amount": 10, "description": "Bulbs", "expense_date": "2024-03-05", "category": "Maintenance"}, "amount", "10", "a number"},
+}
+
+// withField is body encoded as JSON with field set to value
+func withField(body map[string]interface{}, field string, value interface{}) string {
+	changed := map[string]interface{}{field: value}
+	for k, v := range body {
+		if k != field {
+			changed[k] = v
+		}
+	}
+	data, _ := json.Marshal(changed)
+	return string(data)
+}
+
+func TestBadPayloads(t *testing.T) {
+	s := newTestServer(t, Options{})
+	s.createResident("Ana Silva", "1A")
+	for _, entity := range payloadEntities {
+		s.expect(http.StatusCreated, "POST", entity.path, entity.valid, nil)
+	}
+
+	for _, entity := range payloadEntities {
+		var before []map[string]interface{}
+		s.expect(http.StatusOK, "GET", entity.path, nil, &before)
+		valid, _ := json.Marshal(entity.valid)
+		for _, tt := range []struct {
+			name, body, want string
+		}{
+			{"unknown field", withField(entity.valid, "residentId", 1), `unknown field "residentId"`},
+			{"wrong type", withField(entity.valid, entity.field, entity.badValue), fmt.Sprintf("field %q must be %s", entity.field, entity.wantType)},
+			{"trailing data", string(valid) + ` {"name": "x"}`, "unexpected data after JSON value"},
+			{"malformed", `{"name": `, "malformed JSON"},
+			{"empty", "", "request body is empty"},
+		} {
+			for _, op := range []struct{ method, path string }{{"POST", entity.path}, {"PUT", entity.path + "/1"}} {
+				var e apiError
+				s.expect(http.StatusBadRequest, op.method, op.path, tt.body, &e)
+				if !strings.Contains(e.Error, tt.want) {
+					t.Errorf("%s %s, %s: error %q, want it to mention %s", op.method, op.path, tt.name, e.Error, tt.want)
+				}
+			}
+		}
+
+		// Nothing was added or changed
+		var after []map[string]interface{}
+		s.expect(http.StatusOK, "GET", entity.path, nil, &after)
+		if a, b := fmt.Sprint(before), fmt.Sprint(after); a != b {
+			t.Errorf("%s: rows changed by bad payloads:\n%s\n%s", entity.path, a, b)
+		}
+	}
+}
+
+func TestLaxJSON(t *testing.T) {
+	s := newTestServer(t, Options{LaxJSON: true})
+
+	var resident Resident
+	s.expect(http.StatusCreated, "POST", "/api/v1/residents", `{"name": "Ana Silva", "unit": "1A", "residentId": 1} trailing`, &resident)
+	if resident.Name != "Ana Silva" {
+		t.Errorf("created %+v", resident)
+	}
+	// Types are still checked
+	s.expect(http.StatusBadRequest, "POST", "/api/v1/residents", `{"name": 5}`, nil)
+}
@@ -0,0 +1,372 @@
+package condomngr
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// diffEntities are the sections of an export that are diffed, by the record
+// type of their NDJSON lines
+var diffEntities = map[string]string{
+	NDJSONResident:    "residents",
+	NDJSONPayment:     "payments",
+	NDJSONExpense:     "expenses",
+	NDJSONCustomField: "custom_fields",
+}
+
+// FieldChange is a field of a record that differs between two exports
+type FieldChange struct {
+	Before json.RawMessage `json:"before"` // missing from the record when absent
+	After  json.RawMessage `json:"after"`
+}
+
+// EntityDiff is how the records of an entity differ between two exports,
+// keyed by id. Added, removed and changed are missing when there are none,
+// and in summaries.
+type EntityDiff struct {
+	AddedCount     int                               `json:"added_count"`
+	RemovedCount   int                               `json:"removed_count"`
+	ChangedCount   int                               `json:"changed_count"`
+	UnchangedCount int                               `json:"unchanged_count"`
+	Added          map[string]json.RawMessage        `json:"added,omitempty"`   // the record after
+	Removed        map[string]json.RawMessage        `json:"removed,omitempty"` // the record before
+	Changed        map[string]map[string]FieldChange `json:"changed,omitempty"` // the fields that differ
+}
+
+// ExportDiff is how the records of two exports differ, by entity: residents,
+// payments, expenses and custom_fields
+type ExportDiff struct {
+	Before   string                 `json:"before"` // file names, or "database" for the live data
+	After    string                 `json:"after"`
+	Entities map[string]*EntityDiff `json:"entities"`
+}
+
+// exportRecords is a side of a diff: an export file, or the live database
+type exportRecords struct {
+	name string
+	read func(record func(entity string, object json.RawMessage) error) error
+}
+
+// readExportRecords reads an export in format a record at a time, without
+// holding it all, and calls record with each record's entity and JSON
+// object. The export date, filter and manifest are skipped.
+func readExportRecords(r io.Reader, format string, record func(entity string, object json.RawMessage) error) error {
+	if format == ExportFormatNDJSON {
+		reader := bufio.NewReader(r)
+		for line := 1; ; line++ {
+			text, readErr := reader.ReadBytes('\n')
+			if readErr != nil && readErr != io.EOF {
+				return readErr
+			}
+			if len(bytes.TrimSpace(text)) > 0 {
+				var members map[string]json.RawMessage
+				if err := json.Unmarshal(text, &members); err != nil {
+					return fmt.Errorf("line %d: %v", line, describeJSONError(err))
+				}
+				var recordType string
+				json.Unmarshal(members["type"], &recordType)
+				if entity, ok := diffEntities[recordType]; ok {
+					object := members["field"]
+					if recordType != NDJSONCustomField {
+						delete(members, "type")
+						object, _ = json.Marshal(members)
+					}
+					if err := record(entity, object); err != nil {
+						return fmt.Errorf("line %d: %v", line, err)
+					}
+				}
+			}
+			if readErr == io.EOF {
+				return nil
+			}
+		}
+	}
+
+	dec := json.NewDecoder(r)
+	if token, err := dec.Token(); err != nil {
+		return describeJSONError(err)
+	} else if token != json.Delim('{') {
+		return fmt.Errorf("expected an export object")
+	}
+	for dec.More() {
+		token, err := dec.Token()
+		if err != nil {
+			return describeJSONError(err)
+		}
+		section, _ := token.(string)
+		if !slices.Contains([]string{"residents", "payments", "expenses", "custom_fields"}, section) {
+			var skipped json.RawMessage
+			if err := dec.Decode(&skipped); err != nil {
+				return describeJSONError(err)
+			}
+			continue
+		}
+		if token, err := dec.Token(); err != nil {
+			return describeJSONError(err)
+		} else if token == nil {
+			continue
+		} else if token != json.Delim('[') {
+			return fmt.Errorf("%s must be an array", section)
+		}
+		for i := 0; dec.More(); i++ {
+			var object json.RawMessage
+			if err := dec.Decode(&object); err != nil {
+				return fmt.Errorf("%s[%d]: %v", section, i, describeJSONError(err))
+			}
+			if err := record(section, object); err != nil {
+				return fmt.Errorf("%s[%d]: %v", section, i, err)
+			}
+		}
+		if _, err := dec.Token(); err != nil {
+			return describeJSONError(err)
+		}
+	}
+	return nil
+}
+
+// canonicalRecord returns the id of a record and the record with its members
+// sorted and without spacing, so the same record compares equal whichever
+// export and format it comes from
+func canonicalRecord(object json.RawMessage) (string, []byte, error) {
+	var members map[string]interface{}
+	if err := json.Unmarshal(object, &members); err != nil {
+		return "", nil, describeJSONError(err)
+	}
+	id, ok := members["id"].(float64)
+	if !ok {
+		return "", nil, fmt.Errorf("record without a numeric id")
+	}
+	canonical, err := json.Marshal(members)
+	return strconv.FormatFloat(id, 'f', -1, 64), canonical, err
+}
+
+// changedFields returns the fields that differ between two canonical records
+func changedFields(before, after []byte) map[string]FieldChange {
+	var b, a map[string]json.RawMessage
+	json.Unmarshal(before, &b)
+	json.Unmarshal(after, &a)
+	changes := make(map[string]FieldChange)
+	for field, value := range b {
+		if !bytes.Equal(value, a[field]) {
+			changes[field] = FieldChange{Before: value, After: a[field]}
+		}
+	}
+	for field, value := range a {
+		if _, ok := b[field]; !ok {
+			changes[field] = FieldChange{After: value}
+		}
+	}
+	return changes
+}
+
+// diffExports compares the records of after with those of before. Only the
+// records of before are held, canonical and by id; those of after are
+// compared as they are read. With summary only the counts are kept.
+func diffExports(before, after exportRecords, summary bool) (ExportDiff, error) {
+	diff := ExportDiff{Before: before.name, After: after.name, Entities: make(map[string]*EntityDiff)}
+	for _, entity := range diffEntities {
+		diff.Entities[entity] = &EntityDiff{}
+		if !summary {
+			diff.Entities[entity].Added = make(map[string]json.RawMessage)
+			diff.Entities[entity].Removed = make(map[string]json.RawMessage)
+			diff.Entities[entity].Changed = make(map[string]map[string]FieldChange)
+		}
+	}
+
+	records := make(map[string]map[string][]byte)
+	err := before.read(func(entity string, object json.RawMessage) error {
+		id, canonical, err := canonicalRecord(object)
+		if err != nil {
+			return err
+		}
+		if records[entity] == nil {
+			records[entity] = make(map[string][]byte)
+		}
+		records[entity][id] = canonical
+		return nil
+	})
+	if err != nil {
+		return diff, fmt.Errorf("%s: %v", diff.Before, err)
+	}
+
+	seen := make(map[string]map[string]bool)
+	err = after.read(func(entity string, object json.RawMessage) error {
+		id, canonical, err := canonicalRecord(object)
+		if err != nil {
+			return err
+		}
+		if seen[entity] == nil {
+			seen[entity] = make(map[string]bool)
+		}
+		if seen[entity][id] {
+			return nil
+		}
+		seen[entity][id] = true
+		d := diff.Entities[entity]
+		previous, ok := records[entity][id]
+		switch {
+		case !ok:
+			d.AddedCount++
+			if !summary {
+				d.Added[id] = canonical
+			}
+		case bytes.Equal(previous, canonical):
+			d.UnchangedCount++
+		default:
+			d.ChangedCount++
+			if !summary {
+				d.Changed[id] = changedFields(previous, canonical)
+			}
+		}
+		delete(records[entity], id)
+		return nil
+	})
+	if err != nil {
+		return diff, fmt.Errorf("%s: %v", diff.After, err)
+	}
+
+	for entity, removed := range records {
+		d := diff.Entities[entity]
+		d.RemovedCount += len(removed)
+		if !summary {
+			for id, record := range removed {
+				d.Removed[id] = record
+			}
+		}
+	}
+	return diff, nil
+}
+
+// exportFileRecords reads the records of an export file, in the format its
+// name suggests
+func exportFileRecords(name string, r io.Reader) exportRecords {
+	return exportRecords{name, func(record func(entity string, object json.RawMessage) error) error {
+		return readExportRecords(r, importFormat(name), record)
+	}}
+}
+
+// databaseRecords reads the records of the live database, exported as NDJSON
+// through a pipe so they are never held all at once
+func databaseRecords(db *sql.DB) exportRecords {
+	return exportRecords{"database", func(record func(entity string, object json.RawMessage) error) error {
+		pr, pw := io.Pipe()
+		go func() {
+			_, err := writeExport(pw, db, ExportFilter{}, ExportFormatNDJSON, time.Now())
+			pw.CloseWithError(err)
+		}()
+		err := readExportRecords(pr, ExportFormatNDJSON, record)
+		pr.CloseWithError(io.ErrClosedPipe)
+		return err
+	}}
+}
+
+// writeDiff writes a diff for people to read: a line of counts for each
+// entity and, unless it is a summary, a line for each added (+) and removed
+// (-) record and one for each changed field (~)
+func writeDiff(w io.Writer, diff ExportDiff) {
+	fmt.Fprintf(w, "--- %s\n+++ %s\n", diff.Before, diff.After)
+	for _, entity := range []string{"residents", "payments", "expenses", "custom_fields"} {
+		d := diff.Entities[entity]
+		fmt.Fprintf(w, "%s: %d added, %d removed, %d changed, %d unchanged\n",
+			entity, d.AddedCount, d.RemovedCount, d.ChangedCount, d.UnchangedCount)
+		for _, id := range sortedIDs(d.Removed) {
+			fmt.Fprintf(w, "- %s %s %s\n", entity, id, d.Removed[id])
+		}
+		for _, id := range sortedIDs(d.Added) {
+			fmt.Fprintf(w, "+ %s %s %s\n", entity, id, d.Added[id])
+		}
+		for _, id := range sortedIDs(d.Changed) {
+			fields := make([]string, 0, len(d.Changed[id]))
+			for field := range d.Changed[id] {
+				fields = append(fields, field)
+			}
+			slices.Sort(fields)
+			for _, field := range fields {
+				change := d.Changed[id][field]
+				fmt.Fprintf(w, "~ %s %s %s: %s -> %s\n", entity, id, field, diffValue(change.Before), diffValue(change.After))
+			}
+		}
+	}
+}
+
+// sortedIDs returns the ids of a map of records in numeric order
+func sortedIDs[V any](records map[string]V) []string {
+	ids := make([]string, 0, len(records))
+	for id := range records {
+		ids = append(ids, id)
+	}
+	slices.SortFunc(ids, func(a, b string) int {
+		x, _ := strconv.ParseFloat(a, 64)
+		y, _ := strconv.ParseFloat(b, 64)
+		return cmp.Compare(x, y)
+	})
+	return ids
+}
+
+// diffValue shows a field value, or (none) when the record hasn't the field
+func diffValue(value json.RawMessage) string {
+	if value == nil {
+		return "(none)"
+	}
+	return string(value)
+}
+
+// Compare two exports (multipart fields before and after), or an export with
+// the live database when after is left out, listing the records added,
+// removed and changed by id. With summary=true only the counts are listed.
+// The format of each file is guessed from its name, as on import.
+func diffExportsHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := requireAdmin(db, w, r); !ok {
+			return
+		}
+		if err := r.ParseMultipartForm(10 << 20); err != nil { // larger files are buffered on disk
+			if payloadErrorStatus(err) == http.StatusRequestEntityTooLarge {
+				respondWithError(w, http.StatusRequestEntityTooLarge, "Export file is too large")
+				return
+			}
+			respondWithError(w, http.StatusBadRequest, "Unable to parse form")
+			return
+		}
+		var summary bool
+		if value := r.FormValue("summary"); value != "" {
+			var err error
+			if summary, err = strconv.ParseBool(value); err != nil {
+				respondWithError(w, http.StatusBadRequest, "Invalid summary, must be true or false")
+				return
+			}
+		}
+
+		beforeFile, beforeHeader, err := r.FormFile("before")
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Error retrieving before file")
+			return
+		}
+		defer beforeFile.Close()
+		after := databaseRecords(db)
+		afterFile, afterHeader, err := r.FormFile("after")
+		if err == nil {
+			defer afterFile.Close()
+			after = exportFileRecords(afterHeader.Filename, afterFile)
+		} else if err != http.ErrMissingFile {
+			respondWithError(w, http.StatusBadRequest, "Error retrieving after file")
+			return
+		}
+
+		diff, err := diffExports(exportFileRecords(beforeHeader.Filename, beforeFile), after, summary)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid export file: "+err.Error())
+			return
+		}
+		respondWithJSON(w, http.StatusOK, diff)
+	}
+}
@@ -0,0 +1,380 @@
+package condomngr
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Charge is an amount owed by a resident, such as the monthly dues
+type Charge struct {
+	ID          int       `json:"id"`
+	ResidentID  int       `json:"resident_id"`
+	Kind        string    `json:"kind"`
+	Period      string    `json:"period"`
+	Description string    `json:"description"`
+	Amount      float64   `json:"amount"`
+	DueDate     string    `json:"due_date"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// Balance summarizes what a resident owes. A positive balance is owed by the
+// resident; a negative one is a credit in their favour, such as from paying
+// ahead, which settles the dues generated later. Cheques not cleared yet are
+// only part of paid with -count-uncleared-cheques, but always reported apart.
+// Debt written off no longer counts, unless the write-off was reversed.
+type Balance struct {
+	ResidentID       int     `json:"resident_id"`
+	Charged          float64 `json:"charged"`
+	Paid             float64 `json:"paid"`
+	Credited         float64 `json:"credited"`
+	WrittenOff       float64 `json:"written_off"`
+	Balance          float64 `json:"balance"`
+	Credit           float64 `json:"credit"` // -balance when in the resident's favour
+	UnclearedCheques float64 `json:"uncleared_cheques"`
+}
+
+// residentBalance computes a resident's balance from their charges, confirmed
+// payments and credits
+func residentBalance(db querier, residentID int) (Balance, error) {
+	return residentBalanceBefore(db, residentID, "")
+}
+
+// residentBalanceBefore is the balance from the charges due, confirmed
+// payments made, credits given and debt written off before date (YYYY-MM-DD),
+// or from all of them if date is empty
+func residentBalanceBefore(db querier, residentID int, date string) (Balance, error) {
+	b := Balance{ResidentID: residentID}
+	err := db.QueryRow(`
+		SELECT
+			(SELECT COALESCE(SUM(amount), 0) FROM charges WHERE resident_id = ?1 AND (?3 = '' OR due_date < ?3)),
+			(SELECT COALESCE(SUM(amount), 0) FROM payments WHERE resident_id = ?1 AND status = ?2 AND (?3 = '' OR payment_date < ?3)),
+			(SELECT COALESCE(SUM(amount), 0) FROM credits WHERE resident_id = ?1 AND (?3 = '' OR credit_date < ?3)),
+			(SELECT COALESCE(SUM(amount), 0) FROM payments WHERE resident_id = ?1 AND method = 'check' AND cheque_status = ?4 AND (?3 = '' OR payment_date < ?3)),
+			(SELECT COALESCE(SUM(amount), 0) FROM write_offs WHERE resident_id = ?1 AND reversed_at IS NULL AND (?3 = '' OR writeoff_date < ?3))
+	`, residentID, PaymentStatusConfirmed, date, ChequePending).Scan(&b.Charged, &b.Paid, &b.Credited, &b.UnclearedCheques, &b.WrittenOff)
+	if err != nil {
+		return b, err
+	}
+	b.Charged, b.Paid, b.Credited = roundCents(b.Charged), roundCents(b.Paid), roundCents(b.Credited)
+	b.UnclearedCheques, b.WrittenOff = roundCents(b.UnclearedCheques), roundCents(b.WrittenOff)
+	b.Balance = roundCents(b.Charged - b.Paid - b.Credited - b.WrittenOff)
+	b.Credit = max(-b.Balance, 0)
+	return b, nil
+}
+
+// Kinds of charges. A resident has at most one charge of each kind per period.
+const (
+	ChargeKindDues       = "dues"
+	ChargeKindInterest   = "interest"
+	ChargeKindAssessment = "assessment" // an installment of an assessment, the period being A<assessment>-<installment>
+	ChargeKindExpenses   = "expenses"   // the unit's share of the expenses allocated to the month
+	ChargeKindTransfer   = "transfer"   // a balance carried over from a unit's previous owner, the period being T<transfer>-<previous owner>
+)
+
+func roundCents(amount float64) float64 {
+	return math.Round(amount*100) / 100
+}
+
+// Rules for pro-rating the dues of a month a resident moves in or out
+const (
+	ProrationDays      = "days"       // by the calendar days lived there
+	ProrationHalfMonth = "half-month" // the handover rounded to the start, middle or end of the month
+)
+
+func validProration(rule string) bool {
+	return rule == ProrationDays || rule == ProrationHalfMonth
+}
+
+// prorate returns the part of fee (for month) owed by a resident who moved in
+// and out on the given dates (YYYY-MM-DD, empty if not in this period). The
+// move-out date is the handover day: it is owed by whoever moves in that day.
+//
+// Each piece is the difference between the amounts owed by the start of the
+// handover days, each rounded half up to the cent. The pieces of a month
+// therefore always add up to exactly one fee: whoever moves out on the 20th
+// and whoever moves in on the 20th pay fee(20) and fee - fee(20).
+func prorate(fee float64, month time.Time, moveIn, moveOut, rule string) (amount float64, prorated bool) {
+	days := time.Date(month.Year(), month.Month()+1, 0, 0, 0, 0, 0, time.UTC).Day()
+	first, next := month.Format("2006-01-02"), month.AddDate(0, 1, 0).Format("2006-01-02")
+
+	// Handover days, from 1 to days+1 for the first day of the next month
+	start, end := 1, days+1
+	if moveIn >= next || (moveOut != "" && moveOut <= first) {
+		return 0, false
+	}
+	if moveIn > first {
+		day, _ := strconv.Atoi(moveIn[8:10])
+		start = day
+	}
+	if moveOut != "" && moveOut < next {
+		day, _ := strconv.Atoi(moveOut[8:10])
+		end = day
+	}
+
+	cents := int64(math.Round(fee * 100))
+	owedBy := func(day int) int64 {
+		elapsed := int64(day - 1)
+		if rule == ProrationHalfMonth {
+			halves := (4*elapsed + int64(days)) / int64(2*days) // 0, 1 or 2
+			return (cents*halves + 1) / 2
+		}
+		return (2*cents*elapsed + int64(days)) / int64(2*days)
+	}
+	return float64(owedBy(end)-owedBy(start)) / 100, start > 1 || end <= days
+}
+
+// Generate the monthly dues charge for every resident, at the fee that
+// applies to each in the month, pro-rated by rule in the months they move in
+// or out. Residents without a fee or not living there are skipped. Residents
+// in credit have the new charge settled from it, reported as credit_applied.
+// Each unit's share of the expenses allocated to the month is charged too.
+func generateDues(db *sql.DB, monthlyFee float64, rule, vacantRule string, cal calendar, rules paymentRules) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		month := r.URL.Query().Get("month")
+		if month == "" {
+			month = cal.now().Format("2006-01")
+		}
+		start, err := time.Parse("2006-01", month)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "invalid month format, must be YYYY-MM")
+			return
+		}
+
+		var scheduled bool
+		if err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM fee_schedule)").Scan(&scheduled); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if monthlyFee <= 0 && !scheduled {
+			respondWithError(w, http.StatusBadRequest, "No monthly fee or fee schedule configured")
+			return
+		}
+
+		// The month's charges are generated together or not at all
+		tx, err := db.Begin()
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		defer tx.Rollback()
+
+		rows, err := tx.Query("SELECT id, name, move_in_date, move_out_date FROM residents ORDER BY id")
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		type dueResident struct {
+			ReminderSkip
+			moveIn, moveOut string
+		}
+		var residents []dueResident
+		for rows.Next() {
+			var resident dueResident
+			if err := rows.Scan(&resident.ResidentID, &resident.Name, &resident.moveIn, &resident.moveOut); err != nil {
+				rows.Close()
+				respondWithError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			residents = append(residents, resident)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		// The unique index on (resident_id, kind, period) makes generating the
+		// same month twice a no-op
+		var created int64
+		var creditApplied float64
+		charge := func(residentID int, description string, amount float64) error {
+			result, err := tx.Exec(`
+				INSERT OR IGNORE INTO charges(resident_id, kind, period, description, amount, due_date)
+				VALUES(?, ?, ?, ?, ?, ?)
+			`, residentID, ChargeKindDues, month, description, amount, start.Format("2006-01-02"))
+			if err != nil {
+				return err
+			}
+			n, _ := result.RowsAffected()
+			if n == 0 {
+				return nil
+			}
+			created += n
+			if err := reallocate(tx, rules, residentID); err != nil {
+				return err
+			}
+
+			// A credit, such as from paying ahead, settles the new charge. The
+			// credit before the charge is what the balance falls short of it.
+			balance, err := residentBalance(tx, residentID)
+			if err != nil {
+				return err
+			}
+			if credit := roundCents(amount - balance.Balance); credit > 0 {
+				creditApplied = roundCents(creditApplied + min(credit, amount))
+			}
+			return nil
+		}
+		skipped := []ReminderSkip{}
+		for _, resident := range residents {
+			fee, err := residentFee(tx, resident.ResidentID, month, monthlyFee)
+			if err != nil {
+				respondWithError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			if fee.Amount == 0 {
+				resident.Reason = "no fee for the month"
+				skipped = append(skipped, resident.ReminderSkip)
+				continue
+			}
+			amount, prorated := prorate(fee.Amount, start, resident.moveIn, resident.moveOut, rule)
+			if amount == 0 {
+				resident.Reason = "not living there in the month"
+				skipped = append(skipped, resident.ReminderSkip)
+				continue
+			}
+			description := fmt.Sprintf("Monthly dues %s", month)
+			if prorated {
+				description += " (pro-rated)"
+			}
+			if err := charge(resident.ResidentID, description, amount); err != nil {
+				respondWithError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+		}
+
+		// Units nobody lives in all month are skipped, or charged in full to
+		// their owner of record, the last resident who moved out
+		occupancy, err := occupancyInMonth(tx, start)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		_, unitResidents, err := loadUnitResidents(tx)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		vacant := []string{}
+		for _, unit := range occupancy.Units {
+			if unit.Status != UnitVacant {
+				continue
+			}
+			vacant = append(vacant, unit.Unit)
+			if vacantRule != VacantOwner {
+				continue
+			}
+			owner := ownerOfRecord(unitResidents[unit.Unit], start.Format("2006-01-02"))
+			if owner == nil {
+				continue
+			}
+			fee, err := residentFee(tx, owner.ResidentID, month, monthlyFee)
+			if err != nil {
+				respondWithError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			if fee.Amount == 0 {
+				continue
+			}
+			if err := charge(owner.ResidentID, fmt.Sprintf("Monthly dues %s (vacant unit)", month), fee.Amount); err != nil {
+				respondWithError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			for i, skip := range skipped {
+				if skip.ResidentID == owner.ResidentID {
+					skipped = append(skipped[:i], skipped[i+1:]...)
+					break
+				}
+			}
+		}
+
+		// The expenses allocated to the month by ownership fraction
+		shared, unbilled, err := chargeExpenseShares(tx, month, start, rules)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		if err := tx.Commit(); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		respondWithJSON(w, http.StatusOK, map[string]interface{}{
+			"month":          month,
+			"created":        created,
+			"credit_applied": creditApplied,
+			"skipped":        skipped,
+			"expense_shares": shared,
+			"unbilled_units": unbilled,
+			"vacant_units":   vacant,
+		})
+	}
+}
+
+// Get a resident's charges, oldest first
+func getResidentCharges(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id, err := strconv.Atoi(vars["id"])
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid resident ID")
+			return
+		}
+
+		rows, err := db.Query("SELECT id, resident_id, kind, period, description, amount, due_date, created_at FROM charges WHERE resident_id = ? ORDER BY due_date, id", id)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		defer rows.Close()
+
+		charges := []Charge{}
+		for rows.Next() {
+			var charge Charge
+			if err := rows.Scan(&charge.ID, &charge.ResidentID, &charge.Kind, &charge.Period, &charge.Description, &charge.Amount, &charge.DueDate, &charge.CreatedAt); err != nil {
+				respondWithError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			charges = append(charges, charge)
+		}
+
+		respondWithJSON(w, http.StatusOK, charges)
+	}
+}
+
+// Get a resident's balance
+func getResidentBalance(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id, err := strconv.Atoi(vars["id"])
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid resident ID")
+			return
+		}
+
+		var exists bool
+		if err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM residents WHERE id = ?)", id).Scan(&exists); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if !exists {
+			respondWithError(w, http.StatusNotFound, "Resident not found")
+			return
+		}
+
+		balance, err := residentBalance(db, id)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		respondWithJSON(w, http.StatusOK, balance)
+	}
+}
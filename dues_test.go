@@ -0,0 +1,95 @@
+package condomngr
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// TestProrateHandoverAddsUpToOneFee hands a unit over on every day of months
+// of every length, under both rules, and checks the part of whoever moves out
+// and of whoever moves in add up to exactly one fee
+func TestProrateHandoverAddsUpToOneFee(t *testing.T) {
+	months := []time.Time{
+		time.Date(2023, time.February, 1, 0, 0, 0, 0, time.UTC), // 28 days
+		time.Date(2024, time.February, 1, 0, 0, 0, 0, time.UTC), // 29 days
+		time.Date(2024, time.April, 1, 0, 0, 0, 0, time.UTC),    // 30 days
+		time.Date(2024, time.March, 1, 0, 0, 0, 0, time.UTC),    // 31 days
+	}
+	for _, rule := range []string{ProrationDays, ProrationHalfMonth} {
+		for _, fee := range []float64{100, 33.33, 57.77, 0.01, 1234.56} {
+			for _, month := range months {
+				days := month.AddDate(0, 1, -1).Day()
+				for day := 1; day <= days+1; day++ {
+					handover := month.AddDate(0, 0, day-1).Format("2006-01-02")
+					out, _ := prorate(fee, month, "2020-01-01", handover, rule)
+					in, _ := prorate(fee, month, handover, "", rule)
+					if math.Round(out*100)+math.Round(in*100) != math.Round(fee*100) {
+						t.Errorf("%s, %.2f, handover %s: %.2f + %.2f != %.2f", rule, fee, handover, out, in, fee)
+					}
+					for _, part := range []float64{out, in} {
+						if part < 0 || part > fee || math.Abs(part*100-math.Round(part*100)) > 1e-6 {
+							t.Errorf("%s, %.2f, handover %s: part %v isn't whole cents of the fee", rule, fee, handover, part)
+						}
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestProrateRules(t *testing.T) {
+	march := time.Date(2024, time.March, 1, 0, 0, 0, 0, time.UTC)
+	for _, tt := range []struct {
+		rule, moveIn, moveOut string
+		want                  float64
+		prorated              bool
+	}{
+		{ProrationDays, "2024-01-10", "", 31, false},
+		{ProrationDays, "2024-03-01", "", 31, false},
+		{ProrationDays, "2024-03-20", "", 12, true},           // the 20th to the 31st
+		{ProrationDays, "2024-01-10", "2024-03-20", 19, true}, // the 1st to the 19th
+		{ProrationDays, "2024-03-10", "2024-03-20", 10, true},
+		{ProrationDays, "2024-04-01", "", 0, false},
+		{ProrationDays, "2024-01-10", "2024-03-01", 0, false},
+		{ProrationHalfMonth, "2024-03-05", "", 31, true}, // rounds to the start
+		{ProrationHalfMonth, "2024-03-12", "", 15.5, true},
+		{ProrationHalfMonth, "2024-03-28", "", 0, true}, // rounds to the end
+		{ProrationHalfMonth, "2024-01-10", "2024-03-12", 15.5, true},
+	} {
+		got, prorated := prorate(31, march, tt.moveIn, tt.moveOut, tt.rule)
+		if got != tt.want || prorated != tt.prorated {
+			t.Errorf("%s in %s out %s: %v, %v, want %v, %v", tt.rule, tt.moveIn, tt.moveOut, got, prorated, tt.want, tt.prorated)
+		}
+	}
+}
+
+func TestGenerateDuesHandover(t *testing.T) {
+	s := newTestServer(t, Options{MonthlyFee: 33.33})
+	var out, in Resident
+	s.expect(http.StatusCreated, "POST", "/api/v1/residents", map[string]string{"name": "Ana Silva", "unit": "1A", "move_in_date": "2020-01-01", "move_out_date": "2024-03-20"}, &out)
+	s.expect(http.StatusCreated, "POST", "/api/v1/residents", map[string]string{"name": "Rui Costa", "unit": "1A", "move_in_date": "2024-03-20"}, &in)
+	s.expect(http.StatusOK, "POST", "/api/v1/dues/generate?month=2024-03", nil, nil)
+
+	var total float64
+	for _, resident := range []Resident{out, in} {
+		var charges []Charge
+		s.expect(http.StatusOK, "GET", fmt.Sprintf("/api/v1/residents/%d/charges", resident.ID), nil, &charges)
+		if len(charges) != 1 {
+			t.Fatalf("%s has charges %+v", resident.Name, charges)
+		}
+		total += charges[0].Amount
+
+		// Balances owe the pro-rated part, not a full fee
+		var balance Balance
+		s.expect(http.StatusOK, "GET", fmt.Sprintf("/api/v1/residents/%d/balance", resident.ID), nil, &balance)
+		if balance.Balance != charges[0].Amount {
+			t.Errorf("%s owes %v for a charge of %v", resident.Name, balance.Balance, charges[0].Amount)
+		}
+	}
+	if math.Round(total*100) != 3333 {
+		t.Errorf("the handover month was charged %.2f in all, want 33.33", total)
+	}
+}
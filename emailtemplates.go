@@ -0,0 +1,446 @@
+package condomngr
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"text/template"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Default templates of the payment receipt and the overdue reminder emails.
+// They are executed with receiptMailData and reminderMailData.
+const (
+	defaultReceiptSubject = "Receipt for your payment of {{printf \"%.2f\" .Amount}} {{.Currency}}"
+	defaultReceiptBody    = `Hello {{.Name}},
+
+We received your payment of {{printf "%.2f" .Amount}} {{.Currency}} for unit {{.Unit}} on {{.Date}}.
+{{- if .Description}}
+Description: {{.Description}}
+{{- end}}
+Receipt number: {{.PaymentID}}
+
+Thank you.
+`
+	defaultReminderSubject = "Condo payment for {{.Month}}"
+	defaultReminderBody    = `Hello {{.Name}},
+
+We have not received the condo payment for unit {{.Unit}} for {{.Month}}.
+Please disregard this message if you have already paid.
+{{- if .Reference}}
+
+To pay by bank transfer:
+{{- if .Amount}}
+Amount: {{printf "%.2f" .Amount}} {{.Currency}}
+{{- end}}
+Beneficiary: {{.Payee}}
+IBAN: {{.IBAN}}
+Reference: {{.Reference}}
+Please quote the reference so your payment is recognized.
+{{- end}}
+
+Thank you.
+`
+)
+
+// receiptMailData is what the receipt templates can use
+type receiptMailData struct {
+	PaymentID   int
+	Name        string
+	Unit        string
+	Amount      float64
+	Currency    string
+	Date        string // YYYY-MM-DD
+	Description string
+	Method      string
+	Reference   string
+}
+
+// reminderMailData is what the overdue reminder templates can use. The
+// payment request is empty when no payment details are set.
+type reminderMailData struct {
+	Name      string
+	Unit      string
+	Month     string // e.g. July 2024
+	Amount    float64
+	Currency  string
+	Payee     string
+	IBAN      string // in groups of four
+	BIC       string
+	Reference string
+}
+
+// emailTemplateDefault is an email the condo sends, with its embedded wording,
+// the variables its templates can use, and the sample data it is previewed
+// and checked against
+type emailTemplateDefault struct {
+	subject   string
+	body      string
+	variables map[string]string
+	sample    func(currency string) interface{}
+}
+
+// emailTemplateDefaults are the emails whose wording can be changed, by name
+var emailTemplateDefaults = map[string]emailTemplateDefault{
+	"receipt": {
+		subject: defaultReceiptSubject,
+		body:    defaultReceiptBody,
+		variables: map[string]string{
+			"PaymentID":   "Payment id, used as the receipt number",
+			"Name":        "Resident name",
+			"Unit":        "Resident unit",
+			"Amount":      "Amount paid, a number",
+			"Currency":    "ISO 4217 currency code",
+			"Date":        "Payment date, YYYY-MM-DD",
+			"Description": "Payment description, may be empty",
+			"Method":      "Payment method, e.g. transfer",
+			"Reference":   "Reference in an external system, may be empty",
+		},
+		sample: func(currency string) interface{} {
+			return receiptMailData{PaymentID: 1042, Name: "Maria Silva", Unit: "2B", Amount: 150, Currency: currency,
+				Date: "2024-07-05", Description: "July dues", Method: "transfer", Reference: "TRF-20240705"}
+		},
+	},
+	"reminder": {
+		subject: defaultReminderSubject,
+		body:    defaultReminderBody,
+		variables: map[string]string{
+			"Name":      "Resident name",
+			"Unit":      "Resident unit",
+			"Month":     "Month without a payment, e.g. July 2024",
+			"Amount":    "Amount owed by the end of the month, a number",
+			"Currency":  "ISO 4217 currency code",
+			"Payee":     "Name of the account to pay into, empty without payment details",
+			"IBAN":      "IBAN to pay into, in groups of four",
+			"BIC":       "BIC of the account, may be empty",
+			"Reference": "Reference to quote, empty without payment details",
+		},
+		sample: func(currency string) interface{} {
+			return reminderMailData{Name: "Maria Silva", Unit: "2B", Month: "July 2024", Amount: 150, Currency: currency,
+				Payee: "Condominio Rua Nova 12", IBAN: "PT50 0002 0123 1234 5678 9015 4", Reference: "RF182B202407"}
+		},
+	},
+	"statement": {
+		subject: defaultStatementSubject,
+		body:    defaultStatementBody,
+		variables: map[string]string{
+			"Name":     "Resident name",
+			"Unit":     "Resident unit",
+			"Month":    "Last month of the statement, e.g. July 2024",
+			"Balance":  "Balance at the end of the month, a number",
+			"Currency": "ISO 4217 currency code",
+		},
+		sample: func(currency string) interface{} {
+			return statementMailData{Name: "Maria Silva", Unit: "2B", Month: "July 2024", Balance: -150, Currency: currency}
+		},
+	},
+	"password_reset": {
+		subject: defaultPasswordResetSubject,
+		body:    defaultPasswordResetBody,
+		variables: map[string]string{
+			"Username": "Username of the user",
+			"URL":      "Link to choose a new password",
+			"Minutes":  "Minutes the link works for, a number",
+		},
+		sample: func(currency string) interface{} {
+			return passwordResetMailData{Username: "alice", URL: "https://condo.example.com/api/v1/password-reset/confirm?token=sample", Minutes: 60}
+		},
+	},
+}
+
+// EmailTemplate is the wording of an email. Custom is true when it was
+// changed from the default.
+type EmailTemplate struct {
+	Name      string            `json:"name"`
+	Subject   string            `json:"subject"`
+	Body      string            `json:"body"`
+	Custom    bool              `json:"custom"`
+	Variables map[string]string `json:"variables"`
+	UpdatedAt *time.Time        `json:"updated_at"`
+}
+
+// RenderedEmail is an email template executed against sample data
+type RenderedEmail struct {
+	Subject string `json:"subject"`
+	Body    string `json:"body"`
+}
+
+// emailTemplate returns the wording of the named email, the default unless it
+// was changed. The name must be one of emailTemplateDefaults.
+func emailTemplate(q querier, name string) (EmailTemplate, error) {
+	def := emailTemplateDefaults[name]
+	t := EmailTemplate{Name: name, Subject: def.subject, Body: def.body, Variables: def.variables}
+	var updatedAt time.Time
+	err := q.QueryRow("SELECT subject, body, updated_at FROM email_templates WHERE name = ?", name).Scan(&t.Subject, &t.Body, &updatedAt)
+	if err == sql.ErrNoRows {
+		return t, nil
+	}
+	if err != nil {
+		return EmailTemplate{}, err
+	}
+	t.Custom = true
+	t.UpdatedAt = &updatedAt
+	return t, nil
+}
+
+// parseEmailTemplate parses a subject and body and executes them against the
+// sample data of the named email, so templates that would fail when sending
+// are rejected up front
+func parseEmailTemplate(name, subject, body, currency string) (*template.Template, *template.Template, RenderedEmail, error) {
+	var errs ValidationErrors
+	var rendered RenderedEmail
+	sample := emailTemplateDefaults[name].sample(currency)
+	parse := func(field, text string, out *string) *template.Template {
+		if text == "" {
+			errs.Add(field, field+" is required")
+			return nil
+		}
+		t, err := template.New(field).Parse(text)
+		if err != nil {
+			errs.Add(field, err.Error())
+			return nil
+		}
+		var buf bytes.Buffer
+		if err := t.Execute(&buf, sample); err != nil {
+			errs.Add(field, err.Error())
+			return nil
+		}
+		*out = buf.String()
+		return t
+	}
+	subjectTemplate := parse("subject", subject, &rendered.Subject)
+	bodyTemplate := parse("body", body, &rendered.Body)
+	if err := errs.Err(); err != nil {
+		return nil, nil, RenderedEmail{}, err
+	}
+	return subjectTemplate, bodyTemplate, rendered, nil
+}
+
+// loadEmailTemplate parses the wording of the named email for sending
+func loadEmailTemplate(q querier, name, currency string) (*template.Template, *template.Template, error) {
+	t, err := emailTemplate(q, name)
+	if err != nil {
+		return nil, nil, err
+	}
+	subject, body, _, err := parseEmailTemplate(name, t.Subject, t.Body, currency)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s email template: %v", name, err)
+	}
+	return subject, body, nil
+}
+
+// renderEmail executes a subject and body template with data
+func renderEmail(subject, body *template.Template, data interface{}) (string, string, error) {
+	var subjectText, bodyText bytes.Buffer
+	if err := subject.Execute(&subjectText, data); err != nil {
+		return "", "", fmt.Errorf("subject template: %v", err)
+	}
+	if err := body.Execute(&bodyText, data); err != nil {
+		return "", "", fmt.Errorf("body template: %v", err)
+	}
+	return subjectText.String(), bodyText.String(), nil
+}
+
+// emailTemplateName returns the template name in the path, answering 404 when
+// there is no such email
+func emailTemplateName(w http.ResponseWriter, r *http.Request) (string, bool) {
+	name := mux.Vars(r)["name"]
+	if _, ok := emailTemplateDefaults[name]; !ok {
+		respondWithError(w, http.StatusNotFound, "Email template not found")
+		return "", false
+	}
+	return name, true
+}
+
+// Get the wording of every email, in name order
+func getEmailTemplates(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		names := make([]string, 0, len(emailTemplateDefaults))
+		for name := range emailTemplateDefaults {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		templates := []EmailTemplate{}
+		for _, name := range names {
+			t, err := emailTemplate(db, name)
+			if err != nil {
+				respondWithError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			templates = append(templates, t)
+		}
+
+		respondWithJSON(w, http.StatusOK, templates)
+	}
+}
+
+func getEmailTemplate(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name, ok := emailTemplateName(w, r)
+		if !ok {
+			return
+		}
+
+		t, err := emailTemplate(db, name)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		respondWithJSON(w, http.StatusOK, t)
+	}
+}
+
+// Change the wording of an email. Templates that don't parse, or fail on the
+// sample data, are rejected.
+func updateEmailTemplate(db *sql.DB, currency string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name, ok := emailTemplateName(w, r)
+		if !ok {
+			return
+		}
+
+		var t EmailTemplate
+		if err := decodeRequest(r, &t); err != nil {
+			respondWithError(w, payloadErrorStatus(err), "Invalid request payload: "+err.Error())
+			return
+		}
+		defer r.Body.Close()
+
+		if _, _, _, err := parseEmailTemplate(name, t.Subject, t.Body, currency); err != nil {
+			respondWithValidationError(w, err)
+			return
+		}
+
+		_, err := db.Exec(`
+			INSERT INTO email_templates(name, subject, body) VALUES(?, ?, ?)
+			ON CONFLICT(name) DO UPDATE SET subject = excluded.subject, body = excluded.body, updated_at = CURRENT_TIMESTAMP
+		`, name, t.Subject, t.Body)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		t, err = emailTemplate(db, name)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		respondWithJSON(w, http.StatusOK, t)
+	}
+}
+
+// Go back to the default wording of an email
+func resetEmailTemplate(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name, ok := emailTemplateName(w, r)
+		if !ok {
+			return
+		}
+
+		if _, err := db.Exec("DELETE FROM email_templates WHERE name = ?", name); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		t, err := emailTemplate(db, name)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		respondWithJSON(w, http.StatusOK, t)
+	}
+}
+
+// Render an email against sample data. The subject and body in the request,
+// when given, are previewed instead of the saved ones.
+func previewEmailTemplate(db *sql.DB, currency string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name, ok := emailTemplateName(w, r)
+		if !ok {
+			return
+		}
+
+		t, err := emailTemplate(db, name)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if r.ContentLength > 0 {
+			var req RenderedEmail
+			if err := decodeRequest(r, &req); err != nil {
+				respondWithError(w, payloadErrorStatus(err), "Invalid request payload: "+err.Error())
+				return
+			}
+			defer r.Body.Close()
+			if req.Subject != "" {
+				t.Subject = req.Subject
+			}
+			if req.Body != "" {
+				t.Body = req.Body
+			}
+		}
+
+		_, _, rendered, err := parseEmailTemplate(name, t.Subject, t.Body, currency)
+		if err != nil {
+			respondWithValidationError(w, err)
+			return
+		}
+
+		respondWithJSON(w, http.StatusOK, rendered)
+	}
+}
+
+// Email the receipt of a payment to its resident, with the receipt as a PDF
+// attachment
+func sendPaymentReceipt(db *sql.DB, mailer *Mailer, unsubscribe *Unsubscribe, currency string, cal calendar) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id, err := strconv.Atoi(vars["id"])
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid payment ID")
+			return
+		}
+
+		receipt, err := loadPaymentReceipt(db, id, currency)
+		if err == sql.ErrNoRows {
+			respondWithError(w, http.StatusNotFound, "Payment not found")
+			return
+		}
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if receipt.anonymized {
+			respondWithError(w, http.StatusConflict, "Resident is anonymized")
+			return
+		}
+		if receipt.channel == "none" {
+			respondWithError(w, http.StatusConflict, "Resident opted out of receipts")
+			return
+		}
+		if receipt.email == "" {
+			respondWithError(w, http.StatusBadRequest, "Resident has no email address")
+			return
+		}
+		if !mailer.Enabled() {
+			respondWithError(w, http.StatusBadRequest, "Email is not configured")
+			return
+		}
+
+		if err := receipt.send(db, mailer, unsubscribe, cal.location); err != nil {
+			respondWithError(w, http.StatusBadGateway, "Failed to send receipt: "+err.Error())
+			return
+		}
+
+		respondWithJSON(w, http.StatusOK, map[string]string{"result": "success", "email": receipt.email})
+	}
+}
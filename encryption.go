@@ -0,0 +1,153 @@
+package condomngr
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// dbKey encrypts the database in builds linked against SQLCipher (make
+// build-sqlcipher). Set with -db-key or CONDO_DB_KEY; it is never logged or
+// shown as a flag default.
+var dbKey string
+
+// sqliteHeader starts every plaintext SQLite database. An encrypted one
+// starts with random salt.
+const sqliteHeader = "SQLite format 3\x00"
+
+// sqliteDSN is the data source name of file, opened with key unless it is
+// empty. SQLCipher takes the key from the URI, so it is set before the
+// driver's first statements read the database.
+func sqliteDSN(file, key string) string {
+	if key == "" {
+		return file
+	}
+	escaped := strings.NewReplacer("%", "%25", "?", "%3f", "#", "%23").Replace(file)
+	return "file:" + escaped + "?key=" + url.QueryEscape(key)
+}
+
+// sqlcipherVersion is the version of SQLCipher the driver is linked against,
+// empty with plain SQLite
+func sqlcipherVersion() string {
+	db, err := sql.Open(sqliteDriver, ":memory:")
+	if err != nil {
+		return ""
+	}
+	defer db.Close()
+	var version string
+	db.QueryRow("PRAGMA cipher_version").Scan(&version)
+	return version
+}
+
+// openSQLite opens file with key, failing clearly when the key can't open it:
+// a key without SQLCipher, no key or the wrong one
+func openSQLite(file, key string) (*sql.DB, error) {
+	if key != "" && sqlcipherVersion() == "" {
+		return nil, fmt.Errorf("a database key needs condomngr built with SQLCipher (make build-sqlcipher)")
+	}
+	db, err := sql.Open(sqliteDriver, sqliteDSN(file, key))
+	if err != nil {
+		return nil, err
+	}
+
+	var tables int
+	err = db.QueryRow("SELECT COUNT(*) FROM sqlite_master").Scan(&tables)
+	var sqliteErr sqlite3.Error
+	switch {
+	case err == nil:
+		return db, nil
+	case !errors.As(err, &sqliteErr) || sqliteErr.Code != sqlite3.ErrNotADB:
+	case key == "":
+		err = fmt.Errorf("%s is encrypted or not a database: set -db-key or CONDO_DB_KEY", file)
+	default:
+		err = fmt.Errorf("wrong key for %s, or it is not encrypted (encrypt it with condomngr encrypt)", file)
+	}
+	db.Close()
+	return nil, err
+}
+
+// plaintextDatabase reports whether file is an unencrypted SQLite database
+func plaintextDatabase(file string) (bool, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	header := make([]byte, len(sqliteHeader))
+	if _, err := io.ReadFull(f, header); err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return false, err
+	}
+	return bytes.Equal(header, []byte(sqliteHeader)), nil
+}
+
+// checkBackupEncrypted fails, removing file, when a backup of the encrypted
+// database was written in plaintext
+func checkBackupEncrypted(file string) error {
+	if dbKey == "" {
+		return nil
+	}
+	plaintext, err := plaintextDatabase(file)
+	if err != nil {
+		return err
+	}
+	if plaintext {
+		os.Remove(file)
+		return fmt.Errorf("the backup of the encrypted database was written unencrypted, removed it")
+	}
+	return nil
+}
+
+// rekeyDatabase rewrites the database with newKey, from oldKey: encrypts a
+// plaintext database when oldKey is empty and decrypts it when newKey is. The
+// copy is checked before it replaces the database.
+func rekeyDatabase(oldKey, newKey string) error {
+	if sqlcipherVersion() == "" {
+		return fmt.Errorf("encryption needs condomngr built with SQLCipher (make build-sqlcipher)")
+	}
+	db, err := openSQLite(dbFile, oldKey)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	// ATTACH only holds on the connection it ran on
+	db.SetMaxOpenConns(1)
+
+	tmp, err := os.CreateTemp(filepath.Dir(dbFile), filepath.Base(dbFile)+".rekey-*")
+	if err != nil {
+		return err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	var version int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+	if _, err := db.Exec("ATTACH DATABASE ? AS rekeyed KEY ?", tmp.Name(), newKey); err != nil {
+		return err
+	}
+	if _, err := db.Exec("SELECT sqlcipher_export('rekeyed')"); err != nil {
+		return err
+	}
+	// PRAGMA does not support placeholders
+	if _, err := db.Exec(fmt.Sprintf("PRAGMA rekeyed.user_version = %d", version)); err != nil {
+		return err
+	}
+	if _, err := db.Exec("DETACH DATABASE rekeyed"); err != nil {
+		return err
+	}
+	db.Close()
+
+	if err := checkBackup(tmp.Name(), newKey); err != nil {
+		return fmt.Errorf("the rewritten database is not usable: %v", err)
+	}
+	return os.Rename(tmp.Name(), dbFile)
+}
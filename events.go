@@ -0,0 +1,145 @@
+package condomngr
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Change actions
+const (
+	ChangeCreated  = "created"
+	ChangeUpdated  = "updated"
+	ChangeDeleted  = "deleted"
+	ChangeImported = "imported" // many records at once; reload the list
+)
+
+// changeTypes and changeActions list what streams can be filtered on
+var changeTypes = []string{"resident", "payment", "expense"}
+var changeActions = []string{ChangeCreated, ChangeUpdated, ChangeDeleted, ChangeImported}
+
+// changeBuffer is how many changes a stream can fall behind before it misses
+// some
+const changeBuffer = 64
+
+// eventsHeartbeat is how often an idle stream sends a comment, so proxies
+// don't close it
+const eventsHeartbeat = 15 * time.Second
+
+// Change tells that a record was created, updated or deleted
+type Change struct {
+	Type   string `json:"type"` // resident, payment or expense
+	ID     int    `json:"id"`   // 0 for imported
+	Action string `json:"action"`
+}
+
+// ChangeBroker hands the changes published by the handlers to every open
+// event stream, in process
+type ChangeBroker struct {
+	mu          sync.Mutex
+	subscribers map[chan Change]struct{}
+	hooks       []func(Change)
+}
+
+// NewChangeBroker creates a broker without streams
+func NewChangeBroker() *ChangeBroker {
+	return &ChangeBroker{subscribers: make(map[chan Change]struct{})}
+}
+
+// Publish sends a change to every stream without blocking the caller. Streams
+// that fell too far behind miss it.
+func (b *ChangeBroker) Publish(change Change) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, hook := range b.hooks {
+		hook(change)
+	}
+	for ch := range b.subscribers {
+		select {
+		case ch <- change:
+		default:
+		}
+	}
+}
+
+// OnPublish calls hook with every change published from now on, before
+// Publish returns, e.g. to drop what the change makes stale
+func (b *ChangeBroker) OnPublish(hook func(Change)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.hooks = append(b.hooks, hook)
+}
+
+// Subscribe returns the channel of the changes published from now on, and the
+// function that stops them
+func (b *ChangeBroker) Subscribe() (<-chan Change, func()) {
+	ch := make(chan Change, changeBuffer)
+	b.mu.Lock()
+	b.subscribers[ch] = struct{}{}
+	b.mu.Unlock()
+	return ch, func() {
+		b.mu.Lock()
+		delete(b.subscribers, ch)
+		b.mu.Unlock()
+	}
+}
+
+// Stream the changes to residents, payments and expenses as server-sent
+// events, optionally only of some types and actions
+func streamEvents(broker *ChangeBroker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := checkQueryParams(r, "type", "action"); err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		types, actions := queryValues(r, "type"), queryValues(r, "action")
+		for _, t := range types {
+			if !slices.Contains(changeTypes, t) {
+				respondWithError(w, http.StatusBadRequest, "Invalid type, must be resident, payment or expense")
+				return
+			}
+		}
+		for _, a := range actions {
+			if !slices.Contains(changeActions, a) {
+				respondWithError(w, http.StatusBadRequest, "Invalid action, must be created, updated, deleted or imported")
+				return
+			}
+		}
+
+		changes, unsubscribe := broker.Subscribe()
+		defer unsubscribe()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("X-Accel-Buffering", "no") // nginx would hold the events back
+		w.WriteHeader(http.StatusOK)
+		rc := http.NewResponseController(w)
+		if _, err := fmt.Fprint(w, ": connected\n\n"); err != nil || rc.Flush() != nil {
+			return
+		}
+
+		heartbeat := time.NewTicker(eventsHeartbeat)
+		defer heartbeat.Stop()
+		for {
+			var err error
+			select {
+			case <-r.Context().Done():
+				return
+			case <-heartbeat.C:
+				_, err = fmt.Fprint(w, ": heartbeat\n\n")
+			case change := <-changes:
+				if (len(types) > 0 && !slices.Contains(types, change.Type)) || (len(actions) > 0 && !slices.Contains(actions, change.Action)) {
+					continue
+				}
+				b, _ := json.Marshal(change)
+				_, err = fmt.Fprintf(w, "event: change\ndata: %s\n\n", b)
+			}
+			if err != nil || rc.Flush() != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package condomngr
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// openEvents opens the event stream at path and returns the changes it sends,
+// once the stream is connected
+func (s *testServer) openEvents(path string) <-chan Change {
+	s.t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	s.t.Cleanup(cancel)
+	req, err := http.NewRequestWithContext(ctx, "GET", s.URL+path, nil)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	resp, err := s.Client().Do(req)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	s.t.Cleanup(func() { resp.Body.Close() })
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		s.t.Fatalf("GET %s: status %d, content type %s", path, resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	lines := bufio.NewScanner(resp.Body)
+	if !lines.Scan() || lines.Text() != ": connected" {
+		s.t.Fatalf("GET %s: stream started with %q", path, lines.Text())
+	}
+	changes := make(chan Change, changeBuffer)
+	go func() {
+		defer close(changes)
+		for lines.Scan() {
+			data, ok := strings.CutPrefix(lines.Text(), "data: ")
+			if !ok {
+				continue
+			}
+			var change Change
+			if json.Unmarshal([]byte(data), &change) == nil {
+				changes <- change
+			}
+		}
+	}()
+	return changes
+}
+
+// nextChange is the next change sent on changes, failing after a second
+func nextChange(t *testing.T, changes <-chan Change) Change {
+	t.Helper()
+	select {
+	case change, ok := <-changes:
+		if !ok {
+			t.Fatal("the stream closed")
+		}
+		return change
+	case <-time.After(time.Second):
+		t.Fatal("no change within a second")
+	}
+	return Change{}
+}
+
+func TestEventsStreamPayments(t *testing.T) {
+	s := newTestServer(t, Options{})
+	resident := s.createResident("Ana Silva", "1A")
+	all := s.openEvents("/api/v1/events")
+	expenses := s.openEvents("/api/v1/events?type=expense")
+
+	var payment Payment
+	s.expect(http.StatusCreated, "POST", "/api/v1/payments", map[string]interface{}{"resident_id": resident.ID, "amount": 50, "description": "Dues", "payment_date": "2024-03-05"}, &payment)
+	if got, want := nextChange(t, all), (Change{Type: "payment", ID: payment.ID, Action: ChangeCreated}); got != want {
+		t.Errorf("change %+v, want %+v", got, want)
+	}
+
+	// Filtered streams skip the payment
+	var expense Expense
+	s.expect(http.StatusCreated, "POST", "/api/v1/expenses", map[string]interface{}{"amount": 10, "description": "Bulbs", "expense_date": "2024-03-05"}, &expense)
+	if got, want := nextChange(t, expenses), (Change{Type: "expense", ID: expense.ID, Action: ChangeCreated}); got != want {
+		t.Errorf("filtered change %+v, want %+v", got, want)
+	}
+
+	s.expect(http.StatusBadRequest, "GET", "/api/v1/events?type=charge", nil, nil)
+}
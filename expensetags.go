@@ -0,0 +1,60 @@
+package condomngr
+
+import (
+	"sort"
+	"strings"
+)
+
+// maxTagLength is the longest tag an expense can have, in characters
+const maxTagLength = 50
+
+// validateTag returns what is wrong with a tag of an expense, or "". Tags are
+// listed separated by commas, so they can't have any.
+func validateTag(tag string) string {
+	switch {
+	case strings.TrimSpace(tag) == "":
+		return "tags must not be empty"
+	case strings.Contains(tag, ","):
+		return "tags must not contain commas"
+	case len([]rune(tag)) > maxTagLength:
+		return "tags must be at most 50 characters"
+	}
+	return ""
+}
+
+// normalizeTags trims the tags of an expense and drops the duplicates,
+// sorted as they are listed
+func normalizeTags(tags []string) []string {
+	if len(tags) == 0 {
+		return nil
+	}
+	seen := map[string]bool{}
+	normalized := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		tag = strings.TrimSpace(tag)
+		if !seen[tag] {
+			seen[tag] = true
+			normalized = append(normalized, tag)
+		}
+	}
+	sort.Strings(normalized)
+	return normalized
+}
+
+// setExpenseTags replaces the tags of an expense
+func setExpenseTags(q querier, expenseID int, tags []string) error {
+	if _, err := q.Exec("DELETE FROM expense_tags WHERE expense_id = ?", expenseID); err != nil {
+		return err
+	}
+	return addExpenseTags(q, expenseID, tags...)
+}
+
+// addExpenseTags tags an expense, keeping the tags it has
+func addExpenseTags(q querier, expenseID int, tags ...string) error {
+	for _, tag := range tags {
+		if _, err := q.Exec("INSERT OR IGNORE INTO expense_tags(expense_id, tag) VALUES(?, ?)", expenseID, tag); err != nil {
+			return err
+		}
+	}
+	return nil
+}
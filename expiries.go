@@ -0,0 +1,477 @@
+package condomngr
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Kinds of documents with an expiry date
+const (
+	DocumentContract   = "contract"
+	DocumentInsurance  = "insurance"
+	DocumentInspection = "inspection" // the date the next inspection is due
+	DocumentOther      = "other"
+)
+
+// Kinds of expiries besides the documents
+const (
+	ExpiryLease       = "lease"        // a resident moving out
+	ExpiryFeeSchedule = "fee_schedule" // the last day a fee schedule applies
+)
+
+// defaultExpiryDays is how far ahead expiries are listed by default
+const defaultExpiryDays = 90
+
+// Document is a contract, insurance certificate, inspection or other paper
+// of the condominium that runs out
+type Document struct {
+	ID        int       `json:"id"`
+	Kind      string    `json:"kind"`
+	Name      string    `json:"name"`
+	ExpiresOn string    `json:"expires_on"` // YYYY-MM-DD
+	Notes     string    `json:"notes"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+const documentColumns = "id, kind, name, expires_on, notes, created_at, updated_at"
+
+func scanDocument(row interface{ Scan(...interface{}) error }) (Document, error) {
+	var d Document
+	err := row.Scan(&d.ID, &d.Kind, &d.Name, &d.ExpiresOn, &d.Notes, &d.CreatedAt, &d.UpdatedAt)
+	return d, err
+}
+
+// Validation function for Document data
+func validateDocument(d Document) error {
+	var errs ValidationErrors
+	switch d.Kind {
+	case DocumentContract, DocumentInsurance, DocumentInspection, DocumentOther:
+	default:
+		errs.Add("kind", "kind must be one of contract, insurance, inspection or other")
+	}
+	if d.Name == "" {
+		errs.Add("name", "name is required")
+	}
+	if _, err := time.Parse("2006-01-02", d.ExpiresOn); err != nil {
+		errs.Add("expires_on", "expires_on must be a date, YYYY-MM-DD")
+	}
+	return errs.Err()
+}
+
+// Expiry is anything that runs out on a date: a document, a lease ending with
+// the resident's move-out or a fee schedule. Item identifies it, e.g.
+// document-3, lease-12 or fee_schedule-4. Suppressed expiries are let lapse:
+// they are listed but not reminded of.
+type Expiry struct {
+	Item              string `json:"item"`
+	Kind              string `json:"kind"`
+	Name              string `json:"name"`
+	ExpiresOn         string `json:"expires_on"`
+	DaysLeft          int    `json:"days_left"`
+	Suppressed        bool   `json:"suppressed"`
+	SuppressionReason string `json:"suppression_reason,omitempty"`
+}
+
+// ExpirySuppression lets an expiry lapse, for the reason given
+type ExpirySuppression struct {
+	Reason string `json:"reason"`
+}
+
+// expiryItemPattern matches the item of an expiry
+var expiryItemPattern = regexp.MustCompile(`^(document|lease|fee_schedule)-([0-9]+)$`)
+
+// loadExpiries returns what runs out from today through within days from
+// now, soonest first
+func loadExpiries(q querier, within int, cal calendar) ([]Expiry, error) {
+	from := cal.now()
+	start, end := from.Format("2006-01-02"), from.AddDate(0, 0, within).Format("2006-01-02")
+
+	// A fee schedule runs out at the end of its last month, the day before
+	// the first of the next one
+	rows, err := q.Query(`
+		SELECT 'document-' || id, kind, name, expires_on FROM documents
+		WHERE expires_on >= ?1 AND expires_on <= ?2
+		UNION ALL
+		SELECT 'lease-' || id, ?3, 'Lease of ' || name || ', unit ' || unit, move_out_date FROM residents
+		WHERE move_out_date >= ?1 AND move_out_date <= ?2
+		UNION ALL
+		SELECT 'fee_schedule-' || f.id, ?4,
+			CASE WHEN f.resident_id IS NULL THEN 'Fee schedule of unit ' || f.unit ELSE 'Fee schedule of ' || COALESCE(r.name, 'resident ' || f.resident_id) END,
+			date(f.effective_to || '-01', '+1 month', '-1 day')
+		FROM fee_schedule f LEFT JOIN residents r ON r.id = f.resident_id
+		WHERE f.effective_to != '' AND date(f.effective_to || '-01', '+1 month', '-1 day') BETWEEN ?1 AND ?2
+	`, start, end, ExpiryLease, ExpiryFeeSchedule)
+	if err != nil {
+		return nil, err
+	}
+	expiries := []Expiry{}
+	for rows.Next() {
+		var e Expiry
+		if err := rows.Scan(&e.Item, &e.Kind, &e.Name, &e.ExpiresOn); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		expiries = append(expiries, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	suppressed, err := expirySuppressions(q)
+	if err != nil {
+		return nil, err
+	}
+	today, _ := time.Parse("2006-01-02", start)
+	for i, e := range expiries {
+		expiresOn, _ := time.Parse("2006-01-02", e.ExpiresOn)
+		expiries[i].DaysLeft = int(expiresOn.Sub(today).Hours() / 24)
+		if reason, ok := suppressed[e.Item]; ok {
+			expiries[i].Suppressed, expiries[i].SuppressionReason = true, reason
+		}
+	}
+	sort.SliceStable(expiries, func(i, j int) bool {
+		if expiries[i].ExpiresOn != expiries[j].ExpiresOn {
+			return expiries[i].ExpiresOn < expiries[j].ExpiresOn
+		}
+		return expiries[i].Item < expiries[j].Item
+	})
+	return expiries, nil
+}
+
+// expirySuppressions returns the reason each suppressed item is let lapse
+func expirySuppressions(q querier) (map[string]string, error) {
+	rows, err := q.Query("SELECT item, reason FROM expiry_suppressions")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	suppressed := map[string]string{}
+	for rows.Next() {
+		var item, reason string
+		if err := rows.Scan(&item, &reason); err != nil {
+			return nil, err
+		}
+		suppressed[item] = reason
+	}
+	return suppressed, rows.Err()
+}
+
+// expiryItemExists reports whether the document, resident or fee schedule
+// of an item exists
+func expiryItemExists(q querier, item string) (bool, error) {
+	match := expiryItemPattern.FindStringSubmatch(item)
+	if match == nil {
+		return false, nil
+	}
+	table := map[string]string{"document": "documents", "lease": "residents", "fee_schedule": "fee_schedule"}[match[1]]
+	var exists bool
+	err := q.QueryRow("SELECT EXISTS(SELECT 1 FROM "+table+" WHERE id = ?)", match[2]).Scan(&exists)
+	return exists, err
+}
+
+// parseLeadDays parses the comma-separated days before an expiry its
+// reminders are sent, e.g. 30,7,1, into a list from the longest lead
+func parseLeadDays(s string) ([]int, error) {
+	var leads []int
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		days, err := strconv.Atoi(field)
+		if err != nil || days < 0 {
+			return nil, fmt.Errorf("invalid lead time %q, must be a number of days", field)
+		}
+		leads = append(leads, days)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(leads)))
+	return leads, nil
+}
+
+// sendExpiryReminders notifies of the expiries at each lead time, once per
+// item, lead time and expiry date, so an item renewed to a later date is
+// reminded of again. An item found inside several lead times at once, say
+// added five days before it runs out, is reminded of only at the shortest.
+func sendExpiryReminders(db *sql.DB, notifier *Notifier, leads []int, cal calendar) (int, error) {
+	if len(leads) == 0 || !notifier.Enabled(EventExpiryDue) {
+		return 0, nil
+	}
+	expiries, err := loadExpiries(db, leads[0], cal)
+	if err != nil {
+		return 0, err
+	}
+	sent := 0
+	for _, e := range expiries {
+		if e.Suppressed {
+			continue
+		}
+		lead := -1
+		for _, days := range leads {
+			if days >= e.DaysLeft {
+				lead = days
+			}
+		}
+		if lead < 0 {
+			continue
+		}
+		result, err := db.Exec("INSERT OR IGNORE INTO expiry_reminders(item, lead_days, expires_on) VALUES(?, ?, ?)", e.Item, lead, e.ExpiresOn)
+		if err != nil {
+			return sent, err
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			continue
+		}
+		when := fmt.Sprintf("in %d days", e.DaysLeft)
+		switch e.DaysLeft {
+		case 0:
+			when = "today"
+		case 1:
+			when = "tomorrow"
+		}
+		notifier.Notify(Event{
+			Type:    EventExpiryDue,
+			Title:   "Expiry " + when,
+			Message: fmt.Sprintf("%s (%s) expires on %s, %s.", e.Name, e.Kind, e.ExpiresOn, when),
+		})
+		sent++
+	}
+	return sent, nil
+}
+
+// scheduleExpiryReminders sends the expiry reminders now and then hourly in a
+// background goroutine. Without lead times no reminders are sent.
+func scheduleExpiryReminders(db *sql.DB, notifier *Notifier, leads []int, cal calendar) {
+	if len(leads) == 0 {
+		return
+	}
+	remind := func() {
+		if _, err := sendExpiryReminders(db, notifier, leads, cal); err != nil {
+			log.Printf("Failed to send expiry reminders: %v", err)
+		}
+	}
+	go func() {
+		remind()
+		ticker := time.NewTicker(time.Hour)
+		defer ticker.Stop()
+		for range ticker.C {
+			remind()
+		}
+	}()
+}
+
+// Handlers for expiry endpoints
+
+// Get what runs out in the next within_days (90 by default)
+func getExpiries(db *sql.DB, cal calendar) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := checkQueryParams(r, "within_days"); err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		within := defaultExpiryDays
+		if s := r.URL.Query().Get("within_days"); s != "" {
+			days, err := strconv.Atoi(s)
+			if err != nil || days < 0 {
+				respondWithError(w, http.StatusBadRequest, "within_days must be a number of days")
+				return
+			}
+			within = days
+		}
+
+		expiries, err := loadExpiries(db, within, cal)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		respondWithJSON(w, http.StatusOK, expiries)
+	}
+}
+
+// Let an item lapse without reminders
+func suppressExpiry(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		item := mux.Vars(r)["item"]
+
+		var suppression ExpirySuppression
+		if err := decodeRequest(r, &suppression); err != nil {
+			respondWithError(w, payloadErrorStatus(err), "Invalid request payload: "+err.Error())
+			return
+		}
+		defer r.Body.Close()
+
+		exists, err := expiryItemExists(db, item)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if !exists {
+			respondWithError(w, http.StatusNotFound, "Expiry item not found")
+			return
+		}
+
+		_, err = db.Exec(`
+			INSERT INTO expiry_suppressions(item, reason) VALUES(?, ?)
+			ON CONFLICT(item) DO UPDATE SET reason = excluded.reason, suppressed_at = CURRENT_TIMESTAMP
+		`, item, suppression.Reason)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		respondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
+	}
+}
+
+// Remind of an item again
+func unsuppressExpiry(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		result, err := db.Exec("DELETE FROM expiry_suppressions WHERE item = ?", mux.Vars(r)["item"])
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			respondWithError(w, http.StatusNotFound, "Expiry item not suppressed")
+			return
+		}
+		respondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
+	}
+}
+
+// Handlers for document endpoints
+func getDocuments(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rows, err := db.Query("SELECT " + documentColumns + " FROM documents ORDER BY expires_on, id")
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		defer rows.Close()
+
+		documents := []Document{}
+		for rows.Next() {
+			d, err := scanDocument(rows)
+			if err != nil {
+				respondWithError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			documents = append(documents, d)
+		}
+
+		respondWithJSON(w, http.StatusOK, documents)
+	}
+}
+
+func createDocument(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var d Document
+		if err := decodeRequest(r, &d); err != nil {
+			respondWithError(w, payloadErrorStatus(err), "Invalid request payload: "+err.Error())
+			return
+		}
+		defer r.Body.Close()
+
+		if err := validateDocument(d); err != nil {
+			respondWithValidationError(w, err)
+			return
+		}
+
+		result, err := db.Exec("INSERT INTO documents(kind, name, expires_on, notes) VALUES(?, ?, ?, ?)", d.Kind, d.Name, d.ExpiresOn, d.Notes)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		id, err := result.LastInsertId()
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		saved, err := scanDocument(db.QueryRow("SELECT "+documentColumns+" FROM documents WHERE id = ?", id))
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		respondWithJSON(w, http.StatusCreated, saved)
+	}
+}
+
+// Update a document, such as to the expiry date of a renewed contract
+func updateDocument(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id, err := strconv.Atoi(vars["id"])
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid document ID")
+			return
+		}
+
+		var d Document
+		if err := decodeRequest(r, &d); err != nil {
+			respondWithError(w, payloadErrorStatus(err), "Invalid request payload: "+err.Error())
+			return
+		}
+		defer r.Body.Close()
+
+		if err := validateDocument(d); err != nil {
+			respondWithValidationError(w, err)
+			return
+		}
+
+		result, err := db.Exec("UPDATE documents SET kind = ?, name = ?, expires_on = ?, notes = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?",
+			d.Kind, d.Name, d.ExpiresOn, d.Notes, id)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			respondWithError(w, http.StatusNotFound, "Document not found")
+			return
+		}
+
+		saved, err := scanDocument(db.QueryRow("SELECT "+documentColumns+" FROM documents WHERE id = ?", id))
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		respondWithJSON(w, http.StatusOK, saved)
+	}
+}
+
+func deleteDocument(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id, err := strconv.Atoi(vars["id"])
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid document ID")
+			return
+		}
+
+		result, err := db.Exec("DELETE FROM documents WHERE id = ?", id)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			respondWithError(w, http.StatusNotFound, "Document not found")
+			return
+		}
+		if _, err := db.Exec("DELETE FROM expiry_suppressions WHERE item = ?", fmt.Sprintf("document-%d", id)); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		respondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
+	}
+}
@@ -0,0 +1,411 @@
+package condomngr
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// FeeSchedule is the monthly fee of a unit, or of a single resident, over a
+// range of months. EffectiveTo is the last month it applies to; empty means
+// it applies until a later schedule replaces it.
+type FeeSchedule struct {
+	ID            int       `json:"id"`
+	Unit          string    `json:"unit"`
+	ResidentID    *int      `json:"resident_id"`
+	Amount        float64   `json:"amount"`
+	EffectiveFrom string    `json:"effective_from"` // YYYY-MM
+	EffectiveTo   string    `json:"effective_to"`   // YYYY-MM
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+// Sources of the fee of a month
+const (
+	FeeSourceResident = "resident" // the resident's own schedule
+	FeeSourceUnit     = "unit"     // the schedule of the resident's unit
+	FeeSourceDefault  = "default"  // the -monthly-fee setting
+)
+
+// FeeMonth is the fee that applies to a resident in a month. Charged is the
+// amount of the dues charge recorded for the month, if it was generated.
+type FeeMonth struct {
+	Month      string   `json:"month"`
+	Amount     float64  `json:"amount"`
+	Source     string   `json:"source"`
+	ScheduleID *int     `json:"schedule_id"`
+	Charged    *float64 `json:"charged"`
+}
+
+// feeScheduleConflict is returned when a schedule overlaps another one of the
+// same unit or resident
+type feeScheduleConflict string
+
+func (e feeScheduleConflict) Error() string { return string(e) }
+
+const feeScheduleColumns = "id, unit, resident_id, amount, effective_from, effective_to, created_at, updated_at"
+
+func scanFeeSchedule(row interface{ Scan(...interface{}) error }) (FeeSchedule, error) {
+	var f FeeSchedule
+	var residentID sql.NullInt64
+	err := row.Scan(&f.ID, &f.Unit, &residentID, &f.Amount, &f.EffectiveFrom, &f.EffectiveTo, &f.CreatedAt, &f.UpdatedAt)
+	if residentID.Valid {
+		id := int(residentID.Int64)
+		f.ResidentID = &id
+	}
+	return f, err
+}
+
+// Validation function for FeeSchedule data
+func validateFeeSchedule(db *sql.DB, f FeeSchedule) error {
+	var errs ValidationErrors
+	switch {
+	case f.Unit == "" && f.ResidentID == nil:
+		errs.Add("unit", "unit or resident_id is required")
+	case f.Unit != "" && f.ResidentID != nil:
+		errs.Add("unit", "set either unit or resident_id, not both")
+	case f.ResidentID != nil:
+		var exists bool
+		if err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM residents WHERE id = ?)", *f.ResidentID).Scan(&exists); err != nil {
+			return err
+		}
+		if !exists {
+			errs.Add("resident_id", "resident does not exist")
+		}
+	}
+	if f.Amount <= 0 {
+		errs.Add("amount", "amount must be greater than zero")
+	}
+	if _, err := time.Parse("2006-01", f.EffectiveFrom); err != nil {
+		errs.Add("effective_from", "effective_from must be a month, YYYY-MM")
+	}
+	if f.EffectiveTo != "" {
+		if _, err := time.Parse("2006-01", f.EffectiveTo); err != nil {
+			errs.Add("effective_to", "effective_to must be a month, YYYY-MM")
+		} else if f.EffectiveTo < f.EffectiveFrom {
+			errs.Add("effective_to", "effective_to must not be before effective_from")
+		}
+	}
+	return errs.Err()
+}
+
+// checkFeeOverlap fails with feeScheduleConflict when f overlaps another
+// schedule of the same unit or resident
+func checkFeeOverlap(tx *sql.Tx, f FeeSchedule) error {
+	to := f.EffectiveTo
+	if to == "" {
+		to = "9999-12"
+	}
+	var residentID interface{}
+	if f.ResidentID != nil {
+		residentID = *f.ResidentID
+	}
+	var other int
+	err := tx.QueryRow(`
+		SELECT id FROM fee_schedule
+		WHERE id != ?1 AND unit = ?2 AND resident_id IS ?3
+			AND effective_from <= ?4 AND (effective_to = '' OR effective_to >= ?5)
+		ORDER BY effective_from LIMIT 1
+	`, f.ID, f.Unit, residentID, to, f.EffectiveFrom).Scan(&other)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return feeScheduleConflict(fmt.Sprintf("Overlaps fee schedule %d", other))
+}
+
+// saveFeeSchedule inserts f, or updates it when it has an ID, unless it
+// overlaps another schedule. It returns sql.ErrNoRows when updating a
+// schedule that doesn't exist.
+func saveFeeSchedule(db *sql.DB, f *FeeSchedule) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := checkFeeOverlap(tx, *f); err != nil {
+		return err
+	}
+	var residentID interface{}
+	if f.ResidentID != nil {
+		residentID = *f.ResidentID
+	}
+	if f.ID == 0 {
+		result, err := tx.Exec("INSERT INTO fee_schedule(unit, resident_id, amount, effective_from, effective_to) VALUES(?, ?, ?, ?, ?)",
+			f.Unit, residentID, f.Amount, f.EffectiveFrom, f.EffectiveTo)
+		if err != nil {
+			return err
+		}
+		id, err := result.LastInsertId()
+		if err != nil {
+			return err
+		}
+		f.ID = int(id)
+	} else {
+		result, err := tx.Exec("UPDATE fee_schedule SET unit = ?, resident_id = ?, amount = ?, effective_from = ?, effective_to = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?",
+			f.Unit, residentID, f.Amount, f.EffectiveFrom, f.EffectiveTo, f.ID)
+		if err != nil {
+			return err
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			return sql.ErrNoRows
+		}
+	}
+
+	saved, err := scanFeeSchedule(tx.QueryRow("SELECT "+feeScheduleColumns+" FROM fee_schedule WHERE id = ?", f.ID))
+	if err != nil {
+		return err
+	}
+	*f = saved
+	return tx.Commit()
+}
+
+// residentFee finds the fee of a resident for month (YYYY-MM): their own
+// schedule, else their unit's, else defaultFee. The amount is zero when none
+// applies.
+func residentFee(db querier, residentID int, month string, defaultFee float64) (FeeMonth, error) {
+	fee := FeeMonth{Month: month}
+	var scheduleID int
+	var own bool
+	err := db.QueryRow(`
+		SELECT f.id, f.amount, f.resident_id IS NOT NULL FROM fee_schedule f
+		WHERE (f.resident_id = ?1 OR (f.resident_id IS NULL AND f.unit = (SELECT unit FROM residents WHERE id = ?1)))
+			AND f.effective_from <= ?2 AND (f.effective_to = '' OR f.effective_to >= ?2)
+		ORDER BY f.resident_id IS NULL LIMIT 1
+	`, residentID, month).Scan(&scheduleID, &fee.Amount, &own)
+	switch {
+	case err == sql.ErrNoRows:
+		if defaultFee > 0 {
+			fee.Amount, fee.Source = defaultFee, FeeSourceDefault
+		}
+		return fee, nil
+	case err != nil:
+		return fee, err
+	}
+	fee.ScheduleID = &scheduleID
+	fee.Source = FeeSourceUnit
+	if own {
+		fee.Source = FeeSourceResident
+	}
+	return fee, nil
+}
+
+// Handlers for fee schedule endpoints
+func getFeeSchedules(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := checkQueryParams(r, "unit", "resident_id"); err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		var filter queryFilter
+		filter.addString(r, "unit", "unit = ?")
+		if err := filter.addInt(r, "resident_id", "resident_id = ?"); err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		rows, err := db.Query("SELECT "+feeScheduleColumns+" FROM fee_schedule"+filter.where()+" ORDER BY unit, resident_id, effective_from", filter.args...)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		defer rows.Close()
+
+		schedules := []FeeSchedule{}
+		for rows.Next() {
+			f, err := scanFeeSchedule(rows)
+			if err != nil {
+				respondWithError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			schedules = append(schedules, f)
+		}
+
+		respondWithJSON(w, http.StatusOK, schedules)
+	}
+}
+
+func getFeeSchedule(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id, err := strconv.Atoi(vars["id"])
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid fee schedule ID")
+			return
+		}
+
+		f, err := scanFeeSchedule(db.QueryRow("SELECT "+feeScheduleColumns+" FROM fee_schedule WHERE id = ?", id))
+		if err != nil {
+			if err == sql.ErrNoRows {
+				respondWithError(w, http.StatusNotFound, "Fee schedule not found")
+				return
+			}
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		respondWithJSON(w, http.StatusOK, f)
+	}
+}
+
+// respondWithSavedFeeSchedule saves f and responds with it, or with why it
+// couldn't be saved
+func respondWithSavedFeeSchedule(w http.ResponseWriter, db *sql.DB, f FeeSchedule, status int) {
+	if err := validateFeeSchedule(db, f); err != nil {
+		respondWithValidationError(w, err)
+		return
+	}
+	err := saveFeeSchedule(db, &f)
+	if conflict, ok := err.(feeScheduleConflict); ok {
+		respondWithError(w, http.StatusConflict, conflict.Error())
+		return
+	}
+	if err == sql.ErrNoRows {
+		respondWithError(w, http.StatusNotFound, "Fee schedule not found")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	respondWithJSON(w, status, f)
+}
+
+func createFeeSchedule(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var f FeeSchedule
+		if err := decodeRequest(r, &f); err != nil {
+			respondWithError(w, payloadErrorStatus(err), "Invalid request payload: "+err.Error())
+			return
+		}
+		defer r.Body.Close()
+
+		f.ID = 0
+		respondWithSavedFeeSchedule(w, db, f, http.StatusCreated)
+	}
+}
+
+func updateFeeSchedule(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id, err := strconv.Atoi(vars["id"])
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid fee schedule ID")
+			return
+		}
+
+		var f FeeSchedule
+		if err := decodeRequest(r, &f); err != nil {
+			respondWithError(w, payloadErrorStatus(err), "Invalid request payload: "+err.Error())
+			return
+		}
+		defer r.Body.Close()
+
+		f.ID = id
+		respondWithSavedFeeSchedule(w, db, f, http.StatusOK)
+	}
+}
+
+func deleteFeeSchedule(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id, err := strconv.Atoi(vars["id"])
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid fee schedule ID")
+			return
+		}
+
+		result, err := db.Exec("DELETE FROM fee_schedule WHERE id = ?", id)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			respondWithError(w, http.StatusNotFound, "Fee schedule not found")
+			return
+		}
+
+		respondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
+	}
+}
+
+// maxFeeHistoryMonths bounds the range of a fee history
+const maxFeeHistoryMonths = 240
+
+// Get the fee that applied to a resident in each month of a range, and what
+// was charged for it
+func getResidentFees(db *sql.DB, monthlyFee float64, cal calendar) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := checkQueryParams(r, "start_month", "end_month"); err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		vars := mux.Vars(r)
+		id, err := strconv.Atoi(vars["id"])
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid resident ID")
+			return
+		}
+
+		now := cal.now()
+		start, _ := cal.fiscalYearRange(cal.fiscalYearOf(now))
+		end := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+		for _, param := range []struct {
+			name  string
+			month *time.Time
+		}{{"start_month", &start}, {"end_month", &end}} {
+			if value := r.URL.Query().Get(param.name); value != "" {
+				if *param.month, err = time.Parse("2006-01", value); err != nil {
+					respondWithError(w, http.StatusBadRequest, fmt.Sprintf("invalid %s format, must be YYYY-MM", param.name))
+					return
+				}
+			}
+		}
+		if end.Before(start) {
+			respondWithError(w, http.StatusBadRequest, "end_month must not be before start_month")
+			return
+		}
+		if !end.Before(start.AddDate(0, maxFeeHistoryMonths, 0)) {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("The range can't span more than %d months", maxFeeHistoryMonths))
+			return
+		}
+
+		var exists bool
+		if err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM residents WHERE id = ?)", id).Scan(&exists); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if !exists {
+			respondWithError(w, http.StatusNotFound, "Resident not found")
+			return
+		}
+
+		months := []FeeMonth{}
+		for month := start; !month.After(end); month = month.AddDate(0, 1, 0) {
+			fee, err := residentFee(db, id, month.Format("2006-01"), monthlyFee)
+			if err != nil {
+				respondWithError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			var charged float64
+			err = db.QueryRow("SELECT amount FROM charges WHERE resident_id = ? AND kind = ? AND period = ?", id, ChargeKindDues, fee.Month).Scan(&charged)
+			switch {
+			case err == nil:
+				fee.Charged = &charged
+			case err != sql.ErrNoRows:
+				respondWithError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			months = append(months, fee)
+		}
+
+		respondWithJSON(w, http.StatusOK, months)
+	}
+}
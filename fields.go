@@ -0,0 +1,119 @@
+package condomngr
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// fieldSet maps the JSON fields a list endpoint can return with ?fields= to the
+// SQL expression that selects them
+type fieldSet map[string]string
+
+var residentFields = fieldSet{
+	"id":             "id",
+	"name":           "name",
+	"unit":           "unit",
+	"contact":        "contact",
+	"email":          "email",
+	"notify_channel": "notify_channel",
+	"move_in_date":   "move_in_date",
+	"move_out_date":  "move_out_date",
+	"created_at":     "created_at",
+	"updated_at":     "updated_at",
+	"anonymized_at":  "anonymized_at",
+}
+
+var paymentFields = fieldSet{
+	"id":                 "p.id",
+	"resident_id":        "p.resident_id",
+	"residentName":       "r.name",
+	"amount":             "p.amount",
+	"description":        "p.description",
+	"payment_date":       "p.payment_date",
+	"method":             "p.method",
+	"status":             "p.status",
+	"reference":          "p.reference",
+	"bank_reference":     "p.bank_reference",
+	"cheque_number":      "p.cheque_number",
+	"cheque_bank":        "p.cheque_bank",
+	"cheque_status":      "p.cheque_status",
+	"cheque_status_date": "p.cheque_status_date",
+	"created_at":         "p.created_at",
+	"updated_at":         "p.updated_at",
+}
+
+var expenseFields = fieldSet{
+	"id":              "id",
+	"amount":          "amount",
+	"description":     "description",
+	"expense_date":    "expense_date",
+	"category":        "category",
+	"created_at":      "created_at",
+	"updated_at":      "updated_at",
+	"currency":        "currency",
+	"original_amount": "original_amount",
+	"exchange_rate":   "exchange_rate",
+	"bank_reference":  "bank_reference",
+	"tax_rate":        "tax_rate",
+	"tax_amount":      "tax_amount",
+	"vendor":          "vendor",
+}
+
+// parse validates a comma-separated fields parameter and returns the field
+// names without duplicates
+func (fs fieldSet) parse(param string) ([]string, error) {
+	var names []string
+	seen := map[string]bool{}
+	for _, name := range strings.Split(param, ",") {
+		name = strings.TrimSpace(name)
+		if _, ok := fs[name]; !ok {
+			return nil, fmt.Errorf("invalid field %q, allowed fields: %s", name, strings.Join(fs.names(), ", "))
+		}
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+func (fs fieldSet) names() []string {
+	names := make([]string, 0, len(fs))
+	for name := range fs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// columns returns the SELECT column list for the given fields
+func (fs fieldSet) columns(names []string) string {
+	columns := make([]string, len(names))
+	for i, name := range names {
+		columns[i] = fs[name]
+	}
+	return strings.Join(columns, ", ")
+}
+
+// scanSparse scans rows selecting the given fields into objects holding just
+// those fields
+func scanSparse(names []string) rowScanner {
+	return func(rows *sql.Rows) (interface{}, error) {
+		values := make([]interface{}, len(names))
+		pointers := make([]interface{}, len(names))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+		if err := rows.Scan(pointers...); err != nil {
+			return nil, err
+		}
+
+		item := make(map[string]interface{}, len(names))
+		for i, name := range names {
+			item[name] = values[i]
+		}
+		return item, nil
+	}
+}
@@ -0,0 +1,218 @@
+package condomngr
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// checkQueryParams rejects query parameters a list endpoint doesn't support, so
+// a misspelled filter fails loudly instead of silently returning everything.
+// lang, the language of messages, is allowed everywhere.
+func checkQueryParams(r *http.Request, allowed ...string) error {
+	var unknown []string
+	for name := range r.URL.Query() {
+		known := name == "lang"
+		for _, a := range allowed {
+			if name == a {
+				known = true
+				break
+			}
+		}
+		if !known {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("unknown query parameter: %s", strings.Join(unknown, ", "))
+	}
+	return nil
+}
+
+// likeEscaper escapes LIKE wildcards so search text matches literally. Queries
+// using its output must add ESCAPE '\' after each LIKE.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// searchPattern turns the q parameter into a LIKE pattern according to the
+// match parameter: contains (the default), prefix or exact
+func searchPattern(r *http.Request) (string, error) {
+	query := likeEscaper.Replace(r.URL.Query().Get("q"))
+	switch r.URL.Query().Get("match") {
+	case "", "contains":
+		return "%" + query + "%", nil
+	case "prefix":
+		return query + "%", nil
+	case "exact":
+		return query, nil
+	}
+	return "", fmt.Errorf("invalid match, must be prefix, contains or exact")
+}
+
+// queryValues returns the values of a repeatable query parameter, also split
+// on commas, so category=a&category=b and category=a,b are the same
+func queryValues(r *http.Request, name string) []string {
+	var values []string
+	for _, param := range r.URL.Query()[name] {
+		for _, value := range strings.Split(param, ",") {
+			if value = strings.TrimSpace(value); value != "" {
+				values = append(values, value)
+			}
+		}
+	}
+	return values
+}
+
+// categoryCondition builds the condition for the category parameter (any of
+// the categories) or exclude_category (none of them). Using both is an error.
+// The condition is empty when neither is set.
+func categoryCondition(r *http.Request) (string, []interface{}, error) {
+	include, exclude := queryValues(r, "category"), queryValues(r, "exclude_category")
+	if len(include) > 0 && len(exclude) > 0 {
+		return "", nil, fmt.Errorf("use either category or exclude_category, not both")
+	}
+	operator, categories := "IN", include
+	if len(exclude) > 0 {
+		operator, categories = "NOT IN", exclude
+	}
+	if len(categories) == 0 {
+		return "", nil, nil
+	}
+
+	args := make([]interface{}, len(categories))
+	for i, category := range categories {
+		args[i] = category
+	}
+	placeholders := strings.Repeat("?, ", len(categories)-1) + "?"
+	return "category " + operator + " (" + placeholders + ")", args, nil
+}
+
+// queryFilter collects the WHERE conditions of a list query
+type queryFilter struct {
+	conditions []string
+	args       []interface{}
+}
+
+func (f *queryFilter) add(condition string, arg interface{}) {
+	f.conditions = append(f.conditions, condition)
+	f.args = append(f.args, arg)
+}
+
+// addInt adds condition when the named query parameter is set, requiring it to
+// be an integer
+func (f *queryFilter) addInt(r *http.Request, name, condition string) error {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return fmt.Errorf("invalid %s, must be a number", name)
+	}
+	f.add(condition, n)
+	return nil
+}
+
+// addDate adds condition when the named query parameter is set, requiring it
+// to be a YYYY-MM-DD date
+func (f *queryFilter) addDate(r *http.Request, name, condition string) error {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return nil
+	}
+	if _, err := time.Parse("2006-01-02", value); err != nil {
+		return fmt.Errorf("invalid %s format, must be YYYY-MM-DD", name)
+	}
+	f.add(condition, value)
+	return nil
+}
+
+// addTimestamp adds condition when the named query parameter is set, requiring
+// it to be an RFC 3339 timestamp. The argument is converted to the UTC
+// "YYYY-MM-DD HH:MM:SS" form SQLite's CURRENT_TIMESTAMP stores, so the
+// comparison works on the stored text.
+func (f *queryFilter) addTimestamp(r *http.Request, name, condition string) error {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return fmt.Errorf("invalid %s format, must be an RFC 3339 timestamp", name)
+	}
+	f.add(condition, t.UTC().Format("2006-01-02 15:04:05"))
+	return nil
+}
+
+// addString adds condition when the named query parameter is set
+func (f *queryFilter) addString(r *http.Request, name, condition string) {
+	if value := r.URL.Query().Get(name); value != "" {
+		f.add(condition, value)
+	}
+}
+
+// where returns the WHERE clause, or an empty string without conditions
+func (f *queryFilter) where() string {
+	if len(f.conditions) == 0 {
+		return ""
+	}
+	return " WHERE " + strings.Join(f.conditions, " AND ")
+}
+
+// incidentFilter builds the incidents list filter from the query parameters
+func incidentFilter(r *http.Request) (queryFilter, error) {
+	var filter queryFilter
+	filter.addString(r, "status", "status = ?")
+	filter.addString(r, "severity", "severity = ?")
+	for _, err := range []error{
+		filter.addDate(r, "start_date", "incident_date >= ?"),
+		filter.addDate(r, "end_date", "incident_date <= ?"),
+	} {
+		if err != nil {
+			return filter, err
+		}
+	}
+	return filter, nil
+}
+
+// residentFilter builds the residents list filter from the query parameters
+func residentFilter(r *http.Request) queryFilter {
+	var filter queryFilter
+	filter.addString(r, "unit", "unit = ?")
+	return filter
+}
+
+// paymentFilter builds the payments list filter from the query parameters
+func paymentFilter(r *http.Request) (queryFilter, error) {
+	var filter queryFilter
+	for _, err := range []error{
+		filter.addInt(r, "resident_id", "p.resident_id = ?"),
+		filter.addDate(r, "start_date", "p.payment_date >= ?"),
+		filter.addDate(r, "end_date", "p.payment_date <= ?"),
+		filter.addTimestamp(r, "updated_since", "p.updated_at >= ?"),
+	} {
+		if err != nil {
+			return filter, err
+		}
+	}
+	return filter, nil
+}
+
+// expenseFilter builds the expenses list filter from the query parameters
+func expenseFilter(r *http.Request) (queryFilter, error) {
+	var filter queryFilter
+	filter.addString(r, "category", "category = ?")
+	for _, err := range []error{
+		filter.addDate(r, "start_date", "expense_date >= ?"),
+		filter.addDate(r, "end_date", "expense_date <= ?"),
+		filter.addTimestamp(r, "updated_since", "updated_at >= ?"),
+	} {
+		if err != nil {
+			return filter, err
+		}
+	}
+	return filter, nil
+}
@@ -0,0 +1,138 @@
+package condomngr
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestListFilters(t *testing.T) {
+	s := newTestServer(t, Options{})
+	ana := s.createResident("Ana Silva", "1A")
+	rui := s.createResident("Rui Costa", "2B")
+	for _, p := range []struct {
+		residentID int
+		date       string
+	}{{ana.ID, "2024-01-15"}, {ana.ID, "2024-02-15"}, {ana.ID, "2024-03-15"}, {rui.ID, "2024-02-20"}} {
+		s.expect(http.StatusCreated, "POST", "/api/v1/payments", map[string]interface{}{
+			"resident_id": p.residentID, "amount": 50, "description": "Dues", "payment_date": p.date,
+		}, nil)
+	}
+	for _, e := range []struct{ category, date string }{
+		{"Maintenance", "2024-01-10"}, {"Maintenance", "2024-02-10"}, {"Cleaning", "2024-02-12"}, {"Cleaning", "2024-03-01"},
+	} {
+		s.expect(http.StatusCreated, "POST", "/api/v1/expenses", map[string]interface{}{
+			"amount": 10, "description": "Work", "expense_date": e.date, "category": e.category,
+		}, nil)
+	}
+
+	for _, tt := range []struct {
+		path string
+		want int
+	}{
+		{"/api/v1/payments", 4},
+		{"/api/v1/payments?resident_id=" + strconv.Itoa(ana.ID), 3},
+		{"/api/v1/payments?start_date=2024-02-01", 3},
+		{"/api/v1/payments?end_date=2024-02-15", 2},
+		{"/api/v1/payments?start_date=2024-02-01&end_date=2024-02-29", 2},
+		{"/api/v1/payments?resident_id=" + strconv.Itoa(ana.ID) + "&start_date=2024-02-01", 2},
+		{"/api/v1/payments?resident_id=" + strconv.Itoa(ana.ID) + "&start_date=2024-02-01&end_date=2024-02-29", 1},
+		{"/api/v1/payments?resident_id=" + strconv.Itoa(rui.ID) + "&end_date=2024-01-31", 0},
+		{"/api/v1/expenses", 4},
+		{"/api/v1/expenses?category=Cleaning", 2},
+		{"/api/v1/expenses?start_date=2024-02-01&end_date=2024-02-29", 2},
+		{"/api/v1/expenses?category=Maintenance&start_date=2024-02-01", 1},
+		{"/api/v1/expenses?category=Cleaning&start_date=2024-02-01&end_date=2024-02-29", 1},
+		{"/api/v1/expenses?category=Plumbing", 0},
+		{"/api/v1/residents", 2},
+		{"/api/v1/residents?unit=2B", 1},
+		{"/api/v1/residents?unit=9Z", 0},
+	} {
+		var list []map[string]interface{}
+		resp := s.expect(http.StatusOK, "GET", tt.path, nil, &list)
+		if len(list) != tt.want {
+			t.Errorf("%s: %d rows, want %d", tt.path, len(list), tt.want)
+		}
+		if total := resp.Header.Get("X-Total-Count"); total != strconv.Itoa(tt.want) {
+			t.Errorf("%s: X-Total-Count %s, want %d", tt.path, total, tt.want)
+		}
+	}
+}
+
+func TestListFiltersRejectUnknownParameters(t *testing.T) {
+	s := newTestServer(t, Options{})
+	for _, tt := range []struct{ path, unknown string }{
+		{"/api/v1/payments?resident=1", "resident"},
+		{"/api/v1/payments?resident_id=1&from=2024-01-01", "from"},
+		{"/api/v1/expenses?categroy=Cleaning", "categroy"},
+		{"/api/v1/expenses?category=Cleaning&resident_id=1", "resident_id"},
+		{"/api/v1/residents?archived=true", "archived"},
+		{"/api/v1/residents?name=Ana&unit=1A", "name"},
+		{"/api/payments?resident=1", "resident"},
+	} {
+		var e apiError
+		s.expect(http.StatusBadRequest, "GET", tt.path, nil, &e)
+		if !strings.Contains(e.Error, tt.unknown) {
+			t.Errorf("%s: error %q doesn't name %s", tt.path, e.Error, tt.unknown)
+		}
+	}
+
+	for _, path := range []string{
+		"/api/v1/payments?resident_id=seven",
+		"/api/v1/payments?start_date=2024-13-01",
+		"/api/v1/expenses?end_date=yesterday",
+	} {
+		s.expect(http.StatusBadRequest, "GET", path, nil, nil)
+	}
+}
+
+func TestSearchMatchesWildcardsLiterally(t *testing.T) {
+	s := newTestServer(t, Options{})
+	for _, r := range []struct{ name, unit string }{
+		{"100% Club", "1A"}, {"100 Club", "1B"}, {"Owner of unit_1", "2A"}, {"Owner of unitX1", "2B"}, {`Back\slash`, "3A"},
+	} {
+		resident := s.createResident(r.name, r.unit)
+		s.expect(http.StatusCreated, "POST", "/api/v1/payments", map[string]interface{}{
+			"resident_id": resident.ID, "amount": 10, "description": "Paid " + r.name, "payment_date": "2024-03-05",
+		}, nil)
+	}
+	for _, description := range []string{"50% deposit", "500 deposit", "tile_floor", "tileXfloor"} {
+		s.expect(http.StatusCreated, "POST", "/api/v1/expenses", map[string]interface{}{
+			"amount": 10, "description": description, "expense_date": "2024-03-05", "category": "Maintenance",
+		}, nil)
+	}
+
+	for _, tt := range []struct {
+		path  string
+		field string
+		want  []string
+	}{
+		{"/api/v1/search/residents?q=" + url.QueryEscape("100%"), "name", []string{"100% Club"}},
+		{"/api/v1/search/residents?q=" + url.QueryEscape("%"), "name", []string{"100% Club"}},
+		{"/api/v1/search/residents?q=unit_1", "name", []string{"Owner of unit_1"}},
+		{"/api/v1/search/residents?q=_", "name", []string{"Owner of unit_1"}},
+		{"/api/v1/search/residents?q=" + url.QueryEscape(`\`), "name", []string{`Back\slash`}},
+		{"/api/v1/search/residents?match=prefix&q=" + url.QueryEscape("100%"), "name", []string{"100% Club"}},
+		{"/api/v1/search/residents?match=exact&q=" + url.QueryEscape("100%"), "name", []string{}},
+		{"/api/v1/search/residents?match=exact&q=" + url.QueryEscape("100% Club"), "name", []string{"100% Club"}},
+		{"/api/v1/search/payments?q=" + url.QueryEscape("0%"), "description", []string{"Paid 100% Club"}},
+		{"/api/v1/search/payments?q=t_1", "description", []string{"Paid Owner of unit_1"}},
+		{"/api/v1/search/expenses?q=" + url.QueryEscape("50%"), "description", []string{"50% deposit"}},
+		{"/api/v1/search/expenses?q=e_f", "description", []string{"tile_floor"}},
+		{"/api/v1/search/expenses?match=prefix&q=tile_", "description", []string{"tile_floor"}},
+	} {
+		var list []map[string]interface{}
+		s.expect(http.StatusOK, "GET", tt.path, nil, &list)
+		got := []string{}
+		for _, row := range list {
+			got = append(got, row[tt.field].(string))
+		}
+		if strings.Join(got, "|") != strings.Join(tt.want, "|") {
+			t.Errorf("%s: %q, want %q", tt.path, got, tt.want)
+		}
+	}
+
+	s.expect(http.StatusBadRequest, "GET", "/api/v1/search/residents?q=a&match=suffix", nil, nil)
+}
@@ -0,0 +1,62 @@
+package condomngr
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// A fiscal year is named after the calendar year it starts in: with a July
+// start, fiscal year 2024 runs from 2024-07-01 to 2025-06-30.
+
+// fiscalYearRange returns the first day of a fiscal year and the first day of
+// the next one
+func (c calendar) fiscalYearRange(year int) (start, end time.Time) {
+	start = time.Date(year, time.Month(c.fiscalYearStart), 1, 0, 0, 0, 0, time.UTC)
+	return start, start.AddDate(1, 0, 0)
+}
+
+// fiscalYearDates returns the first and last day of a fiscal year as
+// YYYY-MM-DD
+func (c calendar) fiscalYearDates(year int) (first, last string) {
+	start, end := c.fiscalYearRange(year)
+	return start.Format("2006-01-02"), end.AddDate(0, 0, -1).Format("2006-01-02")
+}
+
+// fiscalYearOf returns the fiscal year a date falls in
+func (c calendar) fiscalYearOf(t time.Time) int {
+	if int(t.Month()) < c.fiscalYearStart {
+		return t.Year() - 1
+	}
+	return t.Year()
+}
+
+// fiscalMonthIndex returns how many months into its fiscal year a date is,
+// 0 for the first month
+func (c calendar) fiscalMonthIndex(t time.Time) int {
+	return (int(t.Month()) - c.fiscalYearStart + 12) % 12
+}
+
+// fiscalYearLabel names a fiscal year for people: "2024" for calendar years,
+// "2024/25" when it spans two
+func (c calendar) fiscalYearLabel(year int) string {
+	if c.fiscalYearStart == 1 {
+		return strconv.Itoa(year)
+	}
+	return fmt.Sprintf("%d/%02d", year, (year+1)%100)
+}
+
+// statementYear reads the year parameter, a fiscal year, the current one by
+// default
+func statementYear(r *http.Request, cal calendar) (int, error) {
+	value := r.URL.Query().Get("year")
+	if value == "" {
+		return cal.fiscalYearOf(cal.now()), nil
+	}
+	year, err := strconv.Atoi(value)
+	if err != nil || year < 1900 || year > 9999 {
+		return 0, fmt.Errorf("invalid year, must be YYYY")
+	}
+	return year, nil
+}
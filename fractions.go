@@ -0,0 +1,558 @@
+package condomngr
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// UnitFraction is a unit's share of the building in permilage (‰), as set in
+// the title deed. Costs split by fraction are shared in proportion to it.
+type UnitFraction struct {
+	Unit      string    `json:"unit"`
+	Permilage float64   `json:"permilage"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Validation function for UnitFraction data
+func validateUnitFraction(f UnitFraction) error {
+	var errs ValidationErrors
+	if f.Permilage <= 0 || f.Permilage > 1000 {
+		errs.Add("permilage", "permilage must be greater than zero and at most 1000")
+	}
+	return errs.Err()
+}
+
+// loadUnitFractions returns the permilage of every unit that has one
+func loadUnitFractions(q querier) (map[string]float64, error) {
+	rows, err := q.Query("SELECT unit, permilage FROM unit_fractions")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	fractions := map[string]float64{}
+	for rows.Next() {
+		var unit string
+		var permilage float64
+		if err := rows.Scan(&unit, &permilage); err != nil {
+			return nil, err
+		}
+		fractions[unit] = permilage
+	}
+	return fractions, rows.Err()
+}
+
+// splitAmount divides amount in proportion to weights, in cents, so that the
+// parts add up to exactly amount. Each part is rounded down, and the cents
+// left over go one each to the parts with the largest remainders, the
+// earliest first on ties. Without any weight every part is zero.
+func splitAmount(amount float64, weights []float64) []float64 {
+	parts := make([]float64, len(weights))
+	var sum float64
+	for _, weight := range weights {
+		sum += weight
+	}
+	if sum <= 0 {
+		return parts
+	}
+
+	cents := int64(math.Round(amount * 100))
+	whole := make([]int64, len(weights))
+	remainders := make([]float64, len(weights))
+	left := cents
+	for i, weight := range weights {
+		exact := float64(cents) * weight / sum
+		whole[i] = int64(math.Floor(exact))
+		remainders[i] = exact - float64(whole[i])
+		left -= whole[i]
+	}
+	order := make([]int, len(weights))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool { return remainders[order[a]] > remainders[order[b]] })
+	for i := 0; left > 0; i = (i + 1) % len(order) {
+		whole[order[i]]++
+		left--
+	}
+	for i := range parts {
+		parts[i] = float64(whole[i]) / 100
+	}
+	return parts
+}
+
+// permilageTotal is what the ownership fractions of all units add up to
+const permilageTotal = 1000
+
+// FractionCheck tells whether the ownership fractions add up to 1000‰
+type FractionCheck struct {
+	Total        float64  `json:"total"`
+	Valid        bool     `json:"valid"`
+	MissingUnits []string `json:"missing_units"` // units with a resident but no fraction
+}
+
+// ExpenseShare is the part of an expense charged to a unit
+type ExpenseShare struct {
+	Unit      string  `json:"unit"`
+	Permilage float64 `json:"permilage"`
+	Amount    float64 `json:"amount"`
+}
+
+// ExpenseAllocation splits an expense between the units by their ownership
+// fractions. The shares are charged with the dues of ChargeMonth.
+type ExpenseAllocation struct {
+	ExpenseID   int            `json:"expense_id"`
+	Amount      float64        `json:"amount"`
+	ChargeMonth string         `json:"charge_month"` // YYYY-MM
+	AllocatedAt time.Time      `json:"allocated_at"`
+	Shares      []ExpenseShare `json:"shares"`
+}
+
+// UnitAllocation is what was allocated to a unit for a month
+type UnitAllocation struct {
+	Unit     string  `json:"unit"`
+	Month    string  `json:"month"` // the charge month, YYYY-MM
+	Expenses int     `json:"expenses"`
+	Amount   float64 `json:"amount"`
+}
+
+// AllocationReport totals the expenses allocated to each unit per month over
+// a fiscal year
+type AllocationReport struct {
+	Year   int              `json:"year"`
+	Units  []UnitAllocation `json:"units"`
+	Amount float64          `json:"amount"`
+}
+
+// checkFractions adds up the ownership fractions and finds the units with a
+// resident that have none
+func checkFractions(q querier) (FractionCheck, error) {
+	check := FractionCheck{MissingUnits: []string{}}
+	if err := q.QueryRow("SELECT COALESCE(SUM(permilage), 0) FROM unit_fractions").Scan(&check.Total); err != nil {
+		return check, err
+	}
+	check.Total = math.Round(check.Total*1000) / 1000
+	rows, err := q.Query(`
+		SELECT DISTINCT unit FROM residents
+		WHERE unit != '' AND move_out_date = '' AND unit NOT IN (SELECT unit FROM unit_fractions)
+		ORDER BY unit
+	`)
+	if err != nil {
+		return check, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var unit string
+		if err := rows.Scan(&unit); err != nil {
+			return check, err
+		}
+		check.MissingUnits = append(check.MissingUnits, unit)
+	}
+	check.Valid = check.Total == permilageTotal && len(check.MissingUnits) == 0
+	return check, rows.Err()
+}
+
+// expenseSharesCharged reports whether the shared expenses of month were
+// charged already
+func expenseSharesCharged(q querier, month string) (bool, error) {
+	var charged bool
+	err := q.QueryRow("SELECT EXISTS(SELECT 1 FROM charges WHERE kind = ? AND period = ?)", ChargeKindExpenses, month).Scan(&charged)
+	return charged, err
+}
+
+// loadExpenseAllocation returns the allocation of an expense, or
+// sql.ErrNoRows when it isn't allocated
+func loadExpenseAllocation(q querier, expenseID int) (ExpenseAllocation, error) {
+	allocation := ExpenseAllocation{ExpenseID: expenseID, Shares: []ExpenseShare{}}
+	rows, err := q.Query("SELECT unit, permilage, amount, charge_month, allocated_at FROM expense_allocations WHERE expense_id = ? ORDER BY unit", expenseID)
+	if err != nil {
+		return allocation, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var share ExpenseShare
+		if err := rows.Scan(&share.Unit, &share.Permilage, &share.Amount, &allocation.ChargeMonth, &allocation.AllocatedAt); err != nil {
+			return allocation, err
+		}
+		allocation.Shares = append(allocation.Shares, share)
+		allocation.Amount = roundCents(allocation.Amount + share.Amount)
+	}
+	if err := rows.Err(); err != nil {
+		return allocation, err
+	}
+	if len(allocation.Shares) == 0 {
+		return allocation, sql.ErrNoRows
+	}
+	return allocation, nil
+}
+
+// chargeExpenseShares charges the residents of each unit its share of the
+// expenses allocated to month, once. Units without a resident on the first
+// day of the month are returned as unbilled.
+func chargeExpenseShares(db querier, month string, first time.Time, rules paymentRules) (created int64, unbilled []string, err error) {
+	unbilled = []string{}
+	rows, err := db.Query(`
+		SELECT a.unit, SUM(a.amount) FROM expense_allocations a
+		JOIN expenses e ON e.id = a.expense_id
+		WHERE a.charge_month = ?
+		GROUP BY a.unit ORDER BY a.unit
+	`, month)
+	if err != nil {
+		return 0, nil, err
+	}
+	amounts := map[string]float64{}
+	var units []string
+	for rows.Next() {
+		var unit string
+		var amount float64
+		if err := rows.Scan(&unit, &amount); err != nil {
+			rows.Close()
+			return 0, nil, err
+		}
+		units = append(units, unit)
+		amounts[unit] = roundCents(amount)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, nil, err
+	}
+	if len(units) == 0 {
+		return 0, unbilled, nil
+	}
+
+	residents, err := assessmentResidents(db, first.Format("2006-01-02"))
+	if err != nil {
+		return 0, nil, err
+	}
+	for _, unit := range units {
+		residentID, ok := residents[unit]
+		if !ok {
+			unbilled = append(unbilled, unit)
+			continue
+		}
+		if amounts[unit] == 0 {
+			continue
+		}
+		result, err := db.Exec(`
+			INSERT OR IGNORE INTO charges(resident_id, kind, period, description, amount, due_date)
+			VALUES(?, ?, ?, ?, ?, ?)
+		`, residentID, ChargeKindExpenses, month, fmt.Sprintf("Shared expenses %s", month), amounts[unit], first.Format("2006-01-02"))
+		if err != nil {
+			return created, unbilled, err
+		}
+		if n, _ := result.RowsAffected(); n > 0 {
+			created += n
+			if err := reallocate(db, rules, residentID); err != nil {
+				return created, unbilled, err
+			}
+		}
+	}
+	return created, unbilled, nil
+}
+
+// Handlers for unit fraction endpoints
+
+// Get the permilage of every unit that has one
+func getUnitFractions(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rows, err := db.Query("SELECT unit, permilage, updated_at FROM unit_fractions ORDER BY unit")
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		defer rows.Close()
+
+		fractions := []UnitFraction{}
+		for rows.Next() {
+			var f UnitFraction
+			if err := rows.Scan(&f.Unit, &f.Permilage, &f.UpdatedAt); err != nil {
+				respondWithError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			fractions = append(fractions, f)
+		}
+
+		respondWithJSON(w, http.StatusOK, fractions)
+	}
+}
+
+// Set the permilage of a unit
+func setUnitFraction(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var f UnitFraction
+		if err := decodeRequest(r, &f); err != nil {
+			respondWithError(w, payloadErrorStatus(err), "Invalid request payload: "+err.Error())
+			return
+		}
+		defer r.Body.Close()
+
+		f.Unit = mux.Vars(r)["unit"]
+		if err := validateUnitFraction(f); err != nil {
+			respondWithValidationError(w, err)
+			return
+		}
+
+		_, err := db.Exec(`
+			INSERT INTO unit_fractions(unit, permilage) VALUES(?, ?)
+			ON CONFLICT(unit) DO UPDATE SET permilage = excluded.permilage, updated_at = CURRENT_TIMESTAMP
+		`, f.Unit, f.Permilage)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if err := db.QueryRow("SELECT updated_at FROM unit_fractions WHERE unit = ?", f.Unit).Scan(&f.UpdatedAt); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		respondWithJSON(w, http.StatusOK, f)
+	}
+}
+
+// Remove the permilage of a unit
+func deleteUnitFraction(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		result, err := db.Exec("DELETE FROM unit_fractions WHERE unit = ?", mux.Vars(r)["unit"])
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			respondWithError(w, http.StatusNotFound, "Unit fraction not found")
+			return
+		}
+
+		respondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
+	}
+}
+
+// Check that the ownership fractions add up to 1000‰ and cover every unit
+// with a resident
+func getFractionCheck(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		check, err := checkFractions(db)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		respondWithJSON(w, http.StatusOK, check)
+	}
+}
+
+// Split an expense between the units by their ownership fractions, to be
+// charged with the dues of charge_month, next month by default. Allocating
+// again replaces the shares, until they are charged.
+func allocateExpense(db *sql.DB, cal calendar) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := checkQueryParams(r, "charge_month"); err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		id, err := strconv.Atoi(mux.Vars(r)["id"])
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid expense ID")
+			return
+		}
+		month := r.URL.Query().Get("charge_month")
+		if month == "" {
+			now := cal.now()
+			month = time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, time.UTC).Format("2006-01")
+		}
+		if _, err := time.Parse("2006-01", month); err != nil {
+			respondWithError(w, http.StatusBadRequest, "invalid charge_month format, must be YYYY-MM")
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		defer tx.Rollback()
+
+		var amount float64
+		err = tx.QueryRow("SELECT amount FROM expenses WHERE id = ?", id).Scan(&amount)
+		if err == sql.ErrNoRows {
+			respondWithError(w, http.StatusNotFound, "Expense not found")
+			return
+		}
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		check, err := checkFractions(tx)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if check.Total != permilageTotal {
+			respondWithError(w, http.StatusConflict, "Ownership fractions must add up to 1000")
+			return
+		}
+		months := []string{month}
+		if previous, err := loadExpenseAllocation(tx, id); err == nil {
+			months = append(months, previous.ChargeMonth)
+		} else if err != sql.ErrNoRows {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		for _, m := range months {
+			charged, err := expenseSharesCharged(tx, m)
+			if err != nil {
+				respondWithError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			if charged {
+				respondWithError(w, http.StatusConflict, "Shared expenses of the month are already charged")
+				return
+			}
+		}
+
+		rows, err := tx.Query("SELECT unit, permilage FROM unit_fractions ORDER BY unit")
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		var units []string
+		var weights []float64
+		for rows.Next() {
+			var unit string
+			var permilage float64
+			if err := rows.Scan(&unit, &permilage); err != nil {
+				rows.Close()
+				respondWithError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			units = append(units, unit)
+			weights = append(weights, permilage)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		if _, err := tx.Exec("DELETE FROM expense_allocations WHERE expense_id = ?", id); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		for i, share := range splitAmount(amount, weights) {
+			_, err := tx.Exec("INSERT INTO expense_allocations(expense_id, unit, permilage, amount, charge_month) VALUES(?, ?, ?, ?, ?)",
+				id, units[i], weights[i], share, month)
+			if err != nil {
+				respondWithError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+		}
+		allocation, err := loadExpenseAllocation(tx, id)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		respondWithJSON(w, http.StatusOK, allocation)
+	}
+}
+
+// Get how an expense was split between the units
+func getExpenseAllocation(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(mux.Vars(r)["id"])
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid expense ID")
+			return
+		}
+
+		allocation, err := loadExpenseAllocation(db, id)
+		if err == sql.ErrNoRows {
+			respondWithError(w, http.StatusNotFound, "Expense not allocated")
+			return
+		}
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		respondWithJSON(w, http.StatusOK, allocation)
+	}
+}
+
+// Get the expenses allocated to each unit per charge month of a fiscal year,
+// as JSON or CSV
+func getAllocationReport(db *sql.DB, cal calendar) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := checkQueryParams(r, "year", "format", "locale"); err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		format := r.URL.Query().Get("format")
+		if format != "" && format != "json" && format != "csv" {
+			respondWithError(w, http.StatusBadRequest, "Invalid format, must be json or csv")
+			return
+		}
+		locale, err := reportLocale(r)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		year, err := statementYear(r, cal)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		months := cal.fiscalYearMonths(year)
+		report := AllocationReport{Year: year, Units: []UnitAllocation{}}
+		rows, err := db.Query(`
+			SELECT a.unit, a.charge_month, COUNT(*), SUM(a.amount) FROM expense_allocations a
+			JOIN expenses e ON e.id = a.expense_id
+			WHERE a.charge_month BETWEEN ? AND ?
+			GROUP BY a.unit, a.charge_month
+			ORDER BY a.unit, a.charge_month
+		`, months[0], months[len(months)-1])
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var u UnitAllocation
+			if err := rows.Scan(&u.Unit, &u.Month, &u.Expenses, &u.Amount); err != nil {
+				respondWithError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			u.Amount = roundCents(u.Amount)
+			report.Units = append(report.Units, u)
+			report.Amount = roundCents(report.Amount + u.Amount)
+		}
+		if err := rows.Err(); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		if format == "csv" {
+			w.Header().Set("Content-Type", "text/csv")
+			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=allocations_%d.csv", year))
+			locale.Start(w)
+			lang := responseLanguage(w)
+			locale.Row(w, reportLabels(lang, "unit", "month", "expenses", "amount")...)
+			summary := newReportSummary("unit")
+			for _, u := range report.Units {
+				locale.Row(w, u.Unit, u.Month, strconv.Itoa(u.Expenses), locale.Amount(u.Amount))
+				summary.Add(u.Amount, u.Unit)
+			}
+			summary.Write(w, locale, lang)
+			return
+		}
+		respondWithJSON(w, http.StatusOK, report)
+	}
+}
@@ -0,0 +1,151 @@
+package condomngr
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestSplitAmount(t *testing.T) {
+	for _, tt := range []struct {
+		amount  float64
+		weights []float64
+		want    []float64
+	}{
+		{100, []float64{1, 1, 1}, []float64{33.34, 33.33, 33.33}},
+		{0.02, []float64{1, 1, 1}, []float64{0.01, 0.01, 0}},
+		{0.05, []float64{1, 1}, []float64{0.03, 0.02}},
+		{1000.01, []float64{500, 300, 200}, []float64{500.01, 300, 200}},
+		{10, []float64{333.33, 333.33, 333.34}, []float64{3.33, 3.33, 3.34}},
+		{100, []float64{500, 333.333, 166.667}, []float64{50, 33.33, 16.67}},
+		{0.01, []float64{500, 333.333, 166.667}, []float64{0.01, 0, 0}},
+		{1, []float64{0, 1, 1}, []float64{0, 0.5, 0.5}},
+		{-100, []float64{1, 1, 1}, []float64{-33.33, -33.33, -33.34}},
+		{100, []float64{0, 0}, []float64{0, 0}},
+		{100, nil, []float64{}},
+	} {
+		if got := splitAmount(tt.amount, tt.weights); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%v by %v: %v, want %v", tt.amount, tt.weights, got, tt.want)
+		}
+	}
+}
+
+// TestSplitAmountAddsUp splits amounts by permilages that don't divide them
+// evenly and checks the parts are whole cents within a cent of their exact
+// share, adding up to exactly the amount
+func TestSplitAmountAddsUp(t *testing.T) {
+	weights := []float64{123.456, 200, 76.544, 333.333, 266.667}
+	for _, amount := range []float64{0.01, 0.99, 1, 33.33, 57.77, 1234.56, 50000, 99999.99} {
+		parts := splitAmount(amount, weights)
+		var cents int64
+		for i, part := range parts {
+			if math.Abs(part*100-math.Round(part*100)) > 1e-6 {
+				t.Errorf("%v: part %v isn't whole cents", amount, part)
+			}
+			if exact := amount * weights[i] / 1000; math.Abs(part-exact) >= 0.01 {
+				t.Errorf("%v: part %v more than a cent off %v", amount, part, exact)
+			}
+			cents += int64(math.Round(part * 100))
+		}
+		if cents != int64(math.Round(amount*100)) {
+			t.Errorf("%v: parts %v add up to %d cents", amount, parts, cents)
+		}
+	}
+}
+
+func TestExpenseSharesCharged(t *testing.T) {
+	s := newTestServer(t, Options{MonthlyFee: 50})
+	for _, r := range []map[string]string{
+		{"name": "Ana Silva", "unit": "1A"},
+		{"name": "Rui Costa", "unit": "1B"},
+		{"name": "Eva Lima", "unit": "1C", "move_out_date": "2024-03-01"},
+	} {
+		s.expect(http.StatusCreated, "POST", "/api/v1/residents", r, nil)
+	}
+
+	// Fractions in thousandths count as adding up to 1000
+	var check FractionCheck
+	for _, f := range []struct {
+		unit      string
+		permilage float64
+		total     float64
+		valid     bool
+	}{
+		{"1A", 500, 500, false},
+		{"1B", 333.333, 833.333, false},
+		{"1C", 166.666, 999.999, false},
+		{"1C", 166.667, 1000, true},
+	} {
+		s.expect(http.StatusOK, "PUT", "/api/v1/fractions/"+f.unit, map[string]float64{"permilage": f.permilage}, nil)
+		s.expect(http.StatusOK, "GET", "/api/v1/fractions/check", nil, &check)
+		if check.Total != f.total || check.Valid != f.valid {
+			t.Errorf("after setting %s to %v: %+v", f.unit, f.permilage, check)
+		}
+	}
+
+	allocate := func(amount float64, month string) ExpenseAllocation {
+		t.Helper()
+		var expense Expense
+		s.expect(http.StatusCreated, "POST", "/api/v1/expenses", map[string]interface{}{"amount": amount, "description": "Lift repair", "expense_date": "2024-02-10", "category": "Maintenance"}, &expense)
+		var allocation ExpenseAllocation
+		s.expect(http.StatusOK, "POST", fmt.Sprintf("/api/v1/expenses/%d/allocate?charge_month=%s", expense.ID, month), nil, &allocation)
+		return allocation
+	}
+	for _, tt := range []struct {
+		amount float64
+		want   []string
+	}{
+		{100, []string{"1A 50", "1B 33.33", "1C 16.67"}},
+		{0.01, []string{"1A 0.01", "1B 0", "1C 0"}},
+		{1234.57, []string{"1A 617.29", "1B 411.52", "1C 205.76"}},
+	} {
+		allocation := allocate(tt.amount, "2024-03")
+		var shares []string
+		for _, share := range allocation.Shares {
+			shares = append(shares, fmt.Sprint(share.Unit, " ", share.Amount))
+		}
+		if !reflect.DeepEqual(shares, tt.want) || allocation.Amount != tt.amount || allocation.ChargeMonth != "2024-03" {
+			t.Errorf("allocating %v: %+v, shares %q, want %q", tt.amount, allocation, shares, tt.want)
+		}
+	}
+
+	// The dues of March charge each unit its shares once, except 1C whose
+	// resident moved out on the 1st
+	var generated struct {
+		ExpenseShares int64    `json:"expense_shares"`
+		UnbilledUnits []string `json:"unbilled_units"`
+	}
+	s.expect(http.StatusOK, "POST", "/api/v1/dues/generate?month=2024-03", nil, &generated)
+	if generated.ExpenseShares != 2 || !reflect.DeepEqual(generated.UnbilledUnits, []string{"1C"}) {
+		t.Errorf("generated %+v", generated)
+	}
+	rows, err := s.db.Query("SELECT r.unit, c.amount FROM charges c JOIN residents r ON r.id = c.resident_id WHERE c.kind = ? ORDER BY r.unit", ChargeKindExpenses)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var charges []string
+	for rows.Next() {
+		var unit string
+		var amount float64
+		if err := rows.Scan(&unit, &amount); err != nil {
+			t.Fatal(err)
+		}
+		charges = append(charges, fmt.Sprint(unit, " ", amount))
+	}
+	if want := []string{"1A 667.3", "1B 444.85"}; !reflect.DeepEqual(charges, want) {
+		t.Errorf("charges %q, want %q", charges, want)
+	}
+	s.expect(http.StatusOK, "POST", "/api/v1/dues/generate?month=2024-03", nil, &generated)
+	if generated.ExpenseShares != 0 {
+		t.Errorf("generating March again charged %d shares", generated.ExpenseShares)
+	}
+
+	// Once charged the month's allocations can't change
+	var expense Expense
+	s.expect(http.StatusCreated, "POST", "/api/v1/expenses", map[string]interface{}{"amount": 10, "description": "Cleaning", "expense_date": "2024-02-12", "category": "Cleaning"}, &expense)
+	s.expect(http.StatusConflict, "POST", fmt.Sprintf("/api/v1/expenses/%d/allocate?charge_month=2024-03", expense.ID), nil, nil)
+	s.expect(http.StatusOK, "POST", fmt.Sprintf("/api/v1/expenses/%d/allocate?charge_month=2024-04", expense.ID), nil, nil)
+}
@@ -0,0 +1,117 @@
+package condomngr
+
+import (
+	"database/sql"
+	"strings"
+	"unicode"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// sqliteDriver is the sqlite3 driver with the functions fuzzy search needs
+// registered on every connection
+const sqliteDriver = "sqlite3_condo"
+
+func init() {
+	sql.Register(sqliteDriver, &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			if err := conn.RegisterFunc("fold", foldText, true); err != nil {
+				return err
+			}
+			return conn.RegisterFunc("fuzzy_distance", fuzzyDistance, true)
+		},
+	})
+}
+
+// foldReplacements maps accented and special Latin letters to the plain
+// letters they are searched by. The standard library can't decompose Unicode,
+// so this covers the Latin-1 Supplement and Latin Extended-A letters.
+var foldReplacements = func() map[rune]string {
+	m := map[rune]string{'ß': "ss", 'æ': "ae", 'œ': "oe", 'ø': "o", 'ł': "l", 'đ': "d", 'ð': "d", 'þ': "th", 'ı': "i"}
+	for base, accented := range map[string]string{
+		"a": "àáâãäåāăą",
+		"c": "çćĉċč",
+		"d": "ď",
+		"e": "èéêëēĕėęě",
+		"g": "ĝğġģ",
+		"h": "ĥħ",
+		"i": "ìíîïĩīĭįİ",
+		"j": "ĵ",
+		"k": "ķ",
+		"l": "ĺļľŀ",
+		"n": "ñńņňŉ",
+		"o": "òóôõöōŏő",
+		"r": "ŕŗř",
+		"s": "śŝşš",
+		"t": "ţťŧ",
+		"u": "ùúûüũūŭůűų",
+		"w": "ŵ",
+		"y": "ýÿŷ",
+		"z": "źżž",
+	} {
+		for _, r := range accented {
+			m[r] = base
+		}
+	}
+	return m
+}()
+
+// foldText lowercases s and strips the accents of Latin letters, so "João"
+// and "joao" compare equal
+func foldText(s string) string {
+	var b strings.Builder
+	b.Grow(len(s))
+	for _, r := range s {
+		r = unicode.ToLower(r)
+		if plain, ok := foldReplacements[r]; ok {
+			b.WriteString(plain)
+		} else {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// fuzzyDistance returns the fewest single-letter edits (insertions,
+// deletions, substitutions or swaps of neighbours) that turn query into some
+// part of text, after folding both. 0 means the query appears in the text as
+// is.
+func fuzzyDistance(text, query string) int {
+	t, q := []rune(foldText(text)), []rune(foldText(query))
+	// Edit distance against any substring of t: row i holds the cost of
+	// matching q[:i] ending at each position of t, starting anywhere for free
+	before := make([]int, len(t)+1) // row i-2, for swaps
+	prev := make([]int, len(t)+1)
+	cur := make([]int, len(t)+1)
+	for i := 1; i <= len(q); i++ {
+		cur[0] = i
+		for j := 1; j <= len(t); j++ {
+			cost := 1
+			if q[i-1] == t[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j-1]+cost, prev[j]+1, cur[j-1]+1)
+			if i > 1 && j > 1 && q[i-1] == t[j-2] && q[i-2] == t[j-1] {
+				cur[j] = min(cur[j], before[j-2]+1)
+			}
+		}
+		before, prev, cur = prev, cur, before
+	}
+	best := len(q)
+	for _, d := range prev {
+		best = min(best, d)
+	}
+	return best
+}
+
+// fuzzyTolerance is how many typos a fuzzy search allows for a query: none
+// for short ones, where a single edit already matches almost anything
+func fuzzyTolerance(query string) int {
+	switch n := len([]rune(query)); {
+	case n >= 8:
+		return 2
+	case n >= 4:
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,1026 @@
+package condomngr
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Languages user-facing messages are translated to
+const (
+	LangEnglish    = "en"
+	LangPortuguese = "pt"
+)
+
+// defaultLanguage is the language of requests that don't ask for a supported
+// one. Set with -lang.
+var defaultLanguage = LangEnglish
+
+// catalogs translate user-facing messages by message id. English is complete;
+// messages missing from another catalog are left in English. The id is also
+// the machine-readable code of an error, the same in every language.
+var catalogs = map[string]map[string]string{
+	LangEnglish:    catalogEnglish,
+	LangPortuguese: catalogPortuguese,
+}
+
+var catalogEnglish = map[string]string{
+	"not_found":                        "Not found",
+	"method_not_allowed":               "Method not allowed",
+	"too_many_requests":                "Too many requests",
+	"invalid_request_payload":          "Invalid request payload",
+	"unknown_query_parameter":          "unknown query parameter",
+	"error_reading_request_body":       "Error reading request body",
+	"unable_to_parse_form":             "Unable to parse form",
+	"read_only":                        "server is in read-only mode",
+	"read_only_locked":                 "read-only mode was set with -read-only and can't be changed at runtime",
+	"unauthorized_token_revoked":       "Unauthorized: token revoked",
+	"invalid_credentials":              "Invalid username or password",
+	"login_throttled":                  "Too many failed sign-in attempts, try again later",
+	"not_signed_in":                    "Not signed in",
+	"username_or_ip":                   "Give either username or ip",
+	"no_login_failures":                "No failed sign-ins to clear",
+	"admin_only":                       "Only admins can do this",
+	"invalid_session_id":               "Invalid session ID",
+	"session_not_found":                "Session not found",
+	"two_factor_already_on":            "Two-factor authentication is already on",
+	"two_factor_not_started":           "Start two-factor enrollment first",
+	"invalid_two_factor_code":          "Invalid two-factor code",
+	"login_challenge_expired":          "Sign-in expired, sign in again",
+	"no_two_factor":                    "The user doesn't have two-factor authentication",
+	"two_factor_required":              "Two-factor authentication is required, turn it on first",
+	"password_change_required":         "Change your password first",
+	"password_reset_throttled":         "Too many password reset requests, try again later",
+	"username_or_email":                "Give a username or an email",
+	"invalid_password_reset_link":      "Invalid or expired password reset link",
+	"password_reset_title":             "Reset password",
+	"new_password":                     "New password",
+	"set_password":                     "Set password",
+	"password_reset_done":              "Your password was changed. Sign in with the new one.",
+	"resident_not_found":               "Resident not found",
+	"payment_not_found":                "Payment not found",
+	"expense_not_found":                "Expense not found",
+	"expense_not_allocated":            "Expense not allocated",
+	"announcement_not_found":           "Announcement not found",
+	"bank_account_not_found":           "Bank account not found",
+	"bank_line_not_found":              "Bank line not found",
+	"invalid_condo_header":             "Invalid X-Condo-ID",
+	"condo_header_mismatch":            "X-Condo-ID doesn't match the condo in the path",
+	"condo_not_found":                  "Condo not found",
+	"condo_access_denied":              "You don't have access to this condo",
+	"condo_grant_not_found":            "The user doesn't have access to this condo",
+	"condo_users_only_default":         "Users and sign-in are served by the default condo",
+	"fee_schedule_not_found":           "Fee schedule not found",
+	"reserve_rule_not_found":           "Reserve rule not found",
+	"budget_not_found":                 "Budget not found",
+	"payment_plan_not_found":           "Payment plan not found",
+	"writeoff_not_found":               "Write-off not found",
+	"assessment_not_found":             "Assessment not found",
+	"unit_fraction_not_found":          "Unit fraction not found",
+	"unit_not_found":                   "Unit not found",
+	"document_not_found":               "Document not found",
+	"incident_not_found":               "Incident not found",
+	"task_not_found":                   "Task not found",
+	"saved_search_not_found":           "Saved search not found",
+	"maintenance_request_not_found":    "Maintenance request not found",
+	"expiry_item_not_found":            "Expiry item not found",
+	"expiry_not_suppressed":            "Expiry item not suppressed",
+	"invalid_document_id":              "Invalid document ID",
+	"invalid_incident_id":              "Invalid incident ID",
+	"invalid_task_id":                  "Invalid task ID",
+	"invalid_saved_search_id":          "Invalid saved search ID",
+	"invalid_saved_search_entity":      "Invalid entity, must be residents, payments or expenses",
+	"invalid_maintenance_request_id":   "Invalid maintenance request ID",
+	"invalid_within_days":              "within_days must be a number of days",
+	"trash_entry_not_found":            "Trash entry not found",
+	"user_not_found":                   "User not found",
+	"attachment_not_found":             "Attachment not found",
+	"custom_field_not_found":           "Custom field not found",
+	"email_template_not_found":         "Email template not found",
+	"token_not_found":                  "Token not found or already revoked",
+	"job_not_found":                    "Job not found",
+	"job_finished":                     "Job already finished",
+	"invalid_resident_id":              "Invalid resident ID",
+	"invalid_payment_id":               "Invalid payment ID",
+	"invalid_expense_id":               "Invalid expense ID",
+	"invalid_announcement_id":          "Invalid announcement ID",
+	"invalid_bank_account_id":          "Invalid bank account ID",
+	"invalid_bank_line_id":             "Invalid bank line ID",
+	"invalid_condo_id":                 "Invalid condo ID",
+	"invalid_fee_schedule_id":          "Invalid fee schedule ID",
+	"invalid_reserve_rule_id":          "Invalid reserve rule ID",
+	"invalid_payment_plan_id":          "Invalid payment plan ID",
+	"invalid_writeoff_id":              "Invalid write-off ID",
+	"invalid_assessment_id":            "Invalid assessment ID",
+	"invalid_token_id":                 "Invalid token ID",
+	"invalid_trash_entry_id":           "Invalid trash entry ID",
+	"invalid_user_id":                  "Invalid user ID",
+	"invalid_job_id":                   "Invalid job ID",
+	"invalid_attachment_id":            "Invalid attachment ID",
+	"invalid_custom_field_id":          "Invalid custom field ID",
+	"bank_account_exists":              "A bank account with this name already exists",
+	"condo_exists":                     "A condo with this name already exists",
+	"custom_field_exists":              "A custom field with this key already exists",
+	"custom_field_locked":              "The entity, key and type of a custom field with values can't change",
+	"custom_field_has_values":          "Custom field has values, delete it with confirm=true to remove them",
+	"payment_reference_exists":         "A payment with this reference already exists",
+	"reserve_rule_exists":              "A reserve rule already starts on this date",
+	"cheque_only":                      "Only payments by check can clear or bounce",
+	"email_not_configured":             "Email is not configured",
+	"payment_details_not_configured":   "Payment details are not configured",
+	"qr_euros_only":                    "QR codes are only for payments in euros",
+	"resident_no_email":                "Resident has no email address",
+	"receipts_opted_out":               "Resident opted out of receipts",
+	"resident_anonymized":              "Resident is anonymized",
+	"resident_already_anonymized":      "Resident is already anonymized",
+	"resident_owes_anonymize":          "Resident has an outstanding balance, set force to anonymize anyway",
+	"invalid_unsubscribe_link":         "Invalid unsubscribe link",
+	"unsubscribed_title":               "Unsubscribed",
+	"unsubscribed_receipts":            "You will no longer receive payment receipts.",
+	"unsubscribed_reminders":           "You will no longer receive payment reminders.",
+	"unsubscribed_announcements":       "You will no longer receive announcements.",
+	"unsubscribed_statements":          "You will no longer receive statements.",
+	"unsubscribed_all":                 "You will no longer receive any messages from the condominium.",
+	"unsubscribe_all":                  "Stop all messages from the condominium",
+	"receipt_send_failed":              "Failed to send receipt",
+	"backup_failed":                    "Backup failed",
+	"sheets_not_configured":            "Google Sheets integration is not configured",
+	"backups_not_configured":           "Backups are not configured",
+	"stripe_not_configured":            "Stripe integration is not configured",
+	"inbound_mail_not_configured":      "Inbound mail is not configured",
+	"invalid_inbound_mail_token":       "Invalid inbound mail token",
+	"no_email_in_request":              "No email in the request",
+	"invalid_email_message":            "Invalid email",
+	"no_interest_rate":                 "No interest rate configured",
+	"no_monthly_fee":                   "No monthly fee or fee schedule configured",
+	"no_notification_channels":         "No notification channels configured",
+	"checkout_no_resident":             "Checkout session has no resident",
+	"invalid_event_payload":            "Invalid event payload",
+	"import_file_too_large":            "Import file is too large",
+	"export_file_too_large":            "Export file is too large",
+	"error_reading_import_file":        "Error reading import file",
+	"error_retrieving_import_file":     "Error retrieving import file",
+	"error_retrieving_before_file":     "Error retrieving before file",
+	"error_retrieving_after_file":      "Error retrieving after file",
+	"attachment_too_large":             "Attachment is too large",
+	"attachment_empty":                 "Attachment is empty",
+	"attachment_type":                  "Unsupported attachment type, must be PDF, JPEG, PNG, GIF, WebP or plain text",
+	"attachment_quota_exceeded":        "Attachment storage quota exceeded",
+	"error_retrieving_attachment_file": "Error retrieving attachment file",
+	"invalid_import_file_format":       "Invalid import file format",
+	"invalid_export_file":              "Invalid export file",
+	"statement_file_too_large":         "Statement file is too large",
+	"error_retrieving_statement_file":  "Error retrieving statement file",
+	"workbook_too_large":               "Workbook is too large",
+	"error_retrieving_workbook":        "Error retrieving workbook",
+	"error_reading_workbook":           "Error reading workbook",
+	"invalid_workbook":                 "Invalid workbook",
+	"invalid_mapping":                  "Invalid mapping",
+	"invalid_statement_file":           "Invalid statement file",
+	"import_successful":                "Database import successful",
+	"invalid_dry_run":                  "Invalid dry_run, must be true or false",
+	"invalid_fuzzy":                    "Invalid fuzzy, must be true or false",
+	"invalid_include_zero":             "Invalid include_zero, must be true or false",
+	"invalid_overdue":                  "Invalid overdue, must be true or false",
+	"invalid_check_only":               "Invalid check_only, must be true or false",
+	"invalid_refresh":                  "Invalid refresh, must be true or false",
+	"invalid_force":                    "Invalid force, must be true or false",
+	"invalid_summary":                  "Invalid summary, must be true or false",
+	"invalid_include_expenses":         "Invalid include, must be expenses",
+	"manifest_mismatch":                "the file doesn't match its manifest, it may be truncated or edited",
+	"invalid_confirm":                  "Invalid confirm, must be true or false",
+	"invalid_format_json_csv":          "Invalid format, must be json or csv",
+	"invalid_format_json_pdf":          "Invalid format, must be json or pdf",
+	"invalid_format_json_ndjson":       "Invalid format, must be json or ndjson",
+	"invalid_format_json_png":          "Invalid format, must be json or png",
+	"not_acceptable_json_csv":          "Not acceptable, supported formats are application/json and text/csv",
+	"invalid_receipt_email_status":     "Invalid status, must be queued, sent, failed, skipped or suppressed",
+	"receipt_needs_confirmed_payment":  "Only confirmed payments have receipts",
+	"invalid_limit_100":                "Invalid limit, must be between 1 and 100",
+	"invalid_limit_200":                "Invalid limit, must be between 1 and 200",
+	"invalid_locale":                   "Invalid locale, must be en or pt-PT",
+	"invalid_mode":                     "Invalid mode, must be replace or merge",
+	"invalid_async":                    "Invalid async, must be true or false",
+	"payment_plan_active":              "Resident already has an active payment plan",
+	"writeoff_reversed":                "Write-off already reversed",
+	"assessment_paid":                  "Assessment has payments, only its name can change",
+	"assessment_paid_delete":           "Assessment has payments, it can't be deleted",
+	"unit_transferred_later":           "The unit was already transferred on or after this date",
+	"transfer_moves_in_later":          "Someone moves into the unit on or after the transfer date",
+	"new_owner_has_unit":               "The new owner already lives or lived in a unit, add them as new_owner instead",
+	"fractions_total":                  "Ownership fractions must add up to 1000",
+	"expense_shares_charged":           "Shared expenses of the month are already charged",
+	"invalid_plan_status":              "Invalid status, must be on_track, behind, completed or defaulted",
+	"invalid_consistency_fix":          "Invalid fix, must be assign_unknown_resident or backfill_defaults",
+	"consistency_fix_required":         "Give at least one fix",
+	"invalid_change_type":              "Invalid type, must be resident, payment or expense",
+	"invalid_change_action":            "Invalid action, must be created, updated, deleted or imported",
+	"invalid_bank_line_status":         "Invalid status, must be unmatched, suggested, matched or discrepancy",
+	"invalid_subtotals_category":       "Invalid subtotals, must be category",
+	"unknown_report_column":            "Unknown report column",
+	"duplicate_report_column":          "Duplicate report column",
+	"report_columns_empty":             "Invalid columns, must list at least one column",
+	"invalid_subtotals_resident":       "Invalid subtotals, must be resident",
+	"invalid_type":                     "Invalid type, must be resident, payment or expense",
+	"search_query_required":            "Search query is required",
+	"match_with_fuzzy":                 "match can't be combined with fuzzy",
+	"saved_search_exists":              "A saved search with this name already exists",
+	"report_schedule_not_found":        "Report schedule not found",
+	"invalid_report_schedule_id":       "Invalid report schedule ID",
+	"report_schedule_exists":           "A report schedule with this name already exists",
+	"invalid_report_run_status":        "Invalid status, must be success, failed or missed",
+	"invalid_as_of":                    "invalid as_of format, must be YYYY-MM-DD",
+	"invalid_date":                     "invalid date format, must be YYYY-MM-DD",
+	"invalid_start_date":               "invalid start date format, must be YYYY-MM-DD",
+	"invalid_end_date":                 "invalid end date format, must be YYYY-MM-DD",
+	"invalid_month":                    "invalid month format, must be YYYY-MM",
+	"invalid_charge_month":             "invalid charge_month format, must be YYYY-MM",
+	"invalid_on":                       "invalid on format, must be YYYY-MM-DD",
+	"on_or_month":                      "Give on or month, not both",
+	"invalid_year":                     "invalid year, must be YYYY",
+	"start_date_required":              "start_date is required as YYYY-MM-DD",
+	"end_date_required":                "end_date is required as YYYY-MM-DD",
+	"end_date_before_start_date":       "end_date must not be before start_date",
+	"end_month_before_start_month":     "end_month must not be before start_month",
+	"format_ofx_qif":                   "format must be ofx or qif",
+	"ids_or_filter":                    "exactly one of ids or filter is required",
+	"name_required":                    "name is required",
+	"payee_required":                   "payee is required",
+	"payee_too_long":                   "payee must be at most 70 characters",
+	"saved_search_name_too_long":       "name must be at most 100 characters",
+	"saved_search_entity_invalid":      "entity must be one of residents, payments or expenses",
+	"unsupported_search_param":         "unsupported search parameter",
+	"report_format_invalid":            "format must be one of csv, pdf or xlsx",
+	"cron_and_day_of_month":            "cron and day_of_month can't both be set",
+	"time_needs_day_of_month":          "time only applies with day_of_month",
+	"cron_invalid":                     "invalid cron expression, must be five fields: minute hour day month weekday",
+	"cron_never_matches":               "cron expression never matches a date",
+	"day_of_month_range":               "day_of_month must be between 1 and 28",
+	"time_invalid":                     "invalid time format, must be HH:MM",
+	"cron_or_day_of_month_required":    "either cron or day_of_month is required",
+	"recipients_required":              "at least one recipient is required",
+	"report_invalid":                   "report must be one of income_expense, payments, expenses or aging",
+	"report_period_invalid":            "period must be previous_month or month_to_date",
+	"report_period_not_applicable":     "period only applies to reports over dates",
+	"unsupported_report_param":         "unsupported report parameter",
+	"search_residents_query_required":  "q is required to search residents",
+	"search_resident_id_number":        "resident_id must be a number",
+	"iban_invalid":                     "iban is not a valid IBAN",
+	"bic_invalid":                      "bic must be 8 or 11 letters and digits",
+	"unit_required":                    "unit is required",
+	"description_required":             "description is required",
+	"title_required":                   "title is required",
+	"reason_required":                  "reason is required",
+	"legal_basis_required":             "legal_basis is required",
+	"filter_field_required":            "filter must set at least one field",
+	"patch_category_required":          "patch must set category",
+	"filter_ids_or_resident":           "filter must set either ids or resident_id",
+	"filter_dates_with_resident":       "dates only apply with resident_id",
+	"target_resident_required":         "target_resident_id is required",
+	"target_resident_same":             "target_resident_id must differ from the filter's resident_id",
+	"target_resident_exists":           "target_resident_id must be an existing resident",
+	"writeoff_exceeds_balance":         "amount must not exceed what the resident owes",
+	"decision_required":                "decision is required",
+	"new_owner_or_resident":            "give new_resident_id or new_owner, not both",
+	"transfer_balance_invalid":         "balance must be freeze or carry",
+	"document_kind_invalid":            "kind must be one of contract, insurance, inspection or other",
+	"expires_on_invalid":               "expires_on must be a date, YYYY-MM-DD",
+	"location_required":                "location is required",
+	"incident_severity_invalid":        "severity must be one of low, medium, high or critical",
+	"incident_resolved_on_open":        "resolved_on is only for resolved incidents",
+	"incident_resolved_on_before":      "resolved_on must not be before incident_date",
+	"incident_status_invalid":          "status must be open or resolved",
+	"reported_by_resident":             "reported_by must be an existing resident",
+	"expense_ids_exist":                "expense_ids must be existing expenses",
+	"task_completed_on_open":           "completed_on is only for done tasks",
+	"task_status_invalid":              "status must be open or done",
+	"task_entity_type_invalid":         "entity_type must be one of incident, maintenance_request, document, expense, resident or announcement, with an entity_id",
+	"assignee_user_exists":             "assignee_user_id must be an existing user",
+	"task_entity_exists":               "entity_id must be an existing record of entity_type",
+	"maintenance_status_invalid":       "status must be open, in_progress or closed",
+	"resident_id_exists":               "resident_id must be an existing resident",
+	"username_required":                "username is required",
+	"username_spaces":                  "username can't contain spaces",
+	"role_invalid":                     "role must be one of admin, treasurer or viewer",
+	"email_invalid":                    "invalid email format",
+	"current_password_incorrect":       "current_password is incorrect",
+	"password_unchanged":               "new_password must differ from the current password",
+	"notify_channel_invalid":           "notify channel must be one of email, sms or none",
+	"receipts_channel_invalid":         "receipts must be email or none",
+	"statements_channel_invalid":       "statements must be email or none",
+	"reminders_channel_invalid":        "reminders must be one of email, sms or none",
+	"announcements_channel_invalid":    "announcements must be one of email, sms or none",
+	"notify_channel_mismatch":          "notify_channel must match notifications.reminders",
+	"move_out_before_move_in":          "move_out_date must be after move_in_date",
+	"resident_required":                "resident is required",
+	"resident_missing":                 "resident does not exist",
+	"amount_positive":                  "amount must be greater than zero",
+	"amount_nonzero":                   "amount must not be zero",
+	"payment_date_required":            "payment date is required",
+	"expense_date_required":            "expense date is required",
+	"method_invalid":                   "method must be one of cash, transfer, card or check",
+	"cheque_details_only_check":        "cheque details are only for payments by check",
+	"cheque_status_invalid":            "cheque status must be one of pending, cleared or bounced",
+	"cheque_status_date_required":      "cheque status date is required as YYYY-MM-DD",
+	"cheque_pending_no_date":           "a pending cheque has no status date",
+	"cheque_before_payment":            "a cheque can't clear or bounce before the payment date",
+	"only_confirmed_allocated":         "only confirmed payments can be allocated",
+	"currency_invalid":                 "currency must be a 3-letter ISO 4217 code",
+	"original_amount_required":         "original amount is required for another currency than the base one",
+	"exchange_rate_required":           "exchange rate is required for another currency than the base one",
+	"amount_exchange_mismatch":         "amount must be original_amount times exchange_rate",
+	"tax_rate_range":                   "tax rate must be between 0 and 100",
+	"tax_amount_negative":              "tax amount must not be negative",
+	"tax_amount_needs_rate":            "tax amount requires a tax rate",
+	"percent_range":                    "percent must be between 0 and 100",
+	"installment_amount_cover":         "installment_amount times installments must cover total_amount, leaving a last installment",
+	"installment_amount_negative":      "installment_amount must not be negative",
+	"category_required":                "category is required",
+	"amount_negative":                  "amount must not be negative",
+	"budget_months_invalid":            "months must be YYYY-MM months of the fiscal year",
+	"budget_month_negative":            "monthly budgets must not be negative",
+	"assessment_allocation_invalid":    "allocation must be equal, fraction or custom",
+	"shares_negative":                  "shares must not be negative",
+	"shares_total":                     "shares must add up to total_amount",
+	"shares_custom_only":               "shares are only given with custom allocation",
+	"shares_units":                     "shares must be for units with a resident on the due date",
+	"assessment_no_residents":          "no resident lives in a unit on the due date",
+	"assessment_no_fractions":          "no unit with a resident has an ownership fraction",
+	"permilage_range":                  "permilage must be greater than zero and at most 1000",
+	"start_month_invalid":              "start_month must be a month, YYYY-MM",
+	"plan_installments_range":          "installments must be between 1 and 120",
+	"plan_total_positive":              "total_amount must be greater than zero",
+	"effective_from_invalid":           "effective_from must be a month, YYYY-MM",
+	"effective_to_invalid":             "effective_to must be a month, YYYY-MM",
+	"effective_to_before_from":         "effective_to must not be before effective_from",
+	"unit_or_resident_required":        "unit or resident_id is required",
+	"unit_and_resident":                "set either unit or resident_id, not both",
+	"expires_in_days_range":            "expires_in_days must be between 1 and 366",
+	"bank_action_invalid":              "action must be one of confirm, create, flag or reject",
+	"bank_no_suggestion":               "the line has no suggested match, entity_type and entity_id are required",
+	"bank_category_required":           "category is required to create an expense",
+	"bank_note_required":               "note is required to flag a discrepancy",
+	"custom_entity_invalid":            "entity must be resident",
+	"custom_key_invalid":               "key must be lowercase letters, digits and underscores, starting with a letter",
+	"label_required":                   "label is required",
+	"custom_type_invalid":              "type must be one of text, number, date or bool",
+	"custom_field_unknown":             "unknown custom field",
+	"custom_value_text":                "custom value must be text",
+	"custom_value_number":              "custom value must be a number",
+	"custom_value_date":                "custom value must be a date, YYYY-MM-DD",
+	"custom_value_bool":                "custom value must be true or false",
+	"subject_required":                 "subject is required",
+	"body_required":                    "body is required",
+	"statement_month":                  "%s %d",
+	"statement_title":                  "Statement %s",
+	"statement_through":                "through %s",
+	"statement_unit":                   "Unit %s",
+	"statement_issued":                 "Amounts in %s. Issued %s.",
+	"statement_date":                   "Date",
+	"statement_description":            "Description",
+	"statement_charge":                 "Charge",
+	"statement_payment":                "Payment",
+	"statement_credit":                 "Credit",
+	"statement_written_off":            "Write-off",
+	"statement_balance":                "Balance",
+	"statement_opening_balance":        "Opening balance",
+	"statement_month_total":            "Month total",
+	"statement_total":                  "Total",
+	"statement_closing_balance":        "Closing balance: %.2f %s",
+	"statement_credit_note":            "A negative balance is a credit in the resident's favour.",
+	"incident_title":                   "Incident report #%d",
+	"incident_date":                    "Date: %s",
+	"incident_location":                "Location: %s",
+	"incident_severity":                "Severity: %s",
+	"incident_resolved":                "Resolved on %s",
+	"incident_open":                    "Open",
+	"incident_reported_by":             "Reported by: %s",
+	"incident_description":             "Description",
+	"incident_costs":                   "Costs",
+	"incident_no_costs":                "No costs recorded.",
+	"incident_total_cost":              "Total cost: %.2f %s",
+	"incident_photos":                  "Photos",
+	"incident_attachments":             "Other attachments",
+	"payment_request_title":            "Payment for unit %s, %s %d",
+	"payment_request_amount":           "Amount: %.2f %s",
+	"payment_request_payee":            "Beneficiary: %s",
+	"payment_request_iban":             "IBAN: %s",
+	"payment_request_bic":              "BIC: %s",
+	"payment_request_reference":        "Reference: %s",
+	"payment_request_note":             "Please quote the reference so your payment is recognized.",
+	"receipt_title":                    "Receipt no. %d",
+	"receipt_received":                 "Received %.2f %s on %s.",
+	"receipt_description":              "Description: %s",
+	"receipt_method":                   "Payment method: %s",
+	"receipt_reference":                "Reference: %s",
+	"receipt_issued":                   "Issued %s.",
+	"month_january":                    "January",
+	"month_february":                   "February",
+	"month_march":                      "March",
+	"month_april":                      "April",
+	"month_may":                        "May",
+	"month_june":                       "June",
+	"month_july":                       "July",
+	"month_august":                     "August",
+	"month_september":                  "September",
+	"month_october":                    "October",
+	"month_november":                   "November",
+	"month_december":                   "December",
+	"report_rows":                      "Rows",
+	"report_total":                     "Total",
+	"report_column_id":                 "ID",
+	"report_column_resident_id":        "Resident ID",
+	"report_column_resident":           "Resident",
+	"report_column_unit":               "Unit",
+	"report_column_email":              "Email",
+	"report_column_contact":            "Contact",
+	"report_column_amount":             "Amount",
+	"report_column_description":        "Description",
+	"report_column_date":               "Date",
+	"report_column_method":             "Method",
+	"report_column_status":             "Status",
+	"report_column_reference":          "Reference",
+	"report_column_bank_reference":     "Bank Reference",
+	"report_column_cheque_number":      "Cheque Number",
+	"report_column_cheque_bank":        "Cheque Bank",
+	"report_column_cheque_status":      "Cheque Status",
+	"report_column_created":            "Created",
+	"report_column_updated":            "Updated",
+	"report_column_category":           "Category",
+	"report_column_original_amount":    "Original Amount",
+	"report_column_currency":           "Currency",
+	"report_column_exchange_rate":      "Exchange Rate",
+	"report_column_tax_rate":           "Tax Rate",
+	"report_column_tax_amount":         "Tax Amount",
+	"report_column_net_amount":         "Net Amount",
+	"report_column_units":              "Units",
+	"report_column_month":              "Month",
+	"report_column_expenses":           "Expenses",
+}
+
+var catalogPortuguese = map[string]string{
+	"not_found":                        "Não encontrado",
+	"method_not_allowed":               "Método não permitido",
+	"too_many_requests":                "Demasiados pedidos",
+	"invalid_request_payload":          "Pedido inválido",
+	"unknown_query_parameter":          "parâmetro de consulta desconhecido",
+	"error_reading_request_body":       "Erro ao ler o corpo do pedido",
+	"unable_to_parse_form":             "Não foi possível ler o formulário",
+	"read_only":                        "o servidor está em modo só de leitura",
+	"read_only_locked":                 "o modo só de leitura foi definido com -read-only e não pode ser alterado em execução",
+	"unauthorized_token_revoked":       "Não autorizado: token revogado",
+	"invalid_credentials":              "Nome de utilizador ou palavra-passe inválidos",
+	"login_throttled":                  "Demasiadas tentativas de início de sessão falhadas, tente mais tarde",
+	"not_signed_in":                    "Sessão não iniciada",
+	"username_or_ip":                   "Indique username ou ip",
+	"no_login_failures":                "Não há tentativas falhadas para limpar",
+	"admin_only":                       "Só os administradores podem fazer isto",
+	"invalid_session_id":               "ID de sessão inválido",
+	"session_not_found":                "Sessão não encontrada",
+	"two_factor_already_on":            "A autenticação de dois fatores já está ativa",
+	"two_factor_not_started":           "Comece primeiro a ativação da autenticação de dois fatores",
+	"invalid_two_factor_code":          "Código de dois fatores inválido",
+	"login_challenge_expired":          "O início de sessão expirou, inicie sessão novamente",
+	"no_two_factor":                    "O utilizador não tem autenticação de dois fatores",
+	"two_factor_required":              "A autenticação de dois fatores é obrigatória, ative-a primeiro",
+	"password_change_required":         "Altere primeiro a sua palavra-passe",
+	"password_reset_throttled":         "Demasiados pedidos de reposição da palavra-passe, tente mais tarde",
+	"username_or_email":                "Indique um nome de utilizador ou um email",
+	"invalid_password_reset_link":      "Link de reposição da palavra-passe inválido ou expirado",
+	"password_reset_title":             "Repor a palavra-passe",
+	"new_password":                     "Nova palavra-passe",
+	"set_password":                     "Definir palavra-passe",
+	"password_reset_done":              "A sua palavra-passe foi alterada. Inicie sessão com a nova.",
+	"resident_not_found":               "Residente não encontrado",
+	"payment_not_found":                "Pagamento não encontrado",
+	"expense_not_found":                "Despesa não encontrada",
+	"expense_not_allocated":            "Despesa não repartida",
+	"announcement_not_found":           "Anúncio não encontrado",
+	"bank_account_not_found":           "Conta bancária não encontrada",
+	"bank_line_not_found":              "Movimento bancário não encontrado",
+	"invalid_condo_header":             "X-Condo-ID inválido",
+	"condo_header_mismatch":            "X-Condo-ID não corresponde ao condomínio do caminho",
+	"condo_not_found":                  "Condomínio não encontrado",
+	"condo_access_denied":              "Não tem acesso a este condomínio",
+	"condo_grant_not_found":            "O utilizador não tem acesso a este condomínio",
+	"condo_users_only_default":         "Os utilizadores e o início de sessão são servidos pelo condomínio principal",
+	"fee_schedule_not_found":           "Tabela de quotas não encontrada",
+	"reserve_rule_not_found":           "Regra do fundo de reserva não encontrada",
+	"budget_not_found":                 "Orçamento não encontrado",
+	"payment_plan_not_found":           "Plano de pagamento não encontrado",
+	"writeoff_not_found":               "Anulação de dívida não encontrada",
+	"assessment_not_found":             "Quota extraordinária não encontrada",
+	"unit_fraction_not_found":          "Permilagem da fração não encontrada",
+	"unit_not_found":                   "Fração não encontrada",
+	"document_not_found":               "Documento não encontrado",
+	"incident_not_found":               "Ocorrência não encontrada",
+	"task_not_found":                   "Tarefa não encontrada",
+	"saved_search_not_found":           "Pesquisa guardada não encontrada",
+	"maintenance_request_not_found":    "Pedido de manutenção não encontrado",
+	"expiry_item_not_found":            "Item a expirar não encontrado",
+	"expiry_not_suppressed":            "O item a expirar não está silenciado",
+	"invalid_document_id":              "ID de documento inválido",
+	"invalid_incident_id":              "ID de ocorrência inválido",
+	"invalid_task_id":                  "ID de tarefa inválido",
+	"invalid_saved_search_id":          "ID de pesquisa guardada inválido",
+	"invalid_saved_search_entity":      "Entidade inválida, deve ser residents, payments ou expenses",
+	"invalid_maintenance_request_id":   "ID de pedido de manutenção inválido",
+	"invalid_within_days":              "within_days deve ser um número de dias",
+	"trash_entry_not_found":            "Entrada do lixo não encontrada",
+	"user_not_found":                   "Utilizador não encontrado",
+	"attachment_not_found":             "Anexo não encontrado",
+	"custom_field_not_found":           "Campo personalizado não encontrado",
+	"email_template_not_found":         "Modelo de email não encontrado",
+	"token_not_found":                  "Token não encontrado ou já revogado",
+	"job_not_found":                    "Tarefa não encontrada",
+	"job_finished":                     "A tarefa já terminou",
+	"invalid_resident_id":              "ID de residente inválido",
+	"invalid_payment_id":               "ID de pagamento inválido",
+	"invalid_expense_id":               "ID de despesa inválido",
+	"invalid_announcement_id":          "ID de anúncio inválido",
+	"invalid_bank_account_id":          "ID de conta bancária inválido",
+	"invalid_bank_line_id":             "ID de movimento bancário inválido",
+	"invalid_condo_id":                 "ID de condomínio inválido",
+	"invalid_fee_schedule_id":          "ID de tabela de quotas inválido",
+	"invalid_reserve_rule_id":          "ID de regra do fundo de reserva inválido",
+	"invalid_payment_plan_id":          "ID de plano de pagamento inválido",
+	"invalid_writeoff_id":              "ID de anulação de dívida inválido",
+	"invalid_assessment_id":            "ID de quota extraordinária inválido",
+	"invalid_token_id":                 "ID de token inválido",
+	"invalid_trash_entry_id":           "ID de entrada do lixo inválido",
+	"invalid_user_id":                  "ID de utilizador inválido",
+	"invalid_job_id":                   "ID de tarefa inválido",
+	"invalid_attachment_id":            "ID de anexo inválido",
+	"invalid_custom_field_id":          "ID de campo personalizado inválido",
+	"bank_account_exists":              "Já existe uma conta bancária com este nome",
+	"condo_exists":                     "Já existe um condomínio com este nome",
+	"custom_field_exists":              "Já existe um campo personalizado com esta chave",
+	"custom_field_locked":              "A entidade, a chave e o tipo de um campo personalizado com valores não podem mudar",
+	"custom_field_has_values":          "O campo personalizado tem valores, apague-o com confirm=true para os remover",
+	"payment_reference_exists":         "Já existe um pagamento com esta referência",
+	"reserve_rule_exists":              "Já existe uma regra do fundo de reserva com início nesta data",
+	"cheque_only":                      "Só os pagamentos por cheque podem ser compensados ou devolvidos",
+	"email_not_configured":             "O email não está configurado",
+	"payment_details_not_configured":   "Os dados de pagamento não estão configurados",
+	"qr_euros_only":                    "Os códigos QR são só para pagamentos em euros",
+	"resident_no_email":                "O residente não tem endereço de email",
+	"receipts_opted_out":               "O residente optou por não receber recibos",
+	"resident_anonymized":              "O residente foi anonimizado",
+	"resident_already_anonymized":      "O residente já foi anonimizado",
+	"resident_owes_anonymize":          "O residente tem saldo em dívida, defina force para anonimizar mesmo assim",
+	"invalid_unsubscribe_link":         "Link de cancelamento inválido",
+	"unsubscribed_title":               "Subscrição cancelada",
+	"unsubscribed_receipts":            "Deixará de receber recibos de pagamento.",
+	"unsubscribed_reminders":           "Deixará de receber lembretes de pagamento.",
+	"unsubscribed_announcements":       "Deixará de receber avisos.",
+	"unsubscribed_statements":          "Deixará de receber extratos.",
+	"unsubscribed_all":                 "Deixará de receber qualquer mensagem do condomínio.",
+	"unsubscribe_all":                  "Deixar de receber todas as mensagens do condomínio",
+	"receipt_send_failed":              "Falha ao enviar o recibo",
+	"backup_failed":                    "A cópia de segurança falhou",
+	"sheets_not_configured":            "A integração com o Google Sheets não está configurada",
+	"backups_not_configured":           "As cópias de segurança não estão configuradas",
+	"stripe_not_configured":            "A integração com o Stripe não está configurada",
+	"inbound_mail_not_configured":      "O correio recebido não está configurado",
+	"invalid_inbound_mail_token":       "Token de correio recebido inválido",
+	"no_email_in_request":              "O pedido não contém nenhum email",
+	"invalid_email_message":            "Email inválido",
+	"no_interest_rate":                 "Nenhuma taxa de juro configurada",
+	"no_monthly_fee":                   "Nenhuma quota mensal ou tabela de quotas configurada",
+	"no_notification_channels":         "Nenhum canal de notificação configurado",
+	"checkout_no_resident":             "A sessão de pagamento não tem residente",
+	"invalid_event_payload":            "Evento inválido",
+	"import_file_too_large":            "O ficheiro de importação é demasiado grande",
+	"export_file_too_large":            "O ficheiro de exportação é demasiado grande",
+	"error_reading_import_file":        "Erro ao ler o ficheiro de importação",
+	"error_retrieving_import_file":     "Erro ao obter o ficheiro de importação",
+	"error_retrieving_before_file":     "Erro ao obter o ficheiro before",
+	"error_retrieving_after_file":      "Erro ao obter o ficheiro after",
+	"attachment_too_large":             "O anexo é demasiado grande",
+	"attachment_empty":                 "O anexo está vazio",
+	"attachment_type":                  "Tipo de anexo não suportado, deve ser PDF, JPEG, PNG, GIF, WebP ou texto simples",
+	"attachment_quota_exceeded":        "Quota de armazenamento de anexos excedida",
+	"error_retrieving_attachment_file": "Erro ao obter o ficheiro do anexo",
+	"invalid_import_file_format":       "Formato do ficheiro de importação inválido",
+	"invalid_export_file":              "Ficheiro de exportação inválido",
+	"statement_file_too_large":         "O extrato é demasiado grande",
+	"error_retrieving_statement_file":  "Erro ao obter o extrato",
+	"workbook_too_large":               "O livro é demasiado grande",
+	"error_retrieving_workbook":        "Erro ao obter o livro",
+	"error_reading_workbook":           "Erro ao ler o livro",
+	"invalid_workbook":                 "Livro inválido",
+	"invalid_mapping":                  "Mapeamento inválido",
+	"invalid_statement_file":           "Extrato inválido",
+	"import_successful":                "Importação da base de dados concluída",
+	"invalid_dry_run":                  "dry_run inválido, deve ser true ou false",
+	"invalid_fuzzy":                    "fuzzy inválido, deve ser true ou false",
+	"invalid_include_zero":             "include_zero inválido, deve ser true ou false",
+	"invalid_overdue":                  "overdue inválido, deve ser true ou false",
+	"invalid_check_only":               "check_only inválido, deve ser true ou false",
+	"invalid_refresh":                  "refresh inválido, deve ser true ou false",
+	"invalid_force":                    "force inválido, deve ser true ou false",
+	"invalid_summary":                  "summary inválido, deve ser true ou false",
+	"invalid_include_expenses":         "include inválido, deve ser expenses",
+	"manifest_mismatch":                "o ficheiro não corresponde ao seu manifesto, pode estar truncado ou editado",
+	"invalid_confirm":                  "confirm inválido, deve ser true ou false",
+	"invalid_format_json_csv":          "Formato inválido, deve ser json ou csv",
+	"invalid_format_json_pdf":          "Formato inválido, deve ser json ou pdf",
+	"invalid_format_json_ndjson":       "Formato inválido, deve ser json ou ndjson",
+	"invalid_format_json_png":          "Formato inválido, deve ser json ou png",
+	"not_acceptable_json_csv":          "Formato não aceitável, os formatos suportados são application/json e text/csv",
+	"invalid_receipt_email_status":     "Estado inválido, deve ser queued, sent, failed, skipped ou suppressed",
+	"receipt_needs_confirmed_payment":  "Só os pagamentos confirmados têm recibo",
+	"invalid_limit_100":                "Limite inválido, deve estar entre 1 e 100",
+	"invalid_limit_200":                "Limite inválido, deve estar entre 1 e 200",
+	"invalid_locale":                   "Locale inválido, deve ser en ou pt-PT",
+	"invalid_mode":                     "Modo inválido, deve ser replace ou merge",
+	"invalid_async":                    "async inválido, deve ser true ou false",
+	"payment_plan_active":              "O residente já tem um plano de pagamento ativo",
+	"writeoff_reversed":                "A anulação de dívida já foi revertida",
+	"assessment_paid":                  "A quota extraordinária tem pagamentos, só o nome pode mudar",
+	"assessment_paid_delete":           "A quota extraordinária tem pagamentos, não pode ser eliminada",
+	"unit_transferred_later":           "A fração já foi transmitida nesta data ou depois",
+	"transfer_moves_in_later":          "Alguém entra na fração na data da transmissão ou depois",
+	"new_owner_has_unit":               "O novo proprietário já vive ou viveu numa fração, adicione-o como new_owner",
+	"fractions_total":                  "As permilagens devem somar 1000",
+	"expense_shares_charged":           "As despesas repartidas do mês já foram cobradas",
+	"invalid_plan_status":              "Estado inválido, deve ser on_track, behind, completed ou defaulted",
+	"invalid_consistency_fix":          "Correção inválida, deve ser assign_unknown_resident ou backfill_defaults",
+	"consistency_fix_required":         "Indique pelo menos uma correção",
+	"invalid_change_type":              "Tipo inválido, deve ser resident, payment ou expense",
+	"invalid_change_action":            "Ação inválida, deve ser created, updated, deleted ou imported",
+	"invalid_bank_line_status":         "Estado inválido, deve ser unmatched, suggested, matched ou discrepancy",
+	"invalid_subtotals_category":       "Subtotais inválidos, deve ser category",
+	"unknown_report_column":            "Coluna de relatório desconhecida",
+	"duplicate_report_column":          "Coluna de relatório repetida",
+	"report_columns_empty":             "Colunas inválidas, deve indicar pelo menos uma coluna",
+	"invalid_subtotals_resident":       "Subtotais inválidos, deve ser resident",
+	"invalid_type":                     "Tipo inválido, deve ser resident, payment ou expense",
+	"search_query_required":            "A pesquisa é obrigatória",
+	"match_with_fuzzy":                 "match não pode ser combinado com fuzzy",
+	"saved_search_exists":              "Já existe uma pesquisa guardada com este nome",
+	"report_schedule_not_found":        "Agendamento de relatório não encontrado",
+	"invalid_report_schedule_id":       "ID de agendamento de relatório inválido",
+	"report_schedule_exists":           "Já existe um agendamento de relatório com este nome",
+	"invalid_report_run_status":        "Estado inválido, deve ser success, failed ou missed",
+	"invalid_as_of":                    "formato de as_of inválido, deve ser AAAA-MM-DD",
+	"invalid_date":                     "formato de data inválido, deve ser AAAA-MM-DD",
+	"invalid_start_date":               "formato da data de início inválido, deve ser AAAA-MM-DD",
+	"invalid_end_date":                 "formato da data de fim inválido, deve ser AAAA-MM-DD",
+	"invalid_month":                    "formato do mês inválido, deve ser AAAA-MM",
+	"invalid_charge_month":             "formato de charge_month inválido, deve ser AAAA-MM",
+	"invalid_on":                       "formato de on inválido, deve ser AAAA-MM-DD",
+	"on_or_month":                      "Indique on ou month, não ambos",
+	"invalid_year":                     "ano inválido, deve ser AAAA",
+	"start_date_required":              "start_date é obrigatório, como AAAA-MM-DD",
+	"end_date_required":                "end_date é obrigatório, como AAAA-MM-DD",
+	"end_date_before_start_date":       "end_date não pode ser anterior a start_date",
+	"end_month_before_start_month":     "end_month não pode ser anterior a start_month",
+	"format_ofx_qif":                   "o formato deve ser ofx ou qif",
+	"ids_or_filter":                    "é obrigatório indicar ids ou filter, mas não ambos",
+	"name_required":                    "o nome é obrigatório",
+	"payee_required":                   "o beneficiário é obrigatório",
+	"payee_too_long":                   "o beneficiário deve ter no máximo 70 caracteres",
+	"saved_search_name_too_long":       "o nome deve ter no máximo 100 caracteres",
+	"saved_search_entity_invalid":      "a entidade deve ser residents, payments ou expenses",
+	"unsupported_search_param":         "parâmetro de pesquisa não suportado",
+	"report_format_invalid":            "format deve ser csv, pdf ou xlsx",
+	"cron_and_day_of_month":            "cron e day_of_month não podem ser ambos indicados",
+	"time_needs_day_of_month":          "time só se aplica com day_of_month",
+	"cron_invalid":                     "expressão cron inválida, deve ter cinco campos: minuto hora dia mês dia-da-semana",
+	"cron_never_matches":               "a expressão cron nunca corresponde a uma data",
+	"day_of_month_range":               "day_of_month deve estar entre 1 e 28",
+	"time_invalid":                     "formato de hora inválido, deve ser HH:MM",
+	"cron_or_day_of_month_required":    "é obrigatório indicar cron ou day_of_month",
+	"recipients_required":              "é obrigatório pelo menos um destinatário",
+	"report_invalid":                   "report deve ser income_expense, payments, expenses ou aging",
+	"report_period_invalid":            "period deve ser previous_month ou month_to_date",
+	"report_period_not_applicable":     "period só se aplica a relatórios de um período",
+	"unsupported_report_param":         "parâmetro de relatório não suportado",
+	"search_residents_query_required":  "q é obrigatório para pesquisar residentes",
+	"search_resident_id_number":        "resident_id deve ser um número",
+	"iban_invalid":                     "o IBAN não é válido",
+	"bic_invalid":                      "o BIC deve ter 8 ou 11 letras e algarismos",
+	"unit_required":                    "a fração é obrigatória",
+	"description_required":             "a descrição é obrigatória",
+	"title_required":                   "o título é obrigatório",
+	"reason_required":                  "o motivo é obrigatório",
+	"legal_basis_required":             "legal_basis é obrigatório",
+	"filter_field_required":            "o filtro deve definir pelo menos um campo",
+	"patch_category_required":          "patch deve definir category",
+	"filter_ids_or_resident":           "o filtro deve definir ids ou resident_id",
+	"filter_dates_with_resident":       "as datas só se aplicam com resident_id",
+	"target_resident_required":         "target_resident_id é obrigatório",
+	"target_resident_same":             "target_resident_id deve ser diferente do resident_id do filtro",
+	"target_resident_exists":           "target_resident_id deve ser um residente existente",
+	"writeoff_exceeds_balance":         "o valor não pode exceder o que o residente deve",
+	"decision_required":                "a decisão é obrigatória",
+	"new_owner_or_resident":            "indique new_resident_id ou new_owner, não ambos",
+	"transfer_balance_invalid":         "balance deve ser freeze ou carry",
+	"document_kind_invalid":            "kind deve ser contract, insurance, inspection ou other",
+	"expires_on_invalid":               "expires_on deve ser uma data, AAAA-MM-DD",
+	"location_required":                "o local é obrigatório",
+	"incident_severity_invalid":        "severity deve ser low, medium, high ou critical",
+	"incident_resolved_on_open":        "resolved_on só se aplica a ocorrências resolvidas",
+	"incident_resolved_on_before":      "resolved_on não pode ser anterior a incident_date",
+	"incident_status_invalid":          "status deve ser open ou resolved",
+	"reported_by_resident":             "reported_by deve ser um residente existente",
+	"expense_ids_exist":                "expense_ids devem ser despesas existentes",
+	"task_completed_on_open":           "completed_on só se aplica a tarefas concluídas",
+	"task_status_invalid":              "status deve ser open ou done",
+	"task_entity_type_invalid":         "entity_type deve ser incident, maintenance_request, document, expense, resident ou announcement, com um entity_id",
+	"assignee_user_exists":             "assignee_user_id deve ser um utilizador existente",
+	"task_entity_exists":               "entity_id deve ser um registo existente de entity_type",
+	"maintenance_status_invalid":       "status deve ser open, in_progress ou closed",
+	"resident_id_exists":               "resident_id deve ser um residente existente",
+	"username_required":                "o nome de utilizador é obrigatório",
+	"username_spaces":                  "o nome de utilizador não pode conter espaços",
+	"role_invalid":                     "o perfil deve ser admin, treasurer ou viewer",
+	"email_invalid":                    "formato de email inválido",
+	"current_password_incorrect":       "current_password está incorreta",
+	"password_unchanged":               "new_password tem de ser diferente da palavra-passe atual",
+	"notify_channel_invalid":           "o canal de notificação deve ser email, sms ou none",
+	"receipts_channel_invalid":         "os recibos devem ser email ou none",
+	"statements_channel_invalid":       "os extratos devem ser email ou none",
+	"reminders_channel_invalid":        "os lembretes devem ser email, sms ou none",
+	"announcements_channel_invalid":    "os avisos devem ser email, sms ou none",
+	"notify_channel_mismatch":          "notify_channel deve coincidir com notifications.reminders",
+	"move_out_before_move_in":          "move_out_date deve ser posterior a move_in_date",
+	"resident_required":                "o residente é obrigatório",
+	"resident_missing":                 "o residente não existe",
+	"amount_positive":                  "o valor deve ser superior a zero",
+	"amount_nonzero":                   "o valor não pode ser zero",
+	"payment_date_required":            "a data do pagamento é obrigatória",
+	"expense_date_required":            "a data da despesa é obrigatória",
+	"method_invalid":                   "o método deve ser cash, transfer, card ou check",
+	"cheque_details_only_check":        "os dados do cheque são apenas para pagamentos por cheque",
+	"cheque_status_invalid":            "o estado do cheque deve ser pending, cleared ou bounced",
+	"cheque_status_date_required":      "a data do estado do cheque é obrigatória, como AAAA-MM-DD",
+	"cheque_pending_no_date":           "um cheque pendente não tem data de estado",
+	"cheque_before_payment":            "um cheque não pode ser compensado ou devolvido antes da data do pagamento",
+	"only_confirmed_allocated":         "só os pagamentos confirmados podem ser imputados",
+	"currency_invalid":                 "a moeda deve ser um código ISO 4217 de 3 letras",
+	"original_amount_required":         "o valor original é obrigatório para uma moeda diferente da base",
+	"exchange_rate_required":           "a taxa de câmbio é obrigatória para uma moeda diferente da base",
+	"amount_exchange_mismatch":         "o valor deve ser original_amount vezes exchange_rate",
+	"tax_rate_range":                   "a taxa de imposto deve estar entre 0 e 100",
+	"tax_amount_negative":              "o valor do imposto não pode ser negativo",
+	"tax_amount_needs_rate":            "o valor do imposto exige uma taxa de imposto",
+	"percent_range":                    "a percentagem deve estar entre 0 e 100",
+	"installment_amount_cover":         "installment_amount vezes installments deve cobrir total_amount, deixando uma última prestação",
+	"installment_amount_negative":      "installment_amount não pode ser negativo",
+	"category_required":                "a categoria é obrigatória",
+	"amount_negative":                  "o valor não pode ser negativo",
+	"budget_months_invalid":            "months devem ser meses AAAA-MM do ano fiscal",
+	"budget_month_negative":            "os orçamentos mensais não podem ser negativos",
+	"assessment_allocation_invalid":    "allocation deve ser equal, fraction ou custom",
+	"shares_negative":                  "shares não podem ser negativos",
+	"shares_total":                     "shares devem somar total_amount",
+	"shares_custom_only":               "shares só são indicados com a repartição custom",
+	"shares_units":                     "shares devem ser de frações com residente na data de vencimento",
+	"assessment_no_residents":          "nenhum residente vive numa fração na data de vencimento",
+	"assessment_no_fractions":          "nenhuma fração com residente tem permilagem",
+	"permilage_range":                  "a permilagem deve ser maior que zero e no máximo 1000",
+	"start_month_invalid":              "start_month deve ser um mês, AAAA-MM",
+	"plan_installments_range":          "installments deve estar entre 1 e 120",
+	"plan_total_positive":              "total_amount deve ser superior a zero",
+	"effective_from_invalid":           "effective_from deve ser um mês, AAAA-MM",
+	"effective_to_invalid":             "effective_to deve ser um mês, AAAA-MM",
+	"effective_to_before_from":         "effective_to não pode ser anterior a effective_from",
+	"unit_or_resident_required":        "é obrigatório indicar unit ou resident_id",
+	"unit_and_resident":                "indique unit ou resident_id, mas não ambos",
+	"expires_in_days_range":            "expires_in_days deve estar entre 1 e 366",
+	"bank_action_invalid":              "a ação deve ser confirm, create, flag ou reject",
+	"bank_no_suggestion":               "o movimento não tem correspondência sugerida, entity_type e entity_id são obrigatórios",
+	"bank_category_required":           "a categoria é obrigatória para criar uma despesa",
+	"bank_note_required":               "a nota é obrigatória para assinalar uma discrepância",
+	"custom_entity_invalid":            "a entidade deve ser resident",
+	"custom_key_invalid":               "a chave deve ter letras minúsculas, algarismos e sublinhados, começando por uma letra",
+	"label_required":                   "o rótulo é obrigatório",
+	"custom_type_invalid":              "o tipo deve ser text, number, date ou bool",
+	"custom_field_unknown":             "campo personalizado desconhecido",
+	"custom_value_text":                "o valor personalizado deve ser texto",
+	"custom_value_number":              "o valor personalizado deve ser um número",
+	"custom_value_date":                "o valor personalizado deve ser uma data, AAAA-MM-DD",
+	"custom_value_bool":                "o valor personalizado deve ser true ou false",
+	"subject_required":                 "o assunto é obrigatório",
+	"body_required":                    "o corpo é obrigatório",
+	"statement_month":                  "%s de %d",
+	"statement_title":                  "Extrato %s",
+	"statement_through":                "até %s",
+	"statement_unit":                   "Fração %s",
+	"statement_issued":                 "Valores em %s. Emitido a %s.",
+	"statement_date":                   "Data",
+	"statement_description":            "Descrição",
+	"statement_charge":                 "Débito",
+	"statement_payment":                "Pagamento",
+	"statement_credit":                 "Crédito",
+	"statement_written_off":            "Anulado",
+	"statement_balance":                "Saldo",
+	"statement_opening_balance":        "Saldo inicial",
+	"statement_month_total":            "Total do mês",
+	"statement_total":                  "Total",
+	"statement_closing_balance":        "Saldo final: %.2f %s",
+	"statement_credit_note":            "Um saldo negativo é um crédito a favor do residente.",
+	"incident_title":                   "Relatório de ocorrência n.º %d",
+	"incident_date":                    "Data: %s",
+	"incident_location":                "Local: %s",
+	"incident_severity":                "Gravidade: %s",
+	"incident_resolved":                "Resolvida a %s",
+	"incident_open":                    "Em aberto",
+	"incident_reported_by":             "Comunicada por: %s",
+	"incident_description":             "Descrição",
+	"incident_costs":                   "Custos",
+	"incident_no_costs":                "Sem custos registados.",
+	"incident_total_cost":              "Custo total: %.2f %s",
+	"incident_photos":                  "Fotografias",
+	"incident_attachments":             "Outros anexos",
+	"payment_request_title":            "Pagamento da fração %s, %s de %d",
+	"payment_request_amount":           "Valor: %.2f %s",
+	"payment_request_payee":            "Beneficiário: %s",
+	"payment_request_iban":             "IBAN: %s",
+	"payment_request_bic":              "BIC: %s",
+	"payment_request_reference":        "Referência: %s",
+	"payment_request_note":             "Indique a referência para que o pagamento seja reconhecido.",
+	"receipt_title":                    "Recibo n.º %d",
+	"receipt_received":                 "Recebemos %.2f %s a %s.",
+	"receipt_description":              "Descrição: %s",
+	"receipt_method":                   "Meio de pagamento: %s",
+	"receipt_reference":                "Referência: %s",
+	"receipt_issued":                   "Emitido a %s.",
+	"month_january":                    "janeiro",
+	"month_february":                   "fevereiro",
+	"month_march":                      "março",
+	"month_april":                      "abril",
+	"month_may":                        "maio",
+	"month_june":                       "junho",
+	"month_july":                       "julho",
+	"month_august":                     "agosto",
+	"month_september":                  "setembro",
+	"month_october":                    "outubro",
+	"month_november":                   "novembro",
+	"month_december":                   "dezembro",
+	"report_rows":                      "Linhas",
+	"report_total":                     "Total",
+	"report_column_id":                 "ID",
+	"report_column_resident_id":        "ID do residente",
+	"report_column_resident":           "Residente",
+	"report_column_unit":               "Fração",
+	"report_column_email":              "Email",
+	"report_column_contact":            "Contacto",
+	"report_column_amount":             "Valor",
+	"report_column_description":        "Descrição",
+	"report_column_date":               "Data",
+	"report_column_method":             "Método",
+	"report_column_status":             "Estado",
+	"report_column_reference":          "Referência",
+	"report_column_bank_reference":     "Referência bancária",
+	"report_column_cheque_number":      "Número do cheque",
+	"report_column_cheque_bank":        "Banco do cheque",
+	"report_column_cheque_status":      "Estado do cheque",
+	"report_column_created":            "Criado",
+	"report_column_updated":            "Atualizado",
+	"report_column_category":           "Categoria",
+	"report_column_original_amount":    "Valor original",
+	"report_column_currency":           "Moeda",
+	"report_column_exchange_rate":      "Taxa de câmbio",
+	"report_column_tax_rate":           "Taxa de IVA",
+	"report_column_tax_amount":         "Valor do IVA",
+	"report_column_net_amount":         "Valor líquido",
+	"report_column_units":              "Frações",
+	"report_column_month":              "Mês",
+	"report_column_expenses":           "Despesas",
+}
+
+// messageIDs finds the id of an English message, as handlers write them
+var messageIDs = func() map[string]string {
+	ids := make(map[string]string, len(catalogEnglish))
+	for id, message := range catalogEnglish {
+		ids[message] = id
+	}
+	return ids
+}()
+
+// statusCodes are the codes of errors whose message has no id
+var statusCodes = map[int]string{
+	http.StatusBadRequest:            "bad_request",
+	http.StatusUnauthorized:          "unauthorized",
+	http.StatusForbidden:             "forbidden",
+	http.StatusNotFound:              "not_found",
+	http.StatusMethodNotAllowed:      "method_not_allowed",
+	http.StatusConflict:              "conflict",
+	http.StatusRequestEntityTooLarge: "payload_too_large",
+	http.StatusUnsupportedMediaType:  "unsupported_media_type",
+	http.StatusUnprocessableEntity:   "validation_failed",
+	http.StatusTooManyRequests:       "too_many_requests",
+	http.StatusServiceUnavailable:    "unavailable",
+	http.StatusInsufficientStorage:   "insufficient_storage",
+}
+
+// validLanguage reports whether messages can be translated to lang
+func validLanguage(lang string) bool {
+	_, ok := catalogs[lang]
+	return ok
+}
+
+// requestLanguage picks the language of a response: the lang parameter, then
+// the best supported language of the Accept-Language header, then the default
+func requestLanguage(r *http.Request) string {
+	if lang := strings.ToLower(r.URL.Query().Get("lang")); validLanguage(lang) {
+		return lang
+	}
+
+	type choice struct {
+		lang    string
+		quality float64
+	}
+	var choices []choice
+	for _, part := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		primary, _, _ := strings.Cut(strings.ToLower(tag), "-")
+		if !validLanguage(primary) {
+			continue
+		}
+		quality := 1.0
+		if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			var err error
+			if quality, err = strconv.ParseFloat(value, 64); err != nil {
+				continue
+			}
+		}
+		if quality > 0 {
+			choices = append(choices, choice{primary, quality})
+		}
+	}
+	sort.SliceStable(choices, func(i, j int) bool { return choices[i].quality > choices[j].quality })
+	if len(choices) > 0 {
+		return choices[0].lang
+	}
+	return defaultLanguage
+}
+
+// withLanguage records the language of each response in its Content-Language
+// header, where respondWithError finds it
+func withLanguage(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Language", requestLanguage(r))
+		next.ServeHTTP(w, r)
+	})
+}
+
+// responseLanguage is the language chosen for a response by withLanguage
+func responseLanguage(w http.ResponseWriter) string {
+	if lang := w.Header().Get("Content-Language"); validLanguage(lang) {
+		return lang
+	}
+	return defaultLanguage
+}
+
+// message returns the message with an id in lang, or in English if it has no
+// translation
+func message(lang, id string) string {
+	if text := catalogs[lang][id]; text != "" {
+		return text
+	}
+	return catalogEnglish[id]
+}
+
+// translate returns the id of an English message and the message in lang.
+// Messages with details after a colon, such as "Invalid request payload: EOF",
+// are translated up to the colon. Messages without an id have an empty id
+// and are returned as they are.
+func translate(lang, text string) (string, string) {
+	if id, ok := messageIDs[text]; ok {
+		return id, message(lang, id)
+	}
+	if head, detail, ok := strings.Cut(text, ": "); ok {
+		if id, ok := messageIDs[head]; ok {
+			return id, message(lang, id) + ": " + detail
+		}
+	}
+	return "", text
+}
+
+// localize translates a message to the language of a response
+func localize(w http.ResponseWriter, text string) string {
+	_, translated := translate(responseLanguage(w), text)
+	return translated
+}
+
+// reportLabel is a label of a CSV report in lang, by its id: "column_" and
+// the name of a column for its header, "rows" or "total" for a line of the
+// footer. Labels without a message, such as the headers of custom fields,
+// are kept as they are.
+func reportLabel(lang, id, label string) string {
+	if text := message(lang, "report_"+id); text != "" {
+		return text
+	}
+	return label
+}
+
+// monthName is the name of a month in lang
+func monthName(lang string, month time.Month) string {
+	return message(lang, "month_"+strings.ToLower(month.String()))
+}
@@ -0,0 +1,106 @@
+package condomngr
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInsertBatchedStaysUnderBindLimit(t *testing.T) {
+	db, err := OpenDB(filepath.Join(t.TempDir(), "condo.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, columns := range []int{1, 8, 12} {
+		tx, err := db.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tx.Exec("CREATE TEMP TABLE wide(" + columnList(columns) + ")"); err != nil {
+			t.Fatal(err)
+		}
+		row := make([]interface{}, columns)
+		for i := range row {
+			row[i] = i
+		}
+		total := 0
+		err = insertBatched(tx, "INSERT INTO wide", "", 2500, func(int) []interface{} { return row }, func(rows int) {
+			if rows*columns > maxBindVariables {
+				t.Errorf("%d columns: batch of %d rows binds %d variables", columns, rows, rows*columns)
+			}
+			total += rows
+		})
+		if err != nil {
+			t.Fatalf("%d columns: %v", columns, err)
+		}
+		var count int
+		if err := tx.QueryRow("SELECT COUNT(*) FROM wide").Scan(&count); err != nil {
+			t.Fatal(err)
+		}
+		if count != 2500 || total != 2500 {
+			t.Errorf("%d columns: inserted %d rows, reported %d", columns, count, total)
+		}
+		tx.Rollback()
+	}
+}
+
+// columnList names columns c0, c1 and so on
+func columnList(columns int) string {
+	names := make([]string, columns)
+	for i := range names {
+		names[i] = fmt.Sprint("c", i)
+	}
+	return strings.Join(names, ", ")
+}
+
+func TestImportLargeExport(t *testing.T) {
+	db, err := OpenDB(filepath.Join(t.TempDir(), "condo.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	const residents, payments = 500, 50000
+	var data ExportData
+	for i := 1; i <= residents; i++ {
+		data.Residents = append(data.Residents, Resident{ID: i, Name: fmt.Sprint("Resident ", i), Unit: fmt.Sprint("U", i)})
+	}
+	for i := 1; i <= payments; i++ {
+		data.Payments = append(data.Payments, Payment{
+			ID: i, ResidentID: i%residents + 1, Amount: float64(i%100 + 1), Description: "Monthly dues",
+			PaymentDate: time.Date(2020, 1, 1+i%1800, 0, 0, 0, 0, time.UTC).Format("2006-01-02"),
+		})
+	}
+
+	progress := 0
+	start := time.Now()
+	if err := importAllContext(context.Background(), db, data, ImportModeReplace, paymentRules{allocation: AllocationFIFO}, func(inserted int) { progress = inserted }); err != nil {
+		t.Fatal(err)
+	}
+	// A row at a time this took minutes; batched it takes a few seconds at
+	// most even on a slow machine
+	if elapsed := time.Since(start); elapsed > 30*time.Second {
+		t.Errorf("importing %d payments took %v", payments, elapsed)
+	}
+
+	var count int
+	var total float64
+	if err := db.QueryRow("SELECT COUNT(*), SUM(amount) FROM payments").Scan(&count, &total); err != nil {
+		t.Fatal(err)
+	}
+	// Each of the 500 runs of 100 payments adds up to 1 + 2 + ... + 100
+	if count != payments || total != payments/100*5050 {
+		t.Errorf("imported %d payments of %.2f, want %d of %d", count, total, payments, payments/100*5050)
+	}
+	if err := db.QueryRow("SELECT COUNT(*) FROM residents").Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != residents || progress != residents+payments {
+		t.Errorf("imported %d residents, progress %d", count, progress)
+	}
+}
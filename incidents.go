@@ -0,0 +1,535 @@
+package condomngr
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Incident severities
+const (
+	SeverityLow      = "low"
+	SeverityMedium   = "medium"
+	SeverityHigh     = "high"
+	SeverityCritical = "critical"
+)
+
+// Incident states
+const (
+	IncidentOpen     = "open"
+	IncidentResolved = "resolved"
+)
+
+// Incident is damage or trouble in a common area, such as a leak in the
+// garage or vandalism in the lobby, kept as a paper trail for insurance
+// claims. Its cost is the total of the expenses linked to it.
+type Incident struct {
+	ID           int       `json:"id"`
+	IncidentDate string    `json:"incident_date"`
+	Location     string    `json:"location"`
+	Description  string    `json:"description"`
+	Severity     string    `json:"severity"`
+	ReportedBy   *int      `json:"reported_by"` // resident id, if a resident reported it
+	Status       string    `json:"status"`      // IncidentOpen if empty
+	ResolvedOn   string    `json:"resolved_on"` // YYYY-MM-DD, only once resolved; today if empty
+	ExpenseIDs   []int     `json:"expense_ids"`
+	TotalCost    float64   `json:"total_cost"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// IncidentExpense is an expense linked to an incident
+type IncidentExpense struct {
+	ID          int     `json:"id"`
+	Description string  `json:"description"`
+	Category    string  `json:"category"`
+	Amount      float64 `json:"amount"`
+	ExpenseDate string  `json:"expense_date"`
+}
+
+// IncidentDetails is an incident with who reported it, its expenses and its
+// attachments
+type IncidentDetails struct {
+	Incident
+	ReportedByName string            `json:"reported_by_name"`
+	Expenses       []IncidentExpense `json:"expenses"`
+	Attachments    []Attachment      `json:"attachments"`
+}
+
+// The total cost is left to loadIncidentLinks
+const incidentColumns = "id, incident_date, location, description, severity, reported_by, status, resolved_on, created_at, updated_at"
+
+func scanIncident(row interface{ Scan(...interface{}) error }) (Incident, error) {
+	i := Incident{ExpenseIDs: []int{}}
+	var reportedBy sql.NullInt64
+	err := row.Scan(&i.ID, &i.IncidentDate, &i.Location, &i.Description, &i.Severity, &reportedBy, &i.Status, &i.ResolvedOn, &i.CreatedAt, &i.UpdatedAt)
+	if reportedBy.Valid {
+		id := int(reportedBy.Int64)
+		i.ReportedBy = &id
+	}
+	return i, err
+}
+
+// Validation function for Incident data
+func validateIncident(i Incident) error {
+	var errs ValidationErrors
+	if _, err := time.Parse("2006-01-02", i.IncidentDate); err != nil {
+		errs.Add("incident_date", "invalid date format, must be YYYY-MM-DD")
+	}
+	if i.Location == "" {
+		errs.Add("location", "location is required")
+	}
+	if i.Description == "" {
+		errs.Add("description", "description is required")
+	}
+	switch i.Severity {
+	case SeverityLow, SeverityMedium, SeverityHigh, SeverityCritical:
+	default:
+		errs.Add("severity", "severity must be one of low, medium, high or critical")
+	}
+	switch i.Status {
+	case IncidentOpen:
+		if i.ResolvedOn != "" {
+			errs.Add("resolved_on", "resolved_on is only for resolved incidents")
+		}
+	case IncidentResolved:
+		if _, err := time.Parse("2006-01-02", i.ResolvedOn); err != nil {
+			errs.Add("resolved_on", "invalid date format, must be YYYY-MM-DD")
+		} else if i.ResolvedOn < i.IncidentDate {
+			errs.Add("resolved_on", "resolved_on must not be before incident_date")
+		}
+	default:
+		errs.Add("status", "status must be open or resolved")
+	}
+	return errs.Err()
+}
+
+// loadIncidentLinks fills in the linked expenses of incidents and their total
+func loadIncidentLinks(q querier, incidents []Incident) error {
+	for i := range incidents {
+		rows, err := q.Query(`
+			SELECT l.expense_id, COALESCE(e.amount, 0) FROM incident_expenses l LEFT JOIN expenses e ON e.id = l.expense_id
+			WHERE l.incident_id = ? ORDER BY l.expense_id
+		`, incidents[i].ID)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var id int
+			var amount float64
+			if err := rows.Scan(&id, &amount); err != nil {
+				rows.Close()
+				return err
+			}
+			incidents[i].ExpenseIDs = append(incidents[i].ExpenseIDs, id)
+			incidents[i].TotalCost = roundCents(incidents[i].TotalCost + amount)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadIncidentDetails returns an incident with its expenses and attachments
+func loadIncidentDetails(q querier, id int) (IncidentDetails, error) {
+	incident, err := scanIncident(q.QueryRow("SELECT "+incidentColumns+" FROM incidents WHERE id = ?", id))
+	if err != nil {
+		return IncidentDetails{}, err
+	}
+	incidents := []Incident{incident}
+	if err := loadIncidentLinks(q, incidents); err != nil {
+		return IncidentDetails{}, err
+	}
+	d := IncidentDetails{Incident: incidents[0], Expenses: []IncidentExpense{}, Attachments: []Attachment{}}
+	if d.ReportedBy != nil {
+		err := q.QueryRow("SELECT name FROM residents WHERE id = ?", *d.ReportedBy).Scan(&d.ReportedByName)
+		if err != nil && err != sql.ErrNoRows {
+			return d, err
+		}
+	}
+
+	rows, err := q.Query(`
+		SELECT e.id, e.description, e.category, e.amount, substr(e.expense_date, 1, 10)
+		FROM incident_expenses l JOIN expenses e ON e.id = l.expense_id
+		WHERE l.incident_id = ? ORDER BY e.expense_date, e.id
+	`, id)
+	if err != nil {
+		return d, err
+	}
+	for rows.Next() {
+		var e IncidentExpense
+		if err := rows.Scan(&e.ID, &e.Description, &e.Category, &e.Amount, &e.ExpenseDate); err != nil {
+			rows.Close()
+			return d, err
+		}
+		d.Expenses = append(d.Expenses, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return d, err
+	}
+
+	rows, err = q.Query("SELECT "+attachmentColumns+" FROM attachments WHERE entity_type = 'incident' AND entity_id = ? ORDER BY id", id)
+	if err != nil {
+		return d, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		a, err := scanAttachmentRow(rows)
+		if err != nil {
+			return d, err
+		}
+		d.Attachments = append(d.Attachments, a)
+	}
+	return d, rows.Err()
+}
+
+// saveIncident inserts an incident, or updates it if it has an id, and
+// replaces the expenses linked to it. It returns a ValidationErrors when the
+// reporting resident or an expense doesn't exist, and sql.ErrNoRows when
+// the incident doesn't.
+func saveIncident(db *sql.DB, i *Incident) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var errs ValidationErrors
+	if i.ReportedBy != nil {
+		var exists bool
+		if err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM residents WHERE id = ?)", *i.ReportedBy).Scan(&exists); err != nil {
+			return err
+		}
+		if !exists {
+			errs.Add("reported_by", "reported_by must be an existing resident")
+		}
+	}
+	linked := map[int]bool{}
+	for _, id := range i.ExpenseIDs {
+		var exists bool
+		if err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM expenses WHERE id = ?)", id).Scan(&exists); err != nil {
+			return err
+		}
+		if !exists {
+			errs.Add("expense_ids", "expense_ids must be existing expenses")
+			break
+		}
+		linked[id] = true
+	}
+	if err := errs.Err(); err != nil {
+		return err
+	}
+
+	if i.ID == 0 {
+		result, err := tx.Exec("INSERT INTO incidents(incident_date, location, description, severity, reported_by, status, resolved_on) VALUES(?, ?, ?, ?, ?, ?, ?)",
+			i.IncidentDate, i.Location, i.Description, i.Severity, i.ReportedBy, i.Status, i.ResolvedOn)
+		if err != nil {
+			return err
+		}
+		id, err := result.LastInsertId()
+		if err != nil {
+			return err
+		}
+		i.ID = int(id)
+	} else {
+		result, err := tx.Exec("UPDATE incidents SET incident_date = ?, location = ?, description = ?, severity = ?, reported_by = ?, status = ?, resolved_on = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?",
+			i.IncidentDate, i.Location, i.Description, i.Severity, i.ReportedBy, i.Status, i.ResolvedOn, i.ID)
+		if err != nil {
+			return err
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			return sql.ErrNoRows
+		}
+		if _, err := tx.Exec("DELETE FROM incident_expenses WHERE incident_id = ?", i.ID); err != nil {
+			return err
+		}
+	}
+	for id := range linked {
+		if _, err := tx.Exec("INSERT INTO incident_expenses(incident_id, expense_id) VALUES(?, ?)", i.ID, id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// incidentPDF lays out an incident report for the insurer as a PDF document,
+// labelled in lang: the details, the photos attached and the costs
+func incidentPDF(store *AttachmentStore, d IncidentDetails, currency, lang string, cal calendar) *pdfDocument {
+	label := func(id string, args ...interface{}) string {
+		return fmt.Sprintf(message(lang, id), args...)
+	}
+
+	doc := newPDFDocument()
+	doc.Line(pdfBold, 16, label("incident_title", d.ID))
+	doc.Space(6)
+	doc.Line(pdfRegular, 10, label("incident_date", d.IncidentDate))
+	doc.Line(pdfRegular, 10, label("incident_location", d.Location))
+	doc.Line(pdfRegular, 10, label("incident_severity", d.Severity))
+	if d.Status == IncidentResolved {
+		doc.Line(pdfRegular, 10, label("incident_resolved", d.ResolvedOn))
+	} else {
+		doc.Line(pdfRegular, 10, label("incident_open"))
+	}
+	if d.ReportedByName != "" {
+		doc.Line(pdfRegular, 10, label("incident_reported_by", d.ReportedByName))
+	}
+	doc.Space(6)
+	doc.Line(pdfRegular, 9, label("statement_issued", currency, cal.today()))
+	doc.Space(10)
+
+	doc.Line(pdfBold, 11, label("incident_description"))
+	doc.Paragraph(pdfRegular, 10, d.Description)
+	doc.Space(10)
+
+	doc.Line(pdfBold, 11, label("incident_costs"))
+	if len(d.Expenses) == 0 {
+		doc.Line(pdfRegular, 10, label("incident_no_costs"))
+	}
+	for _, e := range d.Expenses {
+		description := e.Description
+		if len([]rune(description)) > 40 {
+			description = string([]rune(description)[:39]) + "…"
+		}
+		doc.Line(pdfMono, 9, fmt.Sprintf("%-10s  %-40s %-14s %10.2f", e.ExpenseDate, description, e.Category, e.Amount))
+	}
+	doc.Line(pdfBold, 11, label("incident_total_cost", d.TotalCost, currency))
+
+	// Photos are drawn one below the other; other files, and pictures that
+	// can't be read, are listed by name
+	var others []string
+	photos := false
+	for _, a := range d.Attachments {
+		if strings.HasPrefix(a.ContentType, "image/") {
+			if data, err := os.ReadFile(store.path(a.SHA256)); err == nil {
+				if img, err := newPDFImage(data); err == nil {
+					if !photos {
+						doc.Space(10)
+						doc.Line(pdfBold, 11, label("incident_photos"))
+						photos = true
+					}
+					doc.Space(4)
+					doc.Line(pdfRegular, 9, a.Filename)
+					doc.Image(img, pdfPageWidth-2*pdfMargin, 320)
+					continue
+				}
+			}
+		}
+		others = append(others, a.Filename)
+	}
+	if len(others) > 0 {
+		doc.Space(10)
+		doc.Line(pdfBold, 11, label("incident_attachments"))
+		for _, name := range others {
+			doc.Line(pdfRegular, 10, name)
+		}
+	}
+	return doc
+}
+
+// Handlers for incident endpoints
+
+// Get the incidents, newest first, filtered by status, severity and dates
+func getIncidents(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := checkQueryParams(r, "status", "severity", "start_date", "end_date"); err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		filter, err := incidentFilter(r)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		rows, err := db.Query("SELECT "+incidentColumns+" FROM incidents"+filter.where()+" ORDER BY incident_date DESC, id DESC", filter.args...)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		incidents := []Incident{}
+		for rows.Next() {
+			i, err := scanIncident(rows)
+			if err != nil {
+				rows.Close()
+				respondWithError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			incidents = append(incidents, i)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if err := loadIncidentLinks(db, incidents); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		respondWithJSON(w, http.StatusOK, incidents)
+	}
+}
+
+// Get an incident with its expenses and attachments, as json (the default)
+// or as a pdf report for the insurer
+func getIncident(db *sql.DB, store *AttachmentStore, currency string, cal calendar) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id, err := strconv.Atoi(vars["id"])
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid incident ID")
+			return
+		}
+		if err := checkQueryParams(r, "format"); err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		format := r.URL.Query().Get("format")
+		if format != "" && format != "json" && format != "pdf" {
+			respondWithError(w, http.StatusBadRequest, "Invalid format, must be json or pdf")
+			return
+		}
+
+		details, err := loadIncidentDetails(db, id)
+		if err == sql.ErrNoRows {
+			respondWithError(w, http.StatusNotFound, "Incident not found")
+			return
+		}
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		if format == "pdf" {
+			w.Header().Set("Content-Type", "application/pdf")
+			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=incident_%d.pdf", id))
+			w.WriteHeader(http.StatusOK)
+			incidentPDF(store, details, currency, responseLanguage(w), cal).WriteTo(w)
+			return
+		}
+		respondWithJSON(w, http.StatusOK, details)
+	}
+}
+
+// decodeIncident reads an incident from the request body, defaulting its
+// status to open and the resolution date of a resolved one to today
+func decodeIncident(w http.ResponseWriter, r *http.Request, cal calendar) (Incident, bool) {
+	var i Incident
+	if err := decodeRequest(r, &i); err != nil {
+		respondWithError(w, payloadErrorStatus(err), "Invalid request payload: "+err.Error())
+		return i, false
+	}
+	defer r.Body.Close()
+
+	if i.Status == "" {
+		i.Status = IncidentOpen
+	}
+	if i.Status == IncidentResolved && i.ResolvedOn == "" {
+		i.ResolvedOn = cal.today()
+	}
+	if err := validateIncident(i); err != nil {
+		respondWithValidationError(w, err)
+		return i, false
+	}
+	return i, true
+}
+
+// respondWithSavedIncident saves an incident and answers with it as stored
+func respondWithSavedIncident(w http.ResponseWriter, db *sql.DB, i Incident, status int) {
+	if err := saveIncident(db, &i); err != nil {
+		if err == sql.ErrNoRows {
+			respondWithError(w, http.StatusNotFound, "Incident not found")
+			return
+		}
+		if _, ok := err.(ValidationErrors); ok {
+			respondWithValidationError(w, err)
+			return
+		}
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	details, err := loadIncidentDetails(db, i.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	respondWithJSON(w, status, details)
+}
+
+func createIncident(db *sql.DB, cal calendar) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		i, ok := decodeIncident(w, r, cal)
+		if !ok {
+			return
+		}
+		i.ID = 0
+		respondWithSavedIncident(w, db, i, http.StatusCreated)
+	}
+}
+
+// Update an incident, replacing its linked expenses
+func updateIncident(db *sql.DB, cal calendar) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id, err := strconv.Atoi(vars["id"])
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid incident ID")
+			return
+		}
+		i, ok := decodeIncident(w, r, cal)
+		if !ok {
+			return
+		}
+		i.ID = id
+		respondWithSavedIncident(w, db, i, http.StatusOK)
+	}
+}
+
+// Delete an incident; the expenses linked to it are kept
+func deleteIncident(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id, err := strconv.Atoi(vars["id"])
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid incident ID")
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		defer tx.Rollback()
+
+		result, err := tx.Exec("DELETE FROM incidents WHERE id = ?", id)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			respondWithError(w, http.StatusNotFound, "Incident not found")
+			return
+		}
+		if _, err := tx.Exec("DELETE FROM incident_expenses WHERE incident_id = ?", id); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		respondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
+	}
+}
@@ -0,0 +1,123 @@
+package condomngr
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// IncomeExpenseCategory totals the expenses of a category
+type IncomeExpenseCategory struct {
+	Category string  `json:"category"`
+	Expenses int     `json:"expenses"`
+	Amount   float64 `json:"amount"`
+}
+
+// IncomeExpenseReport sets the income of a period, its confirmed payments,
+// against its expenses by category
+type IncomeExpenseReport struct {
+	StartDate  string                  `json:"start_date"`
+	EndDate    string                  `json:"end_date"`
+	Payments   int                     `json:"payments"`
+	Income     float64                 `json:"income"`
+	Categories []IncomeExpenseCategory `json:"categories"`
+	Expenses   float64                 `json:"expenses"`
+	Net        float64                 `json:"net"` // income less expenses
+}
+
+// incomeExpenseReport totals the income and expenses from start to end,
+// both included
+func incomeExpenseReport(q querier, start, end string) (IncomeExpenseReport, error) {
+	report := IncomeExpenseReport{StartDate: start, EndDate: end, Categories: []IncomeExpenseCategory{}}
+	err := q.QueryRow(`
+		SELECT COUNT(*), COALESCE(SUM(amount), 0) FROM payments
+		WHERE resident_id IN (SELECT id FROM residents) AND status = ? AND substr(payment_date, 1, 10) BETWEEN ? AND ?
+	`, PaymentStatusConfirmed, start, end).Scan(&report.Payments, &report.Income)
+	if err != nil {
+		return report, err
+	}
+	report.Income = roundCents(report.Income)
+
+	rows, err := q.Query(`
+		SELECT category, COUNT(*), COALESCE(SUM(amount), 0) FROM expenses
+		WHERE substr(expense_date, 1, 10) BETWEEN ? AND ?
+		GROUP BY category
+		ORDER BY category
+	`, start, end)
+	if err != nil {
+		return report, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var category IncomeExpenseCategory
+		if err := rows.Scan(&category.Category, &category.Expenses, &category.Amount); err != nil {
+			return report, err
+		}
+		category.Amount = roundCents(category.Amount)
+		report.Categories = append(report.Categories, category)
+		report.Expenses = roundCents(report.Expenses + category.Amount)
+	}
+	report.Net = roundCents(report.Income - report.Expenses)
+	return report, rows.Err()
+}
+
+// Get the income and expenses of a period, the current month by default, as
+// JSON or CSV
+func getIncomeExpenseReport(db *sql.DB, cal calendar) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := checkQueryParams(r, "start_date", "end_date", "format", "locale"); err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		format := r.URL.Query().Get("format")
+		if format != "" && format != "json" && format != "csv" {
+			respondWithError(w, http.StatusBadRequest, "Invalid format, must be json or csv")
+			return
+		}
+		locale, err := reportLocale(r)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		start, end := r.URL.Query().Get("start_date"), r.URL.Query().Get("end_date")
+		if start == "" {
+			start = cal.today()[:8] + "01"
+		}
+		if end == "" {
+			end = cal.today()
+		}
+		for _, date := range []string{start, end} {
+			if _, err := time.Parse("2006-01-02", date); err != nil {
+				respondWithError(w, http.StatusBadRequest, "invalid date format, must be YYYY-MM-DD")
+				return
+			}
+		}
+		if end < start {
+			respondWithError(w, http.StatusBadRequest, "end_date must not be before start_date")
+			return
+		}
+
+		report, err := incomeExpenseReport(db, start, end)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		if format == "csv" {
+			w.Header().Set("Content-Type", "text/csv")
+			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=income_expense_report_%s_%s.csv", start, end))
+			locale.Start(w)
+			locale.Row(w, "Section", "Category", "Count", "Amount")
+			locale.Row(w, "Income", "Payments", strconv.Itoa(report.Payments), locale.Amount(report.Income))
+			for _, category := range report.Categories {
+				locale.Row(w, "Expenses", category.Category, strconv.Itoa(category.Expenses), locale.Amount(category.Amount))
+			}
+			locale.Row(w, "Expenses", "Total", "", locale.Amount(report.Expenses))
+			locale.Row(w, "Net", "", "", locale.Amount(report.Net))
+			return
+		}
+		respondWithJSON(w, http.StatusOK, report)
+	}
+}
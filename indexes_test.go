@@ -0,0 +1,149 @@
+package condomngr
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// queryPlan is the EXPLAIN QUERY PLAN of query, one step per line
+func queryPlan(t testing.TB, db *sql.DB, query string, args ...interface{}) string {
+	t.Helper()
+	rows, err := db.Query("EXPLAIN QUERY PLAN "+query, args...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var steps []string
+	for rows.Next() {
+		var id, parent, unused int
+		var detail string
+		if err := rows.Scan(&id, &parent, &unused, &detail); err != nil {
+			t.Fatal(err)
+		}
+		steps = append(steps, detail)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return strings.Join(steps, "\n")
+}
+
+// TestListQueriesUseIndexes checks the plans of the queries the list and
+// search handlers build for their common filters
+func TestListQueriesUseIndexes(t *testing.T) {
+	db, err := OpenDB(filepath.Join(t.TempDir(), "condo.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	const payments = " FROM payments p JOIN residents r ON p.resident_id = r.id"
+	where := func(filter queryFilter, err error) (string, []interface{}) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		return filter.where(), filter.args
+	}
+	for _, tt := range []struct {
+		name, url string
+		build     func(r *http.Request) (string, []interface{})
+		index     string
+	}{
+		{"payments of a resident", "/api/v1/payments?resident_id=7", func(r *http.Request) (string, []interface{}) {
+			clause, args := where(paymentFilter(r))
+			return "SELECT p.id" + payments + clause + " ORDER BY p.payment_date DESC", args
+		}, "idx_payments_resident_date"},
+		{"payments in a date range", "/api/v1/payments?start_date=2024-01-01&end_date=2024-01-31", func(r *http.Request) (string, []interface{}) {
+			clause, args := where(paymentFilter(r))
+			return "SELECT p.id" + payments + clause + " ORDER BY p.payment_date DESC", args
+		}, "idx_payments_date"},
+		{"payment search in a date range", "/api/v1/search/payments?q=dues&start_date=2024-01-01&end_date=2024-01-31", func(r *http.Request) (string, []interface{}) {
+			clause, args, err := paymentSearchWhere(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return "SELECT p.id" + payments + " WHERE " + clause + " ORDER BY p.payment_date DESC", args
+		}, "idx_payments_date"},
+		{"expenses of a category", "/api/v1/expenses?category=Cleaning", func(r *http.Request) (string, []interface{}) {
+			clause, args := where(expenseFilter(r))
+			return "SELECT id FROM expenses" + clause + " ORDER BY expense_date DESC", args
+		}, "idx_expenses_category_date"},
+		{"expenses in a date range", "/api/v1/expenses?start_date=2024-01-01&end_date=2024-01-31", func(r *http.Request) (string, []interface{}) {
+			clause, args := where(expenseFilter(r))
+			return "SELECT id FROM expenses" + clause + " ORDER BY expense_date DESC", args
+		}, "idx_expenses_date"},
+		{"residents of a unit", "/api/v1/residents?unit=1A", func(r *http.Request) (string, []interface{}) {
+			filter := residentFilter(r)
+			return "SELECT id FROM residents" + filter.where() + " ORDER BY name", filter.args
+		}, "idx_residents_unit"},
+		{"residents by name", "/api/v1/residents", func(r *http.Request) (string, []interface{}) {
+			return "SELECT id FROM residents ORDER BY name", nil
+		}, "idx_residents_name"},
+	} {
+		query, args := tt.build(httptest.NewRequest("GET", tt.url, nil))
+		if plan := queryPlan(t, db, query, args...); !strings.Contains(plan, "INDEX "+tt.index) {
+			t.Errorf("%s doesn't use %s:\n%s", tt.name, tt.index, plan)
+		}
+	}
+}
+
+// BenchmarkListQueries serves the common list and search requests from a
+// database of 50,000 payments and 20,000 expenses, with the indexes and with
+// them dropped
+func BenchmarkListQueries(b *testing.B) {
+	requests := []struct {
+		name    string
+		url     string
+		handler func(db *sql.DB) http.HandlerFunc
+	}{
+		{"payments of a resident", "/api/v1/payments?resident_id=7", getPayments},
+		{"payments in a month", "/api/v1/payments?start_date=2024-01-01&end_date=2024-01-31", getPayments},
+		{"payment search in a month", "/api/v1/search/payments?q=dues&start_date=2024-01-01&end_date=2024-01-31", searchPayments},
+		{"expenses of a category", "/api/v1/expenses?category=Cleaning", getExpenses},
+		{"residents of a unit", "/api/v1/residents?unit=U7", getResidents},
+	}
+	for _, indexed := range []bool{true, false} {
+		db, err := OpenDB(filepath.Join(b.TempDir(), "condo.db"))
+		if err != nil {
+			b.Fatal(err)
+		}
+		seed := []string{
+			`WITH RECURSIVE n(i) AS (SELECT 1 UNION ALL SELECT i + 1 FROM n WHERE i < 500)
+			INSERT INTO residents(name, unit) SELECT 'Resident ' || i, 'U' || i FROM n`,
+			`WITH RECURSIVE n(i) AS (SELECT 1 UNION ALL SELECT i + 1 FROM n WHERE i < 50000)
+			INSERT INTO payments(resident_id, amount, description, payment_date) SELECT i % 500 + 1, 50, 'Monthly dues', date('2020-01-01', '+' || (i % 1800) || ' days') FROM n`,
+			`WITH RECURSIVE n(i) AS (SELECT 1 UNION ALL SELECT i + 1 FROM n WHERE i < 20000)
+			INSERT INTO expenses(amount, description, expense_date, category) SELECT 10, 'Supplies', date('2020-01-01', '+' || (i % 1800) || ' days'), CASE i % 4 WHEN 0 THEN 'Cleaning' WHEN 1 THEN 'Maintenance' WHEN 2 THEN 'Utilities' ELSE 'Insurance' END FROM n`,
+		}
+		if !indexed {
+			seed = append(seed, `DROP INDEX idx_payments_resident_date; DROP INDEX idx_payments_date; DROP INDEX idx_expenses_date;
+				DROP INDEX idx_expenses_category_date; DROP INDEX idx_residents_name; DROP INDEX idx_residents_unit`)
+		}
+		for _, query := range seed {
+			if _, err := db.Exec(query); err != nil {
+				b.Fatal(err)
+			}
+		}
+		variant := "indexed"
+		if !indexed {
+			variant = "unindexed"
+		}
+		for _, req := range requests {
+			handler := req.handler(db)
+			b.Run(variant+"/"+req.name, func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					w := httptest.NewRecorder()
+					handler(w, httptest.NewRequest("GET", req.url, nil))
+					if w.Code != http.StatusOK {
+						b.Fatalf("status %d: %s", w.Code, w.Body)
+					}
+				}
+			})
+		}
+		db.Close()
+	}
+}
@@ -0,0 +1,293 @@
+package condomngr
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// defaultInterestGraceDays is how long a charge can be overdue before it
+// accrues interest
+const defaultInterestGraceDays = 60
+
+// ChargeInterest is the interest accrued by one charge. Each part of the
+// charge accrues from the due date until it was paid, or until the as-of date
+// if still unpaid, but only once it is more than the grace period overdue.
+type ChargeInterest struct {
+	ChargeID    int     `json:"charge_id"`
+	Period      string  `json:"period"`
+	DueDate     string  `json:"due_date"`
+	Amount      float64 `json:"amount"`
+	Outstanding float64 `json:"outstanding"` // unpaid on the as-of date
+	DaysOverdue int     `json:"days_overdue"`
+	Interest    float64 `json:"interest"`
+}
+
+// ResidentInterest is the interest a resident owes on a date. Due is what
+// hasn't been charged yet: the accrued interest minus earlier interest charges.
+type ResidentInterest struct {
+	ResidentID int              `json:"resident_id"`
+	AsOf       string           `json:"as_of"`
+	AnnualRate float64          `json:"annual_rate"` // percent
+	GraceDays  int              `json:"grace_days"`
+	Charges    []ChargeInterest `json:"charges"`
+	Accrued    float64          `json:"accrued"`
+	Charged    float64          `json:"charged"`
+	Due        float64          `json:"due"`
+	Applied    *Charge          `json:"applied,omitempty"`
+}
+
+// chargePart is an amount of a charge settled by a payment on date, or still
+// unpaid when date is empty
+type chargePart struct {
+	amount float64
+	date   string
+}
+
+// allocateFIFO settles charges with payments, oldest charges first, splitting
+// payments across charges. It returns the parts each charge was settled in,
+// in the order of charges; what payments leave unsettled is a final part
+// without a date. Both lists must be sorted by date.
+func allocateFIFO(charges []Charge, payments []Payment) [][]chargePart {
+	parts := make([][]chargePart, len(charges))
+	remaining := make([]float64, len(charges))
+	for i, charge := range charges {
+		remaining[i] = charge.Amount
+	}
+	next := 0
+	for _, payment := range payments {
+		left := payment.Amount
+		for left > 0.005 && next < len(charges) {
+			settled := min(left, remaining[next])
+			parts[next] = append(parts[next], chargePart{amount: roundCents(settled), date: payment.PaymentDate})
+			remaining[next] = roundCents(remaining[next] - settled)
+			left = roundCents(left - settled)
+			if remaining[next] < 0.005 {
+				next++
+			}
+		}
+	}
+	for i := range charges {
+		if remaining[i] >= 0.005 {
+			parts[i] = append(parts[i], chargePart{amount: remaining[i]})
+		}
+	}
+	return parts
+}
+
+// accruedInterest computes the simple interest (actual/365) of a charge due on
+// dueDate and settled in parts, as of asOf (all YYYY-MM-DD). Parts paid after
+// asOf count as unpaid.
+func accruedInterest(dueDate string, parts []chargePart, asOf string, annualRate float64, graceDays int) (interest, outstanding float64, daysOverdue int) {
+	due, _ := time.Parse("2006-01-02", dueDate)
+	end, _ := time.Parse("2006-01-02", asOf)
+	for _, part := range parts {
+		until := end
+		if part.date == "" || part.date > asOf {
+			outstanding += part.amount
+		} else {
+			until, _ = time.Parse("2006-01-02", part.date)
+		}
+		days := int(until.Sub(due).Hours() / 24)
+		if days > daysOverdue && (part.date == "" || part.date > asOf) {
+			daysOverdue = days
+		}
+		if days <= graceDays {
+			continue
+		}
+		interest += part.amount * annualRate / 100 * float64(days) / 365
+	}
+	return roundCents(interest), roundCents(outstanding), daysOverdue
+}
+
+// residentInterest works out the interest a resident owes as of a date. Only
+// dues accrue interest, but payments settle interest charges like any other.
+// Credits and write-offs count as payments, and credit taken back as a charge.
+func residentInterest(db *sql.DB, residentID int, asOf string, annualRate float64, graceDays int) (ResidentInterest, error) {
+	result := ResidentInterest{ResidentID: residentID, AsOf: asOf, AnnualRate: annualRate, GraceDays: graceDays, Charges: []ChargeInterest{}}
+
+	rows, err := db.Query(`
+		SELECT id, kind, period, amount, substr(due_date, 1, 10) AS date FROM charges
+		WHERE resident_id = ?1 AND due_date <= ?2
+		UNION ALL
+		SELECT 0, 'credit', '', -amount, credit_date FROM credits
+		WHERE resident_id = ?1 AND amount < 0 AND credit_date <= ?2
+		ORDER BY date, id
+	`, residentID, asOf)
+	if err != nil {
+		return result, err
+	}
+	var charges []Charge
+	for rows.Next() {
+		var c Charge
+		if err := rows.Scan(&c.ID, &c.Kind, &c.Period, &c.Amount, &c.DueDate); err != nil {
+			rows.Close()
+			return result, err
+		}
+		charges = append(charges, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return result, err
+	}
+
+	rows, err = db.Query(`
+		SELECT amount, substr(payment_date, 1, 10) AS date FROM payments
+		WHERE resident_id = ?1 AND status = ?2
+		UNION ALL
+		SELECT amount, credit_date FROM credits
+		WHERE resident_id = ?1 AND amount > 0
+		UNION ALL
+		SELECT amount, writeoff_date FROM write_offs
+		WHERE resident_id = ?1 AND reversed_at IS NULL
+		ORDER BY date
+	`, residentID, PaymentStatusConfirmed)
+	if err != nil {
+		return result, err
+	}
+	var payments []Payment
+	for rows.Next() {
+		var p Payment
+		if err := rows.Scan(&p.Amount, &p.PaymentDate); err != nil {
+			rows.Close()
+			return result, err
+		}
+		payments = append(payments, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return result, err
+	}
+
+	for i, parts := range allocateFIFO(charges, payments) {
+		charge := charges[i]
+		if charge.Kind == ChargeKindInterest {
+			result.Charged = roundCents(result.Charged + charge.Amount)
+		}
+		if charge.Kind != ChargeKindDues && charge.Kind != ChargeKindAssessment {
+			continue
+		}
+		interest, outstanding, days := accruedInterest(charge.DueDate, parts, asOf, annualRate, graceDays)
+		if interest == 0 && outstanding == 0 {
+			continue
+		}
+		result.Charges = append(result.Charges, ChargeInterest{
+			ChargeID:    charge.ID,
+			Period:      charge.Period,
+			DueDate:     charge.DueDate,
+			Amount:      charge.Amount,
+			Outstanding: outstanding,
+			DaysOverdue: days,
+			Interest:    interest,
+		})
+		result.Accrued = roundCents(result.Accrued + interest)
+	}
+	result.Due = max(roundCents(result.Accrued-result.Charged), 0)
+	return result, nil
+}
+
+// Get the interest a resident owes on overdue charges
+func getResidentInterest(db *sql.DB, annualRate float64, graceDays int, cal calendar, rules paymentRules) http.HandlerFunc {
+	return residentInterestHandler(db, annualRate, graceDays, false, cal, rules)
+}
+
+// Charge the interest a resident owes and that wasn't charged yet, as an
+// interest charge for the month of the as-of date. Applying the same month
+// again does nothing.
+func applyResidentInterest(db *sql.DB, annualRate float64, graceDays int, cal calendar, rules paymentRules) http.HandlerFunc {
+	return residentInterestHandler(db, annualRate, graceDays, true, cal, rules)
+}
+
+func residentInterestHandler(db *sql.DB, annualRate float64, graceDays int, apply bool, cal calendar, rules paymentRules) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := checkQueryParams(r, "as_of"); err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		vars := mux.Vars(r)
+		id, err := strconv.Atoi(vars["id"])
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid resident ID")
+			return
+		}
+		if annualRate <= 0 {
+			respondWithError(w, http.StatusBadRequest, "No interest rate configured")
+			return
+		}
+
+		asOf := r.URL.Query().Get("as_of")
+		if asOf == "" {
+			asOf = cal.today()
+		}
+		if _, err := time.Parse("2006-01-02", asOf); err != nil {
+			respondWithError(w, http.StatusBadRequest, "invalid as_of format, must be YYYY-MM-DD")
+			return
+		}
+
+		var exists bool
+		if err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM residents WHERE id = ?)", id).Scan(&exists); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if !exists {
+			respondWithError(w, http.StatusNotFound, "Resident not found")
+			return
+		}
+
+		interest, err := residentInterest(db, id, asOf, annualRate, graceDays)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if !apply || interest.Due == 0 {
+			respondWithJSON(w, http.StatusOK, interest)
+			return
+		}
+
+		// The unique index on (resident_id, kind, period) makes applying the
+		// same month twice a no-op
+		period := asOf[:7]
+		tx, err := db.Begin()
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		defer tx.Rollback()
+		_, err = tx.Exec(`
+			INSERT OR IGNORE INTO charges(resident_id, kind, period, description, amount, due_date)
+			VALUES(?, ?, ?, ?, ?, ?)
+		`, id, ChargeKindInterest, period, fmt.Sprintf("Interest through %s", asOf), interest.Due, asOf)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if err := reallocate(tx, rules, id); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		var charge Charge
+		err = tx.QueryRow("SELECT id, resident_id, kind, period, description, amount, due_date, created_at FROM charges WHERE resident_id = ? AND kind = ? AND period = ?", id, ChargeKindInterest, period).
+			Scan(&charge.ID, &charge.ResidentID, &charge.Kind, &charge.Period, &charge.Description, &charge.Amount, &charge.DueDate, &charge.CreatedAt)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		if err := tx.Commit(); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		// Report what is left to charge after applying
+		if interest, err = residentInterest(db, id, asOf, annualRate, graceDays); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		interest.Applied = &charge
+		respondWithJSON(w, http.StatusOK, interest)
+	}
+}
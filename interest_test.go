@@ -0,0 +1,95 @@
+package condomngr
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestAccruedInterest(t *testing.T) {
+	for _, tt := range []struct {
+		name            string
+		dueDate         string
+		parts           []chargePart
+		asOf            string
+		rate            float64
+		grace           int
+		wantInterest    float64
+		wantOutstanding float64
+		wantDays        int
+	}{
+		{"unpaid for a year", "2023-01-01", []chargePart{{amount: 100}}, "2024-01-01", 10, 0, 10, 100, 365},
+		{"unpaid over a leap year", "2024-01-01", []chargePart{{amount: 100}}, "2025-01-01", 10, 0, 10.03, 100, 366},
+		{"within the grace days", "2024-01-01", []chargePart{{amount: 1000}}, "2024-01-31", 12, 30, 0, 1000, 30},
+		{"a day past the grace days", "2024-01-01", []chargePart{{amount: 1000}}, "2024-02-01", 12, 30, 10.19, 1000, 31},
+		{"not due yet", "2024-06-01", []chargePart{{amount: 100}}, "2024-05-01", 10, 0, 0, 100, 0},
+		{"paid late", "2024-01-01", []chargePart{{amount: 365, date: "2024-03-01"}}, "2024-12-31", 10, 0, 6, 0, 0},
+		{"paid within the grace days", "2024-01-01", []chargePart{{amount: 100, date: "2024-01-20"}}, "2024-12-31", 10, 30, 0, 0, 0},
+		{"paid after the as-of date", "2023-01-01", []chargePart{{amount: 100, date: "2024-01-10"}}, "2024-01-01", 10, 0, 10, 100, 365},
+		{"paid in part", "2024-01-01", []chargePart{{amount: 200, date: "2024-03-01"}, {amount: 165}}, "2024-12-31", 10, 0, 19.79, 165, 365},
+		{"paid in parts", "2024-01-01", []chargePart{{amount: 50, date: "2024-01-15"}, {amount: 50, date: "2024-04-01"}}, "2024-12-31", 10, 30, 1.25, 0, 0},
+		{"rounded to cents", "2024-01-01", []chargePart{{amount: 33.33}}, "2024-02-15", 7, 0, 0.29, 33.33, 45},
+		{"no rate", "2023-01-01", []chargePart{{amount: 100}}, "2024-01-01", 0, 0, 0, 100, 365},
+		{"as of the due date", "2024-02-29", []chargePart{{amount: 100}}, "2024-02-29", 10, 0, 0, 100, 0},
+		{"paid on the due date", "2024-02-29", []chargePart{{amount: 100, date: "2024-02-29"}}, "2024-12-31", 10, 0, 0, 0, 0},
+		{"due on a leap day, a year on", "2024-02-29", []chargePart{{amount: 365}}, "2025-02-28", 10, 0, 36.5, 365, 365},
+		{"cents left over", "2024-01-01", []chargePart{{amount: 10.01, date: "2024-02-01"}, {amount: 0.01}}, "2024-12-31", 5, 0, 0.04, 0.01, 365},
+	} {
+		interest, outstanding, days := accruedInterest(tt.dueDate, tt.parts, tt.asOf, tt.rate, tt.grace)
+		if interest != tt.wantInterest || outstanding != tt.wantOutstanding || days != tt.wantDays {
+			t.Errorf("%s: %v interest, %v outstanding, %d days overdue, want %v, %v, %d", tt.name, interest, outstanding, days, tt.wantInterest, tt.wantOutstanding, tt.wantDays)
+		}
+	}
+}
+
+func TestAllocateFIFO(t *testing.T) {
+	charges := []Charge{{Amount: 100}, {Amount: 50}, {Amount: 80}}
+	payments := []Payment{{Amount: 120, PaymentDate: "2024-02-10"}, {Amount: 40, PaymentDate: "2024-03-10"}}
+	want := [][]chargePart{
+		{{amount: 100, date: "2024-02-10"}},
+		{{amount: 20, date: "2024-02-10"}, {amount: 30, date: "2024-03-10"}},
+		{{amount: 10, date: "2024-03-10"}, {amount: 70}},
+	}
+	if got := allocateFIFO(charges, payments); !reflect.DeepEqual(got, want) {
+		t.Errorf("parts %+v, want %+v", got, want)
+	}
+}
+
+func TestApplyResidentInterest(t *testing.T) {
+	s := newTestServer(t, Options{InterestRate: 10, InterestGraceDays: 30})
+	resident := s.createResident("Ana Silva", "1A")
+	for _, period := range []string{"2023-01", "2023-02"} {
+		if _, err := s.db.Exec("INSERT INTO charges(resident_id, kind, period, amount, due_date) VALUES(?, ?, ?, 365, ?)", resident.ID, ChargeKindDues, period, period+"-01"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Settles January on March 1st, 59 days late
+	s.expect(http.StatusCreated, "POST", "/api/v1/payments", map[string]interface{}{"resident_id": resident.ID, "amount": 365, "description": "Dues", "payment_date": "2023-03-01"}, nil)
+
+	path := fmt.Sprintf("/api/v1/residents/%d/interest?as_of=2023-04-01", resident.ID)
+	var interest ResidentInterest
+	s.expect(http.StatusOK, "GET", path, nil, &interest)
+	// 365 × 10% × 59/365 on January and 365 × 10% × 59/365 on February
+	if interest.Accrued != 11.8 || interest.Due != 11.8 || len(interest.Charges) != 2 {
+		t.Fatalf("interest %+v", interest)
+	}
+
+	s.expect(http.StatusOK, "POST", path, nil, &interest)
+	if interest.Applied == nil || interest.Applied.Kind != ChargeKindInterest || interest.Applied.Amount != 11.8 || interest.Applied.Period != "2023-04" {
+		t.Fatalf("applied %+v", interest.Applied)
+	}
+
+	// Applying the same month again charges nothing more
+	s.expect(http.StatusOK, "POST", path, nil, &interest)
+	if interest.Due != 0 || interest.Charged != 11.8 {
+		t.Errorf("after applying twice %+v", interest)
+	}
+	var count int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM charges WHERE resident_id = ? AND kind = ?", resident.ID, ChargeKindInterest).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("%d interest charges, want 1", count)
+	}
+}
@@ -0,0 +1,229 @@
+package condomngr
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Job states
+const (
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+	JobCanceled  = "canceled"
+)
+
+// maxRunningJobs is how many jobs run at once; the others wait queued
+const maxRunningJobs = 2
+
+// jobRetention is how long a finished job can still be looked up
+const jobRetention = 24 * time.Hour
+
+// Job is work done in the background, such as a large import, whose progress
+// and outcome clients poll for
+type Job struct {
+	ID         int         `json:"id"`
+	Kind       string      `json:"kind"` // e.g. import
+	State      string      `json:"state"`
+	Processed  int         `json:"processed"`
+	Total      int         `json:"total"`
+	Progress   float64     `json:"progress"` // percentage of total processed, 100 only once succeeded
+	Result     interface{} `json:"result"`   // once succeeded
+	Error      string      `json:"error"`    // once failed
+	CreatedAt  time.Time   `json:"created_at"`
+	StartedAt  *time.Time  `json:"started_at"`
+	FinishedAt *time.Time  `json:"finished_at"`
+}
+
+// JobFunc does the work of a job. It reports how many items it has processed
+// so far through progress, and stops with ctx's error when ctx is canceled.
+type JobFunc func(ctx context.Context, progress func(processed int)) (interface{}, error)
+
+// Jobs runs jobs in the background. Their state is kept in memory only, so
+// it is lost on restart.
+type Jobs struct {
+	slots chan struct{}
+
+	mu     sync.Mutex
+	nextID int
+	jobs   map[int]*jobEntry
+}
+
+type jobEntry struct {
+	job    Job
+	cancel context.CancelFunc
+}
+
+// NewJobs creates a job runner without jobs
+func NewJobs() *Jobs {
+	return &Jobs{slots: make(chan struct{}, maxRunningJobs), jobs: make(map[int]*jobEntry)}
+}
+
+var (
+	errJobNotFound = errors.New("job not found")
+	errJobFinished = errors.New("job already finished")
+)
+
+// Start queues a job of kind over total items and returns it right away
+func (j *Jobs) Start(kind string, total int, run JobFunc) Job {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	j.mu.Lock()
+	j.prune()
+	j.nextID++
+	e := &jobEntry{job: Job{ID: j.nextID, Kind: kind, State: JobQueued, Total: total, CreatedAt: time.Now().UTC()}, cancel: cancel}
+	j.jobs[e.job.ID] = e
+	job := e.job
+	j.mu.Unlock()
+
+	go j.run(ctx, e, run)
+	return job
+}
+
+// Get returns the job with id
+func (j *Jobs) Get(id int) (Job, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	e, ok := j.jobs[id]
+	if !ok {
+		return Job{}, errJobNotFound
+	}
+	return e.job, nil
+}
+
+// Cancel stops the job with id. A queued job is canceled right away, a
+// running one once its function returns.
+func (j *Jobs) Cancel(id int) (Job, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	e, ok := j.jobs[id]
+	if !ok {
+		return Job{}, errJobNotFound
+	}
+	if e.job.FinishedAt != nil {
+		return e.job, errJobFinished
+	}
+	e.cancel()
+	if e.job.State == JobQueued {
+		now := time.Now().UTC()
+		e.job.State, e.job.FinishedAt = JobCanceled, &now
+	}
+	return e.job, nil
+}
+
+func (j *Jobs) run(ctx context.Context, e *jobEntry, run JobFunc) {
+	defer e.cancel()
+	select {
+	case j.slots <- struct{}{}:
+		defer func() { <-j.slots }()
+	case <-ctx.Done():
+		return // canceled by Cancel
+	}
+
+	j.mu.Lock()
+	if e.job.State != JobQueued {
+		j.mu.Unlock()
+		return
+	}
+	now := time.Now().UTC()
+	e.job.State, e.job.StartedAt = JobRunning, &now
+	j.mu.Unlock()
+
+	result, err := run(ctx, func(processed int) {
+		j.mu.Lock()
+		defer j.mu.Unlock()
+		// What comes after the last item, such as a commit, can take a while
+		e.job.Processed, e.job.Progress = processed, min(percentage(processed, e.job.Total), 99)
+	})
+	if err != nil && ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	j.finish(e, result, err)
+}
+
+// finish records the outcome of a job; an error of a canceled context means
+// it was canceled
+func (j *Jobs) finish(e *jobEntry, result interface{}, err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	now := time.Now().UTC()
+	e.job.FinishedAt = &now
+	switch {
+	case errors.Is(err, context.Canceled):
+		e.job.State = JobCanceled
+	case err != nil:
+		e.job.State, e.job.Error = JobFailed, err.Error()
+		log.Printf("Job %d (%s) failed: %v", e.job.ID, e.job.Kind, err)
+	default:
+		e.job.State, e.job.Result = JobSucceeded, result
+		e.job.Processed, e.job.Progress = e.job.Total, 100
+	}
+}
+
+// prune forgets the jobs that finished more than jobRetention ago. j.mu must
+// be held.
+func (j *Jobs) prune() {
+	for id, e := range j.jobs {
+		if e.job.FinishedAt != nil && time.Since(*e.job.FinishedAt) > jobRetention {
+			delete(j.jobs, id)
+		}
+	}
+}
+
+// percentage is processed out of total, to one decimal
+func percentage(processed, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return math.Round(float64(processed)*1000/float64(total)) / 10
+}
+
+// Handlers for job endpoints
+
+// Get the state, progress and outcome of a background job
+func getJob(jobs *Jobs) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(mux.Vars(r)["id"])
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid job ID")
+			return
+		}
+		job, err := jobs.Get(id)
+		if err != nil {
+			respondWithError(w, http.StatusNotFound, "Job not found")
+			return
+		}
+		respondWithJSON(w, http.StatusOK, job)
+	}
+}
+
+// Cancel a queued or running background job. An import that is canceled
+// leaves the database as it was.
+func cancelJob(jobs *Jobs) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(mux.Vars(r)["id"])
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid job ID")
+			return
+		}
+		job, err := jobs.Cancel(id)
+		switch {
+		case errors.Is(err, errJobNotFound):
+			respondWithError(w, http.StatusNotFound, "Job not found")
+			return
+		case errors.Is(err, errJobFinished):
+			respondWithError(w, http.StatusConflict, "Job already finished")
+			return
+		}
+		respondWithJSON(w, http.StatusOK, job)
+	}
+}
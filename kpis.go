@@ -0,0 +1,137 @@
+package condomngr
+
+import (
+	"database/sql"
+	"net/http"
+	"time"
+)
+
+// kpiMonths is how many months, up to the one asked for, the series of each
+// KPI covers
+const kpiMonths = 12
+
+// KPIPoint is the value of a KPI in a month, null when it can't be worked
+// out, as a collection rate without dues
+type KPIPoint struct {
+	Month string   `json:"month"` // YYYY-MM
+	Value *float64 `json:"value"`
+}
+
+// KPI is an indicator for a month, how it is worked out, and its values over
+// the trailing months for charts, oldest first and ending with the month
+type KPI struct {
+	Value   *float64   `json:"value"`
+	Unit    string     `json:"unit"` // percent, days or units
+	Formula string     `json:"formula"`
+	Series  []KPIPoint `json:"series"`
+}
+
+// KPIs are the indicators the board follows for a month
+type KPIs struct {
+	Month            string `json:"month"` // YYYY-MM
+	CollectionRate   KPI    `json:"collection_rate"`
+	AverageDaysToPay KPI    `json:"average_days_to_pay"`
+	DelinquentUnits  KPI    `json:"delinquent_units"`
+	ExpenseChange    KPI    `json:"expense_change"`
+	ReserveFundRatio KPI    `json:"reserve_fund_ratio"`
+}
+
+// kpiQuery works out a KPI for a month in SQL, given the month (?1), the
+// first day of the next one (?2), the previous month (?3), the first month of
+// the year ending with it (?4), the confirmed status (?5) and the dues kind
+// (?6). The dues of a month are those charged to current residents.
+type kpiQuery struct {
+	unit, formula, query string
+}
+
+var (
+	kpiCollectionRate = kpiQuery{"percent",
+		"collected / expected * 100, where expected is the dues charged for the month and collected is what confirmed payments made by its end settled of them", `
+		WITH dues AS (SELECT id, amount FROM charges WHERE kind = ?6 AND period = ?1 AND resident_id IN (SELECT id FROM residents))
+		SELECT ROUND(100.0 * (
+			SELECT COALESCE(SUM(a.amount), 0) FROM payment_allocations a JOIN payments p ON p.id = a.payment_id
+			WHERE a.charge_id IN (SELECT id FROM dues) AND p.status = ?5 AND p.payment_date < ?2
+		) / NULLIF((SELECT SUM(amount) FROM dues), 0), 2)`}
+	kpiAverageDaysToPay = kpiQuery{"days",
+		"sum(settled * (payment date - due date)) / sum(settled) over what confirmed payments settled of the dues charged for the month, so paying early counts negative", `
+		SELECT ROUND(SUM(a.amount * (julianday(substr(p.payment_date, 1, 10)) - julianday(substr(c.due_date, 1, 10)))) / NULLIF(SUM(a.amount), 0), 2)
+		FROM payment_allocations a
+		JOIN charges c ON c.id = a.charge_id
+		JOIN payments p ON p.id = a.payment_id
+		WHERE c.kind = ?6 AND c.period = ?1 AND c.resident_id IN (SELECT id FROM residents) AND p.status = ?5`}
+	kpiDelinquentUnits = kpiQuery{"units",
+		"count of the units with a resident whose charges due by the end of the month exceed their confirmed payments, credits and debt written off by then", `
+		SELECT COUNT(DISTINCT r.unit) FROM residents r
+		WHERE ROUND(
+			(SELECT COALESCE(SUM(amount), 0) FROM charges WHERE resident_id = r.id AND due_date < ?2)
+			- (SELECT COALESCE(SUM(amount), 0) FROM payments WHERE resident_id = r.id AND status = ?5 AND payment_date < ?2)
+			- (SELECT COALESCE(SUM(amount), 0) FROM credits WHERE resident_id = r.id AND credit_date < ?2)
+			- (SELECT COALESCE(SUM(amount), 0) FROM write_offs WHERE resident_id = r.id AND reversed_at IS NULL AND writeoff_date < ?2)
+		, 2) > 0`}
+	kpiExpenseChange = kpiQuery{"percent",
+		"(expenses of the month - expenses of the previous month) / expenses of the previous month * 100", `
+		SELECT ROUND(100.0 * (cur - prev) / NULLIF(prev, 0), 2) FROM (SELECT
+			(SELECT COALESCE(SUM(amount), 0) FROM expenses WHERE substr(expense_date, 1, 7) = ?1) AS cur,
+			(SELECT COALESCE(SUM(amount), 0) FROM expenses WHERE substr(expense_date, 1, 7) = ?3) AS prev)`}
+	kpiReserveFundRatio = kpiQuery{"percent",
+		"reserve balance / expenses of the 12 months ending with the month * 100, where the reserve balance is everything set aside from confirmed payments made by the end of the month", `
+		SELECT ROUND(100.0 * (
+			SELECT COALESCE(SUM(c.amount), 0) FROM reserve_contributions c JOIN payments p ON p.id = c.payment_id
+			WHERE p.status = ?5 AND p.payment_date < ?2
+		) / NULLIF((SELECT SUM(amount) FROM expenses WHERE substr(expense_date, 1, 7) BETWEEN ?4 AND ?1), 0), 2)`}
+)
+
+// kpi works out a KPI for each of the kpiMonths months ending with month
+func kpi(q querier, k kpiQuery, month time.Time) (KPI, error) {
+	result := KPI{Unit: k.unit, Formula: k.formula, Series: []KPIPoint{}}
+	for i := kpiMonths - 1; i >= 0; i-- {
+		m := month.AddDate(0, -i, 0)
+		point := KPIPoint{Month: m.Format("2006-01")}
+		err := q.QueryRow(k.query, point.Month, m.AddDate(0, 1, 0).Format("2006-01-02"), m.AddDate(0, -1, 0).Format("2006-01"),
+			m.AddDate(0, 1-kpiMonths, 0).Format("2006-01"), PaymentStatusConfirmed, ChargeKindDues).Scan(&point.Value)
+		if err != nil {
+			return result, err
+		}
+		result.Series = append(result.Series, point)
+	}
+	result.Value = result.Series[len(result.Series)-1].Value
+	return result, nil
+}
+
+// Get the KPIs of a month, the current one by default, each with its formula
+// and its values over the trailing months
+func getKPIs(db *sql.DB, cal calendar) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := checkQueryParams(r, "month"); err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		month := r.URL.Query().Get("month")
+		if month == "" {
+			month = cal.now().Format("2006-01")
+		}
+		start, err := time.Parse("2006-01", month)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "invalid month format, must be YYYY-MM")
+			return
+		}
+
+		kpis := KPIs{Month: month}
+		for _, k := range []struct {
+			kpi   *KPI
+			query kpiQuery
+		}{
+			{&kpis.CollectionRate, kpiCollectionRate},
+			{&kpis.AverageDaysToPay, kpiAverageDaysToPay},
+			{&kpis.DelinquentUnits, kpiDelinquentUnits},
+			{&kpis.ExpenseChange, kpiExpenseChange},
+			{&kpis.ReserveFundRatio, kpiReserveFundRatio},
+		} {
+			if *k.kpi, err = kpi(db, k.query, start); err != nil {
+				respondWithError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+		}
+		respondWithJSON(w, http.StatusOK, kpis)
+	}
+}
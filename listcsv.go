@@ -0,0 +1,183 @@
+package condomngr
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// listFormat picks the format of a list or search response: the format
+// parameter, json or csv, or else the type of application/json and text/csv
+// the Accept header prefers. JSON is the default, and wins wildcards.
+func listFormat(r *http.Request) (string, error) {
+	switch format := r.URL.Query().Get("format"); format {
+	case "":
+	case "json", "csv":
+		return format, nil
+	default:
+		return "", fmt.Errorf("Invalid format, must be json or csv")
+	}
+
+	accept := r.Header.Get("Accept")
+	if strings.TrimSpace(accept) == "" {
+		return "json", nil
+	}
+	format, best := "", 0.0
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(part)
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if value, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(value, 64); err != nil {
+				continue
+			}
+		}
+		var candidate string
+		switch mediaType {
+		case "application/json", "application/*", "*/*":
+			candidate = "json"
+		case "text/csv", "text/*":
+			candidate = "csv"
+		}
+		// The first of the most preferred types wins ties
+		if candidate != "" && q > best {
+			format, best = candidate, q
+		}
+	}
+	if format == "" {
+		return "", fmt.Errorf("Not acceptable, supported formats are application/json and text/csv")
+	}
+	return format, nil
+}
+
+// jsonFieldNames lists the JSON names of the fields of a struct, in order,
+// the columns of its CSV rows
+func jsonFieldNames(v interface{}) []string {
+	t := reflect.TypeOf(v)
+	var names []string
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if name != "" && name != "-" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// jsonCell writes a JSON value as a CSV field: strings as they are, numbers
+// with the locale's decimal separator, null as empty, and objects and arrays
+// as JSON
+func (l csvLocale) jsonCell(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case json.Number:
+		return strings.Replace(v.String(), ".", l.Decimal, 1)
+	case bool:
+		return strconv.FormatBool(v)
+	default:
+		b, _ := json.Marshal(v)
+		return string(b)
+	}
+}
+
+// writeCSVRows writes rows as CSV in locale, a header of columns and then a
+// row of each element as it would be encoded in JSON, so the values are the
+// same as the JSON array's. Fields an element leaves out are empty. It closes
+// rows and returns the number of rows written.
+func writeCSVRows(w io.Writer, rows *sql.Rows, scan rowScanner, locale csvLocale, columns []string) (int, error) {
+	defer rows.Close()
+
+	locale.Start(w)
+	locale.Row(w, append([]string(nil), columns...)...)
+	n := 0
+	fields := make([]string, len(columns))
+	for rows.Next() {
+		item, err := scan(rows)
+		if err != nil {
+			return n, err
+		}
+		b, err := json.Marshal(item)
+		if err != nil {
+			return n, err
+		}
+		dec := json.NewDecoder(bytes.NewReader(b))
+		dec.UseNumber()
+		var object map[string]interface{}
+		if err := dec.Decode(&object); err != nil {
+			return n, err
+		}
+		for i, column := range columns {
+			fields[i] = locale.jsonCell(object[column])
+		}
+		locale.Row(w, fields...)
+		n++
+		if f, ok := w.(http.Flusher); ok && n%streamFlushEvery == 0 {
+			f.Flush()
+		}
+	}
+	return n, rows.Err()
+}
+
+// listFilename names the CSV download of a list: the entity and then each
+// filter of the request with its value, e.g.
+// payments_end_date-2024-03-31_start_date-2024-01-01.csv
+func listFilename(entity string, r *http.Request) string {
+	query := r.URL.Query()
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		switch key {
+		case "format", "fields", "locale", "lang":
+		default:
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	name := entity
+	for _, key := range keys {
+		name += "_" + budgetFilename(key+"-"+strings.Join(query[key], "-"))
+	}
+	if len(name) > 200 {
+		name = strings.ToValidUTF8(name[:200], "")
+	}
+	return name + ".csv"
+}
+
+// streamList runs a list or search query and streams its rows in format: the
+// JSON array, or CSV with columns as its header, downloaded as a file named
+// after entity and the filters. CSV honors the locale parameter.
+func streamList(w http.ResponseWriter, r *http.Request, db *sql.DB, format, entity string, columns []string, scan rowScanner, query string, args ...interface{}) {
+	w.Header().Add("Vary", "Accept")
+	if format != "csv" {
+		streamQuery(w, db, scan, query, args...)
+		return
+	}
+	locale, err := reportLocale(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": listFilename(entity, r)}))
+	stream := newStreamWriter(w)
+	_, err = writeCSVRows(stream, rows, scan, locale, columns)
+	stream.Finish(err)
+}
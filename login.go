@@ -0,0 +1,484 @@
+package condomngr
+
+import (
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sessionTTL is how long a sign-in lasts
+const sessionTTL = 24 * time.Hour
+
+// sessionSeenInterval is how often the last use of a session is recorded
+const sessionSeenInterval = time.Minute
+
+// Defaults of the sign-in guard. Attempts are slowed down from
+// defaultLoginBackoffAfter failures, waiting loginBackoffBase and then twice
+// as long after each next failure, and locked out at defaultLoginLockoutAfter.
+const (
+	defaultLoginBackoffAfter = 3
+	defaultLoginLockoutAfter = 10
+	defaultLoginLockout      = 15 * time.Minute
+	loginBackoffBase         = time.Second
+)
+
+// What failed sign-ins are counted by
+const (
+	LoginByUsername = "username"
+	LoginByIP       = "ip"
+)
+
+// LoginRequest signs a user in
+type LoginRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// Session is a sign-in. The token is only returned when signing in; the API
+// stores its hash.
+type Session struct {
+	ID         int       `json:"id"`
+	Token      string    `json:"token,omitempty"`
+	IP         string    `json:"ip"`
+	UserAgent  string    `json:"user_agent"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	Current    bool      `json:"current"` // the session of the request
+	User       User      `json:"user"`
+}
+
+// LoginFailures counts the failed sign-ins of a username or client IP since
+// its last successful one
+type LoginFailures struct {
+	Kind          string     `json:"kind"` // username or ip
+	Value         string     `json:"value"`
+	Failures      int        `json:"failures"`
+	LastFailureAt time.Time  `json:"last_failure_at"`
+	LockedUntil   *time.Time `json:"locked_until,omitempty"`
+}
+
+// LoginGuard slows down and then locks out password guessing. Failures are
+// counted per username, whether it exists or not, and per client IP, so
+// throttling doesn't tell which usernames exist. The counts are in the
+// database, so they survive restarts and the CLI can clear them.
+type LoginGuard struct {
+	db           *sql.DB
+	notifier     *Notifier
+	backoffAfter int
+	lockoutAfter int
+	lockout      time.Duration
+	mu           sync.Mutex
+}
+
+// NewLoginGuard creates the guard of the users in db. Attempts are slowed
+// down after backoffAfter failures and locked out for lockout after
+// lockoutAfter.
+func NewLoginGuard(db *sql.DB, notifier *Notifier, backoffAfter, lockoutAfter int, lockout time.Duration) *LoginGuard {
+	if notifier == nil {
+		notifier = NewNotifier(nil, 0)
+	}
+	return &LoginGuard{db: db, notifier: notifier, backoffAfter: backoffAfter, lockoutAfter: lockoutAfter, lockout: lockout}
+}
+
+// failures returns the failures of kind and value, zero without any
+func (g *LoginGuard) failures(kind, value string) (LoginFailures, error) {
+	f := LoginFailures{Kind: kind, Value: value}
+	var lockedUntil sql.NullTime
+	err := g.db.QueryRow("SELECT failures, last_failure_at, locked_until FROM login_failures WHERE kind = ? AND value = ?", kind, value).
+		Scan(&f.Failures, &f.LastFailureAt, &lockedUntil)
+	if err == sql.ErrNoRows {
+		return f, nil
+	}
+	if lockedUntil.Valid {
+		f.LockedUntil = &lockedUntil.Time
+	}
+	return f, err
+}
+
+// wait is how long f has to wait before signing in again, zero if it may now
+func (g *LoginGuard) wait(f LoginFailures, now time.Time) time.Duration {
+	if f.LockedUntil != nil {
+		return max(f.LockedUntil.Sub(now), 0)
+	}
+	if f.Failures < g.backoffAfter {
+		return 0
+	}
+	backoff := g.lockout
+	if doublings := f.Failures - g.backoffAfter; doublings < 30 {
+		backoff = min(loginBackoffBase<<doublings, g.lockout)
+	}
+	return max(f.LastFailureAt.Add(backoff).Sub(now), 0)
+}
+
+// Wait is how long a sign-in as username from ip has to wait, zero if it may
+// go ahead
+func (g *LoginGuard) Wait(username, ip string) (time.Duration, error) {
+	now := time.Now()
+	var wait time.Duration
+	for kind, value := range map[string]string{LoginByUsername: username, LoginByIP: ip} {
+		f, err := g.failures(kind, value)
+		if err != nil {
+			return 0, err
+		}
+		wait = max(wait, g.wait(f, now))
+	}
+	return wait, nil
+}
+
+// Fail counts a failed sign-in as username from ip, locking either out once
+// it reaches the limit
+func (g *LoginGuard) Fail(username, ip string) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := time.Now().UTC()
+	for _, kind := range []string{LoginByUsername, LoginByIP} {
+		value := username
+		if kind == LoginByIP {
+			value = ip
+		}
+		f, err := g.failures(kind, value)
+		if err != nil {
+			return err
+		}
+		if f.LockedUntil != nil && !f.LockedUntil.After(now) {
+			// The lockout is over, count from scratch
+			f.Failures, f.LockedUntil = 0, nil
+		}
+		f.Failures++
+		if f.Failures >= g.lockoutAfter {
+			until := now.Add(g.lockout)
+			f.LockedUntil = &until
+			log.Printf("Sign-in locked out for %s %q until %s after %d failed attempts", kind, value, until.Format(time.RFC3339), f.Failures)
+			g.notifier.Notify(Event{
+				Type:    EventLoginLockout,
+				Title:   "Sign-in locked out",
+				Message: fmt.Sprintf("Sign-in for %s %s is locked out for %s after %d failed attempts", kind, value, g.lockout, f.Failures),
+			})
+		}
+		if _, err := g.db.Exec(`
+			INSERT INTO login_failures(kind, value, failures, last_failure_at, locked_until) VALUES(?, ?, ?, ?, ?)
+			ON CONFLICT(kind, value) DO UPDATE SET failures = excluded.failures,
+				last_failure_at = excluded.last_failure_at, locked_until = excluded.locked_until
+		`, kind, value, f.Failures, now, f.LockedUntil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Succeed resets the counts of username and ip after a successful sign-in
+func (g *LoginGuard) Succeed(username, ip string) error {
+	_, err := g.db.Exec("DELETE FROM login_failures WHERE (kind = ? AND value = ?) OR (kind = ? AND value = ?)",
+		LoginByUsername, username, LoginByIP, ip)
+	return err
+}
+
+// Clear removes the failures and lockout of a username or IP, reporting
+// whether there were any
+func (g *LoginGuard) Clear(kind, value string) (bool, error) {
+	result, err := g.db.Exec("DELETE FROM login_failures WHERE kind = ? AND value = ?", kind, value)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// List returns the counted failures, most recent first
+func (g *LoginGuard) List() ([]LoginFailures, error) {
+	rows, err := g.db.Query("SELECT kind, value, failures, last_failure_at, locked_until FROM login_failures ORDER BY last_failure_at DESC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := []LoginFailures{}
+	for rows.Next() {
+		var f LoginFailures
+		var lockedUntil sql.NullTime
+		if err := rows.Scan(&f.Kind, &f.Value, &f.Failures, &f.LastFailureAt, &lockedUntil); err != nil {
+			return nil, err
+		}
+		if lockedUntil.Valid && lockedUntil.Time.After(time.Now()) {
+			f.LockedUntil = &lockedUntil.Time
+		}
+		list = append(list, f)
+	}
+	return list, rows.Err()
+}
+
+// verifyPassword reports whether password matches a hash made by
+// hashPassword
+func verifyPassword(hash, password string) bool {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[0] != "pbkdf2-sha256" {
+		return false
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations <= 0 {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	want, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+	got, err := pbkdf2.Key(sha256.New, password, salt, iterations, len(want))
+	return err == nil && subtle.ConstantTimeCompare(got, want) == 1
+}
+
+// dummyPasswordHash is checked against for unknown usernames, so they take as
+// long to refuse as wrong passwords
+var dummyPasswordHash = sync.OnceValue(func() string {
+	hash, _ := hashPassword("not the password of anyone")
+	return hash
+})
+
+// authenticate returns the enabled user with username and password
+func authenticate(db *sql.DB, username, password string) (User, bool, error) {
+	var hash string
+	user, err := scanUserWithHash(db.QueryRow("SELECT "+userColumns+", password_hash FROM users WHERE username = ?", username), &hash)
+	found := err == nil
+	if err == sql.ErrNoRows {
+		hash = dummyPasswordHash()
+	} else if err != nil {
+		return User{}, false, err
+	}
+	ok := verifyPassword(hash, password)
+	return user, found && ok && !user.Disabled, nil
+}
+
+func scanUserWithHash(row *sql.Row, hash *string) (User, error) {
+	var u User
+	err := row.Scan(&u.ID, &u.Username, &u.Email, &u.Role, &u.Disabled, &u.MustChangePassword, &u.TwoFactorEnabled, &u.CreatedAt, &u.UpdatedAt, hash)
+	return u, err
+}
+
+// hashToken is how session tokens are stored
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// createSession signs user in from r
+func createSession(db *sql.DB, user User, r *http.Request) (Session, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return Session{}, err
+	}
+	now := time.Now().UTC()
+	session := Session{
+		Token:      base64.RawURLEncoding.EncodeToString(b),
+		IP:         clientIP(r),
+		UserAgent:  r.UserAgent(),
+		CreatedAt:  now,
+		LastSeenAt: now,
+		ExpiresAt:  now.Add(sessionTTL),
+		Current:    true,
+		User:       user,
+	}
+	result, err := db.Exec("INSERT INTO sessions(user_id, token_hash, ip, user_agent, created_at, last_seen_at, expires_at) VALUES(?, ?, ?, ?, ?, ?, ?)",
+		user.ID, hashToken(session.Token), session.IP, session.UserAgent, session.CreatedAt, session.LastSeenAt, session.ExpiresAt)
+	if err != nil {
+		return Session{}, err
+	}
+	id, err := result.LastInsertId()
+	session.ID = int(id)
+	return session, err
+}
+
+// bearerToken is the token in the Authorization header of r
+func bearerToken(r *http.Request) string {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+// findSession returns the unexpired session of an enabled user with token,
+// recording that it was seen. It is looked up on every request, so a revoked
+// session fails right away.
+func findSession(db *sql.DB, token string) (Session, error) {
+	now := time.Now().UTC()
+	s, err := scanSession(db.QueryRow("SELECT "+sessionColumns+" "+sessionsJoin+" WHERE s.token_hash = ? AND s.expires_at > ? AND u.disabled = 0",
+		hashToken(token), now))
+	if err != nil {
+		return Session{}, err
+	}
+	s.Current = true
+	if now.Sub(s.LastSeenAt) >= sessionSeenInterval {
+		if _, err := db.Exec("UPDATE sessions SET last_seen_at = ? WHERE id = ?", now, s.ID); err != nil {
+			return Session{}, err
+		}
+		s.LastSeenAt = now
+	}
+	return s, nil
+}
+
+// loginAllowed responds with 429 when username or ip has to wait before
+// trying to sign in again
+func loginAllowed(w http.ResponseWriter, guard *LoginGuard, username, ip string) bool {
+	wait, err := guard.Wait(username, ip)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return false
+	}
+	if wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		respondWithError(w, http.StatusTooManyRequests, "Too many failed sign-in attempts, try again later")
+		return false
+	}
+	return true
+}
+
+// signIn responds with a new session of user, whose failed sign-ins are
+// forgotten
+func signIn(w http.ResponseWriter, r *http.Request, db *sql.DB, guard *LoginGuard, user User) {
+	if err := guard.Succeed(user.Username, clientIP(r)); err != nil {
+		log.Printf("Failed to reset failed sign-ins: %v", err)
+	}
+	session, err := createSession(db, user, r)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	respondWithJSON(w, http.StatusOK, session)
+}
+
+// Sign in with a username and password. Wrong passwords, unknown usernames
+// and disabled users get the same answer; repeated failures are slowed down
+// and then locked out with 429, whether the username exists or not. Users
+// with two-factor authentication get a challenge to complete with a code.
+func login(db *sql.DB, guard *LoginGuard) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req LoginRequest
+		if err := decodeRequest(r, &req); err != nil {
+			respondWithError(w, payloadErrorStatus(err), "Invalid request payload: "+err.Error())
+			return
+		}
+		defer r.Body.Close()
+
+		ip := clientIP(r)
+		if !loginAllowed(w, guard, req.Username, ip) {
+			return
+		}
+
+		user, ok, err := authenticate(db, req.Username, req.Password)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if !ok {
+			if err := guard.Fail(req.Username, ip); err != nil {
+				log.Printf("Failed to record a failed sign-in: %v", err)
+			}
+			respondWithError(w, http.StatusUnauthorized, "Invalid username or password")
+			return
+		}
+
+		if user.TwoFactorEnabled {
+			challenge, err := createLoginChallenge(db, user, r)
+			if err != nil {
+				respondWithError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			respondWithJSON(w, http.StatusOK, challenge)
+			return
+		}
+		signIn(w, r, db, guard, user)
+	}
+}
+
+// Sign out the session of the bearer token
+func logout(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		result, err := db.Exec("DELETE FROM sessions WHERE token_hash = ?", hashToken(bearerToken(r)))
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			respondWithError(w, http.StatusUnauthorized, "Not signed in")
+			return
+		}
+		respondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
+	}
+}
+
+// Get the session of the bearer token and its user
+func getSession(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session, ok := requireSessionToEnroll(db, w, r)
+		if !ok {
+			return
+		}
+		respondWithJSON(w, http.StatusOK, session)
+	}
+}
+
+// Get the usernames and IPs with failed sign-ins, and their lockouts
+func getLoginFailures(db *sql.DB, guard *LoginGuard) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := requireAdmin(db, w, r); !ok {
+			return
+		}
+		list, err := guard.List()
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		respondWithJSON(w, http.StatusOK, list)
+	}
+}
+
+// Clear the failed sign-ins and lockout of a username or IP
+func clearLoginFailures(db *sql.DB, guard *LoginGuard) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := requireAdmin(db, w, r); !ok {
+			return
+		}
+		if err := checkQueryParams(r, "username", "ip"); err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		query := r.URL.Query()
+		username, ip := query.Get("username"), query.Get("ip")
+		if (username == "") == (ip == "") {
+			respondWithError(w, http.StatusBadRequest, "Give either username or ip")
+			return
+		}
+		kind, value := LoginByUsername, username
+		if ip != "" {
+			kind, value = LoginByIP, ip
+		}
+
+		cleared, err := guard.Clear(kind, value)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if !cleared {
+			respondWithError(w, http.StatusNotFound, "No failed sign-ins to clear")
+			return
+		}
+		respondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
+	}
+}
@@ -0,0 +1,146 @@
+package condomngr
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"sort"
+	"strings"
+	"time"
+)
+
+// MailAttachment is a file attached to an email
+type MailAttachment struct {
+	Filename    string
+	ContentType string
+	Data        []byte
+}
+
+// Mailer sends email through an SMTP server. It uses STARTTLS when the server
+// offers it, and authenticates only when a username is set.
+type Mailer struct {
+	addr     string // host:port
+	username string
+	password string
+	from     string
+}
+
+// NewMailer creates a mailer. An empty address or sender disables email.
+func NewMailer(addr, username, password, from string) *Mailer {
+	return &Mailer{addr: addr, username: username, password: password, from: from}
+}
+
+// Enabled reports whether an SMTP server and sender are configured
+func (m *Mailer) Enabled() bool {
+	return m.addr != "" && m.from != ""
+}
+
+// Send delivers a plain text email with optional attachments to one recipient
+func (m *Mailer) Send(to, subject, body string, attachments ...MailAttachment) error {
+	return m.send(to, subject, body, nil, attachments)
+}
+
+// SendWithUnsubscribe sends like Send, ending the body with a link to stop
+// these emails. The link is also in the List-Unsubscribe headers, so mail
+// clients can offer one-click unsubscribing (RFC 8058).
+func (m *Mailer) SendWithUnsubscribe(to, subject, body, unsubscribeURL string, attachments ...MailAttachment) error {
+	body = strings.TrimRight(body, "\n") + "\n\n--\nTo stop receiving these emails, open " + unsubscribeURL + "\n"
+	header := textproto.MIMEHeader{
+		"List-Unsubscribe":      {"<" + unsubscribeURL + ">"},
+		"List-Unsubscribe-Post": {"List-Unsubscribe=One-Click"},
+	}
+	return m.send(to, subject, body, header, attachments)
+}
+
+// Reply sends like Send as an answer to the message with messageID, so mail
+// clients show them together. Without a message id it is a plain email.
+func (m *Mailer) Reply(to, subject, body, messageID string) error {
+	var header textproto.MIMEHeader
+	if messageID != "" {
+		header = textproto.MIMEHeader{"In-Reply-To": {messageID}, "References": {messageID}}
+	}
+	return m.send(to, subject, body, header, nil)
+}
+
+func (m *Mailer) send(to, subject, body string, header textproto.MIMEHeader, attachments []MailAttachment) error {
+	if !m.Enabled() {
+		return fmt.Errorf("email is not configured")
+	}
+	msg, err := buildMail(m.from, to, subject, body, header, attachments)
+	if err != nil {
+		return err
+	}
+	var auth smtp.Auth
+	if m.username != "" {
+		host, _, err := net.SplitHostPort(m.addr)
+		if err != nil {
+			return fmt.Errorf("invalid SMTP address %q: %v", m.addr, err)
+		}
+		auth = smtp.PlainAuth("", m.username, m.password, host)
+	}
+	return smtp.SendMail(m.addr, auth, m.from, []string{to}, msg)
+}
+
+// buildMail encodes a message as MIME: the body as quoted-printable UTF-8
+// text, followed by the attachments in base64. Header adds to the message
+// headers.
+func buildMail(from, to, subject, body string, header textproto.MIMEHeader, attachments []MailAttachment) ([]byte, error) {
+	var buf bytes.Buffer
+	parts := multipart.NewWriter(&buf)
+	fmt.Fprintf(&buf, "From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\nMIME-Version: 1.0\r\n",
+		from, to, mime.QEncoding.Encode("utf-8", subject), time.Now().Format(time.RFC1123Z))
+	keys := make([]string, 0, len(header))
+	for key := range header {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		for _, value := range header[key] {
+			fmt.Fprintf(&buf, "%s: %s\r\n", key, value)
+		}
+	}
+	fmt.Fprintf(&buf, "Content-Type: multipart/mixed; boundary=%q\r\n\r\n", parts.Boundary())
+
+	text, err := parts.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {"text/plain; charset=utf-8"},
+		"Content-Transfer-Encoding": {"quoted-printable"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	qp := quotedprintable.NewWriter(text)
+	if _, err := qp.Write([]byte(body)); err != nil {
+		return nil, err
+	}
+	if err := qp.Close(); err != nil {
+		return nil, err
+	}
+
+	for _, attachment := range attachments {
+		part, err := parts.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {attachment.ContentType},
+			"Content-Transfer-Encoding": {"base64"},
+			"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": attachment.Filename})},
+		})
+		if err != nil {
+			return nil, err
+		}
+		// Base64 lines are wrapped at 76 characters as MIME requires
+		encoded := base64.StdEncoding.EncodeToString(attachment.Data)
+		for len(encoded) > 76 {
+			fmt.Fprintf(part, "%s\r\n", encoded[:76])
+			encoded = encoded[76:]
+		}
+		fmt.Fprintf(part, "%s\r\n", encoded)
+	}
+	if err := parts.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -1,22 +1,25 @@
-package main
+package condomngr
 
 import (
+	"context"
 	"database/sql"
 	"embed"
 	"encoding/json"
-	"flag"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"net/http"
 	"os"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/mattn/go-sqlite3"
 )
 
 //go:embed static
@@ -29,20 +32,35 @@ var (
 	CommitHash = ""
 )
 
-const (
-	dbFile = "condo.db"
-	port   = "8080"
-)
+const port = "8080"
+
+// dbFile is the SQLite database every command works on. Set with -db.
+var dbFile = "condo.db"
 
 // Models
 type Resident struct {
-	ID        int       `json:"id"`
-	Name      string    `json:"name"`
-	Unit      string    `json:"unit"`
-	Contact   string    `json:"contact"`
-	Email     string    `json:"email"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
+	ID            int       `json:"id"`
+	Name          string    `json:"name"`
+	Unit          string    `json:"unit"`
+	Contact       string    `json:"contact"`
+	Email         string    `json:"email"`
+	NotifyChannel string    `json:"notify_channel"` // reminders channel: "" (automatic), "email", "sms" or "none"
+	MoveInDate    string    `json:"move_in_date"`   // YYYY-MM-DD, empty if unknown
+	MoveOutDate   string    `json:"move_out_date"`  // YYYY-MM-DD, the handover day; empty while living there
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+
+	// When the resident's personal data was erased, with their name replaced
+	// by a placeholder; null otherwise. Set by the anonymize endpoint only.
+	AnonymizedAt *time.Time `json:"anonymized_at"`
+
+	// Values of the custom fields, by key. On update, keys left out keep
+	// their value and null removes it.
+	Custom map[string]interface{} `json:"custom"`
+
+	// Channel per type of notification. Its reminders channel is
+	// notify_channel. Left out on update, the preferences don't change.
+	Notifications *NotificationPreferences `json:"notifications,omitempty"`
 }
 
 type Payment struct {
@@ -52,43 +70,176 @@ type Payment struct {
 	Amount       float64   `json:"amount"`
 	Description  string    `json:"description"`
 	PaymentDate  string    `json:"payment_date"`
+	Method       string    `json:"method"`
+	Status       string    `json:"status"`
+	Reference    string    `json:"reference"` // id in an external system, e.g. a Stripe checkout session
 	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+
+	// The reference of the bank statement line the payment was reconciled
+	// with, empty until a match is confirmed
+	BankReference string `json:"bank_reference,omitempty"`
+
+	// Payments by check only: the cheque and whether it cleared or bounced,
+	// and when. Uncleared cheques are pending until they clear.
+	ChequeNumber     string `json:"cheque_number,omitempty"`
+	ChequeBank       string `json:"cheque_bank,omitempty"`
+	ChequeStatus     string `json:"cheque_status,omitempty"`
+	ChequeStatusDate string `json:"cheque_status_date,omitempty"`
+
+	// The charges the payment settles and what is left of it, only in
+	// GET /payments/{id}. Allocations is left out when it settles none.
+	Allocations []Allocation `json:"allocations,omitempty"`
+	Unallocated *float64     `json:"unallocated,omitempty"`
 }
 
+// Payment statuses. Only confirmed payments count towards balances.
+const (
+	PaymentStatusConfirmed = "confirmed"
+	PaymentStatusPending   = "pending" // a cheque not cleared yet
+	PaymentStatusBounced   = "bounced" // a cheque that bounced
+)
+
 type Expense struct {
 	ID          int       `json:"id"`
-	Amount      float64   `json:"amount"`
+	Amount      float64   `json:"amount"` // in the base currency
 	Description string    `json:"description"`
 	ExpenseDate string    `json:"expense_date"`
 	Category    string    `json:"category"`
 	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+
+	// Expenses invoiced in another currency keep the invoiced amount and the
+	// rate it was converted at, in base currency units per unit of Currency.
+	// Currency is empty for expenses in the base currency.
+	Currency       string  `json:"currency,omitempty"`
+	OriginalAmount float64 `json:"original_amount,omitempty"`
+	ExchangeRate   float64 `json:"exchange_rate,omitempty"`
+
+	// The reference of the bank statement line the expense was reconciled
+	// with, empty until a match is confirmed
+	BankReference string `json:"bank_reference,omitempty"`
+
+	// Recoverable tax (VAT) included in amount, at a rate in percent.
+	// Without a rate there is no tax and amount is all net.
+	TaxRate   float64 `json:"tax_rate"`
+	TaxAmount float64 `json:"tax_amount"`
+
+	// Who was paid, and tags to find expenses across categories, such as
+	// "roof-2024" for the works of a project
+	Vendor string   `json:"vendor,omitempty"`
+	Tags   []string `json:"tags,omitempty"`
 }
 
 // ExportData represents the entire database structure for export/import
 type ExportData struct {
-	Residents  []Resident `json:"residents"`
-	Payments   []Payment  `json:"payments"`
-	Expenses   []Expense  `json:"expenses"`
-	ExportDate string     `json:"export_date"`
+	Residents    []Resident      `json:"residents"`
+	Payments     []Payment       `json:"payments"`
+	Expenses     []Expense       `json:"expenses"`
+	CustomFields []CustomField   `json:"custom_fields,omitempty"` // definitions of the residents' custom values
+	ExportDate   string          `json:"export_date"`
+	Filter       *ExportFilter   `json:"filter,omitempty"`   // set on partial exports
+	Manifest     *ExportManifest `json:"manifest,omitempty"` // missing from exports of older versions
+
+	lines map[string][]int // lines of the records of each section, in NDJSON exports
+}
+
+// position names record i of section in errors: by its index, or by its line
+// in an NDJSON export
+func (d ExportData) position(section string, i int) string {
+	if d.lines != nil {
+		return fmt.Sprintf("line %d", d.lines[section][i])
+	}
+	return fmt.Sprintf("%s[%d]", section, i)
 }
 
-func main() {
+// runServe starts the web server, the default command
+func runServe(args []string) int {
 	// Parse command-line flags
-	loadSampleData := flag.Bool("sample", false, "Load sample data into the database")
-	showVersion := flag.Bool("version", false, "Show version information")
-	flag.Parse()
+	flags, showVersion := commandFlags("serve")
+	loadSampleData := flags.Bool("sample", false, "Replace the data in the database with sample data")
+	confirmed := flags.Bool("yes", false, "Don't ask before -sample replaces existing data")
+	seedFile := flags.String("seed", "", "JSON file in the export format to load when the database is empty")
+	readOnlyMode := flags.Bool("read-only", false, "Reject every API request that changes data, e.g. for a public mirror")
+	seedForce := flags.Bool("seed-force", false, "Load the -seed file even if the database has data, replacing it")
+	telegramToken := flags.String("telegram-token", os.Getenv("CONDO_TELEGRAM_TOKEN"), "Telegram bot token for notifications (or CONDO_TELEGRAM_TOKEN)")
+	telegramChatID := flags.String("telegram-chat-id", os.Getenv("CONDO_TELEGRAM_CHAT_ID"), "Telegram chat id to post notifications to (or CONDO_TELEGRAM_CHAT_ID)")
+	notifyEvents := flags.String("notify-events", strings.Join(allEventTypes, ","), "Comma-separated list of event types to send notifications for")
+	notifyThreshold := flags.Float64("notify-payment-threshold", 1000, "Notify when a payment of at least this amount is recorded")
+	twilioAccountSID := flags.String("twilio-account-sid", os.Getenv("CONDO_TWILIO_ACCOUNT_SID"), "Twilio account SID for SMS (or CONDO_TWILIO_ACCOUNT_SID)")
+	twilioAuthToken := flags.String("twilio-auth-token", os.Getenv("CONDO_TWILIO_AUTH_TOKEN"), "Twilio auth token for SMS (or CONDO_TWILIO_AUTH_TOKEN)")
+	twilioFrom := flags.String("twilio-from", os.Getenv("CONDO_TWILIO_FROM"), "Phone number SMS are sent from (or CONDO_TWILIO_FROM)")
+	smsMaxPerRun := flags.Int("sms-max-per-run", 50, "Maximum number of SMS sent by a single reminder run")
+	smtpAddr := flags.String("smtp-addr", os.Getenv("CONDO_SMTP_ADDR"), "SMTP server host:port email is sent through (or CONDO_SMTP_ADDR)")
+	smtpUsername := flags.String("smtp-username", os.Getenv("CONDO_SMTP_USERNAME"), "SMTP username, if the server requires authentication (or CONDO_SMTP_USERNAME)")
+	smtpPassword := flags.String("smtp-password", os.Getenv("CONDO_SMTP_PASSWORD"), "SMTP password (or CONDO_SMTP_PASSWORD)")
+	smtpFrom := flags.String("smtp-from", os.Getenv("CONDO_SMTP_FROM"), "Address email is sent from (or CONDO_SMTP_FROM)")
+	currency := flags.String("currency", defaultCurrency, "ISO 4217 code of the currency amounts are recorded in")
+	smsCountryPrefix := flags.String("sms-country-prefix", "", "Country prefix added to phone numbers without one, e.g. +351")
+	stripeSecretKey := flags.String("stripe-secret-key", os.Getenv("CONDO_STRIPE_SECRET_KEY"), "Stripe secret key for card payment links (or CONDO_STRIPE_SECRET_KEY)")
+	stripeWebhookSecret := flags.String("stripe-webhook-secret", os.Getenv("CONDO_STRIPE_WEBHOOK_SECRET"), "Stripe webhook signing secret (or CONDO_STRIPE_WEBHOOK_SECRET)")
+	inboundMailSecret := flags.String("inbound-mail-secret", os.Getenv("CONDO_INBOUND_MAIL_SECRET"), "Token a mail-to-webhook service sends emails to be made maintenance requests with (or CONDO_INBOUND_MAIL_SECRET; empty disables inbound mail)")
+	publicURL := flags.String("public-url", "http://localhost:"+port, "Public URL of the application, used in links sent to residents")
+	basePath := flags.String("base-path", "", "Path prefix the application is served under behind a reverse proxy, e.g. /condo")
+	sheetsCredentials := flags.String("sheets-credentials", os.Getenv("CONDO_SHEETS_CREDENTIALS"), "Google service account JSON key file for Sheets sync (or CONDO_SHEETS_CREDENTIALS)")
+	sheetsSpreadsheetID := flags.String("sheets-spreadsheet-id", os.Getenv("CONDO_SHEETS_SPREADSHEET_ID"), "Google spreadsheet id to sync payments and expenses to (or CONDO_SHEETS_SPREADSHEET_ID)")
+	sheetsMode := flags.String("sheets-mode", SheetsModeAppend, "Google Sheets sync mode: append or refresh")
+	sheetsInterval := flags.Duration("sheets-interval", 0, "Sync to Google Sheets at this interval, e.g. 1h (0 disables scheduled syncs)")
+	monthlyFee := flags.Float64("monthly-fee", 0, "Monthly dues charged to residents without a fee schedule (0 charges only scheduled fees)")
+	interestRate := flags.Float64("interest-rate", 0, "Annual interest rate in percent on overdue charges (0 disables interest)")
+	interestGraceDays := flags.Int("interest-grace-days", defaultInterestGraceDays, "Days a charge can be overdue before it accrues interest")
+	duesProration := flags.String("dues-proration", ProrationDays, "How dues are pro-rated in the months residents move in or out: days or half-month")
+	vacantUnits := flags.String("vacant-units", VacantSkip, "Dues for units nobody lives in all month: skip, or owner to charge the last resident who lived there")
+	portalSecret := flags.String("portal-secret", os.Getenv("CONDO_PORTAL_SECRET"), "Secret used to sign resident portal links (or CONDO_PORTAL_SECRET; generated and stored in the database if empty)")
+	maxBodySize := flags.Int64("max-body-size", defaultMaxBodySize, "Maximum size in bytes of API request bodies")
+	maxImportSize := flags.Int64("max-import-size", defaultMaxImportSize, "Maximum size in bytes of a database import upload")
+	maxAttachmentSize := flags.Int64("attachment-max-size", defaultMaxAttachmentSize, "Maximum size in bytes of an attached file")
+	attachmentQuota := flags.Int64("attachment-quota", 0, "Bytes all attached files of a condo may take on disk, each stored once (0 for no limit)")
+	laxJSON := flags.Bool("lax-json", false, "Ignore unknown fields and trailing data in JSON request bodies")
+	paymentAllocation := flags.String("payment-allocation", AllocationFIFO, "How payments settle charges: fifo (oldest charges first) or manual (only by hand)")
+	countUnclearedCheques := flags.Bool("count-uncleared-cheques", false, "Count cheques as paid before they clear")
+	csvLocale := flags.String("csv-locale", defaultCSVLocale, "Locale of CSV reports that don't ask for one with ?locale: en or pt-PT")
+	flags.StringVar(&defaultLanguage, "lang", LangEnglish, "Language of messages for requests that don't ask for one with ?lang or Accept-Language: en or pt")
+	fiscalYearStart := flags.Int("fiscal-year-start", 1, "Month (1-12) the fiscal year starts in; years in reports are fiscal years named after the year they start in")
+	reportGrace := flags.Duration("report-grace", defaultReportGrace, "How late a scheduled report is still emailed, e.g. when the server was down as it was due (later ones are logged as missed)")
+	trashRetention := flags.Duration("trash-retention", defaultTrashRetention, "How long deleted records can be restored before they are purged, e.g. 720h (0 keeps them forever)")
+	loginBackoffAfter := flags.Int("login-backoff-after", defaultLoginBackoffAfter, "Failed sign-ins of a username or IP before further attempts are slowed down")
+	loginLockoutAfter := flags.Int("login-lockout-after", defaultLoginLockoutAfter, "Failed sign-ins of a username or IP before it is locked out")
+	loginLockout := flags.Duration("login-lockout", defaultLoginLockout, "How long a username or IP is locked out for")
+	backupDir := flags.String("backup-dir", "", "Directory scheduled backups of the database are written to (empty disables them)")
+	expiryLeadDays := flags.String("expiry-lead-days", "30,7,1", "Comma-separated days before an expiry its reminders are sent (empty disables them)")
+	backupInterval := flags.Duration("backup-interval", 24*time.Hour, "How often a scheduled backup is taken, e.g. 6h")
+	backupKeep := flags.Int("backup-keep", 7, "Number of backups kept, locally and in the S3 bucket (0 keeps them all)")
+	cacheTTL := flags.Duration("cache-ttl", 30*time.Second, "How long the dashboard, counts and reports are cached when their data doesn't change, e.g. 1m (0 disables the cache)")
+	backupS3 := s3Flags(flags)
+	timezone := flags.String("timezone", os.Getenv("CONDO_TIMEZONE"), "IANA timezone the condominium operates in, e.g. Europe/Lisbon (or CONDO_TIMEZONE; defaults to the server's)")
+	flags.Parse(args)
 
 	// Show version and exit if requested
 	if *showVersion {
-		fmt.Printf("Condo Manager %s\n", Version)
-		if BuildTime != "" {
-			fmt.Printf("Build Time: %s\n", BuildTime)
-		}
-		if CommitHash != "" {
-			fmt.Printf("Commit: %s\n", CommitHash)
-		}
-		return
+		printVersion()
+		return 0
+	}
+
+	location, err := loadLocation(*timezone)
+	if err != nil {
+		log.Fatalf("Invalid timezone: %v", err)
+	}
+
+	if !validAllocation(*paymentAllocation) {
+		log.Fatalf("Invalid -payment-allocation %q, must be %s or %s", *paymentAllocation, AllocationFIFO, AllocationManual)
+	}
+	if _, ok := findCSVLocale(*csvLocale); !ok {
+		log.Fatalf("Invalid -csv-locale %q, must be en or pt-PT", *csvLocale)
+	}
+	if !validLanguage(defaultLanguage) {
+		log.Fatalf("Invalid -lang %q, must be %s or %s", defaultLanguage, LangEnglish, LangPortuguese)
+	}
+	if *fiscalYearStart < 1 || *fiscalYearStart > 12 {
+		log.Fatalf("Invalid -fiscal-year-start %d, must be a month from 1 to 12", *fiscalYearStart)
 	}
+	cal := calendar{location: location, fiscalYearStart: *fiscalYearStart}
+	rules := paymentRules{allocation: *paymentAllocation, countUnclearedCheques: *countUnclearedCheques}
 
 	// Initialize database
 	db, err := initDB()
@@ -97,8 +248,18 @@ func main() {
 	}
 	defer db.Close()
 
+	if *loadSampleData && *seedFile != "" {
+		log.Fatalf("Use either -sample or -seed, not both")
+	}
+	if *readOnlyMode && (*loadSampleData || *seedFile != "") {
+		log.Fatalf("Can't load sample or seed data in read-only mode")
+	}
+
 	// Load sample data if requested
 	if *loadSampleData {
+		if err := confirmSampleData(db, *confirmed); err != nil {
+			log.Fatalf("Not loading sample data: %v", err)
+		}
 		err := insertSampleData(db)
 		if err != nil {
 			log.Printf("Warning: Failed to load sample data: %v", err)
@@ -107,67 +268,235 @@ func main() {
 		}
 	}
 
-	// Initialize router
-	r := mux.NewRouter()
+	// Load seed data into a new database
+	if *seedFile != "" {
+		applied, err := loadSeed(db, *seedFile, *seedForce, *laxJSON, rules)
+		if err != nil {
+			log.Fatalf("Failed to load seed data: %v", err)
+		}
+		if applied {
+			log.Printf("Seed data loaded from %s", *seedFile)
+		} else {
+			log.Printf("Database is not empty, not loading %s (use -seed-force to replace the data)", *seedFile)
+		}
+	}
+
+	// Allocate payments to charges, which also applies a change of
+	// -payment-allocation or -count-uncleared-cheques to existing payments
+	if err := syncPayments(db, rules); err != nil {
+		log.Fatal(err)
+	}
+
+	// Initialize notifications
+	var channels []Channel
+	if *telegramToken != "" && *telegramChatID != "" {
+		channels = append(channels, NewTelegramChannel(*telegramToken, *telegramChatID))
+	}
+	notifier := NewNotifier(strings.Split(*notifyEvents, ","), *notifyThreshold, channels...)
+	notifier.Start()
+
+	// Remind of contracts, leases and other expiries ahead of time
+	leadDays, err := parseLeadDays(*expiryLeadDays)
+	if err != nil {
+		log.Fatalf("Invalid expiry lead days: %v", err)
+	}
+	scheduleExpiryReminders(db, notifier, leadDays, cal)
+
+	// Remind of the tasks left open past their due date
+	scheduleTaskReminders(db, notifier, cal)
+
+	// Initialize SMS channel, disabled unless Twilio is configured
+	var smsProvider SMSProvider
+	if *twilioAccountSID != "" && *twilioAuthToken != "" && *twilioFrom != "" {
+		smsProvider = NewTwilioProvider(*twilioAccountSID, *twilioAuthToken, *twilioFrom)
+	}
+	sms := NewSMSQueue(db, smsProvider, *smsMaxPerRun, *smsCountryPrefix)
+	sms.Start()
+
+	// Initialize email, disabled unless an SMTP server is configured
+	mailer := NewMailer(*smtpAddr, *smtpUsername, *smtpPassword, *smtpFrom)
 
-	// API routes
-	api := r.PathPrefix("/api").Subrouter()
-	// Residents API endpoints
-	api.HandleFunc("/residents", getResidents(db)).Methods("GET")
-	api.HandleFunc("/residents", createResident(db)).Methods("POST")
-	api.HandleFunc("/residents/{id:[0-9]+}", getResident(db)).Methods("GET")
-	api.HandleFunc("/residents/{id:[0-9]+}", updateResident(db)).Methods("PUT")
-	api.HandleFunc("/residents/{id:[0-9]+}", deleteResident(db)).Methods("DELETE")
+	// Email the scheduled reports as they come due
+	if *reportGrace < 0 {
+		log.Fatalf("Invalid -report-grace %s, must be 0 or more", *reportGrace)
+	}
+	scheduleReports(db, mailer, *reportGrace, cal, *csvLocale)
 
-	// Payments API endpoints
-	api.HandleFunc("/payments", getPayments(db)).Methods("GET")
-	api.HandleFunc("/payments", createPayment(db)).Methods("POST")
-	api.HandleFunc("/payments/{id:[0-9]+}", getPayment(db)).Methods("GET")
-	api.HandleFunc("/payments/{id:[0-9]+}", updatePayment(db)).Methods("PUT")
-	api.HandleFunc("/payments/{id:[0-9]+}", deletePayment(db)).Methods("DELETE")
+	// Initialize Google Sheets sync, disabled unless configured
+	sheets, err := NewSheetsSync(db, *sheetsCredentials, *sheetsSpreadsheetID, *sheetsMode)
+	if err != nil {
+		log.Fatalf("Failed to configure Google Sheets sync: %v", err)
+	}
+	sheets.Schedule(*sheetsInterval)
 
-	// Expenses API endpoints
-	api.HandleFunc("/expenses", getExpenses(db)).Methods("GET")
-	api.HandleFunc("/expenses", createExpense(db)).Methods("POST")
-	api.HandleFunc("/expenses/{id:[0-9]+}", getExpense(db)).Methods("GET")
-	api.HandleFunc("/expenses/{id:[0-9]+}", updateExpense(db)).Methods("PUT")
-	api.HandleFunc("/expenses/{id:[0-9]+}", deleteExpense(db)).Methods("DELETE")
+	// Purge old deleted records
+	scheduleTrashPurge(db, *trashRetention)
 
-	// Export and Import API endpoints
-	api.HandleFunc("/export", exportDatabase(db)).Methods("GET")
-	api.HandleFunc("/import", importDatabase(db)).Methods("POST")
+	// Attached files are kept next to the database. Those of records that are
+	// gone, past the trash, are collected hourly.
+	attachments, err := NewAttachmentStore(db, *maxAttachmentSize, *attachmentQuota)
+	if err != nil {
+		log.Fatalf("Failed to set up attachments: %v", err)
+	}
+	attachments.ScheduleCollect(time.Hour)
 
-	// Search API endpoints
-	api.HandleFunc("/search/residents", searchResidents(db)).Methods("GET")
-	api.HandleFunc("/search/payments", searchPayments(db)).Methods("GET")
-	api.HandleFunc("/search/expenses", searchExpenses(db)).Methods("GET")
+	// Initialize Stripe, inert unless a secret key is configured
+	stripe := NewStripe(*stripeSecretKey, *stripeWebhookSecret, *currency, *publicURL)
 
-	// Reports Export endpoints
-	api.HandleFunc("/reports/payments/export", exportPaymentsReport(db)).Methods("GET")
-	api.HandleFunc("/reports/expenses/export", exportExpensesReport(db)).Methods("GET")
+	// Back up the default condo's database, uploading each backup to the S3
+	// bucket if one is configured
+	backupTarget, err := NewS3Target(*backupS3)
+	if err != nil {
+		log.Fatalf("Invalid backup target: %v", err)
+	}
+	if backupTarget != nil && *backupDir == "" {
+		log.Fatalf("-backup-s3-bucket requires -backup-dir")
+	}
+	if *loginBackoffAfter < 1 || *loginLockoutAfter < 1 || *loginLockout <= 0 {
+		log.Fatalf("Invalid sign-in limits: -login-backoff-after and -login-lockout-after must be at least 1 and -login-lockout positive")
+	}
+	if *backupKeep < 0 {
+		log.Fatalf("Invalid -backup-keep %d, must be 0 or more", *backupKeep)
+	}
+	if *basePath != "" && !strings.HasPrefix(*basePath, "/") {
+		log.Fatalf("Invalid -base-path %q, must start with /", *basePath)
+	}
+	backups := NewBackups(db, *backupDir, *backupKeep, backupTarget, notifier)
+	backups.Schedule(*backupInterval)
 
-	// Serve static files
-	r.PathPrefix("/static/").Handler(http.FileServer(http.FS(content)))
+	// Initialize the resident portal
+	secret := []byte(*portalSecret)
+	if len(secret) == 0 {
+		secret, err = loadOrCreateSecret(db, "portal_secret")
+		if err != nil {
+			log.Fatalf("Failed to load portal secret: %v", err)
+		}
+	}
+	apiURL := condoAPIURL(*publicURL, DefaultCondoID)
+	portal := NewPortal(db, secret, apiURL)
+	unsubscribeSecret, err := loadOrCreateSecret(db, "unsubscribe_secret")
+	if err != nil {
+		log.Fatalf("Failed to load unsubscribe secret: %v", err)
+	}
+	unsubscribe := NewUnsubscribe(unsubscribeSecret, apiURL)
+
+	// Other condos are opened at startup, or when created. They share the
+	// notifications and email but not SMS, Sheets sync or Stripe, which are
+	// tied to the default condo's database, nor users and sign-in, which
+	// Condos serves from it. Their links point under /api/v1/condos/{id} of
+	// the public URL, and their backups go to a condo-{id} directory of
+	// -backup-dir and prefix in the bucket.
+	condos := NewCondos(db, func(id int, condoDB *sql.DB) (*Server, error) {
+		if err := syncPayments(condoDB, rules); err != nil {
+			return nil, err
+		}
+		scheduleTrashPurge(condoDB, *trashRetention)
+		scheduleExpiryReminders(condoDB, notifier, leadDays, cal)
+		scheduleTaskReminders(condoDB, notifier, cal)
+		scheduleReports(condoDB, mailer, *reportGrace, cal, *csvLocale)
+		attachments, err := NewAttachmentStore(condoDB, *maxAttachmentSize, *attachmentQuota)
+		if err != nil {
+			return nil, err
+		}
+		attachments.ScheduleCollect(time.Hour)
+		var condoBackups *Backups
+		if *backupDir != "" {
+			sub := fmt.Sprintf("condo-%d", id)
+			condoBackups = NewBackups(condoDB, filepath.Join(*backupDir, sub), *backupKeep, backupTarget.Under(sub+"/"), notifier)
+			condoBackups.Schedule(*backupInterval)
+		}
+		return NewServer(condoDB, Options{
+			ReadOnly:              *readOnlyMode,
+			MaxBodySize:           *maxBodySize,
+			MaxImportSize:         *maxImportSize,
+			Currency:              *currency,
+			MonthlyFee:            *monthlyFee,
+			DuesProration:         *duesProration,
+			VacantUnits:           *vacantUnits,
+			InterestRate:          *interestRate,
+			InterestGraceDays:     *interestGraceDays,
+			Location:              location,
+			FiscalYearStart:       *fiscalYearStart,
+			PaymentAllocation:     *paymentAllocation,
+			CountUnclearedCheques: *countUnclearedCheques,
+			LaxJSON:               *laxJSON,
+			CSVLocale:             *csvLocale,
+			Notifier:              notifier,
+			Mailer:                mailer,
+			InboundMailSecret:     *inboundMailSecret,
+			Attachments:           attachments,
+			Backups:               condoBackups,
+			CacheTTL:              *cacheTTL,
+			PublicURL:             *publicURL,
+			CondoID:               id,
+		})
+	})
+	defer condos.Close()
+	if err := condos.OpenAll(); err != nil {
+		log.Fatalf("Failed to open the condos: %v", err)
+	}
 
-	// Serve index page
-	r.PathPrefix("/").HandlerFunc(serveIndex)
+	server, err := NewServer(db, Options{
+		ReadOnly:              *readOnlyMode,
+		MaxBodySize:           *maxBodySize,
+		MaxImportSize:         *maxImportSize,
+		Currency:              *currency,
+		MonthlyFee:            *monthlyFee,
+		DuesProration:         *duesProration,
+		VacantUnits:           *vacantUnits,
+		InterestRate:          *interestRate,
+		InterestGraceDays:     *interestGraceDays,
+		Location:              location,
+		FiscalYearStart:       *fiscalYearStart,
+		PaymentAllocation:     *paymentAllocation,
+		CountUnclearedCheques: *countUnclearedCheques,
+		LaxJSON:               *laxJSON,
+		CSVLocale:             *csvLocale,
+		Notifier:              notifier,
+		SMS:                   sms,
+		Mailer:                mailer,
+		Sheets:                sheets,
+		Stripe:                stripe,
+		Portal:                portal,
+		Unsubscribe:           unsubscribe,
+		InboundMailSecret:     *inboundMailSecret,
+		Attachments:           attachments,
+		Backups:               backups,
+		LoginGuard:            NewLoginGuard(db, notifier, *loginBackoffAfter, *loginLockoutAfter, *loginLockout),
+		PasswordResets:        NewPasswordResets(db, mailer, apiURL),
+		Condos:                condos,
+		CacheTTL:              *cacheTTL,
+		PublicURL:             *publicURL,
+	})
+	if err != nil {
+		log.Fatalf("Failed to set up the server: %v", err)
+	}
+	defer server.Close()
 
-	// Start server
-	fmt.Printf("Server is running on http://localhost:%s\n", port)
-	log.Fatal(http.ListenAndServe(":"+port, r))
+	// Start server. The base path is removed before the condo is picked, so
+	// it is left out of the servers' options.
+	fmt.Printf("Server is running on http://localhost:%s%s/\n", port, strings.TrimSuffix(*basePath, "/"))
+	log.Fatal(http.ListenAndServe(":"+port, underBasePath(*basePath, condos.Handler(server))))
+	return 0
 }
 
 func initDB() (*sql.DB, error) {
+	return OpenDB(dbFile)
+}
+
+// OpenDB opens the database in file, creating it if needed, and brings its
+// schema up to date, ready for NewServer
+func OpenDB(file string) (*sql.DB, error) {
 	// Create database directory if it doesn't exist
-	dbDir := filepath.Dir(dbFile)
+	dbDir := filepath.Dir(file)
 	if dbDir != "." {
 		if err := os.MkdirAll(dbDir, 0755); err != nil {
 			return nil, fmt.Errorf("failed to create database directory: %v", err)
 		}
 	}
 
-	// Open database connection
-	db, err := sql.Open("sqlite3", dbFile)
+	// Open database connection, with the key of an encrypted database
+	db, err := openSQLite(file, dbKey)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open database: %v", err)
 	}
@@ -179,6 +508,12 @@ func initDB() (*sql.DB, error) {
 		return nil, fmt.Errorf("failed to create tables: %v", err)
 	}
 
+	// Apply schema migrations
+	if err := migrate(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to migrate database: %v", err)
+	}
+
 	return db, nil
 }
 
@@ -233,19 +568,62 @@ func createTables(db *sql.DB) error {
 	return nil
 }
 
-func serveIndex(w http.ResponseWriter, r *http.Request) {
-	data, err := content.ReadFile("static/index.html")
-	if err != nil {
-		http.Error(w, "Could not load page", http.StatusInternalServerError)
-		return
+// deprecatedAPI marks responses served under a deprecated prefix and points
+// clients at the same route under its successor
+func deprecatedAPI(prefix, successor string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Deprecation", "true")
+			w.Header().Set("Link", fmt.Sprintf("<%s%s>; rel=\"successor-version\"", successor, strings.TrimPrefix(r.URL.Path, prefix)))
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// apiMethods are the methods probed to work out which ones a path allows
+var apiMethods = []string{"GET", "POST", "PUT", "PATCH", "DELETE"}
+
+// apiFallback answers API requests no route handled: OPTIONS gets the allowed
+// methods, a known path with the wrong method a 405 and anything else a JSON
+// 404. It must be the last route registered on api.
+func apiFallback(api *mux.Router, fallback *mux.Route) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var allowed []string
+		for _, method := range apiMethods {
+			probe := r.Clone(r.Context())
+			probe.Method = method
+			var match mux.RouteMatch
+			if api.Match(probe, &match) && match.Route != fallback {
+				allowed = append(allowed, method)
+			}
+		}
+
+		if len(allowed) == 0 {
+			respondWithError(w, http.StatusNotFound, "Not found")
+			return
+		}
+
+		w.Header().Set("Allow", strings.Join(append(allowed, "OPTIONS"), ", "))
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		respondWithError(w, http.StatusMethodNotAllowed, "Method not allowed")
 	}
-	w.Header().Set("Content-Type", "text/html")
-	w.Write(data)
 }
 
 // Helper functions
+// respondWithError responds with the message in the response's language and
+// a code clients can branch on, the message id or else one for the status
 func respondWithError(w http.ResponseWriter, code int, message string) {
-	respondWithJSON(w, code, map[string]string{"error": message})
+	id, text := translate(responseLanguage(w), message)
+	if id == "" {
+		id = statusCodes[code]
+	}
+	if id == "" {
+		id = "error"
+	}
+	respondWithJSON(w, code, map[string]string{"error": text, "code": id})
 }
 
 func respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
@@ -259,109 +637,231 @@ func respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
 	w.Write(response)
 }
 
+// isUniqueViolation reports whether err is a UNIQUE constraint failure
+func isUniqueViolation(err error) bool {
+	var sqliteErr sqlite3.Error
+	return errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique
+}
+
 // Validation function for Resident data
 func validateResident(r Resident) error {
+	var errs ValidationErrors
 	if r.Name == "" {
-		return fmt.Errorf("name is required")
+		errs.Add("name", "name is required")
 	}
 	if r.Unit == "" {
-		return fmt.Errorf("unit is required")
+		errs.Add("unit", "unit is required")
 	}
 	if r.Email != "" {
 		// Simple email validation
 		if !strings.Contains(r.Email, "@") || !strings.Contains(r.Email, ".") {
-			return fmt.Errorf("invalid email format")
+			errs.Add("email", "invalid email format")
 		}
 	}
-	return nil
+	switch r.NotifyChannel {
+	case "", "email", "sms", "none":
+	default:
+		errs.Add("notify_channel", "notify channel must be one of email, sms or none")
+	}
+	if n := r.Notifications; n != nil {
+		validateNotificationPreferences(&errs, *n)
+		if r.NotifyChannel != "" && n.Reminders != "" && r.NotifyChannel != n.Reminders {
+			errs.Add("notify_channel", "notify_channel must match notifications.reminders")
+		}
+	}
+	for _, date := range []struct{ field, value string }{{"move_in_date", r.MoveInDate}, {"move_out_date", r.MoveOutDate}} {
+		if date.value == "" {
+			continue
+		}
+		if _, err := time.Parse("2006-01-02", date.value); err != nil {
+			errs.Add(date.field, date.field+" must be a date, YYYY-MM-DD")
+		}
+	}
+	if r.MoveInDate != "" && r.MoveOutDate != "" && r.MoveOutDate <= r.MoveInDate {
+		errs.Add("move_out_date", "move_out_date must be after move_in_date")
+	}
+	return errs.Err()
 }
 
 // Validation function for Payment data
 func validatePayment(p Payment) error {
+	var errs ValidationErrors
 	if p.ResidentID <= 0 {
-		return fmt.Errorf("resident is required")
+		errs.Add("resident_id", "resident is required")
 	}
 	if p.Amount <= 0 {
-		return fmt.Errorf("amount must be greater than zero")
+		errs.Add("amount", "amount must be greater than zero")
 	}
 	if p.PaymentDate == "" {
-		return fmt.Errorf("payment date is required")
+		errs.Add("payment_date", "payment date is required")
+	} else if _, err := time.Parse("2006-01-02", p.PaymentDate); err != nil {
+		// Validate date format
+		errs.Add("payment_date", "invalid date format, must be YYYY-MM-DD")
 	}
-	// Validate date format
-	_, err := time.Parse("2006-01-02", p.PaymentDate)
-	if err != nil {
-		return fmt.Errorf("invalid date format, must be YYYY-MM-DD")
+	switch p.Method {
+	case "", "cash", "transfer", "card", "check":
+	default:
+		errs.Add("method", "method must be one of cash, transfer, card or check")
 	}
-	return nil
+	if p.Method == "check" {
+		switch p.ChequeStatus {
+		case ChequePending:
+			if p.ChequeStatusDate != "" {
+				errs.Add("cheque_status_date", "a pending cheque has no status date")
+			}
+		case ChequeCleared, ChequeBounced:
+			if _, err := time.Parse("2006-01-02", p.ChequeStatusDate); err != nil {
+				errs.Add("cheque_status_date", "cheque status date is required as YYYY-MM-DD")
+			} else if p.ChequeStatusDate < p.PaymentDate {
+				errs.Add("cheque_status_date", "a cheque can't clear or bounce before the payment date")
+			}
+		default:
+			errs.Add("cheque_status", "cheque status must be one of pending, cleared or bounced")
+		}
+	} else if p.ChequeNumber != "" || p.ChequeBank != "" || p.ChequeStatus != "" || p.ChequeStatusDate != "" {
+		errs.Add("method", "cheque details are only for payments by check")
+	}
+	return errs.Err()
 }
 
 // Validation function for Expense data
 func validateExpense(e Expense) error {
-	if e.Amount <= 0 {
-		return fmt.Errorf("amount must be greater than zero")
+	var errs ValidationErrors
+	if e.Currency == "" && e.Amount <= 0 {
+		errs.Add("amount", "amount must be greater than zero")
+	}
+	if e.Currency != "" {
+		if !validCurrencyCode(e.Currency) {
+			errs.Add("currency", "currency must be a 3-letter ISO 4217 code")
+		}
+		if e.ExchangeRate <= 0 {
+			errs.Add("exchange_rate", "exchange rate is required for another currency than the base one")
+		}
+		if e.OriginalAmount <= 0 {
+			errs.Add("original_amount", "original amount is required for another currency than the base one")
+		}
+		if e.ExchangeRate > 0 && e.OriginalAmount > 0 && e.Amount != roundCents(e.OriginalAmount*e.ExchangeRate) {
+			errs.Add("amount", "amount must be original_amount times exchange_rate")
+		}
+	}
+	if e.TaxRate < 0 || e.TaxRate > 100 {
+		errs.Add("tax_rate", "tax rate must be between 0 and 100")
+	}
+	if e.TaxAmount < 0 {
+		errs.Add("tax_amount", "tax amount must not be negative")
+	} else if e.TaxAmount > 0 && e.TaxRate == 0 {
+		errs.Add("tax_amount", "tax amount requires a tax rate")
+	} else if e.TaxRate > 0 && e.TaxRate <= 100 && math.Abs(e.TaxAmount-includedTax(e.Amount, e.TaxRate)) > taxTolerance+1e-9 {
+		errs.Add("tax_amount", fmt.Sprintf("tax amount must be %.2f at %g%% of %.2f, within %.2f", includedTax(e.Amount, e.TaxRate), e.TaxRate, e.Amount, taxTolerance))
 	}
 	if e.Description == "" {
-		return fmt.Errorf("description is required")
+		errs.Add("description", "description is required")
+	}
+	for _, tag := range e.Tags {
+		if err := validateTag(tag); err != "" {
+			errs.Add("tags", err)
+			break
+		}
 	}
 	if e.ExpenseDate == "" {
-		return fmt.Errorf("expense date is required")
+		errs.Add("expense_date", "expense date is required")
+	} else if _, err := time.Parse("2006-01-02", e.ExpenseDate); err != nil {
+		// Validate date format
+		errs.Add("expense_date", "invalid date format, must be YYYY-MM-DD")
 	}
-	// Validate date format
-	_, err := time.Parse("2006-01-02", e.ExpenseDate)
-	if err != nil {
-		return fmt.Errorf("invalid date format, must be YYYY-MM-DD")
+	return errs.Err()
+}
+
+// validCurrencyCode reports whether code looks like an ISO 4217 code
+func validCurrencyCode(code string) bool {
+	if len(code) != 3 {
+		return false
 	}
-	return nil
+	for _, c := range code {
+		if c < 'A' || c > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+// convertExpense prepares an expense for validation against the base
+// currency. An expense in another currency gets its amount from the original
+// amount and rate; one in the base currency drops them.
+func convertExpense(e *Expense, base string) {
+	e.Currency = strings.ToUpper(strings.TrimSpace(e.Currency))
+	if e.Currency == "" || e.Currency == base {
+		e.Currency, e.OriginalAmount, e.ExchangeRate = "", 0, 0
+		return
+	}
+	e.Amount = roundCents(e.OriginalAmount * e.ExchangeRate)
 }
 
 // Handlers for resident endpoints
 func getResidents(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		rows, err := db.Query("SELECT id, name, unit, contact, email, created_at, updated_at FROM residents ORDER BY name")
+		if err := checkQueryParams(r, "unit", "fields", "format", "locale"); err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		format, err := listFormat(r)
 		if err != nil {
+			respondWithError(w, http.StatusNotAcceptable, err.Error())
+			return
+		}
+
+		filter := residentFilter(r)
+		if err := setTotalCount(w, db, "SELECT COUNT(*) FROM residents"+filter.where(), filter.args...); err != nil {
 			respondWithError(w, http.StatusInternalServerError, err.Error())
 			return
 		}
-		defer rows.Close()
 
-		residents := []Resident{}
-		for rows.Next() {
-			var resident Resident
-			if err := rows.Scan(&resident.ID, &resident.Name, &resident.Unit, &resident.Contact, &resident.Email, &resident.CreatedAt, &resident.UpdatedAt); err != nil {
-				respondWithError(w, http.StatusInternalServerError, err.Error())
+		if fields := r.URL.Query().Get("fields"); fields != "" {
+			names, err := residentFields.parse(fields)
+			if err != nil {
+				respondWithError(w, http.StatusBadRequest, err.Error())
 				return
 			}
-			residents = append(residents, resident)
+			streamList(w, r, db, format, "residents", names, scanSparse(names), "SELECT "+residentFields.columns(names)+" FROM residents"+filter.where()+" ORDER BY name", filter.args...)
+			return
 		}
 
-		respondWithJSON(w, http.StatusOK, residents)
+		streamList(w, r, db, format, "residents", jsonFieldNames(Resident{}), scanResident, "SELECT "+residentColumns+" FROM residents"+filter.where()+" ORDER BY name", filter.args...)
 	}
 }
 
-func createResident(db *sql.DB) http.HandlerFunc {
+func createResident(db *sql.DB, stmts *StmtCache, changes *ChangeBroker) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var resident Resident
-		decoder := json.NewDecoder(r.Body)
-		if err := decoder.Decode(&resident); err != nil {
-			respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		if err := decodeRequest(r, &resident); err != nil {
+			respondWithError(w, payloadErrorStatus(err), "Invalid request payload: "+err.Error())
 			return
 		}
 		defer r.Body.Close()
 
 		// Validate resident data
 		if err := validateResident(resident); err != nil {
-			respondWithError(w, http.StatusBadRequest, err.Error())
+			respondWithValidationError(w, err)
+			return
+		}
+		fields, err := customFields(db)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		values, err := customValues(fields, resident.Custom)
+		if err != nil {
+			respondWithValidationError(w, err)
 			return
 		}
 
-		stmt, err := db.Prepare("INSERT INTO residents(name, unit, contact, email) VALUES(?, ?, ?, ?)")
+		stmt, err := stmts.Prepare("INSERT INTO residents(name, unit, contact, email, notify_channel, move_in_date, move_out_date) VALUES(?, ?, ?, ?, ?, ?, ?)")
 		if err != nil {
 			respondWithError(w, http.StatusInternalServerError, err.Error())
 			return
 		}
-		defer stmt.Close()
 
-		result, err := stmt.Exec(resident.Name, resident.Unit, resident.Contact, resident.Email)
+		result, err := stmt.Exec(resident.Name, resident.Unit, resident.Contact, resident.Email, resident.NotifyChannel, resident.MoveInDate, resident.MoveOutDate)
 		if err != nil {
 			respondWithError(w, http.StatusInternalServerError, err.Error())
 			return
@@ -372,8 +872,23 @@ func createResident(db *sql.DB) http.HandlerFunc {
 			respondWithError(w, http.StatusInternalServerError, err.Error())
 			return
 		}
+		if err := storeCustomValues(db, int(id), values, true); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		notifications := resident.notificationPreferences()
+		if err := setNotificationPreferences(db, int(id), notifications, NotificationsByAdmin); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
 
 		resident.ID = int(id)
+		resident.NotifyChannel, resident.Notifications = notifications.Reminders, &notifications
+		if resident.Custom, err = residentCustom(db, resident.ID); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		changes.Publish(Change{Type: "resident", ID: resident.ID, Action: ChangeCreated})
 		respondWithJSON(w, http.StatusCreated, resident)
 	}
 }
@@ -387,9 +902,7 @@ func getResident(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		var resident Resident
-		err = db.QueryRow("SELECT id, name, unit, contact, email, created_at, updated_at FROM residents WHERE id = ?", id).
-			Scan(&resident.ID, &resident.Name, &resident.Unit, &resident.Contact, &resident.Email, &resident.CreatedAt, &resident.UpdatedAt)
+		resident, err := scanResidentRow(db.QueryRow("SELECT "+residentColumns+" FROM residents WHERE id = ?", id))
 		if err != nil {
 			if err == sql.ErrNoRows {
 				respondWithError(w, http.StatusNotFound, "Resident not found")
@@ -403,7 +916,7 @@ func getResident(db *sql.DB) http.HandlerFunc {
 	}
 }
 
-func updateResident(db *sql.DB) http.HandlerFunc {
+func updateResident(db *sql.DB, stmts *StmtCache, changes *ChangeBroker) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
 		id, err := strconv.Atoi(vars["id"])
@@ -413,38 +926,75 @@ func updateResident(db *sql.DB) http.HandlerFunc {
 		}
 
 		var resident Resident
-		decoder := json.NewDecoder(r.Body)
-		if err := decoder.Decode(&resident); err != nil {
-			respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		if err := decodeRequest(r, &resident); err != nil {
+			respondWithError(w, payloadErrorStatus(err), "Invalid request payload: "+err.Error())
 			return
 		}
 		defer r.Body.Close()
 
 		// Validate resident data
 		if err := validateResident(resident); err != nil {
-			respondWithError(w, http.StatusBadRequest, err.Error())
+			respondWithValidationError(w, err)
+			return
+		}
+		fields, err := customFields(db)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		values, err := customValues(fields, resident.Custom)
+		if err != nil {
+			respondWithValidationError(w, err)
 			return
 		}
 
-		stmt, err := db.Prepare("UPDATE residents SET name = ?, unit = ?, contact = ?, email = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?")
+		stmt, err := stmts.Prepare("UPDATE residents SET name = ?, unit = ?, contact = ?, email = ?, move_in_date = ?, move_out_date = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?")
 		if err != nil {
 			respondWithError(w, http.StatusInternalServerError, err.Error())
 			return
 		}
-		defer stmt.Close()
 
-		_, err = stmt.Exec(resident.Name, resident.Unit, resident.Contact, resident.Email, id)
+		result, err := stmt.Exec(resident.Name, resident.Unit, resident.Contact, resident.Email, resident.MoveInDate, resident.MoveOutDate, id)
 		if err != nil {
 			respondWithError(w, http.StatusInternalServerError, err.Error())
 			return
 		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			respondWithError(w, http.StatusNotFound, "Resident not found")
+			return
+		}
+		if err := storeCustomValues(db, id, values, false); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		// Without notifications only the reminders channel can change
+		if resident.Notifications == nil {
+			stored, err := residentNotifications(db, id)
+			if err != nil {
+				respondWithError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			stored.Reminders = resident.NotifyChannel
+			resident.Notifications = &stored.NotificationPreferences
+		}
+		notifications := resident.notificationPreferences()
+		if err := setNotificationPreferences(db, id, notifications, NotificationsByAdmin); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
 
 		resident.ID = id
+		resident.NotifyChannel, resident.Notifications = notifications.Reminders, &notifications
+		if resident.Custom, err = residentCustom(db, id); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		changes.Publish(Change{Type: "resident", ID: id, Action: ChangeUpdated})
 		respondWithJSON(w, http.StatusOK, resident)
 	}
 }
 
-func deleteResident(db *sql.DB) http.HandlerFunc {
+func deleteResident(db *sql.DB, changes *ChangeBroker, rules paymentRules) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
 		id, err := strconv.Atoi(vars["id"])
@@ -453,76 +1003,113 @@ func deleteResident(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		stmt, err := db.Prepare("DELETE FROM residents WHERE id = ?")
+		// Deleted records go to the trash, from where they can be restored
+		found, err := trashRecord(db, "resident", id, rules)
 		if err != nil {
 			respondWithError(w, http.StatusInternalServerError, err.Error())
 			return
 		}
-		defer stmt.Close()
-
-		_, err = stmt.Exec(id)
-		if err != nil {
-			respondWithError(w, http.StatusInternalServerError, err.Error())
+		if !found {
+			respondWithError(w, http.StatusNotFound, "Resident not found")
 			return
 		}
 
+		changes.Publish(Change{Type: "resident", ID: id, Action: ChangeDeleted})
 		respondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
 	}
 }
 
+// paymentsFrom is what payment lists select from. Payments of residents that
+// are gone are left out of the rows and the count alike, whatever the fields.
+const paymentsFrom = " FROM payments p JOIN residents r ON p.resident_id = r.id"
+
 // Handlers for payment endpoints
 func getPayments(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		rows, err := db.Query(`
-			SELECT p.id, p.resident_id, r.name, p.amount, p.description, p.payment_date, p.created_at 
-			FROM payments p
-			JOIN residents r ON p.resident_id = r.id
-			ORDER BY p.payment_date DESC
-		`)
+		if err := checkQueryParams(r, "resident_id", "start_date", "end_date", "updated_since", "fields", "format", "locale"); err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		format, err := listFormat(r)
+		if err != nil {
+			respondWithError(w, http.StatusNotAcceptable, err.Error())
+			return
+		}
+
+		filter, err := paymentFilter(r)
 		if err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err := setTotalCount(w, db, "SELECT COUNT(*)"+paymentsFrom+filter.where(), filter.args...); err != nil {
 			respondWithError(w, http.StatusInternalServerError, err.Error())
 			return
 		}
-		defer rows.Close()
 
-		payments := []Payment{}
-		for rows.Next() {
-			var payment Payment
-			if err := rows.Scan(&payment.ID, &payment.ResidentID, &payment.ResidentName, &payment.Amount, &payment.Description, &payment.PaymentDate, &payment.CreatedAt); err != nil {
-				respondWithError(w, http.StatusInternalServerError, err.Error())
+		if fields := r.URL.Query().Get("fields"); fields != "" {
+			names, err := paymentFields.parse(fields)
+			if err != nil {
+				respondWithError(w, http.StatusBadRequest, err.Error())
 				return
 			}
-			payments = append(payments, payment)
+			streamList(w, r, db, format, "payments", names, scanSparse(names), "SELECT "+paymentFields.columns(names)+paymentsFrom+filter.where()+" ORDER BY p.payment_date DESC", filter.args...)
+			return
 		}
 
-		respondWithJSON(w, http.StatusOK, payments)
+		streamList(w, r, db, format, "payments", jsonFieldNames(Payment{}), scanPaymentWithResident, `
+			SELECT p.id, p.resident_id, r.name, p.amount, p.description, p.payment_date, p.method, p.status, p.reference, p.bank_reference, p.cheque_number, p.cheque_bank, p.cheque_status, p.cheque_status_date, p.created_at, p.updated_at
+		`+paymentsFrom+filter.where()+`
+			ORDER BY p.payment_date DESC
+		`, filter.args...)
 	}
 }
 
-func createPayment(db *sql.DB) http.HandlerFunc {
+func createPayment(db *sql.DB, stmts *StmtCache, notifier *Notifier, receipts *ReceiptQueue, changes *ChangeBroker, rules paymentRules) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var payment Payment
-		decoder := json.NewDecoder(r.Body)
-		if err := decoder.Decode(&payment); err != nil {
-			respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		if err := decodeRequest(r, &payment); err != nil {
+			respondWithError(w, payloadErrorStatus(err), "Invalid request payload: "+err.Error())
 			return
 		}
 		defer r.Body.Close()
 
+		payment.PaymentDate = normalizeDate(payment.PaymentDate)
+		payment.ChequeStatusDate = normalizeDate(payment.ChequeStatusDate)
+		if payment.Method == "check" && payment.ChequeStatus == "" {
+			payment.ChequeStatus = ChequePending
+		}
+
 		// Validate payment data
 		if err := validatePayment(payment); err != nil {
-			respondWithError(w, http.StatusBadRequest, err.Error())
+			respondWithValidationError(w, err)
+			return
+		}
+		payment.Status = paymentStatus(payment, rules)
+
+		// The payment, the charges it settles and its receipt are written
+		// together or not at all
+		tx, err := db.Begin()
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
 			return
 		}
+		defer tx.Rollback()
 
-		stmt, err := db.Prepare("INSERT INTO payments(resident_id, amount, description, payment_date) VALUES(?, ?, ?, ?)")
+		stmt, err := stmts.Prepare(`
+			INSERT INTO payments(resident_id, amount, description, payment_date, method, reference, status, cheque_number, cheque_bank, cheque_status, cheque_status_date)
+			VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		`)
 		if err != nil {
 			respondWithError(w, http.StatusInternalServerError, err.Error())
 			return
 		}
-		defer stmt.Close()
 
-		result, err := stmt.Exec(payment.ResidentID, payment.Amount, payment.Description, payment.PaymentDate)
+		result, err := tx.Stmt(stmt).Exec(payment.ResidentID, payment.Amount, payment.Description, payment.PaymentDate, payment.Method, payment.Reference,
+			payment.Status, payment.ChequeNumber, payment.ChequeBank, payment.ChequeStatus, payment.ChequeStatusDate)
+		if isUniqueViolation(err) {
+			respondWithError(w, http.StatusConflict, "A payment with this reference already exists")
+			return
+		}
 		if err != nil {
 			respondWithError(w, http.StatusInternalServerError, err.Error())
 			return
@@ -535,6 +1122,37 @@ func createPayment(db *sql.DB) http.HandlerFunc {
 		}
 
 		payment.ID = int(id)
+
+		// Settle the resident's oldest open charges and set aside the reserve
+		if err := reallocate(tx, rules, payment.ResidentID); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if err := tagReserve(tx); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		// Email the receipt in the background when that is turned on
+		if err := queueReceipts(tx, payment.ID); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		receipts.Wake()
+
+		if payment.Amount >= notifier.PaymentThreshold {
+			notifier.Notify(Event{
+				Type:    EventPaymentLarge,
+				Title:   "Large payment recorded",
+				Message: fmt.Sprintf("Payment #%d of %.2f from resident #%d (%s)", payment.ID, payment.Amount, payment.ResidentID, payment.PaymentDate),
+			})
+		}
+
+		changes.Publish(Change{Type: "payment", ID: payment.ID, Action: ChangeCreated})
 		respondWithJSON(w, http.StatusCreated, payment)
 	}
 }
@@ -550,11 +1168,11 @@ func getPayment(db *sql.DB) http.HandlerFunc {
 
 		var payment Payment
 		err = db.QueryRow(`
-			SELECT p.id, p.resident_id, r.name, p.amount, p.description, p.payment_date, p.created_at 
+			SELECT p.id, p.resident_id, r.name, p.amount, p.description, p.payment_date, p.method, p.status, p.reference, p.bank_reference, p.cheque_number, p.cheque_bank, p.cheque_status, p.cheque_status_date, p.created_at, p.updated_at
 			FROM payments p
 			JOIN residents r ON p.resident_id = r.id
 			WHERE p.id = ?
-		`, id).Scan(&payment.ID, &payment.ResidentID, &payment.ResidentName, &payment.Amount, &payment.Description, &payment.PaymentDate, &payment.CreatedAt)
+		`, id).Scan(&payment.ID, &payment.ResidentID, &payment.ResidentName, &payment.Amount, &payment.Description, &payment.PaymentDate, &payment.Method, &payment.Status, &payment.Reference, &payment.BankReference, &payment.ChequeNumber, &payment.ChequeBank, &payment.ChequeStatus, &payment.ChequeStatusDate, &payment.CreatedAt, &payment.UpdatedAt)
 		if err != nil {
 			if err == sql.ErrNoRows {
 				respondWithError(w, http.StatusNotFound, "Payment not found")
@@ -563,12 +1181,16 @@ func getPayment(db *sql.DB) http.HandlerFunc {
 			respondWithError(w, http.StatusInternalServerError, err.Error())
 			return
 		}
+		if err := withAllocations(db, &payment); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
 
 		respondWithJSON(w, http.StatusOK, payment)
 	}
 }
 
-func updatePayment(db *sql.DB) http.HandlerFunc {
+func updatePayment(db *sql.DB, stmts *StmtCache, changes *ChangeBroker, rules paymentRules) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
 		id, err := strconv.Atoi(vars["id"])
@@ -578,59 +1200,118 @@ func updatePayment(db *sql.DB) http.HandlerFunc {
 		}
 
 		var payment Payment
-		decoder := json.NewDecoder(r.Body)
-		if err := decoder.Decode(&payment); err != nil {
-			respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		if err := decodeRequest(r, &payment); err != nil {
+			respondWithError(w, payloadErrorStatus(err), "Invalid request payload: "+err.Error())
 			return
 		}
 		defer r.Body.Close()
 
-		// Validate payment data
-		if err := validatePayment(payment); err != nil {
-			respondWithError(w, http.StatusBadRequest, err.Error())
-			return
-		}
+		payment.PaymentDate = normalizeDate(payment.PaymentDate)
+		payment.ChequeStatusDate = normalizeDate(payment.ChequeStatusDate)
 
-		stmt, err := db.Prepare("UPDATE payments SET resident_id = ?, amount = ?, description = ?, payment_date = ? WHERE id = ?")
+		tx, err := db.Begin()
 		if err != nil {
 			respondWithError(w, http.StatusInternalServerError, err.Error())
 			return
 		}
-		defer stmt.Close()
+		defer tx.Rollback()
 
-		_, err = stmt.Exec(payment.ResidentID, payment.Amount, payment.Description, payment.PaymentDate, id)
+		var oldResidentID int
+		var oldChequeStatus, oldChequeStatusDate string
+		err = tx.QueryRow("SELECT resident_id, cheque_status, cheque_status_date FROM payments WHERE id = ?", id).Scan(&oldResidentID, &oldChequeStatus, &oldChequeStatusDate)
+		if err == sql.ErrNoRows {
+			respondWithError(w, http.StatusNotFound, "Payment not found")
+			return
+		}
 		if err != nil {
 			respondWithError(w, http.StatusInternalServerError, err.Error())
 			return
 		}
 
-		payment.ID = id
-		respondWithJSON(w, http.StatusOK, payment)
-	}
-}
+		// A cheque keeps its clearance unless the update sets it
+		if payment.Method == "check" && payment.ChequeStatus == "" {
+			payment.ChequeStatus, payment.ChequeStatusDate = oldChequeStatus, oldChequeStatusDate
+			if payment.ChequeStatus == "" {
+				payment.ChequeStatus = ChequePending
+			}
+		}
 
-func deletePayment(db *sql.DB) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		vars := mux.Vars(r)
-		id, err := strconv.Atoi(vars["id"])
-		if err != nil {
-			respondWithError(w, http.StatusBadRequest, "Invalid payment ID")
+		// Validate payment data
+		if err := validatePayment(payment); err != nil {
+			respondWithValidationError(w, err)
 			return
 		}
+		payment.Status = paymentStatus(payment, rules)
 
-		stmt, err := db.Prepare("DELETE FROM payments WHERE id = ?")
+		stmt, err := stmts.Prepare(`
+			UPDATE payments SET resident_id = ?, amount = ?, description = ?, payment_date = ?, method = ?, reference = ?,
+				status = ?, cheque_number = ?, cheque_bank = ?, cheque_status = ?, cheque_status_date = ?, updated_at = CURRENT_TIMESTAMP
+			WHERE id = ?
+		`)
 		if err != nil {
 			respondWithError(w, http.StatusInternalServerError, err.Error())
 			return
 		}
-		defer stmt.Close()
 
-		_, err = stmt.Exec(id)
+		result, err := tx.Stmt(stmt).Exec(payment.ResidentID, payment.Amount, payment.Description, payment.PaymentDate, payment.Method, payment.Reference,
+			payment.Status, payment.ChequeNumber, payment.ChequeBank, payment.ChequeStatus, payment.ChequeStatusDate, id)
+		if isUniqueViolation(err) {
+			respondWithError(w, http.StatusConflict, "A payment with this reference already exists")
+			return
+		}
 		if err != nil {
 			respondWithError(w, http.StatusInternalServerError, err.Error())
 			return
 		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			respondWithError(w, http.StatusNotFound, "Payment not found")
+			return
+		}
+
+		// A new amount, date or resident changes which charges are settled,
+		// and a new amount or date the reserve part
+		for _, residentID := range []int{oldResidentID, payment.ResidentID} {
+			if err := reallocate(tx, rules, residentID); err != nil {
+				respondWithError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+		}
+		if err := tagReserve(tx); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		payment.ID = id
+		changes.Publish(Change{Type: "payment", ID: id, Action: ChangeUpdated})
+		respondWithJSON(w, http.StatusOK, payment)
+	}
+}
+
+func deletePayment(db *sql.DB, changes *ChangeBroker, rules paymentRules) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id, err := strconv.Atoi(vars["id"])
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid payment ID")
+			return
+		}
+
+		// Deleted records go to the trash, from where they can be restored
+		found, err := trashRecord(db, "payment", id, rules)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if !found {
+			respondWithError(w, http.StatusNotFound, "Payment not found")
+			return
+		}
 
+		changes.Publish(Change{Type: "payment", ID: id, Action: ChangeDeleted})
 		respondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
 	}
 }
@@ -638,51 +1319,76 @@ func deletePayment(db *sql.DB) http.HandlerFunc {
 // Handlers for expense endpoints
 func getExpenses(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		rows, err := db.Query("SELECT id, amount, description, expense_date, category, created_at FROM expenses ORDER BY expense_date DESC")
+		if err := checkQueryParams(r, "category", "start_date", "end_date", "updated_since", "fields", "format", "locale"); err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		format, err := listFormat(r)
 		if err != nil {
+			respondWithError(w, http.StatusNotAcceptable, err.Error())
+			return
+		}
+
+		filter, err := expenseFilter(r)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err := setTotalCount(w, db, "SELECT COUNT(*) FROM expenses"+filter.where(), filter.args...); err != nil {
 			respondWithError(w, http.StatusInternalServerError, err.Error())
 			return
 		}
-		defer rows.Close()
 
-		expenses := []Expense{}
-		for rows.Next() {
-			var expense Expense
-			if err := rows.Scan(&expense.ID, &expense.Amount, &expense.Description, &expense.ExpenseDate, &expense.Category, &expense.CreatedAt); err != nil {
-				respondWithError(w, http.StatusInternalServerError, err.Error())
+		if fields := r.URL.Query().Get("fields"); fields != "" {
+			names, err := expenseFields.parse(fields)
+			if err != nil {
+				respondWithError(w, http.StatusBadRequest, err.Error())
 				return
 			}
-			expenses = append(expenses, expense)
+			streamList(w, r, db, format, "expenses", names, scanSparse(names), "SELECT "+expenseFields.columns(names)+" FROM expenses"+filter.where()+" ORDER BY expense_date DESC", filter.args...)
+			return
 		}
 
-		respondWithJSON(w, http.StatusOK, expenses)
+		streamList(w, r, db, format, "expenses", jsonFieldNames(Expense{}), scanExpense, "SELECT "+expenseColumns+" FROM expenses"+filter.where()+" ORDER BY expense_date DESC", filter.args...)
 	}
 }
 
-func createExpense(db *sql.DB) http.HandlerFunc {
+func createExpense(db *sql.DB, stmts *StmtCache, currency string, changes *ChangeBroker) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var expense Expense
-		decoder := json.NewDecoder(r.Body)
-		if err := decoder.Decode(&expense); err != nil {
-			respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		if err := decodeRequest(r, &expense); err != nil {
+			respondWithError(w, payloadErrorStatus(err), "Invalid request payload: "+err.Error())
 			return
 		}
 		defer r.Body.Close()
 
+		expense.ExpenseDate = normalizeDate(expense.ExpenseDate)
+		convertExpense(&expense, currency)
+		computeExpenseTax(&expense)
+		expense.Tags = normalizeTags(expense.Tags)
+
 		// Validate expense data
 		if err := validateExpense(expense); err != nil {
-			respondWithError(w, http.StatusBadRequest, err.Error())
+			respondWithValidationError(w, err)
+			return
+		}
+
+		stmt, err := stmts.Prepare("INSERT INTO expenses(amount, description, expense_date, category, currency, original_amount, exchange_rate, tax_rate, tax_amount, vendor) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?)")
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
 			return
 		}
 
-		stmt, err := db.Prepare("INSERT INTO expenses(amount, description, expense_date, category) VALUES(?, ?, ?, ?)")
+		// The expense and its tags are written together
+		tx, err := db.Begin()
 		if err != nil {
 			respondWithError(w, http.StatusInternalServerError, err.Error())
 			return
 		}
-		defer stmt.Close()
+		defer tx.Rollback()
 
-		result, err := stmt.Exec(expense.Amount, expense.Description, expense.ExpenseDate, expense.Category)
+		result, err := tx.Stmt(stmt).Exec(expense.Amount, expense.Description, expense.ExpenseDate, expense.Category, expense.Currency, expense.OriginalAmount, expense.ExchangeRate,
+			expense.TaxRate, expense.TaxAmount, expense.Vendor)
 		if err != nil {
 			respondWithError(w, http.StatusInternalServerError, err.Error())
 			return
@@ -695,6 +1401,15 @@ func createExpense(db *sql.DB) http.HandlerFunc {
 		}
 
 		expense.ID = int(id)
+		if err := addExpenseTags(tx, expense.ID, expense.Tags...); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		changes.Publish(Change{Type: "expense", ID: expense.ID, Action: ChangeCreated})
 		respondWithJSON(w, http.StatusCreated, expense)
 	}
 }
@@ -708,9 +1423,7 @@ func getExpense(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		var expense Expense
-		err = db.QueryRow("SELECT id, amount, description, expense_date, category, created_at FROM expenses WHERE id = ?", id).
-			Scan(&expense.ID, &expense.Amount, &expense.Description, &expense.ExpenseDate, &expense.Category, &expense.CreatedAt)
+		expense, err := scanExpenseRow(db.QueryRow("SELECT "+expenseColumns+" FROM expenses WHERE id = ?", id))
 		if err != nil {
 			if err == sql.ErrNoRows {
 				respondWithError(w, http.StatusNotFound, "Expense not found")
@@ -724,7 +1437,7 @@ func getExpense(db *sql.DB) http.HandlerFunc {
 	}
 }
 
-func updateExpense(db *sql.DB) http.HandlerFunc {
+func updateExpense(db *sql.DB, stmts *StmtCache, currency string, changes *ChangeBroker) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
 		id, err := strconv.Atoi(vars["id"])
@@ -734,38 +1447,67 @@ func updateExpense(db *sql.DB) http.HandlerFunc {
 		}
 
 		var expense Expense
-		decoder := json.NewDecoder(r.Body)
-		if err := decoder.Decode(&expense); err != nil {
-			respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		if err := decodeRequest(r, &expense); err != nil {
+			respondWithError(w, payloadErrorStatus(err), "Invalid request payload: "+err.Error())
 			return
 		}
 		defer r.Body.Close()
 
+		expense.ExpenseDate = normalizeDate(expense.ExpenseDate)
+		convertExpense(&expense, currency)
+		computeExpenseTax(&expense)
+		expense.Tags = normalizeTags(expense.Tags)
+
 		// Validate expense data
 		if err := validateExpense(expense); err != nil {
-			respondWithError(w, http.StatusBadRequest, err.Error())
+			respondWithValidationError(w, err)
 			return
 		}
 
-		stmt, err := db.Prepare("UPDATE expenses SET amount = ?, description = ?, expense_date = ?, category = ? WHERE id = ?")
+		stmt, err := stmts.Prepare(`
+			UPDATE expenses SET amount = ?, description = ?, expense_date = ?, category = ?, currency = ?, original_amount = ?, exchange_rate = ?,
+				tax_rate = ?, tax_amount = ?, vendor = ?, updated_at = CURRENT_TIMESTAMP
+			WHERE id = ?
+		`)
 		if err != nil {
 			respondWithError(w, http.StatusInternalServerError, err.Error())
 			return
 		}
-		defer stmt.Close()
 
-		_, err = stmt.Exec(expense.Amount, expense.Description, expense.ExpenseDate, expense.Category, id)
+		// The expense and its tags are replaced together
+		tx, err := db.Begin()
 		if err != nil {
 			respondWithError(w, http.StatusInternalServerError, err.Error())
 			return
 		}
+		defer tx.Rollback()
+
+		result, err := tx.Stmt(stmt).Exec(expense.Amount, expense.Description, expense.ExpenseDate, expense.Category, expense.Currency, expense.OriginalAmount, expense.ExchangeRate,
+			expense.TaxRate, expense.TaxAmount, expense.Vendor, id)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			respondWithError(w, http.StatusNotFound, "Expense not found")
+			return
+		}
+		if err := setExpenseTags(tx, id, expense.Tags); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
 
 		expense.ID = id
+		changes.Publish(Change{Type: "expense", ID: id, Action: ChangeUpdated})
 		respondWithJSON(w, http.StatusOK, expense)
 	}
 }
 
-func deleteExpense(db *sql.DB) http.HandlerFunc {
+func deleteExpense(db *sql.DB, changes *ChangeBroker, rules paymentRules) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
 		id, err := strconv.Atoi(vars["id"])
@@ -774,246 +1516,624 @@ func deleteExpense(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		stmt, err := db.Prepare("DELETE FROM expenses WHERE id = ?")
+		// Deleted records go to the trash, from where they can be restored
+		found, err := trashRecord(db, "expense", id, rules)
 		if err != nil {
 			respondWithError(w, http.StatusInternalServerError, err.Error())
 			return
 		}
-		defer stmt.Close()
-
-		_, err = stmt.Exec(id)
-		if err != nil {
-			respondWithError(w, http.StatusInternalServerError, err.Error())
+		if !found {
+			respondWithError(w, http.StatusNotFound, "Expense not found")
 			return
 		}
 
+		changes.Publish(Change{Type: "expense", ID: id, Action: ChangeDeleted})
 		respondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
 	}
 }
 
 // Export database as JSON
-func exportDatabase(db *sql.DB) http.HandlerFunc {
+func exportDatabase(db *sql.DB, cal calendar) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		exportData := ExportData{
-			ExportDate: time.Now().Format(time.RFC3339),
-		}
-
-		// Get all residents
-		residents, err := getAllResidents(db)
-		if err != nil {
-			respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Error exporting residents: %v", err))
+		if err := checkQueryParams(r, "start_date", "end_date", "entities", "format"); err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
 			return
 		}
-		exportData.Residents = residents
-
-		// Get all payments
-		payments, err := getAllPayments(db)
+		filter, err := parseExportFilter(r.URL.Query().Get("start_date"), r.URL.Query().Get("end_date"), queryValues(r, "entities"))
 		if err != nil {
-			respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Error exporting payments: %v", err))
+			respondWithError(w, http.StatusBadRequest, err.Error())
 			return
 		}
-		exportData.Payments = payments
-
-		// Get all expenses
-		expenses, err := getAllExpenses(db)
-		if err != nil {
-			respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Error exporting expenses: %v", err))
+		format := r.URL.Query().Get("format")
+		if format == "" {
+			format = ExportFormatJSON
+		}
+		if !validExportFormat(format) {
+			respondWithError(w, http.StatusBadRequest, "Invalid format, must be json or ndjson")
 			return
 		}
-		exportData.Expenses = expenses
 
 		// Set header for file download
-		w.Header().Set("Content-Type", "application/json")
-		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=condo_export_%s.json",
-			time.Now().Format("2006-01-02")))
-
-		// Write JSON response
-		if err := json.NewEncoder(w).Encode(exportData); err != nil {
-			respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Error encoding export data: %v", err))
-			return
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=condo_export_%s.%s",
+			cal.today(), format))
+		if format == ExportFormatNDJSON {
+			w.Header().Set("Content-Type", "application/x-ndjson")
 		}
+
+		stream := newStreamWriter(w)
+		_, err = writeExport(stream, db, filter, format, cal.now())
+		stream.Finish(err)
 	}
 }
 
-// Import database from JSON
-func importDatabase(db *sql.DB) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		// Parse multipart form
-		if err := r.ParseMultipartForm(10 << 20); err != nil { // 10 MB limit
-			respondWithError(w, http.StatusBadRequest, "Unable to parse form")
-			return
+// exportEntities are the sections of an export
+var exportEntities = []string{"residents", "payments", "expenses"}
+
+// ExportFilter limits an export to some entities and a date range. Payments
+// and expenses are filtered by their date. Residents have none: they are all
+// exported when asked for, and otherwise only those the exported payments
+// belong to, so the file can still be imported.
+type ExportFilter struct {
+	StartDate string   `json:"start_date,omitempty"`
+	EndDate   string   `json:"end_date,omitempty"`
+	Entities  []string `json:"entities,omitempty"` // all when empty
+}
+
+// parseExportFilter checks the dates and entity names of a filter
+func parseExportFilter(startDate, endDate string, entities []string) (ExportFilter, error) {
+	filter := ExportFilter{StartDate: startDate, EndDate: endDate, Entities: entities}
+	for _, date := range []struct{ name, value string }{{"start_date", startDate}, {"end_date", endDate}} {
+		if date.value == "" {
+			continue
 		}
+		if _, err := time.Parse("2006-01-02", date.value); err != nil {
+			return filter, fmt.Errorf("invalid %s format, must be YYYY-MM-DD", date.name)
+		}
+	}
+	for _, entity := range entities {
+		if !slices.Contains(exportEntities, entity) {
+			return filter, fmt.Errorf("invalid entity %q, must be residents, payments or expenses", entity)
+		}
+	}
+	return filter, nil
+}
 
-		// Get file from form
-		file, _, err := r.FormFile("importFile")
+// Partial reports whether the filter leaves anything out
+func (f ExportFilter) Partial() bool {
+	return f.StartDate != "" || f.EndDate != "" || len(f.Entities) > 0
+}
+
+// includes reports whether entity was asked for
+func (f ExportFilter) includes(entity string) bool {
+	return len(f.Entities) == 0 || slices.Contains(f.Entities, entity)
+}
+
+// dateRange filters column by the date range
+func (f ExportFilter) dateRange(column string) queryFilter {
+	var dates queryFilter
+	if f.StartDate != "" {
+		dates.add(column+" >= ?", f.StartDate)
+	}
+	if f.EndDate != "" {
+		dates.add(column+" <= ?", f.EndDate)
+	}
+	return dates
+}
+
+// exportCounts is the number of rows writeExport wrote from each table, and
+// the checksum of its manifest
+type exportCounts struct {
+	residents, payments, expenses, customFields int
+	sha256                                      string
+}
+
+// writeExport writes the database, or the part filter selects, to w in the
+// format of ExportData or as NDJSON, streaming the rows as they are read
+// instead of loading every table first. The manifest comes last, so a file cut
+// short has none. Both formats of the same data have the same manifest. The
+// export is dated now.
+func writeExport(w io.Writer, db *sql.DB, filter ExportFilter, format string, now time.Time) (exportCounts, error) {
+	var counts exportCounts
+	checksum := newExportHash()
+	ndjson := format == ExportFormatNDJSON
+	exportDate := now.Format(time.RFC3339)
+	var partial *ExportFilter
+	if filter.Partial() {
+		partial = &filter
+	}
+	if ndjson {
+		if err := writeNDJSONLine(w, NDJSONExport, ndjsonHeader{ExportDate: exportDate, Filter: partial}); err != nil {
+			return counts, err
+		}
+	}
+	payments := filter.dateRange("payment_date")
+	expenses := filter.dateRange("expense_date")
+	residents := "SELECT " + residentColumns + " FROM residents"
+	var residentArgs []interface{}
+	if !filter.includes("residents") {
+		residents += " WHERE id IN (SELECT resident_id FROM payments" + payments.where() + ")"
+		residentArgs = payments.args
+	}
+	sections := []struct {
+		name     string
+		record   string // type of the NDJSON records
+		included bool
+		query    string
+		args     []interface{}
+		scan     rowScanner
+		count    *int
+	}{
+		{"residents", NDJSONResident, filter.includes("residents") || filter.includes("payments"), residents, residentArgs, scanResident, &counts.residents},
+		{"payments", NDJSONPayment, filter.includes("payments"), "SELECT id, resident_id, amount, description, payment_date, method, status, reference, bank_reference, cheque_number, cheque_bank, cheque_status, cheque_status_date, created_at, updated_at FROM payments" + payments.where(), payments.args, scanPayment, &counts.payments},
+		{"expenses", NDJSONExpense, filter.includes("expenses"), "SELECT " + expenseColumns + " FROM expenses" + expenses.where(), expenses.args, scanExpense, &counts.expenses},
+		{"custom_fields", NDJSONCustomField, filter.includes("residents") || filter.includes("payments"), "SELECT " + customFieldColumns + " FROM custom_field_definitions ORDER BY id", nil, scanCustomField, &counts.customFields},
+	}
+	for i, section := range sections {
+		separator := ","
+		if i == 0 {
+			separator = "{"
+		}
+		if !section.included {
+			if !ndjson {
+				if _, err := fmt.Fprintf(w, "%s%q:[]", separator, section.name); err != nil {
+					return counts, err
+				}
+			}
+			checksum.section(section.name, []byte("[]"))
+			continue
+		}
+		rows, err := db.Query(section.query, section.args...)
 		if err != nil {
-			respondWithError(w, http.StatusBadRequest, "Error retrieving import file")
-			return
+			return counts, fmt.Errorf("error exporting %s: %v", section.name, err)
+		}
+		if ndjson {
+			*section.count, err = writeNDJSONRecords(w, checksum.writer(section.name), section.record, rows, section.scan)
+		} else {
+			if _, err := fmt.Fprintf(w, "%s%q:", separator, section.name); err != nil {
+				rows.Close()
+				return counts, err
+			}
+			*section.count, err = writeJSONArray(checksum.tee(section.name, w), rows, section.scan)
 		}
-		defer file.Close()
-
-		// Read file content
-		fileBytes, err := io.ReadAll(file)
 		if err != nil {
-			respondWithError(w, http.StatusInternalServerError, "Error reading import file")
-			return
+			return counts, fmt.Errorf("error exporting %s: %v", section.name, err)
 		}
+	}
 
-		// Parse JSON data
-		var importData ExportData
-		if err := json.Unmarshal(fileBytes, &importData); err != nil {
-			respondWithError(w, http.StatusBadRequest, "Invalid import file format")
+	counts.sha256 = checksum.sum()
+	manifest := ExportManifest{
+		Counts: map[string]int{
+			"residents":     counts.residents,
+			"payments":      counts.payments,
+			"expenses":      counts.expenses,
+			"custom_fields": counts.customFields,
+		},
+		SHA256: counts.sha256,
+	}
+	if ndjson {
+		return counts, writeNDJSONLine(w, NDJSONManifest, manifest)
+	}
+
+	trailer, err := json.Marshal(struct {
+		ExportDate string          `json:"export_date"`
+		Filter     *ExportFilter   `json:"filter,omitempty"`
+		Manifest   *ExportManifest `json:"manifest"`
+	}{exportDate, partial, &manifest})
+	if err != nil {
+		return counts, err
+	}
+	_, err = fmt.Fprintf(w, ",%s\n", trailer[1:])
+	return counts, err
+}
+
+// Import modes
+const (
+	ImportModeReplace = "replace" // delete everything first
+	ImportModeMerge   = "merge"   // insert new ids and overwrite existing ones
+)
+
+// errPartialReplace refuses to replace the data with a partial export, which
+// would delete everything the export left out
+var errPartialReplace = errors.New("the file is a partial export, import it in merge mode")
+
+// Import database from JSON
+func importDatabase(db *sql.DB, notifier *Notifier, changes *ChangeBroker, jobs *Jobs, rules paymentRules) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Parse multipart form
+		if err := r.ParseMultipartForm(10 << 20); err != nil { // larger files are buffered on disk
+			if payloadErrorStatus(err) == http.StatusRequestEntityTooLarge {
+				respondWithError(w, http.StatusRequestEntityTooLarge, "Import file is too large")
+				return
+			}
+			respondWithError(w, http.StatusBadRequest, "Unable to parse form")
 			return
 		}
 
-		// Begin transaction
-		tx, err := db.Begin()
-		if err != nil {
-			respondWithError(w, http.StatusInternalServerError, "Failed to begin transaction")
+		mode := r.FormValue("mode")
+		if mode == "" {
+			mode = ImportModeReplace
+		}
+		if mode != ImportModeReplace && mode != ImportModeMerge {
+			respondWithError(w, http.StatusBadRequest, "Invalid mode, must be replace or merge")
 			return
 		}
-		defer func() {
-			if err != nil {
-				tx.Rollback()
+		var async bool
+		if value := r.FormValue("async"); value != "" {
+			var err error
+			if async, err = strconv.ParseBool(value); err != nil {
+				respondWithError(w, http.StatusBadRequest, "Invalid async, must be true or false")
 				return
 			}
-		}()
-
-		// Clear existing data
-		if _, err = tx.Exec("DELETE FROM payments"); err != nil {
-			respondWithError(w, http.StatusInternalServerError, "Failed to clear existing payments")
-			return
 		}
-		if _, err = tx.Exec("DELETE FROM expenses"); err != nil {
-			respondWithError(w, http.StatusInternalServerError, "Failed to clear existing expenses")
-			return
+		var force bool
+		if value := r.FormValue("force"); value != "" {
+			var err error
+			if force, err = strconv.ParseBool(value); err != nil {
+				respondWithError(w, http.StatusBadRequest, "Invalid force, must be true or false")
+				return
+			}
 		}
-		if _, err = tx.Exec("DELETE FROM residents"); err != nil {
-			respondWithError(w, http.StatusInternalServerError, "Failed to clear existing residents")
+
+		format := r.FormValue("format")
+		if format != "" && !validExportFormat(format) {
+			respondWithError(w, http.StatusBadRequest, "Invalid format, must be json or ndjson")
 			return
 		}
 
-		// Insert residents
-		stmt, err := tx.Prepare("INSERT INTO residents(id, name, unit, contact, email) VALUES(?, ?, ?, ?, ?)")
+		// Get file from form
+		file, header, err := r.FormFile("importFile")
 		if err != nil {
-			respondWithError(w, http.StatusInternalServerError, "Failed to prepare resident statement")
+			respondWithError(w, http.StatusBadRequest, "Error retrieving import file")
 			return
 		}
-		defer stmt.Close()
+		defer file.Close()
+		if format == "" {
+			format = importFormat(header.Filename)
+		}
 
-		for _, resident := range importData.Residents {
-			_, err := stmt.Exec(resident.ID, resident.Name, resident.Unit, resident.Contact, resident.Email)
-			if err != nil {
-				respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to import resident: %v", err))
+		// Parse the file. NDJSON is decoded as it is read, a line at a time.
+		var importData ExportData
+		if format == ExportFormatNDJSON {
+			importData, err = decodeNDJSON(file, optionsOf(r).laxJSON)
+		} else {
+			var fileBytes []byte
+			if fileBytes, err = io.ReadAll(file); err != nil {
+				respondWithError(w, http.StatusInternalServerError, "Error reading import file")
 				return
 			}
+			err = decodeJSONBytes(fileBytes, &importData, optionsOf(r).laxJSON)
 		}
-
-		// Insert payments
-		stmt, err = tx.Prepare("INSERT INTO payments(id, resident_id, amount, description, payment_date) VALUES(?, ?, ?, ?, ?)")
 		if err != nil {
-			respondWithError(w, http.StatusInternalServerError, "Failed to prepare payment statement")
+			respondWithError(w, http.StatusBadRequest, "Invalid import file format: "+err.Error())
 			return
 		}
-		defer stmt.Close()
 
-		for _, payment := range importData.Payments {
-			_, err := stmt.Exec(payment.ID, payment.ResidentID, payment.Amount, payment.Description, payment.PaymentDate)
-			if err != nil {
-				respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to import payment: %v", err))
+		// A file that doesn't match its manifest is only imported with force,
+		// and then with a warning
+		var warning string
+		if err := verifyManifest(importData); errors.Is(err, errManifestMismatch) {
+			if !force {
+				respondWithError(w, http.StatusBadRequest, err.Error())
 				return
 			}
+			log.Printf("Importing despite: %v", err)
+			warning = localize(w, err.Error())
+		} else if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
 		}
 
-		// Insert expenses
-		stmt, err = tx.Prepare("INSERT INTO expenses(id, amount, description, expense_date, category) VALUES(?, ?, ?, ?, ?)")
-		if err != nil {
-			respondWithError(w, http.StatusInternalServerError, "Failed to prepare expense statement")
+		if err := validateImport(importData); err != nil {
+			respondWithValidationError(w, err)
 			return
 		}
-		defer stmt.Close()
 
-		for _, expense := range importData.Expenses {
-			_, err := stmt.Exec(expense.ID, expense.Amount, expense.Description, expense.ExpenseDate, expense.Category)
-			if err != nil {
-				respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to import expense: %v", err))
-				return
+		successMessage := localize(w, "Database import successful")
+		run := func(ctx context.Context, progress func(int)) (interface{}, error) {
+			if err := importAllContext(ctx, db, importData, mode, rules, progress); err != nil {
+				return nil, err
+			}
+			notifier.Notify(Event{
+				Type:  EventImportCompleted,
+				Title: "Database import completed",
+				Message: fmt.Sprintf("Imported %d residents, %d payments and %d expenses",
+					len(importData.Residents), len(importData.Payments), len(importData.Expenses)),
+			})
+			for _, kind := range changeTypes {
+				changes.Publish(Change{Type: kind, Action: ChangeImported})
+			}
+			result := map[string]string{
+				"message":            successMessage,
+				"imported_residents": strconv.Itoa(len(importData.Residents)),
+				"imported_payments":  strconv.Itoa(len(importData.Payments)),
+				"imported_expenses":  strconv.Itoa(len(importData.Expenses)),
+			}
+			if warning != "" {
+				result["warning"] = warning
 			}
+			return result, nil
 		}
 
-		// Commit transaction
-		if err = tx.Commit(); err != nil {
-			respondWithError(w, http.StatusInternalServerError, "Failed to commit transaction")
+		// Large files can take longer than proxies wait for an answer
+		if async {
+			total := len(importData.Residents) + len(importData.Payments) + len(importData.Expenses)
+			respondWithJSON(w, http.StatusAccepted, jobs.Start("import", total, run))
 			return
 		}
 
-		respondWithJSON(w, http.StatusOK, map[string]string{
-			"message":            "Database import successful",
-			"imported_residents": strconv.Itoa(len(importData.Residents)),
-			"imported_payments":  strconv.Itoa(len(importData.Payments)),
-			"imported_expenses":  strconv.Itoa(len(importData.Expenses)),
-		})
+		result, err := run(context.Background(), nil)
+		if err != nil {
+			if errors.Is(err, errPartialReplace) {
+				respondWithError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			var fields ValidationErrors
+			if errors.As(err, &fields) {
+				respondWithValidationError(w, err)
+				return
+			}
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		respondWithJSON(w, http.StatusOK, result)
+	}
+}
+
+// validateImport checks every row of an export with the same rules as the
+// create endpoints. Failed fields are named by their position in the file,
+// e.g. payments[3].amount, or "line 7.amount" in an NDJSON export.
+func validateImport(data ExportData) error {
+	var errs ValidationErrors
+	addAll := func(prefix string, err error) {
+		var fields ValidationErrors
+		if errors.As(err, &fields) {
+			for _, f := range fields {
+				errs.Add(prefix+"."+f.Field, prefix+": "+f.Message)
+			}
+		}
+	}
+	for i, resident := range data.Residents {
+		addAll(data.position("residents", i), validateResident(resident))
 	}
+	for i, payment := range data.Payments {
+		payment.PaymentDate = normalizeDate(payment.PaymentDate)
+		addAll(data.position("payments", i), validatePayment(payment))
+	}
+	for i, expense := range data.Expenses {
+		expense.ExpenseDate = normalizeDate(expense.ExpenseDate)
+		addAll(data.position("expenses", i), validateExpense(expense))
+	}
+	for i, field := range data.CustomFields {
+		addAll(data.position("custom_fields", i), validateCustomField(field))
+	}
+	return errs.Err()
 }
 
-// Helper function to get all residents
-func getAllResidents(db *sql.DB) ([]Resident, error) {
-	rows, err := db.Query("SELECT id, name, unit, contact, email, created_at, updated_at FROM residents")
+// importAll writes an export back into the database in a single transaction.
+// In replace mode the existing residents, payments and expenses are deleted
+// first; in merge mode rows are matched by id and everything else is kept.
+// Partial exports can only be merged.
+func importAll(db *sql.DB, importData ExportData, mode string, rules paymentRules) error {
+	return importAllContext(context.Background(), db, importData, mode, rules, nil)
+}
+
+// importAllContext is importAll that rolls back when ctx is canceled. Unless
+// nil, progress is called with the number of residents, payments and
+// expenses inserted so far.
+func importAllContext(ctx context.Context, db *sql.DB, importData ExportData, mode string, rules paymentRules, progress func(inserted int)) error {
+	if mode == ImportModeReplace && importData.Filter != nil {
+		return errPartialReplace
+	}
+
+	dbLock(db).Lock()
+	defer dbLock(db).Unlock()
+
+	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
-		return nil, err
+		return fmt.Errorf("failed to begin transaction: %v", err)
 	}
-	defer rows.Close()
+	defer tx.Rollback()
 
-	residents := []Resident{}
-	for rows.Next() {
-		var resident Resident
-		if err := rows.Scan(&resident.ID, &resident.Name, &resident.Unit, &resident.Contact, &resident.Email, &resident.CreatedAt, &resident.UpdatedAt); err != nil {
-			return nil, err
-		}
-		residents = append(residents, resident)
+	if err := importTx(tx, importData, mode, rules, progress); err != nil {
+		return err
 	}
 
-	return residents, nil
+	// Commit transaction
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %v", err)
+	}
+	return nil
 }
 
-// Helper function to get all payments
-func getAllPayments(db *sql.DB) ([]Payment, error) {
-	rows, err := db.Query("SELECT id, resident_id, amount, description, payment_date, created_at FROM payments")
+// importTx writes an export within tx, for importAllContext and importers
+// that build an export from other files. The caller holds the dbLock of its
+// database.
+func importTx(tx *sql.Tx, importData ExportData, mode string, rules paymentRules, progress func(inserted int)) error {
+	inserted := 0
+	batchInserted := func(rows int) {
+		inserted += rows
+		if progress != nil {
+			progress(inserted)
+		}
+	}
+
+	// Clear existing data. Custom field definitions are kept, and those of
+	// the file added.
+	if mode == ImportModeReplace {
+		for _, table := range []string{"payments", "expenses", "resident_custom_values", "residents"} {
+			if _, err := tx.Exec("DELETE FROM " + table); err != nil {
+				return fmt.Errorf("failed to clear existing %s: %v", table, err)
+			}
+		}
+	}
+
+	// Insert residents
+	err := insertBatched(tx, "INSERT INTO residents(id, name, unit, contact, email, notify_channel, notify_receipts, notify_announcements, notify_statements, move_in_date, move_out_date, anonymized_at)",
+		`ON CONFLICT(id) DO UPDATE SET name = excluded.name, unit = excluded.unit, contact = excluded.contact,
+			email = excluded.email, notify_channel = excluded.notify_channel, notify_receipts = excluded.notify_receipts,
+			notify_announcements = excluded.notify_announcements, notify_statements = excluded.notify_statements,
+			move_in_date = excluded.move_in_date, move_out_date = excluded.move_out_date, anonymized_at = excluded.anonymized_at,
+			updated_at = CURRENT_TIMESTAMP`,
+		len(importData.Residents), func(i int) []interface{} {
+			resident := importData.Residents[i]
+			n := resident.notificationPreferences()
+			var anonymizedAt interface{}
+			if resident.AnonymizedAt != nil {
+				anonymizedAt = resident.AnonymizedAt.UTC().Format(sqliteTimestamp)
+			}
+			return []interface{}{resident.ID, resident.Name, resident.Unit, resident.Contact, resident.Email, n.Reminders, n.Receipts, n.Announcements, n.Statements, resident.MoveInDate, resident.MoveOutDate, anonymizedAt}
+		}, batchInserted)
 	if err != nil {
-		return nil, err
+		return fmt.Errorf("failed to import residents: %v", err)
 	}
-	defer rows.Close()
 
-	payments := []Payment{}
-	for rows.Next() {
-		var payment Payment
-		if err := rows.Scan(&payment.ID, &payment.ResidentID, &payment.Amount, &payment.Description, &payment.PaymentDate, &payment.CreatedAt); err != nil {
-			return nil, err
+	// Insert custom values, replacing those of the residents in the file
+	// that have them
+	if err := importCustomFields(tx, importData.CustomFields); err != nil {
+		return fmt.Errorf("failed to import custom fields: %v", err)
+	}
+	fields, err := customFields(tx)
+	if err != nil {
+		return fmt.Errorf("failed to import custom fields: %v", err)
+	}
+	var errs ValidationErrors
+	for i, resident := range importData.Residents {
+		if resident.Custom == nil {
+			continue
+		}
+		values, err := customValues(fields, resident.Custom)
+		var invalid ValidationErrors
+		if errors.As(err, &invalid) {
+			prefix := importData.position("residents", i)
+			for _, f := range invalid {
+				errs.Add(prefix+"."+f.Field, prefix+": "+f.Message)
+			}
+			continue
+		}
+		if err := storeCustomValues(tx, resident.ID, values, true); err != nil {
+			return fmt.Errorf("failed to import custom values: %v", err)
 		}
-		payments = append(payments, payment)
+	}
+	if err := errs.Err(); err != nil {
+		return err
 	}
 
-	return payments, nil
-}
+	// Insert payments
+	err = insertBatched(tx, "INSERT INTO payments(id, resident_id, amount, description, payment_date, method, status, reference, cheque_number, cheque_bank, cheque_status, cheque_status_date)",
+		`ON CONFLICT(id) DO UPDATE SET resident_id = excluded.resident_id, amount = excluded.amount, description = excluded.description,
+			payment_date = excluded.payment_date, method = excluded.method, status = excluded.status, reference = excluded.reference,
+			cheque_number = excluded.cheque_number, cheque_bank = excluded.cheque_bank, cheque_status = excluded.cheque_status,
+			cheque_status_date = excluded.cheque_status_date, updated_at = CURRENT_TIMESTAMP`,
+		len(importData.Payments), func(i int) []interface{} {
+			payment := importData.Payments[i]
+			return []interface{}{payment.ID, payment.ResidentID, payment.Amount, payment.Description, normalizeDate(payment.PaymentDate), payment.Method, importedPaymentStatus(payment.Status), payment.Reference,
+				payment.ChequeNumber, payment.ChequeBank, payment.ChequeStatus, normalizeDate(payment.ChequeStatusDate)}
+		}, batchInserted)
+	if err != nil {
+		return fmt.Errorf("failed to import payments: %v", err)
+	}
 
-// Helper function to get all expenses
-func getAllExpenses(db *sql.DB) ([]Expense, error) {
-	rows, err := db.Query("SELECT id, amount, description, expense_date, category, created_at FROM expenses")
+	// Insert expenses
+	err = insertBatched(tx, "INSERT INTO expenses(id, amount, description, expense_date, category, currency, original_amount, exchange_rate, tax_rate, tax_amount, vendor)",
+		`ON CONFLICT(id) DO UPDATE SET amount = excluded.amount, description = excluded.description,
+			expense_date = excluded.expense_date, category = excluded.category, currency = excluded.currency,
+			original_amount = excluded.original_amount, exchange_rate = excluded.exchange_rate,
+			tax_rate = excluded.tax_rate, tax_amount = excluded.tax_amount, vendor = excluded.vendor, updated_at = CURRENT_TIMESTAMP`,
+		len(importData.Expenses), func(i int) []interface{} {
+			expense := importData.Expenses[i]
+			return []interface{}{expense.ID, expense.Amount, expense.Description, normalizeDate(expense.ExpenseDate), expense.Category,
+				expense.Currency, expense.OriginalAmount, expense.ExchangeRate, expense.TaxRate, expense.TaxAmount, expense.Vendor}
+		}, batchInserted)
 	if err != nil {
-		return nil, err
+		return fmt.Errorf("failed to import expenses: %v", err)
+	}
+	// Tags are added to those the expenses have, as exports before tags
+	// existed have none
+	for _, expense := range importData.Expenses {
+		if err := addExpenseTags(tx, expense.ID, normalizeTags(expense.Tags)...); err != nil {
+			return fmt.Errorf("failed to import expense tags: %v", err)
+		}
 	}
-	defer rows.Close()
 
-	expenses := []Expense{}
-	for rows.Next() {
-		var expense Expense
-		if err := rows.Scan(&expense.ID, &expense.Amount, &expense.Description, &expense.ExpenseDate, &expense.Category, &expense.CreatedAt); err != nil {
-			return nil, err
+	if err := syncChequeStatuses(tx, rules); err != nil {
+		return fmt.Errorf("failed to update cheque payments: %v", err)
+	}
+	if err := reallocateAll(tx, rules); err != nil {
+		return fmt.Errorf("failed to allocate payments: %v", err)
+	}
+	if err := tagReserve(tx); err != nil {
+		return fmt.Errorf("failed to set aside the reserve: %v", err)
+	}
+	if err := unlinkBankLines(tx); err != nil {
+		return fmt.Errorf("failed to unlink bank lines: %v", err)
+	}
+	return nil
+}
+
+// maxBindVariables is SQLite's historical limit on the variables bound to
+// one statement. An import inserts as many rows per statement as fit in it.
+const maxBindVariables = 999
+
+// insertBatched inserts n rows with multi-row INSERTs of as many rows as fit in
+// maxBindVariables.
+// insert is the statement up to VALUES, conflict the clause after it and row
+// the values of row i. The statement for full batches is prepared once.
+// inserted is called with the number of rows of each batch.
+func insertBatched(tx *sql.Tx, insert, conflict string, n int, row func(i int) []interface{}, inserted func(rows int)) error {
+	if n == 0 {
+		return nil
+	}
+	columns := len(row(0))
+	batchSize := maxBindVariables / columns
+	values := "(" + strings.Repeat("?, ", columns-1) + "?)"
+	query := func(rows int) string {
+		return insert + " VALUES " + strings.Repeat(values+", ", rows-1) + values + " " + conflict
+	}
+
+	var full *sql.Stmt
+	defer func() {
+		if full != nil {
+			full.Close()
+		}
+	}()
+
+	args := make([]interface{}, 0, batchSize*columns)
+	for start := 0; start < n; start += batchSize {
+		end := min(start+batchSize, n)
+		args = args[:0]
+		for i := start; i < end; i++ {
+			args = append(args, row(i)...)
+		}
+
+		if end-start < batchSize {
+			if _, err := tx.Exec(query(end-start), args...); err != nil {
+				return err
+			}
+			inserted(end - start)
+			continue
+		}
+		if full == nil {
+			var err error
+			if full, err = tx.Prepare(query(batchSize)); err != nil {
+				return err
+			}
 		}
-		expenses = append(expenses, expense)
+		if _, err := full.Exec(args...); err != nil {
+			return err
+		}
+		inserted(end - start)
 	}
+	return nil
+}
 
-	return expenses, nil
+// importedPaymentStatus defaults the status of payments from exports made
+// before statuses existed
+func importedPaymentStatus(status string) string {
+	if status == "" {
+		return PaymentStatusConfirmed
+	}
+	return status
 }
 
 // Search for residents
@@ -1024,82 +2144,100 @@ func searchResidents(db *sql.DB) http.HandlerFunc {
 			respondWithError(w, http.StatusBadRequest, "Search query is required")
 			return
 		}
+		format, err := listFormat(r)
+		if err != nil {
+			respondWithError(w, http.StatusNotAcceptable, err.Error())
+			return
+		}
+
+		fuzzy := false
+		if value := r.URL.Query().Get("fuzzy"); value != "" {
+			var err error
+			if fuzzy, err = strconv.ParseBool(value); err != nil {
+				respondWithError(w, http.StatusBadRequest, "Invalid fuzzy, must be true or false")
+				return
+			}
+		}
+		if fuzzy {
+			if r.URL.Query().Get("match") != "" {
+				respondWithError(w, http.StatusBadRequest, "match can't be combined with fuzzy")
+				return
+			}
+			searchResidentsFuzzy(w, r, db, format, query)
+			return
+		}
+
+		pattern, err := searchPattern(r)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
 
-		// SQL query with LIKE for matching name, unit, or email
+		whereClause, args := residentSearchWhere(pattern)
 		sqlQuery := `
-			SELECT id, name, unit, contact, email, created_at, updated_at 
+			SELECT ` + residentColumns + `
 			FROM residents 
-			WHERE name LIKE ? OR unit LIKE ? OR email LIKE ? OR contact LIKE ?
+			WHERE ` + whereClause + `
 			ORDER BY name
 		`
-		searchPattern := "%" + query + "%"
 
-		rows, err := db.Query(sqlQuery, searchPattern, searchPattern, searchPattern, searchPattern)
-		if err != nil {
+		if err := setTotalCount(w, db, "SELECT COUNT(*) FROM residents WHERE "+whereClause, args...); err != nil {
 			respondWithError(w, http.StatusInternalServerError, err.Error())
 			return
 		}
-		defer rows.Close()
 
-		residents := []Resident{}
-		for rows.Next() {
-			var resident Resident
-			if err := rows.Scan(&resident.ID, &resident.Name, &resident.Unit, &resident.Contact, &resident.Email, &resident.CreatedAt, &resident.UpdatedAt); err != nil {
-				respondWithError(w, http.StatusInternalServerError, err.Error())
-				return
-			}
-			residents = append(residents, resident)
-		}
+		streamList(w, r, db, format, "residents_search", jsonFieldNames(Resident{}), scanResident, sqlQuery, args...)
+	}
+}
+
+// searchResidentsFuzzy matches residents ignoring case and accents and
+// allowing a typo or two, closest matches first. Anonymized residents are
+// never found.
+func searchResidentsFuzzy(w http.ResponseWriter, r *http.Request, db *sql.DB, format, query string) {
+	matches := `
+		SELECT *, min(fuzzy_distance(name, ?1), fuzzy_distance(unit, ?1), fuzzy_distance(email, ?1), fuzzy_distance(contact, ?1)) AS distance
+		FROM residents WHERE anonymized_at IS NULL`
+	tolerance := fuzzyTolerance(query)
 
-		respondWithJSON(w, http.StatusOK, residents)
+	if err := setTotalCount(w, db, "SELECT COUNT(*) FROM ("+matches+") WHERE distance <= ?2", query, tolerance); err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
 	}
+
+	streamList(w, r, db, format, "residents_search", jsonFieldNames(Resident{}), scanResident, `
+		SELECT `+residentColumns+`
+		FROM (`+matches+`) AS residents
+		WHERE distance <= ?2
+		ORDER BY distance, name
+	`, query, tolerance)
 }
 
 // Search for payments
 func searchPayments(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		query := r.URL.Query().Get("q")
-		residentId := r.URL.Query().Get("resident_id")
-		startDate := r.URL.Query().Get("start_date")
-		endDate := r.URL.Query().Get("end_date")
-
-		// Build WHERE clause dynamically
-		whereClause := ""
-		args := []interface{}{}
-
-		if query != "" {
-			whereClause += "p.description LIKE ? OR r.name LIKE ?"
-			searchPattern := "%" + query + "%"
-			args = append(args, searchPattern, searchPattern)
+		format, err := listFormat(r)
+		if err != nil {
+			respondWithError(w, http.StatusNotAcceptable, err.Error())
+			return
 		}
-
-		if residentId != "" {
-			if whereClause != "" {
-				whereClause += " AND "
-			}
-			whereClause += "p.resident_id = ?"
-			args = append(args, residentId)
+		whereClause, args, err := paymentSearchWhere(r)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
 		}
 
-		if startDate != "" {
-			if whereClause != "" {
-				whereClause += " AND "
-			}
-			whereClause += "p.payment_date >= ?"
-			args = append(args, startDate)
+		countQuery := "SELECT COUNT(*) FROM payments p JOIN residents r ON p.resident_id = r.id"
+		if whereClause != "" {
+			countQuery += " WHERE " + whereClause
 		}
-
-		if endDate != "" {
-			if whereClause != "" {
-				whereClause += " AND "
-			}
-			whereClause += "p.payment_date <= ?"
-			args = append(args, endDate)
+		if err := setTotalCount(w, db, countQuery, args...); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
 		}
 
 		// Build full SQL query
 		sqlQuery := `
-			SELECT p.id, p.resident_id, r.name, p.amount, p.description, p.payment_date, p.created_at 
+			SELECT p.id, p.resident_id, r.name, p.amount, p.description, p.payment_date, p.method, p.status, p.reference, p.bank_reference, p.cheque_number, p.cheque_bank, p.cheque_status, p.cheque_status_date, p.created_at, p.updated_at
 			FROM payments p
 			JOIN residents r ON p.resident_id = r.id
 		`
@@ -1110,71 +2248,35 @@ func searchPayments(db *sql.DB) http.HandlerFunc {
 
 		sqlQuery += " ORDER BY p.payment_date DESC"
 
-		rows, err := db.Query(sqlQuery, args...)
-		if err != nil {
-			respondWithError(w, http.StatusInternalServerError, err.Error())
-			return
-		}
-		defer rows.Close()
-
-		payments := []Payment{}
-		for rows.Next() {
-			var payment Payment
-			if err := rows.Scan(&payment.ID, &payment.ResidentID, &payment.ResidentName, &payment.Amount, &payment.Description, &payment.PaymentDate, &payment.CreatedAt); err != nil {
-				respondWithError(w, http.StatusInternalServerError, err.Error())
-				return
-			}
-			payments = append(payments, payment)
-		}
-
-		respondWithJSON(w, http.StatusOK, payments)
+		streamList(w, r, db, format, "payments_search", jsonFieldNames(Payment{}), scanPaymentWithResident, sqlQuery, args...)
 	}
 }
 
 // Search for expenses
 func searchExpenses(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		query := r.URL.Query().Get("q")
-		category := r.URL.Query().Get("category")
-		startDate := r.URL.Query().Get("start_date")
-		endDate := r.URL.Query().Get("end_date")
-
-		// Build WHERE clause dynamically
-		whereClause := ""
-		args := []interface{}{}
-
-		if query != "" {
-			whereClause += "description LIKE ?"
-			searchPattern := "%" + query + "%"
-			args = append(args, searchPattern)
+		format, err := listFormat(r)
+		if err != nil {
+			respondWithError(w, http.StatusNotAcceptable, err.Error())
+			return
 		}
-
-		if category != "" {
-			if whereClause != "" {
-				whereClause += " AND "
-			}
-			whereClause += "category = ?"
-			args = append(args, category)
+		whereClause, args, err := expenseSearchWhere(r)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
 		}
 
-		if startDate != "" {
-			if whereClause != "" {
-				whereClause += " AND "
-			}
-			whereClause += "expense_date >= ?"
-			args = append(args, startDate)
+		countQuery := "SELECT COUNT(*) FROM expenses"
+		if whereClause != "" {
+			countQuery += " WHERE " + whereClause
 		}
-
-		if endDate != "" {
-			if whereClause != "" {
-				whereClause += " AND "
-			}
-			whereClause += "expense_date <= ?"
-			args = append(args, endDate)
+		if err := setTotalCount(w, db, countQuery, args...); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
 		}
 
 		// Build full SQL query
-		sqlQuery := "SELECT id, amount, description, expense_date, category, created_at FROM expenses"
+		sqlQuery := "SELECT " + expenseColumns + " FROM expenses"
 
 		if whereClause != "" {
 			sqlQuery += " WHERE " + whereClause
@@ -1182,34 +2284,33 @@ func searchExpenses(db *sql.DB) http.HandlerFunc {
 
 		sqlQuery += " ORDER BY expense_date DESC"
 
-		rows, err := db.Query(sqlQuery, args...)
-		if err != nil {
-			respondWithError(w, http.StatusInternalServerError, err.Error())
-			return
-		}
-		defer rows.Close()
-
-		expenses := []Expense{}
-		for rows.Next() {
-			var expense Expense
-			if err := rows.Scan(&expense.ID, &expense.Amount, &expense.Description, &expense.ExpenseDate, &expense.Category, &expense.CreatedAt); err != nil {
-				respondWithError(w, http.StatusInternalServerError, err.Error())
-				return
-			}
-			expenses = append(expenses, expense)
-		}
-
-		respondWithJSON(w, http.StatusOK, expenses)
+		streamList(w, r, db, format, "expenses_search", jsonFieldNames(Expense{}), scanExpense, sqlQuery, args...)
 	}
 }
 
 // Export payments report as CSV
-func exportPaymentsReport(db *sql.DB) http.HandlerFunc {
+func exportPaymentsReport(db *sql.DB, cal calendar) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Get query parameters for filtering
 		residentId := r.URL.Query().Get("resident_id")
 		startDate := r.URL.Query().Get("start_date")
 		endDate := r.URL.Query().Get("end_date")
+		locale, err := reportLocale(r)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		var summary *reportSummary
+		switch r.URL.Query().Get("subtotals") {
+		case "":
+			summary = newReportSummary()
+		case "resident":
+			summary = newReportSummary("resident", "unit")
+		default:
+			respondWithError(w, http.StatusBadRequest, "Invalid subtotals, must be resident")
+			return
+		}
 
 		// Build WHERE clause dynamically
 		whereClause := ""
@@ -1238,7 +2339,8 @@ func exportPaymentsReport(db *sql.DB) http.HandlerFunc {
 
 		// Build full SQL query
 		sqlQuery := `
-			SELECT p.id, r.name, r.unit, p.amount, p.description, p.payment_date
+			SELECT p.id, r.id, r.name, r.unit, r.email, r.contact, p.amount, p.description, p.payment_date, p.method, p.status,
+				p.reference, p.bank_reference, p.cheque_number, p.cheque_bank, p.cheque_status, p.created_at, p.updated_at
 			FROM payments p
 			JOIN residents r ON p.resident_id = r.id
 		`
@@ -1249,6 +2351,22 @@ func exportPaymentsReport(db *sql.DB) http.HandlerFunc {
 
 		sqlQuery += " ORDER BY p.payment_date DESC"
 
+		custom, err := loadCustomColumns(db)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		var p paymentReportRow
+		available, defaults := paymentReportColumns(&p, locale, custom)
+		columns, err := pickReportColumns(r, available, defaults)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if r.URL.Query().Get("columns") != "" {
+			summary.Align(len(columns), reportColumnIndex(columns, "amount"))
+		}
+
 		rows, err := db.Query(sqlQuery, args...)
 		if err != nil {
 			respondWithError(w, http.StatusInternalServerError, err.Error())
@@ -1259,49 +2377,61 @@ func exportPaymentsReport(db *sql.DB) http.HandlerFunc {
 		// Set headers for CSV download
 		w.Header().Set("Content-Type", "text/csv")
 		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=payments_report_%s.csv",
-			time.Now().Format("2006-01-02")))
+			cal.today()))
 
-		// Write CSV header
-		fmt.Fprintf(w, "ID,Resident,Unit,Amount,Description,Date\n")
+		// Write CSV header, by default with the residents' custom fields last
+		locale.Start(w)
+		locale.Row(w, reportHeader(columns, responseLanguage(w))...)
 
 		// Write data rows
 		for rows.Next() {
-			var id int
-			var name, unit, description, date string
-			var amount float64
-
-			if err := rows.Scan(&id, &name, &unit, &amount, &description, &date); err != nil {
+			p = paymentReportRow{}
+			if err := rows.Scan(&p.ID, &p.ResidentID, &p.Name, &p.Unit, &p.Email, &p.Contact, &p.Amount, &p.Description, &p.Date, &p.Method, &p.Status,
+				&p.Reference, &p.BankReference, &p.ChequeNumber, &p.ChequeBank, &p.ChequeStatus, &p.CreatedAt, &p.UpdatedAt); err != nil {
 				log.Printf("Error scanning payment row: %v", err)
 				continue
 			}
 
-			// Escape description field for CSV (handle commas and quotes)
-			if strings.Contains(description, ",") || strings.Contains(description, "\"") {
-				description = "\"" + strings.ReplaceAll(description, "\"", "\"\"") + "\""
-			}
-
-			fmt.Fprintf(w, "%d,%s,%s,%.2f,%s,%s\n", id, name, unit, amount, description, date)
+			locale.Row(w, reportRow(columns)...)
+			summary.Add(p.Amount, p.Name, p.Unit)
 		}
+		summary.Write(w, locale, responseLanguage(w))
 	}
 }
 
 // Export expenses report as CSV
-func exportExpensesReport(db *sql.DB) http.HandlerFunc {
+func exportExpensesReport(db *sql.DB, cal calendar) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Get query parameters for filtering
-		category := r.URL.Query().Get("category")
 		startDate := r.URL.Query().Get("start_date")
 		endDate := r.URL.Query().Get("end_date")
+		locale, err := reportLocale(r)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
 
-		// Build WHERE clause dynamically
-		whereClause := ""
-		args := []interface{}{}
+		var summary *reportSummary
+		switch r.URL.Query().Get("subtotals") {
+		case "":
+			summary = newReportSummary()
+		case "category":
+			summary = newReportSummary("category")
+		default:
+			respondWithError(w, http.StatusBadRequest, "Invalid subtotals, must be category")
+			return
+		}
 
-		if category != "" {
-			whereClause += "category = ?"
-			args = append(args, category)
+		categoryClause, categoryArgs, err := categoryCondition(r)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
 		}
 
+		// Build WHERE clause dynamically
+		whereClause := categoryClause
+		args := categoryArgs
+
 		if startDate != "" {
 			if whereClause != "" {
 				whereClause += " AND "
@@ -1318,8 +2448,21 @@ func exportExpensesReport(db *sql.DB) http.HandlerFunc {
 			args = append(args, endDate)
 		}
 
-		// Build full SQL query
-		sqlQuery := "SELECT id, amount, description, expense_date, category FROM expenses"
+		var e expenseReportRow
+		available, defaults := expenseReportColumns(&e, locale)
+		columns, err := pickReportColumns(r, available, defaults)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if r.URL.Query().Get("columns") != "" {
+			summary.Align(len(columns), reportColumnIndex(columns, "amount"))
+		}
+
+		// Build full SQL query. Units are those the expense is split among.
+		sqlQuery := `SELECT id, amount, description, expense_date, category, currency, original_amount, exchange_rate, tax_rate, tax_amount, bank_reference,
+			(SELECT COALESCE(group_concat(unit, ', '), '') FROM (SELECT unit FROM expense_allocations a WHERE a.expense_id = expenses.id ORDER BY unit)),
+			created_at, updated_at FROM expenses`
 
 		if whereClause != "" {
 			sqlQuery += " WHERE " + whereClause
@@ -1337,29 +2480,25 @@ func exportExpensesReport(db *sql.DB) http.HandlerFunc {
 		// Set headers for CSV download
 		w.Header().Set("Content-Type", "text/csv")
 		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=expenses_report_%s.csv",
-			time.Now().Format("2006-01-02")))
+			cal.today()))
 
 		// Write CSV header
-		fmt.Fprintf(w, "ID,Amount,Description,Date,Category\n")
+		locale.Start(w)
+		locale.Row(w, reportHeader(columns, responseLanguage(w))...)
 
 		// Write data rows
 		for rows.Next() {
-			var id int
-			var description, date, category string
-			var amount float64
-
-			if err := rows.Scan(&id, &amount, &description, &date, &category); err != nil {
+			e = expenseReportRow{}
+			if err := rows.Scan(&e.ID, &e.Amount, &e.Description, &e.Date, &e.Category, &e.Currency, &e.OriginalAmount, &e.ExchangeRate, &e.TaxRate, &e.TaxAmount,
+				&e.BankReference, &e.Units, &e.CreatedAt, &e.UpdatedAt); err != nil {
 				log.Printf("Error scanning expense row: %v", err)
 				continue
 			}
 
-			// Escape description field for CSV (handle commas and quotes)
-			if strings.Contains(description, ",") || strings.Contains(description, "\"") {
-				description = "\"" + strings.ReplaceAll(description, "\"", "\"\"") + "\""
-			}
-
-			fmt.Fprintf(w, "%d,%.2f,%s,%s,%s\n", id, amount, description, date, category)
+			locale.Row(w, reportRow(columns)...)
+			summary.Add(e.Amount, e.Category)
 		}
+		summary.Write(w, locale, responseLanguage(w))
 	}
 }
 
@@ -1387,6 +2526,10 @@ func insertSampleData(db *sql.DB) error {
 	if err != nil {
 		return err
 	}
+	_, err = tx.Exec("DELETE FROM resident_custom_values")
+	if err != nil {
+		return err
+	}
 	_, err = tx.Exec("DELETE FROM residents")
 	if err != nil {
 		return err
@@ -0,0 +1,170 @@
+package condomngr
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// dbLocks serialize the operations that rewrite a whole database, imports
+// and maintenance, with a lock per database so those of different condos
+// don't wait for each other
+var dbLocks sync.Map // *sql.DB to *sync.Mutex
+
+// dbLock returns the lock of the operations that rewrite db
+func dbLock(db *sql.DB) *sync.Mutex {
+	lock, _ := dbLocks.LoadOrStore(db, &sync.Mutex{})
+	return lock.(*sync.Mutex)
+}
+
+// errBusy is returned when maintenance would have to wait for an import
+var errBusy = errors.New("an import or maintenance run is in progress")
+
+// MaintenanceResult reports a maintenance run. Vacuum and analyze are skipped
+// when the integrity check finds problems.
+type MaintenanceResult struct {
+	Integrity  []string `json:"integrity"` // "ok", or the problems found
+	Vacuumed   bool     `json:"vacuumed"`
+	Analyzed   bool     `json:"analyzed"`
+	SizeBefore int64    `json:"size_before"`
+	SizeAfter  int64    `json:"size_after"`
+	DurationMS int64    `json:"duration_ms"`
+}
+
+// DBStats describes the database file and its contents
+type DBStats struct {
+	FileSize      int64            `json:"file_size"`
+	PageSize      int64            `json:"page_size"`
+	PageCount     int64            `json:"page_count"`
+	FreelistCount int64            `json:"freelist_count"` // unused pages VACUUM would release
+	Tables        map[string]int64 `json:"tables"`         // row count per table
+}
+
+// maintainDatabase checks integrity, then rebuilds the file with VACUUM to
+// release the space of deleted rows and refreshes the query planner
+// statistics with ANALYZE
+func maintainDatabase(db *sql.DB) (MaintenanceResult, error) {
+	result := MaintenanceResult{Integrity: []string{}}
+	if !dbLock(db).TryLock() {
+		return result, errBusy
+	}
+	defer dbLock(db).Unlock()
+
+	start := time.Now()
+	var err error
+	if result.SizeBefore, err = databaseSize(db); err != nil {
+		return result, err
+	}
+
+	rows, err := db.Query("PRAGMA integrity_check")
+	if err != nil {
+		return result, err
+	}
+	for rows.Next() {
+		var line string
+		if err := rows.Scan(&line); err != nil {
+			rows.Close()
+			return result, err
+		}
+		result.Integrity = append(result.Integrity, line)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return result, err
+	}
+
+	if len(result.Integrity) == 1 && result.Integrity[0] == "ok" {
+		if _, err := db.Exec("VACUUM"); err != nil {
+			return result, err
+		}
+		result.Vacuumed = true
+		if _, err := db.Exec("ANALYZE"); err != nil {
+			return result, err
+		}
+		result.Analyzed = true
+	}
+
+	result.SizeAfter, err = databaseSize(db)
+	result.DurationMS = time.Since(start).Milliseconds()
+	return result, err
+}
+
+// databaseSize returns the size of the database in bytes
+func databaseSize(db *sql.DB) (int64, error) {
+	var size int64
+	err := db.QueryRow("SELECT page_count * page_size FROM pragma_page_count(), pragma_page_size()").Scan(&size)
+	return size, err
+}
+
+// databaseStats collects the page counts of the database and the row count of
+// every table
+func databaseStats(db *sql.DB) (DBStats, error) {
+	stats := DBStats{Tables: map[string]int64{}}
+	if info, err := os.Stat(dbFile); err == nil {
+		stats.FileSize = info.Size()
+	}
+	err := db.QueryRow("SELECT page_size, page_count, freelist_count FROM pragma_page_size(), pragma_page_count(), pragma_freelist_count()").
+		Scan(&stats.PageSize, &stats.PageCount, &stats.FreelistCount)
+	if err != nil {
+		return stats, err
+	}
+
+	rows, err := db.Query("SELECT name FROM sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%' ORDER BY name")
+	if err != nil {
+		return stats, err
+	}
+	var tables []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return stats, err
+		}
+		tables = append(tables, name)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return stats, err
+	}
+
+	for _, table := range tables {
+		var n int64
+		// Table names come from sqlite_master, not from the request
+		if err := db.QueryRow(`SELECT COUNT(*) FROM "` + table + `"`).Scan(&n); err != nil {
+			return stats, err
+		}
+		stats.Tables[table] = n
+	}
+	return stats, nil
+}
+
+// Run integrity check, VACUUM and ANALYZE
+func postMaintenance(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		result, err := maintainDatabase(db)
+		if errors.Is(err, errBusy) {
+			respondWithError(w, http.StatusConflict, err.Error())
+			return
+		}
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		respondWithJSON(w, http.StatusOK, result)
+	}
+}
+
+// Get database size and row counts
+func getDBStats(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		stats, err := databaseStats(db)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		respondWithJSON(w, http.StatusOK, stats)
+	}
+}
@@ -0,0 +1,551 @@
+package condomngr
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/http"
+	"net/mail"
+	"net/textproto"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Maintenance request states
+const (
+	MaintenanceRequestOpen       = "open"
+	MaintenanceRequestInProgress = "in_progress"
+	MaintenanceRequestClosed     = "closed"
+)
+
+// MaintenanceRequest is a problem a resident asks to have fixed, such as a
+// leaking tap, either entered by hand or emailed to the inbound address
+type MaintenanceRequest struct {
+	ID           int       `json:"id"`
+	ResidentID   *int      `json:"resident_id"`
+	ResidentName string    `json:"resident_name"` // of resident_id
+	Sender       string    `json:"sender"`        // the address it was emailed from
+	Subject      string    `json:"subject"`
+	Description  string    `json:"description"`
+	Status       string    `json:"status"`     // MaintenanceRequestOpen if empty
+	MessageID    string    `json:"message_id"` // of the email it came from; set only by the inbound endpoint
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+const maintenanceRequestColumns = `m.id, m.resident_id, COALESCE(r.name, ''), m.sender, m.subject, m.description,
+	m.status, m.message_id, m.created_at, m.updated_at`
+
+const maintenanceRequestFrom = " FROM maintenance_requests m LEFT JOIN residents r ON r.id = m.resident_id"
+
+func scanMaintenanceRequest(row interface{ Scan(...interface{}) error }) (MaintenanceRequest, error) {
+	var m MaintenanceRequest
+	var residentID sql.NullInt64
+	err := row.Scan(&m.ID, &residentID, &m.ResidentName, &m.Sender, &m.Subject, &m.Description,
+		&m.Status, &m.MessageID, &m.CreatedAt, &m.UpdatedAt)
+	if residentID.Valid {
+		id := int(residentID.Int64)
+		m.ResidentID = &id
+	}
+	return m, err
+}
+
+func loadMaintenanceRequest(q querier, id int) (MaintenanceRequest, error) {
+	return scanMaintenanceRequest(q.QueryRow("SELECT "+maintenanceRequestColumns+maintenanceRequestFrom+" WHERE m.id = ?", id))
+}
+
+// Validation function for MaintenanceRequest data
+func validateMaintenanceRequest(m MaintenanceRequest) error {
+	var errs ValidationErrors
+	if m.Subject == "" {
+		errs.Add("subject", "subject is required")
+	}
+	switch m.Status {
+	case MaintenanceRequestOpen, MaintenanceRequestInProgress, MaintenanceRequestClosed:
+	default:
+		errs.Add("status", "status must be open, in_progress or closed")
+	}
+	return errs.Err()
+}
+
+// inboundMail is what a maintenance request is made of from an email
+type inboundMail struct {
+	MessageID   string
+	From        string
+	Subject     string
+	Body        string
+	Images      []MailAttachment
+	AutoReplied bool // sent by a machine, such as an out-of-office reply, so not to be answered
+}
+
+// htmlTag matches the tags stripped from HTML-only emails
+var htmlTag = regexp.MustCompile(`(?s)<(script|style)[^>]*>.*?</(script|style)>|<[^>]*>`)
+
+// parseInboundMail reads a raw email (RFC 5322): the sender, subject, the
+// plain text body, or the HTML one without its tags, and the attached
+// images. A message without a Message-ID is identified by its hash.
+func parseInboundMail(raw []byte) (inboundMail, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return inboundMail{}, err
+	}
+	from, err := msg.Header.AddressList("From")
+	if err != nil || len(from) == 0 {
+		return inboundMail{}, errors.New("the message has no sender")
+	}
+
+	decoder := new(mime.WordDecoder)
+	m := inboundMail{From: strings.ToLower(from[0].Address), MessageID: strings.TrimSpace(msg.Header.Get("Message-Id"))}
+	if m.Subject, err = decoder.DecodeHeader(msg.Header.Get("Subject")); err != nil {
+		m.Subject = msg.Header.Get("Subject")
+	}
+	m.Subject = strings.TrimSpace(m.Subject)
+	if m.MessageID == "" {
+		sum := sha256.Sum256(raw)
+		m.MessageID = "sha256:" + hex.EncodeToString(sum[:])
+	}
+	auto := strings.ToLower(msg.Header.Get("Auto-Submitted"))
+	precedence := strings.ToLower(msg.Header.Get("Precedence"))
+	m.AutoReplied = (auto != "" && auto != "no") || precedence == "bulk" || precedence == "list" || precedence == "junk"
+
+	var text, htmlText string
+	var walk func(header textproto.MIMEHeader, body io.Reader) error
+	walk = func(header textproto.MIMEHeader, body io.Reader) error {
+		mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+		if err != nil {
+			mediaType, params = "text/plain", map[string]string{}
+		}
+		if strings.HasPrefix(mediaType, "multipart/") {
+			parts := multipart.NewReader(body, params["boundary"])
+			for {
+				part, err := parts.NextRawPart()
+				if err == io.EOF {
+					return nil
+				}
+				if err != nil {
+					return err
+				}
+				if err := walk(part.Header, part); err != nil {
+					return err
+				}
+			}
+		}
+
+		switch strings.ToLower(strings.TrimSpace(header.Get("Content-Transfer-Encoding"))) {
+		case "base64":
+			body = base64.NewDecoder(base64.StdEncoding, body)
+		case "quoted-printable":
+			body = quotedprintable.NewReader(body)
+		}
+		data, err := io.ReadAll(body)
+		if err != nil {
+			return err
+		}
+		disposition, dispositionParams, _ := mime.ParseMediaType(header.Get("Content-Disposition"))
+		switch {
+		case strings.HasPrefix(mediaType, "image/"):
+			name := dispositionParams["filename"]
+			if name == "" {
+				name = params["name"]
+			}
+			if decoded, err := decoder.DecodeHeader(name); err == nil {
+				name = decoded
+			}
+			m.Images = append(m.Images, MailAttachment{Filename: name, ContentType: mediaType, Data: data})
+		case disposition == "attachment":
+		case mediaType == "text/plain" && text == "":
+			text = mailText(data, params["charset"])
+		case mediaType == "text/html" && htmlText == "":
+			htmlText = mailText(data, params["charset"])
+		}
+		return nil
+	}
+	if err := walk(textproto.MIMEHeader(msg.Header), msg.Body); err != nil {
+		return m, err
+	}
+
+	if text == "" && htmlText != "" {
+		text = html.UnescapeString(htmlTag.ReplaceAllString(htmlText, "\n"))
+	}
+	lines := strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n")
+	var kept []string
+	for _, line := range lines {
+		line = strings.TrimRight(line, " \t")
+		if line == "" && (len(kept) == 0 || kept[len(kept)-1] == "") {
+			continue
+		}
+		kept = append(kept, line)
+	}
+	m.Body = strings.TrimSpace(strings.Join(kept, "\n"))
+	return m, nil
+}
+
+// readFormFile reads a file uploaded in a multipart form
+func readFormFile(header *multipart.FileHeader) ([]byte, error) {
+	file, err := header.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return io.ReadAll(file)
+}
+
+// mailText is the text of a body part in charset. Latin-1 and Windows-1252
+// are converted to UTF-8, the characters Windows-1252 adds aside; anything
+// else is taken as UTF-8.
+func mailText(data []byte, charset string) string {
+	switch strings.ToLower(charset) {
+	case "iso-8859-1", "iso-8859-15", "latin1", "windows-1252":
+		runes := make([]rune, len(data))
+		for i, b := range data {
+			runes[i] = rune(b)
+		}
+		return string(runes)
+	}
+	return string(bytes.ToValidUTF8(data, []byte("\uFFFD")))
+}
+
+// Handlers for maintenance request endpoints
+
+// Get the maintenance requests, newest first, filtered by status and resident
+func getMaintenanceRequests(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := checkQueryParams(r, "status", "resident_id"); err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		var filter queryFilter
+		filter.addString(r, "status", "m.status = ?")
+		if err := filter.addInt(r, "resident_id", "m.resident_id = ?"); err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		rows, err := db.Query("SELECT "+maintenanceRequestColumns+maintenanceRequestFrom+filter.where()+" ORDER BY m.created_at DESC, m.id DESC", filter.args...)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		defer rows.Close()
+
+		requests := []MaintenanceRequest{}
+		for rows.Next() {
+			m, err := scanMaintenanceRequest(rows)
+			if err != nil {
+				respondWithError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			requests = append(requests, m)
+		}
+
+		respondWithJSON(w, http.StatusOK, requests)
+	}
+}
+
+func getMaintenanceRequest(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id, err := strconv.Atoi(vars["id"])
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid maintenance request ID")
+			return
+		}
+
+		m, err := loadMaintenanceRequest(db, id)
+		if err == sql.ErrNoRows {
+			respondWithError(w, http.StatusNotFound, "Maintenance request not found")
+			return
+		}
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		respondWithJSON(w, http.StatusOK, m)
+	}
+}
+
+// saveMaintenanceRequest inserts m, or updates it when it has an id, after
+// checking its resident exists. The sender and message id of emailed
+// requests are kept as they came. It returns sql.ErrNoRows when the request
+// to update doesn't exist.
+func saveMaintenanceRequest(db *sql.DB, m *MaintenanceRequest) error {
+	if m.ResidentID != nil {
+		var exists bool
+		if err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM residents WHERE id = ?)", *m.ResidentID).Scan(&exists); err != nil {
+			return err
+		}
+		if !exists {
+			var errs ValidationErrors
+			errs.Add("resident_id", "resident_id must be an existing resident")
+			return errs
+		}
+	}
+
+	if m.ID == 0 {
+		result, err := db.Exec("INSERT INTO maintenance_requests(resident_id, subject, description, status) VALUES(?, ?, ?, ?)",
+			m.ResidentID, m.Subject, m.Description, m.Status)
+		if err != nil {
+			return err
+		}
+		id, err := result.LastInsertId()
+		if err != nil {
+			return err
+		}
+		m.ID = int(id)
+		return nil
+	}
+	result, err := db.Exec(`
+		UPDATE maintenance_requests SET resident_id = ?, subject = ?, description = ?, status = ?, updated_at = CURRENT_TIMESTAMP
+		WHERE id = ?
+	`, m.ResidentID, m.Subject, m.Description, m.Status, m.ID)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// respondWithSavedMaintenanceRequest decodes a maintenance request from the
+// request body, saves it as id (0 for a new one) and responds with it as
+// stored
+func respondWithSavedMaintenanceRequest(w http.ResponseWriter, r *http.Request, db *sql.DB, id, status int) {
+	var m MaintenanceRequest
+	if err := decodeRequest(r, &m); err != nil {
+		respondWithError(w, payloadErrorStatus(err), "Invalid request payload: "+err.Error())
+		return
+	}
+	defer r.Body.Close()
+	m.ID = id
+	if m.Status == "" {
+		m.Status = MaintenanceRequestOpen
+	}
+
+	if err := validateMaintenanceRequest(m); err != nil {
+		respondWithValidationError(w, err)
+		return
+	}
+	err := saveMaintenanceRequest(db, &m)
+	if _, ok := err.(ValidationErrors); ok {
+		respondWithValidationError(w, err)
+		return
+	}
+	if err == sql.ErrNoRows {
+		respondWithError(w, http.StatusNotFound, "Maintenance request not found")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	saved, err := loadMaintenanceRequest(db, m.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	respondWithJSON(w, status, saved)
+}
+
+// Enter a maintenance request by hand, such as one phoned in
+func createMaintenanceRequest(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		respondWithSavedMaintenanceRequest(w, r, db, 0, http.StatusCreated)
+	}
+}
+
+// Update a maintenance request, such as to close it once fixed
+func updateMaintenanceRequest(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id, err := strconv.Atoi(vars["id"])
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid maintenance request ID")
+			return
+		}
+		respondWithSavedMaintenanceRequest(w, r, db, id, http.StatusOK)
+	}
+}
+
+func deleteMaintenanceRequest(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id, err := strconv.Atoi(vars["id"])
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid maintenance request ID")
+			return
+		}
+
+		result, err := db.Exec("DELETE FROM maintenance_requests WHERE id = ?", id)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			respondWithError(w, http.StatusNotFound, "Maintenance request not found")
+			return
+		}
+
+		respondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
+	}
+}
+
+// Receive an email forwarded by a mail-to-webhook service, authenticated by
+// the inbound mail secret in ?token or the X-Inbound-Token header, and make a
+// maintenance request of it. The raw message is the request body, or the
+// email form field (SendGrid's Inbound Parse with raw messages) or body-mime
+// (Mailgun's routes to a URL ending in mime). The sender is matched to a
+// resident by email, images are attached, and the sender is answered with
+// the request's id. An email received again with the same Message-ID is
+// acknowledged without making another request.
+func inboundMaintenanceRequest(db *sql.DB, store *AttachmentStore, mailer *Mailer, notifier *Notifier, secret string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if secret == "" {
+			respondWithError(w, http.StatusNotFound, "Inbound mail is not configured")
+			return
+		}
+		token := r.URL.Query().Get("token")
+		if token == "" {
+			token = r.Header.Get("X-Inbound-Token")
+		}
+		if subtle.ConstantTimeCompare([]byte(token), []byte(secret)) != 1 {
+			respondWithError(w, http.StatusUnauthorized, "Invalid inbound mail token")
+			return
+		}
+
+		var raw []byte
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		var err error
+		switch mediaType {
+		case "multipart/form-data", "application/x-www-form-urlencoded":
+			if mediaType == "multipart/form-data" {
+				err = r.ParseMultipartForm(32 << 20)
+			} else {
+				err = r.ParseForm()
+			}
+			for _, field := range []string{"email", "body-mime"} {
+				if err != nil {
+					break
+				}
+				if raw = []byte(r.FormValue(field)); len(raw) > 0 {
+					break
+				}
+				if r.MultipartForm != nil && len(r.MultipartForm.File[field]) > 0 {
+					raw, err = readFormFile(r.MultipartForm.File[field][0])
+					break
+				}
+			}
+		default:
+			raw, err = io.ReadAll(r.Body)
+		}
+		if err != nil {
+			respondWithError(w, payloadErrorStatus(err), "Error reading request body")
+			return
+		}
+		defer r.Body.Close()
+		if len(raw) == 0 {
+			respondWithError(w, http.StatusBadRequest, "No email in the request")
+			return
+		}
+
+		email, err := parseInboundMail(raw)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid email: "+err.Error())
+			return
+		}
+		subject := email.Subject
+		if subject == "" {
+			subject = "(no subject)"
+		}
+
+		var residentID *int
+		var resident int
+		err = db.QueryRow("SELECT id FROM residents WHERE lower(email) = ? ORDER BY id LIMIT 1", email.From).Scan(&resident)
+		if err != nil && err != sql.ErrNoRows {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if err == nil {
+			residentID = &resident
+		}
+
+		// The unique index on message_id turns duplicate deliveries into no-ops
+		result, err := db.Exec(`
+			INSERT OR IGNORE INTO maintenance_requests(resident_id, sender, subject, description, status, message_id)
+			VALUES(?, ?, ?, ?, ?, ?)
+		`, residentID, email.From, subject, email.Body, MaintenanceRequestOpen, email.MessageID)
+		if err != nil {
+			// A 5xx makes the service retry the delivery later
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			var existing int
+			if err := db.QueryRow("SELECT id FROM maintenance_requests WHERE message_id = ?", email.MessageID).Scan(&existing); err != nil {
+				respondWithError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			respondWithJSON(w, http.StatusOK, map[string]interface{}{"result": "duplicate", "id": existing})
+			return
+		}
+		lastID, err := result.LastInsertId()
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		id := int(lastID)
+
+		// An image that can't be stored, say over the quota, doesn't lose
+		// the request
+		for _, image := range email.Images {
+			if _, err := store.Save("maintenance_request", id, image.Filename, bytes.NewReader(image.Data)); err != nil {
+				log.Printf("Skipped image %q of maintenance request %d: %v", image.Filename, id, err)
+			}
+		}
+
+		saved, err := loadMaintenanceRequest(db, id)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		from := email.From
+		if saved.ResidentName != "" {
+			from = saved.ResidentName + " <" + email.From + ">"
+		}
+		notifier.Notify(Event{
+			Type:    EventMaintenanceRequest,
+			Title:   fmt.Sprintf("Maintenance request #%d", id),
+			Message: fmt.Sprintf("%s from %s", subject, from),
+		})
+
+		if mailer.Enabled() && !email.AutoReplied {
+			inReplyTo := ""
+			if strings.HasPrefix(email.MessageID, "<") {
+				inReplyTo = email.MessageID
+			}
+			body := fmt.Sprintf("We received your maintenance request and filed it as #%d:\n\n%s\n\nPlease quote #%d when writing to us about it.\n", id, subject, id)
+			if err := mailer.Reply(email.From, fmt.Sprintf("Re: %s [#%d]", subject, id), body, inReplyTo); err != nil {
+				log.Printf("Failed to acknowledge maintenance request %d to %s: %v", id, email.From, err)
+			}
+		}
+
+		respondWithJSON(w, http.StatusCreated, saved)
+	}
+}
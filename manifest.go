@@ -0,0 +1,132 @@
+package condomngr
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// ExportManifest lets an import tell a complete export from a truncated or
+// edited one. It is written last, so a file cut short has none.
+type ExportManifest struct {
+	Counts map[string]int `json:"counts"` // records in each section
+	SHA256 string         `json:"sha256"` // hex, of the sections as exportChecksum canonicalizes them
+}
+
+// exportSections are the sections an export's checksum covers, in the order
+// they are written
+var exportSections = []string{"residents", "payments", "expenses", "custom_fields"}
+
+// errManifestMismatch is returned when the data of an export doesn't match
+// its manifest
+var errManifestMismatch = errors.New("the file doesn't match its manifest, it may be truncated or edited")
+
+// exportHash hashes the sections of an export as they are written. The
+// canonical form is a JSON object of the sections in the order of
+// exportSections, each an array of its records as json.Marshal encodes them,
+// without whitespace: exactly what writeExport writes for them.
+type exportHash struct {
+	h       hash.Hash
+	started bool
+}
+
+func newExportHash() *exportHash {
+	return &exportHash{h: sha256.New()}
+}
+
+// section adds a section, given as its JSON array
+func (e *exportHash) section(name string, array []byte) {
+	e.writer(name).Write(array)
+}
+
+// writer adds the key of a section and returns where its array is to be
+// written
+func (e *exportHash) writer(name string) io.Writer {
+	separator := ","
+	if !e.started {
+		separator, e.started = "{", true
+	}
+	fmt.Fprintf(e.h, "%s%q:", separator, name)
+	return e.h
+}
+
+// tee adds the key of a section and returns a writer that writes its array to
+// w as well, still flushing w as writeJSONArray goes if it can
+func (e *exportHash) tee(name string, w io.Writer) io.Writer {
+	return &teeFlusher{Writer: io.MultiWriter(w, e.writer(name)), w: w}
+}
+
+type teeFlusher struct {
+	io.Writer
+	w io.Writer
+}
+
+func (t *teeFlusher) Flush() {
+	if f, ok := t.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// sum returns the hex checksum of the sections added
+func (e *exportHash) sum() string {
+	io.WriteString(e.h, "}")
+	return hex.EncodeToString(e.h.Sum(nil))
+}
+
+// exportChecksum computes the checksum of the sections of data again
+func exportChecksum(data ExportData) (string, error) {
+	e := newExportHash()
+	sections := []interface{}{data.Residents, data.Payments, data.Expenses, data.CustomFields}
+	for i, records := range sections {
+		array, err := json.Marshal(records)
+		if err != nil {
+			return "", err
+		}
+		if string(array) == "null" {
+			array = []byte("[]")
+		}
+		e.section(exportSections[i], array)
+	}
+	return e.sum(), nil
+}
+
+// verifyManifest checks the records of an export against its manifest.
+// JSON exports from before manifests have none and pass, while an NDJSON
+// export without one was cut short.
+func verifyManifest(data ExportData) error {
+	if data.Manifest == nil {
+		if data.lines != nil {
+			return fmt.Errorf("%w: no manifest record", errManifestMismatch)
+		}
+		return nil
+	}
+	counts := map[string]int{
+		"residents":     len(data.Residents),
+		"payments":      len(data.Payments),
+		"expenses":      len(data.Expenses),
+		"custom_fields": len(data.CustomFields),
+	}
+	var problems []string
+	for _, section := range exportSections {
+		if want := data.Manifest.Counts[section]; counts[section] != want {
+			problems = append(problems, fmt.Sprintf("%d %s instead of %d", counts[section], section, want))
+		}
+	}
+	sum, err := exportChecksum(data)
+	if err != nil {
+		return err
+	}
+	if !strings.EqualFold(sum, data.Manifest.SHA256) {
+		problems = append(problems, "SHA-256 "+sum+" instead of "+data.Manifest.SHA256)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%w: %s", errManifestMismatch, strings.Join(problems, ", "))
+	}
+	return nil
+}
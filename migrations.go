@@ -0,0 +1,762 @@
+package condomngr
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// migrations are applied in order on startup. The index of the last applied
+// migration is tracked in sqlite's user_version pragma, so entries must never
+// be reordered or removed; append new ones at the end.
+var migrations = []string{
+	// 1: per-resident notification channel preference
+	`ALTER TABLE residents ADD COLUMN notify_channel TEXT NOT NULL DEFAULT ''`,
+
+	// 2: queued and sent SMS messages
+	`CREATE TABLE IF NOT EXISTS sms_messages (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		resident_id INTEGER,
+		phone TEXT NOT NULL,
+		body TEXT NOT NULL,
+		status TEXT NOT NULL DEFAULT 'queued',
+		provider_id TEXT NOT NULL DEFAULT '',
+		error TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		sent_at TIMESTAMP,
+		FOREIGN KEY (resident_id) REFERENCES residents (id)
+	)`,
+
+	// 3-6: payment method, status and external reference
+	`ALTER TABLE payments ADD COLUMN method TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE payments ADD COLUMN status TEXT NOT NULL DEFAULT 'confirmed'`,
+	`ALTER TABLE payments ADD COLUMN reference TEXT NOT NULL DEFAULT ''`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS idx_payments_reference ON payments (reference) WHERE reference != ''`,
+
+	// 7-8: charges owed by residents, one per resident and period
+	`CREATE TABLE IF NOT EXISTS charges (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		resident_id INTEGER NOT NULL,
+		period TEXT NOT NULL,
+		description TEXT NOT NULL DEFAULT '',
+		amount REAL NOT NULL,
+		due_date DATE NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (resident_id) REFERENCES residents (id)
+	)`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS idx_charges_resident_period ON charges (resident_id, period)`,
+
+	// 9: announcements
+	`CREATE TABLE IF NOT EXISTS announcements (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		title TEXT NOT NULL,
+		body TEXT NOT NULL DEFAULT '',
+		public INTEGER NOT NULL DEFAULT 1,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	)`,
+
+	// 10: application settings such as generated signing secrets
+	`CREATE TABLE IF NOT EXISTS settings (
+		key TEXT PRIMARY KEY,
+		value TEXT NOT NULL
+	)`,
+
+	// 11: resident portal tokens
+	`CREATE TABLE IF NOT EXISTS portal_tokens (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		resident_id INTEGER NOT NULL,
+		expires_at TIMESTAMP NOT NULL,
+		revoked_at TIMESTAMP,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (resident_id) REFERENCES residents (id)
+	)`,
+
+	// 12-14: the original optional text columns allowed NULL, which the
+	// handlers can't scan into strings. SQLite can't alter a column's
+	// constraints, so backfill and rebuild each table with NOT NULL DEFAULT ''.
+	`CREATE TABLE residents_new (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL,
+		unit TEXT NOT NULL,
+		contact TEXT NOT NULL DEFAULT '',
+		email TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		notify_channel TEXT NOT NULL DEFAULT ''
+	);
+	INSERT INTO residents_new (id, name, unit, contact, email, created_at, updated_at, notify_channel)
+		SELECT id, name, unit, COALESCE(contact, ''), COALESCE(email, ''), created_at, updated_at, notify_channel FROM residents;
+	DROP TABLE residents;
+	ALTER TABLE residents_new RENAME TO residents`,
+	`CREATE TABLE payments_new (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		resident_id INTEGER NOT NULL,
+		amount REAL NOT NULL,
+		description TEXT NOT NULL DEFAULT '',
+		payment_date DATE NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		method TEXT NOT NULL DEFAULT '',
+		status TEXT NOT NULL DEFAULT 'confirmed',
+		reference TEXT NOT NULL DEFAULT '',
+		FOREIGN KEY (resident_id) REFERENCES residents (id)
+	);
+	INSERT INTO payments_new (id, resident_id, amount, description, payment_date, created_at, method, status, reference)
+		SELECT id, resident_id, amount, COALESCE(description, ''), payment_date, created_at, method, status, reference FROM payments;
+	DROP TABLE payments;
+	ALTER TABLE payments_new RENAME TO payments;
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_payments_reference ON payments (reference) WHERE reference != ''`,
+	`CREATE TABLE expenses_new (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		amount REAL NOT NULL,
+		description TEXT NOT NULL DEFAULT '',
+		expense_date DATE NOT NULL,
+		category TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	INSERT INTO expenses_new (id, amount, description, expense_date, category, created_at)
+		SELECT id, amount, COALESCE(description, ''), expense_date, COALESCE(category, ''), created_at FROM expenses;
+	DROP TABLE expenses;
+	ALTER TABLE expenses_new RENAME TO expenses`,
+	// 15: imports used to store exported timestamps as-is; keep just the date
+	`UPDATE payments SET payment_date = substr(payment_date, 1, 10) WHERE length(payment_date) > 10;
+	UPDATE expenses SET expense_date = substr(expense_date, 1, 10) WHERE length(expense_date) > 10`,
+	// 16-17: track edits to payments and expenses like residents do. ALTER
+	// TABLE can't add a column defaulting to CURRENT_TIMESTAMP, so rebuild.
+	`CREATE TABLE payments_new (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		resident_id INTEGER NOT NULL,
+		amount REAL NOT NULL,
+		description TEXT NOT NULL DEFAULT '',
+		payment_date DATE NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		method TEXT NOT NULL DEFAULT '',
+		status TEXT NOT NULL DEFAULT 'confirmed',
+		reference TEXT NOT NULL DEFAULT '',
+		FOREIGN KEY (resident_id) REFERENCES residents (id)
+	);
+	INSERT INTO payments_new (id, resident_id, amount, description, payment_date, created_at, updated_at, method, status, reference)
+		SELECT id, resident_id, amount, description, payment_date, created_at, created_at, method, status, reference FROM payments;
+	DROP TABLE payments;
+	ALTER TABLE payments_new RENAME TO payments;
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_payments_reference ON payments (reference) WHERE reference != ''`,
+	`CREATE TABLE expenses_new (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		amount REAL NOT NULL,
+		description TEXT NOT NULL DEFAULT '',
+		expense_date DATE NOT NULL,
+		category TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	INSERT INTO expenses_new (id, amount, description, expense_date, category, created_at, updated_at)
+		SELECT id, amount, description, expense_date, category, created_at, created_at FROM expenses;
+	DROP TABLE expenses;
+	ALTER TABLE expenses_new RENAME TO expenses`,
+	// 18: accounts for signing in
+	`CREATE TABLE users (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		username TEXT NOT NULL UNIQUE,
+		password_hash TEXT NOT NULL,
+		role TEXT NOT NULL DEFAULT 'viewer',
+		disabled INTEGER NOT NULL DEFAULT 0,
+		must_change_password INTEGER NOT NULL DEFAULT 0,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	)`,
+	// 19: the lists are ordered by name and date and filtered by resident,
+	// date range, category and unit. Searches match anywhere in the text, so
+	// they can't use an index.
+	`CREATE INDEX IF NOT EXISTS idx_payments_resident_date ON payments (resident_id, payment_date);
+	CREATE INDEX IF NOT EXISTS idx_payments_date ON payments (payment_date);
+	CREATE INDEX IF NOT EXISTS idx_expenses_date ON expenses (expense_date);
+	CREATE INDEX IF NOT EXISTS idx_expenses_category_date ON expenses (category, expense_date);
+	CREATE INDEX IF NOT EXISTS idx_residents_name ON residents (name);
+	CREATE INDEX IF NOT EXISTS idx_residents_unit ON residents (unit)`,
+	// 20: deleted residents, payments and expenses, kept as JSON until they
+	// are restored or purged. deleted_by stays empty until the API has
+	// sign-in.
+	`CREATE TABLE deleted_records (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		entity_type TEXT NOT NULL,
+		entity_id INTEGER NOT NULL,
+		snapshot TEXT NOT NULL,
+		deleted_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		deleted_by TEXT NOT NULL DEFAULT ''
+	);
+	CREATE INDEX IF NOT EXISTS idx_deleted_records_deleted_at ON deleted_records (deleted_at);
+	CREATE INDEX IF NOT EXISTS idx_deleted_records_entity ON deleted_records (entity_type, entity_id)`,
+	// 21: statements emailed to residents, one per resident and month
+	`CREATE TABLE statement_sends (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		resident_id INTEGER NOT NULL,
+		month TEXT NOT NULL,
+		email TEXT NOT NULL,
+		sent_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE (resident_id, month),
+		FOREIGN KEY (resident_id) REFERENCES residents (id)
+	)`,
+	// 22: monthly fees per unit or resident over a range of months
+	`CREATE TABLE fee_schedule (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		unit TEXT NOT NULL DEFAULT '',
+		resident_id INTEGER,
+		amount REAL NOT NULL,
+		effective_from TEXT NOT NULL,
+		effective_to TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (resident_id) REFERENCES residents (id)
+	);
+	CREATE INDEX IF NOT EXISTS idx_fee_schedule_unit ON fee_schedule (unit, effective_from);
+	CREATE INDEX IF NOT EXISTS idx_fee_schedule_resident ON fee_schedule (resident_id, effective_from)`,
+	// 23-24: when residents moved in and out, to pro-rate their dues
+	`ALTER TABLE residents ADD COLUMN move_in_date TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE residents ADD COLUMN move_out_date TEXT NOT NULL DEFAULT ''`,
+	// 25: charges other than dues, such as interest, each unique per period
+	`ALTER TABLE charges ADD COLUMN kind TEXT NOT NULL DEFAULT 'dues';
+	DROP INDEX IF EXISTS idx_charges_resident_period;
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_charges_resident_kind_period ON charges (resident_id, kind, period)`,
+	// 26: manual adjustments of residents' balances
+	`CREATE TABLE credits (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		resident_id INTEGER NOT NULL,
+		amount REAL NOT NULL,
+		reason TEXT NOT NULL,
+		credit_date TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (resident_id) REFERENCES residents (id)
+	);
+	CREATE INDEX IF NOT EXISTS idx_credits_resident_date ON credits (resident_id, credit_date)`,
+	// 27: the charges each payment settles
+	`CREATE TABLE payment_allocations (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		resident_id INTEGER NOT NULL,
+		payment_id INTEGER NOT NULL,
+		charge_id INTEGER NOT NULL,
+		amount REAL NOT NULL,
+		manual INTEGER NOT NULL DEFAULT 0,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (payment_id) REFERENCES payments (id),
+		FOREIGN KEY (charge_id) REFERENCES charges (id)
+	);
+	CREATE INDEX IF NOT EXISTS idx_payment_allocations_resident ON payment_allocations (resident_id);
+	CREATE INDEX IF NOT EXISTS idx_payment_allocations_payment ON payment_allocations (payment_id);
+	CREATE INDEX IF NOT EXISTS idx_payment_allocations_charge ON payment_allocations (charge_id)`,
+	// 28: the share of payments set aside for the reserve fund
+	`CREATE TABLE reserve_rules (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		percent REAL NOT NULL,
+		effective_from TEXT NOT NULL UNIQUE,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE TABLE reserve_contributions (
+		payment_id INTEGER PRIMARY KEY,
+		payment_amount REAL NOT NULL,
+		payment_date TEXT NOT NULL,
+		percent REAL NOT NULL,
+		amount REAL NOT NULL,
+		FOREIGN KEY (payment_id) REFERENCES payments (id)
+	);
+	CREATE INDEX IF NOT EXISTS idx_reserve_contributions_date ON reserve_contributions (payment_date)`,
+	// 29: expenses invoiced in another currency
+	`ALTER TABLE expenses ADD COLUMN currency TEXT NOT NULL DEFAULT '';
+	ALTER TABLE expenses ADD COLUMN original_amount REAL NOT NULL DEFAULT 0;
+	ALTER TABLE expenses ADD COLUMN exchange_rate REAL NOT NULL DEFAULT 0`,
+	// 30: bank accounts and the statement lines reconciled against them
+	`CREATE TABLE bank_accounts (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL UNIQUE,
+		iban TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE TABLE bank_lines (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		account_id INTEGER NOT NULL,
+		line_date TEXT NOT NULL,
+		amount REAL NOT NULL,
+		description TEXT NOT NULL DEFAULT '',
+		reference TEXT NOT NULL,
+		status TEXT NOT NULL DEFAULT 'unmatched',
+		entity_type TEXT NOT NULL DEFAULT '',
+		entity_id INTEGER NOT NULL DEFAULT 0,
+		note TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE (account_id, reference),
+		FOREIGN KEY (account_id) REFERENCES bank_accounts (id)
+	);
+	CREATE INDEX IF NOT EXISTS idx_bank_lines_account_date ON bank_lines (account_id, line_date);
+	CREATE INDEX IF NOT EXISTS idx_bank_lines_entity ON bank_lines (entity_type, entity_id);
+	ALTER TABLE payments ADD COLUMN bank_reference TEXT NOT NULL DEFAULT '';
+	ALTER TABLE expenses ADD COLUMN bank_reference TEXT NOT NULL DEFAULT ''`,
+	// 31: cheques and their clearance; earlier cheques were counted as paid
+	`ALTER TABLE payments ADD COLUMN cheque_number TEXT NOT NULL DEFAULT '';
+	ALTER TABLE payments ADD COLUMN cheque_bank TEXT NOT NULL DEFAULT '';
+	ALTER TABLE payments ADD COLUMN cheque_status TEXT NOT NULL DEFAULT '';
+	ALTER TABLE payments ADD COLUMN cheque_status_date TEXT NOT NULL DEFAULT '';
+	UPDATE payments SET cheque_status = 'cleared', cheque_status_date = substr(payment_date, 1, 10) WHERE method = 'check';
+	CREATE INDEX IF NOT EXISTS idx_payments_cheque_status ON payments (cheque_status)`,
+	// 32: recoverable tax included in expenses
+	`ALTER TABLE expenses ADD COLUMN tax_rate REAL NOT NULL DEFAULT 0;
+	ALTER TABLE expenses ADD COLUMN tax_amount REAL NOT NULL DEFAULT 0`,
+
+	// 33: condominiums managed by the instance, each in its own database.
+	// Only read in the database the server starts on, which is condo 1.
+	`CREATE TABLE IF NOT EXISTS condos (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL UNIQUE,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	INSERT INTO condos(id, name) VALUES(1, 'Default')`,
+
+	// 34: custom fields on residents, defined at runtime. Values are stored as
+	// text and read back by the type of their definition.
+	`CREATE TABLE IF NOT EXISTS custom_field_definitions (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		entity TEXT NOT NULL DEFAULT 'resident',
+		key TEXT NOT NULL,
+		label TEXT NOT NULL,
+		type TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE(entity, key)
+	);
+	CREATE TABLE IF NOT EXISTS resident_custom_values (
+		resident_id INTEGER NOT NULL,
+		field_id INTEGER NOT NULL,
+		value TEXT NOT NULL,
+		PRIMARY KEY (resident_id, field_id)
+	);
+	CREATE INDEX IF NOT EXISTS idx_resident_custom_values_field ON resident_custom_values(field_id)`,
+
+	// 35: files attached to payments, expenses and other records. The content
+	// is on disk, named by its SHA-256, so a file attached twice is stored
+	// once.
+	`CREATE TABLE IF NOT EXISTS attachments (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		entity_type TEXT NOT NULL,
+		entity_id INTEGER NOT NULL,
+		sha256 TEXT NOT NULL,
+		filename TEXT NOT NULL,
+		content_type TEXT NOT NULL,
+		size INTEGER NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS idx_attachments_entity ON attachments(entity_type, entity_id);
+	CREATE INDEX IF NOT EXISTS idx_attachments_sha256 ON attachments(sha256)`,
+
+	// 36: changed wording of the emails sent to residents; emails without a
+	// row use the default templates
+	`CREATE TABLE IF NOT EXISTS email_templates (
+		name TEXT PRIMARY KEY,
+		subject TEXT NOT NULL,
+		body TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	)`,
+
+	// 37: notification channel per type; notify_channel stays the reminders
+	// channel. When and by whom they last changed is kept as a record of
+	// opt-outs.
+	`ALTER TABLE residents ADD COLUMN notify_receipts TEXT NOT NULL DEFAULT '';
+	ALTER TABLE residents ADD COLUMN notify_announcements TEXT NOT NULL DEFAULT '';
+	ALTER TABLE residents ADD COLUMN notify_statements TEXT NOT NULL DEFAULT '';
+	ALTER TABLE residents ADD COLUMN notifications_updated_at TIMESTAMP;
+	ALTER TABLE residents ADD COLUMN notifications_updated_by TEXT NOT NULL DEFAULT ''`,
+
+	// 38: scheduled backups and the status of their upload to the off-site
+	// target. A snapshot doesn't contain its own row.
+	`CREATE TABLE IF NOT EXISTS backups (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		filename TEXT NOT NULL UNIQUE,
+		size INTEGER NOT NULL,
+		sha256 TEXT NOT NULL,
+		remote_status TEXT NOT NULL DEFAULT 'none',
+		remote_url TEXT NOT NULL DEFAULT '',
+		remote_error TEXT NOT NULL DEFAULT '',
+		upload_attempts INTEGER NOT NULL DEFAULT 0,
+		uploaded_at TIMESTAMP,
+		created_at TIMESTAMP NOT NULL
+	)`,
+
+	// 39: sign-in sessions, stored by the hash of their token, and failed
+	// sign-ins per username and client IP for slowing down and locking out
+	// password guessing
+	`CREATE TABLE IF NOT EXISTS sessions (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		token_hash TEXT NOT NULL UNIQUE,
+		ip TEXT NOT NULL DEFAULT '',
+		user_agent TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		expires_at TIMESTAMP NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS idx_sessions_user ON sessions (user_id);
+	CREATE TABLE IF NOT EXISTS login_failures (
+		kind TEXT NOT NULL,
+		value TEXT NOT NULL,
+		failures INTEGER NOT NULL,
+		last_failure_at TIMESTAMP NOT NULL,
+		locked_until TIMESTAMP,
+		PRIMARY KEY (kind, value)
+	)`,
+	// 40: when sessions were last used, to tell them apart when revoking one
+	`ALTER TABLE sessions ADD COLUMN last_seen_at TIMESTAMP;
+	UPDATE sessions SET last_seen_at = created_at`,
+	// 41: two-factor authentication with TOTP. The secret is set when
+	// enrollment starts and only asked for once totp_enabled; totp_last_step
+	// keeps a code from being used twice. Challenges are sign-ins waiting for
+	// their code.
+	`ALTER TABLE users ADD COLUMN totp_secret TEXT NOT NULL DEFAULT '';
+	ALTER TABLE users ADD COLUMN totp_enabled INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE users ADD COLUMN totp_last_step INTEGER NOT NULL DEFAULT 0;
+	CREATE TABLE IF NOT EXISTS recovery_codes (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		code_hash TEXT NOT NULL,
+		used_at TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS idx_recovery_codes_user ON recovery_codes (user_id);
+	CREATE TABLE IF NOT EXISTS login_challenges (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		token_hash TEXT NOT NULL UNIQUE,
+		ip TEXT NOT NULL DEFAULT '',
+		expires_at TIMESTAMP NOT NULL
+	)`,
+	// 42: email addresses of users, the password reset links sent to them,
+	// stored by the hash of their token, and the audit log of sensitive actions
+	`ALTER TABLE users ADD COLUMN email TEXT NOT NULL DEFAULT '';
+	CREATE TABLE IF NOT EXISTS password_resets (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		token_hash TEXT NOT NULL UNIQUE,
+		created_at TIMESTAMP NOT NULL,
+		expires_at TIMESTAMP NOT NULL,
+		used_at TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS idx_password_resets_user ON password_resets (user_id);
+	CREATE TABLE IF NOT EXISTS audit_log (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		at TIMESTAMP NOT NULL,
+		action TEXT NOT NULL,
+		actor TEXT NOT NULL DEFAULT '',
+		ip TEXT NOT NULL DEFAULT '',
+		subject TEXT NOT NULL DEFAULT '',
+		detail TEXT NOT NULL DEFAULT ''
+	);
+	CREATE INDEX IF NOT EXISTS idx_audit_log_action ON audit_log (action)`,
+	// 43: installment plans agreed with residents in arrears; their schedule
+	// and status are derived
+	`CREATE TABLE IF NOT EXISTS payment_plans (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		resident_id INTEGER NOT NULL,
+		total_amount REAL NOT NULL,
+		installments INTEGER NOT NULL,
+		installment_amount REAL NOT NULL,
+		start_month TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (resident_id) REFERENCES residents (id)
+	);
+	CREATE INDEX IF NOT EXISTS idx_payment_plans_resident ON payment_plans (resident_id)`,
+	// 44: debts written off by decision of the assembly; reversing one keeps
+	// the row
+	`CREATE TABLE IF NOT EXISTS write_offs (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		resident_id INTEGER NOT NULL,
+		amount REAL NOT NULL,
+		reason TEXT NOT NULL,
+		decision TEXT NOT NULL,
+		writeoff_date TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		reversed_at TIMESTAMP,
+		FOREIGN KEY (resident_id) REFERENCES residents (id)
+	);
+	CREATE INDEX IF NOT EXISTS idx_write_offs_resident ON write_offs (resident_id, writeoff_date)`,
+	// 45: budgets per expense category and fiscal year; month is empty for
+	// the annual amount, or the YYYY-MM of a month budgeted on its own
+	`CREATE TABLE IF NOT EXISTS budgets (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		year INTEGER NOT NULL,
+		category TEXT NOT NULL,
+		month TEXT NOT NULL DEFAULT '',
+		amount REAL NOT NULL,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE (year, category, month)
+	)`,
+	// 46: one-off assessments split between the units; their charges point
+	// back to them
+	`CREATE TABLE IF NOT EXISTS assessments (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL,
+		total_amount REAL NOT NULL,
+		allocation TEXT NOT NULL,
+		due_date TEXT NOT NULL,
+		installments INTEGER NOT NULL DEFAULT 1,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE TABLE IF NOT EXISTS assessment_shares (
+		assessment_id INTEGER NOT NULL,
+		unit TEXT NOT NULL,
+		amount REAL NOT NULL,
+		PRIMARY KEY (assessment_id, unit),
+		FOREIGN KEY (assessment_id) REFERENCES assessments (id)
+	);
+	ALTER TABLE charges ADD COLUMN assessment_id INTEGER;
+	CREATE INDEX IF NOT EXISTS idx_charges_assessment ON charges (assessment_id)`,
+	// 47: the ownership fraction of each unit, in permilage
+	`CREATE TABLE IF NOT EXISTS unit_fractions (
+		unit TEXT PRIMARY KEY,
+		permilage REAL NOT NULL,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	)`,
+	// 48: the share of each unit in an expense split by ownership fraction,
+	// charged with the dues of charge_month
+	`CREATE TABLE IF NOT EXISTS expense_allocations (
+		expense_id INTEGER NOT NULL,
+		unit TEXT NOT NULL,
+		permilage REAL NOT NULL,
+		amount REAL NOT NULL,
+		charge_month TEXT NOT NULL,
+		allocated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (expense_id, unit),
+		FOREIGN KEY (expense_id) REFERENCES expenses (id)
+	);
+	CREATE INDEX IF NOT EXISTS idx_expense_allocations_month ON expense_allocations (charge_month, unit)`,
+	// 49: unit ownership transfers, with the balance each previous owner
+	// owed and how much of it was carried over to the new owner
+	`CREATE TABLE IF NOT EXISTS unit_transfers (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		unit TEXT NOT NULL,
+		transfer_date TEXT NOT NULL,
+		new_owner_id INTEGER NOT NULL,
+		balance TEXT NOT NULL,
+		notes TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (new_owner_id) REFERENCES residents (id)
+	);
+	CREATE INDEX IF NOT EXISTS idx_unit_transfers_unit ON unit_transfers (unit, transfer_date);
+	CREATE TABLE IF NOT EXISTS unit_transfer_owners (
+		transfer_id INTEGER NOT NULL,
+		resident_id INTEGER NOT NULL,
+		balance REAL NOT NULL,
+		carried REAL NOT NULL,
+		PRIMARY KEY (transfer_id, resident_id),
+		FOREIGN KEY (transfer_id) REFERENCES unit_transfers (id),
+		FOREIGN KEY (resident_id) REFERENCES residents (id)
+	)`,
+	// 50: documents that run out, the expiries let lapse and the expiry
+	// reminders sent, once per item, lead time and expiry date
+	`CREATE TABLE IF NOT EXISTS documents (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		kind TEXT NOT NULL,
+		name TEXT NOT NULL,
+		expires_on TEXT NOT NULL,
+		notes TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE TABLE IF NOT EXISTS expiry_suppressions (
+		item TEXT PRIMARY KEY,
+		reason TEXT NOT NULL DEFAULT '',
+		suppressed_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE TABLE IF NOT EXISTS expiry_reminders (
+		item TEXT NOT NULL,
+		lead_days INTEGER NOT NULL,
+		expires_on TEXT NOT NULL,
+		sent_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (item, lead_days, expires_on)
+	)`,
+	// 51: incidents in the common areas and the expenses they caused
+	`CREATE TABLE IF NOT EXISTS incidents (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		incident_date TEXT NOT NULL,
+		location TEXT NOT NULL,
+		description TEXT NOT NULL,
+		severity TEXT NOT NULL,
+		reported_by INTEGER,
+		status TEXT NOT NULL,
+		resolved_on TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (reported_by) REFERENCES residents (id)
+	);
+	CREATE INDEX IF NOT EXISTS idx_incidents_date ON incidents (incident_date);
+	CREATE TABLE IF NOT EXISTS incident_expenses (
+		incident_id INTEGER NOT NULL,
+		expense_id INTEGER NOT NULL,
+		PRIMARY KEY (incident_id, expense_id),
+		FOREIGN KEY (incident_id) REFERENCES incidents (id),
+		FOREIGN KEY (expense_id) REFERENCES expenses (id)
+	)`,
+	// 52: action items, optionally linked to the record they came from.
+	// overdue_reminded_on is the due date the overdue reminder was sent for.
+	`CREATE TABLE IF NOT EXISTS tasks (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		title TEXT NOT NULL,
+		description TEXT NOT NULL DEFAULT '',
+		assignee_user_id INTEGER,
+		assignee TEXT NOT NULL DEFAULT '',
+		due_date TEXT NOT NULL DEFAULT '',
+		status TEXT NOT NULL,
+		completed_on TEXT NOT NULL DEFAULT '',
+		entity_type TEXT NOT NULL DEFAULT '',
+		entity_id INTEGER,
+		overdue_reminded_on TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (assignee_user_id) REFERENCES users (id)
+	);
+	CREATE INDEX IF NOT EXISTS idx_tasks_status_due ON tasks (status, due_date)`,
+	// 53: maintenance requests, entered by hand or emailed in. Emails are
+	// taken once per Message-ID.
+	`CREATE TABLE IF NOT EXISTS maintenance_requests (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		resident_id INTEGER,
+		sender TEXT NOT NULL DEFAULT '',
+		subject TEXT NOT NULL,
+		description TEXT NOT NULL DEFAULT '',
+		status TEXT NOT NULL,
+		message_id TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (resident_id) REFERENCES residents (id)
+	);
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_maintenance_requests_message_id ON maintenance_requests (message_id) WHERE message_id != ''`,
+	// 54: payment requests, one per resident and month, and the request whose
+	// reference a statement line carries
+	`CREATE TABLE IF NOT EXISTS payment_requests (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		resident_id INTEGER NOT NULL,
+		period TEXT NOT NULL,
+		reference TEXT NOT NULL UNIQUE,
+		amount REAL NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE (resident_id, period),
+		FOREIGN KEY (resident_id) REFERENCES residents (id)
+	);
+	ALTER TABLE bank_lines ADD COLUMN payment_request_id INTEGER NOT NULL DEFAULT 0`,
+
+	// 55: receipts queued for and emailed to residents. There is no foreign
+	// key to payments, so the log outlives payments moved to the trash.
+	`CREATE TABLE receipt_emails (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		payment_id INTEGER NOT NULL,
+		resident_id INTEGER NOT NULL,
+		email TEXT NOT NULL DEFAULT '',
+		status TEXT NOT NULL DEFAULT 'queued',
+		reason TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		sent_at TIMESTAMP
+	);
+	CREATE INDEX idx_receipt_emails_payment ON receipt_emails (payment_id);
+	CREATE INDEX idx_receipt_emails_status ON receipt_emails (status)`,
+
+	// 56: searches users saved under a name, with their query parameters
+	// encoded as a query string
+	`CREATE TABLE saved_searches (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		name TEXT NOT NULL,
+		entity TEXT NOT NULL,
+		params TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE (user_id, name),
+		FOREIGN KEY (user_id) REFERENCES users (id)
+	)`,
+
+	// 57: reports emailed on a schedule, and the log of their runs. Times are
+	// in UTC; the schedules are worked out in the condominium's timezone.
+	`CREATE TABLE report_schedules (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL UNIQUE,
+		report TEXT NOT NULL,
+		params TEXT NOT NULL DEFAULT '',
+		period TEXT NOT NULL DEFAULT '',
+		format TEXT NOT NULL DEFAULT 'csv',
+		cron TEXT NOT NULL DEFAULT '',
+		day_of_month INTEGER NOT NULL DEFAULT 0,
+		time_of_day TEXT NOT NULL DEFAULT '',
+		recipients TEXT NOT NULL DEFAULT '',
+		paused INTEGER NOT NULL DEFAULT 0,
+		next_run_at TIMESTAMP,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE TABLE report_runs (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		schedule_id INTEGER NOT NULL,
+		trigger TEXT NOT NULL,
+		status TEXT NOT NULL,
+		error TEXT NOT NULL DEFAULT '',
+		filename TEXT NOT NULL DEFAULT '',
+		sent_to TEXT NOT NULL DEFAULT '',
+		due_at TIMESTAMP,
+		started_at TIMESTAMP NOT NULL,
+		finished_at TIMESTAMP NOT NULL,
+		FOREIGN KEY (schedule_id) REFERENCES report_schedules (id)
+	);
+	CREATE INDEX idx_report_runs_schedule ON report_runs (schedule_id)`,
+
+	// 58: when a resident's personal data was erased, keeping their financial
+	// records under a placeholder name
+	`ALTER TABLE residents ADD COLUMN anonymized_at TIMESTAMP`,
+
+	// 59: payment descriptions suggested for autocomplete are grouped from
+	// this index alone; expense categories already have theirs
+	`CREATE INDEX IF NOT EXISTS idx_payments_description_date ON payments (description, payment_date)`,
+
+	// 60: who an expense was paid to, and free-form tags to find expenses
+	// across categories
+	`ALTER TABLE expenses ADD COLUMN vendor TEXT NOT NULL DEFAULT '';
+	CREATE TABLE IF NOT EXISTS expense_tags (
+		expense_id INTEGER NOT NULL,
+		tag TEXT NOT NULL,
+		PRIMARY KEY (expense_id, tag),
+		FOREIGN KEY (expense_id) REFERENCES expenses (id)
+	);
+	CREATE INDEX IF NOT EXISTS idx_expense_tags_tag ON expense_tags (tag)`,
+
+	// 61: the condos other than the default one each user may reach; admins
+	// reach them all. Only read in the default condo's database, like condos.
+	`CREATE TABLE IF NOT EXISTS condo_grants (
+		user_id INTEGER NOT NULL,
+		condo_id INTEGER NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (user_id, condo_id),
+		FOREIGN KEY (user_id) REFERENCES users (id),
+		FOREIGN KEY (condo_id) REFERENCES condos (id)
+	)`,
+}
+
+func migrate(db *sql.DB) error {
+	var version int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+
+	for i := version; i < len(migrations); i++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(migrations[i]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %v", i+1, err)
+		}
+		// PRAGMA does not support placeholders
+		if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", i+1)); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %v", i+1, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("migration %d: %v", i+1, err)
+		}
+	}
+
+	return nil
+}
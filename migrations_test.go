@@ -0,0 +1,71 @@
+package condomngr
+
+import (
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestNullColumnsFromOldDatabases opens a database from before migrations
+// 12-14, whose optional text columns still allow NULL, with NULLs written
+// straight to it, and checks every list endpoint works on it
+func TestNullColumnsFromOldDatabases(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "condo.db")
+	old, err := openSQLite(file, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := createTables(old); err != nil {
+		t.Fatal(err)
+	}
+	for i, migration := range migrations[:11] {
+		if _, err := old.Exec(migration); err != nil {
+			t.Fatalf("migration %d: %v", i+1, err)
+		}
+	}
+	for _, query := range []string{
+		"PRAGMA user_version = 11",
+		"INSERT INTO residents(name, unit, contact, email) VALUES('Ana Silva', '1A', NULL, NULL)",
+		"INSERT INTO payments(resident_id, amount, description, payment_date) VALUES(1, 50, NULL, '2024-03-05')",
+		"INSERT INTO expenses(amount, description, expense_date, category) VALUES(10, NULL, '2024-03-06', NULL)",
+	} {
+		if _, err := old.Exec(query); err != nil {
+			t.Fatalf("%s: %v", query, err)
+		}
+	}
+	old.Close()
+
+	db, err := OpenDB(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	s := serveTestDB(t, db, Options{})
+	s.token = s.signIn("admin", RoleAdmin)
+
+	var residents []Resident
+	s.expect(http.StatusOK, "GET", "/api/v1/residents", nil, &residents)
+	if len(residents) != 1 || residents[0].Contact != "" || residents[0].Email != "" {
+		t.Errorf("residents %+v", residents)
+	}
+	var payments []Payment
+	s.expect(http.StatusOK, "GET", "/api/v1/payments", nil, &payments)
+	if len(payments) != 1 || payments[0].Description != "" {
+		t.Errorf("payments %+v", payments)
+	}
+	var expenses []Expense
+	s.expect(http.StatusOK, "GET", "/api/v1/expenses", nil, &expenses)
+	if len(expenses) != 1 || expenses[0].Category != "" {
+		t.Errorf("expenses %+v", expenses)
+	}
+
+	for _, op := range apiOperations {
+		if op.Method != "GET" || strings.Contains(op.Path, "{") || op.ContentType == "text/event-stream" {
+			continue
+		}
+		if resp := s.do("GET", "/api/v1"+op.Path, nil, nil); resp.StatusCode >= 500 {
+			t.Errorf("GET %s: %d", op.Path, resp.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package condomngr
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Export formats
+const (
+	ExportFormatJSON   = "json"   // a single ExportData object
+	ExportFormatNDJSON = "ndjson" // one typed record per line
+)
+
+// Record types of an NDJSON export. The first line is the export record,
+// holding the export date and filter, and the last the manifest record. The
+// lines between are the residents, payments, expenses and custom fields, each
+// with the members it has in a JSON export and a "type" member. Custom
+// fields have a type of their own, so they are nested under "field".
+const (
+	NDJSONExport      = "export"
+	NDJSONResident    = "resident"
+	NDJSONPayment     = "payment"
+	NDJSONExpense     = "expense"
+	NDJSONCustomField = "custom_field"
+	NDJSONManifest    = "manifest"
+)
+
+// validExportFormat reports whether format is one of the export formats
+func validExportFormat(format string) bool {
+	return format == ExportFormatJSON || format == ExportFormatNDJSON
+}
+
+// importFormat guesses the format of an export file from its name
+func importFormat(filename string) string {
+	if strings.HasSuffix(filename, ".ndjson") || strings.HasSuffix(filename, ".jsonl") {
+		return ExportFormatNDJSON
+	}
+	return ExportFormatJSON
+}
+
+// ndjsonLine returns the line of a record given as its JSON object
+func ndjsonLine(recordType string, object []byte) []byte {
+	line := fmt.Appendf(nil, `{"type":%q`, recordType)
+	switch {
+	case recordType == NDJSONCustomField:
+		line = append(append(append(line, `,"field":`...), object...), '}')
+	case len(object) > 2:
+		line = append(append(line, ','), object[1:]...)
+	default:
+		line = append(line, '}')
+	}
+	return append(line, '\n')
+}
+
+// writeNDJSONLine writes v as a record line of recordType
+func writeNDJSONLine(w io.Writer, recordType string, v interface{}) error {
+	object, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(ndjsonLine(recordType, object))
+	return err
+}
+
+// writeNDJSONRecords writes rows as record lines of recordType, one at a time,
+// and to array as the JSON array writeJSONArray would write, for the
+// checksum. It closes rows and returns the number of records written.
+func writeNDJSONRecords(w, array io.Writer, recordType string, rows *sql.Rows, scan rowScanner) (int, error) {
+	defer rows.Close()
+
+	if _, err := io.WriteString(array, "["); err != nil {
+		return 0, err
+	}
+	n := 0
+	for rows.Next() {
+		item, err := scan(rows)
+		if err != nil {
+			return n, err
+		}
+		b, err := json.Marshal(item)
+		if err != nil {
+			return n, err
+		}
+		if n > 0 {
+			io.WriteString(array, ",")
+		}
+		array.Write(b)
+		if _, err := w.Write(ndjsonLine(recordType, b)); err != nil {
+			return n, err
+		}
+		n++
+		if f, ok := w.(http.Flusher); ok && n%streamFlushEvery == 0 {
+			f.Flush()
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return n, err
+	}
+	_, err := io.WriteString(array, "]")
+	return n, err
+}
+
+// ndjsonHeader is the export record of an NDJSON export
+type ndjsonHeader struct {
+	ExportDate string        `json:"export_date"`
+	Filter     *ExportFilter `json:"filter,omitempty"`
+}
+
+// decodeNDJSON reads an NDJSON export line by line. Records are decoded as
+// strictly as a JSON export, and errors name the line. The records remember
+// their lines, so validation errors name them too. A file without a manifest
+// record doesn't match its manifest, as NDJSON exports always end with one.
+func decodeNDJSON(r io.Reader, lax bool) (ExportData, error) {
+	data := ExportData{lines: make(map[string][]int)}
+	reader := bufio.NewReader(r)
+	for line := 1; ; line++ {
+		text, readErr := reader.ReadBytes('\n')
+		if readErr != nil && readErr != io.EOF {
+			return data, readErr
+		}
+		if len(bytes.TrimSpace(text)) > 0 {
+			if data.Manifest != nil {
+				return data, fmt.Errorf("line %d: record after the manifest", line)
+			}
+			if err := data.decodeRecord(line, text, lax); err != nil {
+				return data, fmt.Errorf("line %d: %v", line, err)
+			}
+		}
+		if readErr == io.EOF {
+			break
+		}
+	}
+	return data, nil
+}
+
+// decodeRecord adds the record of a line of an NDJSON export
+func (d *ExportData) decodeRecord(line int, text []byte, lax bool) error {
+	var record struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(text, &record); err != nil {
+		return describeJSONError(err)
+	}
+	switch record.Type {
+	case NDJSONExport:
+		var header struct {
+			Type string `json:"type"`
+			ndjsonHeader
+		}
+		if err := decodeJSONBytes(text, &header, lax); err != nil {
+			return err
+		}
+		d.ExportDate, d.Filter = header.ExportDate, header.Filter
+	case NDJSONResident:
+		var resident struct {
+			Type string `json:"type"`
+			Resident
+		}
+		if err := decodeJSONBytes(text, &resident, lax); err != nil {
+			return err
+		}
+		d.Residents = append(d.Residents, resident.Resident)
+		d.lines["residents"] = append(d.lines["residents"], line)
+	case NDJSONPayment:
+		var payment struct {
+			Type string `json:"type"`
+			Payment
+		}
+		if err := decodeJSONBytes(text, &payment, lax); err != nil {
+			return err
+		}
+		d.Payments = append(d.Payments, payment.Payment)
+		d.lines["payments"] = append(d.lines["payments"], line)
+	case NDJSONExpense:
+		var expense struct {
+			Type string `json:"type"`
+			Expense
+		}
+		if err := decodeJSONBytes(text, &expense, lax); err != nil {
+			return err
+		}
+		d.Expenses = append(d.Expenses, expense.Expense)
+		d.lines["expenses"] = append(d.lines["expenses"], line)
+	case NDJSONCustomField:
+		var field struct {
+			Type  string      `json:"type"`
+			Field CustomField `json:"field"`
+		}
+		if err := decodeJSONBytes(text, &field, lax); err != nil {
+			return err
+		}
+		d.CustomFields = append(d.CustomFields, field.Field)
+		d.lines["custom_fields"] = append(d.lines["custom_fields"], line)
+	case NDJSONManifest:
+		var manifest struct {
+			Type string `json:"type"`
+			ExportManifest
+		}
+		if err := decodeJSONBytes(text, &manifest, lax); err != nil {
+			return err
+		}
+		d.Manifest = &manifest.ExportManifest
+	default:
+		return fmt.Errorf("unknown record type %q, must be export, resident, payment, expense, custom_field or manifest", record.Type)
+	}
+	return nil
+}
+
+// decodeExport reads an export in format, ignoring unknown fields if lax
+func decodeExport(r io.Reader, format string, lax bool) (ExportData, error) {
+	if format == ExportFormatNDJSON {
+		return decodeNDJSON(r, lax)
+	}
+	var data ExportData
+	err := decodeJSON(r, &data, lax)
+	return data, err
+}
@@ -0,0 +1,86 @@
+package condomngr
+
+import (
+	"context"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// export gets an export of the whole database in format and decodes it
+func (s *testServer) export(format string) ExportData {
+	s.t.Helper()
+	req, err := http.NewRequest("GET", s.URL+"/api/v1/export?format="+format, nil)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	if s.token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	}
+	resp, err := s.Client().Do(req)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		s.t.Fatalf("%s export: status %d", format, resp.StatusCode)
+	}
+	data, err := decodeExport(resp.Body, format, false)
+	if err != nil {
+		s.t.Fatalf("decoding the %s export: %v", format, err)
+	}
+	if err := verifyManifest(data); err != nil {
+		s.t.Errorf("%s export: %v", format, err)
+	}
+	data.lines = nil
+	return data
+}
+
+func TestNDJSONExportMatchesJSON(t *testing.T) {
+	s := newTestServer(t, Options{})
+	s.expect(http.StatusCreated, "POST", "/api/v1/custom-fields", map[string]interface{}{"entity": "resident", "key": "parking", "label": "Parking", "type": "text"}, nil)
+	var ana Resident
+	s.expect(http.StatusCreated, "POST", "/api/v1/residents", map[string]interface{}{"name": "Ana Silva", "unit": "1A", "email": "ana@example.com", "custom": map[string]interface{}{"parking": "P3"}}, &ana)
+	rui := s.createResident("Rui Conceição", "2B")
+	for _, p := range []map[string]interface{}{
+		{"resident_id": ana.ID, "amount": 50.25, "description": "Dues\nMarch", "payment_date": "2024-03-05"},
+		{"resident_id": rui.ID, "amount": 120, "description": `Quota "extra" – €`, "payment_date": "2024-03-20", "method": "check", "cheque_number": "0042", "cheque_status": "cleared", "cheque_status_date": "2024-03-22"},
+	} {
+		s.expect(http.StatusCreated, "POST", "/api/v1/payments", p, nil)
+	}
+	s.expect(http.StatusCreated, "POST", "/api/v1/expenses", map[string]interface{}{"amount": 99.99, "description": "Elevator", "expense_date": "2024-03-10", "category": "Maintenance", "tax_rate": 23}, nil)
+
+	exported := s.export(ExportFormatJSON)
+	if len(exported.Residents) != 2 || len(exported.Payments) != 2 || len(exported.Expenses) != 1 || len(exported.CustomFields) != 1 {
+		t.Fatalf("JSON export %+v", exported)
+	}
+	if ndjson := s.export(ExportFormatNDJSON); !reflect.DeepEqual(ndjson, exported) {
+		t.Errorf("NDJSON export\n%+v\nJSON export\n%+v", ndjson, exported)
+	}
+
+	// Importing the NDJSON export into an empty database gives it back
+	db, err := OpenDB(filepath.Join(t.TempDir(), "copy.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	ndjson := s.export(ExportFormatNDJSON)
+	if err := importAllContext(context.Background(), db, ndjson, ImportModeReplace, paymentRules{allocation: AllocationFIFO}, func(int) {}); err != nil {
+		t.Fatal(err)
+	}
+	copied := serveTestDB(t, db, Options{}).export(ExportFormatJSON)
+	for _, section := range []struct {
+		name      string
+		got, want interface{}
+	}{
+		{"residents", copied.Residents, exported.Residents},
+		{"payments", copied.Payments, exported.Payments},
+		{"expenses", copied.Expenses, exported.Expenses},
+		{"custom fields", copied.CustomFields, exported.CustomFields},
+	} {
+		if !reflect.DeepEqual(section.got, section.want) {
+			t.Errorf("imported %s\n%+v\nwant\n%+v", section.name, section.got, section.want)
+		}
+	}
+}
@@ -0,0 +1,343 @@
+package condomngr
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Notification types a resident can choose a channel for, and "all" of them
+// at once in unsubscribe links
+const (
+	NotifyReceipts      = "receipts"
+	NotifyReminders     = "reminders"
+	NotifyAnnouncements = "announcements"
+	NotifyStatements    = "statements"
+	NotifyAll           = "all"
+)
+
+// Who last changed a resident's notification preferences
+const (
+	NotificationsByAdmin       = "admin"
+	NotificationsByUnsubscribe = "unsubscribe link"
+)
+
+// NotificationPreferences is the channel a resident is reached through for
+// each type of notification: "" (automatic), "email", "sms" or "none".
+// Receipts and statements are only emailed. Reminders is the resident's
+// notify_channel.
+type NotificationPreferences struct {
+	Receipts      string `json:"receipts"`
+	Reminders     string `json:"reminders"`
+	Announcements string `json:"announcements"`
+	Statements    string `json:"statements"`
+}
+
+// ResidentNotifications is a resident's notification preferences and when
+// and by whom they last changed. UpdatedAt is null while they are as set when
+// the resident was added.
+type ResidentNotifications struct {
+	ResidentID int `json:"resident_id"`
+	NotificationPreferences
+	UpdatedAt *time.Time `json:"updated_at"`
+	UpdatedBy string     `json:"updated_by"`
+}
+
+// validateNotificationPreferences adds an error for each channel that isn't
+// one of the type's
+func validateNotificationPreferences(errs *ValidationErrors, p NotificationPreferences) {
+	for _, c := range []struct{ field, channel string }{{"receipts", p.Receipts}, {"statements", p.Statements}} {
+		switch c.channel {
+		case "", "email", "none":
+		default:
+			errs.Add("notifications."+c.field, c.field+" must be email or none")
+		}
+	}
+	for _, c := range []struct{ field, channel string }{{"reminders", p.Reminders}, {"announcements", p.Announcements}} {
+		switch c.channel {
+		case "", "email", "sms", "none":
+		default:
+			errs.Add("notifications."+c.field, c.field+" must be one of email, sms or none")
+		}
+	}
+}
+
+// notificationPreferences returns the preferences a resident was sent with,
+// the reminders channel taken from notify_channel when only that is set
+func (r Resident) notificationPreferences() NotificationPreferences {
+	var p NotificationPreferences
+	if r.Notifications != nil {
+		p = *r.Notifications
+	}
+	if p.Reminders == "" {
+		p.Reminders = r.NotifyChannel
+	}
+	return p
+}
+
+// residentNotifications returns the stored preferences of a resident
+func residentNotifications(q querier, residentID int) (ResidentNotifications, error) {
+	n := ResidentNotifications{ResidentID: residentID}
+	var updatedAt sql.NullTime
+	err := q.QueryRow(`
+		SELECT notify_receipts, notify_channel, notify_announcements, notify_statements, notifications_updated_at, notifications_updated_by
+		FROM residents WHERE id = ?
+	`, residentID).Scan(&n.Receipts, &n.Reminders, &n.Announcements, &n.Statements, &updatedAt, &n.UpdatedBy)
+	if updatedAt.Valid {
+		n.UpdatedAt = &updatedAt.Time
+	}
+	return n, err
+}
+
+// setNotificationPreferences stores a resident's preferences, recording when
+// and by whom they changed if they did. It returns sql.ErrNoRows if there is
+// no such resident.
+func setNotificationPreferences(q querier, residentID int, p NotificationPreferences, by string) error {
+	result, err := q.Exec(`
+		UPDATE residents SET
+			notifications_updated_at = CASE WHEN `+notificationsChanged+` THEN CURRENT_TIMESTAMP ELSE notifications_updated_at END,
+			notifications_updated_by = CASE WHEN `+notificationsChanged+` THEN ?6 ELSE notifications_updated_by END,
+			notify_receipts = ?2, notify_channel = ?3, notify_announcements = ?4, notify_statements = ?5
+		WHERE id = ?1
+	`, residentID, p.Receipts, p.Reminders, p.Announcements, p.Statements, by)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// notificationsChanged compares the stored preferences with the new ones of
+// setNotificationPreferences. SET expressions see the row as it was before
+// the update, whatever their order.
+const notificationsChanged = "(notify_receipts != ?2 OR notify_channel != ?3 OR notify_announcements != ?4 OR notify_statements != ?5)"
+
+// Unsubscribe signs and verifies the links that let a resident stop a type of
+// notification without logging in. A link is "<resident id>.<type>.<signature>";
+// it doesn't expire, so an old email can still be used to opt out.
+type Unsubscribe struct {
+	secret []byte
+	apiURL string
+}
+
+// NewUnsubscribe creates links to the API at apiURL, see condoAPIURL, signed
+// with secret
+func NewUnsubscribe(secret []byte, apiURL string) *Unsubscribe {
+	return &Unsubscribe{secret: secret, apiURL: strings.TrimRight(apiURL, "/")}
+}
+
+func (u *Unsubscribe) signature(payload string) string {
+	mac := hmac.New(sha256.New, u.secret)
+	mac.Write([]byte("unsubscribe:" + payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// URL returns the link that stops notifications of kind for a resident
+func (u *Unsubscribe) URL(residentID int, kind string) string {
+	payload := fmt.Sprintf("%d.%s", residentID, kind)
+	return u.apiURL + "/unsubscribe?token=" + url.QueryEscape(payload+"."+u.signature(payload))
+}
+
+// parse verifies a token's signature and returns its resident id and type
+func (u *Unsubscribe) parse(token string) (int, string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return 0, "", fmt.Errorf("malformed token")
+	}
+	payload := parts[0] + "." + parts[1]
+	if !hmac.Equal([]byte(parts[2]), []byte(u.signature(payload))) {
+		return 0, "", fmt.Errorf("invalid token")
+	}
+	residentID, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, "", fmt.Errorf("malformed token")
+	}
+	switch parts[1] {
+	case NotifyReceipts, NotifyReminders, NotifyAnnouncements, NotifyStatements, NotifyAll:
+	default:
+		return 0, "", fmt.Errorf("malformed token")
+	}
+	return residentID, parts[1], nil
+}
+
+// Get a resident's notification preferences
+func getResidentNotifications(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id, err := strconv.Atoi(vars["id"])
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid resident ID")
+			return
+		}
+
+		n, err := residentNotifications(db, id)
+		if err == sql.ErrNoRows {
+			respondWithError(w, http.StatusNotFound, "Resident not found")
+			return
+		}
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		respondWithJSON(w, http.StatusOK, n)
+	}
+}
+
+// Replace a resident's notification preferences
+func updateResidentNotifications(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id, err := strconv.Atoi(vars["id"])
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid resident ID")
+			return
+		}
+
+		var p NotificationPreferences
+		if err := decodeRequest(r, &p); err != nil {
+			respondWithError(w, payloadErrorStatus(err), "Invalid request payload: "+err.Error())
+			return
+		}
+		defer r.Body.Close()
+
+		var errs ValidationErrors
+		validateNotificationPreferences(&errs, p)
+		if err := errs.Err(); err != nil {
+			respondWithValidationError(w, err)
+			return
+		}
+
+		err = setNotificationPreferences(db, id, p, NotificationsByAdmin)
+		if err == sql.ErrNoRows {
+			respondWithError(w, http.StatusNotFound, "Resident not found")
+			return
+		}
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		n, err := residentNotifications(db, id)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		respondWithJSON(w, http.StatusOK, n)
+	}
+}
+
+// Stop a type of notification, or all of them, for the resident of a signed
+// unsubscribe link. Opening the link is enough, and mail clients can POST to
+// it for one-click unsubscribing (RFC 8058); either way no login is needed.
+func unsubscribe(db *sql.DB, u *Unsubscribe) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, kind, err := u.parse(r.URL.Query().Get("token"))
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Invalid unsubscribe link: %v", err))
+			return
+		}
+
+		n, err := residentNotifications(db, id)
+		if err == sql.ErrNoRows {
+			respondWithError(w, http.StatusNotFound, "Resident not found")
+			return
+		}
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		p := n.NotificationPreferences
+		for _, c := range []struct {
+			kind    string
+			channel *string
+		}{{NotifyReceipts, &p.Receipts}, {NotifyReminders, &p.Reminders}, {NotifyAnnouncements, &p.Announcements}, {NotifyStatements, &p.Statements}} {
+			if kind == NotifyAll || kind == c.kind {
+				*c.channel = "none"
+			}
+		}
+		if err := setNotificationPreferences(db, id, p, NotificationsByUnsubscribe); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		if r.Method == http.MethodPost {
+			respondWithJSON(w, http.StatusOK, map[string]string{"result": "success", "unsubscribed": kind})
+			return
+		}
+		// The page offers to stop everything else too
+		lang := responseLanguage(w)
+		var all string
+		if kind != NotifyAll {
+			all = fmt.Sprintf("<p><a href=\"%s\">%s</a></p>", html.EscapeString(u.URL(id, NotifyAll)), html.EscapeString(message(lang, "unsubscribe_all")))
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprintf(w, "<!DOCTYPE html>\n<html lang=%q><head><meta charset=\"utf-8\"><title>%s</title></head><body><p>%s</p>%s</body></html>\n",
+			lang, html.EscapeString(message(lang, "unsubscribed_title")), html.EscapeString(message(lang, "unsubscribed_"+kind)), all)
+	}
+}
+
+// Export every resident's notification preferences as CSV, e.g. to keep a
+// record of who opted out and when
+func exportNotificationsReport(db *sql.DB, cal calendar) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		locale, err := reportLocale(r)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		rows, err := db.Query(`
+			SELECT id, name, unit, email, contact, notify_receipts, notify_channel, notify_announcements, notify_statements,
+				notifications_updated_at, notifications_updated_by
+			FROM residents ORDER BY unit, name
+		`)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		defer rows.Close()
+
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=notification_preferences_%s.csv", cal.today()))
+
+		locale.Start(w)
+		locale.Row(w, "Resident ID", "Name", "Unit", "Email", "Contact", "Receipts", "Reminders", "Announcements", "Statements", "Updated", "Updated By")
+		channel := func(c string) string {
+			if c == "" {
+				return "automatic"
+			}
+			return c
+		}
+		for rows.Next() {
+			var id int
+			var name, unit, email, contact, updatedBy string
+			var p NotificationPreferences
+			var updatedAt sql.NullTime
+			if err := rows.Scan(&id, &name, &unit, &email, &contact, &p.Receipts, &p.Reminders, &p.Announcements, &p.Statements, &updatedAt, &updatedBy); err != nil {
+				log.Printf("Error scanning resident row: %v", err)
+				continue
+			}
+			var updated string
+			if updatedAt.Valid {
+				updated = locale.Time(updatedAt.Time)
+			}
+			locale.Row(w, strconv.Itoa(id), name, unit, email, contact,
+				channel(p.Receipts), channel(p.Reminders), channel(p.Announcements), channel(p.Statements), updated, updatedBy)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package condomngr
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Notification event types. Every type can be switched on or off with the
+// -notify-events flag.
+const (
+	EventPaymentLarge       = "payment_large"
+	EventMaintenanceRequest = "maintenance_request"
+	EventImportCompleted    = "import_completed"
+	EventBackupFailed       = "backup_failed"
+	EventLoginLockout       = "login_lockout"
+	EventExpiryDue          = "expiry_due"
+	EventTaskOverdue        = "task_overdue"
+	EventTest               = "test"
+)
+
+// allEventTypes lists the event types that can be toggled
+var allEventTypes = []string{
+	EventPaymentLarge,
+	EventMaintenanceRequest,
+	EventImportCompleted,
+	EventBackupFailed,
+	EventLoginLockout,
+	EventExpiryDue,
+	EventTaskOverdue,
+}
+
+// Event is a single notification handed to the dispatcher
+type Event struct {
+	Type    string
+	Title   string
+	Message string
+	Time    time.Time
+}
+
+// Channel delivers events to an external service
+type Channel interface {
+	Name() string
+	Send(ctx context.Context, e Event) error
+}
+
+// Notifier dispatches events asynchronously to every configured channel
+type Notifier struct {
+	channels         []Channel
+	enabled          map[string]bool
+	queue            chan Event
+	PaymentThreshold float64
+}
+
+// NewNotifier creates a dispatcher for the given event types and channels.
+// Call Start to begin delivering queued events.
+func NewNotifier(events []string, paymentThreshold float64, channels ...Channel) *Notifier {
+	enabled := make(map[string]bool)
+	for _, e := range events {
+		enabled[strings.TrimSpace(e)] = true
+	}
+	return &Notifier{
+		channels:         channels,
+		enabled:          enabled,
+		queue:            make(chan Event, 100),
+		PaymentThreshold: paymentThreshold,
+	}
+}
+
+// Start delivers queued events in a background goroutine
+func (n *Notifier) Start() {
+	go func() {
+		for e := range n.queue {
+			n.deliver(e)
+		}
+	}()
+}
+
+// Configured reports whether at least one channel is set up
+func (n *Notifier) Configured() bool {
+	return len(n.channels) > 0
+}
+
+// Enabled reports whether events of the given type should be sent
+func (n *Notifier) Enabled(eventType string) bool {
+	return n.Configured() && n.enabled[eventType]
+}
+
+// Notify queues an event without blocking the caller. Events of disabled
+// types are dropped, as are events arriving while the queue is full.
+func (n *Notifier) Notify(e Event) {
+	if !n.Enabled(e.Type) {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	select {
+	case n.queue <- e:
+	default:
+		log.Printf("Notification queue full, dropping %s event", e.Type)
+	}
+}
+
+// Test sends a test message synchronously to every channel
+func (n *Notifier) Test(ctx context.Context) error {
+	e := Event{
+		Type:    EventTest,
+		Title:   "Test notification",
+		Message: "Condo Manager notifications are configured correctly.",
+		Time:    time.Now(),
+	}
+	for _, c := range n.channels {
+		if err := c.Send(ctx, e); err != nil {
+			return fmt.Errorf("%s: %v", c.Name(), err)
+		}
+	}
+	return nil
+}
+
+func (n *Notifier) deliver(e Event) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	for _, c := range n.channels {
+		if err := c.Send(ctx, e); err != nil {
+			log.Printf("Failed to send %s notification via %s: %v", e.Type, c.Name(), err)
+		}
+	}
+}
+
+// TelegramChannel posts events to a chat through the Telegram Bot API
+type TelegramChannel struct {
+	Token  string
+	ChatID string
+	Client *http.Client
+}
+
+// NewTelegramChannel creates a channel for the given bot token and chat id
+func NewTelegramChannel(token, chatID string) *TelegramChannel {
+	return &TelegramChannel{
+		Token:  token,
+		ChatID: chatID,
+		Client: &http.Client{Timeout: 15 * time.Second},
+	}
+}
+
+// Name returns the channel name
+func (t *TelegramChannel) Name() string {
+	return "telegram"
+}
+
+// Send posts the event as an HTML formatted message
+func (t *TelegramChannel) Send(ctx context.Context, e Event) error {
+	text := fmt.Sprintf("<b>%s</b>\n%s\n<i>%s</i>",
+		html.EscapeString(e.Title), html.EscapeString(e.Message), e.Time.Format("2006-01-02 15:04"))
+
+	body, err := json.Marshal(map[string]string{
+		"chat_id":    t.ChatID,
+		"text":       text,
+		"parse_mode": "HTML",
+	})
+	if err != nil {
+		return err
+	}
+
+	url := fmt.Sprintf("https://api.telegram.org/bot%s/sendMessage", t.Token)
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := t.Client.Do(req)
+	if err != nil {
+		// Don't leak the bot token through the request URL in the error
+		return fmt.Errorf("request failed: %v", strings.ReplaceAll(err.Error(), t.Token, "***"))
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		OK          bool   `json:"ok"`
+		Description string `json:"description"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return fmt.Errorf("unexpected response (status %d)", resp.StatusCode)
+	}
+	if !result.OK {
+		return fmt.Errorf("telegram API error: %s", result.Description)
+	}
+	return nil
+}
+
+// Send a test notification to all configured channels
+func testNotification(notifier *Notifier) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !notifier.Configured() {
+			respondWithError(w, http.StatusBadRequest, "No notification channels configured")
+			return
+		}
+
+		if err := notifier.Test(r.Context()); err != nil {
+			respondWithError(w, http.StatusBadGateway, fmt.Sprintf("Test notification failed: %v", err))
+			return
+		}
+
+		respondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
+	}
+}
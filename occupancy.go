@@ -0,0 +1,269 @@
+package condomngr
+
+import (
+	"database/sql"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// Occupancy statuses of a unit
+const (
+	UnitOccupied     = "occupied"
+	UnitVacant       = "vacant"
+	UnitPartlyVacant = "partly_vacant" // only for a month: vacant some of its days
+)
+
+// How dues generation treats the units nobody lives in for a whole month
+const (
+	VacantSkip  = "skip"  // charge nobody
+	VacantOwner = "owner" // charge the owner of record, the last resident who lived there
+)
+
+func validVacantRule(rule string) bool {
+	return rule == VacantSkip || rule == VacantOwner
+}
+
+// OccupancyResident is a resident who lived in a unit on the date or in the
+// month asked for
+type OccupancyResident struct {
+	ResidentID  int    `json:"resident_id"`
+	Name        string `json:"name"`
+	MoveInDate  string `json:"move_in_date"`
+	MoveOutDate string `json:"move_out_date"`
+}
+
+// UnitOccupancy tells who lived in a unit, or since when nobody did
+type UnitOccupancy struct {
+	Unit        string              `json:"unit"`
+	Status      string              `json:"status"`
+	Residents   []OccupancyResident `json:"residents"`
+	VacantSince string              `json:"vacant_since,omitempty"` // when the last resident moved out; empty if nobody ever lived there
+	VacantDays  *int                `json:"vacant_days,omitempty"`  // only for a month
+}
+
+// OccupancyReport is the occupancy of every unit on a date or over a month.
+// The units are those of the residents, fee schedules and ownership fractions.
+type OccupancyReport struct {
+	On          string          `json:"on,omitempty"`
+	Month       string          `json:"month,omitempty"`
+	Units       []UnitOccupancy `json:"units"`
+	Occupied    int             `json:"occupied"`
+	Vacant      int             `json:"vacant"`       // for a month, vacant all of it
+	VacancyRate float64         `json:"vacancy_rate"` // percent of the units vacant
+}
+
+// unitResident is a resident of a unit with the dates they lived there
+type unitResident struct {
+	OccupancyResident
+	unit string
+}
+
+// livesOn reports whether the resident lived in the unit on date; the
+// move-out date is the handover day, when they no longer do
+func (r unitResident) livesOn(date string) bool {
+	return (r.MoveInDate == "" || r.MoveInDate <= date) && (r.MoveOutDate == "" || r.MoveOutDate > date)
+}
+
+// loadUnitResidents returns every unit, sorted, and the residents of each,
+// in the order they were added
+func loadUnitResidents(q querier) ([]string, map[string][]unitResident, error) {
+	rows, err := q.Query(`
+		SELECT id, name, unit, move_in_date, move_out_date FROM residents WHERE unit != '' ORDER BY id
+	`)
+	if err != nil {
+		return nil, nil, err
+	}
+	residents := map[string][]unitResident{}
+	for rows.Next() {
+		var r unitResident
+		if err := rows.Scan(&r.ResidentID, &r.Name, &r.unit, &r.MoveInDate, &r.MoveOutDate); err != nil {
+			rows.Close()
+			return nil, nil, err
+		}
+		residents[r.unit] = append(residents[r.unit], r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	units := map[string]bool{}
+	for unit := range residents {
+		units[unit] = true
+	}
+	rows, err = q.Query("SELECT unit FROM fee_schedule WHERE unit != '' UNION SELECT unit FROM unit_fractions")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var unit string
+		if err := rows.Scan(&unit); err != nil {
+			return nil, nil, err
+		}
+		units[unit] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	sorted := make([]string, 0, len(units))
+	for unit := range units {
+		sorted = append(sorted, unit)
+	}
+	sort.Strings(sorted)
+	return sorted, residents, nil
+}
+
+// vacantSince is the last move-out of the residents up to date, when nobody
+// lives in their unit anymore
+func vacantSince(residents []unitResident, date string) string {
+	since := ""
+	for _, r := range residents {
+		if r.MoveOutDate != "" && r.MoveOutDate <= date && r.MoveOutDate > since {
+			since = r.MoveOutDate
+		}
+	}
+	return since
+}
+
+// ownerOfRecord is the resident who last moved out of a unit before date, who
+// still answers for it while nobody lives there; nil if nobody ever did
+func ownerOfRecord(residents []unitResident, date string) *unitResident {
+	var owner *unitResident
+	for i, r := range residents {
+		if r.MoveOutDate != "" && r.MoveOutDate <= date && (owner == nil || r.MoveOutDate >= owner.MoveOutDate) {
+			owner = &residents[i]
+		}
+	}
+	return owner
+}
+
+// occupancyOn is the occupancy of every unit on date (YYYY-MM-DD)
+func occupancyOn(q querier, date string) (OccupancyReport, error) {
+	report := OccupancyReport{On: date, Units: []UnitOccupancy{}}
+	units, residents, err := loadUnitResidents(q)
+	if err != nil {
+		return report, err
+	}
+	for _, unit := range units {
+		occupancy := UnitOccupancy{Unit: unit, Status: UnitVacant, Residents: []OccupancyResident{}}
+		for _, r := range residents[unit] {
+			if r.livesOn(date) {
+				occupancy.Residents = append(occupancy.Residents, r.OccupancyResident)
+			}
+		}
+		if len(occupancy.Residents) > 0 {
+			occupancy.Status = UnitOccupied
+			report.Occupied++
+		} else {
+			occupancy.VacantSince = vacantSince(residents[unit], date)
+			report.Vacant++
+		}
+		report.Units = append(report.Units, occupancy)
+	}
+	report.VacancyRate = vacancyRate(report.Vacant, len(units))
+	return report, nil
+}
+
+// occupancyInMonth is the occupancy of every unit over a month: who lived
+// there any of its days, and how many days nobody did
+func occupancyInMonth(q querier, month time.Time) (OccupancyReport, error) {
+	report := OccupancyReport{Month: month.Format("2006-01"), Units: []UnitOccupancy{}}
+	units, residents, err := loadUnitResidents(q)
+	if err != nil {
+		return report, err
+	}
+	next := month.AddDate(0, 1, 0)
+	days := int(next.Sub(month).Hours() / 24)
+	for _, unit := range units {
+		occupancy := UnitOccupancy{Unit: unit, Residents: []OccupancyResident{}}
+		lived := map[int]bool{}
+		vacant := 0
+		for day := 0; day < days; day++ {
+			date := month.AddDate(0, 0, day).Format("2006-01-02")
+			occupied := false
+			for i, r := range residents[unit] {
+				if r.livesOn(date) {
+					occupied = true
+					if !lived[i] {
+						lived[i] = true
+						occupancy.Residents = append(occupancy.Residents, r.OccupancyResident)
+					}
+				}
+			}
+			if !occupied {
+				vacant++
+			}
+		}
+		occupancy.VacantDays = &vacant
+		switch vacant {
+		case 0:
+			occupancy.Status = UnitOccupied
+			report.Occupied++
+		case days:
+			occupancy.Status = UnitVacant
+			occupancy.VacantSince = vacantSince(residents[unit], month.Format("2006-01-02"))
+			report.Vacant++
+		default:
+			occupancy.Status = UnitPartlyVacant
+			report.Occupied++
+		}
+		report.Units = append(report.Units, occupancy)
+	}
+	report.VacancyRate = vacancyRate(report.Vacant, len(units))
+	return report, nil
+}
+
+// vacancyRate is the percentage of units vacant, to one decimal
+func vacancyRate(vacant, units int) float64 {
+	if units == 0 {
+		return 0
+	}
+	return math.Round(float64(vacant)/float64(units)*1000) / 10
+}
+
+// Handlers for occupancy endpoints
+
+// Get who lives in each unit, or since when it is vacant, on a date (today by
+// default) or over a month
+func getOccupancy(db *sql.DB, cal calendar) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := checkQueryParams(r, "on", "month"); err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		on, month := r.URL.Query().Get("on"), r.URL.Query().Get("month")
+		if on != "" && month != "" {
+			respondWithError(w, http.StatusBadRequest, "Give on or month, not both")
+			return
+		}
+
+		var report OccupancyReport
+		var err error
+		if month != "" {
+			start, perr := time.Parse("2006-01", month)
+			if perr != nil {
+				respondWithError(w, http.StatusBadRequest, "invalid month format, must be YYYY-MM")
+				return
+			}
+			report, err = occupancyInMonth(db, start)
+		} else {
+			if on == "" {
+				on = cal.today()
+			}
+			if _, perr := time.Parse("2006-01-02", on); perr != nil {
+				respondWithError(w, http.StatusBadRequest, "invalid on format, must be YYYY-MM-DD")
+				return
+			}
+			report, err = occupancyOn(db, on)
+		}
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		respondWithJSON(w, http.StatusOK, report)
+	}
+}
@@ -0,0 +1,652 @@
+package condomngr
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// apiParam is a path or query parameter of an API operation
+type apiParam struct {
+	Name        string
+	In          string // "path" or "query"
+	Type        string
+	Description string
+	Required    bool
+}
+
+// apiOperation documents one route for the OpenAPI specification. Request and
+// Response hold a zero value of the body type; schemas are derived from their
+// json tags so they follow the models automatically.
+type apiOperation struct {
+	Method      string
+	Path        string
+	Tag         string
+	Summary     string
+	Params      []apiParam
+	Request     interface{}
+	Upload      string // form field of a multipart file upload, or comma-separated fields of several
+	Status      int
+	Response    interface{}
+	ContentType string // response content type when it is not JSON
+	Portal      bool   // authenticated with a portal token
+}
+
+var (
+	idParam              = apiParam{Name: "id", In: "path", Type: "integer", Required: true}
+	condoIDParam         = apiParam{Name: "condo_id", In: "path", Type: "integer", Required: true}
+	loginUsernameParam   = apiParam{Name: "username", In: "query", Type: "string", Description: "Username to unlock; not with ip"}
+	loginIPParam         = apiParam{Name: "ip", In: "query", Type: "string", Description: "Client IP to unlock; not with username"}
+	resetTokenParam      = apiParam{Name: "token", In: "query", Type: "string", Required: true, Description: "Token of the password reset link"}
+	unsubscribeParam     = apiParam{Name: "token", In: "query", Type: "string", Required: true, Description: "Token of the link in the email"}
+	emailTemplateParam   = apiParam{Name: "name", In: "path", Type: "string", Required: true, Description: "receipt, reminder, statement or password_reset"}
+	startDateParam       = apiParam{Name: "start_date", In: "query", Type: "string", Description: "Earliest date, YYYY-MM-DD"}
+	endDateParam         = apiParam{Name: "end_date", In: "query", Type: "string", Description: "Latest date, YYYY-MM-DD"}
+	updatedParam         = apiParam{Name: "updated_since", In: "query", Type: "string", Description: "Only rows created or updated at or after this RFC 3339 timestamp"}
+	monthParam           = apiParam{Name: "month", In: "query", Type: "string", Description: "Month as YYYY-MM, defaults to the current month"}
+	searchParam          = apiParam{Name: "q", In: "query", Type: "string", Description: "Text to search for"}
+	matchParam           = apiParam{Name: "match", In: "query", Type: "string", Description: "contains (default), prefix or exact"}
+	suggestionLimitParam = apiParam{Name: "limit", In: "query", Type: "integer", Description: "Maximum number of suggestions, 1 to 100 (default 10)"}
+	fuzzyParam           = apiParam{Name: "fuzzy", In: "query", Type: "boolean", Description: "Ignore case and accents and allow typos, closest matches first"}
+	residentParam        = apiParam{Name: "resident_id", In: "query", Type: "integer"}
+	categoryParam        = apiParam{Name: "category", In: "query", Type: "string"}
+	categoriesParam      = apiParam{Name: "category", In: "query", Type: "string", Description: "Any of these categories, repeated or comma-separated"}
+	excludeParam         = apiParam{Name: "exclude_category", In: "query", Type: "string", Description: "None of these categories, repeated or comma-separated; not with category"}
+	refreshParam         = apiParam{Name: "refresh", In: "query", Type: "boolean", Description: "Compute it again rather than answer from the cache"}
+	asOfParam            = apiParam{Name: "as_of", In: "query", Type: "string", Description: "Date as YYYY-MM-DD, defaults to today"}
+	yearParam            = apiParam{Name: "year", In: "query", Type: "integer", Description: "Fiscal year as YYYY, named after the year it starts in, defaults to the current one"}
+	statementFormatParam = apiParam{Name: "format", In: "query", Type: "string", Description: "json (default) or pdf"}
+	requestFormatParam   = apiParam{Name: "format", In: "query", Type: "string", Description: "json (default) or png, the QR code alone"}
+	fieldsParam          = apiParam{Name: "fields", In: "query", Type: "string", Description: "Comma-separated fields to return, e.g. id,name"}
+	listFormatParam      = apiParam{Name: "format", In: "query", Type: "string", Description: "json (default) or csv, also chosen by an Accept header of application/json or text/csv"}
+	localeParam          = apiParam{Name: "locale", In: "query", Type: "string", Description: "Locale of the CSV: en (default) or pt-PT, with ; between fields, decimal commas and DD/MM/YYYY dates"}
+	budgetYearParam      = apiParam{Name: "year", In: "path", Type: "integer", Required: true, Description: "Fiscal year as YYYY, named after the year it starts in"}
+	budgetCategoryParam  = apiParam{Name: "category", In: "path", Type: "string", Required: true, Description: "Expense category"}
+	unitParam            = apiParam{Name: "unit", In: "path", Type: "string", Required: true}
+	expiryItemParam      = apiParam{Name: "item", In: "path", Type: "string", Required: true, Description: "The expiry item, e.g. document-3, lease-12 or fee_schedule-4"}
+	resultResponse       = map[string]string{}
+	countResult          = map[string]int{}
+)
+
+// apiOperations lists every API route. Keep it in sync with the router in
+// NewServer; TestAPIDocsCoverEveryRoute fails when a route is missing.
+var apiOperations = []apiOperation{
+	// Residents
+	{Method: "GET", Path: "/residents", Tag: "Residents", Summary: "Get all residents", Params: []apiParam{{Name: "unit", In: "query", Type: "string"}, fieldsParam, listFormatParam, localeParam}, Response: []Resident{}},
+	{Method: "POST", Path: "/residents", Tag: "Residents", Summary: "Create a new resident", Request: Resident{}, Status: http.StatusCreated, Response: Resident{}},
+	{Method: "GET", Path: "/residents/count", Tag: "Residents", Summary: "Count residents", Params: []apiParam{{Name: "unit", In: "query", Type: "string"}, refreshParam}, Response: countResult},
+	{Method: "GET", Path: "/residents/{id}", Tag: "Residents", Summary: "Get a specific resident", Params: []apiParam{idParam}, Response: Resident{}},
+	{Method: "PUT", Path: "/residents/{id}", Tag: "Residents", Summary: "Update a resident", Params: []apiParam{idParam}, Request: Resident{}, Response: Resident{}},
+	{Method: "DELETE", Path: "/residents/{id}", Tag: "Residents", Summary: "Move a resident to the trash", Params: []apiParam{idParam}, Response: resultResponse},
+	{Method: "GET", Path: "/residents/{id}/timeline", Tag: "Residents", Summary: "What happened to a resident, newest first", Params: []apiParam{
+		idParam,
+		{Name: "limit", In: "query", Type: "integer", Description: "Page size, 1 to 200 (default 50)"},
+		{Name: "before", In: "query", Type: "string", Description: "X-Next-Cursor of the previous page"},
+	}, Response: []TimelineEntry{}},
+	{Method: "GET", Path: "/residents/{id}/notifications", Tag: "Residents", Summary: "Get a resident's notification preferences and when they last changed", Params: []apiParam{idParam}, Response: ResidentNotifications{}},
+	{Method: "PUT", Path: "/residents/{id}/notifications", Tag: "Residents", Summary: "Set the channel a resident is reached through for each type of notification", Params: []apiParam{idParam}, Request: NotificationPreferences{}, Response: ResidentNotifications{}},
+	{Method: "POST", Path: "/residents/{id}/anonymize", Tag: "Residents", Summary: "Erase a resident's personal data for good, keeping their financial records; refused while they owe money unless forced. Audited (admins only)", Params: []apiParam{idParam}, Request: ResidentAnonymization{}, Response: Resident{}},
+
+	// Payments
+	{Method: "GET", Path: "/payments", Tag: "Payments", Summary: "Get all payments", Params: []apiParam{residentParam, startDateParam, endDateParam, updatedParam, fieldsParam, listFormatParam, localeParam}, Response: []Payment{}},
+	{Method: "POST", Path: "/payments", Tag: "Payments", Summary: "Create a new payment", Request: Payment{}, Status: http.StatusCreated, Response: Payment{}},
+	{Method: "GET", Path: "/payments/count", Tag: "Payments", Summary: "Count payments", Params: []apiParam{residentParam, startDateParam, endDateParam, updatedParam, refreshParam}, Response: countResult},
+	{Method: "GET", Path: "/payments/calendar", Tag: "Payments", Summary: "Every day of a month with the count and total of the confirmed payments made on it, zero for days without, and the month's totals", Params: []apiParam{monthParam,
+		{Name: "include", In: "query", Type: "string", Description: "expenses to add the count and total of the expenses of each day"}, refreshParam,
+	}, Response: PaymentCalendar{}},
+	{Method: "GET", Path: "/payments/descriptions", Tag: "Payments", Summary: "Descriptions in use matching q, the most used first with their counts and latest dates, for autocomplete", Params: []apiParam{searchParam, matchParam, suggestionLimitParam, refreshParam}, Response: []Suggestion{}},
+	{Method: "GET", Path: "/payments/{id}", Tag: "Payments", Summary: "Get a specific payment and the charges it settles", Params: []apiParam{idParam}, Response: Payment{}},
+	{Method: "PUT", Path: "/payments/{id}", Tag: "Payments", Summary: "Update a payment", Params: []apiParam{idParam}, Request: Payment{}, Response: Payment{}},
+	{Method: "DELETE", Path: "/payments/{id}", Tag: "Payments", Summary: "Move a payment to the trash", Params: []apiParam{idParam}, Response: resultResponse},
+	{Method: "PUT", Path: "/payments/{id}/allocations", Tag: "Payments", Summary: "Set the charges a payment settles by hand", Params: []apiParam{idParam}, Request: AllocationRequest{}, Response: Payment{}},
+	{Method: "POST", Path: "/payments/{id}/clearance", Tag: "Payments", Summary: "Record that a cheque cleared or bounced", Params: []apiParam{idParam}, Request: ChequeClearance{}, Response: Payment{}},
+	{Method: "POST", Path: "/payments/{id}/receipt", Tag: "Payments", Summary: "Email the receipt of a payment to its resident, with the receipt as a PDF", Params: []apiParam{idParam}, Response: resultResponse},
+	{Method: "POST", Path: "/payments/{id}/receipt/resend", Tag: "Payments", Summary: "Queue the receipt of a confirmed payment to be emailed again, in the background", Params: []apiParam{idParam}, Status: http.StatusAccepted, Response: ReceiptEmail{}},
+	{Method: "GET", Path: "/payments/cheques/outstanding", Tag: "Payments", Summary: "Cheques not cleared yet, oldest first", Params: []apiParam{asOfParam}, Response: OutstandingCheques{}},
+	{Method: "POST", Path: "/payments/links", Tag: "Payments", Summary: "Create a Stripe Checkout payment link for a resident", Request: PaymentLink{}, Status: http.StatusCreated, Response: PaymentLink{}},
+	{Method: "POST", Path: "/payments/bulk-delete", Tag: "Payments", Summary: "Delete payments by id or filter", Request: BulkDeleteRequest{}, Response: BulkDeleteResult{}},
+	{Method: "POST", Path: "/payments/bulk-reassign", Tag: "Payments", Summary: "Move payments recorded against the wrong resident to another one in one transaction, reallocating the charges of both and recording the payment ids in the audit log; with dry_run, report what it would do", Request: PaymentReassignment{}, Response: PaymentReassignResult{}},
+
+	// Expenses
+	{Method: "GET", Path: "/expenses", Tag: "Expenses", Summary: "Get all expenses", Params: []apiParam{categoryParam, startDateParam, endDateParam, updatedParam, fieldsParam, listFormatParam, localeParam}, Response: []Expense{}},
+	{Method: "POST", Path: "/expenses", Tag: "Expenses", Summary: "Create a new expense", Request: Expense{}, Status: http.StatusCreated, Response: Expense{}},
+	{Method: "GET", Path: "/expenses/count", Tag: "Expenses", Summary: "Count expenses", Params: []apiParam{categoryParam, startDateParam, endDateParam, updatedParam, refreshParam}, Response: countResult},
+	{Method: "GET", Path: "/expenses/categories", Tag: "Expenses", Summary: "Categories in use, matching q if given, the most used first with their counts and latest dates, for autocomplete", Params: []apiParam{searchParam, matchParam, suggestionLimitParam, refreshParam}, Response: []Suggestion{}},
+	{Method: "GET", Path: "/expenses/{id}", Tag: "Expenses", Summary: "Get a specific expense", Params: []apiParam{idParam}, Response: Expense{}},
+	{Method: "PUT", Path: "/expenses/{id}", Tag: "Expenses", Summary: "Update an expense", Params: []apiParam{idParam}, Request: Expense{}, Response: Expense{}},
+	{Method: "DELETE", Path: "/expenses/{id}", Tag: "Expenses", Summary: "Move an expense to the trash", Params: []apiParam{idParam}, Response: resultResponse},
+	{Method: "POST", Path: "/expenses/{id}/allocate", Tag: "Expenses", Summary: "Split an expense between the units by ownership fraction, charged with the dues of a month", Params: []apiParam{idParam,
+		{Name: "charge_month", In: "query", Type: "string", Description: "Month whose dues carry the shares, YYYY-MM, next month by default"},
+	}, Response: ExpenseAllocation{}},
+	{Method: "GET", Path: "/expenses/{id}/allocation", Tag: "Expenses", Summary: "How an expense was split between the units", Params: []apiParam{idParam}, Response: ExpenseAllocation{}},
+	{Method: "POST", Path: "/expenses/bulk-delete", Tag: "Expenses", Summary: "Delete expenses by id or filter", Request: BulkDeleteRequest{}, Response: BulkDeleteResult{}},
+	{Method: "POST", Path: "/expenses/bulk-update", Tag: "Expenses", Summary: "Change the category, vendor or tags of the expenses matching a filter in one transaction, recorded in the audit log; with dry_run, list them instead", Request: ExpenseBulkUpdate{}, Response: ExpenseBulkUpdateResult{}},
+
+	// Data import/export
+	{Method: "GET", Path: "/export", Tag: "Data", Summary: "Export database as JSON or NDJSON", Params: []apiParam{
+		{Name: "start_date", In: "query", Type: "string", Description: "Earliest payment and expense date, YYYY-MM-DD"},
+		{Name: "end_date", In: "query", Type: "string", Description: "Latest payment and expense date, YYYY-MM-DD"},
+		{Name: "entities", In: "query", Type: "string", Description: "residents, payments and/or expenses, repeated or comma-separated; all by default"},
+		{Name: "format", In: "query", Type: "string", Description: "json (default), or ndjson for one record per line"},
+	}, Response: ExportData{}},
+	{Method: "POST", Path: "/import", Tag: "Data", Summary: "Import database from JSON or NDJSON. With async=true the import runs as a background job, answered with 202 and the Job", Params: []apiParam{
+		{Name: "async", In: "query", Type: "boolean", Description: "Import in the background and answer with the job right away"},
+		{Name: "force", In: "query", Type: "boolean", Description: "Import even if the file doesn't match its manifest, answering with a warning"},
+		{Name: "format", In: "query", Type: "string", Description: "json or ndjson; by default ndjson for .ndjson and .jsonl files, json otherwise"},
+	}, Upload: "importFile", Response: resultResponse},
+	{Method: "POST", Path: "/import/xlsx/detect", Tag: "Data", Summary: "List the sheets of an .xlsx workbook with their headers and first rows, and suggest a mapping", Upload: "workbook", Response: XLSXDetection{}},
+	{Method: "POST", Path: "/import/xlsx", Tag: "Data", Summary: "Merge the residents, payments and expenses of an .xlsx workbook as mapped. A dry run, listing the records, unless dry_run=false", Params: []apiParam{
+		{Name: "mapping", In: "query", Type: "string", Description: "The XLSXMapping as JSON, also taken as a form field; the suggested one when left out"},
+		{Name: "dry_run", In: "query", Type: "boolean", Description: "Check and list the records without importing them, true by default"},
+	}, Upload: "workbook", Response: XLSXImportResult{}},
+	{Method: "GET", Path: "/jobs/{id}", Tag: "Data", Summary: "Get the state, progress and result or error of a background job", Params: []apiParam{idParam}, Response: Job{}},
+	{Method: "POST", Path: "/jobs/{id}/cancel", Tag: "Data", Summary: "Cancel a queued or running background job; a canceled import changes nothing", Params: []apiParam{idParam}, Response: Job{}},
+
+	// Trash
+	{Method: "GET", Path: "/trash", Tag: "Trash", Summary: "Deleted residents, payments and expenses, most recent first", Params: []apiParam{
+		{Name: "type", In: "query", Type: "string", Description: "resident, payment or expense"},
+	}, Response: []TrashEntry{}},
+	{Method: "POST", Path: "/trash/{id}/restore", Tag: "Trash", Summary: "Restore a deleted record under its old id", Params: []apiParam{idParam}, Response: TrashEntry{}},
+	{Method: "GET", Path: "/status", Tag: "Settings", Summary: "Server status, version and read-only mode", Response: ServerStatus{}},
+	{Method: "POST", Path: "/admin/readonly", Tag: "Settings", Summary: "Turn read-only mode on or off until restart (admins only)", Request: ReadOnlyRequest{}, Response: ServerStatus{}},
+	{Method: "POST", Path: "/admin/maintenance", Tag: "Data", Summary: "Check integrity, then VACUUM and ANALYZE the database (admins only)", Response: MaintenanceResult{}},
+	{Method: "GET", Path: "/admin/dbstats", Tag: "Data", Summary: "Database size and row counts (admins only)", Response: DBStats{}},
+	{Method: "GET", Path: "/admin/consistency", Tag: "Data", Summary: "Find orphan payments and credits, missing required values, duplicate payment references, negative amounts and dates outside 1990-2100, with the ids of the rows (admins only)", Response: ConsistencyReport{}},
+	{Method: "POST", Path: "/admin/consistency/fix", Tag: "Data", Summary: "Apply safe fixes in one transaction: assign orphans to an \"Unknown resident\" and/or backfill missing values; recorded in the audit log (admins only)", Request: ConsistencyFixRequest{}, Response: ConsistencyFixResult{}},
+	{Method: "POST", Path: "/admin/recompute", Tag: "Data", Summary: "Rebuild the payment allocations and reserve contributions from the payments and charges in one transaction, and report every allocation, charge status, resident's open charges and reserve contribution that differed; recorded in the audit log (admins only)", Params: []apiParam{
+		{Name: "check_only", In: "query", Type: "boolean", Description: "Only report the discrepancies, changing nothing"},
+	}, Response: RecomputeResult{}},
+	{Method: "GET", Path: "/admin/backups", Tag: "Data", Summary: "List the scheduled backups, newest first, with the status of their upload (admins only)", Response: []Backup{}},
+	{Method: "POST", Path: "/admin/backups", Tag: "Data", Summary: "Take a backup now; it is uploaded in the background (admins only)", Status: http.StatusCreated, Response: Backup{}},
+	{Method: "POST", Path: "/admin/diff", Tag: "Data", Summary: "Compare two exports, before and after, or before with the live database when after is left out, listing the records added, removed and changed by id, with the before and after of each changed field (admins only)", Params: []apiParam{
+		{Name: "summary", In: "query", Type: "boolean", Description: "Only count the records added, removed, changed and unchanged"},
+	}, Upload: "before,after", Response: ExportDiff{}},
+	{Method: "POST", Path: "/admin/anonymize", Tag: "Data", Summary: "Download a copy of the database with made-up names, contacts and text, to share as test data; the same seed makes the same copy (admins only)", Request: struct {
+		Seed *int64 `json:"seed"`
+	}{}, ContentType: "application/vnd.sqlite3"},
+
+	// Users
+	{Method: "GET", Path: "/users", Tag: "Users", Summary: "Get all users (admins only)", Response: []User{}},
+	{Method: "POST", Path: "/users", Tag: "Users", Summary: "Create a user (admins only, or anyone while there are no users)", Request: NewUserRequest{}, Status: http.StatusCreated, Response: User{}},
+	{Method: "GET", Path: "/users/{id}", Tag: "Users", Summary: "Get a specific user (admins only)", Params: []apiParam{idParam}, Response: User{}},
+	{Method: "PUT", Path: "/users/{id}", Tag: "Users", Summary: "Change a user's role or disable them (admins only)", Params: []apiParam{idParam}, Request: UpdateUserRequest{}, Response: User{}},
+	{Method: "DELETE", Path: "/users/{id}", Tag: "Users", Summary: "Delete a user (admins only)", Params: []apiParam{idParam}, Response: resultResponse},
+	{Method: "POST", Path: "/users/{id}/password", Tag: "Users", Summary: "Set a user's password (admins only)", Params: []apiParam{idParam}, Request: PasswordRequest{}, Response: resultResponse},
+	{Method: "POST", Path: "/auth/login", Tag: "Users", Summary: "Sign in; repeated failures are slowed down and then locked out with 429. Users with two-factor authentication get a LoginChallenge instead of a session", Request: LoginRequest{}, Response: Session{}},
+	{Method: "POST", Path: "/auth/login/2fa", Tag: "Users", Summary: "Complete a sign-in with two-factor authentication, with a code from the authenticator app or a recovery code", Request: TwoFactorLoginRequest{}, Response: Session{}},
+	{Method: "POST", Path: "/auth/logout", Tag: "Users", Summary: "Sign out the session of the bearer token", Response: resultResponse},
+	{Method: "GET", Path: "/auth/session", Tag: "Users", Summary: "Get the session of the bearer token and its user", Response: Session{}},
+	{Method: "POST", Path: "/auth/password", Tag: "Users", Summary: "Change the password of the signed-in user, giving the current one; signs out their other sessions", Request: ChangePasswordRequest{}, Response: resultResponse},
+	{Method: "GET", Path: "/auth/failures", Tag: "Users", Summary: "List the usernames and client IPs with failed sign-ins, and their lockouts (admins only)", Response: []LoginFailures{}},
+	{Method: "DELETE", Path: "/auth/failures", Tag: "Users", Summary: "Clear the failed sign-ins and lockout of a username or client IP (admins only)", Params: []apiParam{loginUsernameParam, loginIPParam}, Response: resultResponse},
+	{Method: "GET", Path: "/sessions", Tag: "Users", Summary: "List the sessions of the signed-in user, with their device, IP and last use", Response: []Session{}},
+	{Method: "DELETE", Path: "/sessions/{id}", Tag: "Users", Summary: "Sign out one of the sessions of the signed-in user", Params: []apiParam{idParam}, Response: resultResponse},
+	{Method: "GET", Path: "/admin/sessions", Tag: "Users", Summary: "List the sessions of every user (admins only)", Response: []Session{}},
+	{Method: "DELETE", Path: "/admin/sessions/{id}", Tag: "Users", Summary: "Sign out the session of any user (admins only)", Params: []apiParam{idParam}, Response: resultResponse},
+	{Method: "POST", Path: "/auth/2fa/enroll", Tag: "Users", Summary: "Start two-factor authentication: a TOTP secret, its otpauth URI and QR code, and recovery codes", Response: TwoFactorEnrollment{}},
+	{Method: "POST", Path: "/auth/2fa/activate", Tag: "Users", Summary: "Turn two-factor authentication on with a code from the authenticator app", Request: TwoFactorCode{}, Response: resultResponse},
+	{Method: "DELETE", Path: "/users/{id}/2fa", Tag: "Users", Summary: "Turn off the two-factor authentication of a user who lost their authenticator (admins only)", Params: []apiParam{idParam}, Response: resultResponse},
+	{Method: "GET", Path: "/admin/2fa", Tag: "Users", Summary: "Get whether sessions need two-factor authentication (admins only)", Response: TwoFactorPolicy{}},
+	{Method: "PUT", Path: "/admin/2fa", Tag: "Users", Summary: "Set whether sessions need two-factor authentication (admins only)", Request: TwoFactorPolicy{}, Response: TwoFactorPolicy{}},
+	{Method: "POST", Path: "/password-reset/request", Tag: "Users", Summary: "Email a single-use link to set a new password to the user with this username or email; the answer is the same whether one exists, and requests are rate limited", Request: PasswordResetRequest{}, Response: resultResponse},
+	{Method: "GET", Path: "/password-reset/confirm", Tag: "Users", Summary: "Open the link of a password reset email, answering with a form to choose the new password", Params: []apiParam{resetTokenParam}, ContentType: "text/html"},
+	{Method: "POST", Path: "/password-reset/confirm", Tag: "Users", Summary: "Set a new password with the token of a reset link, signing out every session of the user", Request: PasswordResetConfirm{}, Response: resultResponse},
+	{Method: "GET", Path: "/admin/audit", Tag: "Users", Summary: "Get the audit log of sensitive actions, newest first, a page at a time (admins only)", Params: []apiParam{
+		{Name: "action", In: "query", Type: "string", Description: "Only entries of this action, e.g. password_reset"},
+		{Name: "limit", In: "query", Type: "integer", Description: "Page size, 1 to 200 (default 50)"},
+		{Name: "cursor", In: "query", Type: "string", Description: "X-Next-Cursor of the previous page"},
+	}, Response: []AuditEntry{}},
+
+	// Search
+	{Method: "GET", Path: "/dashboard", Tag: "Reports", Summary: "Counts, totals of the current month, occupancy, latest payments and expenses and overdue tasks, for the dashboard", Params: []apiParam{refreshParam}, Response: Dashboard{}},
+	{Method: "GET", Path: "/kpis", Tag: "Reports", Summary: "Collection rate, average days to pay, delinquent units, expense change and reserve fund ratio of a month, with their formulas and the trailing 12 months", Params: []apiParam{monthParam, refreshParam}, Response: KPIs{}},
+	{Method: "GET", Path: "/search", Tag: "Search", Summary: "Search residents, payments and expenses at once", Params: []apiParam{searchParam, matchParam, startDateParam, endDateParam,
+		{Name: "limit", In: "query", Type: "integer", Description: "Maximum number of results, 1 to 100 (default 20)"},
+	}, Response: []SearchResult{}},
+	{Method: "GET", Path: "/activity", Tag: "Search", Summary: "Residents, payments and expenses created or updated, newest first", Params: []apiParam{
+		{Name: "since", In: "query", Type: "string", Description: "YYYY-MM-DD or RFC 3339 timestamp"},
+		{Name: "limit", In: "query", Type: "integer", Description: "Page size, 1 to 200 (default 50)"},
+		{Name: "cursor", In: "query", Type: "string", Description: "X-Next-Cursor of the previous page"},
+	}, Response: []ActivityEntry{}},
+	{Method: "GET", Path: "/events", Tag: "Search", Summary: "Stream the residents, payments and expenses created, updated or deleted as server-sent change events of {type, id, action}, with a heartbeat comment every 15 seconds", Params: []apiParam{
+		{Name: "type", In: "query", Type: "string", Description: "Only changes of these types: resident, payment or expense, repeated or comma-separated"},
+		{Name: "action", In: "query", Type: "string", Description: "Only changes with these actions: created, updated, deleted or imported, repeated or comma-separated"},
+	}, ContentType: "text/event-stream"},
+	{Method: "GET", Path: "/search/residents", Tag: "Search", Summary: "Search residents", Params: []apiParam{searchParam, matchParam, fuzzyParam, listFormatParam, localeParam}, Response: []Resident{}},
+	{Method: "GET", Path: "/search/payments", Tag: "Search", Summary: "Search payments", Params: []apiParam{searchParam, matchParam, residentParam, startDateParam, endDateParam, listFormatParam, localeParam}, Response: []Payment{}},
+	{Method: "GET", Path: "/search/expenses", Tag: "Search", Summary: "Search expenses", Params: []apiParam{searchParam, matchParam, categoriesParam, excludeParam, startDateParam, endDateParam, listFormatParam, localeParam}, Response: []Expense{}},
+	{Method: "GET", Path: "/saved-searches", Tag: "Search", Summary: "Get the saved searches of the signed-in user, by name", Params: []apiParam{
+		{Name: "entity", In: "query", Type: "string", Description: "residents, payments or expenses"},
+	}, Response: []SavedSearch{}},
+	{Method: "POST", Path: "/saved-searches", Tag: "Search", Summary: "Save a search under a name", Request: SavedSearch{}, Status: http.StatusCreated, Response: SavedSearch{}},
+	{Method: "GET", Path: "/saved-searches/{id}", Tag: "Search", Summary: "Get a saved search, with the filters naming deleted residents or categories", Params: []apiParam{idParam}, Response: SavedSearch{}},
+	{Method: "PUT", Path: "/saved-searches/{id}", Tag: "Search", Summary: "Update a saved search", Params: []apiParam{idParam}, Request: SavedSearch{}, Response: SavedSearch{}},
+	{Method: "DELETE", Path: "/saved-searches/{id}", Tag: "Search", Summary: "Delete a saved search", Params: []apiParam{idParam}, Response: resultResponse},
+	{Method: "GET", Path: "/saved-searches/{id}/run", Tag: "Search", Summary: "Run a saved search, answering as the search endpoint of its entity. Filters naming deleted residents or categories are listed in X-Dangling-Filters", Params: []apiParam{idParam}, Response: []interface{}{}},
+
+	// Reports
+	{Method: "GET", Path: "/reports/payments/export", Tag: "Reports", Summary: "Export payments report as CSV", Params: []apiParam{residentParam, startDateParam, endDateParam,
+		{Name: "subtotals", In: "query", Type: "string", Description: "resident to add a subtotal per resident to the totals"},
+		{Name: "columns", In: "query", Type: "string", Description: "Comma-separated columns in order, of id, resident_id, resident, unit, email, contact, amount, description, date, method, status, reference, bank_reference, cheque_number, cheque_bank, cheque_status, created, updated and custom.<key>; by default id, resident, unit, amount, description, date, updated and the custom fields"},
+		localeParam,
+	}, ContentType: "text/csv"},
+	{Method: "GET", Path: "/reports/expenses/export", Tag: "Reports", Summary: "Export expenses report as CSV", Params: []apiParam{categoriesParam, excludeParam, startDateParam, endDateParam,
+		{Name: "subtotals", In: "query", Type: "string", Description: "category to add a subtotal per category to the totals"},
+		{Name: "columns", In: "query", Type: "string", Description: "Comma-separated columns in order, of id, amount, description, date, category, updated, original_amount, currency, exchange_rate, tax_rate, tax_amount, net_amount, units, bank_reference and created; by default all but the last three"},
+		localeParam,
+	}, ContentType: "text/csv"},
+	{Method: "GET", Path: "/reports/accounting/export", Tag: "Reports", Summary: "Export payments and expenses for accounting packages", Params: []apiParam{
+		{Name: "format", In: "query", Type: "string", Description: "ofx (default) or qif"}, startDateParam, endDateParam,
+	}, ContentType: "application/octet-stream"},
+	{Method: "GET", Path: "/reports/aging", Tag: "Reports", Summary: "Outstanding charges per resident by days past due", Params: []apiParam{asOfParam,
+		{Name: "include_zero", In: "query", Type: "boolean", Description: "Include residents who owe nothing"},
+		{Name: "format", In: "query", Type: "string", Description: "json (default) or csv"}, localeParam, refreshParam,
+	}, Response: AgingReport{}},
+	{Method: "GET", Path: "/reports/funds", Tag: "Reports", Summary: "Payments of a period split between the reserve and operating funds", Params: []apiParam{startDateParam, endDateParam, refreshParam}, Response: FundsReport{}},
+	{Method: "GET", Path: "/reports/notifications/export", Tag: "Reports", Summary: "Export every resident's notification preferences as CSV, with when and by whom they last changed", Params: []apiParam{localeParam}, ContentType: "text/csv"},
+	{Method: "GET", Path: "/reports/tax", Tag: "Reports", Summary: "Net, tax and gross of a fiscal year's expenses per tax rate and per category", Params: []apiParam{yearParam, refreshParam}, Response: TaxReport{}},
+	{Method: "GET", Path: "/reports/income-expense", Tag: "Reports", Summary: "Confirmed payments against expenses per category for a period, the current month by default", Params: []apiParam{startDateParam, endDateParam,
+		{Name: "format", In: "query", Type: "string", Description: "json (default) or csv"}, localeParam, refreshParam,
+	}, Response: IncomeExpenseReport{}},
+	{Method: "GET", Path: "/report-schedules", Tag: "Reports", Summary: "Get the reports emailed on a schedule, by name, each with its last run", Response: []ReportSchedule{}},
+	{Method: "POST", Path: "/report-schedules", Tag: "Reports", Summary: "Schedule a report to be emailed as CSV, PDF or XLSX (admins only)", Request: ReportSchedule{}, Status: http.StatusCreated, Response: ReportSchedule{}},
+	{Method: "GET", Path: "/report-schedules/{id}", Tag: "Reports", Summary: "Get a report schedule", Params: []apiParam{idParam}, Response: ReportSchedule{}},
+	{Method: "PUT", Path: "/report-schedules/{id}", Tag: "Reports", Summary: "Update a report schedule; its next run is worked out again from now (admins only)", Params: []apiParam{idParam}, Request: ReportSchedule{}, Response: ReportSchedule{}},
+	{Method: "DELETE", Path: "/report-schedules/{id}", Tag: "Reports", Summary: "Delete a report schedule and the log of its runs (admins only)", Params: []apiParam{idParam}, Response: resultResponse},
+	{Method: "POST", Path: "/report-schedules/{id}/run", Tag: "Reports", Summary: "Render and email the report of a schedule now, answering with the logged run (admins only)", Params: []apiParam{idParam}, Response: ReportRun{}},
+	{Method: "GET", Path: "/report-runs", Tag: "Reports", Summary: "Get the log of report runs, newest first", Params: []apiParam{
+		{Name: "schedule_id", In: "query", Type: "integer", Description: "Only the runs of this schedule"},
+		{Name: "status", In: "query", Type: "string", Description: "success, failed or missed"},
+	}, Response: []ReportRun{}},
+	{Method: "GET", Path: "/reports/budget/{year}", Tag: "Reports", Summary: "Budget against actual spending per category for a fiscal year", Params: []apiParam{budgetYearParam,
+		{Name: "format", In: "query", Type: "string", Description: "json (default) or csv"}, localeParam, refreshParam,
+	}, Response: BudgetReport{}},
+	{Method: "GET", Path: "/reports/budget/{year}/{category}", Tag: "Reports", Summary: "Budget against actual spending of a category month by month, with the expenses of each month", Params: []apiParam{budgetYearParam, budgetCategoryParam,
+		{Name: "format", In: "query", Type: "string", Description: "json (default) or csv"}, localeParam, refreshParam,
+	}, Response: BudgetDrillDown{}},
+	{Method: "GET", Path: "/reports/allocations", Tag: "Reports", Summary: "Expenses allocated to each unit per charge month of a fiscal year", Params: []apiParam{yearParam,
+		{Name: "format", In: "query", Type: "string", Description: "json (default) or csv"}, localeParam, refreshParam,
+	}, Response: AllocationReport{}},
+
+	// Notifications and reminders
+	{Method: "POST", Path: "/notify/test", Tag: "Notifications", Summary: "Send a test notification to all configured channels", Response: resultResponse},
+	{Method: "GET", Path: "/unsubscribe", Tag: "Notifications", Summary: "Stop a type of notification for the resident of a signed link from an email, answering with a page", Params: []apiParam{unsubscribeParam}, ContentType: "text/html"},
+	{Method: "POST", Path: "/unsubscribe", Tag: "Notifications", Summary: "Stop a type of notification for the resident of a signed link, for one-click unsubscribing from mail clients", Params: []apiParam{unsubscribeParam}, Response: resultResponse},
+	{Method: "POST", Path: "/reminders/overdue", Tag: "Notifications", Summary: "Remind residents without a payment in the month", Params: []apiParam{monthParam}, Response: ReminderRun{}},
+	{Method: "GET", Path: "/sms", Tag: "Notifications", Summary: "Get the SMS log with delivery status", Response: []SMSMessage{}},
+	{Method: "POST", Path: "/statements/send", Tag: "Notifications", Summary: "Email every resident their statement through a month, in the background", Params: []apiParam{
+		monthParam, {Name: "dry_run", In: "query", Type: "boolean", Description: "Report who would get a statement without sending, answering 200"},
+	}, Request: StatementMailRequest{}, Status: http.StatusAccepted, Response: StatementMailStatus{}},
+	{Method: "GET", Path: "/statements/send/status", Tag: "Notifications", Summary: "Get the progress of the last statement mailing", Response: StatementMailStatus{}},
+	{Method: "GET", Path: "/receipt-emails", Tag: "Notifications", Summary: "Get the log of receipts emailed in the background, newest first", Params: []apiParam{
+		{Name: "payment_id", In: "query", Type: "integer", Description: "Only the receipts of this payment"},
+		{Name: "status", In: "query", Type: "string", Description: "queued, sent, failed, skipped or suppressed"},
+	}, Response: []ReceiptEmail{}},
+	{Method: "GET", Path: "/receipt-emails/settings", Tag: "Notifications", Summary: "Get whether receipts are emailed as payments are created", Response: ReceiptSettings{}},
+	{Method: "PUT", Path: "/receipt-emails/settings", Tag: "Notifications", Summary: "Set whether receipts are emailed as payments are created (admins only)", Request: ReceiptSettings{}, Response: ReceiptSettings{}},
+	{Method: "GET", Path: "/email-templates", Tag: "Notifications", Summary: "Get the wording of the receipt, reminder and statement emails", Response: []EmailTemplate{}},
+	{Method: "GET", Path: "/email-templates/{name}", Tag: "Notifications", Summary: "Get the wording of an email", Params: []apiParam{emailTemplateParam}, Response: EmailTemplate{}},
+	{Method: "PUT", Path: "/email-templates/{name}", Tag: "Notifications", Summary: "Change the wording of an email; templates failing on sample data are rejected", Params: []apiParam{emailTemplateParam}, Request: RenderedEmail{}, Response: EmailTemplate{}},
+	{Method: "DELETE", Path: "/email-templates/{name}", Tag: "Notifications", Summary: "Go back to the default wording of an email", Params: []apiParam{emailTemplateParam}, Response: EmailTemplate{}},
+	{Method: "POST", Path: "/email-templates/{name}/preview", Tag: "Notifications", Summary: "Render an email against a sample resident and payment, the saved wording unless a subject or body is given", Params: []apiParam{emailTemplateParam}, Request: RenderedEmail{}, Response: RenderedEmail{}},
+
+	// Integrations
+	{Method: "POST", Path: "/integrations/sheets/sync", Tag: "Integrations", Summary: "Sync payments and expenses to Google Sheets", Response: SheetsStatus{}},
+	{Method: "GET", Path: "/integrations/sheets/status", Tag: "Integrations", Summary: "Get the status of the last Google Sheets sync", Response: SheetsStatus{}},
+	{Method: "POST", Path: "/integrations/stripe/webhook", Tag: "Integrations", Summary: "Receive Stripe webhook deliveries", Request: map[string]interface{}{}, Response: resultResponse},
+
+	// Dues
+	{Method: "POST", Path: "/dues/generate", Tag: "Dues", Summary: "Charge every resident the fee that applies to them in the month", Params: []apiParam{monthParam}, Response: map[string]interface{}{}},
+	{Method: "GET", Path: "/residents/{id}/charges", Tag: "Dues", Summary: "Get a resident's charges", Params: []apiParam{idParam}, Response: []Charge{}},
+	{Method: "GET", Path: "/residents/{id}/balance", Tag: "Dues", Summary: "Get a resident's balance", Params: []apiParam{idParam}, Response: Balance{}},
+	{Method: "GET", Path: "/residents/{id}/statement", Tag: "Dues", Summary: "Get a resident's charges and payments for a fiscal year, month by month", Params: []apiParam{idParam, yearParam, statementFormatParam}, Response: Statement{}},
+	{Method: "GET", Path: "/residents/{id}/payment-request", Tag: "Dues", Summary: "Get what a resident owes for a month, with the reference to quote and an EPC QR code to pay it by transfer", Params: []apiParam{idParam, monthParam, requestFormatParam}, Response: PaymentRequest{}},
+	{Method: "GET", Path: "/residents/{id}/fees", Tag: "Dues", Summary: "Get the fee that applied to a resident in each month, and what was charged", Params: []apiParam{
+		idParam,
+		{Name: "start_month", In: "query", Type: "string", Description: "First month as YYYY-MM, defaults to the first month of the current fiscal year"},
+		{Name: "end_month", In: "query", Type: "string", Description: "Last month as YYYY-MM, defaults to the current month"},
+	}, Response: []FeeMonth{}},
+	{Method: "GET", Path: "/residents/{id}/credits", Tag: "Dues", Summary: "Get a resident's credits and corrections", Params: []apiParam{idParam}, Response: []Credit{}},
+	{Method: "POST", Path: "/residents/{id}/credits", Tag: "Dues", Summary: "Adjust a resident's balance with a credit, or take credit back with a negative amount", Params: []apiParam{idParam}, Request: Credit{}, Status: http.StatusCreated, Response: Credit{}},
+	{Method: "GET", Path: "/residents/{id}/writeoffs", Tag: "Dues", Summary: "Get a resident's write-offs, including the reversed ones", Params: []apiParam{idParam}, Response: []WriteOff{}},
+	{Method: "POST", Path: "/residents/{id}/writeoff", Tag: "Dues", Summary: "Write off debt a resident won't pay, up to their balance; it isn't income. Audited (admins only)", Params: []apiParam{idParam}, Request: WriteOff{}, Status: http.StatusCreated, Response: WriteOff{}},
+	{Method: "DELETE", Path: "/writeoffs/{id}", Tag: "Dues", Summary: "Reverse a write-off, so the resident owes the debt again. Audited (admins only)", Params: []apiParam{idParam}, Response: resultResponse},
+	{Method: "GET", Path: "/residents/{id}/interest", Tag: "Dues", Summary: "Get the interest accrued by a resident's overdue charges", Params: []apiParam{idParam, asOfParam}, Response: ResidentInterest{}},
+	{Method: "POST", Path: "/residents/{id}/interest", Tag: "Dues", Summary: "Charge the accrued interest not charged yet, once per month", Params: []apiParam{idParam, asOfParam}, Response: ResidentInterest{}},
+	{Method: "GET", Path: "/fee-schedules", Tag: "Dues", Summary: "Get the fee schedules", Params: []apiParam{{Name: "unit", In: "query", Type: "string"}, residentParam}, Response: []FeeSchedule{}},
+	{Method: "POST", Path: "/fee-schedules", Tag: "Dues", Summary: "Create a fee schedule for a unit or resident", Request: FeeSchedule{}, Status: http.StatusCreated, Response: FeeSchedule{}},
+	{Method: "GET", Path: "/fee-schedules/{id}", Tag: "Dues", Summary: "Get a fee schedule", Params: []apiParam{idParam}, Response: FeeSchedule{}},
+	{Method: "PUT", Path: "/fee-schedules/{id}", Tag: "Dues", Summary: "Update a fee schedule", Params: []apiParam{idParam}, Request: FeeSchedule{}, Response: FeeSchedule{}},
+	{Method: "DELETE", Path: "/fee-schedules/{id}", Tag: "Dues", Summary: "Delete a fee schedule", Params: []apiParam{idParam}, Response: resultResponse},
+	{Method: "GET", Path: "/payment-plans", Tag: "Dues", Summary: "Get the payment plans with their installment schedule and derived status", Params: []apiParam{residentParam,
+		{Name: "status", In: "query", Type: "string", Description: "on_track, behind, completed or defaulted"},
+	}, Response: []PaymentPlan{}},
+	{Method: "POST", Path: "/payment-plans", Tag: "Dues", Summary: "Agree a plan of monthly installments with a resident in arrears", Request: PaymentPlan{}, Status: http.StatusCreated, Response: PaymentPlan{}},
+	{Method: "GET", Path: "/payment-plans/{id}", Tag: "Dues", Summary: "Get a payment plan", Params: []apiParam{idParam}, Response: PaymentPlan{}},
+	{Method: "PUT", Path: "/payment-plans/{id}", Tag: "Dues", Summary: "Update a payment plan, regenerating its schedule", Params: []apiParam{idParam}, Request: PaymentPlan{}, Response: PaymentPlan{}},
+	{Method: "DELETE", Path: "/payment-plans/{id}", Tag: "Dues", Summary: "Delete a payment plan", Params: []apiParam{idParam}, Response: resultResponse},
+	{Method: "GET", Path: "/assessments", Tag: "Dues", Summary: "Get the assessments, newest due first", Response: []Assessment{}},
+	{Method: "POST", Path: "/assessments", Tag: "Dues", Summary: "Create an assessment and charge each unit its share", Request: Assessment{}, Status: http.StatusCreated, Response: Assessment{}},
+	{Method: "GET", Path: "/assessments/{id}", Tag: "Dues", Summary: "Get an assessment", Params: []apiParam{idParam}, Response: Assessment{}},
+	{Method: "PUT", Path: "/assessments/{id}", Tag: "Dues", Summary: "Update an assessment and charge it anew; once paid only the name can change", Params: []apiParam{idParam}, Request: Assessment{}, Response: Assessment{}},
+	{Method: "DELETE", Path: "/assessments/{id}", Tag: "Dues", Summary: "Delete an assessment and its charges, unless paid", Params: []apiParam{idParam}, Response: resultResponse},
+	{Method: "GET", Path: "/assessments/{id}/progress", Tag: "Dues", Summary: "How much of an assessment each resident paid and still owes", Params: []apiParam{idParam}, Response: AssessmentProgress{}},
+	{Method: "GET", Path: "/fractions", Tag: "Dues", Summary: "Get the ownership fraction of every unit, in permilage", Response: []UnitFraction{}},
+	{Method: "GET", Path: "/fractions/check", Tag: "Dues", Summary: "Check that the ownership fractions add up to 1000 and cover every unit with a resident", Response: FractionCheck{}},
+	{Method: "PUT", Path: "/fractions/{unit}", Tag: "Dues", Summary: "Set the ownership fraction of a unit", Params: []apiParam{unitParam}, Request: UnitFraction{}, Response: UnitFraction{}},
+	{Method: "DELETE", Path: "/fractions/{unit}", Tag: "Dues", Summary: "Remove the ownership fraction of a unit", Params: []apiParam{unitParam}, Response: resultResponse},
+	{Method: "GET", Path: "/units/occupancy", Tag: "Dues", Summary: "Get who lives in each unit, or since when it is vacant, on a date or over a month", Params: []apiParam{
+		{Name: "on", In: "query", Type: "string", Description: "Date as YYYY-MM-DD, defaults to today"},
+		{Name: "month", In: "query", Type: "string", Description: "Month as YYYY-MM, instead of on, also counting the vacant days of each unit"},
+	}, Response: OccupancyReport{}},
+	{Method: "POST", Path: "/units/{unit}/transfer", Tag: "Dues", Summary: "Transfer a unit to a new owner, freezing or carrying over what the previous owners owe (admins only)", Params: []apiParam{unitParam}, Request: UnitTransferRequest{}, Status: http.StatusCreated, Response: UnitTransfer{}},
+	{Method: "GET", Path: "/units/{unit}/history", Tag: "Dues", Summary: "Get the ownership chain of a unit and its transfers", Params: []apiParam{unitParam}, Response: UnitHistory{}},
+	{Method: "GET", Path: "/reserve/rules", Tag: "Dues", Summary: "Get the reserve fund rules", Response: []ReserveRule{}},
+	{Method: "POST", Path: "/reserve/rules", Tag: "Dues", Summary: "Set aside a percentage of payments for the reserve fund from a date", Request: ReserveRule{}, Status: http.StatusCreated, Response: ReserveRule{}},
+	{Method: "DELETE", Path: "/reserve/rules/{id}", Tag: "Dues", Summary: "Delete a reserve fund rule", Params: []apiParam{idParam}, Response: resultResponse},
+	{Method: "POST", Path: "/reserve/recalculate", Tag: "Dues", Summary: "Apply the reserve rules to the payments of a period", Params: []apiParam{startDateParam, endDateParam,
+		{Name: "dry_run", In: "query", Type: "boolean", Description: "Only report the changes; true unless set to false"},
+	}, Response: ReserveRecalculation{}},
+	{Method: "GET", Path: "/budgets", Tag: "Expenses", Summary: "Get the budgets of a fiscal year", Params: []apiParam{yearParam}, Response: []Budget{}},
+	{Method: "PUT", Path: "/budgets/{year}/{category}", Tag: "Expenses", Summary: "Set the budget of a category for a fiscal year, with any months budgeted on their own", Params: []apiParam{budgetYearParam, budgetCategoryParam}, Request: Budget{}, Response: Budget{}},
+	{Method: "DELETE", Path: "/budgets/{year}/{category}", Tag: "Expenses", Summary: "Delete the budget of a category for a fiscal year", Params: []apiParam{budgetYearParam, budgetCategoryParam}, Response: resultResponse},
+
+	// Bank reconciliation
+	{Method: "GET", Path: "/bank-accounts", Tag: "Bank", Summary: "Get the bank accounts", Response: []BankAccount{}},
+	{Method: "POST", Path: "/bank-accounts", Tag: "Bank", Summary: "Create a bank account", Request: BankAccount{}, Status: http.StatusCreated, Response: BankAccount{}},
+	{Method: "POST", Path: "/bank-accounts/{id}/statements", Tag: "Bank", Summary: "Upload a statement CSV and match its lines to payments and expenses", Params: []apiParam{idParam}, Upload: "statementFile", Response: StatementImport{}},
+	{Method: "GET", Path: "/bank-accounts/{id}/lines", Tag: "Bank", Summary: "Get the statement lines of an account", Params: []apiParam{idParam,
+		{Name: "status", In: "query", Type: "string", Description: "unmatched, suggested, matched or discrepancy"},
+		{Name: "month", In: "query", Type: "string", Description: "Only lines of a month, as YYYY-MM"},
+	}, Response: []BankLine{}},
+	{Method: "GET", Path: "/bank-accounts/{id}/reconciliation", Tag: "Bank", Summary: "Lines matched and left unmatched in the bank and in the app for a month", Params: []apiParam{idParam, monthParam}, Response: ReconciliationReport{}},
+	{Method: "POST", Path: "/bank-lines/{id}/review", Tag: "Bank", Summary: "Confirm a line's match, create its missing entry, flag a discrepancy or reject the match", Params: []apiParam{idParam}, Request: BankLineReview{}, Response: BankLine{}},
+	{Method: "GET", Path: "/payment-details", Tag: "Bank", Summary: "Get the account residents pay into", Response: PaymentDetails{}},
+	{Method: "PUT", Path: "/payment-details", Tag: "Bank", Summary: "Set the account residents pay into (admins only)", Request: PaymentDetails{}, Response: PaymentDetails{}},
+
+	// Announcements
+	{Method: "GET", Path: "/announcements", Tag: "Announcements", Summary: "Get all announcements", Response: []Announcement{}},
+	{Method: "POST", Path: "/announcements", Tag: "Announcements", Summary: "Create an announcement", Request: Announcement{}, Status: http.StatusCreated, Response: Announcement{}},
+	{Method: "PUT", Path: "/announcements/{id}", Tag: "Announcements", Summary: "Update an announcement", Params: []apiParam{idParam}, Request: Announcement{}, Response: Announcement{}},
+	{Method: "DELETE", Path: "/announcements/{id}", Tag: "Announcements", Summary: "Delete an announcement", Params: []apiParam{idParam}, Response: resultResponse},
+	{Method: "GET", Path: "/expiries", Tag: "Expiries", Summary: "Get the documents, leases and fee schedules running out soon, soonest first", Params: []apiParam{
+		{Name: "within_days", In: "query", Type: "integer", Description: "Days ahead to look, 90 by default"},
+	}, Response: []Expiry{}},
+	{Method: "PUT", Path: "/expiries/{item}/suppress", Tag: "Expiries", Summary: "Let an item lapse without reminders", Params: []apiParam{expiryItemParam}, Request: ExpirySuppression{}, Response: resultResponse},
+	{Method: "DELETE", Path: "/expiries/{item}/suppress", Tag: "Expiries", Summary: "Remind of an item again", Params: []apiParam{expiryItemParam}, Response: resultResponse},
+	{Method: "GET", Path: "/documents", Tag: "Expiries", Summary: "Get the contracts, insurance certificates, inspections and other documents that run out", Response: []Document{}},
+	{Method: "POST", Path: "/documents", Tag: "Expiries", Summary: "Create a document", Request: Document{}, Status: http.StatusCreated, Response: Document{}},
+	{Method: "PUT", Path: "/documents/{id}", Tag: "Expiries", Summary: "Update a document, such as to the expiry date of a renewal", Params: []apiParam{idParam}, Request: Document{}, Response: Document{}},
+	{Method: "DELETE", Path: "/documents/{id}", Tag: "Expiries", Summary: "Delete a document", Params: []apiParam{idParam}, Response: resultResponse},
+	{Method: "GET", Path: "/incidents", Tag: "Incidents", Summary: "Get the incidents, newest first, with their total cost", Params: []apiParam{
+		{Name: "status", In: "query", Type: "string", Description: "open or resolved"},
+		{Name: "severity", In: "query", Type: "string", Description: "low, medium, high or critical"},
+		startDateParam, endDateParam,
+	}, Response: []Incident{}},
+	{Method: "POST", Path: "/incidents", Tag: "Incidents", Summary: "Create an incident", Request: Incident{}, Status: http.StatusCreated, Response: IncidentDetails{}},
+	{Method: "GET", Path: "/incidents/{id}", Tag: "Incidents", Summary: "Get an incident with its expenses and attachments, or its report for the insurer as a PDF", Params: []apiParam{idParam, statementFormatParam}, Response: IncidentDetails{}},
+	{Method: "PUT", Path: "/incidents/{id}", Tag: "Incidents", Summary: "Update an incident, replacing its linked expenses", Params: []apiParam{idParam}, Request: Incident{}, Response: IncidentDetails{}},
+	{Method: "DELETE", Path: "/incidents/{id}", Tag: "Incidents", Summary: "Delete an incident, keeping its expenses", Params: []apiParam{idParam}, Response: resultResponse},
+	{Method: "GET", Path: "/maintenance-requests", Tag: "Maintenance Requests", Summary: "Get the maintenance requests, newest first", Params: []apiParam{
+		{Name: "status", In: "query", Type: "string", Description: "open, in_progress or closed"},
+		{Name: "resident_id", In: "query", Type: "integer", Description: "Only those of this resident"},
+	}, Response: []MaintenanceRequest{}},
+	{Method: "POST", Path: "/maintenance-requests", Tag: "Maintenance Requests", Summary: "Enter a maintenance request by hand", Request: MaintenanceRequest{}, Status: http.StatusCreated, Response: MaintenanceRequest{}},
+	{Method: "POST", Path: "/maintenance-requests/inbound", Tag: "Maintenance Requests", Summary: "Make a maintenance request of an email forwarded by a mail-to-webhook service, sent as the raw message or in the email or body-mime form field; an email received again answers 200 with its request's id", Params: []apiParam{
+		{Name: "token", In: "query", Type: "string", Description: "The inbound mail secret, unless in the X-Inbound-Token header"},
+	}, Status: http.StatusCreated, Response: MaintenanceRequest{}},
+	{Method: "GET", Path: "/maintenance-requests/{id}", Tag: "Maintenance Requests", Summary: "Get a maintenance request", Params: []apiParam{idParam}, Response: MaintenanceRequest{}},
+	{Method: "PUT", Path: "/maintenance-requests/{id}", Tag: "Maintenance Requests", Summary: "Update a maintenance request, such as to close it", Params: []apiParam{idParam}, Request: MaintenanceRequest{}, Response: MaintenanceRequest{}},
+	{Method: "DELETE", Path: "/maintenance-requests/{id}", Tag: "Maintenance Requests", Summary: "Delete a maintenance request", Params: []apiParam{idParam}, Response: resultResponse},
+	{Method: "POST", Path: "/maintenance-requests/{id}/tasks", Tag: "Tasks", Summary: "Create a task to follow up a maintenance request, linked to it", Params: []apiParam{idParam}, Request: Task{}, Status: http.StatusCreated, Response: Task{}},
+	{Method: "POST", Path: "/incidents/{id}/tasks", Tag: "Tasks", Summary: "Create a task to follow up an incident, linked to it", Params: []apiParam{idParam}, Request: Task{}, Status: http.StatusCreated, Response: Task{}},
+	{Method: "GET", Path: "/tasks", Tag: "Tasks", Summary: "Get the tasks, soonest due first", Params: []apiParam{
+		{Name: "status", In: "query", Type: "string", Description: "open or done"},
+		{Name: "overdue", In: "query", Type: "boolean", Description: "Only the open tasks past their due date"},
+		{Name: "assignee_user_id", In: "query", Type: "string", Description: "The assignee's user id, or me for the signed-in user"},
+		{Name: "entity_type", In: "query", Type: "string", Description: "incident, maintenance_request, document, expense, resident or announcement"},
+		{Name: "entity_id", In: "query", Type: "integer", Description: "The id of the linked record"},
+	}, Response: []Task{}},
+	{Method: "POST", Path: "/tasks", Tag: "Tasks", Summary: "Create a task", Request: Task{}, Status: http.StatusCreated, Response: Task{}},
+	{Method: "GET", Path: "/tasks/{id}", Tag: "Tasks", Summary: "Get a task", Params: []apiParam{idParam}, Response: Task{}},
+	{Method: "PUT", Path: "/tasks/{id}", Tag: "Tasks", Summary: "Update a task, such as to mark it done", Params: []apiParam{idParam}, Request: Task{}, Response: Task{}},
+	{Method: "DELETE", Path: "/tasks/{id}", Tag: "Tasks", Summary: "Delete a task", Params: []apiParam{idParam}, Response: resultResponse},
+
+	// Attachments
+	{Method: "GET", Path: "/payments/{id}/attachments", Tag: "Attachments", Summary: "Get the files attached to a payment", Params: []apiParam{idParam}, Response: []Attachment{}},
+	{Method: "POST", Path: "/payments/{id}/attachments", Tag: "Attachments", Summary: "Attach a file to a payment: PDF, image or plain text", Params: []apiParam{idParam}, Upload: "attachmentFile", Status: http.StatusCreated, Response: Attachment{}},
+	{Method: "GET", Path: "/expenses/{id}/attachments", Tag: "Attachments", Summary: "Get the files attached to an expense", Params: []apiParam{idParam}, Response: []Attachment{}},
+	{Method: "POST", Path: "/expenses/{id}/attachments", Tag: "Attachments", Summary: "Attach a file to an expense: PDF, image or plain text", Params: []apiParam{idParam}, Upload: "attachmentFile", Status: http.StatusCreated, Response: Attachment{}},
+	{Method: "GET", Path: "/incidents/{id}/attachments", Tag: "Attachments", Summary: "Get the files attached to an incident", Params: []apiParam{idParam}, Response: []Attachment{}},
+	{Method: "POST", Path: "/incidents/{id}/attachments", Tag: "Attachments", Summary: "Attach a file to an incident, such as a photo of the damage: PDF, image or plain text", Params: []apiParam{idParam}, Upload: "attachmentFile", Status: http.StatusCreated, Response: Attachment{}},
+	{Method: "GET", Path: "/maintenance-requests/{id}/attachments", Tag: "Attachments", Summary: "Get the files attached to a maintenance request", Params: []apiParam{idParam}, Response: []Attachment{}},
+	{Method: "POST", Path: "/maintenance-requests/{id}/attachments", Tag: "Attachments", Summary: "Attach a file to a maintenance request: PDF, image or plain text", Params: []apiParam{idParam}, Upload: "attachmentFile", Status: http.StatusCreated, Response: Attachment{}},
+	{Method: "GET", Path: "/attachments/usage", Tag: "Attachments", Summary: "Get the storage used by attachments and the quota", Response: AttachmentUsage{}},
+	{Method: "GET", Path: "/attachments/{id}", Tag: "Attachments", Summary: "Get an attachment's details", Params: []apiParam{idParam}, Response: Attachment{}},
+	{Method: "DELETE", Path: "/attachments/{id}", Tag: "Attachments", Summary: "Delete an attachment", Params: []apiParam{idParam}, Response: resultResponse},
+	{Method: "GET", Path: "/attachments/{id}/download", Tag: "Attachments", Summary: "Download an attachment, with range support", Params: []apiParam{idParam}, ContentType: "application/octet-stream"},
+
+	// Custom fields
+	{Method: "GET", Path: "/custom-fields", Tag: "Custom Fields", Summary: "Get the custom fields of residents", Response: []CustomField{}},
+	{Method: "POST", Path: "/custom-fields", Tag: "Custom Fields", Summary: "Define a custom field: text, number, date or bool", Request: CustomField{}, Status: http.StatusCreated, Response: CustomField{}},
+	{Method: "GET", Path: "/custom-fields/{id}", Tag: "Custom Fields", Summary: "Get a custom field", Params: []apiParam{idParam}, Response: CustomField{}},
+	{Method: "PUT", Path: "/custom-fields/{id}", Tag: "Custom Fields", Summary: "Update a custom field; key and type only while it has no values", Params: []apiParam{idParam}, Request: CustomField{}, Response: CustomField{}},
+	{Method: "DELETE", Path: "/custom-fields/{id}", Tag: "Custom Fields", Summary: "Delete a custom field and its values", Params: []apiParam{idParam,
+		{Name: "confirm", In: "query", Type: "boolean", Description: "Required when residents have values for the field, which are deleted with it"}}, Response: map[string]interface{}{}},
+
+	// Resident portal
+	{Method: "POST", Path: "/residents/{id}/portal-token", Tag: "Portal", Summary: "Create a portal link for a resident", Params: []apiParam{idParam}, Request: struct {
+		ExpiresInDays int `json:"expires_in_days"`
+	}{}, Status: http.StatusCreated, Response: PortalToken{}},
+	{Method: "GET", Path: "/residents/{id}/portal-tokens", Tag: "Portal", Summary: "List a resident's portal tokens", Params: []apiParam{idParam}, Response: []PortalToken{}},
+	{Method: "DELETE", Path: "/portal-tokens/{id}", Tag: "Portal", Summary: "Revoke a portal token", Params: []apiParam{idParam}, Response: resultResponse},
+	{Method: "GET", Path: "/portal/me", Tag: "Portal", Summary: "The token's resident", Response: Resident{}, Portal: true},
+	{Method: "GET", Path: "/portal/payments", Tag: "Portal", Summary: "The resident's payments", Response: []Payment{}, Portal: true},
+	{Method: "GET", Path: "/portal/balance", Tag: "Portal", Summary: "The resident's balance", Response: Balance{}, Portal: true},
+	{Method: "GET", Path: "/portal/statement", Tag: "Portal", Summary: "The resident's statement for a fiscal year", Params: []apiParam{yearParam, statementFormatParam}, Response: Statement{}, Portal: true},
+	{Method: "GET", Path: "/portal/payment-request", Tag: "Portal", Summary: "What the resident owes for a month and how to pay it", Params: []apiParam{monthParam, requestFormatParam}, Response: PaymentRequest{}, Portal: true},
+	{Method: "GET", Path: "/portal/announcements", Tag: "Portal", Summary: "Public announcements", Response: []Announcement{}, Portal: true},
+
+	// Condos; the other endpoints are also served per condo under /condos/{id}
+	{Method: "GET", Path: "/condos", Tag: "Condos", Summary: "Get the condominiums managed by the instance (admins only)", Response: []Condo{}},
+	{Method: "POST", Path: "/condos", Tag: "Condos", Summary: "Create a condominium with its own empty database (admins only)", Request: Condo{}, Status: http.StatusCreated, Response: Condo{}},
+	{Method: "GET", Path: "/condos/{id}", Tag: "Condos", Summary: "Get a condominium (admins only)", Params: []apiParam{idParam}, Response: Condo{}},
+	{Method: "GET", Path: "/users/{id}/condos", Tag: "Condos", Summary: "Get the condominiums other than the default one a user may reach; admins reach them all (admins only)", Params: []apiParam{idParam}, Response: []Condo{}},
+	{Method: "POST", Path: "/users/{id}/condos", Tag: "Condos", Summary: "Give a user access to a condominium other than the default one (admins only)", Params: []apiParam{idParam}, Request: CondoGrant{}, Status: http.StatusCreated, Response: Condo{}},
+	{Method: "DELETE", Path: "/users/{id}/condos/{condo_id}", Tag: "Condos", Summary: "Take a user's access to a condominium away (admins only)", Params: []apiParam{idParam, condoIDParam}, Response: resultResponse},
+
+	// Documentation
+	{Method: "GET", Path: "/config", Tag: "Settings", Summary: "Timezone, current date, currency and current fiscal year", Response: map[string]interface{}{}},
+	{Method: "GET", Path: "/openapi.json", Tag: "Documentation", Summary: "This OpenAPI specification", Response: map[string]interface{}{}},
+	{Method: "GET", Path: "/docs", Tag: "Documentation", Summary: "Interactive API documentation", ContentType: "text/html"},
+}
+
+// openAPISpec builds the OpenAPI 3 document from apiOperations
+func openAPISpec() map[string]interface{} {
+	schemas := map[string]interface{}{}
+	schemas["Error"] = map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"error":   map[string]interface{}{"type": "string"},
+			"code":    map[string]interface{}{"type": "string"},
+			"details": schemaFor(reflect.TypeOf(ValidationErrors{}), schemas),
+		},
+	}
+
+	paths := map[string]interface{}{}
+	for _, op := range apiOperations {
+		operation := map[string]interface{}{
+			"tags":    []string{op.Tag},
+			"summary": op.Summary,
+		}
+
+		if len(op.Params) > 0 {
+			params := []interface{}{}
+			for _, p := range op.Params {
+				param := map[string]interface{}{
+					"name":     p.Name,
+					"in":       p.In,
+					"required": p.Required,
+					"schema":   map[string]interface{}{"type": p.Type},
+				}
+				if p.Description != "" {
+					param["description"] = p.Description
+				}
+				params = append(params, param)
+			}
+			operation["parameters"] = params
+		}
+
+		if op.Request != nil {
+			operation["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content": map[string]interface{}{
+					"application/json": map[string]interface{}{"schema": schemaFor(reflect.TypeOf(op.Request), schemas)},
+				},
+			}
+		}
+		if op.Upload != "" {
+			properties := make(map[string]interface{})
+			for _, field := range strings.Split(op.Upload, ",") {
+				properties[field] = map[string]interface{}{"type": "string", "format": "binary"}
+			}
+			operation["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content": map[string]interface{}{
+					"multipart/form-data": map[string]interface{}{"schema": map[string]interface{}{
+						"type":       "object",
+						"properties": properties,
+					}},
+				},
+			}
+		}
+
+		status := op.Status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		success := map[string]interface{}{"description": http.StatusText(status)}
+		if op.ContentType != "" {
+			success["content"] = map[string]interface{}{
+				op.ContentType: map[string]interface{}{"schema": map[string]interface{}{"type": "string"}},
+			}
+		} else if op.Response != nil {
+			success["content"] = map[string]interface{}{
+				"application/json": map[string]interface{}{"schema": schemaFor(reflect.TypeOf(op.Response), schemas)},
+			}
+		}
+		operation["responses"] = map[string]interface{}{
+			fmt.Sprint(status): success,
+			"default": map[string]interface{}{
+				"description": "Error",
+				"content": map[string]interface{}{
+					"application/json": map[string]interface{}{"schema": map[string]interface{}{"$ref": "#/components/schemas/Error"}},
+				},
+			},
+		}
+
+		if op.Portal {
+			operation["security"] = []interface{}{map[string]interface{}{"portalToken": []string{}}}
+		}
+
+		item, ok := paths[op.Path].(map[string]interface{})
+		if !ok {
+			item = map[string]interface{}{}
+			paths[op.Path] = item
+		}
+		item[strings.ToLower(op.Method)] = operation
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "Condo Manager API",
+			"version": Version,
+		},
+		"servers": []interface{}{map[string]interface{}{"url": "/api/v1"}},
+		"paths":   paths,
+		"components": map[string]interface{}{
+			"schemas": schemas,
+			"securitySchemes": map[string]interface{}{
+				"portalToken": map[string]interface{}{"type": "http", "scheme": "bearer"},
+			},
+		},
+	}
+}
+
+var (
+	timeType       = reflect.TypeOf(time.Time{})
+	rawMessageType = reflect.TypeOf(json.RawMessage{})
+)
+
+// schemaFor returns the JSON schema of t. Named structs are added to schemas
+// and referenced, anonymous ones are inlined.
+func schemaFor(t reflect.Type, schemas map[string]interface{}) map[string]interface{} {
+	if t == timeType {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+	if t == rawMessageType {
+		return map[string]interface{}{} // any JSON value
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		schema := schemaFor(t.Elem(), schemas)
+		if _, isRef := schema["$ref"]; isRef {
+			return map[string]interface{}{"allOf": []interface{}{schema}, "nullable": true}
+		}
+		schema["nullable"] = true
+		return schema
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice:
+		return map[string]interface{}{"type": "array", "items": schemaFor(t.Elem(), schemas)}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": schemaFor(t.Elem(), schemas)}
+	case reflect.Interface:
+		return map[string]interface{}{}
+	case reflect.Struct:
+		if t.Name() != "" {
+			if _, ok := schemas[t.Name()]; !ok {
+				// Reserve the name first so self-referencing types terminate
+				schemas[t.Name()] = nil
+				schemas[t.Name()] = structSchema(t, schemas)
+			}
+			return map[string]interface{}{"$ref": "#/components/schemas/" + t.Name()}
+		}
+		return structSchema(t, schemas)
+	}
+	return map[string]interface{}{}
+}
+
+func structSchema(t reflect.Type, schemas map[string]interface{}) map[string]interface{} {
+	properties := map[string]interface{}{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" || !field.IsExported() {
+			continue
+		}
+		properties[name] = schemaFor(field.Type, schemas)
+	}
+	return map[string]interface{}{"type": "object", "properties": properties}
+}
+
+// Serve the OpenAPI specification
+func serveOpenAPI(w http.ResponseWriter, r *http.Request) {
+	respondWithJSON(w, http.StatusOK, openAPISpec())
+}
+
+// Serve the interactive API documentation page
+func serveAPIDocs(w http.ResponseWriter, r *http.Request) {
+	serveEmbedded(w, r, "static/docs.html")
+}
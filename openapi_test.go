@@ -0,0 +1,67 @@
+package condomngr
+
+import (
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+var routeVarPattern = regexp.MustCompile(`\{(\w+):[^}]+\}`)
+
+// TestAPIDocsCoverEveryRoute walks the router, condo routes included, and
+// checks every API route is in apiOperations
+func TestAPIDocsCoverEveryRoute(t *testing.T) {
+	db, err := OpenDB(filepath.Join(t.TempDir(), "condo.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	server, err := NewServer(db, Options{Condos: NewCondos(db, nil)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	documented := map[string]bool{}
+	for _, op := range apiOperations {
+		documented[op.Method+" "+op.Path] = true
+	}
+	routes := 0
+	err = server.handler.(*mux.Router).Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		path, err := route.GetPathTemplate()
+		if err != nil {
+			return nil
+		}
+		// Documented paths are relative to the API prefix
+		switch {
+		case strings.HasPrefix(path, "/api/v1/"):
+			path = strings.TrimPrefix(path, "/api/v1")
+		case strings.HasPrefix(path, "/api/"):
+			path = strings.TrimPrefix(path, "/api")
+		default:
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			// Subrouters and prefixes have no methods of their own
+			return nil
+		}
+		path = routeVarPattern.ReplaceAllString(path, "{$1}")
+		for _, method := range methods {
+			routes++
+			if !documented[method+" "+path] {
+				t.Errorf("%s %s is missing from the OpenAPI specification", method, path)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if routes == 0 {
+		t.Fatal("no API routes walked")
+	}
+}
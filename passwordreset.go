@@ -0,0 +1,310 @@
+package condomngr
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// passwordResetTTL is how long a password reset link works
+const passwordResetTTL = time.Hour
+
+// passwordResetInterval is the least time between two reset emails to the
+// same user, so the request endpoint can't be used to flood an inbox
+const passwordResetInterval = 5 * time.Minute
+
+// Default templates of the password reset email, executed with
+// passwordResetMailData
+const (
+	defaultPasswordResetSubject = "Reset your condomngr password"
+	defaultPasswordResetBody    = `Hello {{.Username}},
+
+Someone asked to reset your condomngr password. To choose a new one, open
+this link within {{.Minutes}} minutes:
+
+{{.URL}}
+
+If it wasn't you, ignore this email: your password stays the same.
+`
+)
+
+// passwordResetMailData is what the password reset templates can use
+type passwordResetMailData struct {
+	Username string
+	URL      string
+	Minutes  int
+}
+
+// PasswordResetRequest asks for a password reset link, by username or email
+type PasswordResetRequest struct {
+	Username string `json:"username"`
+	Email    string `json:"email"`
+}
+
+// PasswordResetConfirm sets a new password with the token of a reset link
+type PasswordResetConfirm struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+// PasswordResets emails users links to set a new password. Only the hash of
+// their tokens is stored, and each works once.
+type PasswordResets struct {
+	db      *sql.DB
+	mailer  *Mailer
+	apiURL  string
+	limiter *rateLimiter
+}
+
+// NewPasswordResets creates the password resets of the users in db, with
+// links to the API at apiURL, see condoAPIURL
+func NewPasswordResets(db *sql.DB, mailer *Mailer, apiURL string) *PasswordResets {
+	return &PasswordResets{
+		db:      db,
+		mailer:  mailer,
+		apiURL:  strings.TrimRight(apiURL, "/"),
+		limiter: newRateLimiter(1, 3),
+	}
+}
+
+// URL is the link of the reset with token
+func (p *PasswordResets) URL(token string) string {
+	return p.apiURL + "/password-reset/confirm?token=" + url.QueryEscape(token)
+}
+
+// Send emails a reset link to the enabled users matching req that have an
+// email address, unless one was sent to them lately. It is run after the
+// request was answered, so its time doesn't tell whether a user exists.
+func (p *PasswordResets) Send(req PasswordResetRequest, r *http.Request) {
+	rows, err := p.db.Query(`
+		SELECT `+userColumns+` FROM users
+		WHERE disabled = 0 AND email != '' AND (? = '' OR username = ?) AND (? = '' OR email = ? COLLATE NOCASE)
+		AND NOT EXISTS (SELECT 1 FROM password_resets WHERE user_id = users.id AND created_at > ?)
+	`, req.Username, req.Username, req.Email, req.Email, time.Now().UTC().Add(-passwordResetInterval))
+	if err != nil {
+		log.Printf("Failed to look up a password reset: %v", err)
+		return
+	}
+	var users []User
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			log.Printf("Failed to look up a password reset: %v", err)
+			break
+		}
+		users = append(users, user)
+	}
+	rows.Close()
+
+	for _, user := range users {
+		if !p.mailer.Enabled() {
+			log.Printf("Password reset requested for %s, but email is not configured", user.Username)
+			continue
+		}
+		if err := p.send(user, r); err != nil {
+			log.Printf("Failed to send the password reset of %s: %v", user.Username, err)
+		}
+	}
+}
+
+// send stores a new reset for user and emails its link
+func (p *PasswordResets) send(user User, r *http.Request) error {
+	subjectTemplate, bodyTemplate, err := loadEmailTemplate(p.db, "password_reset", "")
+	if err != nil {
+		return err
+	}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	now := time.Now().UTC()
+	if _, err := p.db.Exec("INSERT INTO password_resets(user_id, token_hash, created_at, expires_at) VALUES(?, ?, ?, ?)",
+		user.ID, hashToken(token), now, now.Add(passwordResetTTL)); err != nil {
+		return err
+	}
+	if err := recordAudit(p.db, r, AuditPasswordResetRequested, "user "+user.Username, ""); err != nil {
+		return err
+	}
+	subject, body, err := renderEmail(subjectTemplate, bodyTemplate, passwordResetMailData{
+		Username: user.Username,
+		URL:      p.URL(token),
+		Minutes:  int(passwordResetTTL / time.Minute),
+	})
+	if err != nil {
+		return err
+	}
+	return p.mailer.Send(user.Email, subject, body)
+}
+
+// Confirm sets the password of the user of an unused, unexpired token. The
+// token and the other links sent to the user stop working, and all their
+// sessions are signed out. It returns the user.
+func (p *PasswordResets) Confirm(token, password string) (User, error) {
+	var userID int
+	err := p.db.QueryRow(`
+		SELECT r.user_id FROM password_resets r JOIN users u ON u.id = r.user_id
+		WHERE r.token_hash = ? AND r.used_at IS NULL AND r.expires_at > ? AND u.disabled = 0
+	`, hashToken(token), time.Now().UTC()).Scan(&userID)
+	if err != nil {
+		return User{}, err
+	}
+	// Marking it used first keeps two requests from both using it
+	result, err := p.db.Exec("UPDATE password_resets SET used_at = ? WHERE user_id = ? AND used_at IS NULL", time.Now().UTC(), userID)
+	if err != nil {
+		return User{}, err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return User{}, sql.ErrNoRows
+	}
+	if err := setUserPassword(p.db, userID, password, false, ""); err != nil {
+		return User{}, err
+	}
+	return findUser(p.db, userID)
+}
+
+// valid reports whether token is an unused, unexpired reset of an enabled
+// user
+func (p *PasswordResets) valid(token string) (bool, error) {
+	var valid bool
+	err := p.db.QueryRow(`
+		SELECT EXISTS(SELECT 1 FROM password_resets r JOIN users u ON u.id = r.user_id
+		WHERE r.token_hash = ? AND r.used_at IS NULL AND r.expires_at > ? AND u.disabled = 0)
+	`, hashToken(token), time.Now().UTC()).Scan(&valid)
+	return valid, err
+}
+
+// Handlers for password reset endpoints
+
+// Ask for a password reset link by email. The answer is the same whether a
+// user matched or not; requests are limited per client IP.
+func requestPasswordReset(p *PasswordResets) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !p.limiter.Allow(clientIP(r)) {
+			w.Header().Set("Retry-After", "60")
+			respondWithError(w, http.StatusTooManyRequests, "Too many password reset requests, try again later")
+			return
+		}
+		var req PasswordResetRequest
+		if err := decodeRequest(r, &req); err != nil {
+			respondWithError(w, payloadErrorStatus(err), "Invalid request payload: "+err.Error())
+			return
+		}
+		defer r.Body.Close()
+		if req.Username == "" && req.Email == "" {
+			respondWithError(w, http.StatusBadRequest, "Give a username or an email")
+			return
+		}
+
+		go p.Send(req, r.Clone(r.Context()))
+		respondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
+	}
+}
+
+// Set a new password with the token of a reset link. The link opens a form
+// with GET, which posts here; API clients post JSON instead.
+func confirmPasswordReset(p *PasswordResets, guard *LoginGuard) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		lang := responseLanguage(w)
+		form := r.Method == http.MethodGet || strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded")
+		var req PasswordResetConfirm
+		switch {
+		case r.Method == http.MethodGet:
+			req.Token = r.URL.Query().Get("token")
+		case form:
+			if err := r.ParseForm(); err != nil {
+				respondWithError(w, http.StatusBadRequest, "Unable to parse form")
+				return
+			}
+			req.Token, req.Password = r.PostForm.Get("token"), r.PostForm.Get("password")
+		default:
+			if err := decodeRequest(r, &req); err != nil {
+				respondWithError(w, payloadErrorStatus(err), "Invalid request payload: "+err.Error())
+				return
+			}
+			defer r.Body.Close()
+		}
+
+		if r.Method == http.MethodGet {
+			valid, err := p.valid(req.Token)
+			if err != nil {
+				respondWithError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			if !valid {
+				passwordResetPage(w, lang, http.StatusBadRequest, html.EscapeString(message(lang, "invalid_password_reset_link")))
+				return
+			}
+			passwordResetPage(w, lang, http.StatusOK, passwordResetForm(lang, req.Token, ""))
+			return
+		}
+
+		var errs ValidationErrors
+		validatePassword(&errs, "password", req.Password)
+		if err := errs.Err(); err != nil {
+			if form {
+				passwordResetPage(w, lang, http.StatusBadRequest, passwordResetForm(lang, req.Token, err.Error()))
+				return
+			}
+			respondWithValidationError(w, err)
+			return
+		}
+
+		user, err := p.Confirm(req.Token, req.Password)
+		if err == sql.ErrNoRows {
+			if form {
+				passwordResetPage(w, lang, http.StatusBadRequest, html.EscapeString(message(lang, "invalid_password_reset_link")))
+				return
+			}
+			respondWithError(w, http.StatusBadRequest, "Invalid or expired password reset link")
+			return
+		}
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if err := recordAudit(p.db, r, AuditPasswordReset, "user "+user.Username, "by emailed link"); err != nil {
+			log.Printf("Failed to record the password reset of %s: %v", user.Username, err)
+		}
+		// Whoever has the email may sign in again right away
+		if _, err := guard.Clear(LoginByUsername, user.Username); err != nil {
+			log.Printf("Failed to clear the failed sign-ins of %s: %v", user.Username, err)
+		}
+
+		if form {
+			passwordResetPage(w, lang, http.StatusOK, html.EscapeString(message(lang, "password_reset_done")))
+			return
+		}
+		respondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
+	}
+}
+
+// passwordResetForm is the form of the reset with token, with an error of the
+// previous attempt
+func passwordResetForm(lang, token, problem string) string {
+	var b strings.Builder
+	if problem != "" {
+		fmt.Fprintf(&b, "<p>%s</p>", html.EscapeString(problem))
+	}
+	fmt.Fprintf(&b, `<form method="post"><input type="hidden" name="token" value="%s">`+
+		`<p><label>%s <input type="password" name="password" minlength="%d" required autocomplete="new-password"></label></p>`+
+		`<p><button type="submit">%s</button></p></form>`,
+		html.EscapeString(token), html.EscapeString(message(lang, "new_password")), minPasswordLength, html.EscapeString(message(lang, "set_password")))
+	return b.String()
+}
+
+// passwordResetPage writes an HTML page with body
+func passwordResetPage(w http.ResponseWriter, lang string, status int, body string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<!DOCTYPE html>\n<html lang=%q><head><meta charset=\"utf-8\"><title>%s</title></head><body>%s</body></html>\n",
+		lang, html.EscapeString(message(lang, "password_reset_title")), body)
+}
@@ -0,0 +1,497 @@
+package condomngr
+
+import (
+	"database/sql"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Payment plan statuses, derived from the payments matched to the installments
+const (
+	PlanOnTrack   = "on_track"
+	PlanBehind    = "behind"    // an installment is past due
+	PlanCompleted = "completed" // every installment is paid
+	PlanDefaulted = "defaulted" // planDefaultMissed installments are past due
+)
+
+var planStatuses = []string{PlanOnTrack, PlanBehind, PlanCompleted, PlanDefaulted}
+
+// planDefaultMissed is how many installments past due default a plan
+const planDefaultMissed = 3
+
+// maxPlanInstallments bounds the length of a payment plan
+const maxPlanInstallments = 120
+
+// PaymentPlan spreads what a resident in arrears owes over monthly
+// installments, the first one due on the first day of StartMonth. It doesn't
+// change their charges or balance; it tracks how they pay the debt down.
+type PaymentPlan struct {
+	ID                int               `json:"id"`
+	ResidentID        int               `json:"resident_id"`
+	TotalAmount       float64           `json:"total_amount"`
+	Installments      int               `json:"installments"`
+	InstallmentAmount float64           `json:"installment_amount"` // 0 splits total_amount evenly; the last installment takes the rest
+	StartMonth        string            `json:"start_month"`        // YYYY-MM
+	Status            string            `json:"status"`
+	Paid              float64           `json:"paid"`
+	Remaining         float64           `json:"remaining"`
+	Overdue           float64           `json:"overdue"` // unpaid part of the installments past due
+	Schedule          []PlanInstallment `json:"schedule"`
+	CreatedAt         time.Time         `json:"created_at"`
+	UpdatedAt         time.Time         `json:"updated_at"`
+}
+
+// PlanInstallment is an installment of a payment plan and how much of it the
+// resident paid. PaidDate is when it was paid in full.
+type PlanInstallment struct {
+	Number   int     `json:"number"`
+	DueDate  string  `json:"due_date"`
+	Amount   float64 `json:"amount"`
+	Paid     float64 `json:"paid"`
+	PaidDate string  `json:"paid_date"`
+}
+
+// paymentPlanConflict is returned when a resident would have two active plans
+type paymentPlanConflict string
+
+func (e paymentPlanConflict) Error() string { return string(e) }
+
+const paymentPlanColumns = "id, resident_id, total_amount, installments, installment_amount, start_month, created_at, updated_at"
+
+func scanPaymentPlan(row interface{ Scan(...interface{}) error }) (PaymentPlan, error) {
+	var p PaymentPlan
+	err := row.Scan(&p.ID, &p.ResidentID, &p.TotalAmount, &p.Installments, &p.InstallmentAmount, &p.StartMonth, &p.CreatedAt, &p.UpdatedAt)
+	return p, err
+}
+
+// active reports whether the resident is still paying the plan as agreed
+func (p PaymentPlan) active() bool {
+	return p.Status == PlanOnTrack || p.Status == PlanBehind
+}
+
+// installmentAmount is the amount of every installment but the last
+func (p PaymentPlan) installmentAmount() float64 {
+	if p.InstallmentAmount > 0 {
+		return p.InstallmentAmount
+	}
+	return roundCents(p.TotalAmount / float64(p.Installments))
+}
+
+// schedule generates the installments of the plan, one a month
+func (p PaymentPlan) schedule() []PlanInstallment {
+	start, _ := time.Parse("2006-01", p.StartMonth)
+	amount := p.installmentAmount()
+	installments := make([]PlanInstallment, p.Installments)
+	for i := range installments {
+		installments[i] = PlanInstallment{Number: i + 1, DueDate: start.AddDate(0, i, 0).Format("2006-01-02"), Amount: amount}
+	}
+	if n := len(installments); n > 0 {
+		installments[n-1].Amount = roundCents(p.TotalAmount - amount*float64(n-1))
+	}
+	return installments
+}
+
+// pay settles the installments in order with amount paid on date, and returns
+// what is left of it
+func (p *PaymentPlan) pay(amount float64, date string) float64 {
+	for i := range p.Schedule {
+		if amount < 0.005 {
+			break
+		}
+		installment := &p.Schedule[i]
+		settled := roundCents(min(amount, installment.Amount-installment.Paid))
+		if settled <= 0 {
+			continue
+		}
+		installment.Paid = roundCents(installment.Paid + settled)
+		if installment.Paid >= installment.Amount {
+			installment.PaidDate = date
+		}
+		amount = roundCents(amount - settled)
+	}
+	return amount
+}
+
+// Validation function for PaymentPlan data
+func validatePaymentPlan(db *sql.DB, p PaymentPlan) error {
+	var errs ValidationErrors
+	if p.ResidentID <= 0 {
+		errs.Add("resident_id", "resident is required")
+	} else {
+		var exists bool
+		if err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM residents WHERE id = ?)", p.ResidentID).Scan(&exists); err != nil {
+			return err
+		}
+		if !exists {
+			errs.Add("resident_id", "resident does not exist")
+		}
+	}
+	if p.TotalAmount <= 0 {
+		errs.Add("total_amount", "total_amount must be greater than zero")
+	}
+	if p.Installments < 1 || p.Installments > maxPlanInstallments {
+		errs.Add("installments", "installments must be between 1 and 120")
+	}
+	if _, err := time.Parse("2006-01", p.StartMonth); err != nil {
+		errs.Add("start_month", "start_month must be a month, YYYY-MM")
+	}
+	if p.InstallmentAmount < 0 {
+		errs.Add("installment_amount", "installment_amount must not be negative")
+	} else if p.TotalAmount > 0 && p.Installments >= 1 && p.Installments <= maxPlanInstallments {
+		amount, n := p.installmentAmount(), float64(p.Installments)
+		if roundCents(amount*(n-1)) >= p.TotalAmount || roundCents(amount*n) < p.TotalAmount {
+			errs.Add("installment_amount", "installment_amount times installments must cover total_amount, leaving a last installment")
+		}
+	}
+	return errs.Err()
+}
+
+// loadPaymentPlans returns the payment plans of a resident, or of all
+// residents when residentID is 0, with the payments up to asOf (YYYY-MM-DD)
+// matched to their installments
+func loadPaymentPlans(q querier, residentID int, asOf string) ([]PaymentPlan, error) {
+	rows, err := q.Query("SELECT "+paymentPlanColumns+" FROM payment_plans WHERE ?1 = 0 OR resident_id = ?1 ORDER BY resident_id, start_month, id", residentID)
+	if err != nil {
+		return nil, err
+	}
+	plans := []PaymentPlan{}
+	for rows.Next() {
+		p, err := scanPaymentPlan(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		p.Schedule = p.schedule()
+		plans = append(plans, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for start := 0; start < len(plans); {
+		end := start + 1
+		for end < len(plans) && plans[end].ResidentID == plans[start].ResidentID {
+			end++
+		}
+		if err := matchPlanPayments(q, plans[start:end], asOf); err != nil {
+			return nil, err
+		}
+		start = end
+	}
+	return plans, nil
+}
+
+// matchPlanPayments matches the payments of a resident to the installments of
+// their plans, sorted by start month, and derives the status of the plans as
+// of asOf. From the start of the first plan, each payment and credit first
+// settles the charges due by its date, as the resident keeps owing their
+// dues; what is left pays the installments of the earliest plan started by
+// then, oldest first.
+func matchPlanPayments(q querier, plans []PaymentPlan, asOf string) error {
+	residentID, start := plans[0].ResidentID, plans[0].StartMonth+"-01"
+
+	var charges []Charge
+	rows, err := q.Query(`
+		SELECT amount, substr(due_date, 1, 10) AS date FROM charges
+		WHERE resident_id = ?1 AND substr(due_date, 1, 10) BETWEEN ?2 AND ?3
+		UNION ALL
+		SELECT -amount, credit_date FROM credits
+		WHERE resident_id = ?1 AND amount < 0 AND credit_date BETWEEN ?2 AND ?3
+		ORDER BY date
+	`, residentID, start, asOf)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var c Charge
+		if err := rows.Scan(&c.Amount, &c.DueDate); err != nil {
+			rows.Close()
+			return err
+		}
+		charges = append(charges, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	var payments []Payment
+	rows, err = q.Query(`
+		SELECT amount, substr(payment_date, 1, 10) AS date FROM payments
+		WHERE resident_id = ?1 AND status = ?4 AND substr(payment_date, 1, 10) BETWEEN ?2 AND ?3
+		UNION ALL
+		SELECT amount, credit_date FROM credits
+		WHERE resident_id = ?1 AND amount > 0 AND credit_date BETWEEN ?2 AND ?3
+		ORDER BY date
+	`, residentID, start, asOf, PaymentStatusConfirmed)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var p Payment
+		if err := rows.Scan(&p.Amount, &p.PaymentDate); err != nil {
+			rows.Close()
+			return err
+		}
+		payments = append(payments, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	next, owed := 0, 0.0
+	for _, payment := range payments {
+		for next < len(charges) && charges[next].DueDate <= payment.PaymentDate {
+			owed = roundCents(owed + charges[next].Amount)
+			next++
+		}
+		settled := max(min(payment.Amount, owed), 0)
+		owed = roundCents(owed - settled)
+		left := roundCents(payment.Amount - settled)
+		for i := range plans {
+			if left < 0.005 || plans[i].StartMonth+"-01" > payment.PaymentDate {
+				break
+			}
+			left = plans[i].pay(left, payment.PaymentDate)
+		}
+	}
+
+	for i := range plans {
+		p := &plans[i]
+		missed := 0
+		for _, installment := range p.Schedule {
+			p.Paid = roundCents(p.Paid + installment.Paid)
+			if installment.DueDate < asOf && installment.Paid < installment.Amount {
+				missed++
+				p.Overdue = roundCents(p.Overdue + installment.Amount - installment.Paid)
+			}
+		}
+		p.Remaining = roundCents(p.TotalAmount - p.Paid)
+		switch {
+		case p.Remaining < 0.005:
+			p.Status = PlanCompleted
+		case missed >= planDefaultMissed:
+			p.Status = PlanDefaulted
+		case missed > 0:
+			p.Status = PlanBehind
+		default:
+			p.Status = PlanOnTrack
+		}
+	}
+	return nil
+}
+
+// findPaymentPlan returns the plan with id as of today, or sql.ErrNoRows
+func findPaymentPlan(q querier, id int, cal calendar) (PaymentPlan, error) {
+	var residentID int
+	if err := q.QueryRow("SELECT resident_id FROM payment_plans WHERE id = ?", id).Scan(&residentID); err != nil {
+		return PaymentPlan{}, err
+	}
+	plans, err := loadPaymentPlans(q, residentID, cal.today())
+	if err != nil {
+		return PaymentPlan{}, err
+	}
+	for _, p := range plans {
+		if p.ID == id {
+			return p, nil
+		}
+	}
+	return PaymentPlan{}, sql.ErrNoRows
+}
+
+// savePaymentPlan inserts p, or updates it when it has an ID, unless its
+// resident has another active plan. It returns sql.ErrNoRows when updating a
+// plan that doesn't exist.
+func savePaymentPlan(db *sql.DB, p *PaymentPlan, cal calendar) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	others, err := loadPaymentPlans(tx, p.ResidentID, cal.today())
+	if err != nil {
+		return err
+	}
+	for _, other := range others {
+		if other.ID != p.ID && other.active() {
+			return paymentPlanConflict("Resident already has an active payment plan")
+		}
+	}
+
+	amount := p.installmentAmount()
+	if p.ID == 0 {
+		result, err := tx.Exec("INSERT INTO payment_plans(resident_id, total_amount, installments, installment_amount, start_month) VALUES(?, ?, ?, ?, ?)",
+			p.ResidentID, p.TotalAmount, p.Installments, amount, p.StartMonth)
+		if err != nil {
+			return err
+		}
+		id, err := result.LastInsertId()
+		if err != nil {
+			return err
+		}
+		p.ID = int(id)
+	} else {
+		result, err := tx.Exec("UPDATE payment_plans SET resident_id = ?, total_amount = ?, installments = ?, installment_amount = ?, start_month = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?",
+			p.ResidentID, p.TotalAmount, p.Installments, amount, p.StartMonth, p.ID)
+		if err != nil {
+			return err
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			return sql.ErrNoRows
+		}
+	}
+
+	saved, err := findPaymentPlan(tx, p.ID, cal)
+	if err != nil {
+		return err
+	}
+	*p = saved
+	return tx.Commit()
+}
+
+// Handlers for payment plan endpoints
+
+// Get the payment plans with their schedule and status, optionally of a
+// resident or with a status
+func getPaymentPlans(db *sql.DB, cal calendar) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := checkQueryParams(r, "resident_id", "status"); err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		residentID := 0
+		if value := r.URL.Query().Get("resident_id"); value != "" {
+			var err error
+			if residentID, err = strconv.Atoi(value); err != nil {
+				respondWithError(w, http.StatusBadRequest, "Invalid resident ID")
+				return
+			}
+		}
+		status := r.URL.Query().Get("status")
+		if status != "" && !slices.Contains(planStatuses, status) {
+			respondWithError(w, http.StatusBadRequest, "Invalid status, must be on_track, behind, completed or defaulted")
+			return
+		}
+
+		plans, err := loadPaymentPlans(db, residentID, cal.today())
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if status != "" {
+			plans = slices.DeleteFunc(plans, func(p PaymentPlan) bool { return p.Status != status })
+		}
+		respondWithJSON(w, http.StatusOK, plans)
+	}
+}
+
+func getPaymentPlan(db *sql.DB, cal calendar) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id, err := strconv.Atoi(vars["id"])
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid payment plan ID")
+			return
+		}
+
+		p, err := findPaymentPlan(db, id, cal)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				respondWithError(w, http.StatusNotFound, "Payment plan not found")
+				return
+			}
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		respondWithJSON(w, http.StatusOK, p)
+	}
+}
+
+// respondWithSavedPaymentPlan saves p and responds with it, or with why it
+// couldn't be saved
+func respondWithSavedPaymentPlan(w http.ResponseWriter, db *sql.DB, p PaymentPlan, status int, cal calendar) {
+	if err := validatePaymentPlan(db, p); err != nil {
+		respondWithValidationError(w, err)
+		return
+	}
+	err := savePaymentPlan(db, &p, cal)
+	if conflict, ok := err.(paymentPlanConflict); ok {
+		respondWithError(w, http.StatusConflict, conflict.Error())
+		return
+	}
+	if err == sql.ErrNoRows {
+		respondWithError(w, http.StatusNotFound, "Payment plan not found")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	respondWithJSON(w, status, p)
+}
+
+func createPaymentPlan(db *sql.DB, cal calendar) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var p PaymentPlan
+		if err := decodeRequest(r, &p); err != nil {
+			respondWithError(w, payloadErrorStatus(err), "Invalid request payload: "+err.Error())
+			return
+		}
+		defer r.Body.Close()
+
+		p.ID = 0
+		respondWithSavedPaymentPlan(w, db, p, http.StatusCreated, cal)
+	}
+}
+
+func updatePaymentPlan(db *sql.DB, cal calendar) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id, err := strconv.Atoi(vars["id"])
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid payment plan ID")
+			return
+		}
+
+		var p PaymentPlan
+		if err := decodeRequest(r, &p); err != nil {
+			respondWithError(w, payloadErrorStatus(err), "Invalid request payload: "+err.Error())
+			return
+		}
+		defer r.Body.Close()
+
+		p.ID = id
+		respondWithSavedPaymentPlan(w, db, p, http.StatusOK, cal)
+	}
+}
+
+func deletePaymentPlan(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id, err := strconv.Atoi(vars["id"])
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid payment plan ID")
+			return
+		}
+
+		result, err := db.Exec("DELETE FROM payment_plans WHERE id = ?", id)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			respondWithError(w, http.StatusNotFound, "Payment plan not found")
+			return
+		}
+
+		respondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
+	}
+}
@@ -0,0 +1,443 @@
+package condomngr
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+// Settings holding the account residents pay into
+const (
+	settingPaymentPayee = "payment_payee"
+	settingPaymentIBAN  = "payment_iban"
+	settingPaymentBIC   = "payment_bic"
+)
+
+// qrModulePixels is the size of a module of payment QR codes, in pixels
+const qrModulePixels = 8
+
+// PaymentDetails is the account residents pay into by bank transfer
+type PaymentDetails struct {
+	Payee string `json:"payee"` // the association, as the bank knows it
+	IBAN  string `json:"iban"`
+	BIC   string `json:"bic"` // optional within SEPA
+}
+
+// Configured reports whether payment requests can be made
+func (d PaymentDetails) Configured() bool {
+	return d.IBAN != ""
+}
+
+// PaymentRequest is what a resident is asked to pay for a month and how. The
+// reference is kept, so a statement line quoting it is matched with the
+// resident. The QR code is an EPC QR code, which banking apps read to fill in
+// a SEPA transfer, so only requests in euros have one.
+type PaymentRequest struct {
+	ID         int       `json:"id"`
+	ResidentID int       `json:"resident_id"`
+	Name       string    `json:"name"`
+	Unit       string    `json:"unit"`
+	Period     string    `json:"period"`  // YYYY-MM
+	Charged    float64   `json:"charged"` // charges due in the month
+	Amount     float64   `json:"amount"`  // owed by the end of the month, arrears included
+	Currency   string    `json:"currency"`
+	Reference  string    `json:"reference"` // ISO 11649 creditor reference
+	Payee      string    `json:"payee"`
+	IBAN       string    `json:"iban"`
+	BIC        string    `json:"bic,omitempty"`
+	Text       string    `json:"text"`                  // the instructions, to paste into a message
+	EPC        string    `json:"epc,omitempty"`         // content of the QR code
+	QRCodePNG  []byte    `json:"qr_code_png,omitempty"` // base64 in JSON
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// loadPaymentDetails reads the payment details from the settings
+func loadPaymentDetails(db *sql.DB) (PaymentDetails, error) {
+	var d PaymentDetails
+	for _, setting := range []struct {
+		key   string
+		value *string
+	}{{settingPaymentPayee, &d.Payee}, {settingPaymentIBAN, &d.IBAN}, {settingPaymentBIC, &d.BIC}} {
+		value, _, err := getSetting(db, setting.key)
+		if err != nil {
+			return d, err
+		}
+		*setting.value = value
+	}
+	return d, nil
+}
+
+// normalizePaymentDetails trims the payee and writes the IBAN and BIC without
+// spaces, in upper case
+func normalizePaymentDetails(d *PaymentDetails) {
+	d.Payee = strings.TrimSpace(d.Payee)
+	d.IBAN = strings.ToUpper(strings.ReplaceAll(d.IBAN, " ", ""))
+	d.BIC = strings.ToUpper(strings.ReplaceAll(d.BIC, " ", ""))
+}
+
+// Validation function for PaymentDetails data. The payee fits the 70
+// characters of an EPC QR code.
+func validatePaymentDetails(d PaymentDetails) error {
+	var errs ValidationErrors
+	if d.Payee == "" {
+		errs.Add("payee", "payee is required")
+	} else if utf8.RuneCountInString(d.Payee) > 70 {
+		errs.Add("payee", "payee must be at most 70 characters")
+	}
+	if !validIBAN(d.IBAN) {
+		errs.Add("iban", "iban is not a valid IBAN")
+	}
+	if d.BIC != "" && !validBIC(d.BIC) {
+		errs.Add("bic", "bic must be 8 or 11 letters and digits")
+	}
+	return errs.Err()
+}
+
+// mod97 is the remainder by 97 of s read as a number, its letters standing for
+// 10 (A) to 35 (Z), as IBANs and creditor references are checked. It is -1
+// when s has anything else than digits and upper case letters.
+func mod97(s string) int {
+	remainder := 0
+	for _, c := range s {
+		switch {
+		case c >= '0' && c <= '9':
+			remainder = (remainder*10 + int(c-'0')) % 97
+		case c >= 'A' && c <= 'Z':
+			remainder = (remainder*100 + int(c-'A') + 10) % 97
+		default:
+			return -1
+		}
+	}
+	return remainder
+}
+
+// validIBAN checks the length, country and check digits of an IBAN without
+// spaces, in upper case
+func validIBAN(iban string) bool {
+	if len(iban) < 15 || len(iban) > 34 {
+		return false
+	}
+	for i, c := range iban[:4] {
+		if (i < 2) != (c >= 'A' && c <= 'Z') || (i >= 2) != (c >= '0' && c <= '9') {
+			return false
+		}
+	}
+	return mod97(iban[4:]+iban[:4]) == 1
+}
+
+// validBIC checks the form of a BIC: a bank code of 4 letters, a country code
+// of 2, a location of 2 letters or digits and optionally a branch of 3
+func validBIC(bic string) bool {
+	if len(bic) != 8 && len(bic) != 11 {
+		return false
+	}
+	for i, c := range bic {
+		letter, digit := c >= 'A' && c <= 'Z', c >= '0' && c <= '9'
+		if !letter && (i < 6 || !digit) {
+			return false
+		}
+	}
+	return true
+}
+
+// creditorReference makes an ISO 11649 creditor reference of the letters and
+// digits of body, up to 21 of them: RF, two check digits and body
+func creditorReference(body string) string {
+	var b strings.Builder
+	for _, c := range strings.ToUpper(body) {
+		if (c >= 'A' && c <= 'Z' || c >= '0' && c <= '9') && b.Len() < 21 {
+			b.WriteRune(c)
+		}
+	}
+	body = b.String()
+	return fmt.Sprintf("RF%02d%s", 98-mod97(body+"RF00"), body)
+}
+
+// validCreditorReference checks the form and check digits of a creditor
+// reference without spaces, in upper case
+func validCreditorReference(ref string) bool {
+	if len(ref) < 5 || len(ref) > 25 || !strings.HasPrefix(ref, "RF") {
+		return false
+	}
+	return mod97(ref[4:]+ref[:4]) == 1
+}
+
+// creditorReferences finds what may be creditor references in the text of a
+// statement line. Banks print them in groups of four, so spaces are ignored,
+// and as the end of one is not always clear, every valid length is tried.
+func creditorReferences(text string) []string {
+	s := strings.ToUpper(strings.Join(strings.Fields(text), ""))
+	var refs []string
+	for i := strings.Index(s, "RF"); i >= 0; i = strings.Index(s, "RF") {
+		end := 2
+		for end < len(s[i:]) && end < 25 && mod97(s[i+end:i+end+1]) >= 0 {
+			end++
+		}
+		for n := end; n >= 5; n-- {
+			if validCreditorReference(s[i : i+n]) {
+				refs = append(refs, s[i:i+n])
+			}
+		}
+		s = s[i+2:]
+	}
+	return refs
+}
+
+// formatIBAN writes an IBAN in groups of four, as it is printed
+func formatIBAN(iban string) string {
+	var b strings.Builder
+	for i, c := range iban {
+		if i > 0 && i%4 == 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// epcPayload is the content of an EPC QR code (EPC069-12, version 002) for a
+// SEPA credit transfer to details, with the reference as structured
+// remittance information. Without an amount the payer fills it in.
+func epcPayload(details PaymentDetails, amount float64, reference string) string {
+	lines := []string{"BCD", "002", "1", "SCT", details.BIC, details.Payee, details.IBAN, "", "", reference}
+	if amount >= 0.01 && amount <= 999999999.99 {
+		lines[7] = fmt.Sprintf("EUR%.2f", amount)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// paymentRequestFor makes the payment request of a resident for a month
+// (YYYY-MM), keeping its reference. The reference is the unit and the month,
+// e.g. RF59101202408 for unit 101 in August 2024, unless another resident of
+// the unit has it already. It returns sql.ErrNoRows when there is no such
+// resident.
+func paymentRequestFor(db *sql.DB, details PaymentDetails, residentID int, period, currency, lang string) (PaymentRequest, error) {
+	pr := PaymentRequest{ResidentID: residentID, Period: period, Currency: currency, Payee: details.Payee, IBAN: details.IBAN, BIC: details.BIC}
+	month, err := time.Parse("2006-01", period)
+	if err != nil {
+		return pr, err
+	}
+	if err := db.QueryRow("SELECT name, unit FROM residents WHERE id = ?", residentID).Scan(&pr.Name, &pr.Unit); err != nil {
+		return pr, err
+	}
+	balance, err := residentBalanceBefore(db, residentID, month.AddDate(0, 1, 0).Format("2006-01-02"))
+	if err != nil {
+		return pr, err
+	}
+	pr.Amount = max(balance.Balance, 0)
+	if err := db.QueryRow("SELECT COALESCE(SUM(amount), 0) FROM charges WHERE resident_id = ? AND substr(due_date, 1, 7) = ?", residentID, period).Scan(&pr.Charged); err != nil {
+		return pr, err
+	}
+	pr.Charged = roundCents(pr.Charged)
+
+	tx, err := db.Begin()
+	if err != nil {
+		return pr, err
+	}
+	defer tx.Rollback()
+	err = tx.QueryRow("SELECT id, reference, created_at FROM payment_requests WHERE resident_id = ? AND period = ?", residentID, period).Scan(&pr.ID, &pr.Reference, &pr.CreatedAt)
+	switch {
+	case err == sql.ErrNoRows:
+		pr.Reference = creditorReference(pr.Unit + month.Format("200601"))
+		var taken bool
+		if err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM payment_requests WHERE reference = ?)", pr.Reference).Scan(&taken); err != nil {
+			return pr, err
+		}
+		if taken {
+			pr.Reference = creditorReference(fmt.Sprintf("R%d%s", residentID, month.Format("200601")))
+		}
+		result, err := tx.Exec("INSERT INTO payment_requests(resident_id, period, reference, amount) VALUES(?, ?, ?, ?)", residentID, period, pr.Reference, pr.Amount)
+		if err != nil {
+			return pr, err
+		}
+		id, _ := result.LastInsertId()
+		pr.ID = int(id)
+	case err != nil:
+		return pr, err
+	default:
+		if _, err := tx.Exec("UPDATE payment_requests SET amount = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?", pr.Amount, pr.ID); err != nil {
+			return pr, err
+		}
+	}
+	if err := tx.QueryRow("SELECT created_at, updated_at FROM payment_requests WHERE id = ?", pr.ID).Scan(&pr.CreatedAt, &pr.UpdatedAt); err != nil {
+		return pr, err
+	}
+	if err := tx.Commit(); err != nil {
+		return pr, err
+	}
+
+	pr.Text = paymentRequestText(pr, month, lang)
+	if currency == "EUR" {
+		pr.EPC = epcPayload(details, pr.Amount, pr.Reference)
+		modules, err := qrCode(pr.EPC)
+		if err != nil {
+			return pr, err
+		}
+		if pr.QRCodePNG, err = qrPNG(modules, qrModulePixels); err != nil {
+			return pr, err
+		}
+	}
+	return pr, nil
+}
+
+// paymentRequestText writes the instructions of a payment request in lang
+func paymentRequestText(pr PaymentRequest, month time.Time, lang string) string {
+	label := func(id string, args ...interface{}) string {
+		return fmt.Sprintf(message(lang, id), args...) + "\n"
+	}
+	text := label("payment_request_title", pr.Unit, monthName(lang, month.Month()), month.Year())
+	if pr.Amount > 0 {
+		text += label("payment_request_amount", pr.Amount, pr.Currency)
+	}
+	text += label("payment_request_payee", pr.Payee)
+	text += label("payment_request_iban", formatIBAN(pr.IBAN))
+	if pr.BIC != "" {
+		text += label("payment_request_bic", pr.BIC)
+	}
+	text += label("payment_request_reference", pr.Reference)
+	return text + label("payment_request_note")
+}
+
+// bankLinePaymentRequest finds the payment request whose reference a
+// statement line quotes, returning its id and resident, or zeros
+func bankLinePaymentRequest(q querier, line BankLine) (int, int, error) {
+	for _, text := range []string{line.Reference, line.Description} {
+		for _, ref := range creditorReferences(text) {
+			var id, residentID int
+			err := q.QueryRow("SELECT id, resident_id FROM payment_requests WHERE reference = ? AND resident_id IN (SELECT id FROM residents)", ref).Scan(&id, &residentID)
+			if err == sql.ErrNoRows {
+				continue
+			}
+			return id, residentID, err
+		}
+	}
+	return 0, 0, nil
+}
+
+// writePaymentRequest answers the payment request of a resident for the
+// month parameter, the current month by default, as JSON or with format=png
+// as its QR code
+func writePaymentRequest(w http.ResponseWriter, r *http.Request, db *sql.DB, residentID int, currency string, cal calendar) {
+	if err := checkQueryParams(r, "month", "format"); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	month := r.URL.Query().Get("month")
+	if month == "" {
+		month = cal.now().Format("2006-01")
+	}
+	if _, err := time.Parse("2006-01", month); err != nil {
+		respondWithError(w, http.StatusBadRequest, "invalid month format, must be YYYY-MM")
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "json" && format != "png" {
+		respondWithError(w, http.StatusBadRequest, "Invalid format, must be json or png")
+		return
+	}
+
+	details, err := loadPaymentDetails(db)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !details.Configured() {
+		respondWithError(w, http.StatusBadRequest, "Payment details are not configured")
+		return
+	}
+	pr, err := paymentRequestFor(db, details, residentID, month, currency, responseLanguage(w))
+	if err == sql.ErrNoRows {
+		respondWithError(w, http.StatusNotFound, "Resident not found")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if format == "png" {
+		if pr.QRCodePNG == nil {
+			respondWithError(w, http.StatusBadRequest, "QR codes are only for payments in euros")
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("Content-Length", strconv.Itoa(len(pr.QRCodePNG)))
+		w.Write(pr.QRCodePNG)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, pr)
+}
+
+// Handlers for payment request endpoints
+
+// Get what a resident is asked to pay for a month, and how
+func getPaymentRequest(db *sql.DB, currency string, cal calendar) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(mux.Vars(r)["id"])
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid resident ID")
+			return
+		}
+		writePaymentRequest(w, r, db, id, currency, cal)
+	}
+}
+
+// Get the payment request of the resident a portal token belongs to
+func portalPaymentRequest(db *sql.DB, currency string, cal calendar) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var residentID int
+		err := db.QueryRow("SELECT resident_id FROM portal_tokens WHERE id = ?", portalTokenID(r)).Scan(&residentID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writePaymentRequest(w, r, db, residentID, currency, cal)
+	}
+}
+
+// Get the account residents pay into
+func getPaymentDetails(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		details, err := loadPaymentDetails(db)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		respondWithJSON(w, http.StatusOK, details)
+	}
+}
+
+// Set the account residents pay into. Only admins can, as payments follow it.
+func putPaymentDetails(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := requireAdmin(db, w, r); !ok {
+			return
+		}
+		var details PaymentDetails
+		if err := decodeRequest(r, &details); err != nil {
+			respondWithError(w, payloadErrorStatus(err), "Invalid request payload: "+err.Error())
+			return
+		}
+		defer r.Body.Close()
+
+		normalizePaymentDetails(&details)
+		if err := validatePaymentDetails(details); err != nil {
+			respondWithValidationError(w, err)
+			return
+		}
+		for key, value := range map[string]string{settingPaymentPayee: details.Payee, settingPaymentIBAN: details.IBAN, settingPaymentBIC: details.BIC} {
+			if err := setSetting(db, key, value); err != nil {
+				respondWithError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+		}
+		respondWithJSON(w, http.StatusOK, details)
+	}
+}
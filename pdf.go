@@ -0,0 +1,255 @@
+package condomngr
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"  // decoded to be embedded
+	_ "image/jpeg" // read to be embedded
+	_ "image/png"  // decoded to be embedded
+	"io"
+	"strings"
+	"unicode/utf8"
+)
+
+// A4 in points, and the margin kept on every side
+const (
+	pdfPageWidth  = 595
+	pdfPageHeight = 842
+	pdfMargin     = 50
+)
+
+// Fonts of a pdfDocument. They are among the standard fonts every PDF viewer
+// has, so none is embedded.
+const (
+	pdfRegular = "F1" // Helvetica
+	pdfBold    = "F2" // Helvetica-Bold
+	pdfMono    = "F3" // Courier, for columns that must line up
+)
+
+var pdfFonts = []struct{ name, base string }{
+	{pdfRegular, "Helvetica"},
+	{pdfBold, "Helvetica-Bold"},
+	{pdfMono, "Courier"},
+}
+
+// pdfDocument lays out lines of text and images top to bottom, starting a new
+// page when one is full. It only writes what documents such as statements
+// need: text in the standard fonts, in Windows-1252 so Latin accents show,
+// and JPEG, PNG or GIF pictures.
+type pdfDocument struct {
+	pages  []*bytes.Buffer // content stream of each page
+	images []pdfImage
+	y      float64 // baseline of the next line
+}
+
+// pdfImage is a picture as a PDF image object: JPEGs as they are, other
+// formats decoded to compressed RGB
+type pdfImage struct {
+	width, height int
+	colorSpace    string
+	filter        string
+	data          []byte
+}
+
+// newPDFImage prepares a JPEG, PNG or GIF file to be embedded. Transparent
+// parts come out white.
+func newPDFImage(data []byte) (pdfImage, error) {
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return pdfImage{}, err
+	}
+	if format == "jpeg" {
+		colorSpace := "DeviceRGB"
+		switch config.ColorModel {
+		case color.GrayModel:
+			colorSpace = "DeviceGray"
+		case color.CMYKModel:
+			colorSpace = "DeviceCMYK"
+		}
+		return pdfImage{width: config.Width, height: config.Height, colorSpace: colorSpace, filter: "DCTDecode", data: data}, nil
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return pdfImage{}, err
+	}
+	bounds := img.Bounds()
+	var buf bytes.Buffer
+	zw := zlib.NewWriter(&buf)
+	pixel := make([]byte, 3)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, a := img.At(x, y).RGBA()
+			// The components are premultiplied by alpha, so adding the
+			// rest of white puts the picture on a white page
+			for i, c := range []uint32{r, g, b} {
+				pixel[i] = byte((c + 0xffff - a) >> 8)
+			}
+			zw.Write(pixel)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return pdfImage{}, err
+	}
+	return pdfImage{width: bounds.Dx(), height: bounds.Dy(), colorSpace: "DeviceRGB", filter: "FlateDecode", data: buf.Bytes()}, nil
+}
+
+func newPDFDocument() *pdfDocument {
+	d := &pdfDocument{}
+	d.newPage()
+	return d
+}
+
+func (d *pdfDocument) newPage() {
+	d.pages = append(d.pages, &bytes.Buffer{})
+	d.y = pdfPageHeight - pdfMargin
+}
+
+// Line writes text at the left margin and moves down by its height
+func (d *pdfDocument) Line(font string, size float64, text string) {
+	d.LineAt(font, size, pdfMargin, text)
+}
+
+// LineAt writes text starting x points from the left edge and moves down
+func (d *pdfDocument) LineAt(font string, size, x float64, text string) {
+	height := size * 1.4
+	if d.y-height < pdfMargin {
+		d.newPage()
+	}
+	d.y -= size
+	fmt.Fprintf(d.pages[len(d.pages)-1], "BT /%s %.1f Tf %.2f %.2f Td (%s) Tj ET\n", font, size, x, d.y, pdfString(text))
+	d.y -= height - size
+}
+
+// Paragraph writes text at the left margin, wrapped at word boundaries to the
+// width of the page. The wrapping goes by the average width of Helvetica's
+// characters, so a line of wide letters can come out a little long.
+func (d *pdfDocument) Paragraph(font string, size float64, text string) {
+	perLine := int((pdfPageWidth - 2*pdfMargin) / (size * 0.5))
+	for _, paragraph := range strings.Split(text, "\n") {
+		line := ""
+		for _, word := range strings.Fields(paragraph) {
+			if line != "" && utf8.RuneCountInString(line)+1+utf8.RuneCountInString(word) > perLine {
+				d.Line(font, size, line)
+				line = ""
+			}
+			if line != "" {
+				line += " "
+			}
+			line += word
+		}
+		d.Line(font, size, line)
+	}
+}
+
+// Image draws a picture at the left margin, scaled down to fit maxWidth by
+// maxHeight points, on a new page if this one has no room left, and moves
+// down past it
+func (d *pdfDocument) Image(img pdfImage, maxWidth, maxHeight float64) {
+	width, height := float64(img.width), float64(img.height)
+	if scale := min(maxWidth/width, maxHeight/height, 1); scale < 1 {
+		width, height = width*scale, height*scale
+	}
+	if d.y-height < pdfMargin {
+		d.newPage()
+	}
+	d.images = append(d.images, img)
+	d.y -= height
+	fmt.Fprintf(d.pages[len(d.pages)-1], "q %.2f 0 0 %.2f %d %.2f cm /Im%d Do Q\n", width, height, pdfMargin, d.y, len(d.images))
+}
+
+// Space leaves a gap of height points
+func (d *pdfDocument) Space(height float64) {
+	d.y -= height
+}
+
+// WriteTo writes the complete document
+func (d *pdfDocument) WriteTo(w io.Writer) (int64, error) {
+	var buf bytes.Buffer
+	var offsets []int
+	object := func(body string) {
+		offsets = append(offsets, buf.Len())
+		fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+	}
+
+	// Objects 1 and 2 are the catalog and the page tree, then the fonts and
+	// images, then each page followed by its content
+	firstImage := 3 + len(pdfFonts)
+	firstPage := firstImage + len(d.images)
+	kids := make([]string, len(d.pages))
+	for i := range d.pages {
+		kids[i] = fmt.Sprintf("%d 0 R", firstPage+2*i)
+	}
+	var resources strings.Builder
+	resources.WriteString("/Font << ")
+	for i, font := range pdfFonts {
+		fmt.Fprintf(&resources, "/%s %d 0 R ", font.name, 3+i)
+	}
+	resources.WriteString(">> ")
+	if len(d.images) > 0 {
+		resources.WriteString("/XObject << ")
+		for i := range d.images {
+			fmt.Fprintf(&resources, "/Im%d %d 0 R ", i+1, firstImage+i)
+		}
+		resources.WriteString(">> ")
+	}
+
+	buf.WriteString("%PDF-1.4\n")
+	object("<< /Type /Catalog /Pages 2 0 R >>")
+	object(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(d.pages)))
+	for _, font := range pdfFonts {
+		object(fmt.Sprintf("<< /Type /Font /Subtype /Type1 /BaseFont /%s /Encoding /WinAnsiEncoding >>", font.base))
+	}
+	for _, img := range d.images {
+		object(fmt.Sprintf("<< /Type /XObject /Subtype /Image /Width %d /Height %d /ColorSpace /%s /BitsPerComponent 8 /Filter /%s /Length %d >>\nstream\n%s\nendstream",
+			img.width, img.height, img.colorSpace, img.filter, len(img.data), img.data))
+	}
+	for i, content := range d.pages {
+		object(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %d %d] /Resources << %s>> /Contents %d 0 R >>",
+			pdfPageWidth, pdfPageHeight, resources.String(), firstPage+2*i+1))
+		object(fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", content.Len(), content.Bytes()))
+	}
+
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+
+	n, err := w.Write(buf.Bytes())
+	return int64(n), err
+}
+
+// pdfWinAnsi maps the characters Windows-1252 has outside Latin-1
+var pdfWinAnsi = map[rune]byte{
+	'€': 0x80, '‚': 0x82, 'ƒ': 0x83, '„': 0x84, '…': 0x85, '†': 0x86, '‡': 0x87, 'ˆ': 0x88, '‰': 0x89,
+	'Š': 0x8a, '‹': 0x8b, 'Œ': 0x8c, 'Ž': 0x8e, '‘': 0x91, '’': 0x92, '“': 0x93, '”': 0x94, '•': 0x95,
+	'–': 0x96, '—': 0x97, '˜': 0x98, '™': 0x99, 'š': 0x9a, '›': 0x9b, 'œ': 0x9c, 'ž': 0x9e, 'Ÿ': 0x9f,
+}
+
+// pdfString encodes text as the inside of a PDF string literal. Characters
+// Windows-1252 doesn't have become question marks.
+func pdfString(text string) string {
+	var b strings.Builder
+	for _, r := range text {
+		var c byte
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			b.WriteByte('\\')
+			c = byte(r)
+		case r >= ' ' && r < 0x7f, r >= 0xa0 && r <= 0xff:
+			c = byte(r)
+		default:
+			var ok bool
+			if c, ok = pdfWinAnsi[r]; !ok {
+				c = '?'
+			}
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
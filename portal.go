@@ -0,0 +1,351 @@
+package condomngr
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// defaultPortalTokenDays is how long a portal link stays valid unless the
+// request asks for something else
+const defaultPortalTokenDays = 90
+
+// PortalToken is a revocable access token scoped to a single resident
+type PortalToken struct {
+	ID         int        `json:"id"`
+	ResidentID int        `json:"resident_id"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	RevokedAt  *time.Time `json:"revoked_at"`
+	CreatedAt  time.Time  `json:"created_at"`
+	Token      string     `json:"token,omitempty"`
+	URL        string     `json:"url,omitempty"`
+}
+
+type portalTokenKey struct{}
+
+// Portal issues and verifies resident portal tokens. A token is
+// "<token id>.<resident id>.<expiry>.<signature>"; the signature makes it
+// tamper-proof and the portal_tokens row makes it revocable.
+type Portal struct {
+	db      *sql.DB
+	secret  []byte
+	apiURL  string
+	limiter *rateLimiter
+}
+
+// NewPortal creates a portal signing tokens with the given secret, with links
+// to the API at apiURL, see condoAPIURL
+func NewPortal(db *sql.DB, secret []byte, apiURL string) *Portal {
+	return &Portal{
+		db:      db,
+		secret:  secret,
+		apiURL:  strings.TrimRight(apiURL, "/"),
+		limiter: newRateLimiter(60, 20),
+	}
+}
+
+func (p *Portal) signature(payload string) string {
+	mac := hmac.New(sha256.New, p.secret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (p *Portal) sign(tokenID int64, residentID int, expires time.Time) string {
+	payload := fmt.Sprintf("%d.%d.%d", tokenID, residentID, expires.Unix())
+	return payload + "." + p.signature(payload)
+}
+
+// parse verifies a token's signature and expiry and returns its token id
+func (p *Portal) parse(token string) (int64, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 4 {
+		return 0, fmt.Errorf("malformed token")
+	}
+	payload := strings.Join(parts[:3], ".")
+	if !hmac.Equal([]byte(parts[3]), []byte(p.signature(payload))) {
+		return 0, fmt.Errorf("invalid token")
+	}
+
+	tokenID, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("malformed token")
+	}
+	expires, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("malformed token")
+	}
+	if time.Now().Unix() >= expires {
+		return 0, fmt.Errorf("token expired")
+	}
+	return tokenID, nil
+}
+
+// Middleware authenticates portal requests by their token, rejects revoked
+// tokens, and rate-limits each token (or client IP for bad tokens)
+func (p *Portal) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if token == "" {
+			token = r.URL.Query().Get("token")
+		}
+
+		tokenID, err := p.parse(token)
+
+		limitKey := "token:" + strconv.FormatInt(tokenID, 10)
+		if err != nil {
+			limitKey = "ip:" + clientIP(r)
+		}
+		if !p.limiter.Allow(limitKey) {
+			w.Header().Set("Retry-After", "60")
+			respondWithError(w, http.StatusTooManyRequests, "Too many requests")
+			return
+		}
+
+		if err != nil {
+			respondWithError(w, http.StatusUnauthorized, fmt.Sprintf("Unauthorized: %v", err))
+			return
+		}
+
+		var active bool
+		if err := p.db.QueryRow("SELECT EXISTS(SELECT 1 FROM portal_tokens WHERE id = ? AND revoked_at IS NULL)", tokenID).Scan(&active); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if !active {
+			respondWithError(w, http.StatusUnauthorized, "Unauthorized: token revoked")
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), portalTokenKey{}, tokenID)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// portalTokenID returns the token id the middleware stored in the request.
+// Portal queries join on portal_tokens by this id, so the resident a request
+// can see is decided by the database rather than by handler code.
+func portalTokenID(r *http.Request) int64 {
+	id, _ := r.Context().Value(portalTokenKey{}).(int64)
+	return id
+}
+
+// Create a portal token for a resident
+func createPortalToken(db *sql.DB, portal *Portal) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id, err := strconv.Atoi(vars["id"])
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid resident ID")
+			return
+		}
+
+		var req struct {
+			ExpiresInDays int `json:"expires_in_days"`
+		}
+		if r.ContentLength > 0 {
+			if err := decodeRequest(r, &req); err != nil {
+				respondWithError(w, payloadErrorStatus(err), "Invalid request payload: "+err.Error())
+				return
+			}
+			defer r.Body.Close()
+		}
+		if req.ExpiresInDays == 0 {
+			req.ExpiresInDays = defaultPortalTokenDays
+		}
+		if req.ExpiresInDays < 0 || req.ExpiresInDays > 366 {
+			respondWithError(w, http.StatusBadRequest, "expires_in_days must be between 1 and 366")
+			return
+		}
+
+		var exists bool
+		if err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM residents WHERE id = ?)", id).Scan(&exists); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if !exists {
+			respondWithError(w, http.StatusNotFound, "Resident not found")
+			return
+		}
+
+		expires := time.Now().UTC().AddDate(0, 0, req.ExpiresInDays).Truncate(time.Second)
+		result, err := db.Exec("INSERT INTO portal_tokens(resident_id, expires_at) VALUES(?, ?)", id, expires)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		tokenID, err := result.LastInsertId()
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		token := portal.sign(tokenID, id, expires)
+		respondWithJSON(w, http.StatusCreated, PortalToken{
+			ID:         int(tokenID),
+			ResidentID: id,
+			ExpiresAt:  expires,
+			CreatedAt:  time.Now().UTC(),
+			Token:      token,
+			URL:        portal.apiURL + "/portal/me?token=" + url.QueryEscape(token),
+		})
+	}
+}
+
+// Get the portal tokens issued for a resident
+func getPortalTokens(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id, err := strconv.Atoi(vars["id"])
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid resident ID")
+			return
+		}
+
+		rows, err := db.Query("SELECT id, resident_id, expires_at, revoked_at, created_at FROM portal_tokens WHERE resident_id = ? ORDER BY id DESC", id)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		defer rows.Close()
+
+		tokens := []PortalToken{}
+		for rows.Next() {
+			var t PortalToken
+			var revokedAt sql.NullTime
+			if err := rows.Scan(&t.ID, &t.ResidentID, &t.ExpiresAt, &revokedAt, &t.CreatedAt); err != nil {
+				respondWithError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			if revokedAt.Valid {
+				t.RevokedAt = &revokedAt.Time
+			}
+			tokens = append(tokens, t)
+		}
+
+		respondWithJSON(w, http.StatusOK, tokens)
+	}
+}
+
+// Revoke a portal token
+func revokePortalToken(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id, err := strconv.Atoi(vars["id"])
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid token ID")
+			return
+		}
+
+		result, err := db.Exec("UPDATE portal_tokens SET revoked_at = CURRENT_TIMESTAMP WHERE id = ? AND revoked_at IS NULL", id)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			respondWithError(w, http.StatusNotFound, "Token not found or already revoked")
+			return
+		}
+
+		respondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
+	}
+}
+
+// Handlers for the token-scoped portal endpoints
+func portalMe(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		resident, err := scanResidentRow(db.QueryRow(`
+			SELECT `+residentColumns+` FROM residents
+			WHERE id = (SELECT resident_id FROM portal_tokens WHERE id = ?)
+		`, portalTokenID(r)))
+		if err == sql.ErrNoRows {
+			respondWithError(w, http.StatusNotFound, "Resident not found")
+			return
+		}
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		respondWithJSON(w, http.StatusOK, resident)
+	}
+}
+
+func portalPayments(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rows, err := db.Query(`
+			SELECT p.id, p.resident_id, p.amount, p.description, p.payment_date, p.method, p.status, p.created_at, p.updated_at
+			FROM payments p
+			JOIN portal_tokens t ON t.resident_id = p.resident_id
+			WHERE t.id = ?
+			ORDER BY p.payment_date DESC
+		`, portalTokenID(r))
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		defer rows.Close()
+
+		payments := []Payment{}
+		for rows.Next() {
+			var payment Payment
+			if err := rows.Scan(&payment.ID, &payment.ResidentID, &payment.Amount, &payment.Description, &payment.PaymentDate, &payment.Method, &payment.Status, &payment.CreatedAt, &payment.UpdatedAt); err != nil {
+				respondWithError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			payments = append(payments, payment)
+		}
+
+		respondWithJSON(w, http.StatusOK, payments)
+	}
+}
+
+func portalBalance(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var residentID int
+		err := db.QueryRow("SELECT resident_id FROM portal_tokens WHERE id = ?", portalTokenID(r)).Scan(&residentID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		b, err := residentBalance(db, residentID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		respondWithJSON(w, http.StatusOK, b)
+	}
+}
+
+func portalAnnouncements(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rows, err := db.Query("SELECT id, title, body, public, created_at FROM announcements WHERE public = 1 ORDER BY created_at DESC, id DESC")
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		defer rows.Close()
+
+		announcements := []Announcement{}
+		for rows.Next() {
+			var a Announcement
+			if err := rows.Scan(&a.ID, &a.Title, &a.Body, &a.Public, &a.CreatedAt); err != nil {
+				respondWithError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			announcements = append(announcements, a)
+		}
+
+		respondWithJSON(w, http.StatusOK, announcements)
+	}
+}
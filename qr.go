@@ -0,0 +1,465 @@
+package condomngr
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"strings"
+)
+
+// qrVersion is the layout of a QR code version at error correction level M:
+// the data codewords of each block, the error correction codewords added to
+// every block and the centers of the alignment patterns
+type qrVersion struct {
+	blocks []int
+	ec     int
+	align  []int
+}
+
+// qrVersions are versions 1 to 13, up to 331 bytes: plenty for the otpauth
+// URIs of two-factor enrollment, and the most an EPC payment code may hold
+var qrVersions = []qrVersion{
+	{[]int{16}, 10, nil},
+	{[]int{28}, 16, []int{6, 18}},
+	{[]int{44}, 26, []int{6, 22}},
+	{[]int{32, 32}, 18, []int{6, 26}},
+	{[]int{43, 43}, 24, []int{6, 30}},
+	{[]int{27, 27, 27, 27}, 16, []int{6, 34}},
+	{[]int{31, 31, 31, 31}, 18, []int{6, 22, 38}},
+	{[]int{38, 38, 39, 39}, 22, []int{6, 24, 42}},
+	{[]int{36, 36, 36, 37, 37}, 22, []int{6, 26, 46}},
+	{[]int{43, 43, 43, 43, 44}, 26, []int{6, 28, 50}},
+	{[]int{50, 51, 51, 51, 51}, 30, []int{6, 30, 54}},
+	{[]int{36, 36, 36, 36, 36, 36, 37, 37}, 22, []int{6, 32, 58}},
+	{[]int{37, 37, 37, 37, 37, 37, 37, 37, 38}, 22, []int{6, 34, 62}},
+}
+
+// qrCode encodes text as a QR code in byte mode at error correction level M,
+// the smallest version it fits in. The modules are indexed by row then column;
+// true is dark.
+func qrCode(text string) ([][]bool, error) {
+	for i, version := range qrVersions {
+		countBits := 8
+		if i+1 >= 10 {
+			countBits = 16
+		}
+		capacity := 0
+		for _, n := range version.blocks {
+			capacity += n
+		}
+		if 4+countBits+8*len(text) > 8*capacity {
+			continue
+		}
+
+		q := newQRMatrix(i+1, version)
+		q.placeData(qrCodewords(text, countBits, capacity, version))
+		q.applyBestMask()
+		return q.modules, nil
+	}
+	return nil, fmt.Errorf("too long for a QR code: %d bytes", len(text))
+}
+
+// qrCodewords are the data of text, padded to capacity, and its error
+// correction, interleaved across the blocks of version
+func qrCodewords(text string, countBits, capacity int, version qrVersion) []byte {
+	var bits []bool
+	appendBits := func(value, n int) {
+		for i := n - 1; i >= 0; i-- {
+			bits = append(bits, value>>i&1 == 1)
+		}
+	}
+	appendBits(0b0100, 4) // byte mode
+	appendBits(len(text), countBits)
+	for i := 0; i < len(text); i++ {
+		appendBits(int(text[i]), 8)
+	}
+	appendBits(0, min(4, 8*capacity-len(bits))) // terminator
+	appendBits(0, (8-len(bits)%8)%8)
+	for pad := 0; len(bits) < 8*capacity; pad++ {
+		appendBits([]int{0xEC, 0x11}[pad%2], 8)
+	}
+
+	data := make([]byte, capacity)
+	for i, bit := range bits {
+		if bit {
+			data[i/8] |= 1 << (7 - i%8)
+		}
+	}
+
+	var blocks, ecBlocks [][]byte
+	longest := 0
+	for _, n := range version.blocks {
+		blocks = append(blocks, data[:n])
+		ecBlocks = append(ecBlocks, reedSolomon(data[:n], version.ec))
+		data = data[n:]
+		longest = max(longest, n)
+	}
+	var codewords []byte
+	for i := 0; i < longest; i++ {
+		for _, block := range blocks {
+			if i < len(block) {
+				codewords = append(codewords, block[i])
+			}
+		}
+	}
+	for i := 0; i < version.ec; i++ {
+		for _, block := range ecBlocks {
+			codewords = append(codewords, block[i])
+		}
+	}
+	return codewords
+}
+
+// gfMultiply multiplies in GF(256) with the QR code polynomial, 0x11D
+func gfMultiply(a, b byte) byte {
+	var product byte
+	for ; b > 0; b >>= 1 {
+		if b&1 == 1 {
+			product ^= a
+		}
+		carry := a&0x80 != 0
+		a <<= 1
+		if carry {
+			a ^= 0x1D
+		}
+	}
+	return product
+}
+
+// reedSolomon returns the n error correction codewords of data
+func reedSolomon(data []byte, n int) []byte {
+	// The generator polynomial is the product of (x - 2^i) for i below n,
+	// its coefficients from the highest power down, the leading 1 left out
+	generator := make([]byte, n)
+	generator[n-1] = 1
+	root := byte(1)
+	for i := 0; i < n; i++ {
+		for j := range generator {
+			generator[j] = gfMultiply(generator[j], root)
+			if j+1 < n {
+				generator[j] ^= generator[j+1]
+			}
+		}
+		root = gfMultiply(root, 2)
+	}
+
+	remainder := make([]byte, n)
+	for _, b := range data {
+		factor := b ^ remainder[0]
+		copy(remainder, remainder[1:])
+		remainder[n-1] = 0
+		for j := range remainder {
+			remainder[j] ^= gfMultiply(generator[j], factor)
+		}
+	}
+	return remainder
+}
+
+// qrMatrix is a QR code being drawn. Function modules are the fixed patterns,
+// which data and masks leave alone.
+type qrMatrix struct {
+	version  int
+	size     int
+	modules  [][]bool
+	function [][]bool
+}
+
+// newQRMatrix draws the function patterns of version, with the format
+// information reserved
+func newQRMatrix(version int, layout qrVersion) *qrMatrix {
+	size := 17 + 4*version
+	q := &qrMatrix{version: version, size: size}
+	q.modules = make([][]bool, size)
+	q.function = make([][]bool, size)
+	for i := range q.modules {
+		q.modules[i] = make([]bool, size)
+		q.function[i] = make([]bool, size)
+	}
+
+	for i := 0; i < size; i++ {
+		q.set(6, i, i%2 == 0)
+		q.set(i, 6, i%2 == 0)
+	}
+	q.finder(3, 3)
+	q.finder(3, size-4)
+	q.finder(size-4, 3)
+	last := len(layout.align) - 1
+	for i, row := range layout.align {
+		for j, col := range layout.align {
+			// Those in the corners would overlap the finders
+			if i == 0 && j == 0 || i == 0 && j == last || i == last && j == 0 {
+				continue
+			}
+			q.alignment(row, col)
+		}
+	}
+	q.format(0)
+	if version >= 7 {
+		bits := version<<12 | bchRemainder(version, 0x1F25, 12)
+		for i := 0; i < 18; i++ {
+			dark := bits>>i&1 == 1
+			q.set(i/3, size-11+i%3, dark)
+			q.set(size-11+i%3, i/3, dark)
+		}
+	}
+	return q
+}
+
+// set draws a function module
+func (q *qrMatrix) set(row, col int, dark bool) {
+	q.modules[row][col] = dark
+	q.function[row][col] = true
+}
+
+// finder draws a finder pattern centered on row and col, with its separator
+func (q *qrMatrix) finder(row, col int) {
+	for dr := -4; dr <= 4; dr++ {
+		for dc := -4; dc <= 4; dc++ {
+			r, c := row+dr, col+dc
+			if r < 0 || r >= q.size || c < 0 || c >= q.size {
+				continue
+			}
+			ring := max(abs(dr), abs(dc))
+			q.set(r, c, ring != 2 && ring != 4)
+		}
+	}
+}
+
+// alignment draws an alignment pattern centered on row and col
+func (q *qrMatrix) alignment(row, col int) {
+	for dr := -2; dr <= 2; dr++ {
+		for dc := -2; dc <= 2; dc++ {
+			q.set(row+dr, col+dc, max(abs(dr), abs(dc)) != 1)
+		}
+	}
+}
+
+// format draws the format information of level M with mask, twice
+func (q *qrMatrix) format(mask int) {
+	data := 0b00<<3 | mask // 00 is level M
+	bits := (data<<10 | bchRemainder(data, 0x537, 10)) ^ 0x5412
+	bit := func(i int) bool { return bits>>i&1 == 1 }
+
+	for i := 0; i <= 5; i++ {
+		q.set(i, 8, bit(i))
+	}
+	q.set(7, 8, bit(6))
+	q.set(8, 8, bit(7))
+	q.set(8, 7, bit(8))
+	for i := 9; i < 15; i++ {
+		q.set(8, 14-i, bit(i))
+	}
+	for i := 0; i < 8; i++ {
+		q.set(8, q.size-1-i, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		q.set(q.size-15+i, 8, bit(i))
+	}
+	q.set(q.size-8, 8, true) // always dark
+}
+
+// bchRemainder is the remainder of value, shifted left by n bits, divided by
+// the BCH generator polynomial of the format or version information
+func bchRemainder(value, generator, n int) int {
+	remainder := value << n
+	for bit := 31; bit >= n; bit-- {
+		if remainder>>bit&1 == 1 {
+			remainder ^= generator << (bit - n)
+		}
+	}
+	return remainder
+}
+
+// placeData fills the modules that aren't function modules with codewords,
+// in two-column strips zigzagging up and down from the bottom right
+func (q *qrMatrix) placeData(codewords []byte) {
+	i := 0
+	for right := q.size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5 // skip the vertical timing pattern
+		}
+		upward := (right+1)&2 == 0
+		for vert := 0; vert < q.size; vert++ {
+			row := vert
+			if upward {
+				row = q.size - 1 - vert
+			}
+			for col := right; col >= right-1; col-- {
+				if q.function[row][col] {
+					continue
+				}
+				// The remainder bits after the last codeword are light
+				if i < 8*len(codewords) {
+					q.modules[row][col] = codewords[i/8]>>(7-i%8)&1 == 1
+				}
+				i++
+			}
+		}
+	}
+}
+
+// qrMasks tell which modules each mask pattern flips
+var qrMasks = []func(row, col int) bool{
+	func(r, c int) bool { return (r+c)%2 == 0 },
+	func(r, c int) bool { return r%2 == 0 },
+	func(r, c int) bool { return c%3 == 0 },
+	func(r, c int) bool { return (r+c)%3 == 0 },
+	func(r, c int) bool { return (r/2+c/3)%2 == 0 },
+	func(r, c int) bool { return r*c%2+r*c%3 == 0 },
+	func(r, c int) bool { return (r*c%2+r*c%3)%2 == 0 },
+	func(r, c int) bool { return ((r+c)%2+r*c%3)%2 == 0 },
+}
+
+// mask flips the data modules selected by mask; applying it twice undoes it
+func (q *qrMatrix) mask(mask int) {
+	for r := 0; r < q.size; r++ {
+		for c := 0; c < q.size; c++ {
+			if !q.function[r][c] && qrMasks[mask](r, c) {
+				q.modules[r][c] = !q.modules[r][c]
+			}
+		}
+	}
+}
+
+// applyBestMask applies the mask with the lowest penalty, the one readers
+// scan most easily
+func (q *qrMatrix) applyBestMask() {
+	best, lowest := 0, -1
+	for mask := range qrMasks {
+		q.mask(mask)
+		q.format(mask)
+		if penalty := q.penalty(); lowest < 0 || penalty < lowest {
+			best, lowest = mask, penalty
+		}
+		q.mask(mask)
+	}
+	q.mask(best)
+	q.format(best)
+}
+
+// penalty scores the modules by the four rules of the QR code specification:
+// runs of one color, 2×2 blocks, patterns that look like finders and an
+// uneven share of dark modules
+func (q *qrMatrix) penalty() int {
+	penalty, dark := 0, 0
+	finderLike := []bool{true, false, true, true, true, false, true}
+	for i := 0; i < q.size; i++ {
+		for _, line := range [][]bool{q.row(i), q.column(i)} {
+			run := 1
+			for j := 1; j <= len(line); j++ {
+				if j < len(line) && line[j] == line[j-1] {
+					run++
+					continue
+				}
+				if run >= 5 {
+					penalty += 3 + run - 5
+				}
+				run = 1
+			}
+			for j := 0; j+len(finderLike) <= len(line); j++ {
+				if matches(line[j:], finderLike) && (lightRun(line, j-4, j) || lightRun(line, j+7, j+11)) {
+					penalty += 40
+				}
+			}
+		}
+	}
+	for r := 0; r < q.size; r++ {
+		for c := 0; c < q.size; c++ {
+			if q.modules[r][c] {
+				dark++
+			}
+			if r+1 < q.size && c+1 < q.size {
+				m := q.modules[r][c]
+				if q.modules[r][c+1] == m && q.modules[r+1][c] == m && q.modules[r+1][c+1] == m {
+					penalty += 3
+				}
+			}
+		}
+	}
+	percent := dark * 100 / (q.size * q.size)
+	return penalty + 10*(abs(percent-50)/5)
+}
+
+func (q *qrMatrix) row(r int) []bool {
+	return q.modules[r]
+}
+
+func (q *qrMatrix) column(c int) []bool {
+	column := make([]bool, q.size)
+	for r := range column {
+		column[r] = q.modules[r][c]
+	}
+	return column
+}
+
+// matches reports whether line starts with pattern
+func matches(line, pattern []bool) bool {
+	for i, m := range pattern {
+		if line[i] != m {
+			return false
+		}
+	}
+	return true
+}
+
+// lightRun reports whether the modules of line from start to end are light,
+// counting those past the edges as light like the quiet zone
+func lightRun(line []bool, start, end int) bool {
+	for i := start; i < end; i++ {
+		if i >= 0 && i < len(line) && line[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// qrSVG draws modules as an SVG image, with the quiet zone readers need
+// around it
+func qrSVG(modules [][]bool) string {
+	const quiet = 4
+	size := len(modules) + 2*quiet
+	var path strings.Builder
+	for r, row := range modules {
+		for c, dark := range row {
+			if dark {
+				fmt.Fprintf(&path, "M%d %dh1v1h-1z", c+quiet, r+quiet)
+			}
+		}
+	}
+	return fmt.Sprintf(`<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %d %d" shape-rendering="crispEdges">`+
+		`<rect width="%d" height="%d" fill="#fff"/><path d="%s" fill="#000"/></svg>`, size, size, size, size, path.String())
+}
+
+// qrPNG draws modules as a black and white PNG image, scale pixels to a
+// module, with the quiet zone readers need around it
+func qrPNG(modules [][]bool, scale int) ([]byte, error) {
+	const quiet = 4
+	size := (len(modules) + 2*quiet) * scale
+	img := image.NewPaletted(image.Rect(0, 0, size, size), color.Palette{color.White, color.Black})
+	for r, row := range modules {
+		for c, dark := range row {
+			if !dark {
+				continue
+			}
+			for y := (r + quiet) * scale; y < (r+quiet+1)*scale; y++ {
+				for x := (c + quiet) * scale; x < (c+quiet+1)*scale; x++ {
+					img.SetColorIndex(x, y, 1)
+				}
+			}
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,100 @@
+package condomngr
+
+import (
+	"database/sql"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// ReadOnly blocks every API request that could change data while it is on,
+// e.g. while the annual report is prepared or on a public mirror
+type ReadOnly struct {
+	enabled atomic.Bool
+	locked  bool // set with -read-only, can't be turned off through the API
+}
+
+// NewReadOnly creates the read-only switch. Started enabled it stays on: until
+// the API has authentication, anyone who can reach a public mirror could
+// otherwise turn it off.
+func NewReadOnly(enabled bool) *ReadOnly {
+	ro := &ReadOnly{locked: enabled}
+	ro.enabled.Store(enabled)
+	return ro
+}
+
+// Enabled reports whether the server is in read-only mode
+func (ro *ReadOnly) Enabled() bool {
+	return ro.enabled.Load()
+}
+
+// Middleware rejects requests with methods that change data with 403 while
+// read-only mode is on. It goes by method rather than by route so new routes
+// are covered without being listed. The switch itself stays reachable so the
+// mode can be turned off again, and so do unsubscribe links, which can be
+// opened with GET anyway and must always be honored, and signing in and out,
+// including revoking sessions.
+func (ro *ReadOnly) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+		default:
+			if ro.Enabled() && !readOnlyExempt(r.URL.Path) {
+				respondWithError(w, http.StatusForbidden, "server is in read-only mode")
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// readOnlyExempt reports whether path stays writable in read-only mode
+func readOnlyExempt(path string) bool {
+	for _, suffix := range []string{"/admin/readonly", "/unsubscribe", "/auth/login", "/auth/login/2fa", "/auth/logout", "/import/xlsx/detect", "/admin/anonymize", "/admin/diff"} {
+		if strings.HasSuffix(path, suffix) {
+			return true
+		}
+	}
+	return strings.Contains(path, "/sessions/")
+}
+
+// ServerStatus is the response of the status endpoint
+type ServerStatus struct {
+	Status   string `json:"status"`
+	Version  string `json:"version"`
+	ReadOnly bool   `json:"read_only"`
+}
+
+// ReadOnlyRequest turns read-only mode on or off
+type ReadOnlyRequest struct {
+	ReadOnly bool `json:"read_only"`
+}
+
+// Get the server status
+func getStatus(ro *ReadOnly) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		respondWithJSON(w, http.StatusOK, ServerStatus{Status: "ok", Version: Version, ReadOnly: ro.Enabled()})
+	}
+}
+
+// Turn read-only mode on or off until the next restart
+func setReadOnly(db *sql.DB, ro *ReadOnly) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := requireAdmin(db, w, r); !ok {
+			return
+		}
+		var req ReadOnlyRequest
+		if err := decodeRequest(r, &req); err != nil {
+			respondWithError(w, payloadErrorStatus(err), "Invalid request payload: "+err.Error())
+			return
+		}
+		defer r.Body.Close()
+
+		if ro.locked {
+			respondWithError(w, http.StatusForbidden, "read-only mode was set with -read-only and can't be changed at runtime")
+			return
+		}
+		ro.enabled.Store(req.ReadOnly)
+		respondWithJSON(w, http.StatusOK, ServerStatus{Status: "ok", Version: Version, ReadOnly: ro.Enabled()})
+	}
+}
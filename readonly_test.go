@@ -0,0 +1,24 @@
+package condomngr
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestSetReadOnlyRequiresAdmin(t *testing.T) {
+	s := newTestServer(t, Options{})
+	on := map[string]bool{"read_only": true}
+
+	s.expect(http.StatusUnauthorized, "POST", "/api/v1/admin/readonly", on, nil)
+	s.token = s.signIn("tom", RoleTreasurer)
+	s.expect(http.StatusForbidden, "POST", "/api/v1/admin/readonly", on, nil)
+
+	s.token = s.signIn("alice", RoleAdmin)
+	var status ServerStatus
+	s.expect(http.StatusOK, "POST", "/api/v1/admin/readonly", on, &status)
+	if !status.ReadOnly {
+		t.Fatal("read-only mode not turned on")
+	}
+	s.expect(http.StatusForbidden, "POST", "/api/v1/residents", map[string]string{"name": "Ana", "unit": "1A"}, nil)
+	s.expect(http.StatusOK, "POST", "/api/v1/admin/readonly", map[string]bool{"read_only": false}, nil)
+}
@@ -0,0 +1,219 @@
+package condomngr
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PaymentReassignFilter selects the payments to move: either by ids, or those
+// of a resident, optionally within a date range
+type PaymentReassignFilter struct {
+	IDs        []int  `json:"ids,omitempty"`
+	ResidentID int    `json:"resident_id,omitempty"`
+	StartDate  string `json:"start_date,omitempty"`
+	EndDate    string `json:"end_date,omitempty"`
+}
+
+// PaymentReassignment is a request to move payments recorded against the
+// wrong resident to the right one
+type PaymentReassignment struct {
+	Filter           PaymentReassignFilter `json:"filter"`
+	TargetResidentID int                   `json:"target_resident_id"`
+	DryRun           bool                  `json:"dry_run"`
+}
+
+// ReassignedBalance is the balance of a resident payments were moved from or
+// to, before and after the move
+type ReassignedBalance struct {
+	ResidentID int     `json:"resident_id"`
+	Before     float64 `json:"before"`
+	After      float64 `json:"after"`
+}
+
+// PaymentReassignResult reports the payments moved and the balances of the
+// residents involved. With dry_run nothing is moved, and the ids and
+// balances are what moving would give.
+type PaymentReassignResult struct {
+	DryRun   bool                `json:"dry_run"`
+	Moved    int                 `json:"moved"`
+	IDs      []int               `json:"ids"`
+	Balances []ReassignedBalance `json:"balances"` // the residents moved from, then the target
+}
+
+// where turns the filter into a WHERE clause, adding its errors to errs
+func (f PaymentReassignFilter) where(errs *ValidationErrors) queryFilter {
+	var filter queryFilter
+	switch {
+	case (len(f.IDs) == 0) == (f.ResidentID == 0):
+		errs.Add("filter", "filter must set either ids or resident_id")
+		return filter
+	case len(f.IDs) > maxBulkUpdate:
+		errs.Add("filter.ids", fmt.Sprintf("at most %d ids can be moved per request", maxBulkUpdate))
+		return filter
+	case len(f.IDs) > 0:
+		if f.StartDate != "" || f.EndDate != "" {
+			errs.Add("filter", "dates only apply with resident_id")
+		}
+		return idsFilter(f.IDs)
+	}
+
+	filter.add("resident_id = ?", f.ResidentID)
+	for _, date := range []struct {
+		field, value, condition string
+	}{{"filter.start_date", f.StartDate, "payment_date >= ?"}, {"filter.end_date", f.EndDate, "payment_date <= ?"}} {
+		if date.value == "" {
+			continue
+		}
+		if _, err := time.Parse("2006-01-02", date.value); err != nil {
+			errs.Add(date.field, "invalid date format, must be YYYY-MM-DD")
+			continue
+		}
+		filter.add(date.condition, date.value)
+	}
+	return filter
+}
+
+// Move payments recorded against the wrong resident to another one in one
+// transaction, reallocating the charges of everyone involved. The move is
+// recorded in the audit log with the ids of the payments. A dry run makes the
+// same changes and rolls them back, to report what they would be.
+func reassignPayments(db *sql.DB, changes *ChangeBroker, rules paymentRules) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req PaymentReassignment
+		if err := decodeRequest(r, &req); err != nil {
+			respondWithError(w, payloadErrorStatus(err), "Invalid request payload: "+err.Error())
+			return
+		}
+		defer r.Body.Close()
+
+		var errs ValidationErrors
+		filter := req.Filter.where(&errs)
+		if req.TargetResidentID <= 0 {
+			errs.Add("target_resident_id", "target_resident_id is required")
+		} else if req.TargetResidentID == req.Filter.ResidentID {
+			errs.Add("target_resident_id", "target_resident_id must differ from the filter's resident_id")
+		} else {
+			var anonymized sql.NullTime
+			err := db.QueryRow("SELECT anonymized_at FROM residents WHERE id = ?", req.TargetResidentID).Scan(&anonymized)
+			if err == sql.ErrNoRows || anonymized.Valid {
+				errs.Add("target_resident_id", "target_resident_id must be an existing resident")
+			} else if err != nil {
+				respondWithError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+		}
+		if err := errs.Err(); err != nil {
+			respondWithValidationError(w, err)
+			return
+		}
+		// Payments already the target's are left alone
+		filter.add("resident_id != ?", req.TargetResidentID)
+
+		tx, err := db.Begin()
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		defer tx.Rollback()
+
+		result := PaymentReassignResult{DryRun: req.DryRun, IDs: []int{}, Balances: []ReassignedBalance{}}
+		var residentIDs []int
+		rows, err := tx.Query("SELECT id, resident_id FROM payments"+filter.where()+" ORDER BY payment_date, id", filter.args...)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		for rows.Next() {
+			var id, residentID int
+			if err := rows.Scan(&id, &residentID); err != nil {
+				rows.Close()
+				respondWithError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			result.IDs = append(result.IDs, id)
+			if !slices.Contains(residentIDs, residentID) {
+				residentIDs = append(residentIDs, residentID)
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if len(result.IDs) > maxBulkUpdate {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("filter matches %d payments, at most %d can be moved per request", len(result.IDs), maxBulkUpdate))
+			return
+		}
+		result.Moved = len(result.IDs)
+		if len(result.IDs) == 0 {
+			respondWithJSON(w, http.StatusOK, result)
+			return
+		}
+
+		slices.Sort(residentIDs)
+		residentIDs = append(residentIDs, req.TargetResidentID)
+		for _, residentID := range residentIDs {
+			balance, err := residentBalance(tx, residentID)
+			if err != nil {
+				respondWithError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			result.Balances = append(result.Balances, ReassignedBalance{ResidentID: residentID, Before: balance.Balance})
+		}
+
+		moved := idsFilter(result.IDs)
+		if _, err := tx.Exec("UPDATE payments SET resident_id = ?, updated_at = CURRENT_TIMESTAMP"+moved.where(),
+			append([]interface{}{req.TargetResidentID}, moved.args...)...); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		for i, residentID := range residentIDs {
+			if err := reallocate(tx, rules, residentID); err != nil {
+				respondWithError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			balance, err := residentBalance(tx, residentID)
+			if err != nil {
+				respondWithError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			result.Balances[i].After = balance.Balance
+		}
+		if req.DryRun {
+			respondWithJSON(w, http.StatusOK, result)
+			return
+		}
+
+		ids := make([]string, len(result.IDs))
+		for i, id := range result.IDs {
+			ids[i] = strconv.Itoa(id)
+		}
+		from := make([]string, len(residentIDs)-1)
+		for i, id := range residentIDs[:len(residentIDs)-1] {
+			from[i] = strconv.Itoa(id)
+		}
+		residents := "resident"
+		if len(from) > 1 {
+			residents = "residents"
+		}
+		detail := fmt.Sprintf("payments %s moved from %s %s", strings.Join(ids, ", "), residents, strings.Join(from, ", "))
+		if err := recordAudit(tx, r, AuditPaymentsReassigned, fmt.Sprintf("resident %d", req.TargetResidentID), detail); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		for _, id := range result.IDs {
+			changes.Publish(Change{Type: "payment", ID: id, Action: ChangeUpdated})
+		}
+
+		respondWithJSON(w, http.StatusOK, result)
+	}
+}
@@ -0,0 +1,423 @@
+package condomngr
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// settingAutoEmailReceipts turns on emailing a receipt for every confirmed
+// payment created
+const settingAutoEmailReceipts = "auto_email_receipts"
+
+// Statuses of a receipt email
+const (
+	ReceiptEmailQueued     = "queued"
+	ReceiptEmailSent       = "sent"
+	ReceiptEmailFailed     = "failed"
+	ReceiptEmailSkipped    = "skipped"    // no email address, or opted out of receipts
+	ReceiptEmailSuppressed = "suppressed" // the payment was deleted or stopped being confirmed before the receipt went out
+)
+
+// ReceiptEmail is a receipt queued for or sent to a resident. Reason says why
+// it was skipped, suppressed or failed.
+type ReceiptEmail struct {
+	ID         int        `json:"id"`
+	PaymentID  int        `json:"payment_id"`
+	ResidentID int        `json:"resident_id"`
+	Email      string     `json:"email"`
+	Status     string     `json:"status"`
+	Reason     string     `json:"reason"`
+	CreatedAt  time.Time  `json:"created_at"`
+	SentAt     *time.Time `json:"sent_at"`
+}
+
+// ReceiptSettings is whether receipts are emailed as payments are created
+type ReceiptSettings struct {
+	AutoEmail bool `json:"auto_email"`
+}
+
+// ReceiptQueue emails receipts from the receipt_emails table in a background
+// worker, so recording a payment never waits on the SMTP server. The payment
+// is looked up again when its receipt is sent, and a receipt whose payment
+// was deleted in the meantime is suppressed.
+type ReceiptQueue struct {
+	db          *sql.DB
+	mailer      *Mailer
+	unsubscribe *Unsubscribe
+	currency    string
+	location    *time.Location
+	wake        chan struct{}
+	done        chan struct{}
+}
+
+// NewReceiptQueue creates a queue sending through mailer, with unsubscribe
+// links signed by unsubscribe. Receipts are dated in location.
+func NewReceiptQueue(db *sql.DB, mailer *Mailer, unsubscribe *Unsubscribe, currency string, location *time.Location) *ReceiptQueue {
+	return &ReceiptQueue{
+		db:          db,
+		mailer:      mailer,
+		unsubscribe: unsubscribe,
+		currency:    currency,
+		location:    location,
+		wake:        make(chan struct{}, 1),
+		done:        make(chan struct{}),
+	}
+}
+
+// Start sends queued receipts in a background goroutine, including any left
+// over from a previous run, until Stop
+func (rq *ReceiptQueue) Start() {
+	go func() {
+		for {
+			select {
+			case <-rq.wake:
+				rq.drain()
+			case <-rq.done:
+				return
+			}
+		}
+	}()
+	rq.Wake()
+}
+
+// Stop ends the worker; receipts still queued are sent on the next Start
+func (rq *ReceiptQueue) Stop() {
+	close(rq.done)
+}
+
+// Wake has the worker look for queued receipts. Call it once the
+// transaction that queued them is committed.
+func (rq *ReceiptQueue) Wake() {
+	select {
+	case rq.wake <- struct{}{}:
+	default:
+	}
+}
+
+// autoEmailReceipts reports whether receipts are emailed as payments are
+// created
+func autoEmailReceipts(q querier) (bool, error) {
+	var value string
+	err := q.QueryRow("SELECT value FROM settings WHERE key = ?", settingAutoEmailReceipts).Scan(&value)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return strconv.ParseBool(value)
+}
+
+// queueReceipts queues the receipts of newly created payments when receipts
+// are emailed automatically. Payments that aren't confirmed, such as
+// uncleared cheques, get none.
+func queueReceipts(q querier, paymentIDs ...int) error {
+	on, err := autoEmailReceipts(q)
+	if err != nil || !on {
+		return err
+	}
+	for _, id := range paymentIDs {
+		_, err := q.Exec("INSERT INTO receipt_emails(payment_id, resident_id) SELECT id, resident_id FROM payments WHERE id = ? AND status = ?",
+			id, PaymentStatusConfirmed)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (rq *ReceiptQueue) drain() {
+	for {
+		select {
+		case <-rq.done:
+			return
+		default:
+		}
+
+		var id, paymentID int
+		err := rq.db.QueryRow("SELECT id, payment_id FROM receipt_emails WHERE status = ? ORDER BY id LIMIT 1", ReceiptEmailQueued).
+			Scan(&id, &paymentID)
+		if err == sql.ErrNoRows {
+			return
+		}
+		if err != nil {
+			log.Printf("Error reading receipt queue: %v", err)
+			return
+		}
+
+		email, status, reason := rq.send(paymentID)
+		if status == ReceiptEmailFailed {
+			log.Printf("Failed to email the receipt of payment %d: %s", paymentID, reason)
+		}
+		_, err = rq.db.Exec("UPDATE receipt_emails SET email = ?1, status = ?2, reason = ?3, sent_at = CASE WHEN ?2 = ?4 THEN CURRENT_TIMESTAMP END WHERE id = ?5",
+			email, status, reason, ReceiptEmailSent, id)
+		if err != nil {
+			log.Printf("Error updating receipt email %d: %v", id, err)
+			return
+		}
+	}
+}
+
+// send emails the receipt of a payment as it is now, and returns the address
+// it went to, the status to record and why it wasn't sent
+func (rq *ReceiptQueue) send(paymentID int) (string, string, string) {
+	receipt, err := loadPaymentReceipt(rq.db, paymentID, rq.currency)
+	switch {
+	case err == sql.ErrNoRows:
+		return "", ReceiptEmailSuppressed, "payment was deleted"
+	case err != nil:
+		return "", ReceiptEmailFailed, err.Error()
+	case receipt.status != PaymentStatusConfirmed:
+		return receipt.email, ReceiptEmailSuppressed, "payment is " + receipt.status
+	case receipt.anonymized:
+		return "", ReceiptEmailSuppressed, "resident was anonymized"
+	case receipt.channel == "none":
+		return receipt.email, ReceiptEmailSkipped, "resident opted out of receipts"
+	case receipt.email == "":
+		return "", ReceiptEmailSkipped, "no email address"
+	case !rq.mailer.Enabled():
+		return receipt.email, ReceiptEmailFailed, "email is not configured"
+	}
+
+	if err := receipt.send(rq.db, rq.mailer, rq.unsubscribe, rq.location); err != nil {
+		return receipt.email, ReceiptEmailFailed, err.Error()
+	}
+	return receipt.email, ReceiptEmailSent, ""
+}
+
+// paymentReceipt is a payment with what its receipt email needs
+type paymentReceipt struct {
+	data                   receiptMailData
+	residentID             int
+	email, channel, status string
+	anonymized             bool
+}
+
+// loadPaymentReceipt reads a payment and its resident for a receipt. It
+// returns sql.ErrNoRows when the payment doesn't exist.
+func loadPaymentReceipt(q querier, id int, currency string) (paymentReceipt, error) {
+	receipt := paymentReceipt{data: receiptMailData{Currency: currency}}
+	err := q.QueryRow(`
+		SELECT p.id, r.id, r.name, r.unit, r.email, r.notify_receipts, r.anonymized_at IS NOT NULL,
+			p.amount, p.payment_date, p.description, p.method, p.reference, p.status
+		FROM payments p
+		JOIN residents r ON p.resident_id = r.id
+		WHERE p.id = ?
+	`, id).Scan(&receipt.data.PaymentID, &receipt.residentID, &receipt.data.Name, &receipt.data.Unit, &receipt.email, &receipt.channel, &receipt.anonymized,
+		&receipt.data.Amount, &receipt.data.Date, &receipt.data.Description, &receipt.data.Method, &receipt.data.Reference, &receipt.status)
+	receipt.data.Date = normalizeDate(receipt.data.Date)
+	return receipt, err
+}
+
+// send emails the receipt with the receipt template and the receipt as a PDF
+// attachment, issued today in location
+func (p paymentReceipt) send(db *sql.DB, mailer *Mailer, unsubscribe *Unsubscribe, location *time.Location) error {
+	subjectTemplate, bodyTemplate, err := loadEmailTemplate(db, "receipt", p.data.Currency)
+	if err != nil {
+		return err
+	}
+	subject, body, err := renderEmail(subjectTemplate, bodyTemplate, p.data)
+	if err != nil {
+		return err
+	}
+	var pdf bytes.Buffer
+	if _, err := receiptPDF(p.data, defaultLanguage, time.Now().In(location).Format("2006-01-02")).WriteTo(&pdf); err != nil {
+		return err
+	}
+	attachment := MailAttachment{
+		Filename:    fmt.Sprintf("receipt_%d.pdf", p.data.PaymentID),
+		ContentType: "application/pdf",
+		Data:        pdf.Bytes(),
+	}
+	return mailer.SendWithUnsubscribe(p.email, subject, body, unsubscribe.URL(p.residentID, NotifyReceipts), attachment)
+}
+
+// receiptPDF lays out the receipt of a payment, issued on a YYYY-MM-DD date,
+// as a PDF document labelled in lang
+func receiptPDF(data receiptMailData, lang, issued string) *pdfDocument {
+	label := func(id string, args ...interface{}) string {
+		return fmt.Sprintf(message(lang, id), args...)
+	}
+
+	doc := newPDFDocument()
+	doc.Line(pdfBold, 16, label("receipt_title", data.PaymentID))
+	doc.Space(6)
+	doc.Line(pdfBold, 11, data.Name)
+	doc.Line(pdfRegular, 10, label("statement_unit", data.Unit))
+	doc.Space(10)
+	doc.Paragraph(pdfRegular, 11, label("receipt_received", data.Amount, data.Currency, data.Date))
+	for _, detail := range []struct{ id, value string }{
+		{"receipt_description", data.Description},
+		{"receipt_method", data.Method},
+		{"receipt_reference", data.Reference},
+	} {
+		if detail.value != "" {
+			doc.Line(pdfRegular, 10, label(detail.id, detail.value))
+		}
+	}
+	doc.Space(10)
+	doc.Line(pdfRegular, 9, label("receipt_issued", issued))
+	return doc
+}
+
+// receiptEmailColumns are the columns scanned by scanReceiptEmail
+const receiptEmailColumns = "id, payment_id, resident_id, email, status, reason, created_at, sent_at"
+
+func scanReceiptEmail(row interface{ Scan(...interface{}) error }) (ReceiptEmail, error) {
+	var e ReceiptEmail
+	var sentAt sql.NullTime
+	if err := row.Scan(&e.ID, &e.PaymentID, &e.ResidentID, &e.Email, &e.Status, &e.Reason, &e.CreatedAt, &sentAt); err != nil {
+		return e, err
+	}
+	if sentAt.Valid {
+		e.SentAt = &sentAt.Time
+	}
+	return e, nil
+}
+
+// Get the receipt email log, newest first, optionally of one payment or with
+// one status
+func getReceiptEmails(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := checkQueryParams(r, "payment_id", "status"); err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		query := "SELECT " + receiptEmailColumns + " FROM receipt_emails WHERE 1 = 1"
+		var args []interface{}
+		if value := r.URL.Query().Get("payment_id"); value != "" {
+			id, err := strconv.Atoi(value)
+			if err != nil {
+				respondWithError(w, http.StatusBadRequest, "Invalid payment ID")
+				return
+			}
+			query += " AND payment_id = ?"
+			args = append(args, id)
+		}
+		if status := r.URL.Query().Get("status"); status != "" {
+			switch status {
+			case ReceiptEmailQueued, ReceiptEmailSent, ReceiptEmailFailed, ReceiptEmailSkipped, ReceiptEmailSuppressed:
+			default:
+				respondWithError(w, http.StatusBadRequest, "Invalid status, must be queued, sent, failed, skipped or suppressed")
+				return
+			}
+			query += " AND status = ?"
+			args = append(args, status)
+		}
+
+		rows, err := db.Query(query+" ORDER BY id DESC", args...)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		defer rows.Close()
+
+		emails := []ReceiptEmail{}
+		for rows.Next() {
+			e, err := scanReceiptEmail(rows)
+			if err != nil {
+				respondWithError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			emails = append(emails, e)
+		}
+		if err := rows.Err(); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		respondWithJSON(w, http.StatusOK, emails)
+	}
+}
+
+// Queue the receipt of a payment to be emailed again. It answers 202 with the
+// queued receipt, whose status the log has once it is sent.
+func resendPaymentReceipt(db *sql.DB, receipts *ReceiptQueue) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(mux.Vars(r)["id"])
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid payment ID")
+			return
+		}
+
+		var residentID int
+		var status string
+		err = db.QueryRow("SELECT resident_id, status FROM payments WHERE id = ?", id).Scan(&residentID, &status)
+		if err == sql.ErrNoRows {
+			respondWithError(w, http.StatusNotFound, "Payment not found")
+			return
+		}
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if status != PaymentStatusConfirmed {
+			respondWithError(w, http.StatusConflict, "Only confirmed payments have receipts")
+			return
+		}
+
+		result, err := db.Exec("INSERT INTO receipt_emails(payment_id, resident_id) VALUES(?, ?)", id, residentID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		queued, err := result.LastInsertId()
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		email, err := scanReceiptEmail(db.QueryRow("SELECT "+receiptEmailColumns+" FROM receipt_emails WHERE id = ?", queued))
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		receipts.Wake()
+
+		respondWithJSON(w, http.StatusAccepted, email)
+	}
+}
+
+// Get whether receipts are emailed as payments are created
+func getReceiptSettings(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		on, err := autoEmailReceipts(db)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		respondWithJSON(w, http.StatusOK, ReceiptSettings{AutoEmail: on})
+	}
+}
+
+// Set whether receipts are emailed as payments are created. Turning it on
+// needs email to be configured.
+func putReceiptSettings(db *sql.DB, mailer *Mailer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := requireAdmin(db, w, r); !ok {
+			return
+		}
+		var req ReceiptSettings
+		if err := decodeRequest(r, &req); err != nil {
+			respondWithError(w, payloadErrorStatus(err), "Invalid request payload: "+err.Error())
+			return
+		}
+		defer r.Body.Close()
+
+		if req.AutoEmail && !mailer.Enabled() {
+			respondWithError(w, http.StatusBadRequest, "Email is not configured")
+			return
+		}
+		if err := setSetting(db, settingAutoEmailReceipts, strconv.FormatBool(req.AutoEmail)); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		respondWithJSON(w, http.StatusOK, req)
+	}
+}
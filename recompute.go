@@ -0,0 +1,372 @@
+package condomngr
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// Settlement statuses of a charge, from the payments allocated to it
+const (
+	ChargeOpen    = "open"
+	ChargePartial = "partial"
+	ChargePaid    = "paid"
+)
+
+// AllocationDiscrepancy is an amount of a payment allocated to a charge that
+// a recompute changes; 0 before means it was missing, 0 after that it was
+// removed
+type AllocationDiscrepancy struct {
+	ResidentID int     `json:"resident_id"`
+	PaymentID  int     `json:"payment_id"`
+	ChargeID   int     `json:"charge_id"`
+	Before     float64 `json:"before"`
+	After      float64 `json:"after"`
+}
+
+// ChargeDiscrepancy is a charge whose settled amount a recompute changes
+type ChargeDiscrepancy struct {
+	ChargeID      int     `json:"charge_id"`
+	ResidentID    int     `json:"resident_id"`
+	Period        string  `json:"period"`
+	Amount        float64 `json:"amount"`
+	SettledBefore float64 `json:"settled_before"`
+	SettledAfter  float64 `json:"settled_after"`
+	StatusBefore  string  `json:"status_before"` // open, partial or paid
+	StatusAfter   string  `json:"status_after"`
+}
+
+// ResidentDiscrepancy is a resident whose charges left open a recompute
+// changes. Balance is computed from the raw rows, so it is the same before and
+// after; the open charges add up to it once the payments are fully allocated.
+type ResidentDiscrepancy struct {
+	ResidentID int     `json:"resident_id"`
+	Balance    float64 `json:"balance"`
+	OpenBefore float64 `json:"open_before"`
+	OpenAfter  float64 `json:"open_after"`
+}
+
+// RecomputeResult lists every derived figure a recompute corrected, or with
+// check_only would correct
+type RecomputeResult struct {
+	CheckedAt            time.Time               `json:"checked_at"`
+	CheckOnly            bool                    `json:"check_only"`
+	Discrepancies        int                     `json:"discrepancies"`
+	Allocations          []AllocationDiscrepancy `json:"allocations"`
+	Charges              []ChargeDiscrepancy     `json:"charges"`
+	Residents            []ResidentDiscrepancy   `json:"residents"`
+	Reserve              []ReserveChange         `json:"reserve"`
+	ReserveBalanceBefore float64                 `json:"reserve_balance_before"`
+	ReserveBalanceAfter  float64                 `json:"reserve_balance_after"`
+}
+
+// derivedFigures is a snapshot of what is stored about payments beyond the
+// payments and charges themselves
+type derivedFigures struct {
+	allocations    map[[2]int]AllocationDiscrepancy // by payment and charge, with the amount in Before
+	charges        []ChargeDiscrepancy              // with the settled amount in SettledBefore
+	reserve        map[int]ReserveChange            // by payment, with the share in PercentBefore and ReserveBefore
+	reserveBalance float64
+}
+
+func chargeStatus(amount, settled float64) string {
+	switch {
+	case settled < 0.005:
+		return ChargeOpen
+	case settled < amount-0.005:
+		return ChargePartial
+	default:
+		return ChargePaid
+	}
+}
+
+// loadDerivedFigures takes a snapshot of the allocations, what they settle of
+// each charge, the reserve contributions and the reserve fund balance
+func loadDerivedFigures(q querier) (derivedFigures, error) {
+	f := derivedFigures{allocations: map[[2]int]AllocationDiscrepancy{}, reserve: map[int]ReserveChange{}}
+
+	rows, err := q.Query(`
+		SELECT MIN(resident_id), payment_id, charge_id, SUM(amount) FROM payment_allocations
+		GROUP BY payment_id, charge_id
+	`)
+	if err != nil {
+		return f, err
+	}
+	for rows.Next() {
+		var a AllocationDiscrepancy
+		if err := rows.Scan(&a.ResidentID, &a.PaymentID, &a.ChargeID, &a.Before); err != nil {
+			rows.Close()
+			return f, err
+		}
+		a.Before = roundCents(a.Before)
+		f.allocations[[2]int{a.PaymentID, a.ChargeID}] = a
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return f, err
+	}
+
+	rows, err = q.Query(`
+		SELECT c.id, c.resident_id, c.period, c.amount, COALESCE((SELECT SUM(a.amount) FROM payment_allocations a WHERE a.charge_id = c.id), 0)
+		FROM charges c ORDER BY c.resident_id, c.due_date, c.id
+	`)
+	if err != nil {
+		return f, err
+	}
+	for rows.Next() {
+		var c ChargeDiscrepancy
+		if err := rows.Scan(&c.ChargeID, &c.ResidentID, &c.Period, &c.Amount, &c.SettledBefore); err != nil {
+			rows.Close()
+			return f, err
+		}
+		c.SettledBefore = roundCents(c.SettledBefore)
+		f.charges = append(f.charges, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return f, err
+	}
+
+	rows, err = q.Query("SELECT payment_id, payment_date, payment_amount, percent, amount FROM reserve_contributions")
+	if err != nil {
+		return f, err
+	}
+	for rows.Next() {
+		var c ReserveChange
+		if err := rows.Scan(&c.PaymentID, &c.PaymentDate, &c.Amount, &c.PercentBefore, &c.ReserveBefore); err != nil {
+			rows.Close()
+			return f, err
+		}
+		f.reserve[c.PaymentID] = c
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return f, err
+	}
+
+	err = q.QueryRow(`
+		SELECT COALESCE(SUM(c.amount), 0) FROM reserve_contributions c
+		JOIN payments p ON p.id = c.payment_id
+		WHERE p.status = ?
+	`, PaymentStatusConfirmed).Scan(&f.reserveBalance)
+	f.reserveBalance = roundCents(f.reserveBalance)
+	return f, err
+}
+
+// recomputeReserve drops the reserve contributions of payments that no longer
+// exist, corrects the amounts that don't match the percent they were recorded
+// at, and records the missing and stale ones. The rule a payment was recorded
+// under is kept; applying new rules is left to the reserve recalculation.
+func recomputeReserve(q querier) error {
+	if _, err := q.Exec("DELETE FROM reserve_contributions WHERE payment_id NOT IN (SELECT id FROM payments)"); err != nil {
+		return err
+	}
+	rows, err := q.Query("SELECT payment_id, payment_amount, percent, amount FROM reserve_contributions")
+	if err != nil {
+		return err
+	}
+	wrong := map[int]float64{}
+	for rows.Next() {
+		var id int
+		var paymentAmount, percent, amount float64
+		if err := rows.Scan(&id, &paymentAmount, &percent, &amount); err != nil {
+			rows.Close()
+			return err
+		}
+		if reserve := roundCents(paymentAmount * percent / 100); reserve != amount {
+			wrong[id] = reserve
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for id, reserve := range wrong {
+		if _, err := q.Exec("UPDATE reserve_contributions SET amount = ? WHERE payment_id = ?", reserve, id); err != nil {
+			return err
+		}
+	}
+	return tagReserve(q)
+}
+
+// compareDerivedFigures fills result with the differences between the
+// snapshots taken before and after a recompute
+func compareDerivedFigures(q querier, before, after derivedFigures, result *RecomputeResult) error {
+	for key, a := range before.allocations {
+		a.After = after.allocations[key].Before
+		if a.After != a.Before {
+			result.Allocations = append(result.Allocations, a)
+		}
+	}
+	for key, a := range after.allocations {
+		if _, ok := before.allocations[key]; !ok {
+			a.After, a.Before = a.Before, 0
+			result.Allocations = append(result.Allocations, a)
+		}
+	}
+	slices.SortFunc(result.Allocations, func(a, b AllocationDiscrepancy) int {
+		if a.ResidentID != b.ResidentID {
+			return a.ResidentID - b.ResidentID
+		}
+		if a.PaymentID != b.PaymentID {
+			return a.PaymentID - b.PaymentID
+		}
+		return a.ChargeID - b.ChargeID
+	})
+
+	// A recompute doesn't touch the charges, so both snapshots list the same
+	// ones in the same order
+	open := map[int]*ResidentDiscrepancy{}
+	var residents []int
+	for i, c := range before.charges {
+		c.SettledAfter = after.charges[i].SettledBefore
+		r := open[c.ResidentID]
+		if r == nil {
+			r = &ResidentDiscrepancy{ResidentID: c.ResidentID}
+			open[c.ResidentID] = r
+			residents = append(residents, c.ResidentID)
+		}
+		r.OpenBefore = roundCents(r.OpenBefore + c.Amount - c.SettledBefore)
+		r.OpenAfter = roundCents(r.OpenAfter + c.Amount - c.SettledAfter)
+		if c.SettledAfter != c.SettledBefore {
+			c.StatusBefore, c.StatusAfter = chargeStatus(c.Amount, c.SettledBefore), chargeStatus(c.Amount, c.SettledAfter)
+			result.Charges = append(result.Charges, c)
+		}
+	}
+	for _, id := range residents {
+		r := open[id]
+		if r.OpenAfter == r.OpenBefore {
+			continue
+		}
+		b, err := residentBalance(q, id)
+		if err != nil {
+			return err
+		}
+		r.Balance = b.Balance
+		result.Residents = append(result.Residents, *r)
+	}
+
+	for id, c := range before.reserve {
+		if now, ok := after.reserve[id]; ok {
+			c.PercentAfter, c.ReserveAfter = now.PercentBefore, now.ReserveBefore
+			c.Amount, c.PaymentDate = now.Amount, now.PaymentDate
+		}
+		if c.PercentAfter != c.PercentBefore || c.ReserveAfter != c.ReserveBefore {
+			result.Reserve = append(result.Reserve, c)
+		}
+	}
+	for id, c := range after.reserve {
+		if _, ok := before.reserve[id]; !ok {
+			c.PercentAfter, c.ReserveAfter = c.PercentBefore, c.ReserveBefore
+			c.PercentBefore, c.ReserveBefore = 0, 0
+			result.Reserve = append(result.Reserve, c)
+		}
+	}
+	slices.SortFunc(result.Reserve, func(a, b ReserveChange) int { return a.PaymentID - b.PaymentID })
+
+	result.ReserveBalanceBefore, result.ReserveBalanceAfter = before.reserveBalance, after.reserveBalance
+	result.Discrepancies = len(result.Allocations) + len(result.Charges) + len(result.Residents) + len(result.Reserve)
+	return nil
+}
+
+// recompute rebuilds the payment allocations and reserve contributions from
+// the payments and charges in one transaction, and reports every figure that
+// differed. With checkOnly nothing is changed; otherwise the corrections are
+// recorded in the audit log as done through r (nil from the command line).
+func recompute(db *sql.DB, r *http.Request, checkOnly bool, rules paymentRules) (RecomputeResult, error) {
+	result := RecomputeResult{
+		CheckedAt:   time.Now().UTC(),
+		CheckOnly:   checkOnly,
+		Allocations: []AllocationDiscrepancy{},
+		Charges:     []ChargeDiscrepancy{},
+		Residents:   []ResidentDiscrepancy{},
+		Reserve:     []ReserveChange{},
+	}
+	if !dbLock(db).TryLock() {
+		return result, errBusy
+	}
+	defer dbLock(db).Unlock()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return result, err
+	}
+	defer tx.Rollback()
+
+	before, err := loadDerivedFigures(tx)
+	if err != nil {
+		return result, err
+	}
+	// reallocateAll only looks at the allocations of existing residents
+	_, err = tx.Exec(`
+		DELETE FROM payment_allocations WHERE resident_id NOT IN (SELECT id FROM residents)
+			OR charge_id NOT IN (SELECT id FROM charges)
+			OR resident_id != (SELECT p.resident_id FROM payments p WHERE p.id = payment_id)
+	`)
+	if err != nil {
+		return result, err
+	}
+	if err := reallocateAll(tx, rules); err != nil {
+		return result, err
+	}
+	if err := recomputeReserve(tx); err != nil {
+		return result, err
+	}
+	after, err := loadDerivedFigures(tx)
+	if err != nil {
+		return result, err
+	}
+	if err := compareDerivedFigures(tx, before, after, &result); err != nil {
+		return result, err
+	}
+
+	if checkOnly || result.Discrepancies == 0 {
+		return result, nil
+	}
+	detail := fmt.Sprintf("%d allocations, %d charges, %d residents, %d reserve contributions",
+		len(result.Allocations), len(result.Charges), len(result.Residents), len(result.Reserve))
+	if err := recordAudit(tx, r, AuditRecompute, "database", detail); err != nil {
+		return result, err
+	}
+	return result, tx.Commit()
+}
+
+// Handlers for recompute endpoints
+
+// Recompute the allocations, charge statuses, resident balances and reserve
+// fund from the payments and charges, reporting what was corrected. Nothing is
+// changed with check_only=true.
+func postRecompute(db *sql.DB, changes *ChangeBroker, rules paymentRules) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := checkQueryParams(r, "check_only"); err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		checkOnly := false
+		if value := r.URL.Query().Get("check_only"); value != "" {
+			var err error
+			if checkOnly, err = strconv.ParseBool(value); err != nil {
+				respondWithError(w, http.StatusBadRequest, "Invalid check_only, must be true or false")
+				return
+			}
+		}
+
+		result, err := recompute(db, r, checkOnly, rules)
+		if errors.Is(err, errBusy) {
+			respondWithError(w, http.StatusConflict, err.Error())
+			return
+		}
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if !checkOnly && result.Discrepancies > 0 {
+			changes.Publish(Change{Type: "payment", Action: ChangeImported})
+		}
+		respondWithJSON(w, http.StatusOK, result)
+	}
+}
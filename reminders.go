@@ -0,0 +1,158 @@
+package condomngr
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// ReminderSkip records a resident who was not reminded and why
+type ReminderSkip struct {
+	ResidentID int    `json:"resident_id"`
+	Name       string `json:"name"`
+	Reason     string `json:"reason"`
+}
+
+// ReminderRun summarizes a run of the overdue reminder flow
+type ReminderRun struct {
+	Month      string         `json:"month"`
+	Overdue    int            `json:"overdue"`
+	SMSQueued  int            `json:"sms_queued"`
+	EmailsSent int            `json:"emails_sent"`
+	Skipped    []ReminderSkip `json:"skipped"`
+}
+
+// reminderChannel picks the channel to remind a resident through, honoring
+// their preference and falling back to SMS for residents without an email
+func reminderChannel(r Resident) string {
+	switch r.NotifyChannel {
+	case "none", "email", "sms":
+		return r.NotifyChannel
+	}
+	if r.Email == "" && r.Contact != "" {
+		return "sms"
+	}
+	if r.Email != "" {
+		return "email"
+	}
+	return ""
+}
+
+// Send reminders to residents without a payment in the given month
+func sendOverdueReminders(db *sql.DB, sms *SMSQueue, mailer *Mailer, unsubscribe *Unsubscribe, currency string, cal calendar) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		month := r.URL.Query().Get("month")
+		if month == "" {
+			month = cal.now().Format("2006-01")
+		}
+		period, err := time.Parse("2006-01", month)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "invalid month format, must be YYYY-MM")
+			return
+		}
+		subject, body, err := loadEmailTemplate(db, "reminder", currency)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		details, err := loadPaymentDetails(db)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		rows, err := db.Query(`
+			SELECT id, name, unit, contact, email, notify_channel
+			FROM residents
+			WHERE anonymized_at IS NULL AND id NOT IN (SELECT resident_id FROM payments WHERE substr(payment_date, 1, 7) = ?)
+			ORDER BY unit
+		`, month)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		overdue := []Resident{}
+		for rows.Next() {
+			var resident Resident
+			if err := rows.Scan(&resident.ID, &resident.Name, &resident.Unit, &resident.Contact, &resident.Email, &resident.NotifyChannel); err != nil {
+				rows.Close()
+				respondWithError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			overdue = append(overdue, resident)
+		}
+		rows.Close()
+
+		run := ReminderRun{
+			Month:   month,
+			Overdue: len(overdue),
+			Skipped: []ReminderSkip{},
+		}
+
+		for _, resident := range overdue {
+			skip := func(reason string) {
+				run.Skipped = append(run.Skipped, ReminderSkip{ResidentID: resident.ID, Name: resident.Name, Reason: reason})
+			}
+
+			switch reminderChannel(resident) {
+			case "sms":
+				if !sms.Enabled() {
+					skip("SMS channel is not configured")
+					continue
+				}
+				if resident.Contact == "" {
+					skip("no phone number")
+					continue
+				}
+				if run.SMSQueued >= sms.MaxPerRun {
+					skip("SMS limit per run reached")
+					continue
+				}
+				body := fmt.Sprintf("Hello %s, we have not received the condo payment for unit %s for %s. Please disregard this message if you have already paid.",
+					resident.Name, resident.Unit, month)
+				if _, err := sms.Enqueue(resident.ID, resident.Contact, body); err != nil {
+					skip(fmt.Sprintf("failed to queue SMS: %v", err))
+					continue
+				}
+				run.SMSQueued++
+			case "email":
+				if !mailer.Enabled() {
+					skip("email is not configured")
+					continue
+				}
+				data := reminderMailData{Name: resident.Name, Unit: resident.Unit, Month: period.Format("January 2006"), Currency: currency}
+				var attachments []MailAttachment
+				if details.Configured() {
+					pr, err := paymentRequestFor(db, details, resident.ID, month, currency, defaultLanguage)
+					if err != nil {
+						skip(fmt.Sprintf("failed to make the payment request: %v", err))
+						continue
+					}
+					data.Amount, data.Reference = pr.Amount, pr.Reference
+					data.Payee, data.IBAN, data.BIC = pr.Payee, formatIBAN(pr.IBAN), pr.BIC
+					if pr.QRCodePNG != nil {
+						attachments = append(attachments, MailAttachment{Filename: "payment-" + month + ".png", ContentType: "image/png", Data: pr.QRCodePNG})
+					}
+				}
+				subjectText, bodyText, err := renderEmail(subject, body, data)
+				if err != nil {
+					skip(err.Error())
+					continue
+				}
+				if err := mailer.SendWithUnsubscribe(resident.Email, subjectText, bodyText, unsubscribe.URL(resident.ID, NotifyReminders), attachments...); err != nil {
+					skip(fmt.Sprintf("failed to send email: %v", err))
+					continue
+				}
+				run.EmailsSent++
+			case "none":
+				skip("resident opted out of reminders")
+			default:
+				skip("no email or phone number")
+			}
+		}
+
+		respondWithJSON(w, http.StatusOK, run)
+	}
+}
@@ -0,0 +1,187 @@
+package condomngr
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// reportColumn is a column a CSV report can have: its name in the columns
+// parameter, its header, and its value in the row being written
+type reportColumn struct {
+	name   string
+	header string
+	value  func() string
+}
+
+// pickReportColumns reads the columns parameter of a CSV report, a
+// comma-separated list of the names of columns it has, in the order they are
+// wanted. Without it the report has the defaults.
+func pickReportColumns(r *http.Request, columns []reportColumn, defaults []string) ([]reportColumn, error) {
+	names := defaults
+	if value := r.URL.Query().Get("columns"); value != "" {
+		names = strings.Split(value, ",")
+	}
+	byName := map[string]reportColumn{}
+	for _, column := range columns {
+		byName[column.name] = column
+	}
+
+	var picked []reportColumn
+	var unknown []string
+	seen := map[string]bool{}
+	for _, name := range names {
+		name = strings.ToLower(strings.TrimSpace(name))
+		column, ok := byName[name]
+		switch {
+		case name == "":
+			continue
+		case !ok:
+			unknown = append(unknown, name)
+		case seen[name]:
+			return nil, fmt.Errorf("Duplicate report column: %s", name)
+		default:
+			seen[name] = true
+			picked = append(picked, column)
+		}
+	}
+	if len(unknown) > 0 {
+		return nil, fmt.Errorf("Unknown report column: %s", strings.Join(unknown, ", "))
+	}
+	if len(picked) == 0 {
+		return nil, fmt.Errorf("Invalid columns, must list at least one column")
+	}
+	return picked, nil
+}
+
+// reportHeader returns the headers of columns in lang
+func reportHeader(columns []reportColumn, lang string) []string {
+	header := make([]string, len(columns))
+	for i, column := range columns {
+		header[i] = reportLabel(lang, "column_"+column.name, column.header)
+	}
+	return header
+}
+
+// reportLabels returns the headers of the built-in columns with names in lang
+func reportLabels(lang string, names ...string) []string {
+	labels := make([]string, len(names))
+	for i, name := range names {
+		labels[i] = reportLabel(lang, "column_"+name, name)
+	}
+	return labels
+}
+
+// reportRow returns the values of columns in the row being written
+func reportRow(columns []reportColumn) []string {
+	row := make([]string, len(columns))
+	for i, column := range columns {
+		row[i] = column.value()
+	}
+	return row
+}
+
+// reportColumnIndex returns the position of the column with a name, or -1
+func reportColumnIndex(columns []reportColumn, name string) int {
+	for i, column := range columns {
+		if column.name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// customReportColumns are the residents' custom fields as report columns,
+// named custom.<key>, for the resident of the row being written
+func customReportColumns(custom *customColumns, locale csvLocale, residentID *int) []reportColumn {
+	columns := make([]reportColumn, len(custom.fields))
+	for i, f := range custom.fields {
+		columns[i] = reportColumn{"custom." + f.Key, f.Label, func() string { return custom.Value(locale, *residentID, i) }}
+	}
+	return columns
+}
+
+// paymentReportRow is a row of the payments report as read
+type paymentReportRow struct {
+	ID, ResidentID                                              int
+	Name, Unit, Email, Contact                                  string
+	Amount                                                      float64
+	Description, Date, Method, Status, Reference, BankReference string
+	ChequeNumber, ChequeBank, ChequeStatus                      string
+	CreatedAt, UpdatedAt                                        time.Time
+}
+
+// paymentReportColumns are the columns the payments report can have, for
+// the row p, and those it has by default: its layout before the columns
+// parameter, with the residents' custom fields last
+func paymentReportColumns(p *paymentReportRow, locale csvLocale, custom *customColumns) ([]reportColumn, []string) {
+	columns := []reportColumn{
+		{"id", "ID", func() string { return strconv.Itoa(p.ID) }},
+		{"resident_id", "Resident ID", func() string { return strconv.Itoa(p.ResidentID) }},
+		{"resident", "Resident", func() string { return p.Name }},
+		{"unit", "Unit", func() string { return p.Unit }},
+		{"email", "Email", func() string { return p.Email }},
+		{"contact", "Contact", func() string { return p.Contact }},
+		{"amount", "Amount", func() string { return locale.Amount(p.Amount) }},
+		{"description", "Description", func() string { return p.Description }},
+		{"date", "Date", func() string { return locale.Date(p.Date) }},
+		{"method", "Method", func() string { return p.Method }},
+		{"status", "Status", func() string { return p.Status }},
+		{"reference", "Reference", func() string { return p.Reference }},
+		{"bank_reference", "Bank Reference", func() string { return p.BankReference }},
+		{"cheque_number", "Cheque Number", func() string { return p.ChequeNumber }},
+		{"cheque_bank", "Cheque Bank", func() string { return p.ChequeBank }},
+		{"cheque_status", "Cheque Status", func() string { return p.ChequeStatus }},
+		{"created", "Created", func() string { return locale.Time(p.CreatedAt) }},
+		{"updated", "Updated", func() string { return locale.Time(p.UpdatedAt) }},
+	}
+	defaults := []string{"id", "resident", "unit", "amount", "description", "date", "updated"}
+	for _, column := range customReportColumns(custom, locale, &p.ResidentID) {
+		columns = append(columns, column)
+		defaults = append(defaults, column.name)
+	}
+	return columns, defaults
+}
+
+// expenseReportRow is a row of the expenses report as read
+type expenseReportRow struct {
+	ID                                                          int
+	Amount, OriginalAmount, ExchangeRate, TaxRate, TaxAmount    float64
+	Description, Date, Category, Currency, BankReference, Units string
+	CreatedAt, UpdatedAt                                        time.Time
+}
+
+// expenseReportColumns are the columns the expenses report can have, for
+// the row e, and those it has by default. Expenses in the base currency
+// have the original columns empty.
+func expenseReportColumns(e *expenseReportRow, locale csvLocale) ([]reportColumn, []string) {
+	original := func(value func() string) func() string {
+		return func() string {
+			if e.Currency == "" {
+				return ""
+			}
+			return value()
+		}
+	}
+	columns := []reportColumn{
+		{"id", "ID", func() string { return strconv.Itoa(e.ID) }},
+		{"amount", "Amount", func() string { return locale.Amount(e.Amount) }},
+		{"description", "Description", func() string { return e.Description }},
+		{"date", "Date", func() string { return locale.Date(e.Date) }},
+		{"category", "Category", func() string { return e.Category }},
+		{"updated", "Updated", func() string { return locale.Time(e.UpdatedAt) }},
+		{"original_amount", "Original Amount", original(func() string { return locale.Amount(e.OriginalAmount) })},
+		{"currency", "Currency", func() string { return e.Currency }},
+		{"exchange_rate", "Exchange Rate", original(func() string { return locale.Number(e.ExchangeRate) })},
+		{"tax_rate", "Tax Rate", func() string { return locale.Number(e.TaxRate) }},
+		{"tax_amount", "Tax Amount", func() string { return locale.Amount(e.TaxAmount) }},
+		{"net_amount", "Net Amount", func() string { return locale.Amount(roundCents(e.Amount - e.TaxAmount)) }},
+		{"units", "Units", func() string { return e.Units }},
+		{"bank_reference", "Bank Reference", func() string { return e.BankReference }},
+		{"created", "Created", func() string { return locale.Time(e.CreatedAt) }},
+	}
+	defaults := []string{"id", "amount", "description", "date", "category", "updated", "original_amount", "currency", "exchange_rate", "tax_rate", "tax_amount", "net_amount"}
+	return columns, defaults
+}
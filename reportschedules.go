@@ -0,0 +1,927 @@
+package condomngr
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+// Formats scheduled reports are emailed in
+const (
+	ReportFormatCSV  = "csv"
+	ReportFormatPDF  = "pdf"
+	ReportFormatXLSX = "xlsx"
+)
+
+// Periods a scheduled report over dates covers, counted from the day it runs
+const (
+	ReportPeriodPreviousMonth = "previous_month"
+	ReportPeriodMonthToDate   = "month_to_date"
+)
+
+// Outcomes of a report run
+const (
+	ReportRunSuccess = "success"
+	ReportRunFailed  = "failed"
+	ReportRunMissed  = "missed" // due while the server was down, past the grace period
+)
+
+// What started a report run
+const (
+	ReportTriggerSchedule = "schedule"
+	ReportTriggerManual   = "manual"
+)
+
+// maxReportScheduleName is the longest name of a report schedule, in
+// characters
+const maxReportScheduleName = 100
+
+// reportCheckInterval is how often the scheduler looks for reports due
+const reportCheckInterval = time.Minute
+
+// defaultReportGrace is how late a scheduled report is still sent, e.g.
+// after the server was down when it was due
+const defaultReportGrace = 24 * time.Hour
+
+// scheduledReport is a report that can be scheduled: the handler of its
+// endpoint, which renders it as CSV with the fixed parameters, and the
+// parameters a schedule may set. Reports over a period are given its
+// start_date and end_date, the others the day they run as as_of.
+type scheduledReport struct {
+	title   string
+	handler func(db *sql.DB, cal calendar) http.HandlerFunc
+	params  []string
+	fixed   map[string]string
+	period  bool
+}
+
+// scheduledReports are the reports that can be scheduled, by name
+var scheduledReports = map[string]scheduledReport{
+	"income_expense": {
+		title:   "Income and expenses",
+		handler: getIncomeExpenseReport,
+		params:  []string{"locale"},
+		fixed:   map[string]string{"format": "csv"},
+		period:  true,
+	},
+	"payments": {
+		title:   "Payments",
+		handler: exportPaymentsReport,
+		params:  []string{"resident_id", "subtotals", "columns", "locale"},
+		period:  true,
+	},
+	"expenses": {
+		title:   "Expenses",
+		handler: exportExpensesReport,
+		params:  []string{"category", "exclude_category", "subtotals", "columns", "locale"},
+		period:  true,
+	},
+	"aging": {
+		title:   "Delinquency (receivables aging)",
+		handler: getAgingReport,
+		params:  []string{"include_zero", "locale"},
+		fixed:   map[string]string{"format": "csv"},
+	},
+}
+
+// ReportSchedule emails a report to a list of recipients on a schedule:
+// either a cron expression, or a day of the month and a time of day, in the
+// condominium's timezone
+type ReportSchedule struct {
+	ID         int               `json:"id"`
+	Name       string            `json:"name"`
+	Report     string            `json:"report"` // income_expense, payments, expenses or aging
+	Params     map[string]string `json:"params"`
+	Period     string            `json:"period,omitempty"` // previous_month or month_to_date, for reports over dates
+	Format     string            `json:"format"`           // csv, pdf or xlsx
+	Cron       string            `json:"cron,omitempty"`
+	DayOfMonth int               `json:"day_of_month,omitempty"` // 1 to 28
+	Time       string            `json:"time,omitempty"`         // HH:MM, with day_of_month
+	Recipients []string          `json:"recipients"`
+	Paused     bool              `json:"paused"`
+	NextRunAt  *time.Time        `json:"next_run_at,omitempty"` // none while paused
+	LastRun    *ReportRun        `json:"last_run,omitempty"`
+	CreatedAt  time.Time         `json:"created_at"`
+	UpdatedAt  time.Time         `json:"updated_at"`
+}
+
+// ReportRun is an entry of the log of scheduled reports
+type ReportRun struct {
+	ID         int        `json:"id"`
+	ScheduleID int        `json:"schedule_id"`
+	Trigger    string     `json:"trigger"` // schedule or manual
+	Status     string     `json:"status"`  // success, failed or missed
+	Error      string     `json:"error,omitempty"`
+	Filename   string     `json:"filename,omitempty"`
+	SentTo     []string   `json:"sent_to"`
+	DueAt      *time.Time `json:"due_at,omitempty"` // when a scheduled run was due
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt time.Time  `json:"finished_at"`
+}
+
+// cronExpr is the cron expression of the schedule, of which a day of the
+// month and a time are a shorthand
+func (s ReportSchedule) cronExpr() string {
+	if s.Cron != "" {
+		return s.Cron
+	}
+	at, _ := time.Parse("15:04", s.Time)
+	return fmt.Sprintf("%d %d %d * *", at.Minute(), at.Hour(), s.DayOfMonth)
+}
+
+// nextRun returns when the schedule runs next after after, nil while it is
+// paused
+func (s ReportSchedule) nextRun(after time.Time) *time.Time {
+	if s.Paused {
+		return nil
+	}
+	c, err := parseCron(s.cronExpr())
+	if err != nil {
+		return nil
+	}
+	next := c.Next(after)
+	if next.IsZero() {
+		return nil
+	}
+	next = next.UTC()
+	return &next
+}
+
+// locale is the CSV locale the schedule renders its report in, fallback
+// unless it sets one
+func (s ReportSchedule) locale(fallback string) csvLocale {
+	name := s.Params["locale"]
+	if name == "" {
+		name = fallback
+	}
+	locale, _ := findCSVLocale(name)
+	return locale
+}
+
+const reportScheduleColumns = "id, name, report, params, period, format, cron, day_of_month, time_of_day, recipients, paused, next_run_at, created_at, updated_at"
+
+func scanReportSchedule(row interface{ Scan(...interface{}) error }) (ReportSchedule, error) {
+	var s ReportSchedule
+	var params, recipients string
+	var next sql.NullTime
+	err := row.Scan(&s.ID, &s.Name, &s.Report, &params, &s.Period, &s.Format, &s.Cron, &s.DayOfMonth, &s.Time, &recipients, &s.Paused, &next, &s.CreatedAt, &s.UpdatedAt)
+	if err != nil {
+		return s, err
+	}
+	values, err := url.ParseQuery(params)
+	if err != nil {
+		return s, err
+	}
+	s.Params = map[string]string{}
+	for name := range values {
+		s.Params[name] = values.Get(name)
+	}
+	s.Recipients = strings.Split(recipients, ",")
+	if next.Valid {
+		s.NextRunAt = &next.Time
+	}
+	return s, nil
+}
+
+const reportRunColumns = "id, schedule_id, trigger, status, error, filename, sent_to, due_at, started_at, finished_at"
+
+func scanReportRun(row interface{ Scan(...interface{}) error }) (ReportRun, error) {
+	var run ReportRun
+	var sentTo string
+	var due sql.NullTime
+	err := row.Scan(&run.ID, &run.ScheduleID, &run.Trigger, &run.Status, &run.Error, &run.Filename, &sentTo, &due, &run.StartedAt, &run.FinishedAt)
+	run.SentTo = []string{}
+	if sentTo != "" {
+		run.SentTo = strings.Split(sentTo, ",")
+	}
+	if due.Valid {
+		run.DueAt = &due.Time
+	}
+	return run, err
+}
+
+// listReportSchedules returns the report schedules matching where, by name,
+// each with its last run
+func listReportSchedules(db *sql.DB, where string, args ...interface{}) ([]ReportSchedule, error) {
+	rows, err := db.Query("SELECT "+reportScheduleColumns+" FROM report_schedules "+where+" ORDER BY name", args...)
+	if err != nil {
+		return nil, err
+	}
+	schedules := []ReportSchedule{}
+	for rows.Next() {
+		s, err := scanReportSchedule(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		schedules = append(schedules, s)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for i := range schedules {
+		run, err := scanReportRun(db.QueryRow("SELECT "+reportRunColumns+" FROM report_runs WHERE schedule_id = ? ORDER BY id DESC LIMIT 1", schedules[i].ID))
+		if err == nil {
+			schedules[i].LastRun = &run
+		} else if err != sql.ErrNoRows {
+			return nil, err
+		}
+	}
+	return schedules, nil
+}
+
+// loadReportSchedule returns a report schedule, or sql.ErrNoRows
+func loadReportSchedule(db *sql.DB, id int) (ReportSchedule, error) {
+	schedules, err := listReportSchedules(db, "WHERE id = ?", id)
+	if err != nil {
+		return ReportSchedule{}, err
+	}
+	if len(schedules) == 0 {
+		return ReportSchedule{}, sql.ErrNoRows
+	}
+	return schedules[0], nil
+}
+
+// reportPeriod returns the first and last day of a period as of now
+func reportPeriod(period string, now time.Time) (string, string) {
+	first := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+	if period == ReportPeriodMonthToDate {
+		return first.Format("2006-01-02"), now.Format("2006-01-02")
+	}
+	return first.AddDate(0, -1, 0).Format("2006-01-02"), first.AddDate(0, 0, -1).Format("2006-01-02")
+}
+
+// reportRecorder keeps the response of a report handler called in-process
+type reportRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *reportRecorder) Header() http.Header {
+	return rec.header
+}
+
+func (rec *reportRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+}
+
+func (rec *reportRecorder) Write(p []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	return rec.body.Write(p)
+}
+
+// renderScheduledReport renders the report of a schedule as of now through
+// the handler of its endpoint, and converts it to the format of the
+// schedule. It returns the file and the dates it covers. The errors of the
+// handler, such as an invalid parameter, are returned in English. Reports
+// without a locale of their own are rendered in csvLocale.
+func renderScheduledReport(db *sql.DB, s ReportSchedule, now time.Time, cal calendar, csvLocale string) (MailAttachment, string, error) {
+	report := scheduledReports[s.Report]
+	query := url.Values{}
+	for name, value := range s.Params {
+		query.Set(name, value)
+	}
+	for name, value := range report.fixed {
+		query.Set(name, value)
+	}
+	var covers, stem string
+	if report.period {
+		start, end := reportPeriod(s.Period, now)
+		query.Set("start_date", start)
+		query.Set("end_date", end)
+		covers, stem = start+" to "+end, s.Report+"_"+start+"_"+end
+	} else {
+		asOf := now.Format("2006-01-02")
+		query.Set("as_of", asOf)
+		covers, stem = "as of "+asOf, s.Report+"_"+asOf
+	}
+
+	r, err := http.NewRequest("GET", "/?"+query.Encode(), nil)
+	if err != nil {
+		return MailAttachment{}, covers, err
+	}
+	r = r.WithContext(context.WithValue(r.Context(), requestOptionsKey{}, requestOptions{csvLocale: csvLocale}))
+	rec := &reportRecorder{header: http.Header{"Content-Language": {LangEnglish}}}
+	report.handler(db, cal)(rec, r)
+	if rec.status != http.StatusOK {
+		var response struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(rec.body.Bytes(), &response) != nil || response.Error == "" {
+			response.Error = fmt.Sprintf("the report failed with status %d", rec.status)
+		}
+		return MailAttachment{}, covers, errors.New(response.Error)
+	}
+
+	if s.Format == ReportFormatCSV {
+		return MailAttachment{Filename: stem + ".csv", ContentType: "text/csv", Data: rec.body.Bytes()}, covers, nil
+	}
+	locale := s.locale(csvLocale)
+	reader := csv.NewReader(bytes.NewReader(bytes.TrimPrefix(rec.body.Bytes(), []byte("\ufeff"))))
+	reader.Comma, _ = utf8.DecodeRuneInString(locale.Delimiter)
+	reader.FieldsPerRecord = -1
+	rows, err := reader.ReadAll()
+	if err != nil {
+		return MailAttachment{}, covers, err
+	}
+	var data bytes.Buffer
+	if s.Format == ReportFormatXLSX {
+		if err := writeXLSX(&data, "Report", rows, reportNumber(locale)); err != nil {
+			return MailAttachment{}, covers, err
+		}
+		return MailAttachment{Filename: stem + ".xlsx", ContentType: "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", Data: data.Bytes()}, covers, nil
+	}
+	if _, err := reportPDF(report.title, covers, rows, reportNumber(locale)).WriteTo(&data); err != nil {
+		return MailAttachment{}, covers, err
+	}
+	return MailAttachment{Filename: stem + ".pdf", ContentType: "application/pdf", Data: data.Bytes()}, covers, nil
+}
+
+// reportNumber reads the numbers of a CSV report written in locale, so they
+// are numbers in a workbook and lined up right in a PDF
+func reportNumber(locale csvLocale) func(string) (float64, bool) {
+	digits := func(s string) bool {
+		return s != "" && strings.Trim(s, "0123456789") == ""
+	}
+	return func(s string) (float64, bool) {
+		whole, fraction, decimal := strings.Cut(strings.TrimPrefix(s, "-"), locale.Decimal)
+		if !digits(whole) || decimal && !digits(fraction) {
+			return 0, false
+		}
+		n, err := strconv.ParseFloat(strings.Replace(s, locale.Decimal, ".", 1), 64)
+		return n, err == nil
+	}
+}
+
+// reportPDF lays out the rows of a report as a table in Courier under its
+// title, the widest columns narrowed, and their values cut, until a row fits
+// the width of the page
+func reportPDF(title, covers string, rows [][]string, number func(string) (float64, bool)) *pdfDocument {
+	size := 8.0
+	perLine := int((pdfPageWidth - 2*pdfMargin) / (size * 0.6))
+	var widths []int
+	for _, row := range rows {
+		for i, value := range row {
+			if i == len(widths) {
+				widths = append(widths, 0)
+			}
+			widths[i] = max(widths[i], utf8.RuneCountInString(value))
+		}
+	}
+	for {
+		total, widest := 2*(len(widths)-1), 0
+		for i, width := range widths {
+			total += width
+			if width > widths[widest] {
+				widest = i
+			}
+		}
+		if total <= perLine || widths[widest] <= 4 {
+			break
+		}
+		widths[widest]--
+	}
+
+	doc := newPDFDocument()
+	doc.Line(pdfBold, 14, title)
+	doc.Line(pdfRegular, 10, covers)
+	doc.Space(10)
+	for i, row := range rows {
+		cells := make([]string, len(widths))
+		for j, width := range widths {
+			var value []rune
+			if j < len(row) {
+				value = []rune(row[j])
+			}
+			if len(value) > width {
+				value = value[:width]
+			}
+			pad := strings.Repeat(" ", width-len(value))
+			if _, ok := number(string(value)); ok && i > 0 {
+				cells[j] = pad + string(value)
+			} else {
+				cells[j] = string(value) + pad
+			}
+		}
+		doc.Line(pdfMono, size, strings.TrimRight(strings.Join(cells, "  "), " "))
+		if i == 0 {
+			doc.Line(pdfMono, size, strings.Repeat("-", min(perLine, len(strings.Join(cells, "  ")))))
+		}
+	}
+	return doc
+}
+
+// runReportSchedule renders the report of a schedule and emails it to each
+// of its recipients, logging the run. due is when a scheduled run was due.
+func runReportSchedule(db *sql.DB, mailer *Mailer, s ReportSchedule, trigger string, due *time.Time, cal calendar, csvLocale string) (ReportRun, error) {
+	run := ReportRun{ScheduleID: s.ID, Trigger: trigger, DueAt: due, SentTo: []string{}, StartedAt: time.Now()}
+	file, covers, err := renderScheduledReport(db, s, cal.now(), cal, csvLocale)
+	if err == nil {
+		run.Filename = file.Filename
+		title := scheduledReports[s.Report].title
+		subject := fmt.Sprintf("%s: %s, %s", s.Name, title, covers)
+		body := fmt.Sprintf("Attached is the report %s, %s.\n\nIt is sent by the report schedule %q, which admins can change or pause.\n", title, covers, s.Name)
+		var failures []string
+		for _, to := range s.Recipients {
+			if err := mailer.Send(to, subject, body, file); err != nil {
+				failures = append(failures, to+": "+err.Error())
+				continue
+			}
+			run.SentTo = append(run.SentTo, to)
+		}
+		if len(failures) > 0 {
+			err = errors.New(strings.Join(failures, "; "))
+		}
+	}
+	run.Status = ReportRunSuccess
+	if err != nil {
+		run.Status, run.Error = ReportRunFailed, err.Error()
+	}
+	run.FinishedAt = time.Now()
+	return run, logReportRun(db, &run)
+}
+
+// logReportRun adds a run to the log, setting its id
+func logReportRun(db *sql.DB, run *ReportRun) error {
+	var due interface{}
+	if run.DueAt != nil {
+		due = run.DueAt.UTC()
+	}
+	result, err := db.Exec(`
+		INSERT INTO report_runs(schedule_id, trigger, status, error, filename, sent_to, due_at, started_at, finished_at)
+		VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, run.ScheduleID, run.Trigger, run.Status, run.Error, run.Filename, strings.Join(run.SentTo, ","), due, run.StartedAt.UTC(), run.FinishedAt.UTC())
+	if err != nil {
+		return err
+	}
+	id, err := result.LastInsertId()
+	run.ID = int(id)
+	return err
+}
+
+// scheduleReports emails the scheduled reports of db as they come due.
+// Reports due while the server was down are sent once it starts, once
+// however many runs were missed, when the last was due within grace; later
+// ones are logged as missed. Reports without a locale of their own are
+// rendered in csvLocale.
+func scheduleReports(db *sql.DB, mailer *Mailer, grace time.Duration, cal calendar, csvLocale string) {
+	go func() {
+		runDueReports(db, mailer, grace, cal, csvLocale)
+		ticker := time.NewTicker(reportCheckInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			runDueReports(db, mailer, grace, cal, csvLocale)
+		}
+	}()
+}
+
+func runDueReports(db *sql.DB, mailer *Mailer, grace time.Duration, cal calendar, csvLocale string) {
+	schedules, err := listReportSchedules(db, "WHERE next_run_at IS NOT NULL")
+	if err != nil {
+		log.Printf("Failed to list the report schedules: %v", err)
+		return
+	}
+	now := cal.now()
+	for _, s := range schedules {
+		due := *s.NextRunAt
+		if due.After(now) {
+			continue
+		}
+		// Move the schedule on first, unless it was changed meanwhile
+		result, err := db.Exec("UPDATE report_schedules SET next_run_at = ? WHERE id = ? AND next_run_at = ?", s.nextRun(now), s.ID, due)
+		if err != nil {
+			log.Printf("Failed to update report schedule %q: %v", s.Name, err)
+			continue
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			continue
+		}
+
+		if late := now.Sub(due); late > grace+reportCheckInterval {
+			run := ReportRun{ScheduleID: s.ID, Trigger: ReportTriggerSchedule, Status: ReportRunMissed, SentTo: []string{}, DueAt: &due, StartedAt: time.Now(), FinishedAt: time.Now(),
+				Error: fmt.Sprintf("due %s ago, more than the grace period of %s", late.Truncate(time.Minute), grace)}
+			if err := logReportRun(db, &run); err != nil {
+				log.Printf("Failed to log report schedule %q: %v", s.Name, err)
+			}
+			log.Printf("Missed scheduled report %q, due at %s", s.Name, due.In(cal.location).Format(time.RFC3339))
+			continue
+		}
+		run, err := runReportSchedule(db, mailer, s, ReportTriggerSchedule, &due, cal, csvLocale)
+		if err != nil {
+			log.Printf("Failed to log report schedule %q: %v", s.Name, err)
+		}
+		if run.Status == ReportRunFailed {
+			log.Printf("Scheduled report %q failed: %s", s.Name, run.Error)
+		}
+	}
+}
+
+// validateReportSchedule checks a schedule, rendering its report once so the
+// parameters the report rejects are caught when it is saved rather than when
+// it is due
+func validateReportSchedule(db *sql.DB, s ReportSchedule, cal calendar, csvLocale string) error {
+	var errs ValidationErrors
+	if s.Name == "" {
+		errs.Add("name", "name is required")
+	} else if len([]rune(s.Name)) > maxReportScheduleName {
+		errs.Add("name", "name must be at most 100 characters")
+	}
+	switch s.Format {
+	case ReportFormatCSV, ReportFormatPDF, ReportFormatXLSX:
+	default:
+		errs.Add("format", "format must be one of csv, pdf or xlsx")
+	}
+
+	switch {
+	case s.Cron != "" && s.DayOfMonth != 0:
+		errs.Add("cron", "cron and day_of_month can't both be set")
+	case s.Cron != "":
+		if s.Time != "" {
+			errs.Add("time", "time only applies with day_of_month")
+		} else if c, err := parseCron(s.Cron); err != nil {
+			errs.Add("cron", err.Error())
+		} else if c.Next(cal.now()).IsZero() {
+			errs.Add("cron", "cron expression never matches a date")
+		}
+	case s.DayOfMonth != 0:
+		if s.DayOfMonth < 1 || s.DayOfMonth > 28 {
+			errs.Add("day_of_month", "day_of_month must be between 1 and 28")
+		}
+		if _, err := time.Parse("15:04", s.Time); err != nil {
+			errs.Add("time", "invalid time format, must be HH:MM")
+		}
+	default:
+		errs.Add("cron", "either cron or day_of_month is required")
+	}
+
+	if len(s.Recipients) == 0 {
+		errs.Add("recipients", "at least one recipient is required")
+	}
+	for _, email := range s.Recipients {
+		if !strings.Contains(email, "@") || !strings.Contains(email, ".") || strings.Contains(email, ",") {
+			errs.Add("recipients", "invalid email format")
+			break
+		}
+	}
+
+	report, ok := scheduledReports[s.Report]
+	if !ok {
+		errs.Add("report", "report must be one of income_expense, payments, expenses or aging")
+		return errs.Err()
+	}
+	if report.period {
+		if s.Period != ReportPeriodPreviousMonth && s.Period != ReportPeriodMonthToDate {
+			errs.Add("period", "period must be previous_month or month_to_date")
+		}
+	} else if s.Period != "" {
+		errs.Add("period", "period only applies to reports over dates")
+	}
+	var unknown []string
+	for name := range s.Params {
+		known := false
+		for _, param := range report.params {
+			known = known || name == param
+		}
+		if !known {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		errs.Add("params", "unsupported report parameter: "+strings.Join(unknown, ", "))
+	}
+	if err := errs.Err(); err != nil {
+		return err
+	}
+	if _, _, err := renderScheduledReport(db, s, cal.now(), cal, csvLocale); err != nil {
+		errs.Add("params", err.Error())
+	}
+	return errs.Err()
+}
+
+// decodeReportSchedule reads a report schedule from the request body, fills
+// in its defaults and checks it. It responds itself and returns false when
+// the body is invalid.
+func decodeReportSchedule(db *sql.DB, w http.ResponseWriter, r *http.Request, cal calendar) (ReportSchedule, bool) {
+	var s ReportSchedule
+	if err := decodeRequest(r, &s); err != nil {
+		respondWithError(w, payloadErrorStatus(err), "Invalid request payload: "+err.Error())
+		return s, false
+	}
+	defer r.Body.Close()
+	s.Name = strings.TrimSpace(s.Name)
+	s.Cron = strings.Join(strings.Fields(s.Cron), " ")
+	s.Time = strings.TrimSpace(s.Time)
+	s.Format = strings.ToLower(strings.TrimSpace(s.Format))
+	if s.Format == "" {
+		s.Format = ReportFormatCSV
+	}
+	if s.Period == "" && scheduledReports[s.Report].period {
+		s.Period = ReportPeriodPreviousMonth
+	}
+	if s.DayOfMonth != 0 && s.Time == "" {
+		s.Time = "08:00"
+	}
+	for name, value := range s.Params {
+		if value = strings.TrimSpace(value); value == "" {
+			delete(s.Params, name)
+		} else {
+			s.Params[name] = value
+		}
+	}
+	var recipients []string
+	seen := map[string]bool{}
+	for _, email := range s.Recipients {
+		email = strings.TrimSpace(email)
+		if email != "" && !seen[strings.ToLower(email)] {
+			seen[strings.ToLower(email)] = true
+			recipients = append(recipients, email)
+		}
+	}
+	s.Recipients = recipients
+
+	if err := validateReportSchedule(db, s, cal, optionsOf(r).csvLocale); err != nil {
+		respondWithValidationError(w, err)
+		return s, false
+	}
+	return s, true
+}
+
+// encodeParams writes the parameters of a schedule as a query string
+func (s ReportSchedule) encodeParams() string {
+	values := url.Values{}
+	for name, value := range s.Params {
+		values.Set(name, value)
+	}
+	return values.Encode()
+}
+
+// reportScheduleID reads the id of a report schedule from the path. It
+// responds itself and returns false when it is invalid.
+func reportScheduleID(w http.ResponseWriter, r *http.Request) (int, bool) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid report schedule ID")
+		return 0, false
+	}
+	return id, true
+}
+
+// Get the report schedules, by name, each with its last run
+func getReportSchedules(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		schedules, err := listReportSchedules(db, "")
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		respondWithJSON(w, http.StatusOK, schedules)
+	}
+}
+
+func getReportSchedule(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := reportScheduleID(w, r)
+		if !ok {
+			return
+		}
+		s, err := loadReportSchedule(db, id)
+		if err == sql.ErrNoRows {
+			respondWithError(w, http.StatusNotFound, "Report schedule not found")
+			return
+		}
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		respondWithJSON(w, http.StatusOK, s)
+	}
+}
+
+// Schedule a report to be emailed, under a name no other schedule has
+func createReportSchedule(db *sql.DB, cal calendar) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := requireAdmin(db, w, r); !ok {
+			return
+		}
+		s, ok := decodeReportSchedule(db, w, r, cal)
+		if !ok {
+			return
+		}
+
+		result, err := db.Exec(`
+			INSERT INTO report_schedules(name, report, params, period, format, cron, day_of_month, time_of_day, recipients, paused, next_run_at)
+			VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		`, s.Name, s.Report, s.encodeParams(), s.Period, s.Format, s.Cron, s.DayOfMonth, s.Time, strings.Join(s.Recipients, ","), s.Paused, s.nextRun(cal.now()))
+		if isUniqueViolation(err) {
+			respondWithError(w, http.StatusConflict, "A report schedule with this name already exists")
+			return
+		}
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		id, err := result.LastInsertId()
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		saved, err := loadReportSchedule(db, int(id))
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		respondWithJSON(w, http.StatusCreated, saved)
+	}
+}
+
+// Change a report schedule. Its next run is worked out again from now, so
+// unpausing a schedule doesn't send the runs missed while it was paused.
+func updateReportSchedule(db *sql.DB, cal calendar) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := requireAdmin(db, w, r); !ok {
+			return
+		}
+		id, ok := reportScheduleID(w, r)
+		if !ok {
+			return
+		}
+		s, ok := decodeReportSchedule(db, w, r, cal)
+		if !ok {
+			return
+		}
+
+		result, err := db.Exec(`
+			UPDATE report_schedules SET name = ?, report = ?, params = ?, period = ?, format = ?, cron = ?, day_of_month = ?, time_of_day = ?,
+				recipients = ?, paused = ?, next_run_at = ?, updated_at = CURRENT_TIMESTAMP
+			WHERE id = ?
+		`, s.Name, s.Report, s.encodeParams(), s.Period, s.Format, s.Cron, s.DayOfMonth, s.Time, strings.Join(s.Recipients, ","), s.Paused, s.nextRun(cal.now()), id)
+		if isUniqueViolation(err) {
+			respondWithError(w, http.StatusConflict, "A report schedule with this name already exists")
+			return
+		}
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			respondWithError(w, http.StatusNotFound, "Report schedule not found")
+			return
+		}
+
+		saved, err := loadReportSchedule(db, id)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		respondWithJSON(w, http.StatusOK, saved)
+	}
+}
+
+// Delete a report schedule with the log of its runs
+func deleteReportSchedule(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := requireAdmin(db, w, r); !ok {
+			return
+		}
+		id, ok := reportScheduleID(w, r)
+		if !ok {
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		defer tx.Rollback()
+		result, err := tx.Exec("DELETE FROM report_schedules WHERE id = ?", id)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			respondWithError(w, http.StatusNotFound, "Report schedule not found")
+			return
+		}
+		if _, err := tx.Exec("DELETE FROM report_runs WHERE schedule_id = ?", id); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		respondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
+	}
+}
+
+// Render and email the report of a schedule now, paused or not, without
+// moving its next run. It answers with the run, which is logged like the
+// scheduled ones, whether the report was sent or not.
+func runReportScheduleNow(db *sql.DB, mailer *Mailer, cal calendar) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := requireAdmin(db, w, r); !ok {
+			return
+		}
+		id, ok := reportScheduleID(w, r)
+		if !ok {
+			return
+		}
+		s, err := loadReportSchedule(db, id)
+		if err == sql.ErrNoRows {
+			respondWithError(w, http.StatusNotFound, "Report schedule not found")
+			return
+		}
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if !mailer.Enabled() {
+			respondWithError(w, http.StatusBadRequest, "Email is not configured")
+			return
+		}
+
+		run, err := runReportSchedule(db, mailer, s, ReportTriggerManual, nil, cal, optionsOf(r).csvLocale)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		respondWithJSON(w, http.StatusOK, run)
+	}
+}
+
+// Get the log of report runs, newest first
+func getReportRuns(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := checkQueryParams(r, "schedule_id", "status"); err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		query := "SELECT " + reportRunColumns + " FROM report_runs WHERE 1 = 1"
+		var args []interface{}
+		if value := r.URL.Query().Get("schedule_id"); value != "" {
+			id, err := strconv.Atoi(value)
+			if err != nil {
+				respondWithError(w, http.StatusBadRequest, "Invalid report schedule ID")
+				return
+			}
+			query += " AND schedule_id = ?"
+			args = append(args, id)
+		}
+		if status := r.URL.Query().Get("status"); status != "" {
+			switch status {
+			case ReportRunSuccess, ReportRunFailed, ReportRunMissed:
+			default:
+				respondWithError(w, http.StatusBadRequest, "Invalid status, must be success, failed or missed")
+				return
+			}
+			query += " AND status = ?"
+			args = append(args, status)
+		}
+
+		rows, err := db.Query(query+" ORDER BY id DESC", args...)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		defer rows.Close()
+
+		runs := []ReportRun{}
+		for rows.Next() {
+			run, err := scanReportRun(rows)
+			if err != nil {
+				respondWithError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			runs = append(runs, run)
+		}
+		if err := rows.Err(); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		respondWithJSON(w, http.StatusOK, runs)
+	}
+}
@@ -0,0 +1,106 @@
+package condomngr
+
+import (
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// reportSummary adds up the rows of a CSV report as they are written, so its
+// footer always matches the rows above it
+type reportSummary struct {
+	count   int
+	amount  float64
+	groupBy []string // names of the columns of the subtotals, none without them
+	groups  map[string]*reportGroup
+
+	// The number of columns of the report and the position of its amount,
+	// when the rows and total are to line up with them
+	width, amountColumn int
+}
+
+// reportGroup is the subtotal of the rows sharing the groupBy values
+type reportGroup struct {
+	values []string
+	count  int
+	amount float64
+}
+
+// newReportSummary returns a summary with subtotals by the groupBy columns,
+// or just totals without any
+func newReportSummary(groupBy ...string) *reportSummary {
+	return &reportSummary{groupBy: groupBy, groups: map[string]*reportGroup{}}
+}
+
+// Align lines the row count and total up with the columns of a report with
+// width columns: their labels go in the first column and their values in the
+// amount column, or in the second when the report has none (-1)
+func (s *reportSummary) Align(width, amountColumn int) {
+	s.width, s.amountColumn = width, amountColumn
+}
+
+// line writes a line of the footer with its value
+func (s *reportSummary) line(w io.Writer, locale csvLocale, label, value string) {
+	if s.width == 0 {
+		locale.Row(w, label, value)
+		return
+	}
+	fields := make([]string, s.width)
+	labelAt, valueAt := 0, s.amountColumn
+	if valueAt < 0 {
+		valueAt = min(1, s.width-1)
+	}
+	if valueAt == 0 {
+		labelAt = 1
+	}
+	if labelAt < s.width && labelAt != valueAt {
+		fields[labelAt] = label
+	}
+	fields[valueAt] = value
+	locale.Row(w, fields...)
+}
+
+// Add counts a row; values are its values of the groupBy columns
+func (s *reportSummary) Add(amount float64, values ...string) {
+	s.count++
+	s.amount += amount
+	if len(s.groupBy) == 0 {
+		return
+	}
+	key := strings.Join(values, "\x00")
+	group, ok := s.groups[key]
+	if !ok {
+		group = &reportGroup{values: values}
+		s.groups[key] = group
+	}
+	group.count++
+	group.amount += amount
+}
+
+// Write appends the footer after a blank line: the row count and total
+// amount, then the subtotals if any, ordered by their values. Its labels are
+// in lang, as are the headers of the report.
+func (s *reportSummary) Write(w io.Writer, locale csvLocale, lang string) {
+	rows, total := reportLabel(lang, "rows", "Rows"), reportLabel(lang, "total", "Total")
+	io.WriteString(w, "\n")
+	s.line(w, locale, rows, strconv.Itoa(s.count))
+	s.line(w, locale, total, locale.Amount(s.amount))
+	if len(s.groupBy) == 0 {
+		return
+	}
+
+	groups := make([]*reportGroup, 0, len(s.groups))
+	for _, group := range s.groups {
+		groups = append(groups, group)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		return strings.Join(groups[i].values, "\x00") < strings.Join(groups[j].values, "\x00")
+	})
+
+	io.WriteString(w, "\n")
+	locale.Row(w, append(reportLabels(lang, s.groupBy...), rows, total)...)
+	for _, group := range groups {
+		locale.Row(w, append(append([]string{}, group.values...), strconv.Itoa(group.count), locale.Amount(group.amount))...)
+	}
+}
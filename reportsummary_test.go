@@ -0,0 +1,126 @@
+package condomngr
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// report gets a CSV report
+func (s *testServer) report(path string) string {
+	s.t.Helper()
+	req, err := http.NewRequest("GET", s.URL+path, nil)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	if s.token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	}
+	resp, err := s.Client().Do(req)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		s.t.Fatalf("%s: status %d: %s", path, resp.StatusCode, data)
+	}
+	return string(data)
+}
+
+// reportFooter gets a CSV report and returns the lines of its footer, those
+// after the blank line that ends the rows
+func (s *testServer) reportFooter(path string) []string {
+	s.t.Helper()
+	data := s.report(path)
+	_, footer, ok := strings.Cut(strings.TrimSuffix(data, "\n"), "\n\n")
+	if !ok {
+		s.t.Fatalf("%s: no footer in\n%s", path, data)
+	}
+	return strings.Split(footer, "\n")
+}
+
+func TestReportSummary(t *testing.T) {
+	s := newTestServer(t, Options{})
+	ana := s.createResident("Ana Silva", "1A")
+	rui := s.createResident("Rui Costa", "2B")
+	for _, p := range []struct {
+		residentID int
+		amount     float64
+		date       string
+	}{{ana.ID, 50, "2024-01-15"}, {ana.ID, 25.5, "2024-02-15"}, {rui.ID, 100, "2024-02-20"}} {
+		s.expect(http.StatusCreated, "POST", "/api/v1/payments", map[string]interface{}{
+			"resident_id": p.residentID, "amount": p.amount, "description": "Dues", "payment_date": p.date,
+		}, nil)
+	}
+	for _, e := range []struct {
+		category string
+		amount   float64
+		date     string
+	}{{"Maintenance", 10, "2024-01-10"}, {"Cleaning", 20.25, "2024-02-12"}, {"Cleaning", 5, "2024-03-01"}} {
+		s.expect(http.StatusCreated, "POST", "/api/v1/expenses", map[string]interface{}{
+			"amount": e.amount, "description": "Work", "expense_date": e.date, "category": e.category,
+		}, nil)
+	}
+
+	payments, expenses := "/api/v1/reports/payments/export", "/api/v1/reports/expenses/export"
+	for _, tt := range []struct {
+		path string
+		want []string
+	}{
+		// The totals are of the rows the filters leave
+		{payments, []string{"Rows,3", "Total,175.50"}},
+		{payments + "?resident_id=" + strconv.Itoa(ana.ID), []string{"Rows,2", "Total,75.50"}},
+		{payments + "?start_date=2024-02-01", []string{"Rows,2", "Total,125.50"}},
+		{payments + "?start_date=2024-02-01&end_date=2024-02-15", []string{"Rows,1", "Total,25.50"}},
+		{payments + "?resident_id=" + strconv.Itoa(rui.ID) + "&end_date=2024-01-31", []string{"Rows,0", "Total,0.00"}},
+		{expenses, []string{"Rows,3", "Total,35.25"}},
+		{expenses + "?category=Cleaning", []string{"Rows,2", "Total,25.25"}},
+		{expenses + "?exclude_category=Cleaning", []string{"Rows,1", "Total,10.00"}},
+		{expenses + "?start_date=2024-02-01&end_date=2024-02-29", []string{"Rows,1", "Total,20.25"}},
+		{payments + "?locale=pt-PT", []string{"Rows;3", "Total;175,50"}},
+
+		// Subtotals follow, ordered by their values
+		{payments + "?subtotals=resident", []string{"Rows,3", "Total,175.50", "", "Resident,Unit,Rows,Total", "Ana Silva,1A,2,75.50", "Rui Costa,2B,1,100.00"}},
+		{payments + "?subtotals=resident&start_date=2024-02-01", []string{"Rows,2", "Total,125.50", "", "Resident,Unit,Rows,Total", "Ana Silva,1A,1,25.50", "Rui Costa,2B,1,100.00"}},
+		{expenses + "?subtotals=category", []string{"Rows,3", "Total,35.25", "", "Category,Rows,Total", "Cleaning,2,25.25", "Maintenance,1,10.00"}},
+		{expenses + "?subtotals=category&category=Maintenance", []string{"Rows,1", "Total,10.00", "", "Category,Rows,Total", "Maintenance,1,10.00"}},
+
+		// With picked columns the totals line up with the amount column,
+		// and the subtotals keep their own columns
+		{payments + "?columns=resident,unit,amount", []string{"Rows,,3", "Total,,175.50"}},
+		{payments + "?columns=amount,resident", []string{"3,Rows", "175.50,Total"}},
+		{payments + "?columns=resident,date", []string{"Rows,3", "Total,175.50"}},
+		{payments + "?columns=id,resident,date", []string{"Rows,3,", "Total,175.50,"}},
+		{payments + "?columns=amount", []string{"3", "175.50"}},
+		{payments + "?columns=resident,unit,amount&subtotals=resident", []string{"Rows,,3", "Total,,175.50", "", "Resident,Unit,Rows,Total", "Ana Silva,1A,2,75.50", "Rui Costa,2B,1,100.00"}},
+		{expenses + "?columns=date,category,amount,description&category=Cleaning", []string{"Rows,,2,", "Total,,25.25,"}},
+		{payments + "?columns=resident,amount&locale=pt-PT", []string{"Rows;3", "Total;175,50"}},
+
+		// The labels are in the language of the request, like the headers
+		{payments + "?lang=pt", []string{"Linhas,3", "Total,175.50"}},
+		{payments + "?lang=pt&subtotals=resident", []string{"Linhas,3", "Total,175.50", "", "Residente,Fração,Linhas,Total", "Ana Silva,1A,2,75.50", "Rui Costa,2B,1,100.00"}},
+		{expenses + "?lang=pt&locale=pt-PT&subtotals=category", []string{"Linhas;3", "Total;35,25", "", "Categoria;Linhas;Total", "Cleaning;2;25,25", "Maintenance;1;10,00"}},
+	} {
+		if got := s.reportFooter(tt.path); strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+			t.Errorf("%s: footer\n%s\nwant\n%s", tt.path, strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+		}
+	}
+
+	for _, tt := range []struct {
+		path, want string
+	}{
+		{payments + "?columns=resident,unit,amount,date", "Resident,Unit,Amount,Date"},
+		{payments + "?columns=resident,unit,amount,date&lang=pt", "Residente,Fração,Valor,Data"},
+		{expenses + "?columns=category,tax_amount&lang=pt", "Categoria,Valor do IVA"},
+	} {
+		if got, _, _ := strings.Cut(s.report(tt.path), "\n"); got != tt.want {
+			t.Errorf("%s: header %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,405 @@
+package condomngr
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// ReserveRule is the percentage of collected payments set aside for the
+// reserve fund from a date on, until a later rule replaces it
+type ReserveRule struct {
+	ID            int       `json:"id"`
+	Percent       float64   `json:"percent"`
+	EffectiveFrom string    `json:"effective_from"` // YYYY-MM-DD
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// Validation function for ReserveRule data
+func validateReserveRule(rule ReserveRule) error {
+	var errs ValidationErrors
+	if rule.Percent < 0 || rule.Percent > 100 {
+		errs.Add("percent", "percent must be between 0 and 100")
+	}
+	if _, err := time.Parse("2006-01-02", rule.EffectiveFrom); err != nil {
+		errs.Add("effective_from", "invalid date format, must be YYYY-MM-DD")
+	}
+	return errs.Err()
+}
+
+func loadReserveRules(q querier) ([]ReserveRule, error) {
+	rows, err := q.Query("SELECT id, percent, effective_from, created_at FROM reserve_rules ORDER BY effective_from")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	rules := []ReserveRule{}
+	for rows.Next() {
+		var rule ReserveRule
+		if err := rows.Scan(&rule.ID, &rule.Percent, &rule.EffectiveFrom, &rule.CreatedAt); err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, rows.Err()
+}
+
+// reserveShare returns the percentage in force on date (YYYY-MM-DD) under
+// rules, sorted by effective date, and the part of amount it sets aside
+func reserveShare(rules []ReserveRule, date string, amount float64) (percent, reserve float64) {
+	for _, rule := range rules {
+		if rule.EffectiveFrom > date {
+			break
+		}
+		percent = rule.Percent
+	}
+	return percent, roundCents(amount * percent / 100)
+}
+
+// tagReserve records the reserve part of every payment that doesn't have one
+// yet, or whose amount or date changed since, at the rule in force on the
+// payment date. Earlier payments keep the rule they were recorded under until
+// they are recalculated.
+func tagReserve(q querier) error {
+	rows, err := q.Query(`
+		SELECT p.id, p.amount, substr(p.payment_date, 1, 10) FROM payments p
+		LEFT JOIN reserve_contributions c ON c.payment_id = p.id
+		WHERE c.payment_id IS NULL OR c.payment_amount != p.amount OR c.payment_date != substr(p.payment_date, 1, 10)
+	`)
+	if err != nil {
+		return err
+	}
+	var payments []Payment
+	for rows.Next() {
+		var p Payment
+		if err := rows.Scan(&p.ID, &p.Amount, &p.PaymentDate); err != nil {
+			rows.Close()
+			return err
+		}
+		payments = append(payments, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(payments) == 0 {
+		return nil
+	}
+
+	rules, err := loadReserveRules(q)
+	if err != nil {
+		return err
+	}
+	for _, p := range payments {
+		if err := saveReserveShare(q, p, rules); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func saveReserveShare(q querier, p Payment, rules []ReserveRule) error {
+	percent, reserve := reserveShare(rules, p.PaymentDate, p.Amount)
+	_, err := q.Exec(`
+		INSERT OR REPLACE INTO reserve_contributions(payment_id, payment_amount, payment_date, percent, amount)
+		VALUES(?, ?, ?, ?, ?)
+	`, p.ID, p.Amount, p.PaymentDate, percent, reserve)
+	return err
+}
+
+// ReserveChange is a payment whose reserve part a recalculation changes
+type ReserveChange struct {
+	PaymentID     int     `json:"payment_id"`
+	PaymentDate   string  `json:"payment_date"`
+	Amount        float64 `json:"amount"`
+	PercentBefore float64 `json:"percent_before"`
+	ReserveBefore float64 `json:"reserve_before"`
+	PercentAfter  float64 `json:"percent_after"`
+	ReserveAfter  float64 `json:"reserve_after"`
+}
+
+// ReserveRecalculation reports a recalculation of the reserve parts of the
+// payments in a period. With dry_run nothing was changed.
+type ReserveRecalculation struct {
+	StartDate     string          `json:"start_date"`
+	EndDate       string          `json:"end_date"`
+	DryRun        bool            `json:"dry_run"`
+	Payments      int             `json:"payments"`
+	ReserveBefore float64         `json:"reserve_before"`
+	ReserveAfter  float64         `json:"reserve_after"`
+	Changes       []ReserveChange `json:"changes"`
+}
+
+// FundsMonth is what was collected in a month and how it splits between the
+// reserve and operating funds. UnclearedCheques are the cheques of the month
+// not cleared yet, part of collected only with -count-uncleared-cheques.
+type FundsMonth struct {
+	Month            string  `json:"month"`
+	Collected        float64 `json:"collected"`
+	Reserve          float64 `json:"reserve"`
+	Operating        float64 `json:"operating"`
+	UnclearedCheques float64 `json:"uncleared_cheques"`
+}
+
+// FundsReport splits the payments of a period between the reserve and
+// operating funds. Collected always equals reserve plus operating, and adds up
+// to the payments of the period. ReserveBalance is everything set aside up to
+// the end date.
+type FundsReport struct {
+	StartDate        string       `json:"start_date"`
+	EndDate          string       `json:"end_date"`
+	Months           []FundsMonth `json:"months"`
+	Collected        float64      `json:"collected"`
+	Reserve          float64      `json:"reserve"`
+	Operating        float64      `json:"operating"`
+	ReserveBalance   float64      `json:"reserve_balance"`
+	UnclearedCheques float64      `json:"uncleared_cheques"`
+}
+
+// periodParams reads a required start_date and end_date
+func periodParams(r *http.Request) (start, end string, err error) {
+	var errs ValidationErrors
+	start, end = r.URL.Query().Get("start_date"), r.URL.Query().Get("end_date")
+	if _, err := time.Parse("2006-01-02", start); err != nil {
+		errs.Add("start_date", "start_date is required as YYYY-MM-DD")
+	}
+	if _, err := time.Parse("2006-01-02", end); err != nil {
+		errs.Add("end_date", "end_date is required as YYYY-MM-DD")
+	}
+	if err := errs.Err(); err != nil {
+		return "", "", err
+	}
+	if end < start {
+		errs.Add("end_date", "end_date must not be before start_date")
+	}
+	return start, end, errs.Err()
+}
+
+// Handlers for reserve fund endpoints
+func getReserveRules(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rules, err := loadReserveRules(db)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		respondWithJSON(w, http.StatusOK, rules)
+	}
+}
+
+// Add a reserve rule. It applies to payments recorded from now on; use a
+// recalculation to apply it to earlier payments.
+func createReserveRule(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var rule ReserveRule
+		if err := decodeRequest(r, &rule); err != nil {
+			respondWithError(w, payloadErrorStatus(err), "Invalid request payload: "+err.Error())
+			return
+		}
+		defer r.Body.Close()
+
+		if err := validateReserveRule(rule); err != nil {
+			respondWithValidationError(w, err)
+			return
+		}
+
+		result, err := db.Exec("INSERT INTO reserve_rules(percent, effective_from) VALUES(?, ?)", rule.Percent, rule.EffectiveFrom)
+		if isUniqueViolation(err) {
+			respondWithError(w, http.StatusConflict, "A reserve rule already starts on this date")
+			return
+		}
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		id, err := result.LastInsertId()
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		rule.ID = int(id)
+		respondWithJSON(w, http.StatusCreated, rule)
+	}
+}
+
+func deleteReserveRule(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id, err := strconv.Atoi(vars["id"])
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid reserve rule ID")
+			return
+		}
+
+		result, err := db.Exec("DELETE FROM reserve_rules WHERE id = ?", id)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			respondWithError(w, http.StatusNotFound, "Reserve rule not found")
+			return
+		}
+
+		respondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
+	}
+}
+
+// Apply the current reserve rules to the payments of a period. It is a dry
+// run unless dry_run=false.
+func recalculateReserve(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := checkQueryParams(r, "start_date", "end_date", "dry_run"); err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		start, end, err := periodParams(r)
+		if err != nil {
+			respondWithValidationError(w, err)
+			return
+		}
+		dryRun := true
+		if value := r.URL.Query().Get("dry_run"); value != "" {
+			if dryRun, err = strconv.ParseBool(value); err != nil {
+				respondWithError(w, http.StatusBadRequest, "Invalid dry_run, must be true or false")
+				return
+			}
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		defer tx.Rollback()
+
+		if err := tagReserve(tx); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		rules, err := loadReserveRules(tx)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		rows, err := tx.Query(`
+			SELECT c.payment_id, c.payment_date, c.payment_amount, c.percent, c.amount
+			FROM reserve_contributions c
+			JOIN payments p ON p.id = c.payment_id
+			WHERE c.payment_date BETWEEN ? AND ?
+			ORDER BY c.payment_date, c.payment_id
+		`, start, end)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		result := ReserveRecalculation{StartDate: start, EndDate: end, DryRun: dryRun, Changes: []ReserveChange{}}
+		for rows.Next() {
+			var c ReserveChange
+			if err := rows.Scan(&c.PaymentID, &c.PaymentDate, &c.Amount, &c.PercentBefore, &c.ReserveBefore); err != nil {
+				rows.Close()
+				respondWithError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			c.PercentAfter, c.ReserveAfter = reserveShare(rules, c.PaymentDate, c.Amount)
+			result.Payments++
+			result.ReserveBefore = roundCents(result.ReserveBefore + c.ReserveBefore)
+			result.ReserveAfter = roundCents(result.ReserveAfter + c.ReserveAfter)
+			if c.PercentAfter != c.PercentBefore || c.ReserveAfter != c.ReserveBefore {
+				result.Changes = append(result.Changes, c)
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		if !dryRun {
+			for _, c := range result.Changes {
+				p := Payment{ID: c.PaymentID, Amount: c.Amount, PaymentDate: c.PaymentDate}
+				if err := saveReserveShare(tx, p, rules); err != nil {
+					respondWithError(w, http.StatusInternalServerError, err.Error())
+					return
+				}
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		respondWithJSON(w, http.StatusOK, result)
+	}
+}
+
+// Get how the payments of a period split between the reserve and operating
+// funds, month by month
+func getFundsReport(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := checkQueryParams(r, "start_date", "end_date"); err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		start, end, err := periodParams(r)
+		if err != nil {
+			respondWithValidationError(w, err)
+			return
+		}
+
+		rows, err := db.Query(`
+			SELECT substr(p.payment_date, 1, 7) AS month,
+				COALESCE(SUM(CASE WHEN p.status = ?1 THEN p.amount END), 0),
+				COALESCE(SUM(CASE WHEN p.status = ?1 THEN c.amount END), 0),
+				COALESCE(SUM(CASE WHEN p.cheque_status = ?2 THEN p.amount END), 0)
+			FROM payments p
+			LEFT JOIN reserve_contributions c ON c.payment_id = p.id
+			WHERE (p.status = ?1 OR p.cheque_status = ?2) AND substr(p.payment_date, 1, 10) BETWEEN ?3 AND ?4
+			GROUP BY month ORDER BY month
+		`, PaymentStatusConfirmed, ChequePending, start, end)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		defer rows.Close()
+
+		report := FundsReport{StartDate: start, EndDate: end, Months: []FundsMonth{}}
+		for rows.Next() {
+			var m FundsMonth
+			if err := rows.Scan(&m.Month, &m.Collected, &m.Reserve, &m.UnclearedCheques); err != nil {
+				respondWithError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			m.Collected, m.Reserve, m.UnclearedCheques = roundCents(m.Collected), roundCents(m.Reserve), roundCents(m.UnclearedCheques)
+			m.Operating = roundCents(m.Collected - m.Reserve)
+			report.Months = append(report.Months, m)
+			report.Collected = roundCents(report.Collected + m.Collected)
+			report.Reserve = roundCents(report.Reserve + m.Reserve)
+			report.UnclearedCheques = roundCents(report.UnclearedCheques + m.UnclearedCheques)
+		}
+		if err := rows.Err(); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		report.Operating = roundCents(report.Collected - report.Reserve)
+
+		err = db.QueryRow(`
+			SELECT COALESCE(SUM(c.amount), 0) FROM reserve_contributions c
+			JOIN payments p ON p.id = c.payment_id
+			WHERE p.status = ? AND substr(p.payment_date, 1, 10) <= ?
+		`, PaymentStatusConfirmed, end).Scan(&report.ReserveBalance)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		report.ReserveBalance = roundCents(report.ReserveBalance)
+
+		respondWithJSON(w, http.StatusOK, report)
+	}
+}
@@ -0,0 +1,105 @@
+package condomngr
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestReserveShare(t *testing.T) {
+	rules := []ReserveRule{{Percent: 10, EffectiveFrom: "2024-01-01"}, {Percent: 12.5, EffectiveFrom: "2024-07-01"}}
+	for _, tt := range []struct {
+		date           string
+		amount         float64
+		percent, share float64
+	}{
+		{"2023-12-31", 100, 0, 0},
+		{"2024-01-01", 100, 10, 10},
+		{"2024-06-30", 100, 10, 10},
+		{"2024-07-01", 100, 12.5, 12.5},
+		{"2025-01-01", 100, 12.5, 12.5},
+		{"2024-02-29", 33.33, 10, 3.33},
+		{"2024-02-29", 0.04, 10, 0},
+		{"2024-02-29", 0.06, 10, 0.01},
+		{"2024-07-01", 10.01, 12.5, 1.25},
+		{"2024-07-01", -40, 12.5, -5},
+	} {
+		percent, share := reserveShare(rules, tt.date, tt.amount)
+		if percent != tt.percent || share != tt.share {
+			t.Errorf("%v on %s: %v%%, %v, want %v%%, %v", tt.amount, tt.date, percent, share, tt.percent, tt.share)
+		}
+	}
+	if percent, share := reserveShare(nil, "2024-01-01", 100); percent != 0 || share != 0 {
+		t.Errorf("without rules: %v%%, %v", percent, share)
+	}
+}
+
+// TestFundsReportReconciles checks the reserve and operating funds add up to
+// the payments to the cent, month by month, before and after the rules are
+// recalculated
+func TestFundsReportReconciles(t *testing.T) {
+	s := newTestServer(t, Options{})
+	resident := s.createResident("Ana Silva", "1A")
+	s.expect(http.StatusCreated, "POST", "/api/v1/reserve/rules", map[string]interface{}{"percent": 10, "effective_from": "2024-01-01"}, nil)
+	for _, p := range []struct {
+		amount float64
+		date   string
+	}{{33.33, "2024-01-31"}, {33.33, "2024-02-01"}, {33.34, "2024-02-29"}, {0.07, "2024-03-01"}} {
+		s.expect(http.StatusCreated, "POST", "/api/v1/payments", map[string]interface{}{
+			"resident_id": resident.ID, "amount": p.amount, "description": "Dues", "payment_date": p.date,
+		}, nil)
+	}
+
+	funds := func(start, end string) FundsReport {
+		t.Helper()
+		var report FundsReport
+		s.expect(http.StatusOK, "GET", "/api/v1/reports/funds?refresh=true&start_date="+start+"&end_date="+end, nil, &report)
+		var collected, reserve, operating float64
+		for _, m := range report.Months {
+			if roundCents(m.Reserve+m.Operating) != m.Collected {
+				t.Errorf("%s: reserve %v + operating %v != collected %v", m.Month, m.Reserve, m.Operating, m.Collected)
+			}
+			collected, reserve, operating = roundCents(collected+m.Collected), roundCents(reserve+m.Reserve), roundCents(operating+m.Operating)
+		}
+		if collected != report.Collected || reserve != report.Reserve || operating != report.Operating {
+			t.Errorf("%s to %s: months add up to %v, %v, %v, report %+v", start, end, collected, reserve, operating, report)
+		}
+		return report
+	}
+	for _, tt := range []struct {
+		start, end                               string
+		months                                   int
+		collected, reserve, operating, reserveTo float64
+	}{
+		{"2024-01-01", "2024-12-31", 3, 100.07, 10, 90.07, 10},
+		{"2024-02-01", "2024-02-29", 1, 66.67, 6.66, 60.01, 9.99},
+		{"2024-01-31", "2024-02-01", 2, 66.66, 6.66, 60, 6.66},
+		{"2024-03-01", "2024-03-01", 1, 0.07, 0.01, 0.06, 10},
+		{"2023-01-01", "2023-12-31", 0, 0, 0, 0, 0},
+	} {
+		report := funds(tt.start, tt.end)
+		if len(report.Months) != tt.months || report.Collected != tt.collected || report.Reserve != tt.reserve || report.Operating != tt.operating || report.ReserveBalance != tt.reserveTo {
+			t.Errorf("%s to %s: %+v", tt.start, tt.end, report)
+		}
+	}
+
+	// A higher rule from February is applied to February's payments by a
+	// recalculation, only once it isn't a dry run
+	s.expect(http.StatusCreated, "POST", "/api/v1/reserve/rules", map[string]interface{}{"percent": 20, "effective_from": "2024-02-01"}, nil)
+	for _, dryRun := range []string{"true", "false"} {
+		var result ReserveRecalculation
+		s.expect(http.StatusOK, "POST", "/api/v1/reserve/recalculate?start_date=2024-02-01&end_date=2024-02-29&dry_run="+dryRun, nil, &result)
+		if result.Payments != 2 || len(result.Changes) != 2 || result.ReserveBefore != 6.66 || result.ReserveAfter != 13.34 {
+			t.Errorf("dry run %s: %+v", dryRun, result)
+		}
+		want := 6.66
+		if dryRun == "false" {
+			want = 13.34
+		}
+		if report := funds("2024-02-01", "2024-02-29"); report.Reserve != want || report.Collected != 66.67 {
+			t.Errorf("after a recalculation with dry run %s: %+v", dryRun, report)
+		}
+	}
+	if report := funds("2024-01-01", "2024-12-31"); report.Reserve != 16.68 || report.Operating != 83.39 {
+		t.Errorf("after the recalculation: %+v", report)
+	}
+}
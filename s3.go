@@ -0,0 +1,356 @@
+package condomngr
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// emptySHA256 is the SHA-256 of an empty request body
+const emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// S3Config is where backups are copied off-site: a bucket of any
+// S3-compatible storage (AWS, MinIO, Backblaze B2, ...)
+type S3Config struct {
+	Endpoint  string // e.g. https://s3.eu-west-1.amazonaws.com; AWS in Region if empty
+	Region    string
+	Bucket    string
+	Prefix    string // keys of the backups start with it
+	AccessKey string
+	SecretKey string
+}
+
+// s3Flags adds the flags of the S3 backup target to flags. The config is
+// filled in when they are parsed.
+func s3Flags(flags *flag.FlagSet) *S3Config {
+	var c S3Config
+	flags.StringVar(&c.Endpoint, "backup-s3-endpoint", os.Getenv("CONDO_BACKUP_S3_ENDPOINT"), "URL of the S3-compatible storage backups are uploaded to (or CONDO_BACKUP_S3_ENDPOINT; AWS if empty)")
+	flags.StringVar(&c.Region, "backup-s3-region", envOr("CONDO_BACKUP_S3_REGION", "us-east-1"), "Region of the backup bucket (or CONDO_BACKUP_S3_REGION)")
+	flags.StringVar(&c.Bucket, "backup-s3-bucket", os.Getenv("CONDO_BACKUP_S3_BUCKET"), "Bucket backups are uploaded to (or CONDO_BACKUP_S3_BUCKET; empty keeps them local only)")
+	flags.StringVar(&c.Prefix, "backup-s3-prefix", os.Getenv("CONDO_BACKUP_S3_PREFIX"), "Prefix of the keys of uploaded backups, e.g. condomngr/ (or CONDO_BACKUP_S3_PREFIX)")
+	flags.StringVar(&c.AccessKey, "backup-s3-access-key", os.Getenv("CONDO_BACKUP_S3_ACCESS_KEY"), "Access key of the backup bucket (or CONDO_BACKUP_S3_ACCESS_KEY)")
+	flags.StringVar(&c.SecretKey, "backup-s3-secret-key", os.Getenv("CONDO_BACKUP_S3_SECRET_KEY"), "Secret key of the backup bucket (or CONDO_BACKUP_S3_SECRET_KEY)")
+	return &c
+}
+
+// envOr returns the environment variable key, or fallback if it is empty
+func envOr(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// S3Target stores backups in a bucket, with requests signed with AWS
+// Signature Version 4. It addresses the bucket in the path, which every
+// S3-compatible service supports.
+type S3Target struct {
+	endpoint  *url.URL
+	region    string
+	bucket    string
+	prefix    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+}
+
+// NewS3Target creates the target of c. It returns nil without a bucket.
+func NewS3Target(c S3Config) (*S3Target, error) {
+	if c.Bucket == "" {
+		return nil, nil
+	}
+	if c.AccessKey == "" || c.SecretKey == "" {
+		return nil, fmt.Errorf("the access key and secret key of bucket %s are required", c.Bucket)
+	}
+	if c.Region == "" {
+		c.Region = "us-east-1"
+	}
+	if c.Endpoint == "" {
+		c.Endpoint = "https://s3." + c.Region + ".amazonaws.com"
+	}
+	endpoint, err := url.Parse(c.Endpoint)
+	if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid S3 endpoint %q", c.Endpoint)
+	}
+	return &S3Target{
+		endpoint:  endpoint,
+		region:    c.Region,
+		bucket:    c.Bucket,
+		prefix:    c.Prefix,
+		accessKey: c.AccessKey,
+		secretKey: c.SecretKey,
+		client:    &http.Client{Timeout: 10 * time.Minute},
+	}, nil
+}
+
+// Under returns the target of the keys under sub, within the prefix of t. It
+// returns nil for a nil t.
+func (t *S3Target) Under(sub string) *S3Target {
+	if t == nil {
+		return nil
+	}
+	under := *t
+	under.prefix += sub
+	return &under
+}
+
+// Key is the key a backup file is uploaded under
+func (t *S3Target) Key(filename string) string {
+	return t.prefix + filename
+}
+
+// URL is the s3:// URL of key, as restore -from takes it
+func (t *S3Target) URL(key string) string {
+	return "s3://" + t.bucket + "/" + key
+}
+
+// parseS3URL splits an s3://bucket/key URL
+func parseS3URL(s string) (bucket, key string, err error) {
+	rest, ok := strings.CutPrefix(s, "s3://")
+	bucket, key, _ = strings.Cut(rest, "/")
+	if !ok || bucket == "" || key == "" {
+		return "", "", fmt.Errorf("invalid S3 URL %q, must be s3://bucket/key", s)
+	}
+	return bucket, key, nil
+}
+
+// Put uploads file under key. Its SHA-256 signs the request, so the storage
+// rejects a body that arrives corrupted, and is kept in the object's metadata
+// for Verify and restores.
+func (t *S3Target) Put(key, file, sum string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	header := http.Header{}
+	header.Set("Content-Type", "application/vnd.sqlite3")
+	header.Set("X-Amz-Meta-Sha256", sum)
+	resp, err := t.do(http.MethodPut, key, nil, header, f, info.Size(), sum)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Verify checks that the object under key has the size and SHA-256 of the
+// uploaded file
+func (t *S3Target) Verify(key, sum string, size int64) error {
+	resp, err := t.do(http.MethodHead, key, nil, nil, nil, 0, emptySHA256)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.ContentLength != size {
+		return fmt.Errorf("uploaded %s has %d bytes instead of %d", key, resp.ContentLength, size)
+	}
+	if got := resp.Header.Get("X-Amz-Meta-Sha256"); got != sum {
+		return fmt.Errorf("uploaded %s has SHA-256 %q instead of %s", key, got, sum)
+	}
+	return nil
+}
+
+// Get writes the object under key to w and returns the SHA-256 it was
+// uploaded with, empty if it has none
+func (t *S3Target) Get(key string, w io.Writer) (string, error) {
+	resp, err := t.do(http.MethodGet, key, nil, nil, nil, 0, emptySHA256)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		return "", err
+	}
+	return resp.Header.Get("X-Amz-Meta-Sha256"), nil
+}
+
+// Delete removes the object under key
+func (t *S3Target) Delete(key string) error {
+	resp, err := t.do(http.MethodDelete, key, nil, nil, nil, 0, emptySHA256)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// List returns the keys of the objects under the prefix, in order
+func (t *S3Target) List() ([]string, error) {
+	var keys []string
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {t.prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		resp, err := t.do(http.MethodGet, "", query, nil, nil, 0, emptySHA256)
+		if err != nil {
+			return nil, err
+		}
+		var result struct {
+			Contents []struct {
+				Key string
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("invalid S3 listing: %v", err)
+		}
+		for _, object := range result.Contents {
+			keys = append(keys, object.Key)
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// do sends a signed request for key, or for the bucket if key is empty. It
+// fails on error responses, whose body it closes.
+func (t *S3Target) do(method, key string, query url.Values, header http.Header, body io.Reader, size int64, payloadSHA256 string) (*http.Response, error) {
+	u := *t.endpoint
+	u.Path = path.Join("/", t.endpoint.Path, t.bucket)
+	if key != "" {
+		u.Path += "/" + key
+	}
+	u.RawPath = s3Escape(u.Path, false)
+	u.RawQuery = s3Query(query)
+
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = size
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	t.sign(req, payloadSHA256, time.Now().UTC())
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		return nil, s3Error(method, key, resp)
+	}
+	return resp, nil
+}
+
+// s3Error turns an S3 error response into a readable error
+func s3Error(method, key string, resp *http.Response) error {
+	var apiErr struct {
+		Code    string
+		Message string
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&apiErr); err != nil || apiErr.Code == "" {
+		return fmt.Errorf("S3 %s %s: status %d", method, key, resp.StatusCode)
+	}
+	return fmt.Errorf("S3 %s %s: %s (%s)", method, key, apiErr.Message, apiErr.Code)
+}
+
+// sign adds the Signature Version 4 authorization of req at now, signing the
+// host and every header already set
+func (t *S3Target) sign(req *http.Request, payloadSHA256 string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadSHA256)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadSHA256,
+	}, "\n")
+	scope := now.Format("20060102") + "/" + t.region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := []byte("AWS4" + t.secretKey)
+	for _, part := range []string{now.Format("20060102"), t.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		t.accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Escape percent-encodes s the way Signature Version 4 expects: everything
+// but unreserved characters, and slashes too if escapeSlash is set
+func s3Escape(s string, escapeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && !escapeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// s3Query is the canonical query string of query: sorted and escaped with
+// s3Escape
+func s3Query(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var params []string
+	for _, key := range keys {
+		for _, value := range query[key] {
+			params = append(params, s3Escape(key, true)+"="+s3Escape(value, true))
+		}
+	}
+	return strings.Join(params, "&")
+}
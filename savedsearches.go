@@ -0,0 +1,449 @@
+package condomngr
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// maxSavedSearchName is the longest name of a saved search, in characters
+const maxSavedSearchName = 100
+
+// savedSearchEntity is what a saved search can search: the search endpoint
+// it runs, the query parameters that endpoint takes, and a check of their
+// values
+type savedSearchEntity struct {
+	params []string
+	search func(db *sql.DB) http.HandlerFunc
+	check  func(r *http.Request) error
+}
+
+// savedSearchEntities are the searches that can be saved, by entity
+var savedSearchEntities = map[string]savedSearchEntity{
+	"residents": {
+		params: []string{"q", "match", "fuzzy"},
+		search: searchResidents,
+		check: func(r *http.Request) error {
+			if r.URL.Query().Get("q") == "" {
+				return errors.New("q is required to search residents")
+			}
+			if value := r.URL.Query().Get("fuzzy"); value != "" {
+				fuzzy, err := strconv.ParseBool(value)
+				if err != nil {
+					return errors.New("Invalid fuzzy, must be true or false")
+				}
+				if fuzzy && r.URL.Query().Get("match") != "" {
+					return errors.New("match can't be combined with fuzzy")
+				}
+			}
+			_, err := searchPattern(r)
+			return err
+		},
+	},
+	"payments": {
+		params: []string{"q", "match", "resident_id", "start_date", "end_date"},
+		search: searchPayments,
+		check: func(r *http.Request) error {
+			if value := r.URL.Query().Get("resident_id"); value != "" {
+				if _, err := strconv.Atoi(value); err != nil {
+					return errors.New("resident_id must be a number")
+				}
+			}
+			_, _, err := paymentSearchWhere(r)
+			return err
+		},
+	},
+	"expenses": {
+		params: []string{"q", "match", "category", "exclude_category", "start_date", "end_date"},
+		search: searchExpenses,
+		check: func(r *http.Request) error {
+			_, _, err := expenseSearchWhere(r)
+			return err
+		},
+	},
+}
+
+// SavedSearch is a search a user runs often, kept under a name with its query
+// parameters. Dangling lists the parameters naming residents or categories
+// that no longer exist; the search still runs, and finds nothing by them.
+type SavedSearch struct {
+	ID        int               `json:"id"`
+	Name      string            `json:"name"`
+	Entity    string            `json:"entity"` // residents, payments or expenses
+	Params    map[string]string `json:"params"`
+	Dangling  []DanglingFilter  `json:"dangling,omitempty"`
+	CreatedAt time.Time         `json:"created_at"`
+	UpdatedAt time.Time         `json:"updated_at"`
+}
+
+// DanglingFilter is a saved search parameter naming something that is gone
+type DanglingFilter struct {
+	Param  string `json:"param"`
+	Value  string `json:"value"`
+	Reason string `json:"reason"`
+}
+
+// values returns the parameters of the search as a query string would have
+// them
+func (s SavedSearch) values() url.Values {
+	values := url.Values{}
+	for name, value := range s.Params {
+		values.Set(name, value)
+	}
+	return values
+}
+
+const savedSearchColumns = "id, name, entity, params, created_at, updated_at"
+
+func scanSavedSearch(row interface{ Scan(...interface{}) error }) (SavedSearch, error) {
+	var s SavedSearch
+	var params string
+	if err := row.Scan(&s.ID, &s.Name, &s.Entity, &params, &s.CreatedAt, &s.UpdatedAt); err != nil {
+		return s, err
+	}
+	values, err := url.ParseQuery(params)
+	if err != nil {
+		return s, err
+	}
+	s.Params = map[string]string{}
+	for name := range values {
+		s.Params[name] = values.Get(name)
+	}
+	return s, nil
+}
+
+func validateSavedSearch(s SavedSearch) error {
+	var errs ValidationErrors
+	if s.Name == "" {
+		errs.Add("name", "name is required")
+	} else if len([]rune(s.Name)) > maxSavedSearchName {
+		errs.Add("name", "name must be at most 100 characters")
+	}
+	entity, ok := savedSearchEntities[s.Entity]
+	if !ok {
+		errs.Add("entity", "entity must be one of residents, payments or expenses")
+		return errs.Err()
+	}
+
+	var unknown []string
+	for name := range s.Params {
+		known := false
+		for _, param := range entity.params {
+			known = known || name == param
+		}
+		if !known {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		errs.Add("params", "unsupported search parameter: "+strings.Join(unknown, ", "))
+		return errs.Err()
+	}
+	for _, name := range []string{"start_date", "end_date"} {
+		if value := s.Params[name]; value != "" {
+			if _, err := time.Parse("2006-01-02", value); err != nil {
+				errs.Add(name, "invalid date format, must be YYYY-MM-DD")
+			}
+		}
+	}
+	if err := entity.check(&http.Request{URL: &url.URL{RawQuery: s.values().Encode()}}); err != nil {
+		errs.Add("params", err.Error())
+	}
+	return errs.Err()
+}
+
+// danglingFilters finds the parameters of a saved search naming a resident
+// or an expense category that no longer exists
+func danglingFilters(q querier, s SavedSearch) ([]DanglingFilter, error) {
+	var dangling []DanglingFilter
+	if value := s.Params["resident_id"]; value != "" {
+		var exists bool
+		if err := q.QueryRow("SELECT EXISTS(SELECT 1 FROM residents WHERE id = ?)", value).Scan(&exists); err != nil {
+			return nil, err
+		}
+		if !exists {
+			dangling = append(dangling, DanglingFilter{Param: "resident_id", Value: value, Reason: "no resident with id " + value})
+		}
+	}
+	for _, name := range []string{"category", "exclude_category"} {
+		for _, category := range strings.Split(s.Params[name], ",") {
+			if category = strings.TrimSpace(category); category == "" {
+				continue
+			}
+			var exists bool
+			if err := q.QueryRow("SELECT EXISTS(SELECT 1 FROM expenses WHERE category = ?)", category).Scan(&exists); err != nil {
+				return nil, err
+			}
+			if !exists {
+				dangling = append(dangling, DanglingFilter{Param: name, Value: category, Reason: fmt.Sprintf("no expense has category %q", category)})
+			}
+		}
+	}
+	return dangling, nil
+}
+
+// loadSavedSearch returns a saved search of userID, with its dangling
+// filters. It returns sql.ErrNoRows when the user has no such search.
+func loadSavedSearch(db *sql.DB, userID, id int) (SavedSearch, error) {
+	s, err := scanSavedSearch(db.QueryRow("SELECT "+savedSearchColumns+" FROM saved_searches WHERE id = ? AND user_id = ?", id, userID))
+	if err != nil {
+		return s, err
+	}
+	s.Dangling, err = danglingFilters(db, s)
+	return s, err
+}
+
+// savedSearchFromRequest reads the id of a saved search of the signed-in
+// user from the path. It responds itself and returns false when the id is
+// invalid or nobody is signed in.
+func savedSearchFromRequest(db *sql.DB, w http.ResponseWriter, r *http.Request) (Session, int, bool) {
+	session, ok := requireSession(db, w, r)
+	if !ok {
+		return session, 0, false
+	}
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid saved search ID")
+		return session, 0, false
+	}
+	return session, id, true
+}
+
+// decodeSavedSearch reads a saved search from the request body and checks
+// it. It responds itself and returns false when the body is invalid.
+func decodeSavedSearch(w http.ResponseWriter, r *http.Request) (SavedSearch, bool) {
+	var s SavedSearch
+	if err := decodeRequest(r, &s); err != nil {
+		respondWithError(w, payloadErrorStatus(err), "Invalid request payload: "+err.Error())
+		return s, false
+	}
+	defer r.Body.Close()
+	s.Name = strings.TrimSpace(s.Name)
+	for name, value := range s.Params {
+		if value = strings.TrimSpace(value); value == "" {
+			delete(s.Params, name)
+		} else {
+			s.Params[name] = value
+		}
+	}
+	if err := validateSavedSearch(s); err != nil {
+		respondWithValidationError(w, err)
+		return s, false
+	}
+	return s, true
+}
+
+// Get the saved searches of the signed-in user, by name
+func getSavedSearches(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session, ok := requireSession(db, w, r)
+		if !ok {
+			return
+		}
+		if err := checkQueryParams(r, "entity"); err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		query := "SELECT " + savedSearchColumns + " FROM saved_searches WHERE user_id = ?"
+		args := []interface{}{session.User.ID}
+		if entity := r.URL.Query().Get("entity"); entity != "" {
+			if _, ok := savedSearchEntities[entity]; !ok {
+				respondWithError(w, http.StatusBadRequest, "Invalid entity, must be residents, payments or expenses")
+				return
+			}
+			query += " AND entity = ?"
+			args = append(args, entity)
+		}
+
+		rows, err := db.Query(query+" ORDER BY name", args...)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		searches := []SavedSearch{}
+		for rows.Next() {
+			s, err := scanSavedSearch(rows)
+			if err != nil {
+				rows.Close()
+				respondWithError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			searches = append(searches, s)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		for i := range searches {
+			if searches[i].Dangling, err = danglingFilters(db, searches[i]); err != nil {
+				respondWithError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+		}
+
+		respondWithJSON(w, http.StatusOK, searches)
+	}
+}
+
+func getSavedSearch(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session, id, ok := savedSearchFromRequest(db, w, r)
+		if !ok {
+			return
+		}
+		s, err := loadSavedSearch(db, session.User.ID, id)
+		if err == sql.ErrNoRows {
+			respondWithError(w, http.StatusNotFound, "Saved search not found")
+			return
+		}
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		respondWithJSON(w, http.StatusOK, s)
+	}
+}
+
+// Save a search under a name, unique among the user's saved searches
+func createSavedSearch(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session, ok := requireSession(db, w, r)
+		if !ok {
+			return
+		}
+		s, ok := decodeSavedSearch(w, r)
+		if !ok {
+			return
+		}
+
+		result, err := db.Exec("INSERT INTO saved_searches(user_id, name, entity, params) VALUES(?, ?, ?, ?)",
+			session.User.ID, s.Name, s.Entity, s.values().Encode())
+		if isUniqueViolation(err) {
+			respondWithError(w, http.StatusConflict, "A saved search with this name already exists")
+			return
+		}
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		id, err := result.LastInsertId()
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		saved, err := loadSavedSearch(db, session.User.ID, int(id))
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		respondWithJSON(w, http.StatusCreated, saved)
+	}
+}
+
+func updateSavedSearch(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session, id, ok := savedSearchFromRequest(db, w, r)
+		if !ok {
+			return
+		}
+		s, ok := decodeSavedSearch(w, r)
+		if !ok {
+			return
+		}
+
+		result, err := db.Exec(`
+			UPDATE saved_searches SET name = ?, entity = ?, params = ?, updated_at = CURRENT_TIMESTAMP
+			WHERE id = ? AND user_id = ?
+		`, s.Name, s.Entity, s.values().Encode(), id, session.User.ID)
+		if isUniqueViolation(err) {
+			respondWithError(w, http.StatusConflict, "A saved search with this name already exists")
+			return
+		}
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			respondWithError(w, http.StatusNotFound, "Saved search not found")
+			return
+		}
+
+		saved, err := loadSavedSearch(db, session.User.ID, id)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		respondWithJSON(w, http.StatusOK, saved)
+	}
+}
+
+func deleteSavedSearch(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session, id, ok := savedSearchFromRequest(db, w, r)
+		if !ok {
+			return
+		}
+		result, err := db.Exec("DELETE FROM saved_searches WHERE id = ? AND user_id = ?", id, session.User.ID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			respondWithError(w, http.StatusNotFound, "Saved search not found")
+			return
+		}
+		respondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
+	}
+}
+
+// Run a saved search: the search endpoint of its entity answers with the
+// stored parameters, as if they had been given to it. Parameters naming a
+// deleted resident or a category no expense has any more are listed in the
+// X-Dangling-Filters header.
+func runSavedSearch(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session, id, ok := savedSearchFromRequest(db, w, r)
+		if !ok {
+			return
+		}
+		if err := checkQueryParams(r); err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		s, err := loadSavedSearch(db, session.User.ID, id)
+		if err == sql.ErrNoRows {
+			respondWithError(w, http.StatusNotFound, "Saved search not found")
+			return
+		}
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		if len(s.Dangling) > 0 {
+			var params []string
+			for _, d := range s.Dangling {
+				params = append(params, d.Param+"="+d.Value)
+			}
+			w.Header().Set("X-Dangling-Filters", strings.Join(params, ", "))
+		}
+		values := s.values()
+		if lang := r.URL.Query().Get("lang"); lang != "" {
+			values.Set("lang", lang)
+		}
+		search := r.Clone(r.Context())
+		search.URL.RawQuery = values.Encode()
+		savedSearchEntities[s.Entity].search(db)(w, search)
+	}
+}
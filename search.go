@@ -0,0 +1,304 @@
+package condomngr
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// residentSearchWhere builds the WHERE clause matching the LIKE pattern
+// against a resident's name, unit, email, contact and custom values.
+// Anonymized residents are never found.
+func residentSearchWhere(pattern string) (string, []interface{}) {
+	return `anonymized_at IS NULL AND (name LIKE ? ESCAPE '\' OR unit LIKE ? ESCAPE '\' OR email LIKE ? ESCAPE '\' OR contact LIKE ? ESCAPE '\'
+		OR EXISTS (SELECT 1 FROM resident_custom_values v WHERE v.resident_id = residents.id AND v.value LIKE ? ESCAPE '\'))`,
+		[]interface{}{pattern, pattern, pattern, pattern, pattern}
+}
+
+// paymentSearchWhere builds the WHERE clause of a payment search from the q,
+// match, resident_id and date range parameters, for payments p joined with
+// residents r. It is empty without any of them.
+func paymentSearchWhere(r *http.Request) (string, []interface{}, error) {
+	query := r.URL.Query().Get("q")
+	residentId := r.URL.Query().Get("resident_id")
+	startDate := r.URL.Query().Get("start_date")
+	endDate := r.URL.Query().Get("end_date")
+
+	// Build WHERE clause dynamically
+	whereClause := ""
+	args := []interface{}{}
+
+	if query != "" {
+		pattern, err := searchPattern(r)
+		if err != nil {
+			return "", nil, err
+		}
+		// Parenthesized so the filters below apply to both matches
+		whereClause += `(p.description LIKE ? ESCAPE '\' OR r.name LIKE ? ESCAPE '\')`
+		args = append(args, pattern, pattern)
+	}
+
+	if residentId != "" {
+		if whereClause != "" {
+			whereClause += " AND "
+		}
+		whereClause += "p.resident_id = ?"
+		args = append(args, residentId)
+	}
+
+	if startDate != "" {
+		if whereClause != "" {
+			whereClause += " AND "
+		}
+		whereClause += "p.payment_date >= ?"
+		args = append(args, startDate)
+	}
+
+	if endDate != "" {
+		if whereClause != "" {
+			whereClause += " AND "
+		}
+		whereClause += "p.payment_date <= ?"
+		args = append(args, endDate)
+	}
+
+	return whereClause, args, nil
+}
+
+// expenseSearchWhere builds the WHERE clause of an expense search from the q,
+// match, category and date range parameters. It is empty without any of them.
+func expenseSearchWhere(r *http.Request) (string, []interface{}, error) {
+	query := r.URL.Query().Get("q")
+	startDate := r.URL.Query().Get("start_date")
+	endDate := r.URL.Query().Get("end_date")
+
+	categoryClause, categoryArgs, err := categoryCondition(r)
+	if err != nil {
+		return "", nil, err
+	}
+
+	// Build WHERE clause dynamically
+	whereClause := ""
+	args := []interface{}{}
+
+	if query != "" {
+		pattern, err := searchPattern(r)
+		if err != nil {
+			return "", nil, err
+		}
+		whereClause += `description LIKE ? ESCAPE '\'`
+		args = append(args, pattern)
+	}
+
+	if categoryClause != "" {
+		if whereClause != "" {
+			whereClause += " AND "
+		}
+		whereClause += categoryClause
+		args = append(args, categoryArgs...)
+	}
+
+	if startDate != "" {
+		if whereClause != "" {
+			whereClause += " AND "
+		}
+		whereClause += "expense_date >= ?"
+		args = append(args, startDate)
+	}
+
+	if endDate != "" {
+		if whereClause != "" {
+			whereClause += " AND "
+		}
+		whereClause += "expense_date <= ?"
+		args = append(args, endDate)
+	}
+
+	return whereClause, args, nil
+}
+
+// Search result kinds
+const (
+	SearchKindResident = "resident"
+	SearchKindPayment  = "payment"
+	SearchKindExpense  = "expense"
+)
+
+// SearchResult is one match of the global search
+type SearchResult struct {
+	Kind    string `json:"kind"` // resident, payment or expense
+	ID      int    `json:"id"`
+	Title   string `json:"title"`   // resident name, payer or expense category
+	Detail  string `json:"detail"`  // unit or amount
+	Date    string `json:"date"`    // payment or expense date; last update for residents
+	Snippet string `json:"snippet"` // the matching text around the match
+}
+
+// searchSource is an entity the global search looks in. The query selects
+// the id, title, detail and date followed by the searched text columns, and
+// takes the arguments of where plus a limit.
+type searchSource struct {
+	kind  string
+	from  string
+	query string
+	where func(r *http.Request) (string, []interface{}, error)
+}
+
+// searchSources are searched in this order; new modules add theirs here
+var searchSources = []searchSource{
+	{
+		kind:  SearchKindResident,
+		from:  "residents",
+		query: "SELECT id, name, 'Unit ' || unit, substr(updated_at, 1, 10), name, unit, email, contact FROM residents",
+		where: func(r *http.Request) (string, []interface{}, error) {
+			pattern, err := searchPattern(r)
+			if err != nil {
+				return "", nil, err
+			}
+			where, args := residentSearchWhere(pattern)
+			return where, args, nil
+		},
+	},
+	{
+		kind:  SearchKindPayment,
+		from:  "payments p JOIN residents r ON p.resident_id = r.id",
+		query: "SELECT p.id, r.name, printf('%.2f', p.amount), substr(p.payment_date, 1, 10), p.description, r.name FROM payments p JOIN residents r ON p.resident_id = r.id",
+		where: paymentSearchWhere,
+	},
+	{
+		kind:  SearchKindExpense,
+		from:  "expenses",
+		query: "SELECT id, category, printf('%.2f', amount), substr(expense_date, 1, 10), description FROM expenses",
+		where: expenseSearchWhere,
+	},
+}
+
+// snippetRadius is how many characters of context a snippet keeps on each
+// side of the match
+const snippetRadius = 30
+
+// searchSnippet returns the first text containing query, shortened to the
+// match and some context around it
+func searchSnippet(query string, texts []string) string {
+	folded := strings.ToLower(query)
+	for _, text := range texts {
+		i := strings.Index(strings.ToLower(text), folded)
+		if i < 0 {
+			continue
+		}
+		runes := []rune(text)
+		start := len([]rune(text[:i]))
+		end := start + len([]rune(query))
+		from, to := max(0, start-snippetRadius), min(len(runes), end+snippetRadius)
+		snippet := string(runes[from:to])
+		if from > 0 {
+			snippet = "…" + snippet
+		}
+		if to < len(runes) {
+			snippet += "…"
+		}
+		return snippet
+	}
+	return ""
+}
+
+// globalSearch searches every source, matches in the title first and then the
+// most recent. Source
+// filters such as start_date, end_date, resident_id or category apply to the
+// sources that have them.
+func globalSearch(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query().Get("q")
+		if query == "" {
+			respondWithError(w, http.StatusBadRequest, "Search query is required")
+			return
+		}
+		limit := 20
+		if value := r.URL.Query().Get("limit"); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 || n > 100 {
+				respondWithError(w, http.StatusBadRequest, "Invalid limit, must be between 1 and 100")
+				return
+			}
+			limit = n
+		}
+
+		results := []SearchResult{}
+		total := 0
+		for _, source := range searchSources {
+			where, args, err := source.where(r)
+			if err != nil {
+				respondWithError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			if where == "" {
+				where = "1"
+			}
+
+			var n int
+			if err := db.QueryRow("SELECT COUNT(*) FROM "+source.from+" WHERE "+where, args...).Scan(&n); err != nil {
+				respondWithError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			total += n
+
+			found, err := searchSourceRows(db, source, where, args, query, limit)
+			if err != nil {
+				respondWithError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			results = append(results, found...)
+		}
+
+		// Matches in the title first, e.g. the resident named after the
+		// query before payments mentioning them, then the most recent
+		folded := strings.ToLower(query)
+		inTitle := func(result SearchResult) bool {
+			return strings.Contains(strings.ToLower(result.Title), folded)
+		}
+		sort.SliceStable(results, func(i, j int) bool {
+			if a, b := inTitle(results[i]), inTitle(results[j]); a != b {
+				return a
+			}
+			return results[i].Date > results[j].Date
+		})
+		if len(results) > limit {
+			results = results[:limit]
+		}
+
+		w.Header().Set("X-Total-Count", strconv.Itoa(total))
+		respondWithJSON(w, http.StatusOK, results)
+	}
+}
+
+// searchSourceRows runs the query of a source, newest first
+func searchSourceRows(db *sql.DB, source searchSource, where string, args []interface{}, query string, limit int) ([]SearchResult, error) {
+	rows, err := db.Query(fmt.Sprintf("%s WHERE %s ORDER BY 4 DESC LIMIT %d", source.query, where, limit), args...)
+	if err != nil {
+		return nil, fmt.Errorf("error searching %ss: %v", source.kind, err)
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	var results []SearchResult
+	for rows.Next() {
+		result := SearchResult{Kind: source.kind}
+		texts := make([]string, len(columns)-4)
+		dest := []interface{}{&result.ID, &result.Title, &result.Detail, &result.Date}
+		for i := range texts {
+			dest = append(dest, &texts[i])
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		result.Snippet = searchSnippet(query, texts)
+		results = append(results, result)
+	}
+	return results, rows.Err()
+}
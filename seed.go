@@ -0,0 +1,82 @@
+package condomngr
+
+import (
+	"bufio"
+	"database/sql"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// databaseEmpty reports whether there are no residents, payments or expenses
+func databaseEmpty(db *sql.DB) (bool, error) {
+	var n int
+	err := db.QueryRow(`SELECT (SELECT COUNT(*) FROM residents) + (SELECT COUNT(*) FROM payments) +
+		(SELECT COUNT(*) FROM expenses)`).Scan(&n)
+	return n == 0, err
+}
+
+// loadSeed imports an export file, in the format of the import endpoint, into
+// an empty database. With force it replaces existing data instead of leaving
+// it alone. The file is decoded leniently if lax. It reports whether the seed
+// was applied.
+func loadSeed(db *sql.DB, path string, force, lax bool, rules paymentRules) (bool, error) {
+	empty, err := databaseEmpty(db)
+	if err != nil {
+		return false, err
+	}
+	if !empty && !force {
+		return false, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+	var seed ExportData
+	if err := decodeJSONBytes(data, &seed, lax); err != nil {
+		return false, fmt.Errorf("invalid seed file %s: %v", path, err)
+	}
+	if err := verifyManifest(seed); err != nil {
+		return false, fmt.Errorf("invalid seed file %s: %v", path, err)
+	}
+	if err := validateImport(seed); err != nil {
+		return false, fmt.Errorf("invalid seed file %s: %v", path, err)
+	}
+	// An empty database has nothing to replace, so partial exports seed it too
+	mode := ImportModeReplace
+	if empty {
+		mode = ImportModeMerge
+	}
+	return true, importAll(db, seed, mode, rules)
+}
+
+// confirmSampleData guards against sample data wiping a real database. An
+// empty database needs no confirmation; otherwise yes (the -yes flag) or
+// typing "yes" at a terminal is required.
+func confirmSampleData(db *sql.DB, yes bool) error {
+	empty, err := databaseEmpty(db)
+	if err != nil || empty {
+		return err
+	}
+
+	return confirm(fmt.Sprintf("loading sample data deletes every resident, payment and expense in %s", dbFile), yes)
+}
+
+// confirm prints warning and asks to type yes, unless yes is already set.
+// Without a terminal to ask on it fails.
+func confirm(warning string, yes bool) error {
+	fmt.Fprintf(os.Stderr, "WARNING: %s\n", warning)
+	if yes {
+		return nil
+	}
+	if info, err := os.Stdin.Stat(); err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		return fmt.Errorf("refusing to replace existing data without -yes")
+	}
+	fmt.Fprint(os.Stderr, "Type yes to continue: ")
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	if strings.TrimSpace(answer) != "yes" {
+		return fmt.Errorf("aborted")
+	}
+	return nil
+}
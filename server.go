@@ -0,0 +1,643 @@
+package condomngr
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Defaults of the serve flags, also used for unset Options
+const (
+	defaultMaxBodySize   = 1 << 20
+	defaultMaxImportSize = 10 << 20
+	defaultCurrency      = "USD"
+)
+
+// Options configures NewServer. Components left nil are replaced by inert
+// ones: notifications, SMS, email, Sheets sync and Stripe are then disabled, and
+// the portal signs links with the secret stored in the database.
+type Options struct {
+	ReadOnly      bool  // start in read-only mode, locked as with -read-only
+	MaxBodySize   int64 // bytes, 1 MiB if zero
+	MaxImportSize int64 // bytes, 10 MiB if zero
+	Currency      string
+	MonthlyFee    float64
+	DuesProration string // ProrationDays if empty
+	VacantUnits   string // VacantSkip if empty
+
+	// Interest on overdue charges, as an annual percentage (0 disables it),
+	// accrued once a charge is more than InterestGraceDays overdue
+	InterestRate      float64
+	InterestGraceDays int
+
+	// Location is the timezone the condominium operates in, which decides
+	// what "today" and "this month" are; the server's if nil
+	Location *time.Location
+
+	// FiscalYearStart is the month (1-12) the fiscal year starts in; years
+	// in reports are fiscal years, calendar years if zero
+	FiscalYearStart int
+
+	PaymentAllocation     string // how payments settle charges, AllocationFIFO if empty
+	CountUnclearedCheques bool   // count cheques as paid before they clear
+
+	// LaxJSON ignores unknown fields and trailing data in request bodies,
+	// for clients that depend on it
+	LaxJSON bool
+
+	// CSVLocale is the locale of CSV reports that don't ask for one, en if
+	// empty
+	CSVLocale string
+
+	Notifier *Notifier
+	SMS      *SMSQueue
+	Mailer   *Mailer
+	Sheets   *SheetsSync
+	Stripe   *Stripe
+	Portal   *Portal
+
+	// Unsubscribe signs the links in emails to residents that stop them,
+	// with the secret stored in the database unless set
+	Unsubscribe *Unsubscribe
+
+	// InboundMailSecret authenticates the emails forwarded to be made
+	// maintenance requests; inbound mail is off unless set
+	InboundMailSecret string
+
+	// Attachments stores the files attached to records, next to the
+	// database unless set
+	Attachments *AttachmentStore
+
+	// Backups takes the scheduled backups and lists them; off unless set
+	Backups *Backups
+
+	// LoginGuard slows down and locks out password guessing, with the
+	// default limits unless set
+	LoginGuard *LoginGuard
+
+	// PasswordResets emails users links to set a new password, with links
+	// under PublicURL unless set
+	PasswordResets *PasswordResets
+
+	// PublicURL is where the application is reached, e.g.
+	// https://condo.example.com; links sent by email point under it.
+	// http://localhost:8080 if empty.
+	PublicURL string
+
+	// CondoID is the condo the server is for, DefaultCondoID if zero. The
+	// links of other condos point under /api/v1/condos/{id}.
+	CondoID int
+
+	// Condos serves the condo management endpoints; only the default condo's
+	// server has them
+	Condos *Condos
+
+	// CacheTTL is how long the dashboard, counts and reports are cached;
+	// they aren't unless set
+	CacheTTL time.Duration
+
+	// BasePath is the path prefix the application is served under, e.g.
+	// /condo behind a proxy that serves other sites; the root if empty
+	BasePath string
+}
+
+// Server is the whole application as an http.Handler: the API under /api/v1
+// (and the deprecated /api), the static files and the web interface. Starting
+// background work such as the notifier and SMS queue is left to the caller;
+// only the receipt queue, which sends from the server's own database, is
+// started here.
+type Server struct {
+	handler  http.Handler
+	stmts    *StmtCache
+	receipts *ReceiptQueue
+}
+
+// NewServer returns the application on db, which must have been opened with
+// OpenDB so the schema is current. Close it before closing the database. It
+// fails if the options are invalid or the secrets can't be loaded from db.
+func NewServer(db *sql.DB, opts Options) (*Server, error) {
+	if err := opts.setDefaults(db); err != nil {
+		return nil, err
+	}
+	cal, rules := opts.calendar(), opts.paymentRules()
+
+	// Prepare the handlers' statements once; closed by Close
+	stmts := NewStmtCache(db)
+
+	// Initialize read-only mode, toggled at runtime through the API
+	readOnly := NewReadOnly(opts.ReadOnly)
+
+	// Changes are published to the open event streams
+	changes := NewChangeBroker()
+
+	// Aggregates are cached until the data they are computed from changes
+	cache := NewResponseCache(opts.CacheTTL)
+	changes.OnPublish(cache.invalidateChange)
+
+	// Long work such as large imports runs in the background
+	jobs := NewJobs()
+
+	// Statements are mailed in the background, one mailing at a time
+	statementMailer := NewStatementMailer(db, opts.Mailer, opts.Unsubscribe, opts.Currency, opts.Location, opts.FiscalYearStart)
+
+	// Receipts of new payments are emailed in the background; stopped by Close
+	receipts := NewReceiptQueue(db, opts.Mailer, opts.Unsubscribe, opts.Currency, opts.Location)
+
+	// Initialize router
+	r := mux.NewRouter()
+
+	// API routes are registered once here and mounted under each API version.
+	// The unversioned /api prefix is a deprecated alias of /api/v1.
+	registerAPI := func(api *mux.Router) {
+		api.Use(withLanguage)
+		api.Use(withRequestOptions(requestOptions{laxJSON: opts.LaxJSON, csvLocale: opts.CSVLocale}))
+		api.Use(passwordChangeFirst(db))
+		api.Use(limitRequestBody(opts.MaxBodySize, opts.MaxImportSize, opts.Attachments.maxSize+maxMultipartOverhead))
+		api.Use(readOnly.Middleware)
+		api.Use(cache.Middleware)
+
+		// Residents API endpoints
+		api.HandleFunc("/residents", getResidents(db)).Methods("GET")
+		api.HandleFunc("/residents", createResident(db, stmts, changes)).Methods("POST")
+		api.HandleFunc("/residents/count", cache.Cached(countResidents(db), "resident")).Methods("GET")
+		api.HandleFunc("/residents/{id:[0-9]+}", getResident(db)).Methods("GET")
+		api.HandleFunc("/residents/{id:[0-9]+}", updateResident(db, stmts, changes)).Methods("PUT")
+		api.HandleFunc("/residents/{id:[0-9]+}", deleteResident(db, changes, rules)).Methods("DELETE")
+		api.HandleFunc("/residents/{id:[0-9]+}/timeline", getResidentTimeline(db)).Methods("GET")
+		api.HandleFunc("/residents/{id:[0-9]+}/notifications", getResidentNotifications(db)).Methods("GET")
+		api.HandleFunc("/residents/{id:[0-9]+}/notifications", updateResidentNotifications(db)).Methods("PUT")
+		api.HandleFunc("/residents/{id:[0-9]+}/anonymize", anonymizeResidentHandler(db, changes)).Methods("POST")
+
+		// Payments API endpoints
+		api.HandleFunc("/payments", getPayments(db)).Methods("GET")
+		api.HandleFunc("/payments", createPayment(db, stmts, opts.Notifier, receipts, changes, rules)).Methods("POST")
+		api.HandleFunc("/payments/count", cache.Cached(countPayments(db), "payment", "resident")).Methods("GET")
+		api.HandleFunc("/payments/calendar", cache.Cached(getPaymentCalendar(db, cal), "payment", "expense")).Methods("GET")
+		api.HandleFunc("/payments/descriptions", cache.Cached(suggestionsHandler(db, "payments", "description", "payment_date"), "payment")).Methods("GET")
+		api.HandleFunc("/payments/{id:[0-9]+}", getPayment(db)).Methods("GET")
+		api.HandleFunc("/payments/{id:[0-9]+}", updatePayment(db, stmts, changes, rules)).Methods("PUT")
+		api.HandleFunc("/payments/{id:[0-9]+}", deletePayment(db, changes, rules)).Methods("DELETE")
+		api.HandleFunc("/payments/{id:[0-9]+}/allocations", setPaymentAllocations(db, rules)).Methods("PUT")
+		api.HandleFunc("/payments/{id:[0-9]+}/clearance", setChequeClearance(db, changes, cal, rules)).Methods("POST")
+		api.HandleFunc("/payments/{id:[0-9]+}/receipt", sendPaymentReceipt(db, opts.Mailer, opts.Unsubscribe, opts.Currency, cal)).Methods("POST")
+		api.HandleFunc("/payments/{id:[0-9]+}/receipt/resend", resendPaymentReceipt(db, receipts)).Methods("POST")
+		api.HandleFunc("/payments/cheques/outstanding", getOutstandingCheques(db, cal)).Methods("GET")
+		api.HandleFunc("/payments/links", createPaymentLink(db, opts.Stripe)).Methods("POST")
+		api.HandleFunc("/payments/bulk-delete", bulkDelete(db, "payments", changes, rules)).Methods("POST")
+		api.HandleFunc("/payments/bulk-reassign", reassignPayments(db, changes, rules)).Methods("POST")
+
+		// Expenses API endpoints
+		api.HandleFunc("/expenses", getExpenses(db)).Methods("GET")
+		api.HandleFunc("/expenses", createExpense(db, stmts, opts.Currency, changes)).Methods("POST")
+		api.HandleFunc("/expenses/count", cache.Cached(countExpenses(db), "expense")).Methods("GET")
+		api.HandleFunc("/expenses/categories", cache.Cached(suggestionsHandler(db, "expenses", "category", "expense_date"), "expense")).Methods("GET")
+		api.HandleFunc("/expenses/{id:[0-9]+}", getExpense(db)).Methods("GET")
+		api.HandleFunc("/expenses/{id:[0-9]+}", updateExpense(db, stmts, opts.Currency, changes)).Methods("PUT")
+		api.HandleFunc("/expenses/{id:[0-9]+}", deleteExpense(db, changes, rules)).Methods("DELETE")
+		api.HandleFunc("/expenses/{id:[0-9]+}/allocate", allocateExpense(db, cal)).Methods("POST")
+		api.HandleFunc("/expenses/{id:[0-9]+}/allocation", getExpenseAllocation(db)).Methods("GET")
+		api.HandleFunc("/expenses/bulk-delete", bulkDelete(db, "expenses", changes, rules)).Methods("POST")
+		api.HandleFunc("/expenses/bulk-update", bulkUpdateExpenses(db, changes)).Methods("POST")
+
+		// Export and Import API endpoints
+		api.HandleFunc("/export", exportDatabase(db, cal)).Methods("GET")
+		api.HandleFunc("/import", importDatabase(db, opts.Notifier, changes, jobs, rules)).Methods("POST")
+		api.HandleFunc("/import/xlsx", postXLSXImport(db, receipts, changes, rules)).Methods("POST")
+		api.HandleFunc("/import/xlsx/detect", detectXLSXImport()).Methods("POST")
+		api.HandleFunc("/jobs/{id:[0-9]+}", getJob(jobs)).Methods("GET")
+		api.HandleFunc("/jobs/{id:[0-9]+}/cancel", cancelJob(jobs)).Methods("POST")
+
+		// Trash of deleted residents, payments and expenses
+		api.HandleFunc("/trash", getTrash(db)).Methods("GET")
+		api.HandleFunc("/trash/{id:[0-9]+}/restore", restoreTrash(db, changes, rules)).Methods("POST")
+
+		// Administration endpoints, for admins only
+		adminAPI := api.PathPrefix("/admin").Subrouter()
+		adminAPI.Use(adminOnly(db))
+
+		// Server status and read-only mode
+		api.HandleFunc("/status", getStatus(readOnly)).Methods("GET")
+		adminAPI.HandleFunc("/readonly", setReadOnly(db, readOnly)).Methods("POST")
+
+		// Database maintenance and backups
+		adminAPI.HandleFunc("/maintenance", postMaintenance(db)).Methods("POST")
+		adminAPI.HandleFunc("/dbstats", getDBStats(db)).Methods("GET")
+		adminAPI.HandleFunc("/consistency", getConsistency(db)).Methods("GET")
+		adminAPI.HandleFunc("/consistency/fix", postConsistencyFix(db, changes)).Methods("POST")
+		adminAPI.HandleFunc("/recompute", postRecompute(db, changes, rules)).Methods("POST")
+		adminAPI.HandleFunc("/backups", getBackups(opts.Backups)).Methods("GET")
+		adminAPI.HandleFunc("/backups", createBackup(opts.Backups)).Methods("POST")
+		adminAPI.HandleFunc("/diff", diffExportsHandler(db)).Methods("POST")
+		adminAPI.HandleFunc("/anonymize", downloadAnonymizedDatabase(db, cal)).Methods("POST")
+
+		// User management
+		api.HandleFunc("/users", getUsers(db)).Methods("GET")
+		api.HandleFunc("/users", postUser(db)).Methods("POST")
+		api.HandleFunc("/users/{id:[0-9]+}", getUser(db)).Methods("GET")
+		api.HandleFunc("/users/{id:[0-9]+}", putUser(db)).Methods("PUT")
+		api.HandleFunc("/users/{id:[0-9]+}", deleteUser(db)).Methods("DELETE")
+		api.HandleFunc("/users/{id:[0-9]+}/password", postUserPassword(db)).Methods("POST")
+
+		// Sign-in
+		api.HandleFunc("/auth/login", login(db, opts.LoginGuard)).Methods("POST")
+		api.HandleFunc("/auth/login/2fa", loginTwoFactor(db, opts.LoginGuard)).Methods("POST")
+		api.HandleFunc("/auth/logout", logout(db)).Methods("POST")
+		api.HandleFunc("/auth/session", getSession(db)).Methods("GET")
+		api.HandleFunc("/auth/password", changePassword(db, opts.LoginGuard)).Methods("POST")
+		api.HandleFunc("/auth/failures", getLoginFailures(db, opts.LoginGuard)).Methods("GET")
+		api.HandleFunc("/auth/failures", clearLoginFailures(db, opts.LoginGuard)).Methods("DELETE")
+		api.HandleFunc("/sessions", getSessions(db)).Methods("GET")
+		api.HandleFunc("/sessions/{id:[0-9]+}", deleteSession(db)).Methods("DELETE")
+		adminAPI.HandleFunc("/sessions", getAllSessions(db)).Methods("GET")
+		adminAPI.HandleFunc("/sessions/{id:[0-9]+}", deleteAnySession(db)).Methods("DELETE")
+		api.HandleFunc("/auth/2fa/enroll", postTwoFactorEnroll(db)).Methods("POST")
+		api.HandleFunc("/auth/2fa/activate", postTwoFactorActivate(db)).Methods("POST")
+		api.HandleFunc("/users/{id:[0-9]+}/2fa", deleteUserTwoFactor(db)).Methods("DELETE")
+		adminAPI.HandleFunc("/2fa", getTwoFactorPolicy(db)).Methods("GET")
+		adminAPI.HandleFunc("/2fa", putTwoFactorPolicy(db)).Methods("PUT")
+		api.HandleFunc("/password-reset/request", requestPasswordReset(opts.PasswordResets)).Methods("POST")
+		api.HandleFunc("/password-reset/confirm", confirmPasswordReset(opts.PasswordResets, opts.LoginGuard)).Methods("GET", "POST")
+		adminAPI.HandleFunc("/audit", getAuditLog(db)).Methods("GET")
+
+		// Dashboard of the web interface
+		api.HandleFunc("/dashboard", cache.Cached(getDashboard(db, cal), "resident", "payment", "expense")).Methods("GET")
+		api.HandleFunc("/kpis", cache.Cached(getKPIs(db, cal), "resident", "payment", "expense")).Methods("GET")
+
+		// Search API endpoints
+		api.HandleFunc("/search", globalSearch(db)).Methods("GET")
+		api.HandleFunc("/activity", getActivity(db, cal)).Methods("GET")
+		api.HandleFunc("/events", streamEvents(changes)).Methods("GET")
+		api.HandleFunc("/search/residents", searchResidents(db)).Methods("GET")
+		api.HandleFunc("/search/payments", searchPayments(db)).Methods("GET")
+		api.HandleFunc("/search/expenses", searchExpenses(db)).Methods("GET")
+		api.HandleFunc("/saved-searches", getSavedSearches(db)).Methods("GET")
+		api.HandleFunc("/saved-searches", createSavedSearch(db)).Methods("POST")
+		api.HandleFunc("/saved-searches/{id:[0-9]+}", getSavedSearch(db)).Methods("GET")
+		api.HandleFunc("/saved-searches/{id:[0-9]+}", updateSavedSearch(db)).Methods("PUT")
+		api.HandleFunc("/saved-searches/{id:[0-9]+}", deleteSavedSearch(db)).Methods("DELETE")
+		api.HandleFunc("/saved-searches/{id:[0-9]+}/run", runSavedSearch(db)).Methods("GET")
+
+		// Reports Export endpoints
+		api.HandleFunc("/reports/payments/export", exportPaymentsReport(db, cal)).Methods("GET")
+		api.HandleFunc("/reports/expenses/export", exportExpensesReport(db, cal)).Methods("GET")
+		api.HandleFunc("/reports/accounting/export", exportAccountingReport(db, opts.Currency, cal)).Methods("GET")
+		api.HandleFunc("/reports/aging", cache.Cached(getAgingReport(db, cal), "resident", "payment")).Methods("GET")
+		api.HandleFunc("/reports/funds", cache.Cached(getFundsReport(db), "payment")).Methods("GET")
+		api.HandleFunc("/reports/tax", cache.Cached(getTaxReport(db, cal), "expense")).Methods("GET")
+		api.HandleFunc("/reports/income-expense", cache.Cached(getIncomeExpenseReport(db, cal), "payment", "expense")).Methods("GET")
+		api.HandleFunc("/reports/budget/{year:[0-9]+}", cache.Cached(getBudgetReport(db, cal), "expense")).Methods("GET")
+		api.HandleFunc("/reports/budget/{year:[0-9]+}/{category}", cache.Cached(getBudgetDrillDown(db, cal), "expense")).Methods("GET")
+		api.HandleFunc("/reports/allocations", cache.Cached(getAllocationReport(db, cal), "expense")).Methods("GET")
+		api.HandleFunc("/reports/notifications/export", exportNotificationsReport(db, cal)).Methods("GET")
+		api.HandleFunc("/report-schedules", getReportSchedules(db)).Methods("GET")
+		api.HandleFunc("/report-schedules", createReportSchedule(db, cal)).Methods("POST")
+		api.HandleFunc("/report-schedules/{id:[0-9]+}", getReportSchedule(db)).Methods("GET")
+		api.HandleFunc("/report-schedules/{id:[0-9]+}", updateReportSchedule(db, cal)).Methods("PUT")
+		api.HandleFunc("/report-schedules/{id:[0-9]+}", deleteReportSchedule(db)).Methods("DELETE")
+		api.HandleFunc("/report-schedules/{id:[0-9]+}/run", runReportScheduleNow(db, opts.Mailer, cal)).Methods("POST")
+		api.HandleFunc("/report-runs", getReportRuns(db)).Methods("GET")
+
+		// Notification endpoints
+		api.HandleFunc("/notify/test", testNotification(opts.Notifier)).Methods("POST")
+
+		// Reminder endpoints
+		api.HandleFunc("/unsubscribe", unsubscribe(db, opts.Unsubscribe)).Methods("GET", "POST")
+		api.HandleFunc("/reminders/overdue", sendOverdueReminders(db, opts.SMS, opts.Mailer, opts.Unsubscribe, opts.Currency, cal)).Methods("POST")
+		api.HandleFunc("/sms", getSMSMessages(db)).Methods("GET")
+
+		// Integration endpoints
+		api.HandleFunc("/integrations/sheets/sync", syncSheets(opts.Sheets)).Methods("POST")
+		api.HandleFunc("/integrations/sheets/status", getSheetsStatus(opts.Sheets)).Methods("GET")
+		api.HandleFunc("/integrations/stripe/webhook", stripeWebhook(db, opts.Stripe, receipts, changes, cal, rules)).Methods("POST")
+
+		// Dues endpoints
+		api.HandleFunc("/dues/generate", generateDues(db, opts.MonthlyFee, opts.DuesProration, opts.VacantUnits, cal, rules)).Methods("POST")
+		api.HandleFunc("/residents/{id:[0-9]+}/charges", getResidentCharges(db)).Methods("GET")
+		api.HandleFunc("/residents/{id:[0-9]+}/balance", getResidentBalance(db)).Methods("GET")
+		api.HandleFunc("/residents/{id:[0-9]+}/statement", getResidentStatement(db, opts.Currency, cal)).Methods("GET")
+		api.HandleFunc("/residents/{id:[0-9]+}/payment-request", getPaymentRequest(db, opts.Currency, cal)).Methods("GET")
+		api.HandleFunc("/residents/{id:[0-9]+}/credits", getResidentCredits(db)).Methods("GET")
+		api.HandleFunc("/residents/{id:[0-9]+}/credits", createResidentCredit(db, cal)).Methods("POST")
+		api.HandleFunc("/residents/{id:[0-9]+}/writeoffs", getResidentWriteOffs(db)).Methods("GET")
+		api.HandleFunc("/residents/{id:[0-9]+}/writeoff", createResidentWriteOff(db, cal)).Methods("POST")
+		api.HandleFunc("/writeoffs/{id:[0-9]+}", reverseWriteOff(db)).Methods("DELETE")
+		api.HandleFunc("/residents/{id:[0-9]+}/fees", getResidentFees(db, opts.MonthlyFee, cal)).Methods("GET")
+		api.HandleFunc("/residents/{id:[0-9]+}/interest", getResidentInterest(db, opts.InterestRate, opts.InterestGraceDays, cal, rules)).Methods("GET")
+		api.HandleFunc("/residents/{id:[0-9]+}/interest", applyResidentInterest(db, opts.InterestRate, opts.InterestGraceDays, cal, rules)).Methods("POST")
+		api.HandleFunc("/fee-schedules", getFeeSchedules(db)).Methods("GET")
+		api.HandleFunc("/fee-schedules", createFeeSchedule(db)).Methods("POST")
+		api.HandleFunc("/fee-schedules/{id:[0-9]+}", getFeeSchedule(db)).Methods("GET")
+		api.HandleFunc("/fee-schedules/{id:[0-9]+}", updateFeeSchedule(db)).Methods("PUT")
+		api.HandleFunc("/fee-schedules/{id:[0-9]+}", deleteFeeSchedule(db)).Methods("DELETE")
+		api.HandleFunc("/payment-plans", getPaymentPlans(db, cal)).Methods("GET")
+		api.HandleFunc("/payment-plans", createPaymentPlan(db, cal)).Methods("POST")
+		api.HandleFunc("/payment-plans/{id:[0-9]+}", getPaymentPlan(db, cal)).Methods("GET")
+		api.HandleFunc("/payment-plans/{id:[0-9]+}", updatePaymentPlan(db, cal)).Methods("PUT")
+		api.HandleFunc("/payment-plans/{id:[0-9]+}", deletePaymentPlan(db)).Methods("DELETE")
+		api.HandleFunc("/assessments", getAssessments(db)).Methods("GET")
+		api.HandleFunc("/assessments", createAssessment(db, rules)).Methods("POST")
+		api.HandleFunc("/assessments/{id:[0-9]+}", getAssessment(db)).Methods("GET")
+		api.HandleFunc("/assessments/{id:[0-9]+}", updateAssessment(db, rules)).Methods("PUT")
+		api.HandleFunc("/assessments/{id:[0-9]+}", deleteAssessment(db, rules)).Methods("DELETE")
+		api.HandleFunc("/assessments/{id:[0-9]+}/progress", getAssessmentProgress(db, cal)).Methods("GET")
+		api.HandleFunc("/fractions", getUnitFractions(db)).Methods("GET")
+		api.HandleFunc("/fractions/check", getFractionCheck(db)).Methods("GET")
+		api.HandleFunc("/fractions/{unit}", setUnitFraction(db)).Methods("PUT")
+		api.HandleFunc("/fractions/{unit}", deleteUnitFraction(db)).Methods("DELETE")
+		api.HandleFunc("/units/occupancy", getOccupancy(db, cal)).Methods("GET")
+		api.HandleFunc("/units/{unit}/transfer", transferUnit(db, changes, cal, rules)).Methods("POST")
+		api.HandleFunc("/units/{unit}/history", getUnitHistory(db, cal)).Methods("GET")
+		api.HandleFunc("/reserve/rules", getReserveRules(db)).Methods("GET")
+		api.HandleFunc("/reserve/rules", createReserveRule(db)).Methods("POST")
+		api.HandleFunc("/reserve/rules/{id:[0-9]+}", deleteReserveRule(db)).Methods("DELETE")
+		api.HandleFunc("/reserve/recalculate", recalculateReserve(db)).Methods("POST")
+		api.HandleFunc("/budgets", getBudgets(db, cal)).Methods("GET")
+		api.HandleFunc("/budgets/{year:[0-9]+}/{category}", setBudget(db, cal)).Methods("PUT")
+		api.HandleFunc("/budgets/{year:[0-9]+}/{category}", deleteBudget(db)).Methods("DELETE")
+		api.HandleFunc("/statements/send", sendStatements(statementMailer)).Methods("POST")
+		api.HandleFunc("/statements/send/status", getStatementMailStatus(statementMailer)).Methods("GET")
+		api.HandleFunc("/receipt-emails", getReceiptEmails(db)).Methods("GET")
+		api.HandleFunc("/receipt-emails/settings", getReceiptSettings(db)).Methods("GET")
+		api.HandleFunc("/receipt-emails/settings", putReceiptSettings(db, opts.Mailer)).Methods("PUT")
+		api.HandleFunc("/email-templates", getEmailTemplates(db)).Methods("GET")
+		api.HandleFunc("/email-templates/{name}", getEmailTemplate(db)).Methods("GET")
+		api.HandleFunc("/email-templates/{name}", updateEmailTemplate(db, opts.Currency)).Methods("PUT")
+		api.HandleFunc("/email-templates/{name}", resetEmailTemplate(db)).Methods("DELETE")
+		api.HandleFunc("/email-templates/{name}/preview", previewEmailTemplate(db, opts.Currency)).Methods("POST")
+
+		// Bank reconciliation endpoints
+		api.HandleFunc("/bank-accounts", getBankAccounts(db)).Methods("GET")
+		api.HandleFunc("/bank-accounts", createBankAccount(db)).Methods("POST")
+		api.HandleFunc("/bank-accounts/{id:[0-9]+}/statements", importBankStatement(db)).Methods("POST")
+		api.HandleFunc("/bank-accounts/{id:[0-9]+}/lines", getBankLines(db)).Methods("GET")
+		api.HandleFunc("/bank-accounts/{id:[0-9]+}/reconciliation", getReconciliationReport(db, cal)).Methods("GET")
+		api.HandleFunc("/bank-lines/{id:[0-9]+}/review", reviewBankLine(db, receipts, changes, rules)).Methods("POST")
+		api.HandleFunc("/payment-details", getPaymentDetails(db)).Methods("GET")
+		api.HandleFunc("/payment-details", putPaymentDetails(db)).Methods("PUT")
+
+		// Announcement endpoints
+		api.HandleFunc("/announcements", getAnnouncements(db)).Methods("GET")
+		api.HandleFunc("/announcements", createAnnouncement(db)).Methods("POST")
+		api.HandleFunc("/announcements/{id:[0-9]+}", updateAnnouncement(db)).Methods("PUT")
+		api.HandleFunc("/announcements/{id:[0-9]+}", deleteAnnouncement(db)).Methods("DELETE")
+
+		// Expiry endpoints
+		api.HandleFunc("/expiries", getExpiries(db, cal)).Methods("GET")
+		api.HandleFunc("/expiries/{item}/suppress", suppressExpiry(db)).Methods("PUT")
+		api.HandleFunc("/expiries/{item}/suppress", unsuppressExpiry(db)).Methods("DELETE")
+		api.HandleFunc("/documents", getDocuments(db)).Methods("GET")
+		api.HandleFunc("/documents", createDocument(db)).Methods("POST")
+		api.HandleFunc("/documents/{id:[0-9]+}", updateDocument(db)).Methods("PUT")
+		api.HandleFunc("/documents/{id:[0-9]+}", deleteDocument(db)).Methods("DELETE")
+
+		// Incident endpoints
+		api.HandleFunc("/incidents", getIncidents(db)).Methods("GET")
+		api.HandleFunc("/incidents", createIncident(db, cal)).Methods("POST")
+		api.HandleFunc("/incidents/{id:[0-9]+}", getIncident(db, opts.Attachments, opts.Currency, cal)).Methods("GET")
+		api.HandleFunc("/incidents/{id:[0-9]+}", updateIncident(db, cal)).Methods("PUT")
+		api.HandleFunc("/incidents/{id:[0-9]+}", deleteIncident(db)).Methods("DELETE")
+		api.HandleFunc("/incidents/{id:[0-9]+}/tasks", createLinkedTask(db, "incident", cal)).Methods("POST")
+
+		// Maintenance request endpoints
+		api.HandleFunc("/maintenance-requests", getMaintenanceRequests(db)).Methods("GET")
+		api.HandleFunc("/maintenance-requests", createMaintenanceRequest(db)).Methods("POST")
+		api.HandleFunc("/maintenance-requests/inbound", inboundMaintenanceRequest(db, opts.Attachments, opts.Mailer, opts.Notifier, opts.InboundMailSecret)).Methods("POST")
+		api.HandleFunc("/maintenance-requests/{id:[0-9]+}", getMaintenanceRequest(db)).Methods("GET")
+		api.HandleFunc("/maintenance-requests/{id:[0-9]+}", updateMaintenanceRequest(db)).Methods("PUT")
+		api.HandleFunc("/maintenance-requests/{id:[0-9]+}", deleteMaintenanceRequest(db)).Methods("DELETE")
+		api.HandleFunc("/maintenance-requests/{id:[0-9]+}/tasks", createLinkedTask(db, "maintenance_request", cal)).Methods("POST")
+
+		// Task endpoints
+		api.HandleFunc("/tasks", getTasks(db, cal)).Methods("GET")
+		api.HandleFunc("/tasks", createTask(db, cal)).Methods("POST")
+		api.HandleFunc("/tasks/{id:[0-9]+}", getTask(db, cal)).Methods("GET")
+		api.HandleFunc("/tasks/{id:[0-9]+}", updateTask(db, cal)).Methods("PUT")
+		api.HandleFunc("/tasks/{id:[0-9]+}", deleteTask(db)).Methods("DELETE")
+
+		// Attachment endpoints; each type of record has its own for uploads
+		api.HandleFunc("/payments/{id:[0-9]+}/attachments", getAttachments(opts.Attachments, "payment")).Methods("GET")
+		api.HandleFunc("/payments/{id:[0-9]+}/attachments", createAttachment(opts.Attachments, "payment")).Methods("POST")
+		api.HandleFunc("/expenses/{id:[0-9]+}/attachments", getAttachments(opts.Attachments, "expense")).Methods("GET")
+		api.HandleFunc("/expenses/{id:[0-9]+}/attachments", createAttachment(opts.Attachments, "expense")).Methods("POST")
+		api.HandleFunc("/incidents/{id:[0-9]+}/attachments", getAttachments(opts.Attachments, "incident")).Methods("GET")
+		api.HandleFunc("/incidents/{id:[0-9]+}/attachments", createAttachment(opts.Attachments, "incident")).Methods("POST")
+		api.HandleFunc("/maintenance-requests/{id:[0-9]+}/attachments", getAttachments(opts.Attachments, "maintenance_request")).Methods("GET")
+		api.HandleFunc("/maintenance-requests/{id:[0-9]+}/attachments", createAttachment(opts.Attachments, "maintenance_request")).Methods("POST")
+		api.HandleFunc("/attachments/usage", getAttachmentUsage(opts.Attachments)).Methods("GET")
+		api.HandleFunc("/attachments/{id:[0-9]+}", getAttachment(opts.Attachments)).Methods("GET")
+		api.HandleFunc("/attachments/{id:[0-9]+}", deleteAttachment(opts.Attachments)).Methods("DELETE")
+		api.HandleFunc("/attachments/{id:[0-9]+}/download", downloadAttachment(opts.Attachments)).Methods("GET")
+
+		// Custom field endpoints
+		api.HandleFunc("/custom-fields", getCustomFields(db)).Methods("GET")
+		api.HandleFunc("/custom-fields", createCustomField(db)).Methods("POST")
+		api.HandleFunc("/custom-fields/{id:[0-9]+}", getCustomField(db)).Methods("GET")
+		api.HandleFunc("/custom-fields/{id:[0-9]+}", updateCustomField(db)).Methods("PUT")
+		api.HandleFunc("/custom-fields/{id:[0-9]+}", deleteCustomField(db)).Methods("DELETE")
+
+		// Portal token management
+		api.HandleFunc("/residents/{id:[0-9]+}/portal-token", createPortalToken(db, opts.Portal)).Methods("POST")
+		api.HandleFunc("/residents/{id:[0-9]+}/portal-tokens", getPortalTokens(db)).Methods("GET")
+		api.HandleFunc("/portal-tokens/{id:[0-9]+}", revokePortalToken(db)).Methods("DELETE")
+
+		// Resident portal, read-only and scoped to the token's resident
+		portalAPI := api.PathPrefix("/portal").Subrouter()
+		portalAPI.Use(opts.Portal.Middleware)
+		portalAPI.HandleFunc("/me", portalMe(db)).Methods("GET")
+		portalAPI.HandleFunc("/payments", portalPayments(db)).Methods("GET")
+		portalAPI.HandleFunc("/balance", portalBalance(db)).Methods("GET")
+		portalAPI.HandleFunc("/statement", portalStatement(db, opts.Currency, cal)).Methods("GET")
+		portalAPI.HandleFunc("/payment-request", portalPaymentRequest(db, opts.Currency, cal)).Methods("GET")
+		portalAPI.HandleFunc("/announcements", portalAnnouncements(db)).Methods("GET")
+
+		// Application configuration
+		api.HandleFunc("/config", getAppConfig(opts.Currency, cal)).Methods("GET")
+
+		// Condominiums managed by the instance, and the users who may reach
+		// them, for admins only
+		if opts.Condos != nil {
+			admin := adminOnly(db)
+			api.Handle("/condos", admin(getCondos(opts.Condos))).Methods("GET")
+			api.Handle("/condos", admin(createCondo(opts.Condos))).Methods("POST")
+			api.Handle("/condos/{id:[0-9]+}", admin(getCondo(opts.Condos))).Methods("GET")
+			api.Handle("/users/{id:[0-9]+}/condos", admin(getUserCondos(opts.Condos))).Methods("GET")
+			api.Handle("/users/{id:[0-9]+}/condos", admin(grantUserCondo(opts.Condos))).Methods("POST")
+			api.Handle("/users/{id:[0-9]+}/condos/{condo_id:[0-9]+}", admin(revokeUserCondo(opts.Condos))).Methods("DELETE")
+		}
+
+		// API documentation
+		api.HandleFunc("/openapi.json", serveOpenAPI).Methods("GET")
+		api.HandleFunc("/docs", serveAPIDocs).Methods("GET")
+
+		// Keep unmatched API requests away from the index page catch-all
+		fallback := api.PathPrefix("/")
+		fallback.HandlerFunc(apiFallback(api, fallback))
+	}
+	registerAPI(r.PathPrefix("/api/v1").Subrouter())
+	legacyAPI := r.PathPrefix("/api").Subrouter()
+	legacyAPI.Use(deprecatedAPI("/api", "/api/v1"))
+	registerAPI(legacyAPI)
+
+	// Serve static files
+	r.PathPrefix("/static/").HandlerFunc(serveStatic)
+	r.HandleFunc("/favicon.ico", serveFavicon)
+
+	// Serve index page
+	r.PathPrefix("/").HandlerFunc(serveIndex)
+
+	receipts.Start()
+	return &Server{handler: underBasePath(opts.BasePath, r), stmts: stmts, receipts: receipts}, nil
+}
+
+// ServeHTTP dispatches a request to the routes
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.handler.ServeHTTP(w, r)
+}
+
+// underBasePath serves h under the path prefix base: requests below it reach
+// h with the prefix removed, base itself is redirected to base/, where the
+// web interface is, and the rest get a 404
+func underBasePath(base string, h http.Handler) http.Handler {
+	base = strings.TrimSuffix(base, "/")
+	if base == "" {
+		return h
+	}
+	strip := http.StripPrefix(base, h)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == base:
+			target := base + "/"
+			if r.URL.RawQuery != "" {
+				target += "?" + r.URL.RawQuery
+			}
+			http.Redirect(w, r, target, http.StatusMovedPermanently)
+		case strings.HasPrefix(r.URL.Path, base+"/"):
+			strip.ServeHTTP(w, r)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
+
+// Close stops the receipt queue and releases the prepared statements. Call it
+// before closing the database.
+func (s *Server) Close() error {
+	s.receipts.Stop()
+	return s.stmts.Close()
+}
+
+// setDefaults fills in what the options leave unset
+func (opts *Options) setDefaults(db *sql.DB) error {
+	if opts.MaxBodySize == 0 {
+		opts.MaxBodySize = defaultMaxBodySize
+	}
+	if opts.MaxImportSize == 0 {
+		opts.MaxImportSize = defaultMaxImportSize
+	}
+	if opts.Currency == "" {
+		opts.Currency = defaultCurrency
+	}
+	if opts.DuesProration == "" {
+		opts.DuesProration = ProrationDays
+	}
+	if !validProration(opts.DuesProration) {
+		return fmt.Errorf("invalid dues proration %q, must be %s or %s", opts.DuesProration, ProrationDays, ProrationHalfMonth)
+	}
+	if opts.VacantUnits == "" {
+		opts.VacantUnits = VacantSkip
+	}
+	if !validVacantRule(opts.VacantUnits) {
+		return fmt.Errorf("invalid vacant units rule %q, must be %s or %s", opts.VacantUnits, VacantSkip, VacantOwner)
+	}
+	if opts.Location == nil {
+		opts.Location = time.Local
+	}
+	if opts.FiscalYearStart == 0 {
+		opts.FiscalYearStart = 1
+	}
+	if opts.FiscalYearStart < 1 || opts.FiscalYearStart > 12 {
+		return fmt.Errorf("invalid fiscal year start %d, must be a month from 1 to 12", opts.FiscalYearStart)
+	}
+	if opts.PaymentAllocation == "" {
+		opts.PaymentAllocation = AllocationFIFO
+	}
+	if !validAllocation(opts.PaymentAllocation) {
+		return fmt.Errorf("invalid payment allocation %q, must be %s or %s", opts.PaymentAllocation, AllocationFIFO, AllocationManual)
+	}
+	if opts.CSVLocale == "" {
+		opts.CSVLocale = defaultCSVLocale
+	}
+	if _, ok := findCSVLocale(opts.CSVLocale); !ok {
+		return fmt.Errorf("invalid CSV locale %q, must be en or pt-PT", opts.CSVLocale)
+	}
+	if opts.BasePath != "" && !strings.HasPrefix(opts.BasePath, "/") {
+		return fmt.Errorf("invalid base path %q, must start with /", opts.BasePath)
+	}
+	if opts.PublicURL == "" {
+		opts.PublicURL = "http://localhost:" + port
+	}
+	if opts.CondoID == 0 {
+		opts.CondoID = DefaultCondoID
+	}
+	apiURL := condoAPIURL(opts.PublicURL, opts.CondoID)
+	if opts.Notifier == nil {
+		opts.Notifier = NewNotifier(nil, 0)
+	}
+	if opts.SMS == nil {
+		opts.SMS = NewSMSQueue(db, nil, 0, "")
+	}
+	if opts.Mailer == nil {
+		opts.Mailer = NewMailer("", "", "", "")
+	}
+	if opts.Sheets == nil {
+		opts.Sheets, _ = NewSheetsSync(db, "", "", SheetsModeAppend) // can't fail unconfigured
+	}
+	if opts.Stripe == nil {
+		opts.Stripe = NewStripe("", "", opts.Currency, opts.PublicURL)
+	}
+	if opts.Portal == nil {
+		secret, err := loadOrCreateSecret(db, "portal_secret")
+		if err != nil {
+			return fmt.Errorf("failed to load portal secret: %v", err)
+		}
+		opts.Portal = NewPortal(db, secret, apiURL)
+	}
+	if opts.Unsubscribe == nil {
+		secret, err := loadOrCreateSecret(db, "unsubscribe_secret")
+		if err != nil {
+			return fmt.Errorf("failed to load unsubscribe secret: %v", err)
+		}
+		opts.Unsubscribe = NewUnsubscribe(secret, apiURL)
+	}
+	if opts.LoginGuard == nil {
+		opts.LoginGuard = NewLoginGuard(db, opts.Notifier, defaultLoginBackoffAfter, defaultLoginLockoutAfter, defaultLoginLockout)
+	}
+	if opts.PasswordResets == nil {
+		opts.PasswordResets = NewPasswordResets(db, opts.Mailer, apiURL)
+	}
+	if opts.Backups == nil {
+		opts.Backups = NewBackups(db, "", 0, nil, opts.Notifier)
+	}
+	if opts.Attachments == nil {
+		attachments, err := NewAttachmentStore(db, defaultMaxAttachmentSize, 0)
+		if err != nil {
+			return fmt.Errorf("failed to set up attachments: %v", err)
+		}
+		opts.Attachments = attachments
+	}
+	return nil
+}
+
+// calendar is how the server reads dates, from its options
+func (opts Options) calendar() calendar {
+	return calendar{location: opts.Location, fiscalYearStart: opts.FiscalYearStart}
+}
+
+// paymentRules are how the server counts payments, from its options
+func (opts Options) paymentRules() paymentRules {
+	return paymentRules{allocation: opts.PaymentAllocation, countUnclearedCheques: opts.CountUnclearedCheques}
+}
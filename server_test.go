@@ -0,0 +1,494 @@
+package condomngr
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testServer is the application served over HTTP on a fresh database in a
+// temporary directory
+type testServer struct {
+	*httptest.Server
+	t  testing.TB
+	db *sql.DB
+
+	// token is sent as the bearer token of requests when set
+	token string
+}
+
+// newTestServer starts the application with opts; it is stopped and its
+// database closed when the test ends
+func newTestServer(t testing.TB, opts Options) *testServer {
+	t.Helper()
+	db, err := OpenDB(filepath.Join(t.TempDir(), "condo.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return serveTestDB(t, db, opts)
+}
+
+// serveTestDB starts the application with opts on db, which it leaves open
+func serveTestDB(t testing.TB, db *sql.DB, opts Options) *testServer {
+	t.Helper()
+	server, err := NewServer(db, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+	ts := httptest.NewServer(server)
+	t.Cleanup(ts.Close)
+	return &testServer{Server: ts, t: t, db: db}
+}
+
+// do sends a request with body encoded as JSON, unless it is a string, which
+// is sent as it is, and decodes the JSON response into out unless it's nil
+func (s *testServer) do(method, path string, body, out interface{}) *http.Response {
+	s.t.Helper()
+	var reader io.Reader
+	switch b := body.(type) {
+	case nil:
+	case string:
+		reader = strings.NewReader(b)
+	default:
+		data, err := json.Marshal(b)
+		if err != nil {
+			s.t.Fatal(err)
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, s.URL+path, reader)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	if reader != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if s.token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	}
+	resp, err := s.Client().Do(req)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	if out != nil && len(data) > 0 {
+		if err := json.Unmarshal(data, out); err != nil {
+			s.t.Fatalf("%s %s: %v in %s", method, path, err, data)
+		}
+	}
+	return resp
+}
+
+// expect sends a request as do and fails the test unless it is answered with
+// status
+func (s *testServer) expect(status int, method, path string, body, out interface{}) *http.Response {
+	s.t.Helper()
+	resp := s.do(method, path, body, out)
+	if resp.StatusCode != status {
+		s.t.Fatalf("%s %s: status %d, want %d", method, path, resp.StatusCode, status)
+	}
+	return resp
+}
+
+// apiError is the body of an error response
+type apiError struct {
+	Error   string `json:"error"`
+	Code    string `json:"code"`
+	Details []struct {
+		Field string `json:"field"`
+		Code  string `json:"code"`
+	} `json:"details"`
+}
+
+// signIn adds a user with role, straight to the database, and returns the
+// token of a new session of theirs
+func (s *testServer) signIn(username, role string) string {
+	s.t.Helper()
+	user, err := createUser(s.db, NewUserRequest{Username: username, Password: "secretpass1", Role: role})
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	session, err := createSession(s.db, user, httptest.NewRequest("POST", "/api/v1/auth/login", nil))
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	return session.Token
+}
+
+// createResident adds a resident through the API and returns it
+func (s *testServer) createResident(name, unit string) Resident {
+	s.t.Helper()
+	var resident Resident
+	s.expect(http.StatusCreated, "POST", "/api/v1/residents", map[string]interface{}{"name": name, "unit": unit}, &resident)
+	return resident
+}
+
+func TestResidentCRUD(t *testing.T) {
+	s := newTestServer(t, Options{})
+
+	created := s.createResident("Ana Silva", "1A")
+	if created.ID == 0 || created.Name != "Ana Silva" || created.Unit != "1A" {
+		t.Fatalf("created %+v", created)
+	}
+
+	var got Resident
+	s.expect(http.StatusOK, "GET", fmt.Sprint("/api/v1/residents/", created.ID), nil, &got)
+	if got.Name != "Ana Silva" {
+		t.Errorf("got name %q", got.Name)
+	}
+
+	var updated Resident
+	s.expect(http.StatusOK, "PUT", fmt.Sprint("/api/v1/residents/", created.ID), map[string]interface{}{"name": "Ana Costa", "unit": "1A"}, &updated)
+	if updated.Name != "Ana Costa" {
+		t.Errorf("updated name %q", updated.Name)
+	}
+
+	var list []Resident
+	s.expect(http.StatusOK, "GET", "/api/v1/residents", nil, &list)
+	if len(list) != 1 || list[0].Name != "Ana Costa" {
+		t.Errorf("list %+v", list)
+	}
+
+	s.expect(http.StatusOK, "DELETE", fmt.Sprint("/api/v1/residents/", created.ID), nil, nil)
+	var e apiError
+	s.expect(http.StatusNotFound, "GET", fmt.Sprint("/api/v1/residents/", created.ID), nil, &e)
+	if e.Code != "resident_not_found" {
+		t.Errorf("code %q after delete", e.Code)
+	}
+}
+
+func TestPaymentCRUD(t *testing.T) {
+	s := newTestServer(t, Options{})
+	resident := s.createResident("Ana Silva", "1A")
+
+	var created Payment
+	s.expect(http.StatusCreated, "POST", "/api/v1/payments", map[string]interface{}{
+		"resident_id": resident.ID, "amount": 50, "description": "March dues", "payment_date": "2024-03-05",
+	}, &created)
+	if created.ID == 0 || created.Amount != 50 || created.ResidentID != resident.ID {
+		t.Fatalf("created %+v", created)
+	}
+
+	var updated Payment
+	s.expect(http.StatusOK, "PUT", fmt.Sprint("/api/v1/payments/", created.ID), map[string]interface{}{
+		"resident_id": resident.ID, "amount": 75, "description": "March dues", "payment_date": "2024-03-05",
+	}, &updated)
+	if updated.Amount != 75 {
+		t.Errorf("updated amount %v", updated.Amount)
+	}
+
+	var list []Payment
+	s.expect(http.StatusOK, "GET", "/api/v1/payments", nil, &list)
+	if len(list) != 1 || list[0].Amount != 75 || list[0].ResidentName != "Ana Silva" {
+		t.Errorf("list %+v", list)
+	}
+
+	s.expect(http.StatusOK, "DELETE", fmt.Sprint("/api/v1/payments/", created.ID), nil, nil)
+	s.expect(http.StatusNotFound, "GET", fmt.Sprint("/api/v1/payments/", created.ID), nil, nil)
+}
+
+func TestPaymentWritesAreAtomic(t *testing.T) {
+	s := newTestServer(t, Options{})
+	resident := s.createResident("Ana Silva", "1A")
+	_, err := s.db.Exec("INSERT INTO charges(resident_id, kind, period, description, amount, due_date) VALUES(?, 'dues', '2024-03', 'March dues', 50, '2024-03-01')", resident.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	failAllocations := func(on bool) {
+		t.Helper()
+		query := "DROP TRIGGER fail_allocations"
+		if on {
+			query = "CREATE TRIGGER fail_allocations BEFORE INSERT ON payment_allocations BEGIN SELECT RAISE(ABORT, 'allocation failed'); END"
+		}
+		if _, err := s.db.Exec(query); err != nil {
+			t.Fatal(err)
+		}
+	}
+	payment := map[string]interface{}{"resident_id": resident.ID, "amount": 50, "description": "March dues", "payment_date": "2024-03-05"}
+
+	failAllocations(true)
+	s.expect(http.StatusInternalServerError, "POST", "/api/v1/payments", payment, nil)
+	var count int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM payments").Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Errorf("%d payments left after the allocation failed", count)
+	}
+
+	failAllocations(false)
+	var created Payment
+	s.expect(http.StatusCreated, "POST", "/api/v1/payments", payment, &created)
+	failAllocations(true)
+	payment["amount"] = 80
+	s.expect(http.StatusInternalServerError, "PUT", fmt.Sprint("/api/v1/payments/", created.ID), payment, nil)
+	var got Payment
+	s.expect(http.StatusOK, "GET", fmt.Sprint("/api/v1/payments/", created.ID), nil, &got)
+	if got.Amount != 50 || len(got.Allocations) != 1 {
+		t.Errorf("payment after the failed update %+v", got)
+	}
+}
+
+func TestExpenseCRUD(t *testing.T) {
+	s := newTestServer(t, Options{})
+
+	var created Expense
+	s.expect(http.StatusCreated, "POST", "/api/v1/expenses", map[string]interface{}{
+		"amount": 120.5, "description": "Elevator repair", "expense_date": "2024-03-10", "category": "Maintenance",
+	}, &created)
+	if created.ID == 0 || created.Amount != 120.5 {
+		t.Fatalf("created %+v", created)
+	}
+
+	var updated Expense
+	s.expect(http.StatusOK, "PUT", fmt.Sprint("/api/v1/expenses/", created.ID), map[string]interface{}{
+		"amount": 130, "description": "Elevator repair", "expense_date": "2024-03-10", "category": "Maintenance",
+	}, &updated)
+	if updated.Amount != 130 {
+		t.Errorf("updated amount %v", updated.Amount)
+	}
+
+	var list []Expense
+	s.expect(http.StatusOK, "GET", "/api/v1/expenses", nil, &list)
+	if len(list) != 1 || list[0].Category != "Maintenance" {
+		t.Errorf("list %+v", list)
+	}
+
+	s.expect(http.StatusOK, "DELETE", fmt.Sprint("/api/v1/expenses/", created.ID), nil, nil)
+	s.expect(http.StatusNotFound, "GET", fmt.Sprint("/api/v1/expenses/", created.ID), nil, nil)
+}
+
+func TestErrorResponses(t *testing.T) {
+	s := newTestServer(t, Options{})
+
+	var e apiError
+	s.expect(http.StatusBadRequest, "POST", "/api/v1/residents", `{"name": `, &e)
+	if e.Error == "" {
+		t.Error("malformed JSON: no error message")
+	}
+
+	e = apiError{}
+	s.expect(http.StatusUnprocessableEntity, "POST", "/api/v1/payments", map[string]interface{}{"amount": -1}, &e)
+	if e.Code != "validation_failed" || len(e.Details) < 2 {
+		t.Errorf("invalid payment: %+v", e)
+	}
+
+	e = apiError{}
+	s.expect(http.StatusNotFound, "GET", "/api/v1/no-such-thing", nil, &e)
+	if e.Code == "" {
+		t.Error("unknown path: no JSON error")
+	}
+
+	resp := s.expect(http.StatusMethodNotAllowed, "PATCH", "/api/v1/residents", nil, nil)
+	if allow := resp.Header.Get("Allow"); !strings.Contains(allow, "GET") || !strings.Contains(allow, "POST") {
+		t.Errorf("Allow %q", allow)
+	}
+}
+
+// updateBodies are valid bodies for the update of each documented PUT route
+// on a row by id, so that the only thing wrong with it is a missing row
+var updateBodies = map[string]interface{}{
+	"/residents/{id}":               map[string]interface{}{"name": "Ana Silva", "unit": "1A"},
+	"/residents/{id}/notifications": map[string]interface{}{},
+	"/payments/{id}":                map[string]interface{}{"resident_id": 1, "amount": 50, "description": "Dues", "payment_date": "2024-03-05"},
+	"/payments/{id}/allocations":    map[string]interface{}{"allocations": []interface{}{}},
+	"/expenses/{id}":                map[string]interface{}{"amount": 10, "description": "Bulbs", "expense_date": "2024-03-05", "category": "Maintenance"},
+	"/users/{id}":                   map[string]interface{}{"role": RoleViewer},
+	"/saved-searches/{id}":          map[string]interface{}{"name": "Recent", "entity": "payments", "params": map[string]string{}},
+	"/report-schedules/{id}":        map[string]interface{}{"name": "Monthly", "report": "payments", "format": "csv", "day_of_month": 1, "recipients": []string{"board@example.com"}},
+	"/fee-schedules/{id}":           map[string]interface{}{"unit": "1A", "amount": 50, "effective_from": "2024-01"},
+	"/payment-plans/{id}":           map[string]interface{}{"resident_id": 1, "total_amount": 300, "installments": 3, "start_month": "2024-04"},
+	"/assessments/{id}":             map[string]interface{}{"name": "Roof", "total_amount": 1000, "allocation": "equal", "due_date": "2024-06-01"},
+	"/announcements/{id}":           map[string]interface{}{"title": "Water cut"},
+	"/documents/{id}":               map[string]interface{}{"kind": "insurance", "name": "Building policy", "expires_on": "2025-01-01"},
+	"/incidents/{id}":               map[string]interface{}{"incident_date": "2024-03-05", "location": "Lobby", "description": "Broken door", "severity": "low"},
+	"/maintenance-requests/{id}":    map[string]interface{}{"subject": "Leaking tap"},
+	"/tasks/{id}":                   map[string]interface{}{"title": "Paint the hall"},
+	"/custom-fields/{id}":           map[string]interface{}{"entity": "resident", "key": "parking", "label": "Parking spot", "type": "text"},
+}
+
+// TestUpdateAndDeleteMissingRows sends every documented update and delete of
+// a row by id a valid request for an id that doesn't exist
+func TestUpdateAndDeleteMissingRows(t *testing.T) {
+	s := newTestServer(t, Options{})
+	s.token = s.signIn("admin", RoleAdmin)
+	s.createResident("Ana Silva", "1A")
+
+	for _, op := range apiOperations {
+		// Condo grants are only served with Condos, see TestCondoGrants
+		if (op.Method != "PUT" && op.Method != "DELETE") || !strings.Contains(op.Path, "{id}") || op.Tag == "Condos" {
+			continue
+		}
+		var body interface{}
+		if op.Method == "PUT" {
+			var ok bool
+			if body, ok = updateBodies[op.Path]; !ok {
+				t.Errorf("PUT %s: no valid body to update a missing row with", op.Path)
+				continue
+			}
+		}
+		var e apiError
+		resp := s.do(op.Method, "/api/v1"+strings.Replace(op.Path, "{id}", "999999", 1), body, &e)
+		if resp.StatusCode != http.StatusNotFound || !strings.HasSuffix(e.Code, "_not_found") {
+			t.Errorf("%s %s: %d %+v, want 404", op.Method, op.Path, resp.StatusCode, e)
+		}
+	}
+}
+
+func TestBasePath(t *testing.T) {
+	s := newTestServer(t, Options{BasePath: "/condo"})
+	s.Client().CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+
+	s.expect(http.StatusOK, "GET", "/condo/api/v1/residents", nil, nil)
+	s.expect(http.StatusNotFound, "GET", "/api/v1/residents", nil, nil)
+	s.expect(http.StatusNotFound, "GET", "/condominium/api/v1/residents", nil, nil)
+
+	resp := s.expect(http.StatusMovedPermanently, "GET", "/condo", nil, nil)
+	if location := resp.Header.Get("Location"); location != "/condo/" {
+		t.Errorf("redirected to %q", location)
+	}
+	resp = s.expect(http.StatusOK, "GET", "/condo/", nil, nil)
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+		t.Errorf("index served as %q", ct)
+	}
+	s.expect(http.StatusOK, "GET", "/condo/static/favicon.svg", nil, nil)
+}
+
+func TestNewServerInvalidOptions(t *testing.T) {
+	db, err := OpenDB(filepath.Join(t.TempDir(), "condo.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, opts := range []Options{
+		{BasePath: "condo"},
+		{FiscalYearStart: 13},
+		{PaymentAllocation: "lifo"},
+		{CSVLocale: "fr"},
+	} {
+		if server, err := NewServer(db, opts); err == nil {
+			server.Close()
+			t.Errorf("NewServer accepted %+v", opts)
+		}
+	}
+}
+
+// volatileFields are response fields that differ between two identical
+// requests, such as when they were handled or how long they took
+var volatileFields = map[string]bool{
+	"checked_at": true, "created_at": true, "updated_at": true, "deleted_at": true, "timestamp": true,
+	"duration_ms": true, "size_before": true, "size_after": true,
+}
+
+// comparableBody is body with its volatile fields blanked when it is JSON
+func comparableBody(body []byte) string {
+	var value interface{}
+	if json.Unmarshal(body, &value) != nil {
+		return string(body)
+	}
+	var blank func(v interface{})
+	blank = func(v interface{}) {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			for key, field := range v {
+				if volatileFields[key] {
+					v[key] = nil
+					continue
+				}
+				blank(field)
+			}
+		case []interface{}:
+			for _, item := range v {
+				blank(item)
+			}
+		}
+	}
+	blank(value)
+	data, _ := json.Marshal(value)
+	return string(data)
+}
+
+// TestAPIPrefixes sends every documented operation to one server under
+// /api/v1 and to an identical one under the deprecated /api, in the same
+// order, so both see the same state, and compares the responses. Bodies
+// that aren't JSON are sent as malformed JSON, which most handlers reject
+// before changing anything.
+func TestAPIPrefixes(t *testing.T) {
+	servers := map[string]*testServer{"/api/v1": newTestServer(t, Options{}), "/api": newTestServer(t, Options{})}
+	for _, s := range servers {
+		s.token = s.signIn("admin", RoleAdmin)
+		s.createResident("Ana Silva", "1A")
+		// Otherwise whether a later update lands in the same second decides
+		// if the activity feed calls the resident created or updated
+		if _, err := s.db.Exec("UPDATE residents SET created_at = '2024-01-01 00:00:00', updated_at = '2024-01-01 00:00:00'"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	params := strings.NewReplacer("{id}", "1", "{name}", "receipt", "{year}", "2024", "{category}", "Maintenance", "{unit}", "1A", "{item}", "insurance")
+
+	type response struct {
+		status                   int
+		contentType, deprecation string
+		body                     []byte
+	}
+	send := func(prefix, method, path string) response {
+		s := servers[prefix]
+		var body io.Reader
+		if method != "GET" && method != "DELETE" {
+			body = strings.NewReader("{")
+		}
+		req, err := http.NewRequest(method, s.URL+prefix+path, body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+s.token)
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := s.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		data, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return response{resp.StatusCode, resp.Header.Get("Content-Type"), resp.Header.Get("Deprecation"), data}
+	}
+
+	for _, op := range apiOperations {
+		if op.ContentType == "text/event-stream" {
+			continue // the stream never ends
+		}
+		path := params.Replace(op.Path)
+		current, legacy := send("/api/v1", op.Method, path), send("/api", op.Method, path)
+		name := op.Method + " " + op.Path
+		if current.deprecation != "" || legacy.deprecation != "true" {
+			t.Errorf("%s: Deprecation %q under /api/v1 and %q under /api", name, current.deprecation, legacy.deprecation)
+		}
+		if current.status != legacy.status || current.contentType != legacy.contentType {
+			t.Errorf("%s: %d %s under /api/v1, %d %s under /api", name, current.status, current.contentType, legacy.status, legacy.contentType)
+			continue
+		}
+		// Database copies hold their own random secrets and timestamps
+		if op.ContentType == "application/vnd.sqlite3" || op.ContentType == "application/octet-stream" {
+			continue
+		}
+		if a, b := comparableBody(current.body), comparableBody(legacy.body); a != b {
+			t.Errorf("%s: responses differ:\n/api/v1: %.300s\n/api:    %.300s", name, a, b)
+		}
+	}
+}
@@ -0,0 +1,262 @@
+package condomngr
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const sessionColumns = `s.id, s.ip, s.user_agent, s.created_at, s.last_seen_at, s.expires_at,
+	u.id, u.username, u.email, u.role, u.disabled, u.must_change_password, u.totp_enabled, u.created_at, u.updated_at`
+
+const sessionsJoin = "FROM sessions s JOIN users u ON u.id = s.user_id"
+
+func scanSession(row interface{ Scan(...interface{}) error }) (Session, error) {
+	var s Session
+	err := row.Scan(&s.ID, &s.IP, &s.UserAgent, &s.CreatedAt, &s.LastSeenAt, &s.ExpiresAt,
+		&s.User.ID, &s.User.Username, &s.User.Email, &s.User.Role, &s.User.Disabled, &s.User.MustChangePassword, &s.User.TwoFactorEnabled, &s.User.CreatedAt, &s.User.UpdatedAt)
+	return s, err
+}
+
+// listSessions returns the unexpired sessions of userID, or of every user
+// when it is 0, most recently seen first. current is the session of the
+// request.
+func listSessions(db *sql.DB, userID int, current Session) ([]Session, error) {
+	query := "SELECT " + sessionColumns + " " + sessionsJoin + " WHERE s.expires_at > ?"
+	args := []interface{}{time.Now().UTC()}
+	if userID != 0 {
+		query += " AND s.user_id = ?"
+		args = append(args, userID)
+	}
+	rows, err := db.Query(query+" ORDER BY s.last_seen_at DESC, s.id DESC", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []Session{}
+	for rows.Next() {
+		s, err := scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		s.Current = s.ID == current.ID
+		sessions = append(sessions, s)
+	}
+	return sessions, rows.Err()
+}
+
+// revokeSession signs out session id, of userID unless it is 0, reporting
+// whether there was one
+func revokeSession(db *sql.DB, id, userID int) (bool, error) {
+	query, args := "DELETE FROM sessions WHERE id = ?", []interface{}{id}
+	if userID != 0 {
+		query += " AND user_id = ?"
+		args = append(args, userID)
+	}
+	result, err := db.Exec(query, args...)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// revokeOtherSessions signs out every session of userID but the one of
+// keepToken, which may be empty
+func revokeOtherSessions(db *sql.DB, userID int, keepToken string) error {
+	_, err := db.Exec("DELETE FROM sessions WHERE user_id = ? AND token_hash != ?", userID, hashToken(keepToken))
+	return err
+}
+
+// condoSessionKey is the context key of the session a request for another
+// condo was signed in with. Users and sessions live in the default condo's
+// database, where Condos.Handler finds it, so the other condo's server
+// doesn't look for it in its own.
+type condoSessionKey struct{}
+
+// condoSession returns the session Condos.Handler found for r, if any
+func condoSession(r *http.Request) (Session, bool) {
+	session, ok := r.Context().Value(condoSessionKey{}).(Session)
+	return session, ok
+}
+
+// requireSession returns the session of the bearer token of r, responding
+// with 401 when there is none, and with 403 when two-factor authentication is
+// required and its user hasn't turned it on
+func requireSession(db *sql.DB, w http.ResponseWriter, r *http.Request) (Session, bool) {
+	if session, ok := condoSession(r); ok {
+		return session, true
+	}
+	session, ok := requireSessionToEnroll(db, w, r)
+	if !ok || session.User.TwoFactorEnabled {
+		return session, ok
+	}
+	required, err := twoFactorRequired(db)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return Session{}, false
+	}
+	if required {
+		respondWithError(w, http.StatusForbidden, "Two-factor authentication is required, turn it on first")
+		return Session{}, false
+	}
+	return session, true
+}
+
+// requireSessionToEnroll is requireSession that also lets through users who
+// still have to turn on two-factor authentication, so they can
+func requireSessionToEnroll(db *sql.DB, w http.ResponseWriter, r *http.Request) (Session, bool) {
+	if session, ok := condoSession(r); ok {
+		return session, true
+	}
+	session, err := findSession(db, bearerToken(r))
+	if err == sql.ErrNoRows {
+		respondWithError(w, http.StatusUnauthorized, "Not signed in")
+		return Session{}, false
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return Session{}, false
+	}
+	return session, true
+}
+
+// requireAdmin is requireSession for admins only, responding with 403 to
+// other users
+func requireAdmin(db *sql.DB, w http.ResponseWriter, r *http.Request) (Session, bool) {
+	session, ok := requireSession(db, w, r)
+	if ok && session.User.Role != RoleAdmin {
+		respondWithError(w, http.StatusForbidden, "Only admins can do this")
+		return Session{}, false
+	}
+	return session, ok
+}
+
+// adminOnly lets only the requests of admins through, responding as
+// requireAdmin to the rest
+func adminOnly(db *sql.DB) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if _, ok := requireAdmin(db, w, r); ok {
+				next.ServeHTTP(w, r)
+			}
+		})
+	}
+}
+
+// passwordChangeFirst refuses the requests of users who must change their
+// password with 403, whether the endpoint needs a session or not, until they
+// do. They can still change it, look up their session and sign out.
+func passwordChangeFirst(db *sql.DB) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if token := bearerToken(r); token != "" && !allowedBeforePasswordChange(r) {
+				session, err := findSession(db, token)
+				if err == nil && session.User.MustChangePassword {
+					respondWithError(w, http.StatusForbidden, "Change your password first")
+					return
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// allowedBeforePasswordChange reports whether r is to an endpoint users who
+// must change their password can use
+func allowedBeforePasswordChange(r *http.Request) bool {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return false
+	}
+	path, err := route.GetPathTemplate()
+	if err != nil {
+		return false
+	}
+	for _, allowed := range []string{"/auth/password", "/auth/session", "/auth/logout"} {
+		if strings.HasSuffix(path, allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// Handlers for session endpoints
+
+// List the sessions of the signed-in user
+func getSessions(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session, ok := requireSession(db, w, r)
+		if !ok {
+			return
+		}
+		sessions, err := listSessions(db, session.User.ID, session)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		respondWithJSON(w, http.StatusOK, sessions)
+	}
+}
+
+// Sign out one of the sessions of the signed-in user, e.g. on another device
+func deleteSession(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session, ok := requireSession(db, w, r)
+		if !ok {
+			return
+		}
+		revokeSessionByID(db, w, r, session.User.ID)
+	}
+}
+
+// List the sessions of every user
+func getAllSessions(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session, ok := requireAdmin(db, w, r)
+		if !ok {
+			return
+		}
+		sessions, err := listSessions(db, 0, session)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		respondWithJSON(w, http.StatusOK, sessions)
+	}
+}
+
+// Sign out the session of any user
+func deleteAnySession(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := requireAdmin(db, w, r); !ok {
+			return
+		}
+		revokeSessionByID(db, w, r, 0)
+	}
+}
+
+// revokeSessionByID revokes the session in the path, of userID unless it
+// is 0
+func revokeSessionByID(db *sql.DB, w http.ResponseWriter, r *http.Request, userID int) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid session ID")
+		return
+	}
+	revoked, err := revokeSession(db, id, userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !revoked {
+		respondWithError(w, http.StatusNotFound, "Session not found")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
+}
@@ -0,0 +1,57 @@
+package condomngr
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestAdminEndpointsRequireAdmin(t *testing.T) {
+	s := newTestServer(t, Options{})
+	endpoints := []struct{ method, path string }{
+		{"POST", "/api/v1/admin/readonly"},
+		{"POST", "/api/v1/admin/maintenance"},
+		{"GET", "/api/v1/admin/dbstats"},
+		{"GET", "/api/v1/admin/consistency"},
+		{"POST", "/api/v1/admin/consistency/fix"},
+		{"POST", "/api/v1/admin/recompute"},
+		{"GET", "/api/v1/admin/backups"},
+		{"POST", "/api/v1/admin/backups"},
+		{"POST", "/api/v1/admin/diff"},
+		{"POST", "/api/v1/admin/anonymize"},
+		{"GET", "/api/v1/admin/sessions"},
+		{"DELETE", "/api/v1/admin/sessions/1"},
+		{"GET", "/api/v1/admin/2fa"},
+		{"PUT", "/api/v1/admin/2fa"},
+		{"GET", "/api/v1/admin/audit"},
+	}
+	viewer := s.signIn("victor", RoleViewer)
+	for _, e := range endpoints {
+		s.token = ""
+		s.expect(http.StatusUnauthorized, e.method, e.path, "{}", nil)
+		s.token = viewer
+		s.expect(http.StatusForbidden, e.method, e.path, "{}", nil)
+	}
+
+	s.token = s.signIn("alice", RoleAdmin)
+	s.expect(http.StatusOK, "GET", "/api/v1/admin/dbstats", nil, nil)
+	s.expect(http.StatusOK, "GET", "/api/v1/admin/consistency", nil, nil)
+	s.expect(http.StatusMethodNotAllowed, "PUT", "/api/v1/admin/dbstats", nil, nil)
+}
+
+func TestLoginFailuresRequireAdmin(t *testing.T) {
+	s := newTestServer(t, Options{})
+	s.expect(http.StatusUnauthorized, "POST", "/api/v1/auth/login", LoginRequest{Username: "mallory", Password: "guess"}, nil)
+
+	s.expect(http.StatusUnauthorized, "GET", "/api/v1/auth/failures", nil, nil)
+	s.expect(http.StatusUnauthorized, "DELETE", "/api/v1/auth/failures?username=mallory", nil, nil)
+	s.token = s.signIn("victor", RoleViewer)
+	s.expect(http.StatusForbidden, "DELETE", "/api/v1/auth/failures?username=mallory", nil, nil)
+
+	s.token = s.signIn("alice", RoleAdmin)
+	var failures []LoginFailures
+	s.expect(http.StatusOK, "GET", "/api/v1/auth/failures", nil, &failures)
+	if len(failures) == 0 {
+		t.Fatal("failed sign-in not listed")
+	}
+	s.expect(http.StatusOK, "DELETE", "/api/v1/auth/failures?username=mallory", nil, nil)
+}
@@ -0,0 +1,48 @@
+package condomngr
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+)
+
+// getSetting reads a value from the settings table. The second result is false
+// when the key is not set.
+func getSetting(db *sql.DB, key string) (string, bool, error) {
+	var value string
+	err := db.QueryRow("SELECT value FROM settings WHERE key = ?", key).Scan(&value)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return value, true, nil
+}
+
+// setSetting stores a value in the settings table
+func setSetting(db *sql.DB, key, value string) error {
+	_, err := db.Exec("INSERT INTO settings(key, value) VALUES(?, ?) ON CONFLICT(key) DO UPDATE SET value = excluded.value", key, value)
+	return err
+}
+
+// loadOrCreateSecret returns the secret stored under key, generating and
+// storing a random one on first use so signed links survive restarts
+func loadOrCreateSecret(db *sql.DB, key string) ([]byte, error) {
+	value, ok, err := getSetting(db, key)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		return hex.DecodeString(value)
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	if err := setSetting(db, key, hex.EncodeToString(secret)); err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
@@ -0,0 +1,526 @@
+package condomngr
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	sheetsScope       = "https://www.googleapis.com/auth/spreadsheets"
+	sheetsAPI         = "https://sheets.googleapis.com/v4/spreadsheets/"
+	sheetsPaymentsTab = "Payments"
+	sheetsExpensesTab = "Expenses"
+)
+
+// Sheets sync modes
+const (
+	SheetsModeAppend  = "append"
+	SheetsModeRefresh = "refresh"
+)
+
+// serviceAccount holds the fields of a Google service-account key file we need
+type serviceAccount struct {
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	TokenURI    string `json:"token_uri"`
+}
+
+// SheetsStatus describes the outcome of the last sync
+type SheetsStatus struct {
+	Configured      bool       `json:"configured"`
+	Mode            string     `json:"mode"`
+	Running         bool       `json:"running"`
+	LastRun         *time.Time `json:"last_run"`
+	LastSuccess     *time.Time `json:"last_success"`
+	LastError       string     `json:"last_error"`
+	PaymentsWritten int        `json:"payments_written"`
+	ExpensesWritten int        `json:"expenses_written"`
+}
+
+// SheetsSync pushes payments and expenses to two tabs of a Google spreadsheet.
+// The first column of each tab holds the entity id and is hidden; in append
+// mode rows whose id is already present are skipped, so an interrupted sync can
+// simply be run again.
+type SheetsSync struct {
+	db            *sql.DB
+	account       *serviceAccount
+	key           *rsa.PrivateKey
+	spreadsheetID string
+	mode          string
+	client        *http.Client
+
+	mu     sync.Mutex
+	status SheetsStatus
+
+	tokenMu     sync.Mutex
+	token       string
+	tokenExpiry time.Time
+}
+
+// NewSheetsSync loads the service-account key file. It returns a disabled
+// sync when no credentials are configured.
+func NewSheetsSync(db *sql.DB, credentialsFile, spreadsheetID, mode string) (*SheetsSync, error) {
+	s := &SheetsSync{
+		db:            db,
+		spreadsheetID: spreadsheetID,
+		mode:          mode,
+		client:        &http.Client{Timeout: 30 * time.Second},
+	}
+	s.status.Mode = mode
+	if credentialsFile == "" || spreadsheetID == "" {
+		return s, nil
+	}
+	if mode != SheetsModeAppend && mode != SheetsModeRefresh {
+		return nil, fmt.Errorf("sheets mode must be %s or %s", SheetsModeAppend, SheetsModeRefresh)
+	}
+
+	data, err := os.ReadFile(credentialsFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read service account file: %v", err)
+	}
+	var account serviceAccount
+	if err := json.Unmarshal(data, &account); err != nil {
+		return nil, fmt.Errorf("invalid service account file: %v", err)
+	}
+	if account.TokenURI == "" {
+		account.TokenURI = "https://oauth2.googleapis.com/token"
+	}
+
+	block, _ := pem.Decode([]byte(account.PrivateKey))
+	if block == nil {
+		return nil, fmt.Errorf("invalid service account private key")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid service account private key: %v", err)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("service account private key is not an RSA key")
+	}
+
+	s.account = &account
+	s.key = key
+	s.status.Configured = true
+	return s, nil
+}
+
+// Configured reports whether credentials and a spreadsheet are set up
+func (s *SheetsSync) Configured() bool {
+	return s.account != nil
+}
+
+// Status returns a copy of the current sync status
+func (s *SheetsSync) Status() SheetsStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.status
+}
+
+// Schedule runs a sync at the given interval in a background goroutine
+func (s *SheetsSync) Schedule(interval time.Duration) {
+	if !s.Configured() || interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if _, err := s.Run(); err != nil {
+				log.Printf("Scheduled Google Sheets sync failed: %v", err)
+			}
+		}
+	}()
+}
+
+// errSyncRunning is returned when a sync is requested while one is in progress
+var errSyncRunning = fmt.Errorf("a sync is already running")
+
+// Run performs a sync and records its outcome in the status
+func (s *SheetsSync) Run() (SheetsStatus, error) {
+	s.mu.Lock()
+	if s.status.Running {
+		s.mu.Unlock()
+		return SheetsStatus{}, errSyncRunning
+	}
+	s.status.Running = true
+	s.mu.Unlock()
+
+	payments, expenses, err := s.sync()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	s.status.Running = false
+	s.status.LastRun = &now
+	s.status.PaymentsWritten = payments
+	s.status.ExpensesWritten = expenses
+	if err != nil {
+		s.status.LastError = err.Error()
+	} else {
+		s.status.LastError = ""
+		s.status.LastSuccess = &now
+	}
+	return s.status, err
+}
+
+func (s *SheetsSync) sync() (int, int, error) {
+	if err := s.ensureTabs(); err != nil {
+		return 0, 0, err
+	}
+
+	payments, err := s.paymentRows()
+	if err != nil {
+		return 0, 0, err
+	}
+	paymentsWritten, err := s.write(sheetsPaymentsTab,
+		[]interface{}{"ID", "Date", "Resident", "Unit", "Amount", "Description"}, payments)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	expenses, err := s.expenseRows()
+	if err != nil {
+		return paymentsWritten, 0, err
+	}
+	expensesWritten, err := s.write(sheetsExpensesTab,
+		[]interface{}{"ID", "Date", "Category", "Amount", "Description"}, expenses)
+	if err != nil {
+		return paymentsWritten, 0, err
+	}
+
+	return paymentsWritten, expensesWritten, nil
+}
+
+func (s *SheetsSync) paymentRows() ([][]interface{}, error) {
+	rows, err := s.db.Query(`
+		SELECT p.id, p.payment_date, r.name, r.unit, p.amount, p.description
+		FROM payments p
+		JOIN residents r ON p.resident_id = r.id
+		ORDER BY p.id
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	values := [][]interface{}{}
+	for rows.Next() {
+		var id int
+		var date time.Time
+		var name, unit, description string
+		var amount float64
+		if err := rows.Scan(&id, &date, &name, &unit, &amount, &description); err != nil {
+			return nil, err
+		}
+		values = append(values, []interface{}{fmt.Sprint(id), date.Format("2006-01-02"), name, unit, amount, description})
+	}
+	return values, rows.Err()
+}
+
+func (s *SheetsSync) expenseRows() ([][]interface{}, error) {
+	rows, err := s.db.Query("SELECT id, expense_date, category, amount, description FROM expenses ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	values := [][]interface{}{}
+	for rows.Next() {
+		var id int
+		var date time.Time
+		var category, description string
+		var amount float64
+		if err := rows.Scan(&id, &date, &category, &amount, &description); err != nil {
+			return nil, err
+		}
+		values = append(values, []interface{}{fmt.Sprint(id), date.Format("2006-01-02"), category, amount, description})
+	}
+	return values, rows.Err()
+}
+
+// write pushes rows to a tab and returns how many rows were written
+func (s *SheetsSync) write(tab string, header []interface{}, rows [][]interface{}) (int, error) {
+	if s.mode == SheetsModeRefresh {
+		if err := s.call("POST", url.PathEscape(tab+"!A:Z")+":clear", nil, nil); err != nil {
+			return 0, err
+		}
+		body := map[string]interface{}{"values": append([][]interface{}{header}, rows...)}
+		if err := s.call("PUT", url.PathEscape(tab+"!A1")+"?valueInputOption=RAW", body, nil); err != nil {
+			return 0, err
+		}
+		return len(rows), nil
+	}
+
+	// Append mode: skip rows whose id is already in the hidden id column
+	var existing struct {
+		Values [][]string `json:"values"`
+	}
+	if err := s.call("GET", url.PathEscape(tab+"!A:A"), nil, &existing); err != nil {
+		return 0, err
+	}
+	seen := make(map[string]bool)
+	for _, row := range existing.Values {
+		if len(row) > 0 {
+			seen[row[0]] = true
+		}
+	}
+
+	missing := [][]interface{}{}
+	if len(existing.Values) == 0 {
+		missing = append(missing, header)
+	}
+	written := 0
+	for _, row := range rows {
+		if !seen[row[0].(string)] {
+			missing = append(missing, row)
+			written++
+		}
+	}
+	if len(missing) == 0 {
+		return 0, nil
+	}
+
+	body := map[string]interface{}{"values": missing}
+	path := url.PathEscape(tab+"!A1") + ":append?valueInputOption=RAW&insertDataOption=INSERT_ROWS"
+	if err := s.call("POST", path, body, nil); err != nil {
+		return 0, err
+	}
+	return written, nil
+}
+
+// ensureTabs creates the payments and expenses tabs if needed and hides their
+// id column
+func (s *SheetsSync) ensureTabs() error {
+	var meta struct {
+		Sheets []struct {
+			Properties struct {
+				SheetID int    `json:"sheetId"`
+				Title   string `json:"title"`
+			} `json:"properties"`
+		} `json:"sheets"`
+	}
+	if err := s.call("GET", "?fields=sheets.properties", nil, &meta); err != nil {
+		return err
+	}
+
+	ids := make(map[string]int)
+	for _, sheet := range meta.Sheets {
+		ids[sheet.Properties.Title] = sheet.Properties.SheetID
+	}
+
+	requests := []interface{}{}
+	for _, tab := range []string{sheetsPaymentsTab, sheetsExpensesTab} {
+		if _, ok := ids[tab]; ok {
+			continue
+		}
+		requests = append(requests, map[string]interface{}{
+			"addSheet": map[string]interface{}{"properties": map[string]interface{}{"title": tab}},
+		})
+	}
+	if len(requests) > 0 {
+		var result struct {
+			Replies []struct {
+				AddSheet struct {
+					Properties struct {
+						SheetID int    `json:"sheetId"`
+						Title   string `json:"title"`
+					} `json:"properties"`
+				} `json:"addSheet"`
+			} `json:"replies"`
+		}
+		if err := s.call("POST", ":batchUpdate", map[string]interface{}{"requests": requests}, &result); err != nil {
+			return err
+		}
+		for _, reply := range result.Replies {
+			ids[reply.AddSheet.Properties.Title] = reply.AddSheet.Properties.SheetID
+		}
+	}
+
+	hide := []interface{}{}
+	for _, tab := range []string{sheetsPaymentsTab, sheetsExpensesTab} {
+		hide = append(hide, map[string]interface{}{
+			"updateDimensionProperties": map[string]interface{}{
+				"range": map[string]interface{}{
+					"sheetId":    ids[tab],
+					"dimension":  "COLUMNS",
+					"startIndex": 0,
+					"endIndex":   1,
+				},
+				"properties": map[string]interface{}{"hiddenByUser": true},
+				"fields":     "hiddenByUser",
+			},
+		})
+	}
+	if err := s.call("POST", ":batchUpdate", map[string]interface{}{"requests": hide}, nil); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// call sends a request to the Sheets API for the configured spreadsheet and
+// decodes the response into out when it is not nil
+func (s *SheetsSync) call(method, path string, body interface{}, out interface{}) error {
+	token, err := s.accessToken()
+	if err != nil {
+		return err
+	}
+
+	endpoint := sheetsAPI + url.PathEscape(s.spreadsheetID)
+	if strings.HasPrefix(path, ":") || strings.HasPrefix(path, "?") {
+		endpoint += path
+	} else {
+		endpoint += "/values/" + path
+	}
+
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, endpoint, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return sheetsAPIError(resp)
+	}
+	if out != nil {
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	return nil
+}
+
+// sheetsAPIError turns a Google API error response (quota, permissions, ...)
+// into a readable error
+func sheetsAPIError(resp *http.Response) error {
+	var apiErr struct {
+		Error struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+			Status  string `json:"status"`
+		} `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&apiErr); err != nil || apiErr.Error.Message == "" {
+		return fmt.Errorf("google API error: status %d", resp.StatusCode)
+	}
+	return fmt.Errorf("google API error: %s (%d %s)", apiErr.Error.Message, apiErr.Error.Code, apiErr.Error.Status)
+}
+
+// accessToken returns a cached OAuth token, exchanging a signed JWT assertion
+// for a new one when it is about to expire
+func (s *SheetsSync) accessToken() (string, error) {
+	s.tokenMu.Lock()
+	defer s.tokenMu.Unlock()
+	if s.token != "" && time.Now().Add(time.Minute).Before(s.tokenExpiry) {
+		return s.token, nil
+	}
+
+	now := time.Now()
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`))
+	claims, err := json.Marshal(map[string]interface{}{
+		"iss":   s.account.ClientEmail,
+		"scope": sheetsScope,
+		"aud":   s.account.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	unsigned := header + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	assertion := unsigned + "." + base64.RawURLEncoding.EncodeToString(signature)
+
+	resp, err := s.client.PostForm(s.account.TokenURI, url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {assertion},
+	})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		AccessToken      string `json:"access_token"`
+		ExpiresIn        int    `json:"expires_in"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("unexpected token response (status %d)", resp.StatusCode)
+	}
+	if result.AccessToken == "" {
+		return "", fmt.Errorf("google authentication failed: %s %s", result.Error, result.ErrorDescription)
+	}
+
+	s.token = result.AccessToken
+	s.tokenExpiry = now.Add(time.Duration(result.ExpiresIn) * time.Second)
+	return s.token, nil
+}
+
+// Sync payments and expenses to Google Sheets on demand
+func syncSheets(sheets *SheetsSync) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !sheets.Configured() {
+			respondWithError(w, http.StatusBadRequest, "Google Sheets integration is not configured")
+			return
+		}
+
+		status, err := sheets.Run()
+		if err == errSyncRunning {
+			respondWithError(w, http.StatusConflict, err.Error())
+			return
+		}
+		if err != nil {
+			respondWithError(w, http.StatusBadGateway, fmt.Sprintf("Google Sheets sync failed: %v", err))
+			return
+		}
+
+		respondWithJSON(w, http.StatusOK, status)
+	}
+}
+
+// Get the status of the last Google Sheets sync
+func getSheetsStatus(sheets *SheetsSync) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		respondWithJSON(w, http.StatusOK, sheets.Status())
+	}
+}
@@ -0,0 +1,238 @@
+package condomngr
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// SMSProvider sends text messages through an external gateway
+type SMSProvider interface {
+	Name() string
+	// Send delivers body to the given number and returns the provider's
+	// message id and delivery status
+	Send(ctx context.Context, to, body string) (id, status string, err error)
+}
+
+// TwilioProvider sends SMS through the Twilio REST API
+type TwilioProvider struct {
+	AccountSID string
+	AuthToken  string
+	From       string
+	Client     *http.Client
+}
+
+// NewTwilioProvider creates a provider for the given account credentials
+func NewTwilioProvider(accountSID, authToken, from string) *TwilioProvider {
+	return &TwilioProvider{
+		AccountSID: accountSID,
+		AuthToken:  authToken,
+		From:       from,
+		Client:     &http.Client{Timeout: 15 * time.Second},
+	}
+}
+
+// Name returns the provider name
+func (t *TwilioProvider) Name() string {
+	return "twilio"
+}
+
+// Send creates a message resource on Twilio
+func (t *TwilioProvider) Send(ctx context.Context, to, body string) (string, string, error) {
+	form := url.Values{}
+	form.Set("To", to)
+	form.Set("From", t.From)
+	form.Set("Body", body)
+
+	endpoint := fmt.Sprintf("https://api.twilio.com/2010-04-01/Accounts/%s/Messages.json", t.AccountSID)
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", "", err
+	}
+	req.SetBasicAuth(t.AccountSID, t.AuthToken)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := t.Client.Do(req)
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		SID          string `json:"sid"`
+		Status       string `json:"status"`
+		ErrorMessage string `json:"error_message"`
+		Message      string `json:"message"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", "", fmt.Errorf("unexpected response (status %d)", resp.StatusCode)
+	}
+	if resp.StatusCode >= 300 {
+		return "", "", fmt.Errorf("twilio API error: %s", result.Message)
+	}
+	if result.Status == "failed" || result.Status == "undelivered" {
+		return result.SID, result.Status, fmt.Errorf("twilio API error: %s", result.ErrorMessage)
+	}
+	return result.SID, result.Status, nil
+}
+
+// SMSMessage is a queued or sent text message
+type SMSMessage struct {
+	ID         int        `json:"id"`
+	ResidentID int        `json:"resident_id"`
+	Phone      string     `json:"phone"`
+	Body       string     `json:"body"`
+	Status     string     `json:"status"`
+	ProviderID string     `json:"provider_id"`
+	Error      string     `json:"error"`
+	CreatedAt  time.Time  `json:"created_at"`
+	SentAt     *time.Time `json:"sent_at"`
+}
+
+// SMSQueue stores outgoing messages in the sms_messages table and sends them
+// from a background worker, so callers never wait on the provider.
+type SMSQueue struct {
+	db            *sql.DB
+	provider      SMSProvider
+	MaxPerRun     int
+	CountryPrefix string
+	wake          chan struct{}
+}
+
+// NewSMSQueue creates a queue. A nil provider disables the SMS channel.
+func NewSMSQueue(db *sql.DB, provider SMSProvider, maxPerRun int, countryPrefix string) *SMSQueue {
+	return &SMSQueue{
+		db:            db,
+		provider:      provider,
+		MaxPerRun:     maxPerRun,
+		CountryPrefix: countryPrefix,
+		wake:          make(chan struct{}, 1),
+	}
+}
+
+// Enabled reports whether an SMS provider is configured
+func (q *SMSQueue) Enabled() bool {
+	return q.provider != nil
+}
+
+// Start sends queued messages in a background goroutine, including any left
+// over from a previous run
+func (q *SMSQueue) Start() {
+	if !q.Enabled() {
+		return
+	}
+	go func() {
+		for range q.wake {
+			q.drain()
+		}
+	}()
+	q.signal()
+}
+
+// Enqueue stores a message for delivery and returns its id
+func (q *SMSQueue) Enqueue(residentID int, phone, body string) (int64, error) {
+	if !q.Enabled() {
+		return 0, fmt.Errorf("SMS channel is not configured")
+	}
+	result, err := q.db.Exec("INSERT INTO sms_messages(resident_id, phone, body) VALUES(?, ?, ?)",
+		residentID, q.normalizePhone(phone), body)
+	if err != nil {
+		return 0, err
+	}
+	q.signal()
+	return result.LastInsertId()
+}
+
+func (q *SMSQueue) signal() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// normalizePhone strips formatting characters and adds the configured country
+// prefix to numbers without one
+func (q *SMSQueue) normalizePhone(phone string) string {
+	var b strings.Builder
+	for i, c := range strings.TrimSpace(phone) {
+		if (c >= '0' && c <= '9') || (c == '+' && i == 0) {
+			b.WriteRune(c)
+		}
+	}
+	n := b.String()
+	if !strings.HasPrefix(n, "+") && q.CountryPrefix != "" {
+		n = q.CountryPrefix + strings.TrimLeft(n, "0")
+	}
+	return n
+}
+
+func (q *SMSQueue) drain() {
+	for {
+		var id int64
+		var phone, body string
+		err := q.db.QueryRow("SELECT id, phone, body FROM sms_messages WHERE status = 'queued' ORDER BY id LIMIT 1").
+			Scan(&id, &phone, &body)
+		if err == sql.ErrNoRows {
+			return
+		}
+		if err != nil {
+			log.Printf("Error reading SMS queue: %v", err)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		providerID, status, err := q.provider.Send(ctx, phone, body)
+		cancel()
+
+		if err != nil {
+			log.Printf("Failed to send SMS %d: %v", id, err)
+			_, err = q.db.Exec("UPDATE sms_messages SET status = 'failed', provider_id = ?, error = ? WHERE id = ?",
+				providerID, err.Error(), id)
+		} else {
+			_, err = q.db.Exec("UPDATE sms_messages SET status = ?, provider_id = ?, sent_at = CURRENT_TIMESTAMP WHERE id = ?",
+				status, providerID, id)
+		}
+		if err != nil {
+			log.Printf("Error updating SMS %d: %v", id, err)
+			return
+		}
+	}
+}
+
+// Get the SMS log, newest first
+func getSMSMessages(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rows, err := db.Query(`
+			SELECT id, COALESCE(resident_id, 0), phone, body, status, provider_id, error, created_at, sent_at
+			FROM sms_messages
+			ORDER BY id DESC
+		`)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		defer rows.Close()
+
+		messages := []SMSMessage{}
+		for rows.Next() {
+			var m SMSMessage
+			var sentAt sql.NullTime
+			if err := rows.Scan(&m.ID, &m.ResidentID, &m.Phone, &m.Body, &m.Status, &m.ProviderID, &m.Error, &m.CreatedAt, &sentAt); err != nil {
+				respondWithError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			if sentAt.Valid {
+				m.SentAt = &sentAt.Time
+			}
+			messages = append(messages, m)
+		}
+
+		respondWithJSON(w, http.StatusOK, messages)
+	}
+}
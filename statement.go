@@ -0,0 +1,298 @@
+package condomngr
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+// StatementLine is a charge, a payment, a credit or a write-off on a
+// statement. Balance is the running balance after it.
+type StatementLine struct {
+	Date        string  `json:"date"`
+	Description string  `json:"description"`
+	Charge      float64 `json:"charge"`
+	Payment     float64 `json:"payment"`
+	Credit      float64 `json:"credit"`
+	WrittenOff  float64 `json:"written_off"`
+	Balance     float64 `json:"balance"`
+}
+
+// StatementMonth is one month of a statement. Balance is the balance at the
+// end of the month.
+type StatementMonth struct {
+	Month      string          `json:"month"` // YYYY-MM
+	Charged    float64         `json:"charged"`
+	Paid       float64         `json:"paid"`
+	Credited   float64         `json:"credited"`
+	WrittenOff float64         `json:"written_off"`
+	Balance    float64         `json:"balance"`
+	Lines      []StatementLine `json:"lines"`
+}
+
+// Statement is a resident's charges, confirmed payments, credits and
+// write-offs over a fiscal year, month by month. It counts what residentBalance counts, so the closing balance of
+// the current year is the resident's balance.
+type Statement struct {
+	Resident       Resident         `json:"resident"`
+	Year           int              `json:"year"`
+	StartDate      string           `json:"start_date"`
+	EndDate        string           `json:"end_date"`
+	OpeningBalance float64          `json:"opening_balance"`
+	Charged        float64          `json:"charged"`
+	Paid           float64          `json:"paid"`
+	Credited       float64          `json:"credited"`
+	WrittenOff     float64          `json:"written_off"`
+	ClosingBalance float64          `json:"closing_balance"`
+	Months         []StatementMonth `json:"months"`
+}
+
+// residentStatement builds the statement of a resident for a fiscal year. It
+// returns sql.ErrNoRows for an unknown resident.
+func residentStatement(db *sql.DB, residentID, year int, cal calendar) (Statement, error) {
+	s := Statement{Year: year}
+	s.StartDate, s.EndDate = cal.fiscalYearDates(year)
+	var err error
+	s.Resident, err = scanResidentRow(db.QueryRow("SELECT "+residentColumns+" FROM residents WHERE id = ?", residentID))
+	if err != nil {
+		return s, err
+	}
+
+	first, next := cal.fiscalYearRange(year)
+	start, end := first.Format("2006-01-02"), next.Format("2006-01-02")
+	opening, err := residentBalanceBefore(db, residentID, start)
+	if err != nil {
+		return s, err
+	}
+	s.OpeningBalance = opening.Balance
+
+	// Charges come before the payments, credits and write-offs of the same day. The dates
+	// are cut to YYYY-MM-DD as the driver would otherwise turn them into
+	// timestamps.
+	rows, err := db.Query(`
+		SELECT substr(due_date, 1, 10) AS date, 0 AS kind, description, amount FROM charges
+		WHERE resident_id = ?1 AND due_date >= ?2 AND due_date < ?3
+		UNION ALL
+		SELECT substr(payment_date, 1, 10), 1, CASE description WHEN '' THEN 'Payment' ELSE description END, amount FROM payments
+		WHERE resident_id = ?1 AND status = ?4 AND payment_date >= ?2 AND payment_date < ?3
+		UNION ALL
+		SELECT credit_date, 2, reason, amount FROM credits
+		WHERE resident_id = ?1 AND credit_date >= ?2 AND credit_date < ?3
+		UNION ALL
+		SELECT writeoff_date, 3, 'Written off: ' || reason, amount FROM write_offs
+		WHERE resident_id = ?1 AND reversed_at IS NULL AND writeoff_date >= ?2 AND writeoff_date < ?3
+		ORDER BY date, kind
+	`, residentID, start, end, PaymentStatusConfirmed)
+	if err != nil {
+		return s, err
+	}
+	defer rows.Close()
+
+	s.Months = make([]StatementMonth, 12)
+	for i := range s.Months {
+		s.Months[i] = StatementMonth{Month: first.AddDate(0, i, 0).Format("2006-01"), Balance: s.OpeningBalance, Lines: []StatementLine{}}
+	}
+	balance := s.OpeningBalance
+	for rows.Next() {
+		var line StatementLine
+		var kind int
+		var amount float64
+		if err := rows.Scan(&line.Date, &kind, &line.Description, &amount); err != nil {
+			return s, err
+		}
+		date, err := time.Parse("2006-01-02", line.Date)
+		if err != nil {
+			return s, fmt.Errorf("invalid date %q on the statement", line.Date)
+		}
+		month := &s.Months[cal.fiscalMonthIndex(date)]
+		switch kind {
+		case 0:
+			line.Charge = amount
+			month.Charged = roundCents(month.Charged + amount)
+			balance += amount
+		case 1:
+			line.Payment = amount
+			month.Paid = roundCents(month.Paid + amount)
+			balance -= amount
+		case 2:
+			line.Credit = amount
+			month.Credited = roundCents(month.Credited + amount)
+			balance -= amount
+		default:
+			line.WrittenOff = amount
+			month.WrittenOff = roundCents(month.WrittenOff + amount)
+			balance -= amount
+		}
+		line.Balance = roundCents(balance)
+		month.Lines = append(month.Lines, line)
+	}
+	if err := rows.Err(); err != nil {
+		return s, err
+	}
+
+	// Months without lines carry the balance over from the previous one
+	for i := range s.Months {
+		month := &s.Months[i]
+		if n := len(month.Lines); n > 0 {
+			month.Balance = month.Lines[n-1].Balance
+		} else if i > 0 {
+			month.Balance = s.Months[i-1].Balance
+		}
+		s.Charged = roundCents(s.Charged + month.Charged)
+		s.Paid = roundCents(s.Paid + month.Paid)
+		s.Credited = roundCents(s.Credited + month.Credited)
+		s.WrittenOff = roundCents(s.WrittenOff + month.WrittenOff)
+	}
+	s.ClosingBalance = roundCents(s.OpeningBalance + s.Charged - s.Paid - s.Credited - s.WrittenOff)
+	return s, nil
+}
+
+// through cuts the statement short after its first months, as if it were
+// issued at the end of the last of them
+func (s *Statement) through(months int) {
+	s.Months = s.Months[:months]
+	s.Charged, s.Paid, s.Credited, s.WrittenOff = 0, 0, 0, 0
+	for _, m := range s.Months {
+		s.Charged = roundCents(s.Charged + m.Charged)
+		s.Paid = roundCents(s.Paid + m.Paid)
+		s.Credited = roundCents(s.Credited + m.Credited)
+		s.WrittenOff = roundCents(s.WrittenOff + m.WrittenOff)
+	}
+	s.ClosingBalance = s.Months[months-1].Balance
+}
+
+// statementPDF lays out a statement as a PDF document, labelled in lang
+func statementPDF(s Statement, currency, lang string, cal calendar) *pdfDocument {
+	label := func(id string, args ...interface{}) string {
+		return fmt.Sprintf(message(lang, id), args...)
+	}
+	money := func(amount float64) string {
+		if amount == 0 {
+			return ""
+		}
+		return fmt.Sprintf("%.2f", amount)
+	}
+	// Columns of the Courier table: date, description, charge, payment,
+	// credit, written off, balance
+	row := func(date, description, charge, payment, credit, writtenOff, balance string) string {
+		if utf8.RuneCountInString(description) > 24 {
+			description = string([]rune(description)[:23]) + "…"
+		}
+		return fmt.Sprintf("%-10s  %-24s %10s %10s %10s %10s %10s", date, description, charge, payment, credit, writtenOff, balance)
+	}
+
+	title := label("statement_title", cal.fiscalYearLabel(s.Year))
+	if len(s.Months) < 12 {
+		last, _ := time.Parse("2006-01", s.Months[len(s.Months)-1].Month)
+		title += " " + label("statement_through", monthName(lang, last.Month()))
+	}
+
+	doc := newPDFDocument()
+	doc.Line(pdfBold, 16, title)
+	doc.Space(6)
+	doc.Line(pdfBold, 11, s.Resident.Name)
+	doc.Line(pdfRegular, 10, label("statement_unit", s.Resident.Unit))
+	for _, detail := range []string{s.Resident.Email, s.Resident.Contact} {
+		if detail != "" {
+			doc.Line(pdfRegular, 10, detail)
+		}
+	}
+	doc.Space(6)
+	doc.Line(pdfRegular, 9, label("statement_issued", currency, cal.today()))
+	doc.Space(10)
+
+	doc.Line(pdfMono, 9, row(label("statement_date"), label("statement_description"), label("statement_charge"), label("statement_payment"), label("statement_credit"), label("statement_written_off"), label("statement_balance")))
+	doc.Line(pdfMono, 9, row("", label("statement_opening_balance"), "", "", "", "", fmt.Sprintf("%.2f", s.OpeningBalance)))
+	for _, month := range s.Months {
+		date, _ := time.Parse("2006-01", month.Month)
+		doc.Space(4)
+		heading := []rune(label("statement_month", monthName(lang, date.Month()), date.Year()))
+		heading[0] = unicode.ToUpper(heading[0])
+		doc.Line(pdfBold, 10, string(heading))
+		for _, line := range month.Lines {
+			doc.Line(pdfMono, 9, row(line.Date, line.Description, money(line.Charge), money(line.Payment), money(line.Credit), money(line.WrittenOff), fmt.Sprintf("%.2f", line.Balance)))
+		}
+		doc.Line(pdfMono, 9, row("", label("statement_month_total"), fmt.Sprintf("%.2f", month.Charged), fmt.Sprintf("%.2f", month.Paid), fmt.Sprintf("%.2f", month.Credited), fmt.Sprintf("%.2f", month.WrittenOff), fmt.Sprintf("%.2f", month.Balance)))
+	}
+	doc.Space(8)
+	doc.Line(pdfMono, 9, row("", label("statement_total"), fmt.Sprintf("%.2f", s.Charged), fmt.Sprintf("%.2f", s.Paid), fmt.Sprintf("%.2f", s.Credited), fmt.Sprintf("%.2f", s.WrittenOff), ""))
+	doc.Line(pdfBold, 11, label("statement_closing_balance", s.ClosingBalance, currency))
+	if s.ClosingBalance < 0 {
+		doc.Line(pdfRegular, 9, label("statement_credit_note"))
+	}
+	return doc
+}
+
+// respondWithStatement writes the statement in the format the request asks
+// for: json (the default) or pdf
+func respondWithStatement(w http.ResponseWriter, r *http.Request, db *sql.DB, residentID int, currency string, cal calendar) {
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "json" && format != "pdf" {
+		respondWithError(w, http.StatusBadRequest, "Invalid format, must be json or pdf")
+		return
+	}
+	year, err := statementYear(r, cal)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	statement, err := residentStatement(db, residentID, year, cal)
+	if err == sql.ErrNoRows {
+		respondWithError(w, http.StatusNotFound, "Resident not found")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if format == "pdf" {
+		w.Header().Set("Content-Type", "application/pdf")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=statement_%d_%d.pdf", statement.Resident.ID, statement.Year))
+		w.WriteHeader(http.StatusOK)
+		statementPDF(statement, currency, responseLanguage(w), cal).WriteTo(w)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, statement)
+}
+
+// Get a resident's statement for a year
+func getResidentStatement(db *sql.DB, currency string, cal calendar) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := checkQueryParams(r, "year", "format"); err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		vars := mux.Vars(r)
+		id, err := strconv.Atoi(vars["id"])
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid resident ID")
+			return
+		}
+		respondWithStatement(w, r, db, id, currency, cal)
+	}
+}
+
+// The statement of the token's resident
+func portalStatement(db *sql.DB, currency string, cal calendar) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := checkQueryParams(r, "year", "format"); err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		var residentID int
+		err := db.QueryRow("SELECT resident_id FROM portal_tokens WHERE id = ?", portalTokenID(r)).Scan(&residentID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		respondWithStatement(w, r, db, residentID, currency, cal)
+	}
+}
@@ -0,0 +1,293 @@
+package condomngr
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// Default templates of the statement email. They are executed with
+// statementMailData.
+const (
+	defaultStatementSubject = "Your statement for {{.Month}}"
+	defaultStatementBody    = `Hello {{.Name}},
+
+Attached is the statement of unit {{.Unit}} through {{.Month}}.
+Your balance is {{printf "%.2f" .Balance}} {{.Currency}}.
+
+Thank you.
+`
+)
+
+// statementMailData is what the subject and body templates can use
+type statementMailData struct {
+	Name     string
+	Unit     string
+	Month    string // e.g. July 2024
+	Balance  float64
+	Currency string
+}
+
+// StatementMailRequest overrides the saved subject and body templates
+type StatementMailRequest struct {
+	Subject string `json:"subject"`
+	Body    string `json:"body"`
+}
+
+// StatementMailStatus is the progress of the last statement mailing. During a
+// dry run Sent counts the statements that would be sent.
+type StatementMailStatus struct {
+	Month      string         `json:"month"`
+	DryRun     bool           `json:"dry_run"`
+	Running    bool           `json:"running"`
+	StartedAt  *time.Time     `json:"started_at"`
+	FinishedAt *time.Time     `json:"finished_at"`
+	Residents  int            `json:"residents"`
+	Sent       int            `json:"sent"`
+	Skipped    []ReminderSkip `json:"skipped"`
+	Failed     []ReminderSkip `json:"failed"`
+	Error      string         `json:"error"`
+}
+
+// StatementMailer emails every resident their statement as a PDF. Each send is
+// recorded in statement_sends, so running a month again only mails the
+// residents that didn't get it yet.
+type StatementMailer struct {
+	db          *sql.DB
+	mailer      *Mailer
+	unsubscribe *Unsubscribe
+	currency    string
+	cal         calendar
+
+	mu     sync.Mutex
+	status StatementMailStatus
+}
+
+// NewStatementMailer creates a statement mailer sending through mailer, with
+// unsubscribe links signed by unsubscribe. Statements cover the fiscal years
+// starting in month fiscalYearStart, and the current month is the one in
+// location.
+func NewStatementMailer(db *sql.DB, mailer *Mailer, unsubscribe *Unsubscribe, currency string, location *time.Location, fiscalYearStart int) *StatementMailer {
+	return &StatementMailer{db: db, mailer: mailer, unsubscribe: unsubscribe, currency: currency, cal: calendar{location: location, fiscalYearStart: fiscalYearStart},
+		status: StatementMailStatus{Skipped: []ReminderSkip{}, Failed: []ReminderSkip{}}}
+}
+
+// errMailingRunning is returned when statements are sent while a mailing is in
+// progress
+var errMailingRunning = errors.New("statements are already being sent")
+
+// Status returns a copy of the current mailing status
+func (m *StatementMailer) Status() StatementMailStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	status := m.status
+	status.Skipped = append([]ReminderSkip{}, m.status.Skipped...)
+	status.Failed = append([]ReminderSkip{}, m.status.Failed...)
+	return status
+}
+
+// Start begins mailing the statements through month (YYYY-MM) in the
+// background. A dry run sends nothing and records nothing, and runs before
+// Start returns.
+func (m *StatementMailer) Start(month string, subject, body *template.Template, dryRun bool) error {
+	m.mu.Lock()
+	if m.status.Running {
+		m.mu.Unlock()
+		return errMailingRunning
+	}
+	now := time.Now()
+	m.status = StatementMailStatus{Month: month, DryRun: dryRun, Running: true, StartedAt: &now, Skipped: []ReminderSkip{}, Failed: []ReminderSkip{}}
+	m.mu.Unlock()
+
+	if dryRun {
+		m.run(month, subject, body, dryRun)
+	} else {
+		go m.run(month, subject, body, dryRun)
+	}
+	return nil
+}
+
+func (m *StatementMailer) run(month string, subject, body *template.Template, dryRun bool) {
+	err := m.send(month, subject, body, dryRun)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	m.status.Running = false
+	m.status.FinishedAt = &now
+	if err != nil {
+		m.status.Error = err.Error()
+		log.Printf("Sending statements for %s failed: %v", month, err)
+	}
+}
+
+func (m *StatementMailer) send(month string, subject, body *template.Template, dryRun bool) error {
+	period, err := time.Parse("2006-01", month)
+	if err != nil {
+		return err
+	}
+
+	rows, err := m.db.Query(`
+		SELECT r.id, r.name, r.email, r.notify_statements, EXISTS(SELECT 1 FROM statement_sends s WHERE s.resident_id = r.id AND s.month = ?)
+		FROM residents r WHERE r.anonymized_at IS NULL ORDER BY r.unit, r.name
+	`, month)
+	if err != nil {
+		return err
+	}
+	type recipient struct {
+		id                   int
+		name, email, channel string
+		sent                 bool
+	}
+	var recipients []recipient
+	for rows.Next() {
+		var r recipient
+		if err := rows.Scan(&r.id, &r.name, &r.email, &r.channel, &r.sent); err != nil {
+			rows.Close()
+			return err
+		}
+		recipients = append(recipients, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	m.status.Residents = len(recipients)
+	m.mu.Unlock()
+
+	for _, r := range recipients {
+		skip := func(list *[]ReminderSkip, reason string) {
+			m.mu.Lock()
+			*list = append(*list, ReminderSkip{ResidentID: r.id, Name: r.name, Reason: reason})
+			m.mu.Unlock()
+		}
+		switch {
+		case r.channel == "none":
+			skip(&m.status.Skipped, "resident opted out of statements")
+			continue
+		case r.email == "":
+			skip(&m.status.Skipped, "no email address")
+			continue
+		case r.sent:
+			skip(&m.status.Skipped, "statement already sent")
+			continue
+		}
+
+		statement, err := residentStatement(m.db, r.id, m.cal.fiscalYearOf(period), m.cal)
+		if err != nil {
+			return err
+		}
+		statement.through(m.cal.fiscalMonthIndex(period) + 1)
+		data := statementMailData{
+			Name:     statement.Resident.Name,
+			Unit:     statement.Resident.Unit,
+			Month:    period.Format("January 2006"),
+			Balance:  statement.ClosingBalance,
+			Currency: m.currency,
+		}
+		subjectText, bodyText, err := renderEmail(subject, body, data)
+		if err != nil {
+			return err
+		}
+		var pdf bytes.Buffer
+		if _, err := statementPDF(statement, m.currency, defaultLanguage, m.cal).WriteTo(&pdf); err != nil {
+			return err
+		}
+
+		if !dryRun {
+			attachment := MailAttachment{
+				Filename:    fmt.Sprintf("statement_%d_%s.pdf", r.id, month),
+				ContentType: "application/pdf",
+				Data:        pdf.Bytes(),
+			}
+			if err := m.mailer.SendWithUnsubscribe(r.email, subjectText, bodyText, m.unsubscribe.URL(r.id, NotifyStatements), attachment); err != nil {
+				skip(&m.status.Failed, err.Error())
+				continue
+			}
+			if _, err := m.db.Exec("INSERT INTO statement_sends(resident_id, month, email) VALUES(?, ?, ?)", r.id, month, r.email); err != nil {
+				return err
+			}
+		}
+		m.mu.Lock()
+		m.status.Sent++
+		m.mu.Unlock()
+	}
+	return nil
+}
+
+// Email every resident their statement through a month. The mailing runs in
+// the background and answers 202; a dry run answers with its outcome.
+func sendStatements(mailer *StatementMailer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := checkQueryParams(r, "month", "dry_run"); err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		month := r.URL.Query().Get("month")
+		if month == "" {
+			month = mailer.cal.now().Format("2006-01")
+		}
+		if _, err := time.Parse("2006-01", month); err != nil {
+			respondWithError(w, http.StatusBadRequest, "invalid month format, must be YYYY-MM")
+			return
+		}
+		dryRun := false
+		if value := r.URL.Query().Get("dry_run"); value != "" {
+			var err error
+			if dryRun, err = strconv.ParseBool(value); err != nil {
+				respondWithError(w, http.StatusBadRequest, "Invalid dry_run, must be true or false")
+				return
+			}
+		}
+
+		saved, err := emailTemplate(mailer.db, "statement")
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		req := StatementMailRequest{Subject: saved.Subject, Body: saved.Body}
+		if r.ContentLength > 0 {
+			if err := decodeRequest(r, &req); err != nil {
+				respondWithError(w, payloadErrorStatus(err), "Invalid request payload: "+err.Error())
+				return
+			}
+			defer r.Body.Close()
+		}
+		subject, body, _, err := parseEmailTemplate("statement", req.Subject, req.Body, mailer.currency)
+		if err != nil {
+			respondWithValidationError(w, err)
+			return
+		}
+
+		if !dryRun && !mailer.mailer.Enabled() {
+			respondWithError(w, http.StatusBadRequest, "Email is not configured")
+			return
+		}
+
+		if err := mailer.Start(month, subject, body, dryRun); err != nil {
+			respondWithError(w, http.StatusConflict, err.Error())
+			return
+		}
+		if dryRun {
+			respondWithJSON(w, http.StatusOK, mailer.Status())
+			return
+		}
+		respondWithJSON(w, http.StatusAccepted, mailer.Status())
+	}
+}
+
+// Get the progress of the last statement mailing
+func getStatementMailStatus(mailer *StatementMailer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		respondWithJSON(w, http.StatusOK, mailer.Status())
+	}
+}
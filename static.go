@@ -0,0 +1,78 @@
+package condomngr
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/fs"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	staticETagsOnce sync.Once
+	staticETags     map[string]string
+)
+
+// staticETag returns the ETag of an embedded file, a hash of its content.
+// Embedded files only change with a new build, so they are hashed once.
+func staticETag(name string) string {
+	staticETagsOnce.Do(func() {
+		staticETags = map[string]string{}
+		fs.WalkDir(content, "static", func(name string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return err
+			}
+			data, err := content.ReadFile(name)
+			if err != nil {
+				return err
+			}
+			sum := sha256.Sum256(data)
+			staticETags[name] = `"` + hex.EncodeToString(sum[:16]) + `"`
+			return nil
+		})
+	})
+	return staticETags[name]
+}
+
+// serveEmbedded serves an embedded file with its ETag. Browsers revalidate on
+// every load and get a 304 until a new build changes the file.
+func serveEmbedded(w http.ResponseWriter, r *http.Request, name string) {
+	data, err := content.ReadFile(name)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("ETag", staticETag(name))
+	http.ServeContent(w, r, name, time.Time{}, bytes.NewReader(data))
+}
+
+// Serve the embedded files under /static/
+func serveStatic(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(path.Clean(r.URL.Path), "/")
+	if !strings.HasPrefix(name, "static/") {
+		http.NotFound(w, r)
+		return
+	}
+	serveEmbedded(w, r, name)
+}
+
+// Serve the icon browsers ask for at the root, wherever the application is
+// served from
+func serveFavicon(w http.ResponseWriter, r *http.Request) {
+	serveEmbedded(w, r, "static/favicon.svg")
+}
+
+// Serve the index page for client-side routes. Paths with a file extension
+// are requests for files that don't exist, not pages, and get a 404.
+func serveIndex(w http.ResponseWriter, r *http.Request) {
+	if path.Ext(r.URL.Path) != "" {
+		http.NotFound(w, r)
+		return
+	}
+	serveEmbedded(w, r, "static/index.html")
+}
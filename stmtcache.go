@@ -0,0 +1,50 @@
+package condomngr
+
+import (
+	"database/sql"
+	"errors"
+	"sync"
+)
+
+// StmtCache prepares each statement once and reuses it for every request
+// instead of preparing and closing it per request. Only the fixed
+// INSERT/UPDATE/DELETE statements of the handlers go through it; queries
+// built from filters vary too much to be worth keeping.
+type StmtCache struct {
+	db    *sql.DB
+	mu    sync.Mutex
+	stmts map[string]*sql.Stmt
+}
+
+// NewStmtCache creates an empty statement cache for db
+func NewStmtCache(db *sql.DB) *StmtCache {
+	return &StmtCache{db: db, stmts: map[string]*sql.Stmt{}}
+}
+
+// Prepare returns the prepared statement for query, preparing it on first
+// use. The statement belongs to the cache: callers must not close it.
+func (c *StmtCache) Prepare(query string) (*sql.Stmt, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if stmt, ok := c.stmts[query]; ok {
+		return stmt, nil
+	}
+	stmt, err := c.db.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	c.stmts[query] = stmt
+	return stmt, nil
+}
+
+// Close closes every cached statement. Call it before closing the database.
+func (c *StmtCache) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var errs []error
+	for query, stmt := range c.stmts {
+		errs = append(errs, stmt.Close())
+		delete(c.stmts, query)
+	}
+	return errors.Join(errs...)
+}
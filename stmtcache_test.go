@@ -0,0 +1,64 @@
+package condomngr
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// BenchmarkCreatePayment records payments from parallel clients, as a load
+// generator would, with the statement cache and with the statement prepared
+// and closed on every request as before it
+func BenchmarkCreatePayment(b *testing.B) {
+	for _, bench := range []struct {
+		name    string
+		handler func(db *sql.DB, stmts *StmtCache) http.HandlerFunc
+	}{
+		{"cached", func(db *sql.DB, stmts *StmtCache) http.HandlerFunc {
+			return createPayment(db, stmts, NewNotifier(nil, 0), NewReceiptQueue(db, nil, nil, "", time.UTC), NewChangeBroker(), paymentRules{allocation: AllocationFIFO})
+		}},
+		{"prepared per request", func(db *sql.DB, _ *StmtCache) http.HandlerFunc {
+			notifier, receipts, changes := NewNotifier(nil, 0), NewReceiptQueue(db, nil, nil, "", time.UTC), NewChangeBroker()
+			return func(w http.ResponseWriter, r *http.Request) {
+				stmts := NewStmtCache(db)
+				defer stmts.Close()
+				createPayment(db, stmts, notifier, receipts, changes, paymentRules{allocation: AllocationFIFO})(w, r)
+			}
+		}},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			db, err := OpenDB(filepath.Join(b.TempDir(), "condo.db"))
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer db.Close()
+			// Spread the payments so reallocating a resident's stays cheap
+			const residents = 500
+			if _, err := db.Exec("WITH RECURSIVE n(i) AS (SELECT 1 UNION ALL SELECT i + 1 FROM n WHERE i < ?) INSERT INTO residents(name, unit) SELECT 'Resident ' || i, 'U' || i FROM n", residents); err != nil {
+				b.Fatal(err)
+			}
+			var next atomic.Int64
+			stmts := NewStmtCache(db)
+			defer stmts.Close()
+			handler := bench.handler(db, stmts)
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					body := fmt.Sprintf(`{"resident_id": %d, "amount": 50, "description": "Dues", "payment_date": "2024-03-05"}`, next.Add(1)%residents+1)
+					w := httptest.NewRecorder()
+					handler(w, httptest.NewRequest("POST", "/api/v1/payments", strings.NewReader(body)))
+					if w.Code != http.StatusCreated {
+						panic(fmt.Sprintf("status %d: %s", w.Code, w.Body))
+					}
+				}
+			})
+		})
+	}
+}
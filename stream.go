@@ -0,0 +1,173 @@
+package condomngr
+
+import (
+	"database/sql"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// streamFlushEvery is how many array elements are written between flushes
+const streamFlushEvery = 500
+
+// streamErrorTrailer is the trailer that carries the error of a response cut
+// short after it started
+const streamErrorTrailer = "X-Stream-Error"
+
+// streamWriter writes a JSON response as it is produced instead of building it
+// in memory first. The 200 status goes out with the first write, so an error
+// before that still gets a proper 500. An error after it can only cut the body
+// short: it is logged and reported in the X-Stream-Error trailer, and the JSON
+// is left unterminated so clients don't take it for a complete response.
+type streamWriter struct {
+	w       http.ResponseWriter
+	started bool
+}
+
+func newStreamWriter(w http.ResponseWriter) *streamWriter {
+	return &streamWriter{w: w}
+}
+
+func (s *streamWriter) Write(p []byte) (int, error) {
+	if !s.started {
+		s.started = true
+		if s.w.Header().Get("Content-Type") == "" {
+			s.w.Header().Set("Content-Type", "application/json")
+		}
+		s.w.Header().Set("Trailer", streamErrorTrailer)
+		s.w.WriteHeader(http.StatusOK)
+	}
+	return s.w.Write(p)
+}
+
+// Flush sends what was written so far to the client
+func (s *streamWriter) Flush() {
+	http.NewResponseController(s.w).Flush()
+}
+
+// Finish reports err, if any, the way the state of the response allows
+func (s *streamWriter) Finish(err error) {
+	if err == nil {
+		return
+	}
+	if !s.started {
+		respondWithError(s.w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	log.Printf("Streamed response cut short: %v", err)
+	s.w.Header().Set(streamErrorTrailer, err.Error())
+}
+
+// rowScanner scans the current row into the value to encode
+type rowScanner func(rows *sql.Rows) (interface{}, error)
+
+// writeJSONArray encodes rows as a JSON array, one element at a time. The
+// output is the same as json.Marshal of the complete slice. It closes rows and
+// returns the number of elements written.
+func writeJSONArray(w io.Writer, rows *sql.Rows, scan rowScanner) (int, error) {
+	defer rows.Close()
+
+	if _, err := io.WriteString(w, "["); err != nil {
+		return 0, err
+	}
+	n := 0
+	for rows.Next() {
+		item, err := scan(rows)
+		if err != nil {
+			return n, err
+		}
+		b, err := json.Marshal(item)
+		if err != nil {
+			return n, err
+		}
+		if n > 0 {
+			if _, err := io.WriteString(w, ","); err != nil {
+				return n, err
+			}
+		}
+		if _, err := w.Write(b); err != nil {
+			return n, err
+		}
+		n++
+		if f, ok := w.(http.Flusher); ok && n%streamFlushEvery == 0 {
+			f.Flush()
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return n, err
+	}
+	_, err := io.WriteString(w, "]")
+	return n, err
+}
+
+// streamQuery runs a query and streams its rows as the JSON array response
+func streamQuery(w http.ResponseWriter, db *sql.DB, scan rowScanner, query string, args ...interface{}) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	stream := newStreamWriter(w)
+	_, err = writeJSONArray(stream, rows, scan)
+	stream.Finish(err)
+}
+
+const residentColumns = "id, name, unit, contact, email, notify_channel, notify_receipts, notify_announcements, notify_statements, move_in_date, move_out_date, created_at, updated_at, anonymized_at, " + residentCustomColumn
+
+func scanResidentRow(row interface{ Scan(...interface{}) error }) (Resident, error) {
+	var resident Resident
+	var notifications NotificationPreferences
+	var custom string
+	var anonymizedAt sql.NullTime
+	err := row.Scan(&resident.ID, &resident.Name, &resident.Unit, &resident.Contact, &resident.Email, &resident.NotifyChannel,
+		&notifications.Receipts, &notifications.Announcements, &notifications.Statements,
+		&resident.MoveInDate, &resident.MoveOutDate, &resident.CreatedAt, &resident.UpdatedAt, &anonymizedAt, &custom)
+	if err != nil {
+		return resident, err
+	}
+	if anonymizedAt.Valid {
+		resident.AnonymizedAt = &anonymizedAt.Time
+	}
+	notifications.Reminders = resident.NotifyChannel
+	resident.Notifications = &notifications
+	err = json.Unmarshal([]byte(custom), &resident.Custom)
+	return resident, err
+}
+
+func scanResident(rows *sql.Rows) (interface{}, error) {
+	return scanResidentRow(rows)
+}
+
+// scanPayment scans a payment without the resident name, as exported
+func scanPayment(rows *sql.Rows) (interface{}, error) {
+	var payment Payment
+	err := rows.Scan(&payment.ID, &payment.ResidentID, &payment.Amount, &payment.Description, &payment.PaymentDate, &payment.Method, &payment.Status, &payment.Reference, &payment.BankReference, &payment.ChequeNumber, &payment.ChequeBank, &payment.ChequeStatus, &payment.ChequeStatusDate, &payment.CreatedAt, &payment.UpdatedAt)
+	return payment, err
+}
+
+// scanPaymentWithResident scans a payment joined with its resident's name
+func scanPaymentWithResident(rows *sql.Rows) (interface{}, error) {
+	var payment Payment
+	err := rows.Scan(&payment.ID, &payment.ResidentID, &payment.ResidentName, &payment.Amount, &payment.Description, &payment.PaymentDate, &payment.Method, &payment.Status, &payment.Reference, &payment.BankReference, &payment.ChequeNumber, &payment.ChequeBank, &payment.ChequeStatus, &payment.ChequeStatusDate, &payment.CreatedAt, &payment.UpdatedAt)
+	return payment, err
+}
+
+const expenseColumns = "id, amount, description, expense_date, category, created_at, updated_at, currency, original_amount, exchange_rate, bank_reference, tax_rate, tax_amount, vendor, " +
+	"(SELECT COALESCE(group_concat(tag, ','), '') FROM (SELECT tag FROM expense_tags t WHERE t.expense_id = expenses.id ORDER BY tag))"
+
+func scanExpenseRow(row interface{ Scan(...interface{}) error }) (Expense, error) {
+	var expense Expense
+	var tags string
+	err := row.Scan(&expense.ID, &expense.Amount, &expense.Description, &expense.ExpenseDate, &expense.Category, &expense.CreatedAt, &expense.UpdatedAt,
+		&expense.Currency, &expense.OriginalAmount, &expense.ExchangeRate, &expense.BankReference, &expense.TaxRate, &expense.TaxAmount, &expense.Vendor, &tags)
+	if tags != "" {
+		expense.Tags = strings.Split(tags, ",")
+	}
+	return expense, err
+}
+
+func scanExpense(rows *sql.Rows) (interface{}, error) {
+	return scanExpenseRow(rows)
+}
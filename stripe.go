@@ -0,0 +1,324 @@
+package condomngr
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	stripeAPI = "https://api.stripe.com/v1/"
+	// stripeSignatureTolerance is how old a webhook signature may be before
+	// the delivery is rejected as a possible replay
+	stripeSignatureTolerance = 5 * time.Minute
+)
+
+// stripeZeroDecimal lists currencies Stripe expects in whole units rather than cents
+var stripeZeroDecimal = map[string]bool{
+	"bif": true, "clp": true, "djf": true, "gnf": true, "jpy": true, "kmf": true,
+	"krw": true, "mga": true, "pyg": true, "rwf": true, "ugx": true, "vnd": true,
+	"vuv": true, "xaf": true, "xof": true, "xpf": true,
+}
+
+// Stripe creates Checkout sessions and verifies webhook deliveries. It is inert
+// when no secret key is configured.
+type Stripe struct {
+	SecretKey     string
+	WebhookSecret string
+	Currency      string
+	PublicURL     string
+	Client        *http.Client
+}
+
+// NewStripe creates a Stripe integration for the given keys
+func NewStripe(secretKey, webhookSecret, currency, publicURL string) *Stripe {
+	return &Stripe{
+		SecretKey:     secretKey,
+		WebhookSecret: webhookSecret,
+		Currency:      strings.ToLower(currency),
+		PublicURL:     strings.TrimRight(publicURL, "/"),
+		Client:        &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// Configured reports whether a secret key is set
+func (s *Stripe) Configured() bool {
+	return s.SecretKey != ""
+}
+
+func (s *Stripe) toMinorUnits(amount float64) int64 {
+	if stripeZeroDecimal[s.Currency] {
+		return int64(math.Round(amount))
+	}
+	return int64(math.Round(amount * 100))
+}
+
+func (s *Stripe) fromMinorUnits(amount int64) float64 {
+	if stripeZeroDecimal[s.Currency] {
+		return float64(amount)
+	}
+	return float64(amount) / 100
+}
+
+// PaymentLink is a Checkout session a resident can pay through
+type PaymentLink struct {
+	ResidentID  int     `json:"resident_id"`
+	Amount      float64 `json:"amount"`
+	Description string  `json:"description"`
+	SessionID   string  `json:"session_id"`
+	URL         string  `json:"url"`
+}
+
+// createCheckoutSession creates a Checkout session for a resident's payment
+func (s *Stripe) createCheckoutSession(link *PaymentLink, email string) error {
+	form := url.Values{}
+	form.Set("mode", "payment")
+	form.Set("success_url", s.PublicURL+"/?payment=success")
+	form.Set("cancel_url", s.PublicURL+"/?payment=cancelled")
+	form.Set("client_reference_id", strconv.Itoa(link.ResidentID))
+	form.Set("line_items[0][quantity]", "1")
+	form.Set("line_items[0][price_data][currency]", s.Currency)
+	form.Set("line_items[0][price_data][unit_amount]", strconv.FormatInt(s.toMinorUnits(link.Amount), 10))
+	form.Set("line_items[0][price_data][product_data][name]", link.Description)
+	form.Set("metadata[resident_id]", strconv.Itoa(link.ResidentID))
+	form.Set("metadata[description]", link.Description)
+	if email != "" {
+		form.Set("customer_email", email)
+	}
+
+	req, err := http.NewRequest("POST", stripeAPI+"checkout/sessions", strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(s.SecretKey, "")
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		ID    string `json:"id"`
+		URL   string `json:"url"`
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return fmt.Errorf("unexpected response (status %d)", resp.StatusCode)
+	}
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("stripe API error: %s", result.Error.Message)
+	}
+
+	link.SessionID = result.ID
+	link.URL = result.URL
+	return nil
+}
+
+// verifySignature checks a Stripe-Signature header against the payload
+func (s *Stripe) verifySignature(payload []byte, header string, now time.Time) error {
+	var timestamp string
+	var signatures []string
+	for _, part := range strings.Split(header, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "t":
+			timestamp = kv[1]
+		case "v1":
+			signatures = append(signatures, kv[1])
+		}
+	}
+	if timestamp == "" || len(signatures) == 0 {
+		return fmt.Errorf("malformed signature header")
+	}
+
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("malformed signature timestamp")
+	}
+	if age := now.Sub(time.Unix(ts, 0)); age > stripeSignatureTolerance || age < -stripeSignatureTolerance {
+		return fmt.Errorf("signature timestamp outside tolerance")
+	}
+
+	mac := hmac.New(sha256.New, []byte(s.WebhookSecret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(payload)
+	expected := mac.Sum(nil)
+
+	for _, sig := range signatures {
+		decoded, err := hex.DecodeString(sig)
+		if err == nil && hmac.Equal(decoded, expected) {
+			return nil
+		}
+	}
+	return fmt.Errorf("signature mismatch")
+}
+
+// Create a Stripe Checkout payment link for a resident
+func createPaymentLink(db *sql.DB, stripe *Stripe) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !stripe.Configured() {
+			respondWithError(w, http.StatusBadRequest, "Stripe integration is not configured")
+			return
+		}
+
+		var link PaymentLink
+		if err := decodeRequest(r, &link); err != nil {
+			respondWithError(w, payloadErrorStatus(err), "Invalid request payload: "+err.Error())
+			return
+		}
+		defer r.Body.Close()
+
+		if link.ResidentID <= 0 {
+			respondWithError(w, http.StatusBadRequest, "resident is required")
+			return
+		}
+		if link.Amount <= 0 {
+			respondWithError(w, http.StatusBadRequest, "amount must be greater than zero")
+			return
+		}
+
+		var name, unit, email string
+		err := db.QueryRow("SELECT name, unit, email FROM residents WHERE id = ?", link.ResidentID).Scan(&name, &unit, &email)
+		if err == sql.ErrNoRows {
+			respondWithError(w, http.StatusNotFound, "Resident not found")
+			return
+		}
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		if link.Description == "" {
+			link.Description = fmt.Sprintf("Condo payment - unit %s", unit)
+		}
+
+		if err := stripe.createCheckoutSession(&link, email); err != nil {
+			respondWithError(w, http.StatusBadGateway, fmt.Sprintf("Failed to create payment link: %v", err))
+			return
+		}
+
+		respondWithJSON(w, http.StatusCreated, link)
+	}
+}
+
+// Receive Stripe webhook deliveries and record completed checkouts as payments
+func stripeWebhook(db *sql.DB, stripe *Stripe, receipts *ReceiptQueue, changes *ChangeBroker, cal calendar, rules paymentRules) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !stripe.Configured() || stripe.WebhookSecret == "" {
+			respondWithError(w, http.StatusNotFound, "Stripe integration is not configured")
+			return
+		}
+
+		payload, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Error reading request body")
+			return
+		}
+		defer r.Body.Close()
+
+		if err := stripe.verifySignature(payload, r.Header.Get("Stripe-Signature"), time.Now()); err != nil {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Invalid signature: %v", err))
+			return
+		}
+
+		var event struct {
+			Type string `json:"type"`
+			Data struct {
+				Object struct {
+					ID            string            `json:"id"`
+					PaymentStatus string            `json:"payment_status"`
+					AmountTotal   int64             `json:"amount_total"`
+					Created       int64             `json:"created"`
+					Metadata      map[string]string `json:"metadata"`
+				} `json:"object"`
+			} `json:"data"`
+		}
+		if err := json.Unmarshal(payload, &event); err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid event payload")
+			return
+		}
+
+		// Acknowledge events we don't handle so Stripe stops retrying them
+		session := event.Data.Object
+		if event.Type != "checkout.session.completed" || session.PaymentStatus != "paid" {
+			respondWithJSON(w, http.StatusOK, map[string]string{"result": "ignored"})
+			return
+		}
+
+		residentID, err := strconv.Atoi(session.Metadata["resident_id"])
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Checkout session has no resident")
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		defer tx.Rollback()
+
+		// The unique index on reference turns duplicate deliveries into no-ops
+		result, err := tx.Exec(`
+			INSERT OR IGNORE INTO payments(resident_id, amount, description, payment_date, method, status, reference)
+			VALUES(?, ?, ?, ?, 'card', ?, ?)
+		`, residentID, stripe.fromMinorUnits(session.AmountTotal), session.Metadata["description"],
+			time.Unix(session.Created, 0).In(cal.location).Format("2006-01-02"), PaymentStatusConfirmed, session.ID)
+		if err != nil {
+			// A 5xx makes Stripe retry the delivery later
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		if n, _ := result.RowsAffected(); n == 0 {
+			respondWithJSON(w, http.StatusOK, map[string]string{"result": "duplicate"})
+			return
+		}
+		id, err := result.LastInsertId()
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if err := reallocate(tx, rules, residentID); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if err := tagReserve(tx); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		// Email the receipt and tell clients, as for payments entered by hand
+		if err := queueReceipts(tx, int(id)); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		receipts.Wake()
+		changes.Publish(Change{Type: "payment", ID: int(id), Action: ChangeCreated})
+
+		log.Printf("Recorded Stripe payment %s for resident %d", session.ID, residentID)
+		respondWithJSON(w, http.StatusOK, map[string]string{"result": "recorded"})
+	}
+}
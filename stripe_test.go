@@ -0,0 +1,64 @@
+package condomngr
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// deliverStripeEvent posts a Stripe event to the webhook, signed with secret
+func (s *testServer) deliverStripeEvent(secret, payload string) {
+	s.t.Helper()
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "." + payload))
+	req, err := http.NewRequest("POST", s.URL+"/api/v1/integrations/stripe/webhook", strings.NewReader(payload))
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	req.Header.Set("Stripe-Signature", "t="+timestamp+",v1="+hex.EncodeToString(mac.Sum(nil)))
+	resp, err := s.Client().Do(req)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		s.t.Fatalf("webhook: status %d", resp.StatusCode)
+	}
+}
+
+func TestStripeWebhookRecordsPayment(t *testing.T) {
+	s := newTestServer(t, Options{Stripe: NewStripe("sk_test", "whsec_test", "EUR", "")})
+	resident := s.createResident("Ana Silva", "1A")
+	if err := setSetting(s.db, settingAutoEmailReceipts, "true"); err != nil {
+		t.Fatal(err)
+	}
+	events := s.openEvents("/api/v1/events?type=payment")
+
+	// Card payments get a receipt and reach clients as those entered by hand
+	event := fmt.Sprintf(`{"type": "checkout.session.completed", "data": {"object": {"id": "cs_1", "payment_status": "paid", "amount_total": 5000, "created": 1709600000, "metadata": {"resident_id": "%d", "description": "Dues"}}}}`, resident.ID)
+	s.deliverStripeEvent("whsec_test", event)
+	var id int
+	if err := s.db.QueryRow("SELECT id FROM payments WHERE reference = 'cs_1'").Scan(&id); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := nextChange(t, events), (Change{Type: "payment", ID: id, Action: ChangeCreated}); got != want {
+		t.Errorf("change %+v, want %+v", got, want)
+	}
+	var receipts int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM receipt_emails WHERE payment_id = ?", id).Scan(&receipts); err != nil || receipts != 1 {
+		t.Errorf("%d receipts queued, %v, want 1", receipts, err)
+	}
+
+	// Stripe delivers events again until acknowledged
+	s.deliverStripeEvent("whsec_test", event)
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM receipt_emails WHERE payment_id = ?", id).Scan(&receipts); err != nil || receipts != 1 {
+		t.Errorf("%d receipts queued after the duplicate, %v, want 1", receipts, err)
+	}
+}
@@ -0,0 +1,462 @@
+package condomngr
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Task states
+const (
+	TaskOpen = "open"
+	TaskDone = "done"
+)
+
+// taskEntities maps the types of records a task can be linked to to their
+// tables
+var taskEntities = map[string]string{
+	"incident":            "incidents",
+	"document":            "documents",
+	"expense":             "expenses",
+	"resident":            "residents",
+	"announcement":        "announcements",
+	"maintenance_request": "maintenance_requests",
+}
+
+// Task is an action item, such as getting three quotes for painting the
+// stairwell, assigned to a user or to anyone named in free text and
+// optionally linked to the record it came from
+type Task struct {
+	ID               int       `json:"id"`
+	Title            string    `json:"title"`
+	Description      string    `json:"description"`
+	AssigneeUserID   *int      `json:"assignee_user_id"`
+	AssigneeUsername string    `json:"assignee_username"` // of assignee_user_id
+	Assignee         string    `json:"assignee"`          // anyone without a user, e.g. the painter
+	DueDate          string    `json:"due_date"`          // YYYY-MM-DD, or empty
+	Status           string    `json:"status"`            // TaskOpen if empty
+	CompletedOn      string    `json:"completed_on"`      // YYYY-MM-DD, only once done; today if empty
+	EntityType       string    `json:"entity_type"`       // one of taskEntities, or empty
+	EntityID         *int      `json:"entity_id"`
+	Overdue          bool      `json:"overdue"` // open past its due date
+	CreatedAt        time.Time `json:"created_at"`
+	UpdatedAt        time.Time `json:"updated_at"`
+}
+
+const taskColumns = `t.id, t.title, t.description, t.assignee_user_id, COALESCE(u.username, ''), t.assignee,
+	t.due_date, t.status, t.completed_on, t.entity_type, t.entity_id, t.created_at, t.updated_at`
+
+const taskFrom = " FROM tasks t LEFT JOIN users u ON u.id = t.assignee_user_id"
+
+func scanTask(row interface{ Scan(...interface{}) error }, cal calendar) (Task, error) {
+	var t Task
+	var assignee, entity sql.NullInt64
+	err := row.Scan(&t.ID, &t.Title, &t.Description, &assignee, &t.AssigneeUsername, &t.Assignee,
+		&t.DueDate, &t.Status, &t.CompletedOn, &t.EntityType, &entity, &t.CreatedAt, &t.UpdatedAt)
+	if assignee.Valid {
+		id := int(assignee.Int64)
+		t.AssigneeUserID = &id
+	}
+	if entity.Valid {
+		id := int(entity.Int64)
+		t.EntityID = &id
+	}
+	t.Overdue = t.Status == TaskOpen && t.DueDate != "" && t.DueDate < cal.today()
+	return t, err
+}
+
+// Validation function for Task data
+func validateTask(t Task) error {
+	var errs ValidationErrors
+	if t.Title == "" {
+		errs.Add("title", "title is required")
+	}
+	if t.DueDate != "" {
+		if _, err := time.Parse("2006-01-02", t.DueDate); err != nil {
+			errs.Add("due_date", "invalid date format, must be YYYY-MM-DD")
+		}
+	}
+	switch t.Status {
+	case TaskOpen:
+		if t.CompletedOn != "" {
+			errs.Add("completed_on", "completed_on is only for done tasks")
+		}
+	case TaskDone:
+		if _, err := time.Parse("2006-01-02", t.CompletedOn); err != nil {
+			errs.Add("completed_on", "invalid date format, must be YYYY-MM-DD")
+		}
+	default:
+		errs.Add("status", "status must be open or done")
+	}
+	if _, ok := taskEntities[t.EntityType]; (t.EntityType == "") != (t.EntityID == nil) || (t.EntityType != "" && !ok) {
+		errs.Add("entity_type", "entity_type must be one of incident, maintenance_request, document, expense, resident or announcement, with an entity_id")
+	}
+	return errs.Err()
+}
+
+// loadTask returns a task by id
+func loadTask(q querier, id int, cal calendar) (Task, error) {
+	return scanTask(q.QueryRow("SELECT "+taskColumns+taskFrom+" WHERE t.id = ?", id), cal)
+}
+
+// saveTask inserts t, or updates it when it has an id, after checking its
+// assignee exists and, when it is linked to a record it wasn't before, that
+// the record does. Records deleted later leave their tasks linked to nothing.
+// It returns sql.ErrNoRows when the task to update doesn't exist.
+func saveTask(db *sql.DB, t *Task) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	linked := t.EntityType != ""
+	if linked && t.ID != 0 {
+		var same bool
+		err := tx.QueryRow("SELECT entity_type = ? AND entity_id = ? FROM tasks WHERE id = ?", t.EntityType, *t.EntityID, t.ID).Scan(&same)
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		linked = !same
+	}
+
+	var errs ValidationErrors
+	if t.AssigneeUserID != nil {
+		var exists bool
+		if err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE id = ?)", *t.AssigneeUserID).Scan(&exists); err != nil {
+			return err
+		}
+		if !exists {
+			errs.Add("assignee_user_id", "assignee_user_id must be an existing user")
+		}
+	}
+	if linked {
+		var exists bool
+		if err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM "+taskEntities[t.EntityType]+" WHERE id = ?)", *t.EntityID).Scan(&exists); err != nil {
+			return err
+		}
+		if !exists {
+			errs.Add("entity_id", "entity_id must be an existing record of entity_type")
+		}
+	}
+	if err := errs.Err(); err != nil {
+		return err
+	}
+
+	if t.ID == 0 {
+		result, err := tx.Exec(`
+			INSERT INTO tasks(title, description, assignee_user_id, assignee, due_date, status, completed_on, entity_type, entity_id)
+			VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?)
+		`, t.Title, t.Description, t.AssigneeUserID, t.Assignee, t.DueDate, t.Status, t.CompletedOn, t.EntityType, t.EntityID)
+		if err != nil {
+			return err
+		}
+		id, err := result.LastInsertId()
+		if err != nil {
+			return err
+		}
+		t.ID = int(id)
+	} else {
+		result, err := tx.Exec(`
+			UPDATE tasks SET title = ?, description = ?, assignee_user_id = ?, assignee = ?, due_date = ?, status = ?,
+				completed_on = ?, entity_type = ?, entity_id = ?, updated_at = CURRENT_TIMESTAMP
+			WHERE id = ?
+		`, t.Title, t.Description, t.AssigneeUserID, t.Assignee, t.DueDate, t.Status, t.CompletedOn, t.EntityType, t.EntityID, t.ID)
+		if err != nil {
+			return err
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			return sql.ErrNoRows
+		}
+	}
+	return tx.Commit()
+}
+
+// sendTaskReminders notifies of the open tasks past their due date, once per
+// task and due date, so a task given a new date that passes too is reminded
+// of again
+func sendTaskReminders(db *sql.DB, notifier *Notifier, cal calendar) (int, error) {
+	if !notifier.Enabled(EventTaskOverdue) {
+		return 0, nil
+	}
+	rows, err := db.Query("SELECT "+taskColumns+taskFrom+" WHERE t.status = ? AND t.due_date != '' AND t.due_date < ? AND t.overdue_reminded_on != t.due_date ORDER BY t.due_date, t.id",
+		TaskOpen, cal.today())
+	if err != nil {
+		return 0, err
+	}
+	var tasks []Task
+	for rows.Next() {
+		t, err := scanTask(rows, cal)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		tasks = append(tasks, t)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	sent := 0
+	for _, t := range tasks {
+		result, err := db.Exec("UPDATE tasks SET overdue_reminded_on = due_date WHERE id = ? AND due_date = ? AND overdue_reminded_on != due_date", t.ID, t.DueDate)
+		if err != nil {
+			return sent, err
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			continue
+		}
+		assignee := t.AssigneeUsername
+		if assignee == "" {
+			assignee = t.Assignee
+		}
+		if assignee == "" {
+			assignee = "nobody"
+		}
+		notifier.Notify(Event{
+			Type:    EventTaskOverdue,
+			Title:   "Task overdue",
+			Message: fmt.Sprintf("%s, assigned to %s, was due on %s.", t.Title, assignee, t.DueDate),
+		})
+		sent++
+	}
+	return sent, nil
+}
+
+// scheduleTaskReminders sends the overdue task reminders now and then hourly
+// in a background goroutine
+func scheduleTaskReminders(db *sql.DB, notifier *Notifier, cal calendar) {
+	remind := func() {
+		if _, err := sendTaskReminders(db, notifier, cal); err != nil {
+			log.Printf("Failed to send task reminders: %v", err)
+		}
+	}
+	go func() {
+		remind()
+		ticker := time.NewTicker(time.Hour)
+		defer ticker.Stop()
+		for range ticker.C {
+			remind()
+		}
+	}()
+}
+
+// Handlers for task endpoints
+
+// Get the tasks, soonest due first and those without a due date last,
+// filtered by status, assignee and linked record. overdue=true lists only
+// the open tasks past their due date, and assignee_user_id=me those of the
+// signed-in user.
+func getTasks(db *sql.DB, cal calendar) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := checkQueryParams(r, "status", "overdue", "assignee_user_id", "entity_type", "entity_id"); err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		var filter queryFilter
+		filter.addString(r, "status", "t.status = ?")
+		filter.addString(r, "entity_type", "t.entity_type = ?")
+		if err := filter.addInt(r, "entity_id", "t.entity_id = ?"); err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if value := r.URL.Query().Get("overdue"); value != "" {
+			overdue, err := strconv.ParseBool(value)
+			if err != nil {
+				respondWithError(w, http.StatusBadRequest, "Invalid overdue, must be true or false")
+				return
+			}
+			if overdue {
+				filter.add("t.status = ?", TaskOpen)
+				filter.add("t.due_date != '' AND t.due_date < ?", cal.today())
+			}
+		}
+		if r.URL.Query().Get("assignee_user_id") == "me" {
+			session, ok := requireSession(db, w, r)
+			if !ok {
+				return
+			}
+			filter.add("t.assignee_user_id = ?", session.User.ID)
+		} else if err := filter.addInt(r, "assignee_user_id", "t.assignee_user_id = ?"); err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		rows, err := db.Query("SELECT "+taskColumns+taskFrom+filter.where()+" ORDER BY t.due_date = '', t.due_date, t.id", filter.args...)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		defer rows.Close()
+
+		tasks := []Task{}
+		for rows.Next() {
+			t, err := scanTask(rows, cal)
+			if err != nil {
+				respondWithError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			tasks = append(tasks, t)
+		}
+
+		respondWithJSON(w, http.StatusOK, tasks)
+	}
+}
+
+func getTask(db *sql.DB, cal calendar) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id, err := strconv.Atoi(vars["id"])
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid task ID")
+			return
+		}
+
+		t, err := loadTask(db, id, cal)
+		if err == sql.ErrNoRows {
+			respondWithError(w, http.StatusNotFound, "Task not found")
+			return
+		}
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		respondWithJSON(w, http.StatusOK, t)
+	}
+}
+
+// decodeTask reads a task from the request body, open unless said otherwise
+// and completed today when done without a date. It responds itself and
+// returns false when the body is invalid.
+func decodeTask(w http.ResponseWriter, r *http.Request, cal calendar) (Task, bool) {
+	var t Task
+	if err := decodeRequest(r, &t); err != nil {
+		respondWithError(w, payloadErrorStatus(err), "Invalid request payload: "+err.Error())
+		return t, false
+	}
+	defer r.Body.Close()
+	if t.Status == "" {
+		t.Status = TaskOpen
+	}
+	if t.Status == TaskDone && t.CompletedOn == "" {
+		t.CompletedOn = cal.today()
+	}
+	return t, true
+}
+
+// respondWithSavedTask saves t and responds with it as stored
+func respondWithSavedTask(w http.ResponseWriter, db *sql.DB, t Task, status int, cal calendar) {
+	if err := validateTask(t); err != nil {
+		respondWithValidationError(w, err)
+		return
+	}
+	err := saveTask(db, &t)
+	if _, ok := err.(ValidationErrors); ok {
+		respondWithValidationError(w, err)
+		return
+	}
+	if err == sql.ErrNoRows {
+		respondWithError(w, http.StatusNotFound, "Task not found")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	saved, err := loadTask(db, t.ID, cal)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	respondWithJSON(w, status, saved)
+}
+
+func createTask(db *sql.DB, cal calendar) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		t, ok := decodeTask(w, r, cal)
+		if !ok {
+			return
+		}
+		respondWithSavedTask(w, db, t, http.StatusCreated, cal)
+	}
+}
+
+// createLinkedTask creates a task to follow up a record of entityType, one of
+// attachmentEntities, such as getting an incident's broken door repaired,
+// linked to it
+func createLinkedTask(db *sql.DB, entityType string, cal calendar) http.HandlerFunc {
+	entity := attachmentEntities[entityType]
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id, err := strconv.Atoi(vars["id"])
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, entity.invalidID)
+			return
+		}
+
+		var exists bool
+		if err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM "+entity.table+" WHERE id = ?)", id).Scan(&exists); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if !exists {
+			respondWithError(w, http.StatusNotFound, entity.notFound)
+			return
+		}
+
+		t, ok := decodeTask(w, r, cal)
+		if !ok {
+			return
+		}
+		t.EntityType, t.EntityID = entityType, &id
+		respondWithSavedTask(w, db, t, http.StatusCreated, cal)
+	}
+}
+
+func updateTask(db *sql.DB, cal calendar) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id, err := strconv.Atoi(vars["id"])
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid task ID")
+			return
+		}
+
+		t, ok := decodeTask(w, r, cal)
+		if !ok {
+			return
+		}
+		t.ID = id
+		respondWithSavedTask(w, db, t, http.StatusOK, cal)
+	}
+}
+
+func deleteTask(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id, err := strconv.Atoi(vars["id"])
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid task ID")
+			return
+		}
+
+		result, err := db.Exec("DELETE FROM tasks WHERE id = ?", id)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			respondWithError(w, http.StatusNotFound, "Task not found")
+			return
+		}
+
+		respondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
+	}
+}
@@ -0,0 +1,131 @@
+package condomngr
+
+import (
+	"database/sql"
+	"net/http"
+)
+
+// taxTolerance is how far the tax amount of an expense may be from the tax
+// its rate gives, for invoices that round tax per line
+const taxTolerance = 0.05
+
+// includedTax is the tax included in gross at rate percent
+func includedTax(gross, rate float64) float64 {
+	return roundCents(gross * rate / (100 + rate))
+}
+
+// computeExpenseTax fills in the tax amount of an expense from its rate when
+// only the rate is given
+func computeExpenseTax(e *Expense) {
+	if e.TaxRate > 0 && e.TaxAmount == 0 {
+		e.TaxAmount = includedTax(e.Amount, e.TaxRate)
+	}
+}
+
+// TaxRateSummary totals the expenses of a tax rate
+type TaxRateSummary struct {
+	Rate     float64 `json:"rate"`
+	Expenses int     `json:"expenses"`
+	Net      float64 `json:"net"`
+	Tax      float64 `json:"tax"`
+	Gross    float64 `json:"gross"`
+}
+
+// TaxCategorySummary totals the expenses of a category
+type TaxCategorySummary struct {
+	Category string  `json:"category"`
+	Expenses int     `json:"expenses"`
+	Net      float64 `json:"net"`
+	Tax      float64 `json:"tax"`
+	Gross    float64 `json:"gross"`
+}
+
+// TaxReport summarizes the tax paid on the expenses of a fiscal year, for filing
+type TaxReport struct {
+	Year       int                  `json:"year"`
+	StartDate  string               `json:"start_date"`
+	EndDate    string               `json:"end_date"`
+	Rates      []TaxRateSummary     `json:"rates"`
+	Categories []TaxCategorySummary `json:"categories"`
+	Net        float64              `json:"net"`
+	Tax        float64              `json:"tax"`
+	Gross      float64              `json:"gross"`
+}
+
+// Get the net, tax and gross of the expenses of a fiscal year, per tax rate and
+// per category
+func getTaxReport(db *sql.DB, cal calendar) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := checkQueryParams(r, "year"); err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		year, err := statementYear(r, cal)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		report := TaxReport{Year: year, Rates: []TaxRateSummary{}, Categories: []TaxCategorySummary{}}
+		report.StartDate, report.EndDate = cal.fiscalYearDates(year)
+
+		rows, err := db.Query(`
+			SELECT tax_rate, COUNT(*), COALESCE(SUM(amount), 0), COALESCE(SUM(tax_amount), 0)
+			FROM expenses
+			WHERE substr(expense_date, 1, 10) BETWEEN ? AND ?
+			GROUP BY tax_rate
+			ORDER BY tax_rate
+		`, report.StartDate, report.EndDate)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var rate TaxRateSummary
+			if err := rows.Scan(&rate.Rate, &rate.Expenses, &rate.Gross, &rate.Tax); err != nil {
+				respondWithError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			rate.Gross, rate.Tax = roundCents(rate.Gross), roundCents(rate.Tax)
+			rate.Net = roundCents(rate.Gross - rate.Tax)
+			report.Rates = append(report.Rates, rate)
+			report.Net = roundCents(report.Net + rate.Net)
+			report.Tax = roundCents(report.Tax + rate.Tax)
+			report.Gross = roundCents(report.Gross + rate.Gross)
+		}
+		if err := rows.Err(); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		rows, err = db.Query(`
+			SELECT category, COUNT(*), COALESCE(SUM(amount), 0), COALESCE(SUM(tax_amount), 0)
+			FROM expenses
+			WHERE substr(expense_date, 1, 10) BETWEEN ? AND ?
+			GROUP BY category
+			ORDER BY category
+		`, report.StartDate, report.EndDate)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var category TaxCategorySummary
+			if err := rows.Scan(&category.Category, &category.Expenses, &category.Gross, &category.Tax); err != nil {
+				respondWithError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			category.Gross, category.Tax = roundCents(category.Gross), roundCents(category.Tax)
+			category.Net = roundCents(category.Gross - category.Tax)
+			report.Categories = append(report.Categories, category)
+		}
+		if err := rows.Err(); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		respondWithJSON(w, http.StatusOK, report)
+	}
+}
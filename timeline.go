@@ -0,0 +1,144 @@
+package condomngr
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// TimelineEntry is something that happened to a resident. ID is the id of the
+// record of its type: the payment, credit, write-off, SMS, statement mailing,
+// receipt email, maintenance request or the resident itself.
+type TimelineEntry struct {
+	Type      string    `json:"type"`
+	ID        int       `json:"id"`
+	Summary   string    `json:"summary"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// timelineQuery merges what happened to resident ?1, each normalized to the
+// CURRENT_TIMESTAMP layout so they sort and compare as text. Payments,
+// credits and write-offs are at the start of their day. Only the receipts
+// that went out are listed. Profile edits are only known by the resident's
+// last update.
+const timelineQuery = `SELECT type, id, at, summary FROM (
+	SELECT 'payment' AS type, id, strftime('%Y-%m-%d %H:%M:%S', payment_date) AS at,
+		printf('Payment of %.2f%s%s', amount, CASE WHEN description != '' THEN ': ' || description ELSE '' END,
+			CASE WHEN status != 'confirmed' THEN ' (' || status || ')' ELSE '' END) AS summary
+	FROM payments WHERE resident_id = ?1
+	UNION ALL
+	SELECT 'credit', id, strftime('%Y-%m-%d %H:%M:%S', credit_date), printf('Credit of %.2f: %s', amount, reason)
+	FROM credits WHERE resident_id = ?1
+	UNION ALL
+	SELECT 'write_off', id, strftime('%Y-%m-%d %H:%M:%S', writeoff_date),
+		printf('Write-off of %.2f: %s (%s)%s', amount, reason, decision, CASE WHEN reversed_at IS NOT NULL THEN ', reversed' ELSE '' END)
+	FROM write_offs WHERE resident_id = ?1
+	UNION ALL
+	SELECT 'sms', id, strftime('%Y-%m-%d %H:%M:%S', COALESCE(sent_at, created_at)), printf('SMS %s: %s', status, body)
+	FROM sms_messages WHERE resident_id = ?1
+	UNION ALL
+	SELECT 'statement_email', id, strftime('%Y-%m-%d %H:%M:%S', sent_at), printf('Statement through %s emailed to %s', month, email)
+	FROM statement_sends WHERE resident_id = ?1
+	UNION ALL
+	SELECT 'receipt_email', id, strftime('%Y-%m-%d %H:%M:%S', sent_at), printf('Receipt of payment #%d emailed to %s', payment_id, email)
+	FROM receipt_emails WHERE resident_id = ?1 AND status = 'sent'
+	UNION ALL
+	SELECT 'maintenance_request', id, strftime('%Y-%m-%d %H:%M:%S', created_at), printf('Maintenance request (%s): %s', status, subject)
+	FROM maintenance_requests WHERE resident_id = ?1
+	UNION ALL
+	SELECT 'resident_created', id, strftime('%Y-%m-%d %H:%M:%S', created_at), printf('Added as resident of unit %s', unit)
+	FROM residents WHERE id = ?1
+	UNION ALL
+	SELECT 'resident_updated', id, strftime('%Y-%m-%d %H:%M:%S', updated_at), 'Profile last updated'
+	FROM residents WHERE id = ?1 AND updated_at != created_at
+)`
+
+// Get everything that happened to a resident, newest first. Pages end at the
+// before cursor; the X-Next-Cursor header holds the cursor of the next page,
+// and is absent on the last one.
+func getResidentTimeline(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := checkQueryParams(r, "limit", "before"); err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		vars := mux.Vars(r)
+		id, err := strconv.Atoi(vars["id"])
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid resident ID")
+			return
+		}
+
+		conditions := []string{}
+		args := []interface{}{id}
+		if value := r.URL.Query().Get("before"); value != "" {
+			cursor, err := parseActivityCursor(value)
+			if err != nil {
+				respondWithError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			conditions = append(conditions, "(at, type, id) < (?2, ?3, ?4)")
+			args = append(args, cursor.changedAt, cursor.kind, cursor.id)
+		}
+		limit := 50
+		if value := r.URL.Query().Get("limit"); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 || n > 200 {
+				respondWithError(w, http.StatusBadRequest, "Invalid limit, must be between 1 and 200")
+				return
+			}
+			limit = n
+		}
+
+		var exists bool
+		if err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM residents WHERE id = ?)", id).Scan(&exists); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if !exists {
+			respondWithError(w, http.StatusNotFound, "Resident not found")
+			return
+		}
+
+		query := timelineQuery
+		if len(conditions) > 0 {
+			query += " WHERE " + strings.Join(conditions, " AND ")
+		}
+		// One more than a page tells whether there is a next one
+		query += " ORDER BY at DESC, type DESC, id DESC LIMIT " + strconv.Itoa(limit+1)
+		rows, err := db.Query(query, args...)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		defer rows.Close()
+
+		entries := []TimelineEntry{}
+		var last activityCursor
+		for rows.Next() {
+			if len(entries) == limit {
+				w.Header().Set("X-Next-Cursor", last.String())
+				break
+			}
+			var entry TimelineEntry
+			var at string
+			if err := rows.Scan(&entry.Type, &entry.ID, &at, &entry.Summary); err != nil {
+				respondWithError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			entry.Timestamp, _ = time.Parse(sqliteTimestamp, at)
+			entries = append(entries, entry)
+			last = activityCursor{changedAt: at, kind: entry.Type, id: entry.ID}
+		}
+		if err := rows.Err(); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		respondWithJSON(w, http.StatusOK, entries)
+	}
+}
@@ -0,0 +1,37 @@
+package condomngr
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestTimelineListsReceiptsAndMaintenanceRequests(t *testing.T) {
+	s := newTestServer(t, Options{})
+	resident := s.createResident("Ana Silva", "1A")
+	for _, query := range []string{
+		"INSERT INTO receipt_emails(payment_id, resident_id, email, status, sent_at) VALUES(7, ?1, 'ana@example.com', 'sent', '2024-03-06 10:00:00')",
+		"INSERT INTO receipt_emails(payment_id, resident_id, status) VALUES(8, ?1, 'queued')",
+		"INSERT INTO maintenance_requests(resident_id, subject, status, created_at) VALUES(?1, 'Leaking tap', 'open', '2024-03-07 09:30:00')",
+	} {
+		if _, err := s.db.Exec(query, resident.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var entries []TimelineEntry
+	s.expect(http.StatusOK, "GET", fmt.Sprint("/api/v1/residents/", resident.ID, "/timeline"), nil, &entries)
+	summaries := map[string][]string{}
+	for _, entry := range entries {
+		summaries[entry.Type] = append(summaries[entry.Type], entry.Summary)
+	}
+	if got := summaries["receipt_email"]; len(got) != 1 || got[0] != "Receipt of payment #7 emailed to ana@example.com" {
+		t.Errorf("receipt emails %q", got)
+	}
+	if got := summaries["maintenance_request"]; len(got) != 1 || got[0] != "Maintenance request (open): Leaking tap" {
+		t.Errorf("maintenance requests %q", got)
+	}
+	if entries[0].Type != "resident_created" || entries[1].Type != "maintenance_request" {
+		t.Errorf("order %+v", entries)
+	}
+}
@@ -0,0 +1,67 @@
+package condomngr
+
+import (
+	"net/http"
+	"time"
+)
+
+// calendar is how a condo reads dates: the timezone it operates in, which
+// decides what "today" and "this month" mean independent of the server's
+// clock, and the month its fiscal year starts in. From Options.Location and
+// Options.FiscalYearStart.
+type calendar struct {
+	location        *time.Location
+	fiscalYearStart int
+}
+
+// loadLocation resolves the -timezone flag; an empty name keeps the server's
+// local timezone
+func loadLocation(name string) (*time.Location, error) {
+	if name == "" {
+		return time.Local, nil
+	}
+	return time.LoadLocation(name)
+}
+
+// now returns the current time in the condo's timezone
+func (c calendar) now() time.Time {
+	return time.Now().In(c.location)
+}
+
+// today returns the current date in the condo's timezone as YYYY-MM-DD
+func (c calendar) today() string {
+	return c.now().Format("2006-01-02")
+}
+
+// normalizeDate accepts a YYYY-MM-DD date or an RFC 3339 timestamp and returns
+// the calendar date as YYYY-MM-DD. Timestamps keep the date as written in their
+// own offset, so "2024-01-31T23:30:00-05:00" stays on the 31st. Values that
+// are neither are returned unchanged for validation to reject.
+func normalizeDate(value string) string {
+	if _, err := time.Parse("2006-01-02", value); err == nil {
+		return value
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t.Format("2006-01-02")
+	}
+	return value
+}
+
+// Get the settings clients need to interpret dates and amounts
+func getAppConfig(currency string, cal calendar) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		now := cal.now()
+		year := cal.fiscalYearOf(now)
+		start, end := cal.fiscalYearDates(year)
+		respondWithJSON(w, http.StatusOK, map[string]interface{}{
+			"timezone":               cal.location.String(),
+			"utc_offset":             now.Format("-07:00"),
+			"today":                  now.Format("2006-01-02"),
+			"currency":               currency,
+			"fiscal_year_start":      cal.fiscalYearStart,
+			"fiscal_year":            year,
+			"fiscal_year_start_date": start,
+			"fiscal_year_end_date":   end,
+		})
+	}
+}
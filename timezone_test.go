@@ -0,0 +1,68 @@
+package condomngr
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// TestMonthBoundariesAcrossTimezones records payments and expenses on the
+// first and last days of months, some as timestamps whose offset puts them in
+// another month in UTC, and checks each lands in the month of its calendar
+// date whatever the server's and the condominium's timezones
+func TestMonthBoundariesAcrossTimezones(t *testing.T) {
+	entries := []struct {
+		date   string
+		amount float64
+	}{
+		{"2024-01-31", 1},
+		{"2024-02-01", 2},
+		{"2024-02-29T23:30:00-05:00", 4}, // March 1st in UTC
+		{"2024-03-01T00:30:00+09:00", 8}, // February 29th in UTC
+		{"2024-03-31", 16},
+	}
+	want := map[string]float64{"2024-01": 1, "2024-02": 6, "2024-03": 24}
+
+	local := time.Local
+	defer func() { time.Local = local }()
+	for _, zone := range []*time.Location{time.UTC, time.FixedZone("UTC+14", 14*3600), time.FixedZone("UTC-11", -11*3600)} {
+		t.Run(zone.String(), func(t *testing.T) {
+			time.Local = zone
+			s := newTestServer(t, Options{Location: zone})
+			resident := s.createResident("Ana Silva", "1A")
+			for _, entry := range entries {
+				s.expect(http.StatusCreated, "POST", "/api/v1/payments", map[string]interface{}{
+					"resident_id": resident.ID, "amount": entry.amount, "description": "Dues", "payment_date": entry.date,
+				}, nil)
+				s.expect(http.StatusCreated, "POST", "/api/v1/expenses", map[string]interface{}{
+					"amount": entry.amount, "description": "Repair", "expense_date": entry.date, "category": "Maintenance",
+				}, nil)
+			}
+
+			var statement Statement
+			s.expect(http.StatusOK, "GET", fmt.Sprintf("/api/v1/residents/%d/statement?year=2024", resident.ID), nil, &statement)
+			paid := map[string]float64{}
+			for _, month := range statement.Months {
+				if month.Paid != 0 {
+					paid[month.Month] = month.Paid
+				}
+			}
+			if fmt.Sprint(paid) != fmt.Sprint(want) {
+				t.Errorf("paid per month %v, want %v", paid, want)
+			}
+
+			var budget BudgetDrillDown
+			s.expect(http.StatusOK, "GET", "/api/v1/reports/budget/2024/Maintenance", nil, &budget)
+			spent := map[string]float64{}
+			for _, month := range budget.Months {
+				if month.Actual != 0 {
+					spent[month.Month] = month.Actual
+				}
+			}
+			if fmt.Sprint(spent) != fmt.Sprint(want) {
+				t.Errorf("spent per month %v, want %v", spent, want)
+			}
+		})
+	}
+}
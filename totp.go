@@ -0,0 +1,433 @@
+package condomngr
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"database/sql"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// TOTP parameters, the defaults of authenticator apps (RFC 6238): six digit
+// codes of HMAC-SHA1, changing every totpPeriod. Codes of totpSkew steps
+// before and after now are accepted, for clocks that drift.
+const (
+	totpPeriod = 30 * time.Second
+	totpSkew   = 1
+	totpIssuer = "condomngr"
+)
+
+// recoveryCodeCount recovery codes are made at enrollment, each usable once
+const recoveryCodeCount = 10
+
+// loginChallengeTTL is how long the second step of a sign-in can wait
+const loginChallengeTTL = 5 * time.Minute
+
+// settingRequireTwoFactor is the setting that refuses sessions of users
+// without two-factor authentication
+const settingRequireTwoFactor = "require_two_factor"
+
+var (
+	errTwoFactorEnabled    = errors.New("two-factor authentication is already on")
+	errTwoFactorNotStarted = errors.New("two-factor enrollment was not started")
+	errInvalidTwoFactor    = errors.New("invalid two-factor code")
+)
+
+// TwoFactorEnrollment starts two-factor authentication. The secret and the
+// recovery codes are only shown this once.
+type TwoFactorEnrollment struct {
+	Secret        string   `json:"secret"`
+	OTPAuthURI    string   `json:"otpauth_uri"`
+	QRCodeSVG     string   `json:"qr_code_svg,omitempty"` // the otpauth URI, to scan with an authenticator app
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+// TwoFactorCode is a code from an authenticator app
+type TwoFactorCode struct {
+	Code string `json:"code"`
+}
+
+// LoginChallenge answers a correct password of a user with two-factor
+// authentication on: the sign-in is completed with the challenge and a code.
+type LoginChallenge struct {
+	TwoFactorRequired bool      `json:"two_factor_required"`
+	Challenge         string    `json:"challenge"`
+	ExpiresAt         time.Time `json:"expires_at"`
+}
+
+// TwoFactorLoginRequest completes a sign-in with a code from the
+// authenticator app or a recovery code
+type TwoFactorLoginRequest struct {
+	Challenge string `json:"challenge"`
+	Code      string `json:"code"`
+}
+
+// TwoFactorPolicy tells whether sessions need two-factor authentication
+type TwoFactorPolicy struct {
+	Required bool `json:"required"`
+}
+
+// totpCode is the code of secret at a time step
+func totpCode(secret []byte, step int64) string {
+	mac := hmac.New(sha1.New, secret)
+	binary.Write(mac, binary.BigEndian, step)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+	return fmt.Sprintf("%06d", value%1000000)
+}
+
+// matchTOTP returns the time step code is valid at near now, or 0. Steps up
+// to lastStep were used already and are refused, so a code works once.
+func matchTOTP(secret []byte, code string, lastStep int64, now time.Time) int64 {
+	current := now.Unix() / int64(totpPeriod/time.Second)
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step > lastStep && hmac.Equal([]byte(totpCode(secret, step)), []byte(code)) {
+			return step
+		}
+	}
+	return 0
+}
+
+var base32NoPadding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// normalizeCode strips the spaces and dashes people type in codes
+func normalizeCode(code string) string {
+	return strings.ToLower(strings.NewReplacer(" ", "", "-", "").Replace(code))
+}
+
+// startTwoFactor makes a new secret and recovery codes for a user who doesn't
+// have two-factor authentication on yet, replacing an unfinished enrollment
+func startTwoFactor(db *sql.DB, user User) (TwoFactorEnrollment, error) {
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		return TwoFactorEnrollment{}, err
+	}
+	enrollment := TwoFactorEnrollment{Secret: base32NoPadding.EncodeToString(secret)}
+	enrollment.OTPAuthURI = fmt.Sprintf("otpauth://totp/%s:%s?secret=%s&issuer=%s",
+		url.PathEscape(totpIssuer), url.PathEscape(user.Username), enrollment.Secret, url.QueryEscape(totpIssuer))
+	if modules, err := qrCode(enrollment.OTPAuthURI); err == nil {
+		enrollment.QRCodeSVG = qrSVG(modules)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return TwoFactorEnrollment{}, err
+	}
+	defer tx.Rollback()
+	result, err := tx.Exec("UPDATE users SET totp_secret = ?, totp_last_step = 0 WHERE id = ? AND totp_enabled = 0", enrollment.Secret, user.ID)
+	if err != nil {
+		return TwoFactorEnrollment{}, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return TwoFactorEnrollment{}, err
+	}
+	if n == 0 {
+		return TwoFactorEnrollment{}, errTwoFactorEnabled
+	}
+	if _, err := tx.Exec("DELETE FROM recovery_codes WHERE user_id = ?", user.ID); err != nil {
+		return TwoFactorEnrollment{}, err
+	}
+	for i := 0; i < recoveryCodeCount; i++ {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return TwoFactorEnrollment{}, err
+		}
+		code := strings.ToLower(base32NoPadding.EncodeToString(b))
+		enrollment.RecoveryCodes = append(enrollment.RecoveryCodes, code[:4]+"-"+code[4:])
+		if _, err := tx.Exec("INSERT INTO recovery_codes(user_id, code_hash) VALUES(?, ?)", user.ID, hashToken(code)); err != nil {
+			return TwoFactorEnrollment{}, err
+		}
+	}
+	return enrollment, tx.Commit()
+}
+
+// activateTwoFactor turns two-factor authentication on once the user shows a
+// code of the secret of their enrollment
+func activateTwoFactor(db *sql.DB, userID int, code string) error {
+	var secret string
+	var enabled bool
+	if err := db.QueryRow("SELECT totp_secret, totp_enabled FROM users WHERE id = ?", userID).Scan(&secret, &enabled); err != nil {
+		return err
+	}
+	if enabled {
+		return errTwoFactorEnabled
+	}
+	if secret == "" {
+		return errTwoFactorNotStarted
+	}
+	key, err := base32NoPadding.DecodeString(secret)
+	if err != nil {
+		return err
+	}
+	step := matchTOTP(key, normalizeCode(code), 0, time.Now())
+	if step == 0 {
+		return errInvalidTwoFactor
+	}
+	_, err = db.Exec("UPDATE users SET totp_enabled = 1, totp_last_step = ? WHERE id = ?", step, userID)
+	return err
+}
+
+// verifySecondFactor checks a code from the authenticator app, or else an
+// unused recovery code, using it up
+func verifySecondFactor(db *sql.DB, userID int, code string) (bool, error) {
+	code = normalizeCode(code)
+	var secret string
+	var lastStep int64
+	err := db.QueryRow("SELECT totp_secret, totp_last_step FROM users WHERE id = ? AND totp_enabled = 1", userID).Scan(&secret, &lastStep)
+	if err == sql.ErrNoRows {
+		// Reset by an admin since the password was checked
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	key, err := base32NoPadding.DecodeString(secret)
+	if err != nil {
+		return false, err
+	}
+	if step := matchTOTP(key, code, lastStep, time.Now()); step != 0 {
+		// Guarded, so two requests can't both use the code
+		result, err := db.Exec("UPDATE users SET totp_last_step = ? WHERE id = ? AND totp_last_step < ?", step, userID, step)
+		if err != nil {
+			return false, err
+		}
+		n, err := result.RowsAffected()
+		return n > 0, err
+	}
+
+	result, err := db.Exec("UPDATE recovery_codes SET used_at = ? WHERE user_id = ? AND code_hash = ? AND used_at IS NULL",
+		time.Now().UTC(), userID, hashToken(code))
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	if n > 0 {
+		log.Printf("User %d signed in with a recovery code", userID)
+	}
+	return n > 0, err
+}
+
+// resetTwoFactor turns two-factor authentication off for a user who lost
+// their authenticator, reporting whether it was on or being enrolled
+func resetTwoFactor(db *sql.DB, userID int) (bool, error) {
+	result, err := db.Exec("UPDATE users SET totp_secret = '', totp_enabled = 0, totp_last_step = 0 WHERE id = ? AND totp_secret != ''", userID)
+	if err != nil {
+		return false, err
+	}
+	if _, err := db.Exec("DELETE FROM recovery_codes WHERE user_id = ?", userID); err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// twoFactorRequired reports whether sessions need two-factor authentication
+func twoFactorRequired(db *sql.DB) (bool, error) {
+	value, _, err := getSetting(db, settingRequireTwoFactor)
+	return value == "true", err
+}
+
+// createLoginChallenge stores the first step of the sign-in of user from r
+func createLoginChallenge(db *sql.DB, user User, r *http.Request) (LoginChallenge, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return LoginChallenge{}, err
+	}
+	challenge := LoginChallenge{
+		TwoFactorRequired: true,
+		Challenge:         base64.RawURLEncoding.EncodeToString(b),
+		ExpiresAt:         time.Now().UTC().Add(loginChallengeTTL),
+	}
+	_, err := db.Exec("INSERT INTO login_challenges(user_id, token_hash, ip, expires_at) VALUES(?, ?, ?, ?)",
+		user.ID, hashToken(challenge.Challenge), clientIP(r), challenge.ExpiresAt)
+	return challenge, err
+}
+
+// findLoginChallenge returns the enabled user of an unexpired challenge
+func findLoginChallenge(db *sql.DB, challenge string) (User, error) {
+	row := db.QueryRow(`
+		SELECT u.id, u.username, u.email, u.role, u.disabled, u.must_change_password, u.totp_enabled, u.created_at, u.updated_at
+		FROM login_challenges c JOIN users u ON u.id = c.user_id
+		WHERE c.token_hash = ? AND c.expires_at > ? AND u.disabled = 0
+	`, hashToken(challenge), time.Now().UTC())
+	return scanUser(row)
+}
+
+// respondWithTwoFactorError maps two-factor errors to responses
+func respondWithTwoFactorError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errTwoFactorEnabled):
+		respondWithError(w, http.StatusConflict, "Two-factor authentication is already on")
+	case errors.Is(err, errTwoFactorNotStarted):
+		respondWithError(w, http.StatusConflict, "Start two-factor enrollment first")
+	case errors.Is(err, errInvalidTwoFactor):
+		respondWithError(w, http.StatusBadRequest, "Invalid two-factor code")
+	default:
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+	}
+}
+
+// Handlers for two-factor endpoints
+
+// Start two-factor enrollment of the signed-in user
+func postTwoFactorEnroll(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session, ok := requireSessionToEnroll(db, w, r)
+		if !ok {
+			return
+		}
+		enrollment, err := startTwoFactor(db, session.User)
+		if err != nil {
+			respondWithTwoFactorError(w, err)
+			return
+		}
+		respondWithJSON(w, http.StatusOK, enrollment)
+	}
+}
+
+// Turn two-factor authentication on with a code of the enrolled secret
+func postTwoFactorActivate(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session, ok := requireSessionToEnroll(db, w, r)
+		if !ok {
+			return
+		}
+		var req TwoFactorCode
+		if err := decodeRequest(r, &req); err != nil {
+			respondWithError(w, payloadErrorStatus(err), "Invalid request payload: "+err.Error())
+			return
+		}
+		defer r.Body.Close()
+
+		if err := activateTwoFactor(db, session.User.ID, req.Code); err != nil {
+			respondWithTwoFactorError(w, err)
+			return
+		}
+		respondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
+	}
+}
+
+// Complete a sign-in with a code from the authenticator app or a recovery
+// code. Wrong codes count as failed sign-ins.
+func loginTwoFactor(db *sql.DB, guard *LoginGuard) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req TwoFactorLoginRequest
+		if err := decodeRequest(r, &req); err != nil {
+			respondWithError(w, payloadErrorStatus(err), "Invalid request payload: "+err.Error())
+			return
+		}
+		defer r.Body.Close()
+
+		user, err := findLoginChallenge(db, req.Challenge)
+		if err == sql.ErrNoRows {
+			respondWithError(w, http.StatusUnauthorized, "Sign-in expired, sign in again")
+			return
+		}
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		ip := clientIP(r)
+		if !loginAllowed(w, guard, user.Username, ip) {
+			return
+		}
+		ok, err := verifySecondFactor(db, user.ID, req.Code)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if !ok {
+			if err := guard.Fail(user.Username, ip); err != nil {
+				log.Printf("Failed to record a failed sign-in: %v", err)
+			}
+			respondWithError(w, http.StatusUnauthorized, "Invalid two-factor code")
+			return
+		}
+
+		if _, err := db.Exec("DELETE FROM login_challenges WHERE token_hash = ? OR expires_at <= ?", hashToken(req.Challenge), time.Now().UTC()); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		signIn(w, r, db, guard, user)
+	}
+}
+
+// Turn off the two-factor authentication of a user who lost their
+// authenticator and recovery codes
+func deleteUserTwoFactor(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := requireAdmin(db, w, r); !ok {
+			return
+		}
+		id, err := strconv.Atoi(mux.Vars(r)["id"])
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid user ID")
+			return
+		}
+		if _, err := findUser(db, id); err != nil {
+			respondWithUserError(w, err)
+			return
+		}
+		reset, err := resetTwoFactor(db, id)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if !reset {
+			respondWithError(w, http.StatusNotFound, "The user doesn't have two-factor authentication")
+			return
+		}
+		respondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
+	}
+}
+
+// Get whether sessions need two-factor authentication
+func getTwoFactorPolicy(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := requireAdmin(db, w, r); !ok {
+			return
+		}
+		required, err := twoFactorRequired(db)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		respondWithJSON(w, http.StatusOK, TwoFactorPolicy{Required: required})
+	}
+}
+
+// Set whether sessions need two-factor authentication
+func putTwoFactorPolicy(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := requireAdmin(db, w, r); !ok {
+			return
+		}
+		var req TwoFactorPolicy
+		if err := decodeRequest(r, &req); err != nil {
+			respondWithError(w, payloadErrorStatus(err), "Invalid request payload: "+err.Error())
+			return
+		}
+		defer r.Body.Close()
+
+		if err := setSetting(db, settingRequireTwoFactor, strconv.FormatBool(req.Required)); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		respondWithJSON(w, http.StatusOK, req)
+	}
+}
@@ -0,0 +1,39 @@
+package condomngr
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestTwoFactorEndpointsRequireSignIn(t *testing.T) {
+	s := newTestServer(t, Options{})
+	viewer := s.signIn("victor", RoleViewer)
+	var victorID int
+	if err := s.db.QueryRow("SELECT id FROM users WHERE username = 'victor'").Scan(&victorID); err != nil {
+		t.Fatal(err)
+	}
+	reset := fmt.Sprintf("/api/v1/users/%d/2fa", victorID)
+
+	// Anyone signed in enrolls themselves, only admins reset others
+	s.expect(http.StatusUnauthorized, "POST", "/api/v1/auth/2fa/enroll", nil, nil)
+	s.expect(http.StatusUnauthorized, "POST", "/api/v1/auth/2fa/activate", TwoFactorCode{Code: "000000"}, nil)
+	s.expect(http.StatusUnauthorized, "DELETE", reset, nil, nil)
+	s.token = viewer
+	s.expect(http.StatusForbidden, "DELETE", reset, nil, nil)
+
+	var enrollment TwoFactorEnrollment
+	s.expect(http.StatusOK, "POST", "/api/v1/auth/2fa/enroll", nil, &enrollment)
+	key, err := base32NoPadding.DecodeString(enrollment.Secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := totpCode(key, time.Now().Unix()/int64(totpPeriod/time.Second))
+	s.expect(http.StatusOK, "POST", "/api/v1/auth/2fa/activate", TwoFactorCode{Code: code}, nil)
+	s.expect(http.StatusForbidden, "DELETE", reset, nil, nil)
+
+	s.token = s.signIn("alice", RoleAdmin)
+	s.expect(http.StatusOK, "DELETE", reset, nil, nil)
+	s.expect(http.StatusNotFound, "DELETE", reset, nil, nil)
+}
@@ -0,0 +1,421 @@
+package condomngr
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// What happens to what the previous owners of a unit owe when it is sold
+const (
+	TransferFreeze = "freeze" // it stays with them
+	TransferCarry  = "carry"  // the new owner takes it over
+)
+
+// UnitTransferRequest hands a unit over to a new owner on the transfer date:
+// either an existing resident (new_resident_id) or one added with it
+// (new_owner).
+type UnitTransferRequest struct {
+	TransferDate  string    `json:"transfer_date"` // YYYY-MM-DD, the handover day, today if empty
+	NewResidentID int       `json:"new_resident_id"`
+	NewOwner      *Resident `json:"new_owner"`
+	Balance       string    `json:"balance"` // TransferFreeze if empty
+	Notes         string    `json:"notes"`
+}
+
+// TransferOwner is a previous owner of a transferred unit, with what they
+// owed on the transfer and how much of it the new owner took over
+type TransferOwner struct {
+	ResidentID int     `json:"resident_id"`
+	Name       string  `json:"name"`
+	Balance    float64 `json:"balance"`
+	Carried    float64 `json:"carried"`
+}
+
+// UnitTransfer records a unit changing owners. Previous owners living there
+// move out on the transfer date and the new owner moves in.
+type UnitTransfer struct {
+	ID             int             `json:"id"`
+	Unit           string          `json:"unit"`
+	TransferDate   string          `json:"transfer_date"`
+	PreviousOwners []TransferOwner `json:"previous_owners"`
+	NewOwnerID     int             `json:"new_owner_id"`
+	NewOwnerName   string          `json:"new_owner_name"`
+	Balance        string          `json:"balance"`
+	Notes          string          `json:"notes"`
+	CreatedAt      time.Time       `json:"created_at"`
+}
+
+// UnitOwner is a resident who lived in a unit, and when
+type UnitOwner struct {
+	ResidentID  int    `json:"resident_id"`
+	Name        string `json:"name"`
+	MoveInDate  string `json:"move_in_date"`
+	MoveOutDate string `json:"move_out_date"`
+	Current     bool   `json:"current"`
+}
+
+// UnitHistory is the ownership chain of a unit, oldest first
+type UnitHistory struct {
+	Unit      string         `json:"unit"`
+	Owners    []UnitOwner    `json:"owners"`
+	Transfers []UnitTransfer `json:"transfers"`
+}
+
+// transferConflict is a transfer that doesn't fit the unit's residents
+type transferConflict string
+
+func (e transferConflict) Error() string { return string(e) }
+
+// Validation function for UnitTransferRequest data
+func validateUnitTransfer(t UnitTransferRequest) error {
+	var errs ValidationErrors
+	if _, err := time.Parse("2006-01-02", t.TransferDate); err != nil {
+		errs.Add("transfer_date", "invalid date format, must be YYYY-MM-DD")
+	}
+	if (t.NewResidentID == 0) == (t.NewOwner == nil) {
+		errs.Add("new_owner", "give new_resident_id or new_owner, not both")
+	}
+	if t.Balance != TransferFreeze && t.Balance != TransferCarry {
+		errs.Add("balance", "balance must be freeze or carry")
+	}
+	return errs.Err()
+}
+
+// loadUnitTransfers returns the transfers of a unit, oldest first, or the one
+// with id if it isn't zero
+func loadUnitTransfers(q querier, unit string, id int) ([]UnitTransfer, error) {
+	rows, err := q.Query(`
+		SELECT t.id, t.unit, t.transfer_date, t.new_owner_id, COALESCE(r.name, ''), t.balance, t.notes, t.created_at
+		FROM unit_transfers t LEFT JOIN residents r ON r.id = t.new_owner_id
+		WHERE (?1 = 0 AND t.unit = ?2) OR t.id = ?1
+		ORDER BY t.transfer_date, t.id
+	`, id, unit)
+	if err != nil {
+		return nil, err
+	}
+	transfers := []UnitTransfer{}
+	for rows.Next() {
+		t := UnitTransfer{PreviousOwners: []TransferOwner{}}
+		if err := rows.Scan(&t.ID, &t.Unit, &t.TransferDate, &t.NewOwnerID, &t.NewOwnerName, &t.Balance, &t.Notes, &t.CreatedAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		transfers = append(transfers, t)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i, t := range transfers {
+		rows, err := q.Query(`
+			SELECT o.resident_id, COALESCE(r.name, ''), o.balance, o.carried
+			FROM unit_transfer_owners o LEFT JOIN residents r ON r.id = o.resident_id
+			WHERE o.transfer_id = ? ORDER BY o.resident_id
+		`, t.ID)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var o TransferOwner
+			if err := rows.Scan(&o.ResidentID, &o.Name, &o.Balance, &o.Carried); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			transfers[i].PreviousOwners = append(transfers[i].PreviousOwners, o)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return transfers, nil
+}
+
+// previousOwners are the residents a unit is transferred from on date: those
+// living there, or else its owner of record. Nobody may move in on or after
+// the transfer date but the new owner.
+func previousOwners(residents []unitResident, date string, newOwnerID int) ([]unitResident, error) {
+	var owners []unitResident
+	for _, r := range residents {
+		if r.ResidentID == newOwnerID {
+			continue
+		}
+		if r.MoveInDate != "" && r.MoveInDate >= date {
+			return nil, transferConflict("Someone moves into the unit on or after the transfer date")
+		}
+		if r.livesOn(date) {
+			owners = append(owners, r)
+		}
+	}
+	if len(owners) == 0 {
+		if owner := ownerOfRecord(residents, date); owner != nil {
+			owners = append(owners, *owner)
+		}
+	}
+	return owners, nil
+}
+
+// Handlers for unit transfer endpoints
+
+// Transfer a unit to a new owner (admins only)
+func transferUnit(db *sql.DB, changes *ChangeBroker, cal calendar, rules paymentRules) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := requireAdmin(db, w, r); !ok {
+			return
+		}
+		unit := mux.Vars(r)["unit"]
+
+		var t UnitTransferRequest
+		if err := decodeRequest(r, &t); err != nil {
+			respondWithError(w, payloadErrorStatus(err), "Invalid request payload: "+err.Error())
+			return
+		}
+		defer r.Body.Close()
+
+		if t.TransferDate == "" {
+			t.TransferDate = cal.today()
+		}
+		if t.Balance == "" {
+			t.Balance = TransferFreeze
+		}
+		if err := validateUnitTransfer(t); err != nil {
+			respondWithValidationError(w, err)
+			return
+		}
+		var values map[int]*string
+		if t.NewOwner != nil {
+			t.NewOwner.Unit, t.NewOwner.MoveInDate, t.NewOwner.MoveOutDate = unit, t.TransferDate, ""
+			if err := validateResident(*t.NewOwner); err != nil {
+				respondWithValidationError(w, err)
+				return
+			}
+			fields, err := customFields(db)
+			if err != nil {
+				respondWithError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			if values, err = customValues(fields, t.NewOwner.Custom); err != nil {
+				respondWithValidationError(w, err)
+				return
+			}
+		}
+
+		units, residents, err := loadUnitResidents(db)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		i := sort.SearchStrings(units, unit)
+		if i == len(units) || units[i] != unit {
+			respondWithError(w, http.StatusNotFound, "Unit not found")
+			return
+		}
+
+		var later bool
+		if err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM unit_transfers WHERE unit = ? AND transfer_date >= ?)", unit, t.TransferDate).Scan(&later); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if later {
+			respondWithError(w, http.StatusConflict, "The unit was already transferred on or after this date")
+			return
+		}
+
+		var newOwner Resident
+		if t.NewResidentID != 0 {
+			newOwner, err = scanResidentRow(db.QueryRow("SELECT "+residentColumns+" FROM residents WHERE id = ?", t.NewResidentID))
+			if err == sql.ErrNoRows {
+				respondWithError(w, http.StatusNotFound, "Resident not found")
+				return
+			}
+			if err != nil {
+				respondWithError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			// Only a resident without a unit, or one registered as moving in,
+			// can be linked without rewriting where they lived
+			movingIn := newOwner.Unit == unit && newOwner.MoveOutDate == "" && (newOwner.MoveInDate == "" || newOwner.MoveInDate >= t.TransferDate)
+			if newOwner.Unit != "" && !movingIn {
+				respondWithError(w, http.StatusConflict, "The new owner already lives or lived in a unit, add them as new_owner instead")
+				return
+			}
+		}
+		owners, err := previousOwners(residents[unit], t.TransferDate, t.NewResidentID)
+		if err != nil {
+			respondWithError(w, http.StatusConflict, err.Error())
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		defer tx.Rollback()
+
+		created := t.NewOwner != nil
+		if created {
+			newOwner = *t.NewOwner
+			result, err := tx.Exec("INSERT INTO residents(name, unit, contact, email, notify_channel, move_in_date, move_out_date) VALUES(?, ?, ?, ?, ?, ?, ?)",
+				newOwner.Name, newOwner.Unit, newOwner.Contact, newOwner.Email, newOwner.NotifyChannel, newOwner.MoveInDate, newOwner.MoveOutDate)
+			if err != nil {
+				respondWithError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			id, err := result.LastInsertId()
+			if err != nil {
+				respondWithError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			newOwner.ID = int(id)
+			if err := storeCustomValues(tx, newOwner.ID, values, true); err != nil {
+				respondWithError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			if err := setNotificationPreferences(tx, newOwner.ID, newOwner.notificationPreferences(), NotificationsByAdmin); err != nil {
+				respondWithError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+		} else {
+			_, err := tx.Exec("UPDATE residents SET unit = ?, move_in_date = ?, move_out_date = '', updated_at = CURRENT_TIMESTAMP WHERE id = ?",
+				unit, t.TransferDate, newOwner.ID)
+			if err != nil {
+				respondWithError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+		}
+
+		result, err := tx.Exec("INSERT INTO unit_transfers(unit, transfer_date, new_owner_id, balance, notes) VALUES(?, ?, ?, ?, ?)",
+			unit, t.TransferDate, newOwner.ID, t.Balance, t.Notes)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		transferID, err := result.LastInsertId()
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		var carried float64
+		for _, owner := range owners {
+			if owner.livesOn(t.TransferDate) {
+				_, err := tx.Exec("UPDATE residents SET move_out_date = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?", t.TransferDate, owner.ResidentID)
+				if err != nil {
+					respondWithError(w, http.StatusInternalServerError, err.Error())
+					return
+				}
+			}
+			balance, err := residentBalance(tx, owner.ResidentID)
+			if err != nil {
+				respondWithError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+
+			// The previous owner is credited what they owe and the new owner
+			// charged it, due on the transfer date
+			var carry float64
+			if t.Balance == TransferCarry && balance.Balance > 0 {
+				carry = balance.Balance
+				_, err := tx.Exec("INSERT INTO credits(resident_id, amount, reason, credit_date) VALUES(?, ?, ?, ?)",
+					owner.ResidentID, carry, fmt.Sprintf("Balance carried to %s on the transfer of unit %s", newOwner.Name, unit), t.TransferDate)
+				if err != nil {
+					respondWithError(w, http.StatusInternalServerError, err.Error())
+					return
+				}
+				_, err = tx.Exec(`
+					INSERT INTO charges(resident_id, kind, period, description, amount, due_date)
+					VALUES(?, ?, ?, ?, ?, ?)
+				`, newOwner.ID, ChargeKindTransfer, fmt.Sprintf("T%d-%d", transferID, owner.ResidentID),
+					fmt.Sprintf("Balance carried from %s on the transfer of unit %s", owner.Name, unit), carry, t.TransferDate)
+				if err != nil {
+					respondWithError(w, http.StatusInternalServerError, err.Error())
+					return
+				}
+				carried = roundCents(carried + carry)
+			}
+			_, err = tx.Exec("INSERT INTO unit_transfer_owners(transfer_id, resident_id, balance, carried) VALUES(?, ?, ?, ?)",
+				transferID, owner.ResidentID, balance.Balance, carry)
+			if err != nil {
+				respondWithError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+		}
+		if carried > 0 {
+			if err := reallocate(tx, rules, newOwner.ID); err != nil {
+				respondWithError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+		}
+
+		detail := fmt.Sprintf("transfer %d on %s to resident %d, balance %s, %.2f carried", transferID, t.TransferDate, newOwner.ID, t.Balance, carried)
+		if err := recordAudit(tx, r, AuditUnitTransfer, "unit "+unit, detail); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		transfers, err := loadUnitTransfers(tx, unit, int(transferID))
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		if created {
+			changes.Publish(Change{Type: "resident", ID: newOwner.ID, Action: ChangeCreated})
+		} else {
+			changes.Publish(Change{Type: "resident", ID: newOwner.ID, Action: ChangeUpdated})
+		}
+		for _, owner := range owners {
+			changes.Publish(Change{Type: "resident", ID: owner.ResidentID, Action: ChangeUpdated})
+		}
+		respondWithJSON(w, http.StatusCreated, transfers[0])
+	}
+}
+
+// Get the ownership chain of a unit: who lived there and when, and its
+// transfers
+func getUnitHistory(db *sql.DB, cal calendar) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		unit := mux.Vars(r)["unit"]
+
+		units, residents, err := loadUnitResidents(db)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		i := sort.SearchStrings(units, unit)
+		if i == len(units) || units[i] != unit {
+			respondWithError(w, http.StatusNotFound, "Unit not found")
+			return
+		}
+
+		history := UnitHistory{Unit: unit, Owners: []UnitOwner{}}
+		date := cal.today()
+		for _, resident := range residents[unit] {
+			history.Owners = append(history.Owners, UnitOwner{
+				ResidentID:  resident.ResidentID,
+				Name:        resident.Name,
+				MoveInDate:  resident.MoveInDate,
+				MoveOutDate: resident.MoveOutDate,
+				Current:     resident.livesOn(date),
+			})
+		}
+		sort.SliceStable(history.Owners, func(i, j int) bool {
+			return history.Owners[i].MoveInDate < history.Owners[j].MoveInDate
+		})
+		if history.Transfers, err = loadUnitTransfers(db, unit, 0); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		respondWithJSON(w, http.StatusOK, history)
+	}
+}
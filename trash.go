@@ -0,0 +1,419 @@
+package condomngr
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// defaultTrashRetention is how long deleted records stay in the trash
+const defaultTrashRetention = 30 * 24 * time.Hour
+
+// TrashEntry is a deleted resident, payment or expense. Record is the
+// snapshot taken when it was deleted, in the same format the API returns it.
+type TrashEntry struct {
+	ID        int         `json:"id"`
+	Type      string      `json:"type"` // resident, payment or expense
+	EntityID  int         `json:"entity_id"`
+	Record    interface{} `json:"record"`
+	DeletedAt time.Time   `json:"deleted_at"`
+	DeletedBy string      `json:"deleted_by"`
+}
+
+// trashKind describes how records of one type are put in the trash and
+// taken out again
+type trashKind struct {
+	table   string
+	query   string // SELECT of the columns scan reads, without WHERE
+	scan    rowScanner
+	restore func(tx *sql.Tx, snapshot []byte, rules paymentRules) (interface{}, error)
+}
+
+var trashKinds = map[string]trashKind{
+	"resident": {
+		table:   "residents",
+		query:   "SELECT " + residentColumns + " FROM residents",
+		scan:    scanResident,
+		restore: restoreResident,
+	},
+	"payment": {
+		table:   "payments",
+		query:   "SELECT id, resident_id, amount, description, payment_date, method, status, reference, bank_reference, cheque_number, cheque_bank, cheque_status, cheque_status_date, created_at, updated_at FROM payments",
+		scan:    scanPayment,
+		restore: restorePayment,
+	},
+	"expense": {
+		table:   "expenses",
+		query:   "SELECT " + expenseColumns + " FROM expenses",
+		scan:    scanExpense,
+		restore: restoreExpense,
+	},
+}
+
+// restoreConflict is a restore refused because of the current data, such as
+// the id being taken again
+type restoreConflict string
+
+func (e restoreConflict) Error() string { return string(e) }
+
+// moveToTrash deletes the rows of kind matching where, keeping a snapshot of
+// each in the trash. It returns the number of rows deleted.
+func moveToTrash(tx *sql.Tx, rules paymentRules, kind, where string, args ...interface{}) (int, error) {
+	k := trashKinds[kind]
+	rows, err := tx.Query(k.query+" WHERE "+where, args...)
+	if err != nil {
+		return 0, err
+	}
+	ids := []int{}
+	snapshots := [][]byte{}
+	residents := map[int]bool{}
+	for rows.Next() {
+		record, err := k.scan(rows)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		switch r := record.(type) {
+		case Resident:
+			ids = append(ids, r.ID)
+		case Payment:
+			ids = append(ids, r.ID)
+			residents[r.ResidentID] = true
+		case Expense:
+			ids = append(ids, r.ID)
+		}
+		snapshot, err := json.Marshal(record)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	stmt, err := tx.Prepare("INSERT INTO deleted_records(entity_type, entity_id, snapshot) VALUES(?, ?, ?)")
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+	for i, id := range ids {
+		if _, err := stmt.Exec(kind, id, string(snapshots[i])); err != nil {
+			return 0, err
+		}
+	}
+	if _, err := tx.Exec("DELETE FROM "+k.table+" WHERE "+where, args...); err != nil {
+		return 0, err
+	}
+	if kind == "resident" {
+		// The snapshots keep the custom values
+		if err := deleteOrphanCustomValues(tx); err != nil {
+			return 0, err
+		}
+	}
+
+	// What deleted payments settled is open again, and so are the bank lines
+	// they matched
+	for residentID := range residents {
+		if err := reallocate(tx, rules, residentID); err != nil {
+			return 0, err
+		}
+	}
+	if err := unlinkBankLines(tx); err != nil {
+		return 0, err
+	}
+	return len(ids), nil
+}
+
+// trashRecord moves a single record to the trash, reporting whether it existed
+func trashRecord(db *sql.DB, kind string, id int, rules paymentRules) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	n, err := moveToTrash(tx, rules, kind, "id = ?", id)
+	if err != nil || n == 0 {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// checkRestoreID refuses a restore when a row has the record's id again,
+// which only happens when an import brought it back
+func checkRestoreID(tx *sql.Tx, table, kind string, id int) error {
+	var exists bool
+	if err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM "+table+" WHERE id = ?)", id).Scan(&exists); err != nil {
+		return err
+	}
+	if exists {
+		return restoreConflict(fmt.Sprintf("a %s with id %d already exists", kind, id))
+	}
+	return nil
+}
+
+func restoreResident(tx *sql.Tx, snapshot []byte, rules paymentRules) (interface{}, error) {
+	var resident Resident
+	if err := json.Unmarshal(snapshot, &resident); err != nil {
+		return nil, err
+	}
+	if err := validateResident(resident); err != nil {
+		return nil, err
+	}
+	if err := checkRestoreID(tx, "residents", "resident", resident.ID); err != nil {
+		return nil, err
+	}
+	n := resident.notificationPreferences()
+	var anonymizedAt interface{}
+	if resident.AnonymizedAt != nil {
+		anonymizedAt = resident.AnonymizedAt.UTC().Format(sqliteTimestamp)
+	}
+	_, err := tx.Exec(`INSERT INTO residents(id, name, unit, contact, email, notify_channel, notify_receipts, notify_announcements, notify_statements, move_in_date, move_out_date, created_at, anonymized_at)
+		VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		resident.ID, resident.Name, resident.Unit, resident.Contact, resident.Email, n.Reminders, n.Receipts, n.Announcements, n.Statements,
+		resident.MoveInDate, resident.MoveOutDate, resident.CreatedAt.UTC().Format(sqliteTimestamp), anonymizedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	// Values of custom fields deleted since are dropped, the rest must still
+	// fit their field
+	fields, err := customFields(tx)
+	if err != nil {
+		return nil, err
+	}
+	defined := map[string]bool{}
+	for _, f := range fields {
+		defined[f.Key] = true
+	}
+	for key := range resident.Custom {
+		if !defined[key] {
+			delete(resident.Custom, key)
+		}
+	}
+	values, err := customValues(fields, resident.Custom)
+	if err != nil {
+		return nil, err
+	}
+	return resident, storeCustomValues(tx, resident.ID, values, true)
+}
+
+// restorePayment refuses payments whose resident is gone. When the resident is
+// in the trash the error names its entry, to be restored first.
+func restorePayment(tx *sql.Tx, snapshot []byte, rules paymentRules) (interface{}, error) {
+	var payment Payment
+	if err := json.Unmarshal(snapshot, &payment); err != nil {
+		return nil, err
+	}
+	payment.PaymentDate = normalizeDate(payment.PaymentDate)
+	payment.BankReference = "" // its bank line was unmatched when it was deleted
+	if payment.Method == "check" && payment.ChequeStatus == "" {
+		// Deleted before cheques were tracked, when all counted as paid
+		payment.ChequeStatus, payment.ChequeStatusDate = ChequeCleared, payment.PaymentDate
+	}
+	if err := validatePayment(payment); err != nil {
+		return nil, err
+	}
+	payment.Status = paymentStatus(payment, rules)
+	var residentExists bool
+	if err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM residents WHERE id = ?)", payment.ResidentID).Scan(&residentExists); err != nil {
+		return nil, err
+	}
+	if !residentExists {
+		var entryID int
+		err := tx.QueryRow("SELECT id FROM deleted_records WHERE entity_type = 'resident' AND entity_id = ? ORDER BY id DESC LIMIT 1", payment.ResidentID).Scan(&entryID)
+		if err == nil {
+			return nil, restoreConflict(fmt.Sprintf("resident %d of this payment is in the trash as entry %d, restore it first", payment.ResidentID, entryID))
+		}
+		if err != sql.ErrNoRows {
+			return nil, err
+		}
+		var errs ValidationErrors
+		errs.Add("resident_id", "resident does not exist")
+		return nil, errs
+	}
+	if err := checkRestoreID(tx, "payments", "payment", payment.ID); err != nil {
+		return nil, err
+	}
+	_, err := tx.Exec(`
+		INSERT INTO payments(id, resident_id, amount, description, payment_date, method, status, reference, cheque_number, cheque_bank, cheque_status, cheque_status_date, created_at)
+		VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, payment.ID, payment.ResidentID, payment.Amount, payment.Description, payment.PaymentDate, payment.Method, payment.Status, payment.Reference,
+		payment.ChequeNumber, payment.ChequeBank, payment.ChequeStatus, payment.ChequeStatusDate, payment.CreatedAt.UTC().Format(sqliteTimestamp))
+	if isUniqueViolation(err) {
+		return nil, restoreConflict("a payment with this reference already exists")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := tagReserve(tx); err != nil {
+		return nil, err
+	}
+	return payment, reallocate(tx, rules, payment.ResidentID)
+}
+
+func restoreExpense(tx *sql.Tx, snapshot []byte, rules paymentRules) (interface{}, error) {
+	var expense Expense
+	if err := json.Unmarshal(snapshot, &expense); err != nil {
+		return nil, err
+	}
+	expense.ExpenseDate = normalizeDate(expense.ExpenseDate)
+	expense.BankReference = "" // its bank line was unmatched when it was deleted
+	if err := validateExpense(expense); err != nil {
+		return nil, err
+	}
+	if err := checkRestoreID(tx, "expenses", "expense", expense.ID); err != nil {
+		return nil, err
+	}
+	_, err := tx.Exec(`
+		INSERT INTO expenses(id, amount, description, expense_date, category, currency, original_amount, exchange_rate, tax_rate, tax_amount, vendor, created_at)
+		VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, expense.ID, expense.Amount, expense.Description, expense.ExpenseDate, expense.Category, expense.Currency, expense.OriginalAmount, expense.ExchangeRate,
+		expense.TaxRate, expense.TaxAmount, expense.Vendor, expense.CreatedAt.UTC().Format(sqliteTimestamp))
+	if err != nil {
+		return expense, err
+	}
+	return expense, setExpenseTags(tx, expense.ID, expense.Tags)
+}
+
+// purgeTrash permanently deletes what has been in the trash longer than
+// retention and returns how many entries went
+func purgeTrash(db *sql.DB, retention time.Duration) (int64, error) {
+	cutoff := time.Now().Add(-retention).UTC().Format(sqliteTimestamp)
+	result, err := db.Exec("DELETE FROM deleted_records WHERE deleted_at < ?", cutoff)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// scheduleTrashPurge purges the trash now and then hourly in a background
+// goroutine. A retention of zero keeps deleted records forever.
+func scheduleTrashPurge(db *sql.DB, retention time.Duration) {
+	if retention <= 0 {
+		return
+	}
+	purge := func() {
+		n, err := purgeTrash(db, retention)
+		if err != nil {
+			log.Printf("Failed to purge the trash: %v", err)
+		} else if n > 0 {
+			log.Printf("Purged %d deleted records older than %s", n, retention)
+		}
+	}
+	go func() {
+		purge()
+		ticker := time.NewTicker(time.Hour)
+		defer ticker.Stop()
+		for range ticker.C {
+			purge()
+		}
+	}()
+}
+
+func scanTrashEntry(rows *sql.Rows) (interface{}, error) {
+	var entry TrashEntry
+	var snapshot string
+	err := rows.Scan(&entry.ID, &entry.Type, &entry.EntityID, &snapshot, &entry.DeletedAt, &entry.DeletedBy)
+	entry.Record = json.RawMessage(snapshot)
+	return entry, err
+}
+
+// Get the deleted records, most recently deleted first
+func getTrash(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := checkQueryParams(r, "type"); err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		query := "SELECT id, entity_type, entity_id, snapshot, deleted_at, deleted_by FROM deleted_records"
+		var args []interface{}
+		if kind := r.URL.Query().Get("type"); kind != "" {
+			if _, ok := trashKinds[kind]; !ok {
+				respondWithError(w, http.StatusBadRequest, "Invalid type, must be resident, payment or expense")
+				return
+			}
+			query += " WHERE entity_type = ?"
+			args = append(args, kind)
+		}
+		streamQuery(w, db, scanTrashEntry, query+" ORDER BY deleted_at DESC, id DESC", args...)
+	}
+}
+
+// Put a deleted record back under its old id and take it out of the trash
+func restoreTrash(db *sql.DB, changes *ChangeBroker, rules paymentRules) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id, err := strconv.Atoi(vars["id"])
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid trash entry ID")
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		defer tx.Rollback()
+
+		var entry TrashEntry
+		var snapshot string
+		err = tx.QueryRow("SELECT id, entity_type, entity_id, snapshot, deleted_at, deleted_by FROM deleted_records WHERE id = ?", id).
+			Scan(&entry.ID, &entry.Type, &entry.EntityID, &snapshot, &entry.DeletedAt, &entry.DeletedBy)
+		if err == sql.ErrNoRows {
+			respondWithError(w, http.StatusNotFound, "Trash entry not found")
+			return
+		}
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		kind, ok := trashKinds[entry.Type]
+		if !ok {
+			respondWithError(w, http.StatusInternalServerError, "unknown record type "+entry.Type)
+			return
+		}
+
+		entry.Record, err = kind.restore(tx, []byte(snapshot), rules)
+		var conflict restoreConflict
+		var fields ValidationErrors
+		switch {
+		case errors.As(err, &conflict):
+			respondWithError(w, http.StatusConflict, err.Error())
+			return
+		case errors.As(err, &fields):
+			respondWithValidationError(w, err)
+			return
+		case err != nil:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		if _, err := tx.Exec("DELETE FROM deleted_records WHERE id = ?", id); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		changes.Publish(Change{Type: entry.Type, ID: entry.EntityID, Action: ChangeCreated})
+
+		respondWithJSON(w, http.StatusOK, entry)
+	}
+}
@@ -0,0 +1,517 @@
+package condomngr
+
+import (
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// User roles
+const (
+	RoleAdmin     = "admin"     // everything, including user management
+	RoleTreasurer = "treasurer" // residents, payments and expenses
+	RoleViewer    = "viewer"    // read-only
+)
+
+// minPasswordLength is the shortest password accepted
+const minPasswordLength = 8
+
+// passwordIterations is the PBKDF2-SHA256 work factor, as recommended by OWASP
+const passwordIterations = 600000
+
+var (
+	errUserNotFound = errors.New("user not found")
+	errUsernameUsed = errors.New("username is already taken")
+	errLastAdmin    = errors.New("the last enabled admin can't be disabled, demoted or deleted")
+)
+
+// keepsAnAdmin guards statements that could remove the last enabled admin:
+// they only change a row that isn't an enabled admin or when another enabled
+// admin remains
+const keepsAnAdmin = `(role != 'admin' OR disabled = 1 OR EXISTS (
+	SELECT 1 FROM users other WHERE other.role = 'admin' AND other.disabled = 0 AND other.id != users.id))`
+
+// User is an account that can sign in. The password hash is never returned.
+type User struct {
+	ID                 int       `json:"id"`
+	Username           string    `json:"username"`
+	Email              string    `json:"email"` // where password reset links are sent
+	Role               string    `json:"role"`
+	Disabled           bool      `json:"disabled"`
+	MustChangePassword bool      `json:"must_change_password"` // set by admins, cleared when the user picks a password
+	TwoFactorEnabled   bool      `json:"two_factor_enabled"`
+	CreatedAt          time.Time `json:"created_at"`
+	UpdatedAt          time.Time `json:"updated_at"`
+}
+
+// NewUserRequest creates a user
+type NewUserRequest struct {
+	Username           string `json:"username"`
+	Email              string `json:"email"`
+	Password           string `json:"password"`
+	Role               string `json:"role"`
+	MustChangePassword bool   `json:"must_change_password"`
+}
+
+// UpdateUserRequest replaces a user's email, role and flags
+type UpdateUserRequest struct {
+	Email              string `json:"email"`
+	Role               string `json:"role"`
+	Disabled           bool   `json:"disabled"`
+	MustChangePassword bool   `json:"must_change_password"`
+}
+
+// PasswordRequest sets a user's password
+type PasswordRequest struct {
+	Password           string `json:"password"`
+	MustChangePassword bool   `json:"must_change_password"`
+}
+
+// ChangePasswordRequest changes the password of the signed-in user
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+// hashPassword hashes a password with PBKDF2-SHA256 and a random salt, as
+// "pbkdf2-sha256$<iterations>$<salt>$<hash>" with unpadded base64 parts
+func hashPassword(password string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	hash, err := pbkdf2.Key(sha256.New, password, salt, passwordIterations, 32)
+	if err != nil {
+		return "", err
+	}
+	encode := base64.RawStdEncoding.EncodeToString
+	return fmt.Sprintf("pbkdf2-sha256$%d$%s$%s", passwordIterations, encode(salt), encode(hash)), nil
+}
+
+// temporaryPassword generates a password for an admin to hand over
+func temporaryPassword() (string, error) {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func validRole(role string) bool {
+	return role == RoleAdmin || role == RoleTreasurer || role == RoleViewer
+}
+
+func validateUserEmail(errs *ValidationErrors, email string) {
+	if email != "" && (!strings.Contains(email, "@") || !strings.Contains(email, ".")) {
+		errs.Add("email", "invalid email format")
+	}
+}
+
+func validatePassword(errs *ValidationErrors, field, password string) {
+	if len(password) < minPasswordLength {
+		errs.Add(field, fmt.Sprintf("password must be at least %d characters", minPasswordLength))
+	}
+}
+
+func validateNewUser(u NewUserRequest) error {
+	var errs ValidationErrors
+	if u.Username == "" {
+		errs.Add("username", "username is required")
+	} else if strings.ContainsAny(u.Username, " \t\r\n") {
+		errs.Add("username", "username can't contain spaces")
+	}
+	validateUserEmail(&errs, u.Email)
+	if !validRole(u.Role) {
+		errs.Add("role", "role must be one of admin, treasurer or viewer")
+	}
+	validatePassword(&errs, "password", u.Password)
+	return errs.Err()
+}
+
+func validateUserUpdate(u UpdateUserRequest) error {
+	var errs ValidationErrors
+	validateUserEmail(&errs, u.Email)
+	if !validRole(u.Role) {
+		errs.Add("role", "role must be one of admin, treasurer or viewer")
+	}
+	return errs.Err()
+}
+
+const userColumns = "id, username, email, role, disabled, must_change_password, totp_enabled, created_at, updated_at"
+
+func scanUser(row interface{ Scan(...interface{}) error }) (User, error) {
+	var u User
+	err := row.Scan(&u.ID, &u.Username, &u.Email, &u.Role, &u.Disabled, &u.MustChangePassword, &u.TwoFactorEnabled, &u.CreatedAt, &u.UpdatedAt)
+	return u, err
+}
+
+// listUsers returns every user ordered by username
+func listUsers(db *sql.DB) ([]User, error) {
+	rows, err := db.Query("SELECT " + userColumns + " FROM users ORDER BY username")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []User{}
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+// findUser returns a user by id
+func findUser(db *sql.DB, id int) (User, error) {
+	u, err := scanUser(db.QueryRow("SELECT "+userColumns+" FROM users WHERE id = ?", id))
+	if err == sql.ErrNoRows {
+		return u, errUserNotFound
+	}
+	return u, err
+}
+
+// findUserByName returns a user by username
+func findUserByName(db *sql.DB, username string) (User, error) {
+	u, err := scanUser(db.QueryRow("SELECT "+userColumns+" FROM users WHERE username = ?", username))
+	if err == sql.ErrNoRows {
+		return u, errUserNotFound
+	}
+	return u, err
+}
+
+// createUser adds a validated user
+func createUser(db *sql.DB, req NewUserRequest) (User, error) {
+	hash, err := hashPassword(req.Password)
+	if err != nil {
+		return User{}, err
+	}
+	result, err := db.Exec("INSERT INTO users(username, email, password_hash, role, must_change_password) VALUES(?, ?, ?, ?, ?)",
+		req.Username, req.Email, hash, req.Role, req.MustChangePassword)
+	if isUniqueViolation(err) {
+		return User{}, errUsernameUsed
+	}
+	if err != nil {
+		return User{}, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return User{}, err
+	}
+	return findUser(db, int(id))
+}
+
+// updateUser replaces a user's email, role and flags, refusing to remove the
+// last enabled admin
+func updateUser(db *sql.DB, id int, req UpdateUserRequest) (User, error) {
+	result, err := db.Exec(`UPDATE users SET email = ?, role = ?, disabled = ?, must_change_password = ?, updated_at = CURRENT_TIMESTAMP
+		WHERE id = ? AND ((? = 'admin' AND NOT ?) OR `+keepsAnAdmin+`)`,
+		req.Email, req.Role, req.Disabled, req.MustChangePassword, id, req.Role, req.Disabled)
+	if err != nil {
+		return User{}, err
+	}
+	if err := checkUserChanged(db, id, result); err != nil {
+		return User{}, err
+	}
+	return findUser(db, id)
+}
+
+// setUserDisabled disables or re-enables a user, refusing to disable the last
+// enabled admin
+func setUserDisabled(db *sql.DB, id int, disabled bool) error {
+	query := "UPDATE users SET disabled = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?"
+	if disabled {
+		query += " AND " + keepsAnAdmin
+	}
+	result, err := db.Exec(query, disabled, id)
+	if err != nil {
+		return err
+	}
+	return checkUserChanged(db, id, result)
+}
+
+// deleteUserByID deletes a user with their sessions, recovery codes, saved
+// searches and condo grants and unassigns their tasks, refusing to delete the last enabled admin. Foreign
+// keys aren't enforced, so those would otherwise be left behind.
+func deleteUserByID(db *sql.DB, id int) error {
+	result, err := db.Exec("DELETE FROM users WHERE id = ? AND "+keepsAnAdmin, id)
+	if err != nil {
+		return err
+	}
+	if err := checkUserChanged(db, id, result); err != nil {
+		return err
+	}
+	for _, table := range []string{"sessions", "recovery_codes", "login_challenges", "password_resets", "saved_searches", "condo_grants"} {
+		if _, err := db.Exec("DELETE FROM "+table+" WHERE user_id = ?", id); err != nil {
+			return err
+		}
+	}
+	_, err = db.Exec("UPDATE tasks SET assignee_user_id = NULL WHERE assignee_user_id = ?", id)
+	return err
+}
+
+// setUserPassword replaces a user's password and signs out their sessions,
+// except the one of keepToken, which may be empty
+func setUserPassword(db *sql.DB, id int, password string, mustChange bool, keepToken string) error {
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	result, err := db.Exec("UPDATE users SET password_hash = ?, must_change_password = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?",
+		hash, mustChange, id)
+	if err != nil {
+		return err
+	}
+	if err := checkUserChanged(db, id, result); err != nil {
+		return err
+	}
+	return revokeOtherSessions(db, id, keepToken)
+}
+
+// checkUserChanged tells why a guarded statement changed no row: the user
+// doesn't exist, or it is the last enabled admin
+func checkUserChanged(db *sql.DB, id int, result sql.Result) error {
+	if n, err := result.RowsAffected(); err != nil || n > 0 {
+		return err
+	}
+	if _, err := findUser(db, id); err != nil {
+		return err
+	}
+	return errLastAdmin
+}
+
+// respondWithUserError maps user store errors to responses
+func respondWithUserError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errUserNotFound):
+		respondWithError(w, http.StatusNotFound, "User not found")
+	case errors.Is(err, errUsernameUsed), errors.Is(err, errLastAdmin):
+		respondWithError(w, http.StatusConflict, err.Error())
+	default:
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+	}
+}
+
+// noUsers reports whether no user has been added yet
+func noUsers(db *sql.DB) (bool, error) {
+	var exists bool
+	err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM users)").Scan(&exists)
+	return !exists, err
+}
+
+// Handlers for user endpoints; all of them are for admins only
+func getUsers(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := requireAdmin(db, w, r); !ok {
+			return
+		}
+		users, err := listUsers(db)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		respondWithJSON(w, http.StatusOK, users)
+	}
+}
+
+// Add a user. The first one can be added without signing in, to set up a
+// new instance.
+func postUser(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		first, err := noUsers(db)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if !first {
+			if _, ok := requireAdmin(db, w, r); !ok {
+				return
+			}
+		}
+		var req NewUserRequest
+		if err := decodeRequest(r, &req); err != nil {
+			respondWithError(w, payloadErrorStatus(err), "Invalid request payload: "+err.Error())
+			return
+		}
+		defer r.Body.Close()
+
+		if err := validateNewUser(req); err != nil {
+			respondWithValidationError(w, err)
+			return
+		}
+
+		user, err := createUser(db, req)
+		if err != nil {
+			respondWithUserError(w, err)
+			return
+		}
+		respondWithJSON(w, http.StatusCreated, user)
+	}
+}
+
+func getUser(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := requireAdmin(db, w, r); !ok {
+			return
+		}
+		id, err := strconv.Atoi(mux.Vars(r)["id"])
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid user ID")
+			return
+		}
+
+		user, err := findUser(db, id)
+		if err != nil {
+			respondWithUserError(w, err)
+			return
+		}
+		respondWithJSON(w, http.StatusOK, user)
+	}
+}
+
+func putUser(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := requireAdmin(db, w, r); !ok {
+			return
+		}
+		id, err := strconv.Atoi(mux.Vars(r)["id"])
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid user ID")
+			return
+		}
+
+		var req UpdateUserRequest
+		if err := decodeRequest(r, &req); err != nil {
+			respondWithError(w, payloadErrorStatus(err), "Invalid request payload: "+err.Error())
+			return
+		}
+		defer r.Body.Close()
+
+		if err := validateUserUpdate(req); err != nil {
+			respondWithValidationError(w, err)
+			return
+		}
+
+		user, err := updateUser(db, id, req)
+		if err != nil {
+			respondWithUserError(w, err)
+			return
+		}
+		respondWithJSON(w, http.StatusOK, user)
+	}
+}
+
+func deleteUser(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := requireAdmin(db, w, r); !ok {
+			return
+		}
+		id, err := strconv.Atoi(mux.Vars(r)["id"])
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid user ID")
+			return
+		}
+
+		if err := deleteUserByID(db, id); err != nil {
+			respondWithUserError(w, err)
+			return
+		}
+		respondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
+	}
+}
+
+func postUserPassword(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := requireAdmin(db, w, r); !ok {
+			return
+		}
+		id, err := strconv.Atoi(mux.Vars(r)["id"])
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid user ID")
+			return
+		}
+
+		var req PasswordRequest
+		if err := decodeRequest(r, &req); err != nil {
+			respondWithError(w, payloadErrorStatus(err), "Invalid request payload: "+err.Error())
+			return
+		}
+		defer r.Body.Close()
+
+		var errs ValidationErrors
+		validatePassword(&errs, "password", req.Password)
+		if err := errs.Err(); err != nil {
+			respondWithValidationError(w, err)
+			return
+		}
+
+		if err := setUserPassword(db, id, req.Password, req.MustChangePassword, bearerToken(r)); err != nil {
+			respondWithUserError(w, err)
+			return
+		}
+		respondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
+	}
+}
+
+// Change the password of the signed-in user, who gives the current one. It is
+// the only endpoint open to users who must change their password; their
+// other sessions are signed out. Wrong current passwords count as failed
+// sign-ins.
+func changePassword(db *sql.DB, guard *LoginGuard) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session, ok := requireSessionToEnroll(db, w, r)
+		if !ok {
+			return
+		}
+		var req ChangePasswordRequest
+		if err := decodeRequest(r, &req); err != nil {
+			respondWithError(w, payloadErrorStatus(err), "Invalid request payload: "+err.Error())
+			return
+		}
+		defer r.Body.Close()
+
+		ip := clientIP(r)
+		if !loginAllowed(w, guard, session.User.Username, ip) {
+			return
+		}
+		_, ok, err := authenticate(db, session.User.Username, req.CurrentPassword)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		var errs ValidationErrors
+		if !ok {
+			if err := guard.Fail(session.User.Username, ip); err != nil {
+				log.Printf("Failed to record a failed sign-in: %v", err)
+			}
+			errs.Add("current_password", "current_password is incorrect")
+		}
+		validatePassword(&errs, "new_password", req.NewPassword)
+		if ok && req.NewPassword == req.CurrentPassword {
+			errs.Add("new_password", "new_password must differ from the current password")
+		}
+		if err := errs.Err(); err != nil {
+			respondWithValidationError(w, err)
+			return
+		}
+
+		if err := setUserPassword(db, session.User.ID, req.NewPassword, false, bearerToken(r)); err != nil {
+			respondWithUserError(w, err)
+			return
+		}
+		respondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
+	}
+}
@@ -0,0 +1,81 @@
+package condomngr
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestUserEndpointsRequireAdmin(t *testing.T) {
+	s := newTestServer(t, Options{})
+
+	// The first user can be added without signing in, the next can't
+	var first User
+	s.expect(http.StatusCreated, "POST", "/api/v1/users", NewUserRequest{Username: "alice", Password: "secretpass1", Role: RoleAdmin}, &first)
+	bob := NewUserRequest{Username: "bob", Password: "secretpass1", Role: RoleAdmin}
+	s.expect(http.StatusUnauthorized, "POST", "/api/v1/users", bob, nil)
+
+	endpoints := []struct {
+		method, path string
+		body         interface{}
+	}{
+		{"GET", "/api/v1/users", nil},
+		{"POST", "/api/v1/users", bob},
+		{"GET", fmt.Sprint("/api/v1/users/", first.ID), nil},
+		{"PUT", fmt.Sprint("/api/v1/users/", first.ID), UpdateUserRequest{Role: RoleViewer}},
+		{"DELETE", fmt.Sprint("/api/v1/users/", first.ID), nil},
+		{"POST", fmt.Sprint("/api/v1/users/", first.ID, "/password"), PasswordRequest{Password: "takenover1"}},
+	}
+	treasurer := s.signIn("tom", RoleTreasurer)
+	for _, e := range endpoints {
+		s.token = ""
+		s.expect(http.StatusUnauthorized, e.method, e.path, e.body, nil)
+		s.token = treasurer
+		s.expect(http.StatusForbidden, e.method, e.path, e.body, nil)
+	}
+
+	s.token = s.signIn("carol", RoleAdmin)
+	var users []User
+	s.expect(http.StatusOK, "GET", "/api/v1/users", nil, &users)
+	if len(users) != 3 {
+		t.Errorf("%d users, want 3", len(users))
+	}
+	s.expect(http.StatusCreated, "POST", "/api/v1/users", bob, nil)
+}
+
+func TestMustChangePassword(t *testing.T) {
+	s := newTestServer(t, Options{})
+	s.token = s.signIn("alice", RoleAdmin)
+	if _, err := s.db.Exec("UPDATE users SET must_change_password = 1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Refused everywhere, with or without a session check of its own
+	for _, path := range []string{"/api/v1/users", "/api/v1/residents", "/api/v1/sessions", "/api/v1/no-such-thing"} {
+		var e apiError
+		s.expect(http.StatusForbidden, "GET", path, nil, &e)
+		if e.Code != "password_change_required" {
+			t.Errorf("GET %s: code %q", path, e.Code)
+		}
+	}
+	var session Session
+	s.expect(http.StatusOK, "GET", "/api/v1/auth/session", nil, &session)
+	if !session.User.MustChangePassword {
+		t.Error("session doesn't show the password must be changed")
+	}
+
+	var e apiError
+	s.expect(http.StatusUnprocessableEntity, "POST", "/api/v1/auth/password", ChangePasswordRequest{CurrentPassword: "wrong", NewPassword: "newsecret1"}, &e)
+	if len(e.Details) != 1 || e.Details[0].Code != "current_password_incorrect" {
+		t.Errorf("wrong current password: %+v", e)
+	}
+	e = apiError{}
+	s.expect(http.StatusUnprocessableEntity, "POST", "/api/v1/auth/password", ChangePasswordRequest{CurrentPassword: "secretpass1", NewPassword: "secretpass1"}, &e)
+	if len(e.Details) != 1 || e.Details[0].Code != "password_unchanged" {
+		t.Errorf("same password: %+v", e)
+	}
+
+	s.expect(http.StatusOK, "POST", "/api/v1/auth/password", ChangePasswordRequest{CurrentPassword: "secretpass1", NewPassword: "newsecret1"}, nil)
+	s.expect(http.StatusOK, "GET", "/api/v1/users", nil, nil)
+	s.expect(http.StatusOK, "POST", "/api/v1/auth/login", LoginRequest{Username: "alice", Password: "newsecret1"}, nil)
+}
@@ -0,0 +1,64 @@
+package condomngr
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// FieldError is a validation failure of a single field. Code is set when
+// responding, from the message id.
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code,omitempty"`
+	Message string `json:"message"`
+}
+
+// ValidationErrors collects every failed field so clients can fix them all in
+// one round trip
+type ValidationErrors []FieldError
+
+// Add records a failed field
+func (v *ValidationErrors) Add(field, message string) {
+	*v = append(*v, FieldError{Field: field, Message: message})
+}
+
+func (v ValidationErrors) Error() string {
+	messages := make([]string, len(v))
+	for i, e := range v {
+		messages[i] = e.Message
+	}
+	return strings.Join(messages, "; ")
+}
+
+// Err returns v as an error, or nil when nothing failed
+func (v ValidationErrors) Err() error {
+	if len(v) == 0 {
+		return nil
+	}
+	return v
+}
+
+// respondWithValidationError responds 422 with every failed field in details,
+// or 400 for other errors
+func respondWithValidationError(w http.ResponseWriter, err error) {
+	var fields ValidationErrors
+	if !errors.As(err, &fields) {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	lang := responseLanguage(w)
+	details := make(ValidationErrors, len(fields))
+	for i, field := range fields {
+		id, text := translate(lang, field.Message)
+		if id == "" {
+			id = "invalid"
+		}
+		details[i] = FieldError{Field: field.Field, Code: id, Message: text}
+	}
+	respondWithJSON(w, http.StatusUnprocessableEntity, map[string]interface{}{
+		"error":   details.Error(),
+		"code":    statusCodes[http.StatusUnprocessableEntity],
+		"details": details,
+	})
+}
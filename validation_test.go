@@ -0,0 +1,45 @@
+package condomngr
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestValidationReportsEveryField(t *testing.T) {
+	s := newTestServer(t, Options{})
+	s.createResident("Ana Silva", "1A")
+	s.expect(http.StatusCreated, "POST", "/api/v1/payments", map[string]interface{}{"resident_id": 1, "amount": 50, "description": "Dues", "payment_date": "2024-03-05"}, nil)
+	s.expect(http.StatusCreated, "POST", "/api/v1/expenses", map[string]interface{}{"amount": 10, "description": "Bulbs", "expense_date": "2024-03-05"}, nil)
+
+	for _, tt := range []struct {
+		path   string
+		body   map[string]interface{}
+		fields []string
+	}{
+		{"/api/v1/residents", map[string]interface{}{"email": "nowhere", "move_in_date": "2024-13-01"}, []string{"name", "unit", "email", "move_in_date"}},
+		{"/api/v1/residents", map[string]interface{}{"name": "Rui", "unit": "2B", "notify_channel": "fax", "move_in_date": "2024-05-01", "move_out_date": "2024-04-01"}, []string{"notify_channel", "move_out_date"}},
+		{"/api/v1/payments", map[string]interface{}{"amount": 0, "payment_date": "05/03/2024"}, []string{"resident_id", "amount", "payment_date"}},
+		{"/api/v1/payments", map[string]interface{}{"amount": -5, "method": "bitcoin", "cheque_number": "123"}, []string{"resident_id", "amount", "payment_date", "method", "method"}},
+		{"/api/v1/expenses", map[string]interface{}{"tax_rate": 150}, []string{"amount", "tax_rate", "description", "expense_date"}},
+		{"/api/v1/expenses", map[string]interface{}{"currency": "euro", "description": "Paint", "expense_date": "2024-03-05"}, []string{"currency", "exchange_rate", "original_amount"}},
+	} {
+		for _, op := range []struct{ method, path string }{{"POST", tt.path}, {"PUT", tt.path + "/1"}} {
+			var e struct {
+				Code    string       `json:"code"`
+				Details []FieldError `json:"details"`
+			}
+			s.expect(http.StatusUnprocessableEntity, op.method, op.path, tt.body, &e)
+			fields := []string{}
+			for _, detail := range e.Details {
+				fields = append(fields, detail.Field)
+				if detail.Message == "" || detail.Code == "" {
+					t.Errorf("%s %s: detail %+v without a message or code", op.method, op.path, detail)
+				}
+			}
+			if e.Code != "validation_failed" || !reflect.DeepEqual(fields, tt.fields) {
+				t.Errorf("%s %s %v: %s for %v, want validation_failed for %v", op.method, op.path, tt.body, e.Code, fields, tt.fields)
+			}
+		}
+	}
+}
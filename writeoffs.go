@@ -0,0 +1,228 @@
+package condomngr
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// WriteOff gives up on debt a resident won't pay, as decided by the
+// assembly. It settles their charges like a payment without being income.
+// Reversing it restores the debt; the record stays, with when it was
+// reversed.
+type WriteOff struct {
+	ID           int        `json:"id"`
+	ResidentID   int        `json:"resident_id"`
+	Amount       float64    `json:"amount"`
+	Reason       string     `json:"reason"`
+	Decision     string     `json:"decision"` // the meeting or decision that approved it, e.g. minutes of 2024-03-12
+	WriteOffDate string     `json:"writeoff_date"`
+	CreatedAt    time.Time  `json:"created_at"`
+	ReversedAt   *time.Time `json:"reversed_at"`
+}
+
+const writeOffColumns = "id, resident_id, amount, reason, decision, writeoff_date, created_at, reversed_at"
+
+func scanWriteOff(row interface{ Scan(...interface{}) error }) (WriteOff, error) {
+	var wo WriteOff
+	var reversedAt sql.NullTime
+	err := row.Scan(&wo.ID, &wo.ResidentID, &wo.Amount, &wo.Reason, &wo.Decision, &wo.WriteOffDate, &wo.CreatedAt, &reversedAt)
+	if reversedAt.Valid {
+		wo.ReversedAt = &reversedAt.Time
+	}
+	return wo, err
+}
+
+// Validation function for WriteOff data
+func validateWriteOff(wo WriteOff) error {
+	var errs ValidationErrors
+	if wo.Amount <= 0 {
+		errs.Add("amount", "amount must be greater than zero")
+	}
+	if wo.Reason == "" {
+		errs.Add("reason", "reason is required")
+	}
+	if wo.Decision == "" {
+		errs.Add("decision", "decision is required")
+	}
+	if _, err := time.Parse("2006-01-02", wo.WriteOffDate); err != nil {
+		errs.Add("writeoff_date", "invalid date format, must be YYYY-MM-DD")
+	}
+	return errs.Err()
+}
+
+// Handlers for write-off endpoints
+
+// Get a resident's write-offs, including the reversed ones
+func getResidentWriteOffs(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id, err := strconv.Atoi(vars["id"])
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid resident ID")
+			return
+		}
+
+		rows, err := db.Query("SELECT "+writeOffColumns+" FROM write_offs WHERE resident_id = ? ORDER BY writeoff_date, id", id)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		defer rows.Close()
+
+		writeOffs := []WriteOff{}
+		for rows.Next() {
+			wo, err := scanWriteOff(rows)
+			if err != nil {
+				respondWithError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			writeOffs = append(writeOffs, wo)
+		}
+
+		respondWithJSON(w, http.StatusOK, writeOffs)
+	}
+}
+
+// Write off up to what a resident owes (admins only)
+func createResidentWriteOff(db *sql.DB, cal calendar) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := requireAdmin(db, w, r); !ok {
+			return
+		}
+		vars := mux.Vars(r)
+		id, err := strconv.Atoi(vars["id"])
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid resident ID")
+			return
+		}
+
+		var wo WriteOff
+		if err := decodeRequest(r, &wo); err != nil {
+			respondWithError(w, payloadErrorStatus(err), "Invalid request payload: "+err.Error())
+			return
+		}
+		defer r.Body.Close()
+
+		wo.ResidentID = id
+		if wo.WriteOffDate == "" {
+			wo.WriteOffDate = cal.today()
+		}
+		if err := validateWriteOff(wo); err != nil {
+			respondWithValidationError(w, err)
+			return
+		}
+
+		var exists bool
+		if err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM residents WHERE id = ?)", id).Scan(&exists); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if !exists {
+			respondWithError(w, http.StatusNotFound, "Resident not found")
+			return
+		}
+		balance, err := residentBalance(db, id)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if wo.Amount > balance.Balance+0.005 {
+			var errs ValidationErrors
+			errs.Add("amount", "amount must not exceed what the resident owes")
+			respondWithValidationError(w, errs)
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		defer tx.Rollback()
+
+		result, err := tx.Exec("INSERT INTO write_offs(resident_id, amount, reason, decision, writeoff_date) VALUES(?, ?, ?, ?, ?)",
+			wo.ResidentID, wo.Amount, wo.Reason, wo.Decision, wo.WriteOffDate)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeOffID, err := result.LastInsertId()
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		detail := fmt.Sprintf("write-off %d of %.2f: %s (%s)", writeOffID, wo.Amount, wo.Reason, wo.Decision)
+		if err := recordAudit(tx, r, AuditWriteOff, fmt.Sprintf("resident %d", id), detail); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		saved, err := scanWriteOff(tx.QueryRow("SELECT "+writeOffColumns+" FROM write_offs WHERE id = ?", writeOffID))
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		respondWithJSON(w, http.StatusCreated, saved)
+	}
+}
+
+// Reverse a write-off, so the resident owes the debt again (admins only)
+func reverseWriteOff(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := requireAdmin(db, w, r); !ok {
+			return
+		}
+		vars := mux.Vars(r)
+		id, err := strconv.Atoi(vars["id"])
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid write-off ID")
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		defer tx.Rollback()
+
+		wo, err := scanWriteOff(tx.QueryRow("SELECT "+writeOffColumns+" FROM write_offs WHERE id = ?", id))
+		if err == sql.ErrNoRows {
+			respondWithError(w, http.StatusNotFound, "Write-off not found")
+			return
+		}
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if wo.ReversedAt != nil {
+			respondWithError(w, http.StatusConflict, "Write-off already reversed")
+			return
+		}
+
+		if _, err := tx.Exec("UPDATE write_offs SET reversed_at = ? WHERE id = ?", time.Now().UTC(), id); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		detail := fmt.Sprintf("write-off %d of %.2f: %s (%s)", wo.ID, wo.Amount, wo.Reason, wo.Decision)
+		if err := recordAudit(tx, r, AuditWriteOffReversed, fmt.Sprintf("resident %d", wo.ResidentID), detail); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		respondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
+	}
+}
@@ -0,0 +1,360 @@
+package condomngr
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxXLSXPart caps the uncompressed size of each part of a workbook read, so
+// a small upload can't expand into gigabytes
+const maxXLSXPart = 64 << 20
+
+// Workbook is the content of the sheets of an .xlsx file, as values rather
+// than formulas and styles
+type Workbook struct {
+	Sheets   []Worksheet
+	Date1904 bool // serial dates count from 1904 rather than 1900
+}
+
+// Worksheet is a sheet of a workbook. Rows and their cells are in order,
+// empty ones left out.
+type Worksheet struct {
+	Name string
+	Rows []WorksheetRow
+}
+
+// WorksheetRow is a row of a sheet, numbered from 1 as in the spreadsheet.
+// Cells is indexed by column, from 0 for A.
+type WorksheetRow struct {
+	Number int
+	Cells  []WorksheetCell
+}
+
+// WorksheetCell is the value of a cell. Numbers, which include dates stored
+// as serials, are written as stored, e.g. "44927" or "12.5".
+type WorksheetCell struct {
+	Value  string
+	Number bool
+}
+
+// Value returns the cell of column i, empty if there is none
+func (r WorksheetRow) Value(i int) WorksheetCell {
+	if i < 0 || i >= len(r.Cells) {
+		return WorksheetCell{}
+	}
+	return r.Cells[i]
+}
+
+// Empty reports whether the row has no values
+func (r WorksheetRow) Empty() bool {
+	for _, cell := range r.Cells {
+		if strings.TrimSpace(cell.Value) != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// Sheet finds a sheet by name, ignoring case
+func (wb *Workbook) Sheet(name string) (*Worksheet, bool) {
+	for i := range wb.Sheets {
+		if strings.EqualFold(strings.TrimSpace(wb.Sheets[i].Name), strings.TrimSpace(name)) {
+			return &wb.Sheets[i], true
+		}
+	}
+	return nil, false
+}
+
+// The parts of a workbook read, as far as they are needed. encoding/xml
+// matches the elements by local name, whatever their namespace.
+type xlsxWorkbookXML struct {
+	Properties struct {
+		Date1904 string `xml:"date1904,attr"`
+	} `xml:"workbookPr"`
+	Sheets []struct {
+		Name       string     `xml:"name,attr"`
+		Attributes []xml.Attr `xml:",any,attr"` // r:id, in the transitional or strict namespace
+	} `xml:"sheets>sheet"`
+}
+
+type xlsxRelationshipsXML struct {
+	Relationships []struct {
+		ID     string `xml:"Id,attr"`
+		Target string `xml:"Target,attr"`
+	} `xml:"Relationship"`
+}
+
+// xlsxTextXML is a string item: plain text, or runs of formatted text
+type xlsxTextXML struct {
+	Text string `xml:"t"`
+	Runs []struct {
+		Text string `xml:"t"`
+	} `xml:"r"`
+}
+
+func (t xlsxTextXML) String() string {
+	if len(t.Runs) == 0 {
+		return t.Text
+	}
+	var b strings.Builder
+	for _, run := range t.Runs {
+		b.WriteString(run.Text)
+	}
+	return b.String()
+}
+
+type xlsxSharedStringsXML struct {
+	Items []xlsxTextXML `xml:"si"`
+}
+
+type xlsxSheetXML struct {
+	Rows []struct {
+		Number int `xml:"r,attr"`
+		Cells  []struct {
+			Ref    string      `xml:"r,attr"`
+			Type   string      `xml:"t,attr"`
+			Value  string      `xml:"v"`
+			Inline xlsxTextXML `xml:"is"`
+		} `xml:"c"`
+	} `xml:"sheetData>row"`
+}
+
+// readXLSX reads the sheets of an .xlsx workbook
+func readXLSX(data []byte) (*Workbook, error) {
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, errors.New("not an .xlsx workbook")
+	}
+	parts := make(map[string]*zip.File, len(archive.File))
+	for _, f := range archive.File {
+		parts[strings.TrimPrefix(f.Name, "/")] = f
+	}
+	decode := func(name string, v interface{}, required bool) error {
+		f, ok := parts[name]
+		if !ok {
+			if required {
+				return fmt.Errorf("not an .xlsx workbook, %s is missing", name)
+			}
+			return nil
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+		content, err := io.ReadAll(io.LimitReader(rc, maxXLSXPart+1))
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		if len(content) > maxXLSXPart {
+			return fmt.Errorf("%s is larger than %d bytes", name, maxXLSXPart)
+		}
+		if err := xml.Unmarshal(content, v); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		return nil
+	}
+
+	var workbook xlsxWorkbookXML
+	if err := decode("xl/workbook.xml", &workbook, true); err != nil {
+		return nil, err
+	}
+	var relationships xlsxRelationshipsXML
+	if err := decode("xl/_rels/workbook.xml.rels", &relationships, true); err != nil {
+		return nil, err
+	}
+	targets := make(map[string]string, len(relationships.Relationships))
+	for _, rel := range relationships.Relationships {
+		// Targets are relative to xl/, unless absolute
+		if strings.HasPrefix(rel.Target, "/") {
+			targets[rel.ID] = strings.TrimPrefix(rel.Target, "/")
+		} else {
+			targets[rel.ID] = path.Join("xl", rel.Target)
+		}
+	}
+	var shared xlsxSharedStringsXML
+	if err := decode("xl/sharedStrings.xml", &shared, false); err != nil {
+		return nil, err
+	}
+
+	wb := &Workbook{Date1904: workbook.Properties.Date1904 == "1" || workbook.Properties.Date1904 == "true"}
+	for _, s := range workbook.Sheets {
+		var id string
+		for _, attr := range s.Attributes {
+			if attr.Name.Local == "id" && strings.HasSuffix(attr.Name.Space, "/relationships") {
+				id = attr.Value
+			}
+		}
+		target, ok := targets[id]
+		if !ok {
+			return nil, fmt.Errorf("sheet %q has no part", s.Name)
+		}
+		var sheet xlsxSheetXML
+		if err := decode(target, &sheet, true); err != nil {
+			return nil, err
+		}
+		ws := Worksheet{Name: s.Name}
+		previous := 0
+		for _, row := range sheet.Rows {
+			// Row and cell references are optional, and then follow the
+			// previous ones
+			number := row.Number
+			if number == 0 {
+				number = previous + 1
+			}
+			previous = number
+			r := WorksheetRow{Number: number}
+			for _, c := range row.Cells {
+				column := len(r.Cells)
+				if c.Ref != "" {
+					if column, err = xlsxColumn(c.Ref); err != nil {
+						return nil, fmt.Errorf("sheet %q: %v", s.Name, err)
+					}
+				}
+				cell := WorksheetCell{Value: c.Value}
+				switch c.Type {
+				case "s":
+					i, err := strconv.Atoi(c.Value)
+					if err != nil || i < 0 || i >= len(shared.Items) {
+						return nil, fmt.Errorf("sheet %q: cell %s has no shared string %q", s.Name, c.Ref, c.Value)
+					}
+					cell.Value = shared.Items[i].String()
+				case "inlineStr":
+					cell.Value = c.Inline.String()
+				case "b":
+					cell.Value = "FALSE"
+					if c.Value == "1" {
+						cell.Value = "TRUE"
+					}
+				case "", "n":
+					cell.Number = c.Value != ""
+				}
+				for len(r.Cells) < column {
+					r.Cells = append(r.Cells, WorksheetCell{})
+				}
+				if column < len(r.Cells) {
+					r.Cells[column] = cell
+				} else {
+					r.Cells = append(r.Cells, cell)
+				}
+			}
+			if !r.Empty() {
+				ws.Rows = append(ws.Rows, r)
+			}
+		}
+		wb.Sheets = append(wb.Sheets, ws)
+	}
+	return wb, nil
+}
+
+// xlsxColumn returns the column of a cell reference such as "AB12", from 0
+// for A
+func xlsxColumn(ref string) (int, error) {
+	column := 0
+	letters := 0
+	for _, c := range strings.ToUpper(ref) {
+		if c < 'A' || c > 'Z' {
+			break
+		}
+		column = column*26 + int(c-'A') + 1
+		letters++
+	}
+	if letters == 0 || letters > 3 {
+		return 0, fmt.Errorf("invalid cell reference %q", ref)
+	}
+	return column - 1, nil
+}
+
+// xlsxColumnName returns the letters of column i, from 0 for A
+func xlsxColumnName(i int) string {
+	name := ""
+	for i++; i > 0; i = (i - 1) / 26 {
+		name = string(rune('A'+(i-1)%26)) + name
+	}
+	return name
+}
+
+// xlsxSerialDate converts a date stored as a serial number of days. In the
+// 1900 system day 1 is 1900-01-01 and day 60 the 29 February 1900 Lotus
+// believed in, so counting from 1899-12-30 is right from March 1900 on. In
+// the 1904 system day 0 is 1904-01-01. Times of day are dropped.
+func xlsxSerialDate(serial float64, date1904 bool) (string, error) {
+	epoch, first := time.Date(1899, 12, 30, 0, 0, 0, 0, time.UTC), 1.0
+	if date1904 {
+		epoch, first = time.Date(1904, 1, 1, 0, 0, 0, 0, time.UTC), 0
+	}
+	if serial < first || serial >= 2958466 { // after 9999-12-31
+		return "", fmt.Errorf("%g is not a date", serial)
+	}
+	return epoch.AddDate(0, 0, int(serial)).Format("2006-01-02"), nil
+}
+
+// The parts of a workbook written, but for its sheet
+const (
+	xlsxContentTypes = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types"><Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/><Default Extension="xml" ContentType="application/xml"/><Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/><Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/></Types>`
+	xlsxRootRels = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/></Relationships>`
+	xlsxWorkbookRels = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/></Relationships>`
+)
+
+// writeXLSX writes rows as the one sheet of an .xlsx workbook. Cells number
+// accepts are written as numbers, the others as text.
+func writeXLSX(w io.Writer, sheet string, rows [][]string, number func(string) (float64, bool)) error {
+	var workbook, data bytes.Buffer
+	workbook.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` + "\n" +
+		`<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"><sheets><sheet name="`)
+	xml.EscapeText(&workbook, []byte(sheet))
+	workbook.WriteString(`" sheetId="1" r:id="rId1"/></sheets></workbook>`)
+
+	data.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` + "\n" +
+		`<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`)
+	for i, row := range rows {
+		fmt.Fprintf(&data, `<row r="%d">`, i+1)
+		for j, value := range row {
+			if value == "" {
+				continue
+			}
+			ref := xlsxColumnName(j) + strconv.Itoa(i+1)
+			if n, ok := number(value); ok {
+				fmt.Fprintf(&data, `<c r="%s"><v>%s</v></c>`, ref, strconv.FormatFloat(n, 'f', -1, 64))
+				continue
+			}
+			fmt.Fprintf(&data, `<c r="%s" t="inlineStr"><is><t xml:space="preserve">`, ref)
+			xml.EscapeText(&data, []byte(value))
+			data.WriteString(`</t></is></c>`)
+		}
+		data.WriteString(`</row>`)
+	}
+	data.WriteString(`</sheetData></worksheet>`)
+
+	zw := zip.NewWriter(w)
+	for _, part := range []struct {
+		name string
+		data []byte
+	}{
+		{"[Content_Types].xml", []byte(xlsxContentTypes)},
+		{"_rels/.rels", []byte(xlsxRootRels)},
+		{"xl/workbook.xml", workbook.Bytes()},
+		{"xl/_rels/workbook.xml.rels", []byte(xlsxWorkbookRels)},
+		{"xl/worksheets/sheet1.xml", data.Bytes()},
+	} {
+		f, err := zw.Create(part.name)
+		if err != nil {
+			return err
+		}
+		if _, err := f.Write(part.data); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
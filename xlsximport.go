@@ -0,0 +1,1045 @@
+package condomngr
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// xlsxFields are the fields the columns of a sheet can be mapped to, by
+// entity. Payments name their resident by unit or name with "resident", or by
+// id with "resident_id".
+var xlsxFields = map[string][]string{
+	"residents": {"id", "name", "unit", "contact", "email", "move_in_date", "move_out_date"},
+	"payments":  {"id", "resident", "resident_id", "amount", "payment_date", "description", "method", "reference"},
+	"expenses":  {"id", "amount", "expense_date", "description", "category"},
+}
+
+// xlsxRequired are the fields a sheet of each entity must map. Payments also
+// need resident or resident_id.
+var xlsxRequired = map[string][]string{
+	"residents": {"name", "unit"},
+	"payments":  {"amount", "payment_date"},
+	"expenses":  {"amount", "expense_date", "description"},
+}
+
+// xlsxSynonyms are the headers, folded, that auto-detection maps to each
+// field, in English and Portuguese
+var xlsxSynonyms = map[string]map[string][]string{
+	"residents": {
+		"id":            {"id"},
+		"name":          {"name", "owner", "owner name", "resident", "resident name", "full name", "nome", "proprietario", "condomino", "morador"},
+		"unit":          {"unit", "flat", "apartment", "apt", "fraction", "door", "unidade", "fracao", "andar", "porta"},
+		"contact":       {"contact", "phone", "telephone", "mobile", "phone number", "contacto", "contato", "telefone", "telemovel"},
+		"email":         {"email", "e mail", "mail", "email address"},
+		"move_in_date":  {"move in", "move in date", "moved in", "since", "entrada", "data de entrada"},
+		"move_out_date": {"move out", "move out date", "moved out", "saida", "data de saida"},
+	},
+	"payments": {
+		"id":           {"id"},
+		"resident":     {"resident", "owner", "name", "unit", "flat", "apartment", "fraction", "nome", "proprietario", "condomino", "fracao"},
+		"resident_id":  {"resident id"},
+		"amount":       {"amount", "value", "paid", "amount paid", "total", "valor", "montante", "quantia", "valor pago"},
+		"payment_date": {"date", "payment date", "paid on", "data", "data de pagamento", "data pagamento"},
+		"description":  {"description", "notes", "note", "memo", "concept", "details", "descricao", "observacoes", "notas"},
+		"method":       {"method", "payment method", "metodo", "forma de pagamento", "meio de pagamento"},
+		"reference":    {"reference", "ref", "referencia"},
+	},
+	"expenses": {
+		"id":           {"id"},
+		"amount":       {"amount", "value", "cost", "total", "valor", "montante", "custo"},
+		"expense_date": {"date", "expense date", "data", "data da despesa"},
+		"description":  {"description", "details", "supplier", "notes", "descricao", "fornecedor", "notas"},
+		"category":     {"category", "type", "categoria", "tipo"},
+	},
+}
+
+// xlsxSheetNames are words in sheet names, folded, that auto-detection takes
+// for the entity of the sheet
+var xlsxSheetNames = map[string][]string{
+	"residents": {"owner", "resident", "tenant", "member", "people", "condomino", "proprietario", "morador", "residente"},
+	"payments":  {"payment", "receipt", "income", "dues", "fee", "pagamento", "recebimento", "receita", "quota"},
+	"expenses":  {"expense", "cost", "spending", "bill", "despesa", "custo", "gasto"},
+}
+
+// xlsxMethods are the payment methods spreadsheets write, folded
+var xlsxMethods = map[string]string{
+	"cash": "cash", "numerario": "cash", "dinheiro": "cash",
+	"transfer": "transfer", "bank transfer": "transfer", "wire": "transfer", "transferencia": "transfer", "transferencia bancaria": "transfer",
+	"card": "card", "credit card": "card", "debit card": "card", "cartao": "card", "multibanco": "card", "mb": "card",
+	"check": "check", "cheque": "check",
+}
+
+// xlsxSampleRows is how many rows below the header detection shows
+const xlsxSampleRows = 5
+
+// XLSXMapping tells an .xlsx import which sheets hold which records, and which
+// of their columns hold which fields
+type XLSXMapping struct {
+	Sheets     []XLSXSheetMapping `json:"sheets"`
+	MonthFirst bool               `json:"month_first,omitempty"` // read 01/02/2024 as January 2 rather than February 1
+}
+
+// XLSXSheetMapping maps a sheet to an entity. Sheets not mapped are skipped.
+type XLSXSheetMapping struct {
+	Sheet     string            `json:"sheet"`
+	Entity    string            `json:"entity"`               // residents, payments or expenses
+	HeaderRow int               `json:"header_row,omitempty"` // the first row with values when 0
+	Columns   map[string]string `json:"columns"`              // field by column header; columns left out are skipped
+}
+
+// XLSXSheetInfo is what detection found in a sheet
+type XLSXSheetInfo struct {
+	Name      string     `json:"name"`
+	HeaderRow int        `json:"header_row"`
+	Headers   []string   `json:"headers"`
+	Rows      int        `json:"rows"`   // rows with values below the header
+	Sample    [][]string `json:"sample"` // the first of them, as stored
+}
+
+// XLSXDetection lists the sheets of a workbook with their headers, and the
+// mapping suggested from their names
+type XLSXDetection struct {
+	Sheets  []XLSXSheetInfo `json:"sheets"`
+	Mapping XLSXMapping     `json:"mapping"`
+}
+
+// XLSXImportCounts counts the rows of an entity in an .xlsx import
+type XLSXImportCounts struct {
+	New        int `json:"new"`
+	Updated    int `json:"updated"`    // matching a record, by id or for residents by name and unit, which the non-empty cells overwrite
+	Duplicates int `json:"duplicates"` // payments and expenses already recorded with the same values, skipped
+}
+
+// XLSXImportResult reports an .xlsx import. A dry run also lists the records
+// as they would be written, with the ids new ones would get.
+type XLSXImportResult struct {
+	DryRun    bool                        `json:"dry_run"`
+	Mapping   XLSXMapping                 `json:"mapping"`
+	Counts    map[string]XLSXImportCounts `json:"counts"` // by entity
+	Residents []Resident                  `json:"residents,omitempty"`
+	Payments  []Payment                   `json:"payments,omitempty"`
+	Expenses  []Expense                   `json:"expenses,omitempty"`
+}
+
+// xlsxHeaderKey folds a header or value for matching: lowercase, without
+// accents, and with anything but letters and digits between words
+func xlsxHeaderKey(s string) string {
+	return strings.Join(strings.FieldsFunc(foldText(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}), " ")
+}
+
+// xlsxSheetRef writes a sheet name as cell references do, quoted unless it
+// is a single word
+func xlsxSheetRef(sheet string) string {
+	for _, r := range sheet {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_' {
+			return "'" + strings.ReplaceAll(sheet, "'", "''") + "'"
+		}
+	}
+	return sheet
+}
+
+// xlsxHeaderRow returns the index in sheet.Rows of its header row: the row
+// numbered headerRow, or the first with values when 0
+func xlsxHeaderRow(sheet *Worksheet, headerRow int) (int, bool) {
+	for i, row := range sheet.Rows {
+		if headerRow == 0 || row.Number == headerRow {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// xlsxHeaders returns the headers of a row by column, trimmed
+func xlsxHeaders(row WorksheetRow) []string {
+	headers := make([]string, len(row.Cells))
+	for i, cell := range row.Cells {
+		headers[i] = strings.TrimSpace(cell.Value)
+	}
+	return headers
+}
+
+// detectXLSX lists the sheets of a workbook and suggests a mapping: sheets are
+// mapped by words in their name, or else by the fields their headers match,
+// and columns by their headers
+func detectXLSX(wb *Workbook) XLSXDetection {
+	detection := XLSXDetection{Sheets: []XLSXSheetInfo{}, Mapping: XLSXMapping{Sheets: []XLSXSheetMapping{}}}
+	for i := range wb.Sheets {
+		sheet := &wb.Sheets[i]
+		info := XLSXSheetInfo{Name: sheet.Name, Headers: []string{}, Sample: [][]string{}}
+		header, ok := xlsxHeaderRow(sheet, 0)
+		if !ok {
+			detection.Sheets = append(detection.Sheets, info)
+			continue
+		}
+		info.HeaderRow = sheet.Rows[header].Number
+		info.Headers = xlsxHeaders(sheet.Rows[header])
+		info.Rows = len(sheet.Rows) - header - 1
+		for _, row := range sheet.Rows[header+1 : header+1+min(info.Rows, xlsxSampleRows)] {
+			values := make([]string, len(info.Headers))
+			for c := range values {
+				values[c] = row.Value(c).Value
+			}
+			info.Sample = append(info.Sample, values)
+		}
+		detection.Sheets = append(detection.Sheets, info)
+
+		entity := xlsxSheetEntity(sheet.Name, info.Headers)
+		if entity == "" {
+			continue
+		}
+		detection.Mapping.Sheets = append(detection.Mapping.Sheets, XLSXSheetMapping{
+			Sheet:     sheet.Name,
+			Entity:    entity,
+			HeaderRow: info.HeaderRow,
+			Columns:   xlsxSuggestColumns(entity, info.Headers),
+		})
+	}
+	return detection
+}
+
+// xlsxSheetEntity guesses the entity of a sheet, "" if it holds none
+func xlsxSheetEntity(name string, headers []string) string {
+	key := " " + xlsxHeaderKey(name) + " "
+	for _, entity := range exportEntities {
+		for _, word := range xlsxSheetNames[entity] {
+			// Also plurals, such as "owners" or "despesas"
+			if strings.Contains(key, " "+word+" ") || strings.Contains(key, " "+word+"s ") {
+				return entity
+			}
+		}
+	}
+	payments := xlsxSuggestColumns("payments", headers)
+	mapped := func(columns map[string]string, field string) bool {
+		for _, f := range columns {
+			if f == field {
+				return true
+			}
+		}
+		return false
+	}
+	switch {
+	case mapped(payments, "amount") && mapped(payments, "resident"):
+		return "payments"
+	case mapped(payments, "amount"):
+		return "expenses"
+	case mapped(xlsxSuggestColumns("residents", headers), "unit"):
+		return "residents"
+	}
+	return ""
+}
+
+// xlsxSuggestColumns maps headers to the fields of entity: first those equal
+// to a synonym of a field, then those containing one. Each field and header
+// is mapped at most once.
+func xlsxSuggestColumns(entity string, headers []string) map[string]string {
+	columns := map[string]string{}
+	taken := map[string]bool{}
+	for _, contains := range []bool{false, true} {
+		for _, header := range headers {
+			if _, ok := columns[header]; ok || header == "" {
+				continue
+			}
+			key := xlsxHeaderKey(header)
+			for _, field := range xlsxFields[entity] {
+				if taken[field] {
+					continue
+				}
+				matches := slices.ContainsFunc(xlsxSynonyms[entity][field], func(synonym string) bool {
+					if contains {
+						return strings.Contains(" "+key+" ", " "+synonym+" ")
+					}
+					return key == synonym
+				})
+				if matches {
+					columns[header] = field
+					taken[field] = true
+					break
+				}
+			}
+		}
+	}
+	return columns
+}
+
+// xlsxSheetPlan is a sheet mapping checked against its sheet
+type xlsxSheetPlan struct {
+	sheet   *Worksheet
+	entity  string
+	header  int            // index of the header row in sheet.Rows
+	columns map[string]int // column of each field mapped
+}
+
+// planXLSXSheets checks a mapping against the workbook: sheets, entities,
+// headers and fields must exist, and the fields each entity needs be mapped.
+// The plans are sorted so residents come before the payments naming them.
+func planXLSXSheets(wb *Workbook, mapping XLSXMapping) ([]xlsxSheetPlan, error) {
+	var errs ValidationErrors
+	var plans []xlsxSheetPlan
+	if len(mapping.Sheets) == 0 {
+		errs.Add("sheets", "map at least one sheet")
+	}
+	for i, m := range mapping.Sheets {
+		prefix := fmt.Sprintf("sheets[%d]", i)
+		sheet, ok := wb.Sheet(m.Sheet)
+		if !ok {
+			errs.Add(prefix+".sheet", fmt.Sprintf("%s: no sheet %q in the workbook", prefix, m.Sheet))
+			continue
+		}
+		if _, ok := xlsxFields[m.Entity]; !ok {
+			errs.Add(prefix+".entity", prefix+": entity must be residents, payments or expenses")
+			continue
+		}
+		header, ok := xlsxHeaderRow(sheet, m.HeaderRow)
+		if !ok {
+			errs.Add(prefix+".header_row", fmt.Sprintf("%s: sheet %q has no row %d with values", prefix, m.Sheet, m.HeaderRow))
+			continue
+		}
+		plan := xlsxSheetPlan{sheet: sheet, entity: m.Entity, header: header, columns: map[string]int{}}
+		headers := xlsxHeaders(sheet.Rows[header])
+		for _, name := range slices.Sorted(maps.Keys(m.Columns)) {
+			field := m.Columns[name]
+			column := slices.IndexFunc(headers, func(h string) bool { return strings.EqualFold(h, strings.TrimSpace(name)) })
+			switch {
+			case column < 0:
+				errs.Add(prefix+".columns", fmt.Sprintf("%s: no column %q in sheet %q", prefix, name, m.Sheet))
+			case !slices.Contains(xlsxFields[m.Entity], field):
+				errs.Add(prefix+".columns", fmt.Sprintf("%s: %s have no field %q, only %s", prefix, m.Entity, field, strings.Join(xlsxFields[m.Entity], ", ")))
+			default:
+				if _, ok := plan.columns[field]; ok {
+					errs.Add(prefix+".columns", fmt.Sprintf("%s: %s is mapped twice", prefix, field))
+				}
+				plan.columns[field] = column
+			}
+		}
+		for _, field := range xlsxRequired[m.Entity] {
+			if _, ok := plan.columns[field]; !ok {
+				errs.Add(prefix+".columns", fmt.Sprintf("%s: %s need a column for %s", prefix, m.Entity, field))
+			}
+		}
+		_, resident := plan.columns["resident"]
+		_, residentID := plan.columns["resident_id"]
+		if m.Entity == "payments" && !resident && !residentID {
+			errs.Add(prefix+".columns", prefix+": payments need a column for resident or resident_id")
+		}
+		plans = append(plans, plan)
+	}
+	if err := errs.Err(); err != nil {
+		return nil, err
+	}
+	slices.SortStableFunc(plans, func(a, b xlsxSheetPlan) int {
+		return slices.Index(exportEntities, a.entity) - slices.Index(exportEntities, b.entity)
+	})
+	return plans, nil
+}
+
+// xlsxCells reads the cells of a row as the fields they are mapped to,
+// adding an error naming the cell for each that can't be
+type xlsxCells struct {
+	plan       xlsxSheetPlan
+	row        WorksheetRow
+	date1904   bool
+	monthFirst bool
+	errs       *ValidationErrors
+}
+
+// position names a field of the row in errors: by its cell, or by the row
+// when it has no column
+func (c xlsxCells) position(field string) string {
+	column, ok := c.plan.columns[field]
+	if field == "resident_id" && !ok {
+		column, ok = c.plan.columns["resident"]
+	}
+	if !ok {
+		return fmt.Sprintf("%s row %d", xlsxSheetRef(c.plan.sheet.Name), c.row.Number)
+	}
+	return fmt.Sprintf("%s!%s%d", xlsxSheetRef(c.plan.sheet.Name), xlsxColumnName(column), c.row.Number)
+}
+
+func (c xlsxCells) fail(field, message string) {
+	position := c.position(field)
+	c.errs.Add(position, position+": "+message)
+}
+
+// cell returns the cell of field and whether it has a value
+func (c xlsxCells) cell(field string) (WorksheetCell, bool) {
+	column, ok := c.plan.columns[field]
+	if !ok {
+		return WorksheetCell{}, false
+	}
+	cell := c.row.Value(column)
+	cell.Value = strings.TrimSpace(cell.Value)
+	return cell, cell.Value != ""
+}
+
+// empty reports whether none of the mapped cells have a value
+func (c xlsxCells) empty() bool {
+	for field := range c.plan.columns {
+		if _, ok := c.cell(field); ok {
+			return false
+		}
+	}
+	return true
+}
+
+// text reads a text field. Numbers are written without exponent, so a phone
+// number stored as one reads as typed.
+func (c xlsxCells) text(field string) string {
+	cell, _ := c.cell(field)
+	if cell.Number {
+		if n, err := strconv.ParseFloat(cell.Value, 64); err == nil {
+			return strconv.FormatFloat(n, 'f', -1, 64)
+		}
+	}
+	return cell.Value
+}
+
+// id reads a positive whole number, 0 when empty
+func (c xlsxCells) id(field string) int {
+	cell, ok := c.cell(field)
+	if !ok {
+		return 0
+	}
+	n, err := strconv.ParseFloat(cell.Value, 64)
+	if err != nil || n < 1 || n != math.Trunc(n) || n > math.MaxInt32 {
+		c.fail(field, fmt.Sprintf("%q is not a positive whole number", cell.Value))
+		return 0
+	}
+	return int(n)
+}
+
+// amount reads an amount, stored as a number or typed with a currency
+func (c xlsxCells) amount(field string) float64 {
+	cell, ok := c.cell(field)
+	if !ok {
+		return 0
+	}
+	var amount float64
+	var err error
+	if cell.Number {
+		amount, err = strconv.ParseFloat(cell.Value, 64)
+	} else {
+		amount, err = parseSpreadsheetAmount(cell.Value)
+	}
+	if err != nil {
+		c.fail(field, fmt.Sprintf("%q is not an amount", cell.Value))
+		return 0
+	}
+	return roundCents(amount)
+}
+
+// date reads a date, stored as a serial number or typed, as YYYY-MM-DD
+func (c xlsxCells) date(field string) string {
+	cell, ok := c.cell(field)
+	if !ok {
+		return ""
+	}
+	var date string
+	var err error
+	if serial, numErr := strconv.ParseFloat(cell.Value, 64); numErr == nil {
+		date, err = xlsxSerialDate(serial, c.date1904)
+	} else {
+		date, err = parseSpreadsheetDate(cell.Value, c.monthFirst)
+	}
+	if err != nil {
+		c.fail(field, fmt.Sprintf("%q is not a date", cell.Value))
+		return ""
+	}
+	return date
+}
+
+// method reads a payment method, in English or Portuguese
+func (c xlsxCells) method(field string) string {
+	cell, ok := c.cell(field)
+	if !ok {
+		return ""
+	}
+	method, ok := xlsxMethods[xlsxHeaderKey(cell.Value)]
+	if !ok {
+		c.fail(field, fmt.Sprintf("method must be one of cash, transfer, card or check, got %q", cell.Value))
+	}
+	return method
+}
+
+// xlsxMerge sets *into to value when the cell of field has one, so empty cells
+// keep the values records have
+func xlsxMerge[T any](c xlsxCells, field string, into *T, value T) {
+	if _, ok := c.cell(field); ok {
+		*into = value
+	}
+}
+
+// validate adds the errors of a record validated by validate, naming the cells
+// of the fields that failed
+func (c xlsxCells) validate(err error) {
+	var fields ValidationErrors
+	if errors.As(err, &fields) {
+		for _, f := range fields {
+			c.fail(strings.SplitN(f.Field, ".", 2)[0], f.Message)
+		}
+	}
+}
+
+// parseSpreadsheetAmount reads an amount as typed in a spreadsheet: with a
+// currency symbol or code, thousands separators and either decimal separator,
+// and negative with a minus or in parentheses. With a single separator, one
+// followed by exactly three digits is taken for a thousands separator unless
+// the whole part is 0, so 1,500 is 1500 and 0,500 or 1,50 are decimals.
+func parseSpreadsheetAmount(value string) (float64, error) {
+	s := strings.TrimSpace(value)
+	negative := false
+	if strings.HasPrefix(s, "(") && strings.HasSuffix(s, ")") {
+		negative, s = true, s[1:len(s)-1]
+	}
+	var digits strings.Builder
+	for _, r := range s {
+		switch {
+		case r >= '0' && r <= '9', r == '.', r == ',':
+			digits.WriteRune(r)
+		case r == '-' || r == '−':
+			negative = true
+		case unicode.IsSpace(r) || r == '\'' || r == '’':
+			// thousands separators
+		case unicode.IsLetter(r) || unicode.Is(unicode.Sc, r):
+			// currency symbols and codes, such as € or EUR
+		default:
+			return 0, fmt.Errorf("invalid amount %q", value)
+		}
+	}
+	n := digits.String()
+	if strings.Trim(n, ".,") == "" {
+		return 0, fmt.Errorf("invalid amount %q", value)
+	}
+
+	decimal := ""
+	lastDot, lastComma := strings.LastIndex(n, "."), strings.LastIndex(n, ",")
+	switch {
+	case lastDot >= 0 && lastComma >= 0:
+		decimal = "."
+		if lastComma > lastDot {
+			decimal = ","
+		}
+	case lastDot >= 0 || lastComma >= 0:
+		separator, last := ".", lastDot
+		if lastComma >= 0 {
+			separator, last = ",", lastComma
+		}
+		whole := strings.TrimLeft(n[:last], "0")
+		if strings.Count(n, separator) == 1 && (len(n)-last-1 != 3 || whole == "") {
+			decimal = separator
+		}
+	}
+	var plain strings.Builder
+	for i, r := range n {
+		switch {
+		case decimal != "" && i == strings.LastIndex(n, decimal):
+			plain.WriteByte('.')
+		case r >= '0' && r <= '9':
+			plain.WriteRune(r)
+		}
+	}
+	amount, err := strconv.ParseFloat(plain.String(), 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid amount %q", value)
+	}
+	if negative {
+		amount = -amount
+	}
+	return amount, nil
+}
+
+// spreadsheetDateLayouts are the layouts with month names dates are tried in,
+// after the numeric ones
+var spreadsheetDateLayouts = []string{"2 Jan 2006", "2 January 2006", "Jan 2, 2006", "January 2, 2006", "2-Jan-2006", "2-Jan-06"}
+
+// parseSpreadsheetDate reads a date typed in a spreadsheet, as YYYY-MM-DD:
+// year first (2024-01-31, 2024/01/31), day first (31/01/2024, 31-01-24,
+// 31.01.2024) unless monthFirst, or with an English month name. A time after
+// the date is ignored. Two-digit years are 2000 to 2029 and 1930 to 1999, as
+// Excel reads them.
+func parseSpreadsheetDate(value string, monthFirst bool) (string, error) {
+	s := strings.TrimSpace(value)
+	if i := strings.IndexAny(s, " T"); i >= 8 && strings.Count(s[:i], "/")+strings.Count(s[:i], "-")+strings.Count(s[:i], ".") == 2 {
+		s = s[:i]
+	}
+	parts := strings.FieldsFunc(s, func(r rune) bool { return r == '/' || r == '-' || r == '.' })
+	numeric := len(parts) == 3
+	numbers := make([]int, len(parts))
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			numeric = false
+			break
+		}
+		numbers[i] = n
+	}
+	if numeric {
+		var year, month, day int
+		switch {
+		case len(parts[0]) == 4:
+			year, month, day = numbers[0], numbers[1], numbers[2]
+		case monthFirst:
+			month, day, year = numbers[0], numbers[1], numbers[2]
+		default:
+			day, month, year = numbers[0], numbers[1], numbers[2]
+		}
+		if len(parts[2]) == 2 && len(parts[0]) != 4 {
+			year += 1900
+			if year < 1930 {
+				year += 100
+			}
+		}
+		date := time.Date(year, time.Month(month), day, 0, 0, 0, 0, time.UTC)
+		if year >= 1000 && year <= 9999 && date.Year() == year && date.Month() == time.Month(month) && date.Day() == day {
+			return date.Format("2006-01-02"), nil
+		}
+		return "", fmt.Errorf("invalid date %q", value)
+	}
+	for _, layout := range spreadsheetDateLayouts {
+		if date, err := time.Parse(layout, s); err == nil {
+			return date.Format("2006-01-02"), nil
+		}
+	}
+	return "", fmt.Errorf("invalid date %q", value)
+}
+
+// xlsxResidents finds the residents payments name, among those in the
+// database and those being imported
+type xlsxResidents struct {
+	all  []*Resident
+	byID map[int]*Resident
+}
+
+func (rs *xlsxResidents) add(resident *Resident) {
+	rs.all = append(rs.all, resident)
+	rs.byID[resident.ID] = resident
+}
+
+// match finds a resident by name and unit, as the same resident in another
+// spreadsheet row
+func (rs *xlsxResidents) match(name, unit string) *Resident {
+	for _, resident := range rs.all {
+		if foldText(strings.TrimSpace(resident.Name)) == foldText(name) && foldText(strings.TrimSpace(resident.Unit)) == foldText(unit) {
+			return resident
+		}
+	}
+	return nil
+}
+
+// find finds the resident a payment names by unit or else by name. When
+// several match, those who haven't moved out are preferred.
+func (rs *xlsxResidents) find(value string) (*Resident, error) {
+	key := foldText(strings.TrimSpace(value))
+	for _, field := range []func(*Resident) string{
+		func(r *Resident) string { return r.Unit },
+		func(r *Resident) string { return r.Name },
+	} {
+		var found, current []*Resident
+		for _, resident := range rs.all {
+			if foldText(strings.TrimSpace(field(resident))) == key {
+				found = append(found, resident)
+				if resident.MoveOutDate == "" {
+					current = append(current, resident)
+				}
+			}
+		}
+		if len(current) == 1 || (len(current) == 0 && len(found) == 1) {
+			return append(current, found...)[0], nil
+		}
+		if len(found) > 1 {
+			return nil, fmt.Errorf("%q matches %d residents, map resident_id instead", value, len(found))
+		}
+	}
+	return nil, fmt.Errorf("no resident with unit or name %q", value)
+}
+
+// planXLSXImport reads the records of the sheets into an export to merge,
+// resolving residents and ids against the database. New records get ids after
+// the largest, and payments and expenses equal to recorded ones are skipped.
+// Errors name the cells, e.g. 'Payments 2023'!C7.
+func planXLSXImport(q querier, wb *Workbook, mapping XLSXMapping, plans []xlsxSheetPlan) (ExportData, XLSXImportResult, error) {
+	var data ExportData
+	result := XLSXImportResult{Mapping: mapping, Counts: map[string]XLSXImportCounts{}}
+	for _, entity := range exportEntities {
+		result.Counts[entity] = XLSXImportCounts{}
+	}
+
+	residents := &xlsxResidents{byID: map[int]*Resident{}}
+	rows, err := q.Query("SELECT " + residentColumns + " FROM residents ORDER BY id")
+	if err != nil {
+		return data, result, err
+	}
+	for rows.Next() {
+		resident, err := scanResidentRow(rows)
+		if err != nil {
+			rows.Close()
+			return data, result, err
+		}
+		residents.add(&resident)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return data, result, err
+	}
+	payments := map[int]Payment{}
+	paymentKeys := map[string]int{}
+	paymentKey := func(p Payment) string {
+		return fmt.Sprintf("%d|%s|%.2f|%s", p.ResidentID, normalizeDate(p.PaymentDate), p.Amount, foldText(strings.TrimSpace(p.Description)))
+	}
+	rows, err = q.Query("SELECT id, resident_id, amount, description, payment_date, method, status, reference, bank_reference, cheque_number, cheque_bank, cheque_status, cheque_status_date, created_at, updated_at FROM payments")
+	if err != nil {
+		return data, result, err
+	}
+	for rows.Next() {
+		item, err := scanPayment(rows)
+		if err != nil {
+			rows.Close()
+			return data, result, err
+		}
+		p := item.(Payment)
+		payments[p.ID] = p
+		paymentKeys[paymentKey(p)]++
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return data, result, err
+	}
+	expenses := map[int]Expense{}
+	expenseKeys := map[string]int{}
+	expenseKey := func(e Expense) string {
+		return fmt.Sprintf("%s|%.2f|%s|%s", normalizeDate(e.ExpenseDate), e.Amount, foldText(strings.TrimSpace(e.Description)), foldText(strings.TrimSpace(e.Category)))
+	}
+	rows, err = q.Query("SELECT " + expenseColumns + " FROM expenses")
+	if err != nil {
+		return data, result, err
+	}
+	for rows.Next() {
+		e, err := scanExpenseRow(rows)
+		if err != nil {
+			rows.Close()
+			return data, result, err
+		}
+		expenses[e.ID] = e
+		expenseKeys[expenseKey(e)]++
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return data, result, err
+	}
+
+	var nextResident, nextPayment, nextExpense int
+	err = q.QueryRow(`SELECT (SELECT COALESCE(MAX(id), 0) FROM residents), (SELECT COALESCE(MAX(id), 0) FROM payments),
+		(SELECT COALESCE(MAX(id), 0) FROM expenses)`).Scan(&nextResident, &nextPayment, &nextExpense)
+	if err != nil {
+		return data, result, err
+	}
+
+	var errs ValidationErrors
+	var imported []*Resident // residents to write, each once
+	for _, plan := range plans {
+		counts := result.Counts[plan.entity]
+		for _, row := range plan.sheet.Rows[plan.header+1:] {
+			cells := xlsxCells{plan: plan, row: row, date1904: wb.Date1904, monthFirst: mapping.MonthFirst, errs: &errs}
+			if cells.empty() {
+				continue
+			}
+			before := len(errs)
+			switch plan.entity {
+			case "residents":
+				id := cells.id("id")
+				name, unit := cells.text("name"), cells.text("unit")
+				contact, email := cells.text("contact"), cells.text("email")
+				moveIn, moveOut := cells.date("move_in_date"), cells.date("move_out_date")
+				if len(errs) > before {
+					continue
+				}
+				resident := residents.byID[id]
+				if resident == nil && id == 0 {
+					resident = residents.match(name, unit)
+				}
+				if resident == nil {
+					if id == 0 {
+						id = nextResident + 1
+					}
+					nextResident = max(nextResident, id)
+					resident = &Resident{ID: id}
+					residents.add(resident)
+					counts.New++
+				} else if !slices.Contains(imported, resident) {
+					counts.Updated++
+				}
+				if !slices.Contains(imported, resident) {
+					resident.Custom = nil // custom values are left alone
+					imported = append(imported, resident)
+				}
+				xlsxMerge(cells, "name", &resident.Name, name)
+				xlsxMerge(cells, "unit", &resident.Unit, unit)
+				xlsxMerge(cells, "contact", &resident.Contact, contact)
+				xlsxMerge(cells, "email", &resident.Email, email)
+				xlsxMerge(cells, "move_in_date", &resident.MoveInDate, moveIn)
+				xlsxMerge(cells, "move_out_date", &resident.MoveOutDate, moveOut)
+				cells.validate(validateResident(*resident))
+
+			case "payments":
+				values := Payment{
+					ID:          cells.id("id"),
+					ResidentID:  cells.id("resident_id"),
+					Amount:      cells.amount("amount"),
+					PaymentDate: cells.date("payment_date"),
+					Description: cells.text("description"),
+					Method:      cells.method("method"),
+					Reference:   cells.text("reference"),
+				}
+				if name, ok := cells.cell("resident"); ok && values.ResidentID == 0 {
+					resident, err := residents.find(name.Value)
+					if err != nil {
+						cells.fail("resident", err.Error())
+					} else {
+						values.ResidentID = resident.ID
+					}
+				} else if values.ResidentID != 0 && residents.byID[values.ResidentID] == nil {
+					cells.fail("resident_id", fmt.Sprintf("no resident with id %d", values.ResidentID))
+				}
+				if len(errs) > before {
+					continue
+				}
+				payment, update := payments[values.ID]
+				if !update {
+					payment = Payment{ID: values.ID, Status: PaymentStatusConfirmed}
+				}
+				if values.ResidentID != 0 {
+					payment.ResidentID = values.ResidentID
+				}
+				xlsxMerge(cells, "amount", &payment.Amount, values.Amount)
+				xlsxMerge(cells, "payment_date", &payment.PaymentDate, values.PaymentDate)
+				xlsxMerge(cells, "description", &payment.Description, values.Description)
+				xlsxMerge(cells, "method", &payment.Method, values.Method)
+				xlsxMerge(cells, "reference", &payment.Reference, values.Reference)
+				if payment.Method == "check" && payment.ChequeStatus == "" {
+					// Cheques in old spreadsheets have long cleared
+					payment.ChequeStatus, payment.ChequeStatusDate = ChequeCleared, payment.PaymentDate
+				}
+				if payment.Method != "check" {
+					payment.ChequeNumber, payment.ChequeBank, payment.ChequeStatus, payment.ChequeStatusDate = "", "", "", ""
+				}
+				cells.validate(validatePayment(payment))
+				switch {
+				case update:
+					counts.Updated++
+				case paymentKeys[paymentKey(payment)] > 0:
+					paymentKeys[paymentKey(payment)]--
+					counts.Duplicates++
+					continue
+				default:
+					if payment.ID == 0 {
+						payment.ID = nextPayment + 1
+					}
+					nextPayment = max(nextPayment, payment.ID)
+					counts.New++
+				}
+				data.Payments = append(data.Payments, payment)
+
+			case "expenses":
+				values := Expense{
+					ID:          cells.id("id"),
+					Amount:      cells.amount("amount"),
+					ExpenseDate: cells.date("expense_date"),
+					Description: cells.text("description"),
+					Category:    cells.text("category"),
+				}
+				if len(errs) > before {
+					continue
+				}
+				expense, update := expenses[values.ID]
+				if !update {
+					expense = Expense{ID: values.ID}
+				}
+				if _, ok := cells.cell("amount"); ok && values.Amount != expense.Amount {
+					// A new amount in the base currency, without the tax
+					// and currency of the old one
+					expense.Currency, expense.OriginalAmount, expense.ExchangeRate = "", 0, 0
+					expense.TaxRate, expense.TaxAmount = 0, 0
+				}
+				xlsxMerge(cells, "amount", &expense.Amount, values.Amount)
+				xlsxMerge(cells, "expense_date", &expense.ExpenseDate, values.ExpenseDate)
+				xlsxMerge(cells, "description", &expense.Description, values.Description)
+				xlsxMerge(cells, "category", &expense.Category, values.Category)
+				cells.validate(validateExpense(expense))
+				switch {
+				case update:
+					counts.Updated++
+				case expenseKeys[expenseKey(expense)] > 0:
+					expenseKeys[expenseKey(expense)]--
+					counts.Duplicates++
+					continue
+				default:
+					if expense.ID == 0 {
+						expense.ID = nextExpense + 1
+					}
+					nextExpense = max(nextExpense, expense.ID)
+					counts.New++
+				}
+				data.Expenses = append(data.Expenses, expense)
+			}
+		}
+		result.Counts[plan.entity] = counts
+	}
+	for _, resident := range imported {
+		data.Residents = append(data.Residents, *resident)
+	}
+	if err := errs.Err(); err != nil {
+		return data, result, err
+	}
+	return data, result, nil
+}
+
+// importXLSX plans the import of a workbook and, unless dryRun, merges it in
+// one transaction, queueing the receipts of the new payments. It fails with
+// errBusy while an import or maintenance run is in progress.
+func importXLSX(db *sql.DB, wb *Workbook, mapping XLSXMapping, dryRun bool, rules paymentRules) (XLSXImportResult, error) {
+	plans, err := planXLSXSheets(wb, mapping)
+	if err != nil {
+		return XLSXImportResult{}, err
+	}
+
+	if !dbLock(db).TryLock() {
+		return XLSXImportResult{}, errBusy
+	}
+	defer dbLock(db).Unlock()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return XLSXImportResult{}, err
+	}
+	defer tx.Rollback()
+
+	data, result, err := planXLSXImport(tx, wb, mapping, plans)
+	if err != nil {
+		return result, err
+	}
+	result.DryRun = dryRun
+	if dryRun {
+		result.Residents, result.Payments, result.Expenses = data.Residents, data.Payments, data.Expenses
+		return result, nil
+	}
+	var created []int
+	for _, payment := range data.Payments {
+		var exists bool
+		if err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM payments WHERE id = ?)", payment.ID).Scan(&exists); err != nil {
+			return result, err
+		}
+		if !exists {
+			created = append(created, payment.ID)
+		}
+	}
+	if err := importTx(tx, data, ImportModeMerge, rules, nil); err != nil {
+		return result, err
+	}
+	if err := queueReceipts(tx, created...); err != nil {
+		return result, err
+	}
+	return result, tx.Commit()
+}
+
+// readXLSXForm reads the workbook uploaded as the workbook form field,
+// answering with an error if it can't
+func readXLSXForm(w http.ResponseWriter, r *http.Request) (*Workbook, bool) {
+	if err := r.ParseMultipartForm(10 << 20); err != nil { // larger files are buffered on disk
+		if payloadErrorStatus(err) == http.StatusRequestEntityTooLarge {
+			respondWithError(w, http.StatusRequestEntityTooLarge, "Workbook is too large")
+			return nil, false
+		}
+		respondWithError(w, http.StatusBadRequest, "Unable to parse form")
+		return nil, false
+	}
+	file, _, err := r.FormFile("workbook")
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Error retrieving workbook")
+		return nil, false
+	}
+	defer file.Close()
+	content, err := io.ReadAll(file)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error reading workbook")
+		return nil, false
+	}
+	wb, err := readXLSX(content)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid workbook: "+err.Error())
+		return nil, false
+	}
+	return wb, true
+}
+
+// Upload a workbook (multipart field workbook) to get its sheets, their
+// headers and first rows, and a suggested mapping
+func detectXLSXImport() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		wb, ok := readXLSXForm(w, r)
+		if !ok {
+			return
+		}
+		respondWithJSON(w, http.StatusOK, detectXLSX(wb))
+	}
+}
+
+// Import a workbook (multipart field workbook) as mapped by the mapping form
+// field, or the suggested mapping without one. Records are merged: new ones
+// are added and those matching recorded ones updated. It is a dry run, which
+// lists the records, unless dry_run=false.
+func postXLSXImport(db *sql.DB, receipts *ReceiptQueue, changes *ChangeBroker, rules paymentRules) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		wb, ok := readXLSXForm(w, r)
+		if !ok {
+			return
+		}
+		dryRun := true
+		if value := r.FormValue("dry_run"); value != "" {
+			var err error
+			if dryRun, err = strconv.ParseBool(value); err != nil {
+				respondWithError(w, http.StatusBadRequest, "Invalid dry_run, must be true or false")
+				return
+			}
+		}
+		mapping := detectXLSX(wb).Mapping
+		if value := r.FormValue("mapping"); value != "" {
+			mapping = XLSXMapping{}
+			if err := decodeJSONBytes([]byte(value), &mapping, optionsOf(r).laxJSON); err != nil {
+				respondWithError(w, http.StatusBadRequest, "Invalid mapping: "+err.Error())
+				return
+			}
+		}
+
+		result, err := importXLSX(db, wb, mapping, dryRun, rules)
+		var fields ValidationErrors
+		switch {
+		case errors.As(err, &fields):
+			respondWithValidationError(w, err)
+			return
+		case errors.Is(err, errBusy):
+			respondWithError(w, http.StatusConflict, err.Error())
+			return
+		case err != nil:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if !dryRun {
+			for _, kind := range changeTypes {
+				changes.Publish(Change{Type: kind, Action: ChangeImported})
+			}
+			receipts.Wake()
+		}
+		respondWithJSON(w, http.StatusOK, result)
+	}
+}